@@ -38,6 +38,42 @@ Create the name of the pod security policy role(binding) to use
 {{- printf "%s-psp" (include "azp-agent-autoscaler.fullname" . | trunc 59) -}}
 {{- end -}}
 
+{{/*
+Create the name of the cluster-wide RBAC resources, which must be unique across namespaces
+*/}}
+{{- define "azp-agent-autoscaler.clusterrbacname" -}}
+{{- printf "%s-%s" .Release.Namespace (include "azp-agent-autoscaler.fullname" .) | trunc 63 | trimSuffix "-" -}}
+{{- end -}}
+
+{{/*
+Create the name of the ConfigMap the scaling state is persisted to
+*/}}
+{{- define "azp-agent-autoscaler.state.configMapName" -}}
+{{- default (printf "%s-state" (include "azp-agent-autoscaler.fullname" . | trunc 57)) .Values.state.configMapName -}}
+{{- end -}}
+
+{{/*
+Create the name of the ConfigMap the decision history is persisted to
+*/}}
+{{- define "azp-agent-autoscaler.history.configMapName" -}}
+{{- default (printf "%s-history" (include "azp-agent-autoscaler.fullname" . | trunc 55)) .Values.history.configMapName -}}
+{{- end -}}
+
+{{/*
+Create the names of the ConfigMaps of a ConfigMap name, one per shard if the autoscaler is sharded, as a quoted list
+*/}}
+{{- define "azp-agent-autoscaler.shardedConfigMapNames" -}}
+{{- $names := list -}}
+{{- if gt (int .root.Values.sharding.shards) 1 -}}
+{{- range $shard := until (int .root.Values.sharding.shards) -}}
+{{- $names = append $names (printf "%s-%d" $.name $shard | quote) -}}
+{{- end -}}
+{{- else -}}
+{{- $names = append $names (.name | quote) -}}
+{{- end -}}
+{{- join ", " $names -}}
+{{- end -}}
+
 {{/*
 Create chart name and version as used by the chart label.
 */}}
@@ -52,6 +88,13 @@ Create the name of the service account to use
 {{ .Values.serviceAccount.create | ternary (include "azp-agent-autoscaler.fullname" .) (.Values.serviceAccount.name | default "default") }}
 {{- end -}}
 
+{{/*
+The name of the PriorityClass of the balloon pods
+*/}}
+{{- define "azp-agent-autoscaler.balloon.priorityClassName" -}}
+{{- .Values.balloon.priorityClass.name | default (printf "%s-balloon" (include "azp-agent-autoscaler.fullname" .)) -}}
+{{- end -}}
+
 {{/*
 Common labels
 */}}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+)
+
+// The statuses of the doctor checks and test-policy scenarios
+const (
+	checkPass = autoscaler.CheckPass
+	checkFail = autoscaler.CheckFail
+	checkSkip = autoscaler.CheckSkip
+)
+
+// checkResult is the result of a doctor check or a test-policy scenario
+type checkResult = autoscaler.Check
+
+// doctor runs every step of the autoscaler's startup and first iteration as separate checks, without scaling, and
+// prints a pass/fail report, so a setup can be troubleshot in one run instead of one error at a time. It exits with the
+// exit code of the first failed check.
+func doctor(args args.Args) {
+	report := autoscaler.Doctor(args)
+
+	r := result{ExitCode: exitOK}
+	if report.Err != nil {
+		r = errorResult(report.Err)
+	}
+	r.Checks = report.Checks
+	if isText(args.Output) {
+		printDoctorReport(report.Checks)
+		// The failed checks are already in the report
+		r.Error = ""
+	}
+	exitWith(args.Output, r)
+}
+
+// printDoctorReport prints the result of each doctor check
+func printDoctorReport(checks []checkResult) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	failed := 0
+	for _, check := range checks {
+		if check.Status == checkFail {
+			failed++
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", map[string]string{checkPass: "PASS", checkFail: "FAIL", checkSkip: "SKIP"}[check.Status], check.Name, check.Detail)
+	}
+	writer.Flush()
+	if failed > 0 {
+		fmt.Printf("\n%d of %d checks failed\n", failed, len(checks))
+	} else {
+		fmt.Printf("\nAll %d checks passed\n", len(checks))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// explain prints how the desired replicas of each workload are decided, from its inputs to the limits applied, then exits
+func explain(args args.Args) {
+	backend, k8sClient, targets, err := autoscaler.Initialize(&args)
+	if err != nil {
+		exitWith(args.Output, errorResult(err))
+	}
+	// The decisions are explained from the persisted state of the autoscaler, ex: its scale down delay and drains
+	if args.State.ConfigMapName != "" {
+		if err := scaling.LoadState(scaling.StateStore(k8sClient.Sync(), args)); err != nil {
+			exitWith(args.Output, errorResult(err))
+		}
+	}
+
+	var explanations []scaling.Explanation
+	for i, target := range targets {
+		targetArgs := target.ArgsOr(args)
+		decision, err := scaling.Preview(target.BackendOr(backend), target.AgentPoolID, k8sClient, target.Workload, targetArgs)
+		if err != nil {
+			r := errorResult(fmt.Errorf("Error planning the scaling of %s: %w", target.Workload.FriendlyName, err))
+			r.Explanations = explanations
+			exitWith(args.Output, r)
+		}
+		explanation := scaling.Explain(decision, target.AgentPoolID, target.Workload, targetArgs, nil)
+		explanations = append(explanations, explanation)
+
+		if isText(args.Output) {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Print(explanation.String())
+		}
+	}
+	exitWith(args.Output, result{ExitCode: exitOK, Explanations: explanations})
+}
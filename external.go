@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/keda"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/listener"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/metricsadapter"
+)
+
+// serveExternal serves the KEDA external scaler and the external metrics adapter until the process is killed.
+// KEDA or a HorizontalPodAutoscaler scales the agents, so the autoscaler only calls Azure Devops when they request
+// the metrics of an agent pool.
+func serveExternal(args args.Args) {
+	backend, err := autoscaler.MakeBackend(args, nil)
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+
+	var scaler *keda.Scaler
+	if args.KEDA.Port != 0 {
+		scaler = keda.NewScaler(backend, args)
+		go func() {
+			logger.Infof("Serving the KEDA external scaler on port %d", args.KEDA.Port)
+			handler := listener.Authenticate(scaler.Handler(), "", args.TLS.ClientCAFile != "")
+			if err := listener.ListenAndServe("KEDA external scaler", args.KEDA.Port, handler, args.TLS); err != nil {
+				logger.Panicf("Error serving the KEDA external scaler: %s", err.Error())
+			}
+		}()
+	}
+	var adapter *metricsadapter.Adapter
+	if args.MetricsAdapter.Port != 0 {
+		adapter = metricsadapter.NewAdapter(backend, args)
+		go serveMetricsAdapter(args.MetricsAdapter, adapter)
+	}
+	health.SetReady()
+
+	for reloaded := range watchConfig(args.ConfigFile) {
+		reloadedBackend, _, err := autoscaler.Reload(args, &reloaded, backend, nil)
+		if err != nil {
+			logger.Errorf("Error applying the reloaded config, the current config is kept: %s", err.Error())
+			continue
+		}
+		args, backend = reloaded, reloadedBackend
+		if scaler != nil {
+			scaler.Set(backend, args)
+		}
+		if adapter != nil {
+			adapter.Set(backend, args)
+		}
+		logger.Info("Reloaded the config")
+	}
+	select {}
+}
+
+// serveMetricsAdapter serves the external metrics API over TLS, as the Kubernetes API aggregator only proxies to HTTPS
+func serveMetricsAdapter(adapterArgs args.MetricsAdapterArgs, adapter *metricsadapter.Adapter) {
+	tlsConfig, err := metricsadapter.TLSConfig(adapterArgs)
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", adapterArgs.Port),
+		Handler:   adapter.Handler(),
+		TLSConfig: tlsConfig,
+	}
+	logger.Infof("Serving the external metrics API on port %d", adapterArgs.Port)
+	// The certificate is loaded by the TLS config
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		logger.Panicf("Error serving the external metrics API: %s", err.Error())
+	}
+}
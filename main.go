@@ -1,119 +1,286 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/admin"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/aks"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/appinsights"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
-	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/cloudevents"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
-	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/listener"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/notify"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/tracing"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/version"
 )
 
-const poolNameEnvVar = "AZP_POOL"
+var logger = logging.Component("main")
+
+const (
+	// exitFlushTimeout is how long to wait for notifications and telemetry to be sent before exiting
+	exitFlushTimeout = 30 * time.Second
+)
 
 func main() {
 	// Parse arguments
 	flag.Parse()
 
+	// Subcommands are the first positional argument, and can be followed by more flags
+	subcommand := flag.Arg(0)
+	if subcommand != "" {
+		if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	// These subcommands exit without autoscaling
+	switch subcommand {
+	case "version":
+		printVersion()
+		return
+	case "validate-config":
+		validateConfig()
+		return
+	case "migrate-config":
+		migrateConfig()
+		return
+	case "test-policy":
+		testPolicy()
+		return
+	case "replay":
+		replay()
+		return
+	}
+
+	if err := args.LoadConfig(); err != nil {
+		exitWithConfigError(err)
+	}
 	if err := args.ValidateArgs(); err != nil {
-		panic(err.Error())
+		exitWithConfigError(err)
 	}
+	configSummary := args.ConfigSummary()
 	args := args.ArgsFromFlags()
 
-	logging.Logger.SetLevel(args.Logging.Level)
+	logging.Configure(args.Logging.Format, args.Logging.Level, args.Logging.ComponentLevels)
+	logging.ConfigureSampling(args.Logging.SampleFirst, args.Logging.SampleWindow)
+	if args.Logging.File != "" {
+		if err := logging.SetOutputFile(args.Logging.File); err != nil {
+			logger.Panicf("Error opening the log file %s: %s", args.Logging.File, err.Error())
+		}
+	}
+	// The version and effective config of a misbehaving instance are the first thing support needs
+	logger.Infof("Starting azp-agent-autoscaler %s", version.Get())
+	logger.Infof("Effective config: %s", strings.Join(configSummary, " "))
+	if args.Logging.AuditLog != "" {
+		if err := logging.InitAuditLogger(args.Logging.AuditLog); err != nil {
+			logger.Panicf("Error opening the audit log %s: %s", args.Logging.AuditLog, err.Error())
+		}
+	}
 
-	// Initialize Azure Devops client
-	azdClient := azuredevops.MakeClient(args.AZD.URL, args.AZD.Token)
-	k8sClient, err := kubernetes.MakeClient()
-	if err != nil {
-		panic(err.Error())
+	if args.Tracing.OTLPEndpoint != "" {
+		tracing.Init(args.Tracing.OTLPEndpoint, args.Tracing.OTLPHeaders)
+	}
+
+	if args.AzureMonitor.ConnectionString != "" {
+		if err := appinsights.Init(args.AzureMonitor.ConnectionString); err != nil {
+			logger.Panic(err.Error())
+		}
 	}
 
-	deploymentChan := make(chan kubernetes.WorkloadReturn)
-	verifyHPAChan := make(chan error)
-	agentPoolsChan := make(chan azuredevops.PoolDetailsResponse)
+	if args.AKS.NodePool != "" {
+		aks.Init(args.AKS)
+	}
+
+	if args.CloudEvents.SinkURL != "" {
+		cloudevents.Init(args.CloudEvents.SinkURL, args.CloudEvents.Source)
+	}
+
+	for _, webhookURL := range args.Notifications.WebhookURLs {
+		notify.Register(notify.NewWebhookNotifier(webhookURL, args.Notifications.WebhookSecret), notify.SeverityInfo)
+	}
+	if args.Notifications.SlackWebhookURL != "" {
+		notify.Register(notify.NewSlackNotifier(args.Notifications.SlackWebhookURL, args.Notifications.Template), args.Notifications.SlackMinSeverity)
+	}
+	if args.Notifications.TeamsWebhookURL != "" {
+		notify.Register(notify.NewTeamsNotifier(args.Notifications.TeamsWebhookURL, args.Notifications.Template), args.Notifications.TeamsMinSeverity)
+	}
+
+	health.SetHistorySize(args.History.Size)
+	health.SetRetryBudget(args.RetryBudget.Calls, args.RetryBudget.Window)
+	autoscaler.SetDecisionHook(args)
+
+	switch subcommand {
+	case "":
+		if args.Once {
+			once(args)
+		} else {
+			run(args)
+		}
+	case "plan":
+		plan(args)
+	case "explain":
+		explain(args)
+	case "doctor":
+		doctor(args)
+	default:
+		logger.Panicf("Unknown subcommand %s", subcommand)
+	}
+}
+
+// run autoscales the agents until the process is killed
+func run(args args.Args) {
+	if args.DryRun {
+		logger.Info("Running in dry-run mode - no scaling will be performed")
+	}
+	if args.Sharding.Enabled() {
+		logger.Infof("Autoscaling the agent pools of shard %d of %d", args.Sharding.Shard, args.Sharding.Shards)
+	}
 
-	// Get AZP agent workload
-	go k8sClient.GetWorkloadAsync(deploymentChan, args.Kubernetes)
-	// Verify there isn't a HorizontalPodAutoscaler
-	go k8sClient.VerifyNoHorizontalPodAutoscalerAsync(verifyHPAChan, args.Kubernetes)
-	// Get all agent pools
-	go azdClient.ListPoolsAsync(agentPoolsChan)
 	go func() {
+		// The kubelet can't authenticate the health checks, and they don't expose anything
+		clientCertificates := args.TLS.ClientCAFile != ""
 		mux := http.NewServeMux()
 		mux.Handle("/healthz", health.LivenessCheck{})
-		mux.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(fmt.Sprintf(":%d", args.Health.Port), mux)
+		mux.Handle("/readyz", health.ReadinessCheck{MaxStaleness: readinessMaxStaleness(args), InitializedOnly: args.ExternallyScaled()})
+		mux.Handle("/status", listener.Authenticate(health.StatusHandler{}, args.Health.Token, clientCertificates))
+		mux.Handle("/metrics", listener.Authenticate(promhttp.Handler(), args.Health.Token, clientCertificates))
+		err := listener.ListenAndServe("health", args.Health.Port, mux, args.TLS)
 		if err != nil {
-			logging.Logger.Panicf("Error serving health checks and metrics: %s", err.Error())
+			logger.Panicf("Error serving health checks and metrics: %s", err.Error())
 		}
 	}()
 
-	// Retrieve channel results
-	deployment := <-deploymentChan
-	if deployment.Err != nil {
-		logging.Logger.Panicf("Error retrieving %s in namespace %s: %s", args.Kubernetes.FriendlyName(), args.Kubernetes.Namespace, deployment.Err.Error())
+	if args.Health.DebugPort != 0 {
+		go serveDebug(args.Health, args.TLS)
 	}
-	if err := <-verifyHPAChan; err != nil {
-		logging.Logger.Panic(err.Error())
+
+	if args.Operator.Enabled {
+		operate(args)
+		return
 	}
-	agentPools := <-agentPoolsChan
-	if agentPools.Err != nil {
-		logging.Logger.Panicf("Error retrieving agent pools: %s", agentPools.Err.Error())
-	} else if len(agentPools.Pools) == 0 {
-		logging.Logger.Panic("Error - did not find any agent pools")
+	if args.ExternallyScaled() {
+		serveExternal(args)
+		return
 	}
 
-	// Discover the pool name from the environment variables
-	agentPoolName, err := k8sClient.Sync().GetEnvValue(deployment.Resource.PodTemplateSpec.Spec, deployment.Resource.Namespace, poolNameEnvVar)
+	a, err := autoscaler.New(args)
 	if err != nil {
-		logging.Logger.Panicf("Could not retrieve environment variable %s from %s: %s", poolNameEnvVar, deployment.Resource.FriendlyName, err)
-	} else {
-		logging.Logger.Debugf("Found agent pool %s from %s", agentPoolName, deployment.Resource.FriendlyName)
+		logger.Panic(err.Error())
+	}
+	defer a.Close()
+	if err := a.Init(); err != nil {
+		logger.Panic(err.Error())
+	}
+	health.SetReady()
+
+	if args.Admin.Port != 0 {
+		go serveAdmin(args.Admin, args.TLS, a.Targets)
 	}
 
-	var agentPoolID *int
-	for _, agentPool := range agentPools.Pools {
-		if !agentPool.IsHosted && agentPool.Name == agentPoolName {
-			agentPoolID = &agentPool.ID
-			break
+	// SIGINT and SIGTERM stop the autoscaling, so the decision history is saved before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		for reloaded := range watchConfig(args.ConfigFile) {
+			if err := a.Reload(reloaded); err != nil {
+				logger.Errorf("Error applying the reloaded config, the current config is kept: %s", err.Error())
+			}
 		}
+	}()
+
+	if err := a.Run(ctx); err != nil {
+		notify.SendAndWait(notify.Notification{
+			Type:     notify.TypeAutoscaleFailed,
+			Severity: notify.SeverityError,
+			Time:     time.Now(),
+			Error:    err.Error(),
+		}, exitFlushTimeout)
+		logger.Panic(err.Error())
+	}
+	logger.Info("Stopped autoscaling")
+}
+
+// once autoscales the agents a single time and exits, for running the autoscaler as a Kubernetes CronJob
+func once(args args.Args) {
+	if args.DryRun {
+		logger.Info("Running in dry-run mode - no scaling will be performed")
 	}
-	if agentPoolID == nil {
-		logging.Logger.Panicf("Error - could not find an agent pool with name %s", agentPoolName)
-	} else {
-		logging.Logger.Debugf("Agent pool %s has ID %d", agentPoolName, *agentPoolID)
+	if args.State.ConfigMapName == "" {
+		logger.Warn("Without --state-configmap, the scale down delay and rate limits aren't applied across runs")
 	}
 
-	for {
-		err := scaling.Autoscale(azdClient, *agentPoolID, k8sClient, deployment.Resource, args)
-		if err != nil {
-			switch t := err.(type) {
-			case azuredevops.HTTPError:
-				httpError := err.(azuredevops.HTTPError)
-				if httpError.RetryAfter != nil {
-					logging.Logger.Warnf("%s %s", t, httpError.Error())
-					timeToSleep := math.MaxDuration(*httpError.RetryAfter, args.Rate)
-					logging.Logger.Infof("Retrying after %s", timeToSleep.String())
-					time.Sleep(timeToSleep)
-				}
-			default:
-				// Do nothing
-			}
+	a, err := autoscaler.New(args)
+	if err != nil {
+		exitWith(args.Output, errorResult(err))
+	}
+	if err := a.Init(); err != nil {
+		exitWith(args.Output, errorResult(err))
+	}
 
-			logging.Logger.Panicf("Error autoscaling statefulset/%s: %s", deployment.Resource.Name, err.Error())
-		} else {
-			time.Sleep(args.Rate)
+	decisions, err := a.Once()
+	if err != nil {
+		notify.Send(notify.Notification{
+			Type:     notify.TypeAutoscaleFailed,
+			Severity: notify.SeverityError,
+			Time:     time.Now(),
+			Error:    err.Error(),
+		})
+	}
+
+	// Send the notifications and telemetry of this run before exiting
+	tracing.Flush(exitFlushTimeout)
+	appinsights.Flush()
+	cloudevents.Flush(exitFlushTimeout)
+	notify.Flush(exitFlushTimeout)
+
+	r := result{ExitCode: exitOK, Decisions: decisions}
+	if err != nil {
+		r = errorResult(fmt.Errorf("Error autoscaling: %w", err))
+		r.Decisions = decisions
+		// A failed workload only has a decision if it was made, but couldn't be applied
+		for _, decision := range decisions {
+			if r.ExitCode == exitError && decision.Error != "" {
+				r.ExitCode = exitScaleFailed
+			}
 		}
 	}
+	exitWith(args.Output, r)
+}
+
+// serveDebug serves pprof profiles and goroutine dumps on a separate port, so they aren't exposed with the metrics
+func serveDebug(healthArgs args.HealthArgs, tlsArgs args.TLSArgs) {
+	logger.Infof("Serving pprof on port %d", healthArgs.DebugPort)
+	handler := listener.Authenticate(health.DebugHandler(), healthArgs.Token, tlsArgs.ClientCAFile != "")
+	if err := listener.ListenAndServe("debug", healthArgs.DebugPort, handler, tlsArgs); err != nil {
+		logger.Errorf("Error serving pprof: %s", err.Error())
+	}
+}
+
+// serveAdmin serves the admin API on a separate port, so it isn't exposed with the metrics
+func serveAdmin(adminArgs args.AdminArgs, tlsArgs args.TLSArgs, targets func() []scaling.Target) {
+	server := admin.Server{Token: adminArgs.Token, ClientCertificates: tlsArgs.ClientCAFile != "", Targets: targets}
+	logger.Infof("Serving the admin API on port %d", adminArgs.Port)
+	if err := listener.ListenAndServe("admin API", adminArgs.Port, server.Handler(), tlsArgs); err != nil {
+		logger.Panicf("Error serving the admin API: %s", err.Error())
+	}
+}
 
-	logging.Logger.Info("Exiting azp-agent-autoscaler")
+// readinessMaxStaleness returns how long ago Azure Devops and Kubernetes can have been reached for the autoscaler to be ready
+func readinessMaxStaleness(args args.Args) time.Duration {
+	return math.MaxDuration(3*args.MaxRate(), time.Minute)
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// migratedAutoscaler is an AzpAgentAutoscaler resource printed by migrate-config, without the fields the API server sets
+type migratedAutoscaler struct {
+	APIVersion string                            `json:"apiVersion"`
+	Kind       string                            `json:"kind"`
+	Metadata   migratedMetadata                  `json:"metadata"`
+	Spec       kubernetes.AzpAgentAutoscalerSpec `json:"spec"`
+}
+
+type migratedMetadata struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// migrateConfig prints the arguments set on the command line, from the environment and from the --config file
+// as a config file or as AzpAgentAutoscaler resources, then exits. Notes about the migration are printed to stderr.
+func migrateConfig() {
+	if err := args.LoadConfig(); err != nil {
+		exitWithConfigError(err)
+	}
+	if err := args.ValidateArgs(); err != nil {
+		exitWithConfigError(err)
+	}
+	config, notes := args.MigrateConfig()
+	args := args.ArgsFromFlags()
+
+	var documents [][]byte
+	if args.MigratesToResource() {
+		resources, err := migratedAutoscalers(args)
+		if err != nil {
+			exitWithConfigError(err)
+		}
+		for _, resource := range resources {
+			document, err := marshalYAML(resource)
+			if err != nil {
+				exitWith(args.Output, errorResult(err))
+			}
+			documents = append(documents, document)
+		}
+		notes = []string{"The other arguments are the defaults of the resources in operator mode, migrate them to the operator's config file with --migrate-to=config"}
+	} else {
+		document, err := marshalYAML(config)
+		if err != nil {
+			exitWith(args.Output, errorResult(err))
+		}
+		documents = append(documents, document)
+	}
+
+	for i, document := range documents {
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Print(string(document))
+	}
+	for _, note := range notes {
+		fmt.Fprintln(os.Stderr, note)
+	}
+}
+
+// migratedAutoscalers returns an AzpAgentAutoscaler resource for every workload of the arguments
+func migratedAutoscalers(args args.Args) ([]migratedAutoscaler, error) {
+	if args.Operator.Enabled {
+		return nil, fmt.Errorf("The workloads are already AzpAgentAutoscaler resources in operator mode")
+	} else if args.Kubernetes.Type != "" && !strings.EqualFold(args.Kubernetes.Type, "StatefulSet") {
+		return nil, fmt.Errorf("Only StatefulSets can be autoscaled by AzpAgentAutoscaler resources, not %s", args.Kubernetes.Type)
+	}
+
+	var resources []migratedAutoscaler
+	for _, workload := range args.Kubernetes.Workloads() {
+		min, max := args.Min, args.Max
+		scaleDownMax := args.ScaleDown.Max
+		drainMaxRetries := args.ScaleDown.DrainMaxRetries
+		spec := kubernetes.AzpAgentAutoscalerSpec{
+			WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: workload.Name},
+			Priority:    workload.Priority,
+			Min:         &min,
+			Max:         &max,
+			ScaleDown: &kubernetes.AutoscalerScaleDownSpec{
+				Delay:     &metav1.Duration{Duration: args.ScaleDown.Delay},
+				IdleDelay: &metav1.Duration{Duration: args.ScaleDown.IdleDelay},
+				Max:       &scaleDownMax,
+
+				DrainTimeout:       &metav1.Duration{Duration: args.ScaleDown.DrainTimeout},
+				DrainTimeoutPolicy: args.ScaleDown.DrainTimeoutPolicy,
+				DrainMaxRetries:    &drainMaxRetries,
+			},
+			Policy: &kubernetes.AutoscalerPolicySpec{Name: args.Policy.Mode},
+		}
+		if args.Policy.IsSLO() {
+			spec.Policy.SLOMaxQueueTime = &metav1.Duration{Duration: args.Policy.SLO.MaxQueueTime}
+			spec.Policy.SLOWindow = &metav1.Duration{Duration: args.Policy.SLO.Window}
+		}
+		if args.DryRun {
+			dryRun := true
+			spec.DryRun = &dryRun
+		}
+		resources = append(resources, migratedAutoscaler{
+			APIVersion: kubernetes.AutoscalerGroup + "/" + kubernetes.AutoscalerVersion,
+			Kind:       "AzpAgentAutoscaler",
+			Metadata:   migratedMetadata{Name: workload.Name, Namespace: workload.Namespace},
+			Spec:       spec,
+		})
+	}
+	return resources, nil
+}
+
+// marshalYAML marshals a config file, or a value with JSON tags, to YAML. The order of its fields is kept, and the fields
+// that aren't set are left out.
+func marshalYAML(value interface{}) ([]byte, error) {
+	var data []byte
+	var err error
+	if _, isConfig := value.(args.Config); isConfig {
+		data, err = yaml.Marshal(value)
+	} else {
+		data, err = json.Marshal(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fields yaml.MapSlice
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(pruneYAML(fields))
+}
+
+// pruneYAML removes the null values and the empty lists and sections of a YAML document
+func pruneYAML(fields yaml.MapSlice) yaml.MapSlice {
+	pruned := yaml.MapSlice{}
+	for _, field := range fields {
+		switch value := field.Value.(type) {
+		case nil:
+			continue
+		case yaml.MapSlice:
+			if field.Value = pruneYAML(value); len(field.Value.(yaml.MapSlice)) == 0 {
+				continue
+			}
+		case []interface{}:
+			if len(value) == 0 {
+				continue
+			}
+			for i, item := range value {
+				if section, isSection := item.(yaml.MapSlice); isSection {
+					value[i] = pruneYAML(section)
+				}
+			}
+		}
+		pruned = append(pruned, field)
+	}
+	return pruned
+}
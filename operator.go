@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/operator"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// operate autoscales the workloads of the AzpAgentAutoscaler resources in the operator's namespaces until the process is killed.
+// The resources are listed again every iteration, so resources can be added, changed and deleted without a restart.
+// A resource that can't be autoscaled is logged and retried on the next iteration, without affecting the other resources.
+func operate(args args.Args) {
+	backend, err := autoscaler.MakeBackend(args, nil)
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+	k8sClient, err := kubernetes.MakeClient(args.Kubernetes.Timeout)
+	if err != nil {
+		logger.Panicf("Error creating the Kubernetes client: %s", err.Error())
+	}
+	if args, _, err = autoscaler.ResolveRBACScope(k8sClient.Sync(), args); err != nil {
+		logger.Panic(err.Error())
+	}
+	if err := kubernetes.VerifyPermissions(k8sClient.Sync(), args); err != nil {
+		logger.Panic(err.Error())
+	}
+	targets := &autoscaler.TargetList{}
+	health.SetReady()
+
+	if args.State.ConfigMapName != "" {
+		if err := scaling.LoadState(scaling.StateStore(k8sClient.Sync(), args)); err != nil {
+			logger.Panic(err.Error())
+		}
+	}
+
+	if args.Admin.Port != 0 {
+		go serveAdmin(args.Admin, args.TLS, targets.Get)
+	}
+	var webhook *operator.Webhook
+	if args.Operator.Webhook.Port != 0 {
+		webhook = operator.NewWebhook(backend, k8sClient, args)
+		go serveWebhook(args.Operator.Webhook, webhook)
+	}
+
+	logger.Infof("Running in operator mode, autoscaling the AzpAgentAutoscaler resources in namespaces %s", strings.Join(args.OperatorNamespaces(), ", "))
+	reloads := watchConfig(args.ConfigFile)
+	// Errors listing the resources are retried with a backoff, and the errors of each resource are in its status
+	var backoff autoscaler.ErrorBackoff
+
+	for {
+		select {
+		case reloaded := <-reloads:
+			reloadedBackend, _, err := autoscaler.Reload(args, &reloaded, backend, k8sClient)
+			if err != nil {
+				logger.Errorf("Error applying the reloaded config, the current config is kept: %s", err.Error())
+			} else {
+				args, backend = reloaded, reloadedBackend
+				if webhook != nil {
+					webhook.Set(backend, args)
+				}
+				logger.Info("Reloaded the config")
+			}
+		default:
+		}
+
+		// While the retry budget is exhausted, the iteration is skipped instead of retrying the failing dependencies
+		if err := health.CheckRetryBudget(); err != nil {
+			time.Sleep(backoff.Failed(err, autoscaler.ClassifyError(err), args.Rate))
+			continue
+		}
+
+		autoscalers, err := operator.Reconcile(backend, k8sClient, args)
+		if err != nil {
+			time.Sleep(backoff.Failed(fmt.Errorf("Error reconciling the AzpAgentAutoscaler resources: %w", err), autoscaler.ClassifyError(err), args.Rate))
+			continue
+		}
+		backoff.Succeeded()
+		targets.Set(operator.Targets(autoscalers))
+		_ = scaling.WaitForReconcile(context.Background(), scaling.NextRate(args))
+	}
+}
+
+// serveWebhook serves the admission webhook over TLS on a separate port, as the API server only calls webhooks over HTTPS
+func serveWebhook(webhookArgs args.AdmissionWebhookArgs, webhook *operator.Webhook) {
+	tlsConfig, err := operator.TLSConfig(webhookArgs)
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", webhookArgs.Port),
+		Handler:   webhook.Handler(),
+		TLSConfig: tlsConfig,
+	}
+	logger.Infof("Serving the admission webhook on port %d", webhookArgs.Port)
+	// The certificate is loaded by the TLS config
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		logger.Panicf("Error serving the admission webhook: %s", err.Error())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/github"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/gitlab"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scenario"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/secrets"
+)
+
+// The exit codes of the CLI subcommands and --once
+const (
+	exitOK = 0
+	// exitError is any other error, ex: Azure Devops or Kubernetes couldn't be reached
+	exitError = 1
+	// exitConfigError is an invalid config file or arguments
+	exitConfigError = 2
+	// exitAuthError is Azure Devops or Kubernetes rejecting the credentials or permissions, or a secret store being unavailable
+	exitAuthError = 3
+	// exitScaleFailed is a scaling decision that couldn't be applied
+	exitScaleFailed = 4
+	// exitScenarioFailed is a test-policy scenario that didn't make the expected decision
+	exitScenarioFailed = 5
+)
+
+// result is the JSON output of the CLI subcommands and --once
+type result struct {
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+
+	// MissingPermissions are the RBAC permissions validate-config --probe found missing
+	MissingPermissions []string `json:"missingPermissions,omitempty"`
+	// Workloads are the workloads validate-config --probe found
+	Workloads []workloadResult `json:"workloads,omitempty"`
+	// Decisions are the scaling decisions of plan and --once
+	Decisions []scaling.DecisionRecord `json:"decisions,omitempty"`
+	// Explanations are how explain decided the desired replicas of each workload
+	Explanations []scaling.Explanation `json:"explanations,omitempty"`
+	// Checks are the results of the doctor checks
+	Checks []checkResult `json:"checks,omitempty"`
+	// Scenarios are the results of the test-policy scenarios
+	Scenarios []checkResult `json:"scenarios,omitempty"`
+	// Replays are the summaries of the recorded workloads replayed by replay
+	Replays []scenario.ReplaySummary `json:"replays,omitempty"`
+}
+
+// workloadResult is a workload and the agent pool discovered from it
+type workloadResult struct {
+	Namespace   string `json:"namespace"`
+	Workload    string `json:"workload"`
+	AgentPoolID int    `json:"poolId"`
+	Priority    int32  `json:"priority"`
+	// Organization is the URL of the additional Azure Devops organization of the agent pool
+	Organization string `json:"organization,omitempty"`
+}
+
+// isText returns true if the output format is human-readable text
+func isText(output string) bool {
+	return output != args.OutputJSON
+}
+
+// exitWith prints the result as JSON, or its error as text, and exits with its exit code
+func exitWith(output string, r result) {
+	if !isText(output) {
+		json.NewEncoder(os.Stdout).Encode(r)
+	} else if r.Error != "" {
+		fmt.Fprintln(os.Stderr, r.Error)
+	}
+	os.Exit(r.ExitCode)
+}
+
+// exitWithConfigError exits with the error of an invalid config file or arguments
+func exitWithConfigError(err error) {
+	// The output format is read even if other arguments are invalid
+	exitWith(args.ArgsFromFlags().Output, result{ExitCode: exitConfigError, Error: err.Error()})
+}
+
+// errorResult returns the result of an error from the CI system, Kubernetes or a secret store
+func errorResult(err error) result {
+	var retrieveError secrets.RetrieveError
+	if azuredevops.IsAuthError(err) || github.IsAuthError(err) || gitlab.IsAuthError(err) || kubernetes.IsAuthError(err) || errors.As(err, &retrieveError) {
+		return result{ExitCode: exitAuthError, Error: err.Error()}
+	}
+	return result{ExitCode: exitError, Error: err.Error()}
+}
@@ -0,0 +1,348 @@
+package admin
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/listener"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+var logger = logging.Component("admin")
+
+// WorkloadState is the scaling state of a workload returned by the state endpoint
+type WorkloadState struct {
+	Namespace   string        `json:"namespace"`
+	Workload    string        `json:"workload"`
+	AgentPoolID int           `json:"poolId"`
+	Priority    int32         `json:"priority"`
+	State       scaling.State `json:"state"`
+}
+
+// StateResponse is the response of the state endpoint
+type StateResponse struct {
+	Status    health.Status   `json:"status"`
+	Workloads []WorkloadState `json:"workloads"`
+}
+
+// HistoryResponse is the response of the history endpoint
+type HistoryResponse struct {
+	Workloads []health.WorkloadHistory `json:"workloads"`
+}
+
+// ExplainResponse is the response of the explain endpoint
+type ExplainResponse struct {
+	Workloads []scaling.Explanation `json:"workloads"`
+}
+
+//go:embed dashboard.html
+var dashboard []byte
+
+// Server serves the admin API, which allows operators to pause, resume and force scale the agents at runtime, and the
+// dashboard. Every request must have the token as a bearer token, or as the password of basic authentication so the
+// dashboard can be opened in a browser, or a verified client certificate if ClientCertificates is true.
+type Server struct {
+	Token string
+	// ClientCertificates accepts the requests with a client certificate verified by the TLS config of the listener
+	ClientCertificates bool
+	// Targets returns the autoscaled targets, which can change when the config is reloaded
+	Targets func() []scaling.Target
+}
+
+// Handler returns the routes of the admin API
+func (s Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pause", s.post(s.pause))
+	mux.HandleFunc("/resume", s.post(s.resume))
+	mux.HandleFunc("/scale", s.post(s.scale))
+	mux.HandleFunc("/reconcile", s.post(s.reconcile))
+	mux.HandleFunc("/state", s.get(s.state))
+	mux.HandleFunc("/history", s.get(s.history))
+	mux.HandleFunc("/explain", s.get(s.explain))
+	mux.HandleFunc("/", s.dashboard)
+	return mux
+}
+
+// handlerFunc handles an authenticated admin request, returning the response body or an HTTP status and error
+type handlerFunc func(request *http.Request) (interface{}, int, error)
+
+func (s Server) post(handler handlerFunc) http.HandlerFunc {
+	return s.handle(http.MethodPost, handler)
+}
+
+func (s Server) get(handler handlerFunc) http.HandlerFunc {
+	return s.handle(http.MethodGet, handler)
+}
+
+func (s Server) handle(method string, handler handlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !s.authorized(request) {
+			writeUnauthorized(writer)
+			return
+		}
+		if request.Method != method {
+			writer.Header().Set("Allow", method)
+			writeError(writer, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", request.Method))
+			return
+		}
+
+		response, status, err := handler(request)
+		if err != nil {
+			writeError(writer, status, err)
+			return
+		}
+		if method != http.MethodGet {
+			logger.Infof("Admin request %s %s", request.Method, request.URL.RequestURI())
+		}
+		if csvResponse, ok := response.(csvResponse); ok {
+			writeCSV(writer, status, csvResponse)
+			return
+		}
+		if textResponse, ok := response.(textResponse); ok {
+			writeText(writer, status, textResponse)
+			return
+		}
+		writeJSON(writer, status, response)
+	}
+}
+
+// authorized returns true if the request has the admin token, as a bearer token or a basic authentication password,
+// or an accepted client certificate
+func (s Server) authorized(request *http.Request) bool {
+	if s.ClientCertificates && listener.HasClientCertificate(request) {
+		return true
+	}
+	header := request.Header.Get("Authorization")
+	var token string
+	if strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	} else if _, password, ok := request.BasicAuth(); ok {
+		token = password
+	} else {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+// dashboard serves the web UI, which shows the history endpoint
+func (s Server) dashboard(writer http.ResponseWriter, request *http.Request) {
+	if !s.authorized(request) {
+		writeUnauthorized(writer)
+		return
+	}
+	if request.URL.Path != "/" {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("%s was not found", request.URL.Path))
+		return
+	}
+	if request.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		writeError(writer, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", request.Method))
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := writer.Write(dashboard); err != nil {
+		logger.Errorf("Error writing the dashboard: %s", err.Error())
+	}
+}
+
+func (s Server) pause(request *http.Request) (interface{}, int, error) {
+	targets, err := s.findTargets(request)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	for _, target := range targets {
+		logger.Infof("Pausing autoscaling of %s in namespace %s", target.Workload.FriendlyName, target.Workload.Namespace)
+		scaling.Pause(target.Workload)
+	}
+	scaling.Reconcile()
+	return s.workloadStates(targets), http.StatusOK, nil
+}
+
+func (s Server) resume(request *http.Request) (interface{}, int, error) {
+	targets, err := s.findTargets(request)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	for _, target := range targets {
+		logger.Infof("Resuming autoscaling of %s in namespace %s", target.Workload.FriendlyName, target.Workload.Namespace)
+		scaling.Resume(target.Workload)
+	}
+	scaling.Reconcile()
+	return s.workloadStates(targets), http.StatusOK, nil
+}
+
+func (s Server) scale(request *http.Request) (interface{}, int, error) {
+	replicas, err := strconv.ParseInt(request.URL.Query().Get("replicas"), 10, 32)
+	if err != nil || replicas < 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("The replicas parameter must be a non-negative integer")
+	}
+	targets, err := s.findTargets(request)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(targets) != 1 {
+		return nil, http.StatusBadRequest, fmt.Errorf("The workload parameter is required when there are multiple workloads")
+	}
+	logger.Warnf("Force scaling %s in namespace %s to %d pods", targets[0].Workload.FriendlyName, targets[0].Workload.Namespace, replicas)
+	scaling.ForceScale(targets[0].Workload, int32(replicas))
+	scaling.Reconcile()
+	return s.workloadStates(targets), http.StatusAccepted, nil
+}
+
+func (s Server) reconcile(request *http.Request) (interface{}, int, error) {
+	scaling.Reconcile()
+	return map[string]string{"status": "requested"}, http.StatusAccepted, nil
+}
+
+func (s Server) state(request *http.Request) (interface{}, int, error) {
+	return StateResponse{
+		Status:    health.GetStatus(),
+		Workloads: s.workloadStates(s.Targets()),
+	}, http.StatusOK, nil
+}
+
+// historyCSVHeader are the columns of the history endpoint in the CSV format, one row per decision
+var historyCSVHeader = []string{"time", "namespace", "workload", "poolId", "action", "queuedJobs", "currentReplicas", "desiredReplicas", "activeAgents", "idleAgents"}
+
+func (s Server) history(request *http.Request) (interface{}, int, error) {
+	switch format := request.URL.Query().Get("format"); format {
+	case "", "json":
+		return HistoryResponse{Workloads: health.GetHistory()}, http.StatusOK, nil
+	case "csv":
+		rows := csvResponse{historyCSVHeader}
+		for _, workloadHistory := range health.GetHistory() {
+			for _, sample := range workloadHistory.Samples {
+				rows = append(rows, []string{
+					sample.Time.UTC().Format(time.RFC3339),
+					workloadHistory.Namespace,
+					workloadHistory.Workload,
+					strconv.Itoa(workloadHistory.AgentPoolID),
+					sample.Action,
+					strconv.Itoa(int(sample.QueuedJobs)),
+					strconv.Itoa(int(sample.CurrentReplicas)),
+					strconv.Itoa(int(sample.DesiredReplicas)),
+					strconv.Itoa(int(sample.ActiveAgents)),
+					strconv.Itoa(int(sample.IdleAgents)),
+				})
+			}
+		}
+		return rows, http.StatusOK, nil
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("The format parameter must be json or csv, not %s", format)
+	}
+}
+
+// explain returns how the last desired replicas of the workloads were decided, as JSON or text. The workloads that
+// haven't been autoscaled yet are left out, or are not found if they're requested.
+func (s Server) explain(request *http.Request) (interface{}, int, error) {
+	format := request.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "text" {
+		return nil, http.StatusBadRequest, fmt.Errorf("The format parameter must be json or text, not %s", format)
+	}
+	targets, err := s.findTargets(request)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	response := ExplainResponse{Workloads: []scaling.Explanation{}}
+	for _, target := range targets {
+		if explanation, exists := scaling.GetExplanation(target.Workload); exists {
+			response.Workloads = append(response.Workloads, explanation)
+		}
+	}
+	if len(response.Workloads) == 0 && request.URL.Query().Get("workload") != "" {
+		return nil, http.StatusNotFound, fmt.Errorf("Workload %s hasn't been autoscaled yet", request.URL.Query().Get("workload"))
+	}
+
+	if format == "text" {
+		explanations := make([]string, len(response.Workloads))
+		for i, explanation := range response.Workloads {
+			explanations[i] = explanation.String()
+		}
+		return textResponse(strings.Join(explanations, "\n")), http.StatusOK, nil
+	}
+	return response, http.StatusOK, nil
+}
+
+// findTargets returns the targets matching the workload and namespace parameters, or every target if there is no workload parameter
+func (s Server) findTargets(request *http.Request) ([]scaling.Target, error) {
+	workload := request.URL.Query().Get("workload")
+	namespace := request.URL.Query().Get("namespace")
+	if workload == "" {
+		return s.Targets(), nil
+	}
+
+	var targets []scaling.Target
+	for _, target := range s.Targets() {
+		if strings.EqualFold(target.Workload.FriendlyName, workload) && (namespace == "" || target.Workload.Namespace == namespace) {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("Workload %s is not autoscaled", workload)
+	}
+	return targets, nil
+}
+
+func (s Server) workloadStates(targets []scaling.Target) []WorkloadState {
+	workloadStates := make([]WorkloadState, len(targets))
+	for i, target := range targets {
+		workloadStates[i] = WorkloadState{
+			Namespace:   target.Workload.Namespace,
+			Workload:    target.Workload.FriendlyName,
+			AgentPoolID: target.AgentPoolID,
+			Priority:    target.Priority,
+			State:       scaling.GetState(target.Workload),
+		}
+	}
+	return workloadStates
+}
+
+// writeUnauthorized responds that the admin token is required, prompting browsers for it
+func writeUnauthorized(writer http.ResponseWriter) {
+	writer.Header().Set("WWW-Authenticate", `Basic realm="azp-agent-autoscaler"`)
+	writeError(writer, http.StatusUnauthorized, fmt.Errorf("A valid bearer token is required"))
+}
+
+func writeError(writer http.ResponseWriter, status int, err error) {
+	writeJSON(writer, status, map[string]string{"error": err.Error()})
+}
+
+// csvResponse is a response body written as CSV instead of JSON, starting with the header
+type csvResponse [][]string
+
+func writeCSV(writer http.ResponseWriter, status int, rows csvResponse) {
+	writer.Header().Set("Content-Type", "text/csv")
+	writer.WriteHeader(status)
+	if err := csv.NewWriter(writer).WriteAll(rows); err != nil {
+		logger.Errorf("Error writing the admin response: %s", err.Error())
+	}
+}
+
+// textResponse is a response body written as plain text instead of JSON
+type textResponse string
+
+func writeText(writer http.ResponseWriter, status int, text textResponse) {
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.WriteHeader(status)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		logger.Errorf("Error writing the admin response: %s", err.Error())
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, status int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(body); err != nil {
+		logger.Errorf("Error writing the admin response: %s", err.Error())
+	}
+}
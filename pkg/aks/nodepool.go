@@ -0,0 +1,190 @@
+package aks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/secrets"
+)
+
+const (
+	apiVersion = "2023-08-01"
+	// defaultEndpoint is the Azure Resource Manager endpoint of the Azure public cloud
+	defaultEndpoint = "https://management.azure.com"
+)
+
+var logger = logging.Component("aks")
+
+// nodePool is nil unless Init is called
+var nodePool *NodePool
+
+// Init scales up an AKS node pool when agent pods are unschedulable
+func Init(aksArgs args.AKSArgs) {
+	nodePool = NewNodePool(aksArgs)
+}
+
+// ScaleUpNodePool scales up the node pool for the unschedulable pods, if enabled. See NodePool.ScaleUp.
+func ScaleUpNodePool(unschedulablePods int32, dryRun bool) (*ScaleUp, error) {
+	if nodePool == nil {
+		return nil, nil
+	}
+	return nodePool.ScaleUp(unschedulablePods, dryRun)
+}
+
+// ScaleUp is a node pool scale up
+type ScaleUp struct {
+	NodePool  string
+	FromNodes int32
+	ToNodes   int32
+}
+
+// NodePool scales an AKS node pool with the Azure Resource Manager API, for clusters without the cluster autoscaler
+type NodePool struct {
+	args args.AKSArgs
+
+	// Endpoint is the Azure Resource Manager endpoint, overridden in tests
+	Endpoint string
+	// Identity retrieves the Azure Resource Manager access tokens
+	Identity *secrets.ManagedIdentity
+
+	httpClient  *http.Client
+	lock        sync.Mutex
+	lastScaleUp time.Time
+}
+
+// NewNodePool returns an AKS node pool that is accessed with the managed identity of the client ID
+func NewNodePool(aksArgs args.AKSArgs) *NodePool {
+	return &NodePool{
+		args:       aksArgs,
+		Endpoint:   defaultEndpoint,
+		Identity:   secrets.NewManagedIdentity(aksArgs.ClientID),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// ScaleUp adds a node for every pods per node unschedulable pods, up to the max nodes. It returns nil if the node pool
+// wasn't scaled, because it was scaled within the cooldown, is still provisioning or has the max nodes.
+// An error is returned if the node pool is scaled by the cluster autoscaler.
+func (n *NodePool) ScaleUp(unschedulablePods int32, dryRun bool) (*ScaleUp, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if unschedulablePods <= 0 {
+		return nil, nil
+	}
+	if nextScaleUp := n.lastScaleUp.Add(n.args.Cooldown); time.Now().Before(nextScaleUp) {
+		logger.Debugf("Not scaling up node pool %s - cannot scale up until %s", n.args.NodePool, nextScaleUp.String())
+		return nil, nil
+	}
+
+	agentPool, err := n.get()
+	if err != nil {
+		return nil, err
+	}
+	properties, _ := agentPool["properties"].(map[string]interface{})
+	if enableAutoScaling, _ := properties["enableAutoScaling"].(bool); enableAutoScaling {
+		return nil, fmt.Errorf("The AKS node pool %s is scaled by the cluster autoscaler", n.args.NodePool)
+	}
+	if provisioningState, _ := properties["provisioningState"].(string); !strings.EqualFold(provisioningState, "Succeeded") {
+		logger.Debugf("Not scaling up node pool %s - its provisioning state is %s", n.args.NodePool, provisioningState)
+		return nil, nil
+	}
+	count, _ := properties["count"].(float64)
+	nodes := (unschedulablePods + n.args.PodsPerNode - 1) / n.args.PodsPerNode
+	scaleUp := &ScaleUp{
+		NodePool:  n.args.NodePool,
+		FromNodes: int32(count),
+		ToNodes:   math.MinInt32(int32(count)+nodes, n.args.MaxNodes),
+	}
+	if scaleUp.ToNodes <= scaleUp.FromNodes {
+		logger.Debugf("Not scaling up node pool %s - it has the max of %d nodes", n.args.NodePool, n.args.MaxNodes)
+		return nil, nil
+	}
+
+	if dryRun {
+		logger.Infof("Dry run - would scale node pool %s from %d to %d nodes", n.args.NodePool, scaleUp.FromNodes, scaleUp.ToNodes)
+	} else {
+		properties["count"] = scaleUp.ToNodes
+		if err := n.put(agentPool); err != nil {
+			return nil, err
+		}
+	}
+	n.lastScaleUp = time.Now()
+	return scaleUp, nil
+}
+
+// url returns the Azure Resource Manager URL of the node pool
+func (n *NodePool) url() string {
+	return fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/Microsoft.ContainerService/managedClusters/%s/agentPools/%s?api-version=%s",
+		strings.TrimSuffix(n.Endpoint, "/"), url.PathEscape(n.args.SubscriptionID), url.PathEscape(n.args.ResourceGroup),
+		url.PathEscape(n.args.Cluster), url.PathEscape(n.args.NodePool), apiVersion)
+}
+
+// get retrieves the node pool. It's returned as a map, so it can be updated without removing the properties this doesn't know.
+func (n *NodePool) get() (map[string]interface{}, error) {
+	agentPool := make(map[string]interface{})
+	if err := n.do("GET", nil, &agentPool); err != nil {
+		return nil, fmt.Errorf("Error retrieving AKS node pool %s: %w", n.args.NodePool, err)
+	}
+	return agentPool, nil
+}
+
+// put replaces the node pool, which is provisioned asynchronously
+func (n *NodePool) put(agentPool map[string]interface{}) error {
+	body, err := json.Marshal(agentPool)
+	if err != nil {
+		return err
+	}
+	if err := n.do("PUT", body, nil); err != nil {
+		return fmt.Errorf("Error scaling AKS node pool %s: %w", n.args.NodePool, err)
+	}
+	return nil
+}
+
+// do sends a request to the Azure Resource Manager API and decodes the JSON response if there is one
+func (n *NodePool) do(method string, body []byte, response interface{}) error {
+	accessToken, err := n.Identity.AccessToken(defaultEndpoint)
+	if err != nil {
+		return fmt.Errorf("Error getting an Azure Resource Manager access token: %w", err)
+	}
+	request, err := http.NewRequest(method, n.url(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	request.Header.Set("Content-Type", "application/json")
+	httpResponse, err := n.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		var errorResponse struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(responseBody, &errorResponse)
+		return fmt.Errorf("HTTP %d %s: %s", httpResponse.StatusCode, errorResponse.Error.Code, errorResponse.Error.Message)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, response)
+}
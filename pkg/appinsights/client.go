@@ -0,0 +1,192 @@
+package appinsights
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+const (
+	defaultIngestionEndpoint = "https://dc.services.visualstudio.com"
+	roleName                 = "azp-agent-autoscaler"
+	flushInterval            = 30 * time.Second
+	// maxBufferedItems limits the memory used while the ingestion endpoint is unreachable
+	maxBufferedItems = 1000
+)
+
+var logger = logging.Component("appinsights")
+
+// client is nil unless Init is called
+var client *exporter
+
+// exporter buffers telemetry and periodically sends it to the Application Insights ingestion endpoint
+type exporter struct {
+	instrumentationKey string
+	url                string
+	httpClient         *http.Client
+
+	items []envelope
+	lock  sync.Mutex
+}
+
+// Init starts exporting telemetry to Application Insights with a connection string,
+// ex: InstrumentationKey=00000000-0000-0000-0000-000000000000;IngestionEndpoint=https://westus2-0.in.applicationinsights.azure.com/
+func Init(connectionString string) error {
+	instrumentationKey, ingestionEndpoint, err := ParseConnectionString(connectionString)
+	if err != nil {
+		return err
+	}
+	client = &exporter{
+		instrumentationKey: instrumentationKey,
+		url:                strings.TrimSuffix(ingestionEndpoint, "/") + "/v2/track",
+		httpClient:         &http.Client{Timeout: 10 * time.Second},
+	}
+	go func() {
+		for range time.Tick(flushInterval) {
+			client.flush()
+		}
+	}()
+	return nil
+}
+
+// ParseConnectionString returns the instrumentation key and ingestion endpoint of a connection string
+func ParseConnectionString(connectionString string) (string, string, error) {
+	instrumentationKey, ingestionEndpoint := "", defaultIngestionEndpoint
+	for _, part := range strings.Split(connectionString, ";") {
+		keyValue := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		switch strings.ToLower(keyValue[0]) {
+		case "instrumentationkey":
+			instrumentationKey = keyValue[1]
+		case "ingestionendpoint":
+			ingestionEndpoint = keyValue[1]
+		}
+	}
+	if instrumentationKey == "" {
+		return "", "", fmt.Errorf("The Application Insights connection string does not have an InstrumentationKey")
+	}
+	return instrumentationKey, ingestionEndpoint, nil
+}
+
+// TrackMetrics records metric values with the given properties
+func TrackMetrics(properties map[string]string, values map[string]float64) {
+	if client == nil {
+		return
+	}
+	metrics := make([]metricDataPoint, 0, len(values))
+	for name, value := range values {
+		metrics = append(metrics, metricDataPoint{Name: name, Value: value, Count: 1})
+	}
+	client.add("Metric", "MetricData", metricData{Ver: 2, Metrics: metrics, Properties: properties})
+}
+
+// TrackEvent records a custom event with the given properties and measurements
+func TrackEvent(name string, properties map[string]string, measurements map[string]float64) {
+	if client == nil {
+		return
+	}
+	client.add("Event", "EventData", eventData{Ver: 2, Name: name, Properties: properties, Measurements: measurements})
+}
+
+func (e *exporter) add(itemType string, baseType string, baseData interface{}) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.items) >= maxBufferedItems {
+		e.items = e.items[1:]
+	}
+	e.items = append(e.items, envelope{
+		Name: fmt.Sprintf("Microsoft.ApplicationInsights.%s.%s", strings.Replace(e.instrumentationKey, "-", "", -1), itemType),
+		Time: time.Now().UTC().Format(time.RFC3339Nano),
+		IKey: e.instrumentationKey,
+		Tags: map[string]string{"ai.cloud.role": roleName},
+		Data: envelopeData{BaseType: baseType, BaseData: baseData},
+	})
+}
+
+// Flush sends the buffered telemetry immediately.
+// This should be used before the process exits.
+func Flush() {
+	if client != nil {
+		client.flush()
+	}
+}
+
+// flush sends the buffered telemetry. If sending fails, the telemetry is kept for the next flush.
+func (e *exporter) flush() {
+	e.lock.Lock()
+	items := e.items
+	e.items = nil
+	e.lock.Unlock()
+	if len(items) == 0 {
+		return
+	}
+
+	if err := e.send(items); err != nil {
+		logger.Errorf("Error sending %d items to Application Insights: %s", len(items), err.Error())
+		e.lock.Lock()
+		e.items = append(items, e.items...)
+		if len(e.items) > maxBufferedItems {
+			e.items = e.items[len(e.items)-maxBufferedItems:]
+		}
+		e.lock.Unlock()
+		return
+	}
+	logger.Tracef("Sent %d items to Application Insights", len(items))
+}
+
+func (e *exporter) send(items []envelope) error {
+	body, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	response, err := e.httpClient.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// 206 is a partial success, the rejected items are not retried as they are likely invalid
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s returned HTTP %d", e.url, response.StatusCode)
+	}
+	return nil
+}
+
+type envelope struct {
+	Name string            `json:"name"`
+	Time string            `json:"time"`
+	IKey string            `json:"iKey"`
+	Tags map[string]string `json:"tags"`
+	Data envelopeData      `json:"data"`
+}
+
+type envelopeData struct {
+	BaseType string      `json:"baseType"`
+	BaseData interface{} `json:"baseData"`
+}
+
+type metricData struct {
+	Ver        int               `json:"ver"`
+	Metrics    []metricDataPoint `json:"metrics"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type metricDataPoint struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Count int     `json:"count"`
+}
+
+type eventData struct {
+	Ver          int                `json:"ver"`
+	Name         string             `json:"name"`
+	Properties   map[string]string  `json:"properties,omitempty"`
+	Measurements map[string]float64 `json:"measurements,omitempty"`
+}
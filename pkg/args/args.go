@@ -3,49 +3,1056 @@ package args
 import (
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/appinsights"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/notify"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/schedule"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	logLevel          = flag.String("log-level", "info", "Log level (trace, debug, info, warn, error, fatal, panic).")
-	min               = flag.Int("min", 1, "Minimum number of free agents to keep alive. Minimum of 1.")
-	max               = flag.Int("max", 100, "Maximum number of agents allowed.")
-	rate              = flag.Duration("rate", 10*time.Second, "Duration to check the number of agents.")
-	scaleDownDelay    = flag.Duration("scale-down", 30*time.Second, "Wait time after scaling down to scale down again.")
-	scaleDownMax      = flag.Int("scale-down-max", 1, "Maximum allowed number of pods to scale down.")
-	resourceType      = flag.String("type", "StatefulSet", "Resource type of the agent. Only StatefulSet is supported.")
-	resourceName      = flag.String("name", "", "The name of the StatefulSet.")
-	resourceNamespace = flag.String("namespace", "", "The namespace of the StatefulSet.")
-	azpToken          = flag.String("token", "", "The Azure Devops token.")
-	azpURL            = flag.String("url", "", "The Azure Devops URL. https://dev.azure.com/AccountName")
-	port              = flag.Int("port", 10101, "The port to serve health checks and metrics.")
+	logLevel                    = flag.String("log-level", "info", "Log level (trace, debug, info, warn, error, fatal, panic).")
+	logLevels                   = flag.String("log-levels", "", "Log levels of individual components, as a comma-separated list of <component>=<level>, ex: scaling=debug,health=warn. Components are main, scaling, health, tracing, appinsights, notify, admin, cloudevents, secrets, operator and autoscaler.")
+	appInsightsConnectionString = flag.String("appinsights-connection-string", os.Getenv("APPLICATIONINSIGHTS_CONNECTION_STRING"), "An Application Insights connection string to send the queue depth, replicas and scale events to Azure Monitor with. Defaults to the APPLICATIONINSIGHTS_CONNECTION_STRING environment variable. Disabled if empty.")
+	webhookSecret               = flag.String("webhook-secret", os.Getenv("WEBHOOK_SECRET"), "A secret to sign the webhook notifications with HMAC-SHA256, sent in the X-Azp-Agent-Autoscaler-Signature header. Defaults to the WEBHOOK_SECRET environment variable.")
+	slackWebhookURL             = flag.String("slack-webhook-url", os.Getenv("SLACK_WEBHOOK_URL"), "A Slack incoming webhook URL to send notifications to. Defaults to the SLACK_WEBHOOK_URL environment variable. Disabled if empty.")
+	slackMinSeverity            = flag.String("slack-min-severity", string(notify.SeverityInfo), "The minimum severity of the notifications sent to Slack (info, warning, error).")
+	teamsWebhookURL             = flag.String("teams-webhook-url", os.Getenv("TEAMS_WEBHOOK_URL"), "A Microsoft Teams incoming webhook URL to send notifications to. Defaults to the TEAMS_WEBHOOK_URL environment variable. Disabled if empty.")
+	teamsMinSeverity            = flag.String("teams-min-severity", string(notify.SeverityInfo), "The minimum severity of the notifications sent to Microsoft Teams (info, warning, error).")
+	notificationTemplate        = flag.String("notification-template", notify.DefaultTemplate, "The Go text/template of the Slack and Microsoft Teams messages.")
+	cloudEventsSink             = flag.String("cloudevents-sink", "", "An HTTP endpoint to send every scaling decision to as a CloudEvent, ex: a Knative broker or a Kafka HTTP bridge. Disabled if empty.")
+	cloudEventsSource           = flag.String("cloudevents-source", "/azp-agent-autoscaler", "The source of the CloudEvents.")
+	otlpEndpoint                = flag.String("otlp-endpoint", "", "An OpenTelemetry collector OTLP HTTP endpoint to export a trace of every autoscaling iteration to, ex: http://otel-collector:4318. Disabled if empty.")
+	otlpHeaders                 = flag.String("otlp-headers", "", "Headers to send to the OTLP endpoint, as a comma-separated list of <name>=<value>.")
+	logFormat                   = flag.String("log-format", logging.FormatText, "Log format (text, json).")
+	logSampleFirst              = flag.Int("log-sample-first", 5, "The number of times the same error or warning is logged within the log sample window before it is suppressed. The next occurrence after the window is logged with the number of times it was seen. Disabled if 0.")
+	logSampleWindow             = flag.Duration("log-sample-window", 10*time.Minute, "The window to sample repeated errors and warnings in.")
+	logFile                     = flag.String("log-file", "", "A file to append the logs to instead of stderr, ex: when running as a Windows service. Disabled if empty.")
+	auditLog                    = flag.String("audit-log", "", "A file to write a JSON record of every scaling decision and failed cycle to. Use - for stdout. Disabled if empty.")
+	min                         = flag.Int("min", 1, "Minimum number of free agents to keep alive. Minimum of 1.")
+	max                         = flag.Int("max", 100, "Maximum number of agents allowed.")
+	rate                        = flag.Duration("rate", 10*time.Second, "Duration to check the number of agents.")
+	rateMin                     = flag.Duration("rate-min", 0, "The shortest duration to check the number of agents, used while there are queued jobs or the agents are being scaled. Defaults to the rate.")
+	rateMax                     = flag.Duration("rate-max", 0, "The longest duration to check the number of agents, which the rate grows to while the agents are idle. Defaults to the rate.")
+	concurrency                 = flag.Int("concurrency", 4, "The maximum number of workloads that are autoscaled concurrently. The workloads of an agent pool are autoscaled one at a time.")
+	shards                      = flag.Int("shards", 1, "The number of autoscaler replicas the agent pools are spread across. Each replica only autoscales the agent pools that hash to its shard.")
+	shard                       = flag.Int("shard", -1, "The shard of this replica, from 0 to the number of shards - 1. Defaults to the StatefulSet ordinal at the end of the hostname.")
+	ownership                   = flag.Bool("ownership", false, "Claim the workloads with the azp-agent-autoscaler/owner annotation, and don't autoscale a workload that another autoscaler or AzpAgentAutoscaler resource claimed until its claim expires.")
+	ownerID                     = flag.String("owner-id", "", "The identity this autoscaler claims the workloads with. It must be the same for every replica and restart of the autoscaler. Defaults to the hostname.")
+	ownershipLease              = flag.Duration("ownership-lease", time.Minute, "How long a claim on a workload lasts without being renewed, after which another autoscaler can claim the workload.")
+	scaleDownDelay              = flag.Duration("scale-down", 30*time.Second, "Wait time after scaling down to scale down again.")
+	scaleDownIdle               = flag.Duration("scale-down-delay", 0, "How long an agent must be idle, since its last job finished or its pod started, before its pod can be scaled down, so back-to-back jobs reuse it. Disabled if 0.")
+	scaleDownMax                = flag.Int("scale-down-max", 1, "Maximum allowed number of pods to scale down.")
+	drainTimeout                = flag.Duration("drain-timeout", 0, "Drain the agents of the pods a scale down removes, so they aren't assigned new jobs, and only remove the pods once their agents are idle, for up to this long. Disabled if 0.")
+	drainTimeoutPolicy          = flag.String("drain-timeout-policy", DrainTimeoutAbort, "What to do when a drained agent is still busy after the drain timeout: abort the scale down and undrain the agents, force the scale down, or retry the drain with a new timeout (abort, force, retry).")
+	drainMaxRetries             = flag.Int("drain-max-retries", 3, "How many times the retry drain-timeout-policy waits for the drained agents again, after which the scale down is aborted like the abort policy. Unlimited if 0.")
+	scaleUpSteps                = flag.String("scale-up-steps", "", "Limit each scale up by the queue depth, as a comma-separated list of <minimum queue depth>:<max agents to add>, ex: 1:1,6:5,21:10. Disabled if empty.")
+	rateLimit                   = flag.Int("rate-limit", 0, "Maximum number of scale operations within the rate-limit-window, to protect against constant scaling. Disabled if 0.")
+	rateLimitWindow             = flag.Duration("rate-limit-window", time.Hour, "The window of the rate-limit.")
+	pendingBackoff              = flag.Duration("pending-backoff", 0, "Pause scale ups for this long after agent pods were unschedulable, doubling each consecutive time. Disabled if 0.")
+	pendingBackoffMax           = flag.Duration("pending-backoff-max", 10*time.Minute, "The maximum duration scale ups are paused after agent pods were unschedulable.")
+	scheduleTimeZone            = flag.String("schedule-timezone", "", "The IANA time zone the cron schedules are evaluated in, ex: Europe/Paris, unless they have a CRON_TZ= prefix. Defaults to the time zone of the autoscaler, usually UTC.")
+	registrationTimeout         = flag.Duration("registration-timeout", 0, "After a scale up, pause scale ups if none of the new agent pods registered an online agent within this long, ex: because of a bad token or image. Disabled if 0.")
+	registrationBackoff         = flag.Duration("registration-backoff", 5*time.Minute, "Pause scale ups for this long after the new agent pods didn't register, doubling each consecutive time.")
+	registrationBackoffMax      = flag.Duration("registration-backoff-max", time.Hour, "The maximum duration scale ups are paused after the new agent pods didn't register.")
+	registrationFailures        = flag.Int("registration-failures", 1, "Pause scale ups once this many consecutive scale ups failed, because their new agent pods didn't register or are all failing.")
+	failStaticAfter             = flag.Duration("fail-static-after", 0, "Once the agents and jobs of a pool couldn't be retrieved for this long, scale its StatefulSets up to at least fail-static-min, so an outage of the CI system doesn't leave too few agents. Disabled if 0.")
+	failStaticMin               = flag.Int("fail-static-min", 0, "The minimum number of replicas of a StatefulSet once the agents and jobs of its pool couldn't be retrieved for fail-static-after.")
+	manualScalePolicy           = flag.String("manual-scale-policy", ManualScaleOverwrite, "What to do when the StatefulSet was scaled outside of the autoscaler, ex: with kubectl scale. overwrite scales it as usual, adopt keeps a manual scale up as the minimum or a manual scale down as the maximum for the manual-scale-duration, revert scales it back.")
+	manualScaleDuration         = flag.Duration("manual-scale-duration", time.Hour, "With the adopt manual-scale-policy, how long a manual scale is kept.")
+	decisionHookURL             = flag.String("decision-hook-url", "", "A URL to POST every scaling decision that scales a workload to, which can veto or adjust it. The request is signed with the webhook-secret. Disabled if empty.")
+	decisionHookTimeout         = flag.Duration("decision-hook-timeout", 5*time.Second, "The timeout of the decision hook requests.")
+	execHookTimeout             = flag.Duration("exec-hook-timeout", 30*time.Second, "How long an exec hook can run before it's killed and fails.")
+	execHookFailurePolicy       = flag.String("exec-hook-failure-policy", DecisionHookIgnore, "What to do when a pre-scale exec hook fails. ignore scales the workload anyway, fail doesn't scale it. A failed post-scale hook is only logged.")
+	decisionHookFailurePolicy   = flag.String("decision-hook-failure-policy", DecisionHookIgnore, "What to do when the decision hook fails. ignore applies the decision as if it was allowed, fail doesn't scale the workload.")
+	policy                      = flag.String("policy", PolicyQueue, "The scaling policy. queue scales to the number of queued jobs, slo scales to start jobs within the slo-max-queue-time.")
+	sloMaxQueueTime             = flag.Duration("slo-max-queue-time", 5*time.Minute, "With the slo policy, the maximum time jobs should wait for an agent.")
+	sloWindow                   = flag.Duration("slo-window", time.Hour, "With the slo policy, the window to observe the job arrival rate and average job duration.")
+	queueAgePeriod              = flag.Duration("queue-age-weight-period", 0, "Count a queued job as one more agent for every period it has been waiting. Disabled if 0.")
+	queueAgeMaxWeight           = flag.Float64("queue-age-max-weight", 3, "The maximum number of agents a single queued job can count as when weighting by queue time.")
+	countGatedJobs              = flag.Bool("count-gated-jobs", false, "Count the jobs waiting for an approval or a check as queued jobs, so agents are ready when they're approved.")
+	countDelayedJobs            = flag.Bool("count-delayed-jobs", false, "Count the jobs waiting for a delay as queued jobs once they're released within the delayed-jobs-lookahead.")
+	delayedJobsLookahead        = flag.Duration("delayed-jobs-lookahead", 5*time.Minute, "How long before a delayed job is released it's counted as a queued job. Delayed jobs without a known release time are always counted.")
+	capacityCheck               = flag.Bool("capacity-check", false, "Limit scale ups to the number of agent pods the nodes have allocatable CPU and memory for. Only the nodes matching the agents' node selector, required node affinity and tolerations are counted.")
+	capacityOvershoot           = flag.Bool("capacity-overshoot", true, "When the capacity check limits a scale up, allow scaling one pod past the capacity to trigger the cluster autoscaler.")
+	capacityQuota               = flag.Bool("capacity-quota", false, "Limit scale ups to the number of agent pods the ResourceQuotas of the agents' namespace allow, from their pod, CPU, memory and other resource limits.")
+	healthGateNodeReadyRatio    = flag.Float64("health-gate-node-ready-ratio", 0.9, "The share of the nodes that must be Ready for the nodes health gate to pass. Cordoned nodes aren't counted.")
+	healthGateRegistryURL       = flag.String("health-gate-registry-url", "", "The URL the registry health gate probes, ex: https://contoso.azurecr.io/v2/. Defaults to the /v2/ endpoint of the registry of the agent image.")
+	healthGateMaxScaleUp        = flag.Int("health-gate-max-scale-up", 1, "The most agent pods a scale up adds while a health gate fails. Scale ups are paused if 0.")
+	balloonReplicas             = flag.Int("balloon-replicas", 0, "The number of low-priority balloon pods sized like an agent to keep for each StatefulSet, so the cluster autoscaler keeps a warm node for the next scale up. Disabled if 0.")
+	balloonPriorityClass        = flag.String("balloon-priority-class", "", "The PriorityClass of the balloon pods, which must have a lower priority than the agents so they're preempted by them.")
+	balloonImage                = flag.String("balloon-image", "registry.k8s.io/pause:3.9", "The image of the balloon pods.")
+	aksSubscriptionID           = flag.String("aks-subscription-id", "", "The subscription ID of the AKS cluster whose node pool is scaled up when agent pods are unschedulable.")
+	aksResourceGroup            = flag.String("aks-resource-group", "", "The resource group of the AKS cluster.")
+	aksCluster                  = flag.String("aks-cluster", "", "The name of the AKS cluster.")
+	aksNodePool                 = flag.String("aks-node-pool", "", "The AKS node pool of the agents to scale up when agent pods are unschedulable, for clusters without the cluster autoscaler. Disabled if empty.")
+	aksClientID                 = flag.String("aks-client-id", "", "The client ID of a user-assigned managed identity to scale the node pool with. The system-assigned identity, or the workload identity of the pod, is used if empty.")
+	aksMaxNodes                 = flag.Int("aks-max-nodes", 10, "The maximum number of nodes to scale the AKS node pool to.")
+	aksPodsPerNode              = flag.Int("aks-pods-per-node", 1, "The number of agent pods that fit on a node of the AKS node pool, to calculate how many nodes to add.")
+	aksCooldown                 = flag.Duration("aks-cooldown", 5*time.Minute, "Wait time after scaling up the AKS node pool to scale it up again, while the nodes are provisioned.")
+	resourceType                = flag.String("type", "", "Resource type of the agent. StatefulSet and DeploymentConfig are supported, and Deployment with --targeted-scale-down. If empty, it's detected from the workload with the name in the namespace.")
+	resourceName                = flag.String("name", "", "The name of the StatefulSet.")
+	resourcePriority            = flag.Int("priority", 0, "The priority of the StatefulSet. Under capacity pressure, higher priority workloads are scaled up first and lower priority workloads are scaled down first.")
+	resourceNamespace           = flag.String("namespace", "", "The namespace of the StatefulSet. Defaults to the namespace of the service account when running in a Kubernetes pod.")
+	backend                     = flag.String("backend", BackendAzurePipelines, "The CI system of the agents (azure-pipelines, github, gitlab).")
+	azpToken                    = flag.String("token", "", "The Azure Devops token.")
+	azpURL                      = flag.String("url", "", "The Azure Devops URL. https://dev.azure.com/AccountName")
+	azpURLFromWorkload          = flag.Bool("url-from-workload", false, "Read the Azure Devops URL from the AZP_URL environment variable of the workloads instead of the url argument.")
+	azpTimeout                  = flag.Duration("azure-devops-timeout", 30*time.Second, "The timeout of each Azure Devops API call.")
+	azpMaxIdleConns             = flag.Int("azure-devops-max-idle-conns", 16, "The number of idle connections kept alive to Azure Devops, so the calls of the workloads autoscaled concurrently don't open new connections.")
+	azpIdleConnTimeout          = flag.Duration("azure-devops-idle-conn-timeout", 90*time.Second, "How long an idle connection to Azure Devops is kept alive. Should be longer than the rate, so the connections are reused between polls. Kept alive forever if 0.")
+	azpHTTP2                    = flag.Bool("azure-devops-http2", true, "Call Azure Devops with HTTP/2 when it's supported, which sends every call on a single connection. Disable behind a proxy that doesn't support HTTP/2.")
+	azpIPFamily                 = flag.String("azure-devops-ip-family", IPFamilyDual, "The IP family of the connections to Azure Devops. dual connects over IPv4 or IPv6, whichever is resolved and reachable, ipv4 and ipv6 only connect over one, ex: with IPv6-only egress.")
+	githubURL                   = flag.String("github-url", "https://api.github.com", "The GitHub API URL. Set to https://<hostname>/api/v3 for GitHub Enterprise Server.")
+	githubToken                 = flag.String("github-token", os.Getenv("GITHUB_TOKEN"), "The GitHub token, which needs the organization self-hosted runners (read and write) and repository actions (read) permissions. Defaults to the GITHUB_TOKEN environment variable.")
+	githubOrganization          = flag.String("github-org", "", "The GitHub organization of the runner groups.")
+	githubLabels                = flag.String("github-labels", "self-hosted", "A comma-separated list of the runners' labels. Queued jobs are counted if the runners have all of their runs-on labels.")
+	githubTimeout               = flag.Duration("github-timeout", 30*time.Second, "The timeout of each GitHub API call.")
+	gitlabURL                   = flag.String("gitlab-url", "https://gitlab.com", "The GitLab URL.")
+	gitlabToken                 = flag.String("gitlab-token", os.Getenv("GITLAB_TOKEN"), "The GitLab token, which needs the api scope and the Maintainer role of the group and projects. Defaults to the GITLAB_TOKEN environment variable.")
+	gitlabGroup                 = flag.String("gitlab-group", "", "The ID or path of the GitLab group the runners are registered in.")
+	gitlabTimeout               = flag.Duration("gitlab-timeout", 30*time.Second, "The timeout of each GitLab API call.")
+	k8sTimeout                  = flag.Duration("kubernetes-timeout", 30*time.Second, "The timeout of each Kubernetes API call. At startup, retrieving each workload, verifying it isn't scaled by another autoscaler and listing its pods also share it.")
+	missingWorkload             = flag.String("missing-workload", MissingWorkloadFail, "What to do when an agents workload doesn't exist at startup (fail, wait). With wait, the autoscaler is degraded and waits for it to be created, ex: when it's deployed with the agents.")
+	missingWorkloadTimeout      = flag.Duration("missing-workload-timeout", 10*time.Minute, "How long to wait for a missing agents workload with --missing-workload=wait before failing. Waits forever if 0.")
+	hpaCheck                    = flag.Bool("hpa-check", true, "Refuse to scale a workload targeted by a HorizontalPodAutoscaler or a KEDA ScaledObject, so the autoscalers don't fight over its replicas. Disabling it requires --acknowledge-hpa-conflicts.")
+	acknowledgeHPAConflicts     = flag.Bool("acknowledge-hpa-conflicts", false, "Acknowledge that a workload scaled by another autoscaler isn't detected without the HPA check, which allows disabling it or scoping it with --hpa-check-namespace, and logs a warning instead of failing when the service account isn't allowed to list the HorizontalPodAutoscalers or ScaledObjects.")
+	rbacScope                   = flag.String("rbac-scope", RBACScopeAuto, "The scope of the RBAC permissions of the autoscaler (auto, cluster, namespace). With namespace, the features that need cluster-wide permissions, such as the capacity check, are disabled. With auto, they're disabled if the service account isn't allowed them.")
+	keyVaultURL                 = flag.String("keyvault-url", "", "An Azure Key Vault to retrieve the Azure Devops token from with a managed identity, ex: https://myvault.vault.azure.net. Replaces the token argument.")
+	keyVaultSecret              = flag.String("keyvault-secret", "", "The name of the Key Vault secret with the Azure Devops token.")
+	keyVaultClientID            = flag.String("keyvault-client-id", "", "The client ID of a user-assigned managed identity to access the Key Vault with. The system-assigned identity, or the workload identity of the pod, is used if empty.")
+	keyVaultRefresh             = flag.Duration("keyvault-refresh", 15*time.Minute, "How often to retrieve the Azure Devops token from the Key Vault again, so a rotated token is used.")
+	vaultAddr                   = flag.String("vault-addr", "", "A HashiCorp Vault server to retrieve the Azure Devops token from with the Kubernetes auth method, ex: https://vault.example.com:8200. Replaces the token argument.")
+	vaultNamespace              = flag.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "The Vault Enterprise namespace. Defaults to the VAULT_NAMESPACE environment variable.")
+	vaultAuthPath               = flag.String("vault-auth-path", "kubernetes", "The mount path of the Vault Kubernetes auth method.")
+	vaultRole                   = flag.String("vault-role", "", "The Vault Kubernetes auth role to log in with.")
+	vaultSecretPath             = flag.String("vault-secret-path", "", "The API path of the Vault secret with the Azure Devops token, ex: secret/data/azp-agent-autoscaler for a KV version 2 engine mounted at secret.")
+	vaultSecretKey              = flag.String("vault-secret-key", "token", "The key of the Azure Devops token in the Vault secret.")
+	vaultRefresh                = flag.Duration("vault-refresh", 5*time.Minute, "How often to retrieve the Azure Devops token from Vault again and renew the Vault token. Should be less than half of the Vault token TTL.")
+	port                        = flag.Int("port", 10101, "The port to serve health checks and metrics.")
+	events                      = flag.Bool("events", true, "Create Kubernetes events on the StatefulSet when it is scaled, scaling fails or scaling is blocked.")
+	adminPort                   = flag.Int("admin-port", 0, "A port to serve the admin API and dashboard on, to pause, resume and force scale the agents at runtime. Disabled if 0.")
+	adminToken                  = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "The bearer token required by the admin API. Defaults to the ADMIN_TOKEN environment variable.")
+	debugPort                   = flag.Int("debug-port", 0, "A port to serve pprof profiles and goroutine dumps on at /debug/pprof/. Disabled if 0.")
+	metricsToken                = flag.String("metrics-token", os.Getenv("METRICS_TOKEN"), "A bearer token required by the metrics and status endpoints and pprof. The health checks don't require it. Defaults to the METRICS_TOKEN environment variable. Not required if empty.")
+	tlsCert                     = flag.String("tls-cert", "", "A TLS certificate file to serve the health checks, metrics, pprof, admin API and KEDA external scaler over HTTPS with. It's reloaded when the file changes. Served over HTTP if empty.")
+	tlsKey                      = flag.String("tls-key", "", "The TLS private key file of the tls-cert argument.")
+	tlsClientCA                 = flag.String("tls-client-ca", "", "A CA file to verify client certificates with. A verified client certificate is accepted instead of the metrics and admin tokens, and is required by the KEDA external scaler.")
+	safeToEvict                 = flag.Bool("safe-to-evict", false, "Annotate the agent pods with cluster-autoscaler.kubernetes.io/safe-to-evict, true if the agent is idle and false if it is running a job, so the cluster autoscaler can remove the nodes of idle agents.")
+	quarantineFailureRate       = flag.Float64("quarantine-failure-rate", 0, "Disable an agent and recycle its pod once this share of the jobs it finished since its pod started failed, ex: 0.5. Disabled if 0.")
+	quarantineMinJobs           = flag.Int("quarantine-min-jobs", 5, "The minimum number of jobs an agent must have finished since its pod started before it can be quarantined.")
+	rolloverFrom                = flag.String("rollover-from", "", "The blue workload to roll the agents over from, to the rollover-to workload. Its queued jobs and free agents move to the green workload as its agents come online, then its agents are drained and it is scaled down to zero.")
+	rolloverTo                  = flag.String("rollover-to", "", "The green workload to roll the agents over to, ex: with a new agent image.")
+	osAware                     = flag.Bool("os-aware", false, "Only count the queued jobs that demand the Agent.OS of a workload, from the kubernetes.io/os node selector of its pods, so the Windows and Linux workloads of a pool scale separately.")
+	holdRollingUpdates          = flag.Bool("hold-rolling-updates", true, "Don't scale a StatefulSet while a rolling update of its pods is in progress, so scaling doesn't interfere with an image rollout.")
+	verifyScale                 = flag.Bool("verify-scale", false, "Verify every scale with a server-side dry run before scaling, so a scale that an admission webhook or a resource quota rejects is reported with the reason of the rejection and isn't applied.")
+	targetedScaleDown           = flag.Bool("targeted-scale-down", false, "Scale down Deployments and DeploymentConfigs by deleting the pods of chosen idle agents and lowering the replicas to the remaining pods, so busy agents are never removed. Required for Deployments.")
+	drainAnnotation             = flag.Bool("drain-annotation", false, "Annotate the agent pods that a scale down removes with azp-agent-autoscaler/drain=true before scaling, so the preStop hook of the agent can deregister it.")
+	syncCapabilities            = flag.Bool("sync-capabilities", false, "Set the user capabilities of the agents to the capabilities declared in the capability.azp-agent-autoscaler/<name> labels and annotations of their pods.")
+	agentNamePattern            = flag.String("agent-name-pattern", "", "How the agent names map to the pod names, for agents that aren't named after their pod: a template with the {{workload}}, {{ordinal}} and {{pod}} placeholders, ex: {{workload}}-{{ordinal}} or ci-{{pod}}, or a regular expression with a pod or ordinal named group. The other agents keep the pod name reported by the CI system.")
+	removeDuplicateAgents       = flag.Bool("remove-duplicate-agents", false, "Deregister the offline agents registered with the pod name of another agent of the workload, which a pod that restarted without replacing its agent leaves behind. They're never counted as the agents of their pod.")
+	recycleOutdated             = flag.Bool("recycle-outdated-agents", false, "Delete the pods of idle agents with an older version than the newest agent of the pool, or than min-agent-version, so they're recreated with the current agent version.")
+	recycleOutdatedPods         = flag.Bool("recycle-outdated-pods", false, "Delete the pods of idle agents that don't have the updated pod template of a StatefulSet with the OnDelete update strategy, so they're recreated with it.")
+	minAgentVersion             = flag.String("min-agent-version", "", "The agent version to recycle older agents to, instead of the newest version in the pool.")
+	recycleAfterJobs            = flag.Int("recycle-after-jobs", 0, "Delete the pod of an idle agent once it has run this many jobs, so it's recreated without the state of the jobs. Disabled if 0.")
+	recycleMaxAge               = flag.Duration("recycle-max-age", 0, "Delete the pod of an idle agent once it's older than this, so it's recreated without the state of its jobs. Disabled if 0.")
+	recycleMaxUnavailable       = flag.Int("recycle-max-unavailable", 1, "The maximum number of agent pods that can be unavailable while agents are recycled.")
+	offlineAgentTimeout         = flag.Duration("offline-agent-timeout", 0, "Delete the running pod of an agent that the CI system reports as offline for this long, so it's recreated with a fresh agent. Disabled if 0.")
+	offlineAgentRateLimit       = flag.Int("offline-agent-rate-limit", 1, "The maximum number of pods of offline agents that are deleted per hour.")
+	stalePodRestarts            = flag.Int("stale-pod-restarts", 0, "Don't count the pods whose containers restarted this many times as available agents while their agent isn't online. Crash looping pods aren't counted either. Disabled if 0.")
+	stalePodNotReadyTimeout     = flag.Duration("stale-pod-not-ready-timeout", 0, "Don't count the running pods that have been not ready for this long as available agents while their agent isn't online. Crash looping pods aren't counted either. Disabled if 0.")
+	ordinalGaps                 = flag.Bool("ordinal-gaps", false, "Count the ordinals of a StatefulSet below its replicas that don't have a pod, or whose pod is terminating, as missing agents instead of available agents, so the agents they don't run are scaled up for. Reads the replicas of the StatefulSet every iteration.")
+	forceDeleteTerminatingAfter = flag.Duration("force-delete-terminating-after", 0, "Force delete the pods of a StatefulSet that are still terminating this long after their grace period ended, ex: on an unreachable node, so the StatefulSet recreates their ordinal. Requires ordinal-gaps. Disabled if 0.")
+	dryRun                      = flag.Bool("dry-run", false, "Log the scaling decisions without scaling the StatefulSet or changing anything else, so the autoscaler can observe the agents with read-only permissions.")
+	once                        = flag.Bool("once", false, "Autoscale a single time and exit, ex: to run as a Kubernetes CronJob. Exits with status 1 if autoscaling fails.")
+	output                      = flag.String("output", OutputText, "The output format of the plan, explain, validate-config and doctor subcommands and --once (text, json).")
+	probe                       = flag.Bool("probe", false, "With the validate-config subcommand, also verify that Azure Devops and Kubernetes are reachable and that the RBAC permissions are granted.")
+	migrateTo                   = flag.String("migrate-to", MigrateToConfig, "What the migrate-config subcommand prints the arguments as (config, resource). config is a --config file, and resource is an AzpAgentAutoscaler resource for each workload.")
+	operator                    = flag.Bool("operator", false, "Autoscale the workloads declared by AzpAgentAutoscaler resources in the namespace instead of the name and workload arguments.")
+	admissionWebhookPort        = flag.Int("admission-webhook-port", 0, "A port to serve the validating admission webhook of the AzpAgentAutoscaler resources on in operator mode. Disabled if 0.")
+	admissionWebhookCert        = flag.String("admission-webhook-cert", "", "The TLS certificate file of the admission webhook.")
+	admissionWebhookKey         = flag.String("admission-webhook-key", "", "The TLS private key file of the admission webhook.")
+	admissionWebhookClientCA    = flag.String("admission-webhook-client-ca", "", "A CA file to verify the client certificates of the admission webhook's requests with, if the API server is configured to send one. Client certificates aren't required if empty.")
+	kedaPort                    = flag.Int("keda-port", 0, "A port to serve the KEDA external scaler gRPC API on, so KEDA scales the agents instead of the autoscaler. The name and workload arguments aren't used. Disabled if 0.")
+	metricsAdapterPort          = flag.Int("metrics-adapter-port", 0, "A port to serve the external.metrics.k8s.io API on, so a HorizontalPodAutoscaler scales the agents instead of the autoscaler. The name and workload arguments aren't used. Disabled if 0.")
+	metricsAdapterCert          = flag.String("metrics-adapter-cert", "", "The TLS certificate file of the metrics adapter.")
+	metricsAdapterKey           = flag.String("metrics-adapter-key", "", "The TLS private key file of the metrics adapter.")
+	metricsAdapterClientCA      = flag.String("metrics-adapter-client-ca", "", "A CA file to verify the client certificates of the metrics adapter's requests with, ex: the front proxy CA of the Kubernetes API aggregator. Client certificates aren't required if empty.")
+	stateConfigMap              = flag.String("state-configmap", "", "The name of a ConfigMap in the StatefulSet's namespace to persist the scaling state to between restarts. Disabled if empty.")
+	historySize                 = flag.Int("history-size", 360, "The number of scaling decisions of each workload kept for the history endpoint and dashboard of the admin API.")
+	retryBudgetCalls            = flag.Int("retry-budget", 30, "The number of failed calls to the CI backend and Kubernetes allowed within the retry-budget-window, shared by every dependency. Once it's exhausted, autoscaling is skipped until the failed calls are out of the window. Disabled if 0.")
+	retryBudgetWindow           = flag.Duration("retry-budget-window", time.Minute, "The window the failed calls of the retry budget are counted in.")
+	anomalyWindow               = flag.Duration("anomaly-window", 0, "Report an anomaly of a workload once its pattern lasted this long, ex: jobs queued while agents are idle, or queued without the workload being scaled up. Disabled if 0.")
+	anomalyMaxPinned            = flag.Duration("anomaly-max-pinned", 2*time.Hour, "Report an anomaly once the maximum limited the scale ups of a workload for this long, with --anomaly-window.")
+	rightSizingReport           = flag.Duration("right-sizing-report", 0, "How often to log a right-sizing report of each workload, with the durations of its jobs and its busy and idle agents over the interval, and the max and scale-down-delay they suggest. Disabled if 0.")
+	storeType                   = flag.String("store", StoreConfigMap, "Where to persist the scaling state and decision history (configmap, file, redis). The state-configmap and history-configmap are the names of the files or Redis keys with file or redis.")
+	storePath                   = flag.String("store-path", defaultStorePath(), "The directory of the state and history files with --store=file, ex: a persistent volume. Defaults to %ProgramData%\\azp-agent-autoscaler on Windows.")
+	redisAddr                   = flag.String("redis-addr", "", "The host:port of the Redis server with --store=redis.")
+	redisPassword               = flag.String("redis-password", os.Getenv("REDIS_PASSWORD"), "The password of the Redis server. Defaults to the REDIS_PASSWORD environment variable.")
+	redisDB                     = flag.Int("redis-db", 0, "The Redis database number.")
+	redisKeyPrefix              = flag.String("redis-key-prefix", "azp-agent-autoscaler:", "The prefix of the Redis keys of the state and history.")
+	redisTLS                    = flag.Bool("redis-tls", false, "Connect to the Redis server with TLS.")
+	recordDir                   = flag.String("record-dir", "", "A directory to record snapshots of the agents, jobs and pods of each workload to, with the decision made from them, for the replay subcommand to replay against another scaling policy. Disabled if empty.")
+	recordInterval              = flag.Duration("record-interval", time.Minute, "How often the snapshot of each workload is recorded with --record-dir. A snapshot is recorded at most once per iteration.")
+	recordMaxSize               = flag.Int("record-max-size", 100, "The size in MiB a recording grows to before it's rotated, replacing the previous rotated recording.")
+	historyConfigMap            = flag.String("history-configmap", "", "The name of a ConfigMap in the autoscaler's namespace to persist the decision history to between restarts. Disabled if empty.")
+	maintenanceWindows          stringSliceFlag
+	demandRoutes                stringSliceFlag
+	organizations               stringSliceFlag
+	azpDNSServers               stringSliceFlag
+	capacityPriorityClasses     stringSliceFlag
+	healthGates                 stringSliceFlag
+	hpaCheckNamespaces          stringSliceFlag
+	execHooks                   stringSliceFlag
+	workloads                   stringSliceFlag
+	spotWorkloads               stringSliceFlag
+	operatorNamespaces          stringSliceFlag
+	operatorAllowedPools        stringSliceFlag
+	webhookURLs                 stringSliceFlag
+	githubRepositories          stringSliceFlag
+	gitlabProjects              stringSliceFlag
+	gitlabRunnerTags            stringSliceFlag
 )
 
+func init() {
+	flag.Var(&workloads, "workload", "An additional StatefulSet in the namespace to autoscale, as <name> or <name>:<priority>. Can be repeated.")
+	flag.Var(&spotWorkloads, "spot-workload", "A workload whose agents run on spot nodes, which is scaled up for the queued jobs of its pool before the other workloads. The other workloads of the pool only keep their minimum free agents and run the jobs the spot workload can't. Can be repeated.")
+	flag.Var(&operatorNamespaces, "operator-namespace", "A namespace to autoscale the AzpAgentAutoscaler resources of in operator mode. Can be repeated. Defaults to the namespace argument.")
+	flag.Var(&operatorAllowedPools, "operator-allowed-pools", "The agent pools the AzpAgentAutoscaler resources of a namespace can reference in operator mode, as <namespace>=<pool>,<pool>. Can be repeated. If set, the resources of namespaces without allowed pools can't reference any pool.")
+	flag.Var(&webhookURLs, "webhook-url", "A URL to POST a JSON notification to when a StatefulSet is scaled or scaling fails. Can be repeated.")
+	flag.Var(&githubRepositories, "github-repository", "A repository of the GitHub organization whose queued workflow jobs are counted. Can be repeated.")
+	flag.Var(&gitlabProjects, "gitlab-project", "The ID or path of a GitLab project whose pending jobs are counted. Can be repeated.")
+	flag.Var(&gitlabRunnerTags, "gitlab-runner-tags", "The comma-separated tags of the runners of a workload, which are its agent pool. Can be repeated.")
+	flag.Var(&demandRoutes, "demand-route", "The workloads that run the jobs with a demand, as <demand>=<workload>,<workload>, ex: gpu=azp-agent-gpu. The queued jobs with the demand are only counted by these workloads. Can be repeated.")
+	flag.Var(&organizations, "organization", "An additional Azure Devops organization, as <URL>=<environment variable of its token>, ex: https://dev.azure.com/contoso=AZP_TOKEN_CONTOSO. The workloads whose AZP_URL environment variable is its URL are autoscaled with its agent pools. Can be repeated.")
+	flag.Var(&azpDNSServers, "azure-devops-dns-server", "A DNS server that resolves the Azure Devops hosts instead of the resolvers of the system, as <IP> or <IP>:<port>, ex: a corporate resolver. Can be repeated, and the servers are used in turn.")
+	flag.Var(&capacityPriorityClasses, "capacity-priority-class", "How the capacity check treats the agents of a PriorityClass, as <priority class>=<preempt|ignore>. With preempt, the requests of the pods with a lower priority are available to the agents, and with ignore, their scale ups aren't limited by the capacity. Can be repeated.")
+	flag.Var(&healthGates, "health-gate", "A cluster health check that must pass before scaling up by more than the health-gate-max-scale-up, to not add load to an ongoing cluster incident: nodes, metrics-server or registry. Can be repeated.")
+	flag.Var(&hpaCheckNamespaces, "hpa-check-namespace", "A namespace whose workloads the HPA check verifies, the workloads of the other namespaces aren't. Requires --acknowledge-hpa-conflicts. Can be repeated. Every namespace is checked if not set.")
+	flag.Var(&execHooks, "exec-hook", "A command to run before or after a workload is scaled, as <event>=<command> <arguments>, where the event is pre-scale-up, post-scale-up, pre-scale-down or post-scale-down. The arguments are separated by spaces and aren't run in a shell. The details of the decision are in AZP_AUTOSCALER_ environment variables. Can be repeated, and the hooks of an event run in order.")
+	flag.Var(&maintenanceWindows, "maintenance-window", "A window during which no scaling actions are performed, either <RFC3339 start>/<RFC3339 end> or <cron expression>|<duration>, ex: 0 2 * * 6|4h or CRON_TZ=Europe/Paris 0 2 * * 6|4h. Overlapping windows are merged. Can be repeated.")
+}
+
+// stringSliceFlag is a flag that can be repeated
+type stringSliceFlag []string
+
+func (f *stringSliceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringSliceFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+const (
+	// BackendAzurePipelines scales Azure Pipelines agents
+	BackendAzurePipelines = "azure-pipelines"
+	// BackendGitHub scales GitHub Actions self-hosted runners
+	BackendGitHub = "github"
+	// BackendGitLab scales GitLab runners
+	BackendGitLab = "gitlab"
+)
+
+const (
+	// StoreConfigMap persists the state and history to ConfigMaps
+	StoreConfigMap = "configmap"
+	// StoreFile persists the state and history to files, ex: on a persistent volume
+	StoreFile = "file"
+	// StoreRedis persists the state and history to a Redis server
+	StoreRedis = "redis"
+)
+
+const (
+	// MissingWorkloadFail fails the startup when an agents workload doesn't exist
+	MissingWorkloadFail = "fail"
+	// MissingWorkloadWait waits for a missing agents workload to be created
+	MissingWorkloadWait = "wait"
+)
+
+const (
+	// RBACScopeAuto detects whether the service account is allowed the cluster-wide permissions at startup
+	RBACScopeAuto = "auto"
+	// RBACScopeCluster requires the cluster-wide permissions of the enabled features, granted by a ClusterRole
+	RBACScopeCluster = "cluster"
+	// RBACScopeNamespace only uses the permissions a Role can grant, and disables the features that need cluster-wide ones
+	RBACScopeNamespace = "namespace"
+)
+
+const (
+	// OutputText prints human-readable output
+	OutputText = "text"
+	// OutputJSON prints a JSON object, for scripts and pipelines
+	OutputJSON = "json"
+)
+
+const (
+	// MigrateToConfig migrates the arguments to a --config file
+	MigrateToConfig = "config"
+	// MigrateToResource migrates the arguments to AzpAgentAutoscaler resources for operator mode
+	MigrateToResource = "resource"
+)
+
+// ServiceAccountNamespaceFile is mounted in every pod with a service account token. It's a variable so the default
+// namespace can be tested outside of a pod.
+var ServiceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// serviceAccountNamespace returns the namespace of the pod's service account, or an empty string when not running in a pod
+func serviceAccountNamespace() string {
+	namespace, err := ioutil.ReadFile(ServiceAccountNamespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(namespace))
+}
+
+// kubernetesNamespace returns the namespace of the workloads. The service account's namespace is only read if the
+// argument isn't set, when the args are resolved rather than when the flags are defined.
+func kubernetesNamespace() string {
+	if *resourceNamespace != "" {
+		return *resourceNamespace
+	}
+	return serviceAccountNamespace()
+}
+
+// defaultStorePath returns the directory of the file store, which is under %ProgramData% on Windows
+func defaultStorePath() string {
+	if runtime.GOOS == "windows" {
+		if programData := os.Getenv("ProgramData"); programData != "" {
+			return filepath.Join(programData, "azp-agent-autoscaler")
+		}
+	}
+	return "/var/lib/azp-agent-autoscaler"
+}
+
 // Args holds all of the program arguments
 type Args struct {
 	Min  int32
 	Max  int32
 	Rate time.Duration
+	// RateMin is the rate while there are queued jobs or the agents are being scaled, or the rate if 0
+	RateMin time.Duration
+	// RateMax is the rate the rate grows to while the agents are idle, or the rate if 0
+	RateMax time.Duration
+	// Concurrency is the maximum number of workloads that are autoscaled concurrently
+	Concurrency int32
+
+	// DryRun logs the scaling decisions instead of applying them
+	DryRun bool
+
+	// Once autoscales a single time and exits
+	Once bool
+	// Output is the output format of the CLI subcommands and --once
+	Output string
+	// Probe verifies the connectivity and permissions in the validate-config subcommand
+	Probe bool
+	// MigrateTo is what the migrate-config subcommand prints the arguments as
+	MigrateTo string
+
+	// ConfigFile is the path of the --config file, if there is one
+	ConfigFile string
+	// Events creates Kubernetes events for scaling operations
+	Events bool
+	// SafeToEvict manages the cluster autoscaler safe-to-evict annotation of the agent pods
+	SafeToEvict bool
+	// DemandRoutes are the workloads that count the queued jobs with each demand, by lowercase demand name
+	DemandRoutes map[string][]string
+	// OSAware splits the queued jobs of a pool between its workloads by their Agent.OS demand
+	OSAware bool
+	// HoldRollingUpdates doesn't scale the workloads while their pods are being updated
+	HoldRollingUpdates bool
+	// VerifyScale verifies every scale with a server-side dry run before scaling
+	VerifyScale bool
+	// DrainAnnotation annotates the agent pods that a scale down removes
+	DrainAnnotation bool
+	// TargetedScaleDown deletes the pods of idle agents before lowering the replicas of Deployments and DeploymentConfigs
+	TargetedScaleDown bool
+	// SyncCapabilities sets the user capabilities of the agents from the labels and annotations of their pods
+	SyncCapabilities bool
+	// AgentNames maps the names of the agents to the names of their pods, if they aren't named after their pod
+	AgentNames ci.AgentNamePattern
+	// RemoveDuplicateAgents deregisters the stale agents registered with the pod name of another agent
+	RemoveDuplicateAgents bool
+	// RightSizingReport is how often the right-sizing report of each workload is logged, or 0 if it's disabled
+	RightSizingReport time.Duration
+	// Anomalies reports the patterns of the queue and replicas that usually mean a CI capacity incident
+	Anomalies AnomaliesArgs
+	// Recycle recreates the pods of outdated, overused and old agents
+	Recycle RecycleArgs
+	// OfflineAgents recreates the running pods of offline agents
+	OfflineAgents OfflineAgentsArgs
+	// StalePods excludes the broken agent pods from the available agents
+	StalePods StalePodsArgs
+	// OrdinalGaps excludes the missing and terminating pods of a StatefulSet from the available agents
+	OrdinalGaps OrdinalGapsArgs
+	// Quarantine disables and recycles the agents whose jobs keep failing
+	Quarantine QuarantineArgs
+	// Rollover moves the agents of a workload to another workload
+	Rollover RolloverArgs
+
+	ScaleDown      ScaleDownArgs
+	ScaleUp        ScaleUpArgs
+	RateLimit      RateLimitArgs
+	PendingBackoff PendingBackoffArgs
+	Registration   RegistrationArgs
+	ManualScale    ManualScaleArgs
+	DecisionHook   DecisionHookArgs
+	ExecHooks      ExecHookArgs
+	FailStatic     FailStaticArgs
+	Policy         PolicyArgs
+	QueueAge       QueueAgeArgs
+	WaitingJobs    WaitingJobsArgs
+	Capacity       CapacityArgs
+	HealthGates    HealthGateArgs
+	Balloon        BalloonArgs
+	Logging        LoggingArgs
+	Tracing        TracingArgs
+	AzureMonitor   AzureMonitorArgs
+	CloudEvents    CloudEventsArgs
+	Notifications  NotificationArgs
+	Kubernetes     KubernetesArgs
+	HPACheck       HPACheckArgs
+	// Backend is the CI system of the agents, ex: BackendAzurePipelines
+	Backend        string
+	AZD            AzureDevopsArgs
+	GitHub         GitHubArgs
+	GitLab         GitLabArgs
+	Health         HealthArgs
+	TLS            TLSArgs
+	Sharding       ShardingArgs
+	Ownership      OwnershipArgs
+	State          StateArgs
+	Store          StoreArgs
+	History        HistoryArgs
+	Record         RecordArgs
+	RetryBudget    RetryBudgetArgs
+	Maintenance    MaintenanceArgs
+	Admin          AdminArgs
+	Operator       OperatorArgs
+	KEDA           KEDAArgs
+	MetricsAdapter MetricsAdapterArgs
+	AKS            AKSArgs
+}
+
+// ExternallyScaled returns true if KEDA or a HorizontalPodAutoscaler scales the agents with the metrics
+// the autoscaler serves, instead of the autoscaler
+func (a Args) ExternallyScaled() bool {
+	return a.KEDA.Port != 0 || a.MetricsAdapter.Port != 0
+}
 
-	ScaleDown  ScaleDownArgs
-	Logging    LoggingArgs
-	Kubernetes KubernetesArgs
-	AZD        AzureDevopsArgs
-	Health     HealthArgs
+// MigratesToResource returns true if the migrate-config subcommand prints AzpAgentAutoscaler resources instead of a config file
+func (a Args) MigratesToResource() bool {
+	return a.MigrateTo == MigrateToResource
+}
+
+// NamespaceScoped returns the args with the features that need cluster-wide RBAC permissions disabled, and the
+// arguments of the features that were disabled
+func (a Args) NamespaceScoped() (Args, []string) {
+	var disabled []string
+	if a.Capacity.Enabled {
+		a.Capacity.Enabled = false
+		disabled = append(disabled, "--capacity-check")
+	}
+	if a.HealthGates.ChecksNodes() {
+		gates := make([]string, 0, len(a.HealthGates.Gates)-1)
+		for _, gate := range a.HealthGates.Gates {
+			if gate != HealthGateNodes {
+				gates = append(gates, gate)
+			}
+		}
+		a.HealthGates.Gates = gates
+		disabled = append(disabled, "--health-gate="+HealthGateNodes)
+	}
+	return a, disabled
+}
+
+// ManagesAgents returns true if a feature changes the agents registered in the CI system, which needs a token allowed to
+// manage the agent pools: disabling, deleting or setting the capabilities of agents
+func (a Args) ManagesAgents() bool {
+	return a.Quarantine.Enabled() || a.SyncCapabilities || a.RemoveDuplicateAgents || a.Rollover.From != "" || a.ScaleDown.DrainTimeout > 0
+}
+
+// WithoutAgentManagement returns the args with the features that need to manage the agents disabled, and the flags of
+// the disabled features, for a token that isn't allowed to. The rollover isn't disabled, as the agents it can't disable
+// still stop being assigned jobs as they're scaled down.
+func (a Args) WithoutAgentManagement() (Args, []string) {
+	var disabled []string
+	if a.Quarantine.Enabled() {
+		a.Quarantine.FailureRate = 0
+		disabled = append(disabled, "--quarantine-failure-rate")
+	}
+	if a.SyncCapabilities {
+		a.SyncCapabilities = false
+		disabled = append(disabled, "--sync-capabilities")
+	}
+	if a.RemoveDuplicateAgents {
+		a.RemoveDuplicateAgents = false
+		disabled = append(disabled, "--remove-duplicate-agents")
+	}
+	if a.ScaleDown.DrainTimeout > 0 {
+		a.ScaleDown.DrainTimeout = 0
+		disabled = append(disabled, "--drain-timeout")
+	}
+	return a, disabled
 }
 
 // ScaleDownArgs holds all of the scale-down related args
 type ScaleDownArgs struct {
 	Delay time.Duration
 	Max   int32
+
+	// IdleDelay is how long after an agent's last job finished before it can be scaled down
+	IdleDelay time.Duration
+
+	// DrainTimeout is how long the drained agents of the pods a scale down removes can stay busy, disabled if 0
+	DrainTimeout time.Duration
+	// DrainTimeoutPolicy is what happens when a drained agent is still busy after the drain timeout, ex: DrainTimeoutAbort
+	DrainTimeoutPolicy string
+	// DrainMaxRetries is how many times DrainTimeoutRetry waits for the drained agents again before aborting, unlimited if 0
+	DrainMaxRetries int32
+}
+
+const (
+	// DrainTimeoutAbort cancels the scale down and undrains the agents
+	DrainTimeoutAbort = "abort"
+	// DrainTimeoutForce removes the pods of the busy agents, which cancels their jobs
+	DrainTimeoutForce = "force"
+	// DrainTimeoutRetry keeps the agents drained and waits for them for another drain timeout
+	DrainTimeoutRetry = "retry"
+)
+
+// IsDrainForced returns true if the pods of the drained agents still busy after the drain timeout are removed
+func (a ScaleDownArgs) IsDrainForced() bool {
+	return a.DrainTimeoutPolicy == DrainTimeoutForce
+}
+
+// IsDrainRetried returns true if the drained agents still busy after the drain timeout are waited for again
+func (a ScaleDownArgs) IsDrainRetried() bool {
+	return a.DrainTimeoutPolicy == DrainTimeoutRetry
+}
+
+// CanRetryDrain returns true if the drained agents are waited for again after the given number of retries
+func (a ScaleDownArgs) CanRetryDrain(retries int32) bool {
+	return a.IsDrainRetried() && (a.DrainMaxRetries == 0 || retries < a.DrainMaxRetries)
+}
+
+// IsDrainTimeoutPolicy returns true if the policy is one of the drain timeout policies, ignoring its case
+func IsDrainTimeoutPolicy(policy string) bool {
+	return strings.EqualFold(policy, DrainTimeoutAbort) || strings.EqualFold(policy, DrainTimeoutForce) || strings.EqualFold(policy, DrainTimeoutRetry)
+}
+
+// ScaleUpArgs holds all of the scale-up related args
+type ScaleUpArgs struct {
+	// Steps are sorted by MinQueueDepth
+	Steps []ScaleUpStep
+}
+
+// ScaleUpStep limits the number of agents to add when the queue depth is at least MinQueueDepth
+type ScaleUpStep struct {
+	MinQueueDepth int32
+	MaxAgents     int32
+}
+
+// MaxAgentsForQueueDepth returns the maximum number of agents to add for a queue depth, or 0 if there is no limit
+func (a ScaleUpArgs) MaxAgentsForQueueDepth(queueDepth int32) int32 {
+	maxAgents := int32(0)
+	for _, step := range a.Steps {
+		if queueDepth < step.MinQueueDepth {
+			break
+		}
+		maxAgents = step.MaxAgents
+	}
+	return maxAgents
+}
+
+// parseScaleUpSteps parses steps in the format <minimum queue depth>:<max agents to add>,...
+func parseScaleUpSteps(value string) ([]ScaleUpStep, error) {
+	var steps []ScaleUpStep
+	if strings.TrimSpace(value) == "" {
+		return steps, nil
+	}
+	for _, stepStr := range strings.Split(value, ",") {
+		var step ScaleUpStep
+		if _, err := fmt.Sscanf(strings.TrimSpace(stepStr), "%d:%d", &step.MinQueueDepth, &step.MaxAgents); err != nil {
+			return nil, fmt.Errorf("Invalid scale up step '%s', expected <minimum queue depth>:<max agents to add>", stepStr)
+		}
+		if step.MinQueueDepth < 1 || step.MaxAgents < 1 {
+			return nil, fmt.Errorf("Invalid scale up step '%s', the queue depth and agents must be at least 1", stepStr)
+		}
+		steps = append(steps, step)
+	}
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].MinQueueDepth < steps[j].MinQueueDepth
+	})
+	for i := 1; i < len(steps); i++ {
+		if steps[i].MinQueueDepth == steps[i-1].MinQueueDepth {
+			return nil, fmt.Errorf("Duplicate scale up step for queue depth %d", steps[i].MinQueueDepth)
+		}
+	}
+	return steps, nil
+}
+
+// RateLimitArgs holds all of the scale operation rate limit args
+type RateLimitArgs struct {
+	MaxScales int32
+	Window    time.Duration
+}
+
+// PendingBackoffArgs holds all of the args related to pausing scale ups after pods were unschedulable
+type PendingBackoffArgs struct {
+	Delay time.Duration
+	Max   time.Duration
+}
+
+// RegistrationArgs holds all of the args related to verifying that the agent pods of a scale up register
+type RegistrationArgs struct {
+	// Timeout is how long the new agent pods of a scale up have to register an online agent, disabled if 0
+	Timeout time.Duration
+	// Backoff is how long scale ups are paused after the new agent pods didn't register, doubling each consecutive time
+	Backoff    time.Duration
+	BackoffMax time.Duration
+	// Failures is the number of consecutive failed scale ups before scale ups are paused
+	Failures int32
+}
+
+// FailStaticArgs holds all of the args related to scaling while the CI system is unavailable
+type FailStaticArgs struct {
+	// After is how long the agents and jobs of a pool can't be retrieved before its workloads are scaled to the minimum
+	After time.Duration
+	Min   int32
+}
+
+// Enabled returns true if the workloads are scaled to the minimum while the CI system is unavailable
+func (a FailStaticArgs) Enabled() bool {
+	return a.After > 0
+}
+
+const (
+	// ManualScaleOverwrite scales a manually scaled workload as if it wasn't scaled manually
+	ManualScaleOverwrite = "overwrite"
+	// ManualScaleAdopt keeps a manual scale up as the minimum, or a manual scale down as the maximum, for a duration
+	ManualScaleAdopt = "adopt"
+	// ManualScaleRevert scales a manually scaled workload back to the replicas the autoscaler scaled it to
+	ManualScaleRevert = "revert"
+)
+
+// ManualScaleArgs holds all of the args related to workloads scaled outside of the autoscaler
+type ManualScaleArgs struct {
+	Policy string
+	// Duration is how long a manual scale is kept with the adopt policy
+	Duration time.Duration
+}
+
+// IsAdopt returns true if manual scales are kept for the duration
+func (a ManualScaleArgs) IsAdopt() bool {
+	return a.Policy == ManualScaleAdopt
+}
+
+// IsRevert returns true if manual scales are reverted
+func (a ManualScaleArgs) IsRevert() bool {
+	return a.Policy == ManualScaleRevert
+}
+
+const (
+	// DecisionHookIgnore applies a scaling decision the decision hook failed to review as if it was allowed
+	DecisionHookIgnore = "ignore"
+	// DecisionHookFail doesn't scale a workload whose scaling decision the decision hook failed to review
+	DecisionHookFail = "fail"
+)
+
+// DecisionHookArgs holds all of the args of the hook that reviews the scaling decisions
+type DecisionHookArgs struct {
+	// URL is POSTed the scaling decisions if it isn't empty
+	URL           string
+	Timeout       time.Duration
+	FailurePolicy string
+}
+
+// Enabled returns true if the scaling decisions are reviewed by the decision hook
+func (a DecisionHookArgs) Enabled() bool {
+	return a.URL != ""
+}
+
+// IsFail returns true if a workload isn't scaled when the decision hook fails
+func (a DecisionHookArgs) IsFail() bool {
+	return a.FailurePolicy == DecisionHookFail
+}
+
+const (
+	// ExecHookPreScaleUp runs before a workload is scaled up
+	ExecHookPreScaleUp = "pre-scale-up"
+	// ExecHookPostScaleUp runs after a workload is scaled up, or failed to be
+	ExecHookPostScaleUp = "post-scale-up"
+	// ExecHookPreScaleDown runs before a workload is scaled down
+	ExecHookPreScaleDown = "pre-scale-down"
+	// ExecHookPostScaleDown runs after a workload is scaled down, or failed to be
+	ExecHookPostScaleDown = "post-scale-down"
+)
+
+// ExecHook is a command run before or after a workload is scaled
+type ExecHook struct {
+	// Event is when the command runs, ex: ExecHookPreScaleUp
+	Event string
+	// Command is the executable and its arguments
+	Command []string
+}
+
+// ExecHookArgs holds all of the args of the commands run before and after the workloads are scaled
+type ExecHookArgs struct {
+	Hooks   []ExecHook
+	Timeout time.Duration
+	// FailurePolicy is what to do when a pre-scale hook fails, DecisionHookIgnore or DecisionHookFail
+	FailurePolicy string
+}
+
+// IsFail returns true if a workload isn't scaled when a pre-scale hook fails
+func (a ExecHookArgs) IsFail() bool {
+	return a.FailurePolicy == DecisionHookFail
+}
+
+// parseExecHooks parses the exec hooks in the format <event>=<command> <arguments>
+func parseExecHooks(values []string) ([]ExecHook, error) {
+	var hooks []ExecHook
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		event := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || len(strings.Fields(parts[1])) == 0 {
+			return nil, fmt.Errorf("Invalid exec hook '%s', the format is <event>=<command> <arguments>", value)
+		}
+		if event != ExecHookPreScaleUp && event != ExecHookPostScaleUp && event != ExecHookPreScaleDown && event != ExecHookPostScaleDown {
+			return nil, fmt.Errorf("Unknown exec hook event %s, it must be %s, %s, %s or %s", event, ExecHookPreScaleUp, ExecHookPostScaleUp, ExecHookPreScaleDown, ExecHookPostScaleDown)
+		}
+		hooks = append(hooks, ExecHook{Event: event, Command: strings.Fields(parts[1])})
+	}
+	return hooks, nil
+}
+
+const (
+	// PolicyQueue scales the agents to the number of queued jobs
+	PolicyQueue = "queue"
+	// PolicySLO scales the agents to start jobs within a maximum queue time
+	PolicySLO = "slo"
+)
+
+// PolicyArgs holds all of the scaling policy related args
+type PolicyArgs struct {
+	Mode string
+	SLO  SLOArgs
+}
+
+// IsSLO returns true if the SLO policy is used
+func (a PolicyArgs) IsSLO() bool {
+	return a.Mode == PolicySLO
+}
+
+// SLOArgs holds all of the args of the SLO policy
+type SLOArgs struct {
+	MaxQueueTime time.Duration
+	Window       time.Duration
+}
+
+// QueueAgeArgs holds all of the args related to weighting queued jobs by their queue time
+type QueueAgeArgs struct {
+	WeightPeriod time.Duration
+	MaxWeight    float64
+}
+
+// WaitingJobsArgs holds all of the args related to counting the jobs that aren't queued yet as demand
+type WaitingJobsArgs struct {
+	// Gated counts the jobs waiting for an approval or a check
+	Gated bool
+	// Delayed counts the jobs waiting for a delay
+	Delayed bool
+	// Lookahead is how long before a delayed job is released it's counted
+	Lookahead time.Duration
+}
+
+// CapacityArgs holds all of the cluster capacity check related args
+type CapacityArgs struct {
+	Enabled   bool
+	Overshoot bool
+	// Quota limits the scale ups to the agent pods the ResourceQuotas of their namespace allow
+	Quota bool
+	// PriorityClasses are how the capacity of the agents of each PriorityClass is checked, by PriorityClass name
+	PriorityClasses map[string]string
+}
+
+const (
+	// CapacityPreempt counts the requests of the pods with a lower priority than the agents as capacity, as the scheduler preempts them
+	CapacityPreempt = "preempt"
+	// CapacityIgnore doesn't limit the scale ups of the agents by the capacity
+	CapacityIgnore = "ignore"
+)
+
+// PriorityClassPolicy returns how the capacity of agents with the PriorityClass is checked, or an empty string if they
+// are only limited by the free capacity
+func (a CapacityArgs) PriorityClassPolicy(priorityClassName string) string {
+	if priorityClassName == "" {
+		return ""
+	}
+	return a.PriorityClasses[priorityClassName]
+}
+
+// Checks returns true if the scale ups of the agents with the PriorityClass are limited by the capacity
+func (a CapacityArgs) Checks(priorityClassName string) bool {
+	return a.Enabled && a.PriorityClassPolicy(priorityClassName) != CapacityIgnore
+}
+
+// Preempts returns true if the agents of any PriorityClass preempt the pods with a lower priority
+func (a CapacityArgs) Preempts() bool {
+	for _, policy := range a.PriorityClasses {
+		if policy == CapacityPreempt {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthGateArgs holds all of the cluster health gate related args
+type HealthGateArgs struct {
+	// Gates are the health checks that must pass before a scale up larger than MaxScaleUp
+	Gates []string
+	// NodeReadyRatio is the share of the uncordoned nodes that must be Ready
+	NodeReadyRatio float64
+	// RegistryURL is the URL the registry gate probes, or empty to probe the registry of the agent image
+	RegistryURL string
+	// MaxScaleUp is the most pods a scale up adds while a gate fails
+	MaxScaleUp int32
+}
+
+const (
+	// HealthGateNodes checks the share of the nodes that are Ready
+	HealthGateNodes = "nodes"
+	// HealthGateMetricsServer checks that the metrics API of the metrics-server is available
+	HealthGateMetricsServer = "metrics-server"
+	// HealthGateRegistry probes the registry of the agent image
+	HealthGateRegistry = "registry"
+)
+
+// Enabled returns true if there are health gates
+func (a HealthGateArgs) Enabled() bool {
+	return len(a.Gates) > 0
+}
+
+// Checks returns true if the health gate is enabled
+func (a HealthGateArgs) Checks(gate string) bool {
+	for _, g := range a.Gates {
+		if g == gate {
+			return true
+		}
+	}
+	return false
+}
+
+// ChecksNodes returns true if the nodes health gate is enabled, which lists the nodes of the cluster
+func (a HealthGateArgs) ChecksNodes() bool {
+	return a.Checks(HealthGateNodes)
+}
+
+// BalloonArgs holds all of the overprovisioning balloon pod related args
+type BalloonArgs struct {
+	// Replicas is the number of balloon pods of each workload, disabled if 0
+	Replicas      int32
+	PriorityClass string
+	Image         string
+}
+
+// RecycleArgs holds all of the agent recycling related args
+type RecycleArgs struct {
+	// Outdated recycles the agents with an older version
+	Outdated bool
+	// MinVersion is the version agents are recycled to, the newest version in the pool if empty
+	MinVersion string
+	// OutdatedPods recycles the pods with an outdated pod template of a StatefulSet with the OnDelete update strategy
+	OutdatedPods bool
+	// AfterJobs is the number of jobs an agent can run before it's recycled, disabled if 0
+	AfterJobs int32
+	// MaxAge is the age of a pod after which its agent is recycled, disabled if 0
+	MaxAge time.Duration
+	// MaxUnavailable is the maximum number of pods that can be unavailable while recycling
+	MaxUnavailable int32
+}
+
+// Enabled returns true if any agents are recycled
+func (a RecycleArgs) Enabled() bool {
+	return a.Outdated || a.OutdatedPods || a.AfterJobs > 0 || a.MaxAge > 0
+}
+
+// OfflineAgentsArgs holds all of the offline agent replacement related args
+type OfflineAgentsArgs struct {
+	// Timeout is how long an agent can be offline while its pod is running before the pod is deleted, disabled if 0
+	Timeout time.Duration
+	// RateLimit is the maximum number of pods deleted per hour
+	RateLimit int32
+}
+
+// StalePodsArgs holds all of the stale agent pod related args
+type StalePodsArgs struct {
+	// Restarts is how many times the containers of a pod can restart before it's stale, disabled if 0
+	Restarts int32
+	// NotReadyTimeout is how long a running pod can be not ready before it's stale, disabled if 0
+	NotReadyTimeout time.Duration
+}
+
+// Enabled returns true if the stale pods are excluded from the available agents
+func (a StalePodsArgs) Enabled() bool {
+	return a.Restarts > 0 || a.NotReadyTimeout > 0
+}
+
+// OrdinalGapsArgs holds all of the StatefulSet ordinal gap related args
+type OrdinalGapsArgs struct {
+	// Enabled counts the ordinals below the replicas without a pod that isn't terminating as missing agents
+	Enabled bool
+	// ForceDeleteAfter is how long a pod can be terminating after its grace period ended before it's force deleted,
+	// disabled if 0
+	ForceDeleteAfter time.Duration
+}
+
+// AnomaliesArgs holds all of the anomaly detection related args
+type AnomaliesArgs struct {
+	// Window is how long the pattern of an anomaly lasts before it's reported, disabled if 0
+	Window time.Duration
+	// MaxPinned is how long the maximum limits the scale ups before it's reported
+	MaxPinned time.Duration
+}
+
+// Enabled returns true if the anomalies are detected
+func (a AnomaliesArgs) Enabled() bool {
+	return a.Window > 0
+}
+
+// QuarantineArgs holds all of the failing agent quarantine related args
+type QuarantineArgs struct {
+	// FailureRate is the share of failed jobs an agent is quarantined at, disabled if 0
+	FailureRate float64
+	// MinJobs is the minimum number of finished jobs before an agent can be quarantined
+	MinJobs int32
+}
+
+// Enabled returns true if failing agents are quarantined
+func (a QuarantineArgs) Enabled() bool {
+	return a.FailureRate > 0
+}
+
+// RolloverArgs holds all of the blue/green rollover related args
+type RolloverArgs struct {
+	// From is the name of the blue workload, the rollover is disabled if it is empty
+	From string
+	// To is the name of the green workload
+	To string
 }
 
 // LoggingArgs holds all of the logging related args
 type LoggingArgs struct {
 	Level log.Level
+	// ComponentLevels overrides the level of individual components
+	ComponentLevels map[string]log.Level
+	Format          string
+	// File is appended to instead of stderr if set
+	File     string
+	AuditLog string
+
+	// SampleFirst is the number of times the same error is logged within the SampleWindow
+	SampleFirst  int
+	SampleWindow time.Duration
+}
+
+// parseLogLevels parses component log levels in the format <component>=<level>,...
+func parseLogLevels(value string) (map[string]log.Level, error) {
+	levels := make(map[string]log.Level)
+	if strings.TrimSpace(value) == "" {
+		return levels, nil
+	}
+	for _, componentLevel := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(componentLevel), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid log level '%s', expected <component>=<level>", componentLevel)
+		}
+		known := false
+		for _, component := range logging.Components {
+			known = known || component == parts[0]
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown logging component %s", parts[0])
+		}
+		level, err := log.ParseLevel(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		levels[parts[0]] = level
+	}
+	return levels, nil
+}
+
+// NotificationArgs holds all of the notification related args
+type NotificationArgs struct {
+	WebhookURLs   []string
+	WebhookSecret string
+
+	SlackWebhookURL  string
+	SlackMinSeverity notify.Severity
+	TeamsWebhookURL  string
+	TeamsMinSeverity notify.Severity
+	Template         *template.Template
+}
+
+// AzureMonitorArgs holds all of the Azure Monitor related args
+type AzureMonitorArgs struct {
+	ConnectionString string
+}
+
+// CloudEventsArgs holds all of the CloudEvents related args
+type CloudEventsArgs struct {
+	SinkURL string
+	Source  string
+}
+
+// TracingArgs holds all of the tracing related args
+type TracingArgs struct {
+	OTLPEndpoint string
+	OTLPHeaders  map[string]string
+}
+
+// parseHeaders parses headers in the format <name>=<value>,...
+func parseHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return headers, nil
+	}
+	for _, header := range strings.Split(value, ",") {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid header '%s', expected <name>=<value>", header)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// splitList splits a comma-separated list, removing empty values
+func splitList(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
 }
 
 // KubernetesArgs holds all of the Kubernetes related args
@@ -53,11 +1060,491 @@ type KubernetesArgs struct {
 	Type      string
 	Name      string
 	Namespace string
+
+	// Priority orders the workloads under capacity pressure, higher priorities are scaled up first
+	Priority int32
+	// AdditionalWorkloads are the other workloads of the same type in the namespace to autoscale
+	AdditionalWorkloads []WorkloadArgs
+	// SpotWorkloads are the names of the workloads whose agents run on spot nodes
+	SpotWorkloads []string
+
+	// Timeout limits each Kubernetes API call
+	Timeout time.Duration
+	// RBACScope is whether the autoscaler is allowed cluster-wide permissions, ex: RBACScopeNamespace
+	RBACScope string
+	// MissingWorkload is what to do when a workload doesn't exist at startup, ex: MissingWorkloadWait
+	MissingWorkload string
+	// MissingWorkloadTimeout is how long to wait for a missing workload, forever if 0
+	MissingWorkloadTimeout time.Duration
+}
+
+// HPACheckArgs holds all of the HorizontalPodAutoscaler and KEDA ScaledObject conflict check related args
+type HPACheckArgs struct {
+	// Disabled skips the check, so the zero value checks every namespace
+	Disabled bool
+	// Namespaces are the namespaces whose workloads are checked, every namespace if empty
+	Namespaces []string
+	// Acknowledged allows disabling and scoping the check, and makes an error listing the autoscalers a warning
+	Acknowledged bool
+}
+
+// Checks returns true if the workloads of the namespace are verified not to be scaled by another autoscaler
+func (a HPACheckArgs) Checks(namespace string) bool {
+	if a.Disabled {
+		return false
+	}
+	if len(a.Namespaces) == 0 {
+		return true
+	}
+	for _, n := range a.Namespaces {
+		if n == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkloadArgs holds the args of an additional workload
+type WorkloadArgs struct {
+	Name     string
+	Priority int32
+}
+
+// Workloads returns the args of every workload to autoscale
+func (a KubernetesArgs) Workloads() []KubernetesArgs {
+	workloads := []KubernetesArgs{{Type: a.Type, Name: a.Name, Namespace: a.Namespace, Priority: a.Priority}}
+	for _, workload := range a.AdditionalWorkloads {
+		workloads = append(workloads, KubernetesArgs{Type: a.Type, Name: workload.Name, Namespace: a.Namespace, Priority: workload.Priority})
+	}
+	return workloads
+}
+
+// IsSpot returns true if the agents of a workload run on spot nodes
+func (a KubernetesArgs) IsSpot(name string) bool {
+	for _, spotWorkload := range a.SpotWorkloads {
+		if spotWorkload == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWorkloads parses additional workloads in the format <name> or <name>:<priority>
+func parseWorkloads(values []string) ([]WorkloadArgs, error) {
+	var workloads []WorkloadArgs
+	names := map[string]bool{*resourceName: true}
+	for _, value := range values {
+		parts := strings.SplitN(strings.TrimSpace(value), ":", 2)
+		workload := WorkloadArgs{Name: parts[0]}
+		if workload.Name == "" {
+			return nil, fmt.Errorf("Invalid workload '%s', the name is required", value)
+		}
+		if len(parts) == 2 {
+			priority, err := strconv.ParseInt(parts[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid workload '%s', the priority must be an integer", value)
+			}
+			workload.Priority = int32(priority)
+		}
+		if names[workload.Name] {
+			return nil, fmt.Errorf("Duplicate workload %s", workload.Name)
+		}
+		names[workload.Name] = true
+		workloads = append(workloads, workload)
+	}
+	return workloads, nil
 }
 
 // HealthArgs holds all of the healthcheck related args
 type HealthArgs struct {
 	Port int
+	// DebugPort serves pprof if it is not 0
+	DebugPort int
+	// Token is required by the metrics and status endpoints and pprof if it is set
+	Token string
+}
+
+// TLSArgs holds the TLS args of the health, metrics, debug, admin and KEDA listeners
+type TLSArgs struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile verifies client certificates if it is set
+	ClientCAFile string
+}
+
+// Enabled returns true if the listeners are served over TLS
+func (a TLSArgs) Enabled() bool {
+	return a.CertFile != ""
+}
+
+// RetryBudgetArgs holds all of the retry budget related args
+type RetryBudgetArgs struct {
+	// Calls is the number of failed calls allowed within the window, disabled if 0
+	Calls  int
+	Window time.Duration
+}
+
+// AdminArgs holds all of the admin API related args
+type AdminArgs struct {
+	// Port serves the admin API if it is not 0
+	Port  int
+	Token string
+}
+
+// KEDAArgs holds all of the KEDA external scaler related args
+type KEDAArgs struct {
+	// Port serves the external scaler instead of autoscaling if it is not 0
+	Port int
+}
+
+// MetricsAdapterArgs holds all of the external metrics adapter related args
+type MetricsAdapterArgs struct {
+	// Port serves the external.metrics.k8s.io API instead of autoscaling if it is not 0
+	Port         int
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// AKSArgs holds all of the AKS node pool scaling related args
+type AKSArgs struct {
+	SubscriptionID string
+	ResourceGroup  string
+	Cluster        string
+	// NodePool is scaled up when agent pods are unschedulable if it is set
+	NodePool    string
+	ClientID    string
+	MaxNodes    int32
+	PodsPerNode int32
+	Cooldown    time.Duration
+}
+
+// StateArgs holds all of the state persistence related args
+type StateArgs struct {
+	ConfigMapName string
+	// Namespace is the namespace of the ConfigMap, which is the autoscaler's namespace even if a workload is in another namespace
+	Namespace string
+}
+
+// StoreArgs holds all of the args of where the state and history are persisted
+type StoreArgs struct {
+	// Type is where the state and history are persisted, ex: StoreConfigMap
+	Type string
+	// Path is the directory of the state and history files of StoreFile
+	Path  string
+	Redis RedisArgs
+}
+
+// UsesConfigMaps returns true if the state and history are persisted to ConfigMaps, the default store
+func (a StoreArgs) UsesConfigMaps() bool {
+	return a.Type == "" || a.Type == StoreConfigMap
+}
+
+// RedisArgs holds all of the args of the Redis server of StoreRedis
+type RedisArgs struct {
+	Address  string
+	Password string
+	DB       int
+	// KeyPrefix prefixes the names of the state and history
+	KeyPrefix string
+	TLS       bool
+}
+
+// ShardingArgs holds all of the sharding related args
+type ShardingArgs struct {
+	// Shards is the number of autoscaler replicas, or 1 if the autoscaler isn't sharded
+	Shards int
+	// Shard is the shard of this replica, from 0 to Shards - 1
+	Shard int
+}
+
+// Enabled returns true if the agent pools are spread across several replicas
+func (a ShardingArgs) Enabled() bool {
+	return a.Shards > 1
+}
+
+// Owns returns true if this replica autoscales the agent pool or AzpAgentAutoscaler resource with the key
+func (a ShardingArgs) Owns(key string) bool {
+	if !a.Enabled() {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32()%uint32(a.Shards)) == a.Shard
+}
+
+// ConfigMapName returns the name of a ConfigMap of this replica, suffixed with the shard so the replicas don't overwrite each other's data
+func (a ShardingArgs) ConfigMapName(name string) string {
+	if !a.Enabled() || name == "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", name, a.Shard)
+}
+
+// MinRate returns the rate while there are queued jobs or the agents are being scaled
+func (a Args) MinRate() time.Duration {
+	if a.RateMin > 0 {
+		return a.RateMin
+	}
+	return a.Rate
+}
+
+// MaxRate returns the rate while the agents are idle
+func (a Args) MaxRate() time.Duration {
+	if a.RateMax > 0 {
+		return a.RateMax
+	}
+	return a.Rate
+}
+
+// ownerIDOrHostname returns the owner ID argument, or the hostname if it isn't set
+func ownerIDOrHostname(value string) string {
+	if value != "" {
+		return value
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// parseShard returns the shard argument, or the StatefulSet ordinal at the end of the hostname if it isn't set
+func parseShard(value int) (int, error) {
+	if value >= 0 {
+		return value, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+	ordinal, err := strconv.Atoi(hostname[strings.LastIndex(hostname, "-")+1:])
+	if err != nil || ordinal < 0 {
+		return 0, fmt.Errorf("hostname %s doesn't end with a StatefulSet ordinal", hostname)
+	}
+	return ordinal, nil
+}
+
+// OwnershipArgs holds all of the workload ownership related args
+type OwnershipArgs struct {
+	// Enabled claims the workloads with the owner annotation, and doesn't autoscale the workloads claimed by another owner
+	Enabled bool
+	// Owner is the identity the workloads are claimed with
+	Owner string
+	// Lease is how long a claim lasts without being renewed
+	Lease time.Duration
+}
+
+// HistoryArgs holds all of the decision history related args
+type HistoryArgs struct {
+	// Size is the number of decisions kept per workload
+	Size          int
+	ConfigMapName string
+	// Namespace is the namespace of the ConfigMap, which is the autoscaler's namespace
+	Namespace string
+}
+
+// RecordArgs holds all of the snapshot recording related args
+type RecordArgs struct {
+	// Dir is the directory of the recordings, disabled if empty
+	Dir string
+	// Interval is how often the snapshot of each workload is recorded
+	Interval time.Duration
+	// MaxSize is the size in bytes a recording is rotated at
+	MaxSize int64
+}
+
+// OperatorArgs holds all of the operator mode related args
+type OperatorArgs struct {
+	// Enabled autoscales the workloads of AzpAgentAutoscaler resources instead of the workload arguments
+	Enabled bool
+	// Namespaces are the namespaces of the AzpAgentAutoscaler resources to autoscale. Use Args.OperatorNamespaces, which defaults them.
+	Namespaces []string
+	// AllowedPools are the agent pools the resources of each namespace can reference. All pools are allowed if it is empty.
+	AllowedPools map[string][]string
+	Webhook      AdmissionWebhookArgs
+}
+
+// OperatorNamespaces returns the namespaces of the AzpAgentAutoscaler resources to autoscale in operator mode,
+// which is the namespace argument if none are set
+func (a Args) OperatorNamespaces() []string {
+	if len(a.Operator.Namespaces) == 0 {
+		return []string{a.Kubernetes.Namespace}
+	}
+	return a.Operator.Namespaces
+}
+
+// IsPoolAllowed returns true if the AzpAgentAutoscaler resources of a namespace can reference an agent pool
+func (a OperatorArgs) IsPoolAllowed(namespace string, pool string) bool {
+	if len(a.AllowedPools) == 0 {
+		return true
+	}
+	for _, allowedPool := range a.AllowedPools[namespace] {
+		if allowedPool == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAllowedPools parses the allowed pools of namespaces in the format <namespace>=<pool>,<pool>
+func parseAllowedPools(values []string) (map[string][]string, error) {
+	allowedPools := make(map[string][]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		namespace := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || namespace == "" {
+			return nil, fmt.Errorf("Invalid allowed pools '%s', the format is <namespace>=<pool>,<pool>", value)
+		}
+		for _, pool := range strings.Split(parts[1], ",") {
+			if pool = strings.TrimSpace(pool); pool != "" {
+				allowedPools[namespace] = append(allowedPools[namespace], pool)
+			}
+		}
+		if len(allowedPools[namespace]) == 0 {
+			return nil, fmt.Errorf("Invalid allowed pools '%s', at least one pool is required", value)
+		}
+	}
+	return allowedPools, nil
+}
+
+// parseDemandRoutes parses the workloads of demands in the format <demand>=<workload>,<workload>
+func parseDemandRoutes(values []string) (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		demand := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || demand == "" || strings.ContainsAny(demand, " \t") {
+			return nil, fmt.Errorf("Invalid demand route '%s', the format is <demand>=<workload>,<workload>", value)
+		}
+		for _, workload := range strings.Split(parts[1], ",") {
+			if workload = strings.TrimSpace(workload); workload != "" {
+				routes[demand] = append(routes[demand], workload)
+			}
+		}
+		if len(routes[demand]) == 0 {
+			return nil, fmt.Errorf("Invalid demand route '%s', at least one workload is required", value)
+		}
+	}
+	return routes, nil
+}
+
+// parseDNSServers parses the DNS servers in the format <IP> or <IP>:<port>, and returns them as <IP>:<port>
+func parseDNSServers(values []string) ([]string, error) {
+	var servers []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if ip := net.ParseIP(strings.Trim(value, "[]")); ip != nil {
+			servers = append(servers, net.JoinHostPort(ip.String(), "53"))
+			continue
+		}
+		host, port, err := net.SplitHostPort(value)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("Invalid DNS server '%s', the format is <IP> or <IP>:<port>", value)
+		} else if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 1 || portNumber > 65535 {
+			return nil, fmt.Errorf("Invalid DNS server '%s', %s is not a port", value, port)
+		}
+		servers = append(servers, net.JoinHostPort(host, port))
+	}
+	return servers, nil
+}
+
+// parseOrganizations parses the additional Azure Devops organizations in the format <URL>=<environment variable of its token>.
+// The tokens are read from the environment variables, so they aren't in the arguments of the process.
+func parseOrganizations(values []string) ([]OrganizationArgs, error) {
+	var parsed []OrganizationArgs
+	for _, value := range values {
+		separator := strings.LastIndex(value, "=")
+		if separator < 0 {
+			return nil, fmt.Errorf("Invalid organization '%s', the format is <URL>=<environment variable of its token>", value)
+		}
+		organizationURL := strings.TrimSuffix(strings.TrimSpace(value[:separator]), "/")
+		tokenEnvVar := strings.TrimSpace(value[separator+1:])
+		if parsedURL, err := url.Parse(organizationURL); err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+			return nil, fmt.Errorf("Invalid organization '%s', %s is not an HTTP or HTTPS URL", value, organizationURL)
+		} else if tokenEnvVar == "" {
+			return nil, fmt.Errorf("Invalid organization '%s', the environment variable of its token is required", value)
+		}
+		for _, organization := range parsed {
+			if strings.EqualFold(organization.URL, organizationURL) {
+				return nil, fmt.Errorf("Invalid organization '%s', organization %s is repeated", value, organizationURL)
+			}
+		}
+		parsed = append(parsed, OrganizationArgs{URL: organizationURL, TokenEnvVar: tokenEnvVar, Token: os.Getenv(tokenEnvVar)})
+	}
+	return parsed, nil
+}
+
+// parseHealthGates returns the lowercase health gates without duplicates
+func parseHealthGates(values []string) []string {
+	var gates []string
+	for _, value := range values {
+		gate := strings.ToLower(strings.TrimSpace(value))
+		duplicate := false
+		for _, g := range gates {
+			duplicate = duplicate || g == gate
+		}
+		if !duplicate {
+			gates = append(gates, gate)
+		}
+	}
+	return gates
+}
+
+// parseCapacityPriorityClasses parses the capacity policies of PriorityClasses in the format <priority class>=<preempt|ignore>
+func parseCapacityPriorityClasses(values []string) (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		priorityClass := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || priorityClass == "" {
+			return nil, fmt.Errorf("Invalid capacity priority class '%s', the format is <priority class>=<%s|%s>", value, CapacityPreempt, CapacityIgnore)
+		}
+		policy := strings.ToLower(strings.TrimSpace(parts[1]))
+		if policy != CapacityPreempt && policy != CapacityIgnore {
+			return nil, fmt.Errorf("Invalid capacity priority class '%s', the policy must be %s or %s", value, CapacityPreempt, CapacityIgnore)
+		}
+		policies[priorityClass] = policy
+	}
+	return policies, nil
+}
+
+// AdmissionWebhookArgs holds all of the admission webhook related args
+type AdmissionWebhookArgs struct {
+	// Port serves the admission webhook if it is not 0
+	Port     int
+	CertFile string
+	KeyFile  string
+	// ClientCAFile requires client certificates signed by it if it is set
+	ClientCAFile string
+}
+
+// MaintenanceArgs holds all of the maintenance window related args
+type MaintenanceArgs struct {
+	Windows []schedule.Window
+}
+
+// ActiveWindow returns the maintenance window active at the given time, or nil if there isn't one
+func (a MaintenanceArgs) ActiveWindow(t time.Time) schedule.Window {
+	return schedule.ActiveWindow(a.Windows, t)
+}
+
+// ActiveUntil returns when the maintenance windows active at the given time end, including the windows they overlap
+func (a MaintenanceArgs) ActiveUntil(t time.Time) time.Time {
+	return schedule.ActiveUntil(a.Windows, t)
+}
+
+func parseMaintenanceWindows(values []string, timeZone string) ([]schedule.Window, error) {
+	location, err := schedule.ParseLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+	var windows []schedule.Window
+	for _, value := range values {
+		window, err := schedule.ParseWindow(value, location)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
 }
 
 // FriendlyName returns the name used to reference the resource in the CLI, ex: deployment/myapp
@@ -69,34 +1556,450 @@ func (a KubernetesArgs) FriendlyName() string {
 type AzureDevopsArgs struct {
 	Token string
 	URL   string
+	// URLFromWorkload reads the URL from the AZP_URL environment variable of the workloads instead
+	URLFromWorkload bool
+	// Timeout limits each Azure Devops API call
+	Timeout time.Duration
+	// MaxIdleConns is the number of idle connections kept alive to Azure Devops
+	MaxIdleConns int
+	// IdleConnTimeout is how long an idle connection is kept alive, or forever if it's 0
+	IdleConnTimeout time.Duration
+	// HTTP2 calls Azure Devops with HTTP/2 when it's supported
+	HTTP2 bool
+	// IPFamily is the IP family of the connections to Azure Devops, ex: IPFamilyIPv6
+	IPFamily string
+	// DNSServers resolve the Azure Devops hosts instead of the resolvers of the system, as <IP>:<port>
+	DNSServers []string
+
+	// KeyVault retrieves the token from Azure Key Vault instead, if enabled
+	KeyVault KeyVaultArgs
+	// Vault retrieves the token from HashiCorp Vault instead, if enabled
+	Vault VaultArgs
+	// Organizations are the additional organizations, whose workloads are autoscaled with their own token
+	Organizations []OrganizationArgs
+}
+
+const (
+	// IPFamilyDual connects to Azure Devops over IPv4 or IPv6
+	IPFamilyDual = "dual"
+	// IPFamilyIPv4 only connects to Azure Devops over IPv4
+	IPFamilyIPv4 = "ipv4"
+	// IPFamilyIPv6 only connects to Azure Devops over IPv6
+	IPFamilyIPv6 = "ipv6"
+)
+
+// OrganizationArgs is an additional Azure Devops organization. Its workloads are those whose AZP_URL environment variable is its URL.
+type OrganizationArgs struct {
+	URL string
+	// TokenEnvVar is the environment variable the token is read from
+	TokenEnvVar string
+	Token       string
+}
+
+// Organization returns the additional organization of the Azure Devops URL, or nil if it is the URL of the main organization
+func (a AzureDevopsArgs) Organization(azdURL string) *OrganizationArgs {
+	azdURL = strings.TrimSuffix(azdURL, "/")
+	for i, organization := range a.Organizations {
+		if strings.EqualFold(organization.URL, azdURL) {
+			return &a.Organizations[i]
+		}
+	}
+	return nil
+}
+
+// GitHubArgs holds all of the GitHub Actions related args
+type GitHubArgs struct {
+	URL          string
+	Token        string
+	Organization string
+	// Repositories are the repositories whose queued workflow jobs are counted
+	Repositories []string
+	// Labels are the labels of the runners, queued jobs whose runs-on labels are all in them are counted
+	Labels  []string
+	Timeout time.Duration
+}
+
+// GitLabArgs holds all of the GitLab runner related args
+type GitLabArgs struct {
+	URL   string
+	Token string
+	// Group is the ID or path of the group the runners are registered in
+	Group string
+	// Projects are the IDs or paths of the projects whose pending jobs are counted
+	Projects []string
+	// RunnerTags are the comma-separated tags of the runners of each workload, which are the agent pools
+	RunnerTags []string
+	Timeout    time.Duration
+}
+
+// PoolNameEnvVar returns the environment variable of the agent workload the agent pool is discovered from
+func (a Args) PoolNameEnvVar() string {
+	switch a.Backend {
+	case BackendGitHub:
+		return "RUNNER_GROUP"
+	case BackendGitLab:
+		return "RUNNER_TAG_LIST"
+	default:
+		return "AZP_POOL"
+	}
+}
+
+// KeyVaultArgs holds all of the Azure Key Vault related args
+type KeyVaultArgs struct {
+	// URL is the Key Vault URL. Disabled if empty.
+	URL             string
+	SecretName      string
+	ClientID        string
+	RefreshInterval time.Duration
+}
+
+// VaultArgs holds all of the HashiCorp Vault related args
+type VaultArgs struct {
+	// Address is the Vault server address. Disabled if empty.
+	Address         string
+	Namespace       string
+	AuthPath        string
+	Role            string
+	SecretPath      string
+	SecretKey       string
+	RefreshInterval time.Duration
 }
 
 // ArgsFromFlags returns an Args parsed from the program flags
 func ArgsFromFlags() Args {
-	// error should be validated in ValidateArgs()
+	redactSecrets()
+	// errors should be validated in ValidateArgs()
 	logrusLevel, _ := log.ParseLevel(*logLevel)
+	componentLevels, _ := parseLogLevels(*logLevels)
+	headers, _ := parseHeaders(*otlpHeaders)
+	slackSeverity, _ := notify.ParseSeverity(*slackMinSeverity)
+	teamsSeverity, _ := notify.ParseSeverity(*teamsMinSeverity)
+	messageTemplate, _ := notify.ParseTemplate(*notificationTemplate)
+	steps, _ := parseScaleUpSteps(*scaleUpSteps)
+	windows, _ := parseMaintenanceWindows(maintenanceWindows, *scheduleTimeZone)
+	additionalWorkloads, _ := parseWorkloads(workloads)
+	allowedPools, _ := parseAllowedPools(operatorAllowedPools)
+	routes, _ := parseDemandRoutes(demandRoutes)
+	hooks, _ := parseExecHooks(execHooks)
+	agentNames, _ := ci.ParseAgentNamePattern(*agentNamePattern)
+	additionalOrganizations, _ := parseOrganizations(organizations)
+	dnsServers, _ := parseDNSServers(azpDNSServers)
+	priorityClassPolicies, _ := parseCapacityPriorityClasses(capacityPriorityClasses)
+	namespace := kubernetesNamespace()
+	sharding := ShardingArgs{Shards: 1}
+	if *shards > 1 {
+		shardIndex, _ := parseShard(*shard)
+		sharding = ShardingArgs{Shards: *shards, Shard: shardIndex}
+	}
 	return Args{
-		Min:  int32(*min),
-		Max:  int32(*max),
-		Rate: *rate,
+		Min:                   int32(*min),
+		Max:                   int32(*max),
+		Rate:                  *rate,
+		RateMin:               *rateMin,
+		RateMax:               *rateMax,
+		Concurrency:           int32(*concurrency),
+		DryRun:                *dryRun,
+		Once:                  *once,
+		Output:                strings.ToLower(*output),
+		Probe:                 *probe,
+		MigrateTo:             strings.ToLower(*migrateTo),
+		ConfigFile:            *configFile,
+		Events:                *events,
+		SafeToEvict:           *safeToEvict,
+		DrainAnnotation:       *drainAnnotation,
+		TargetedScaleDown:     *targetedScaleDown,
+		HoldRollingUpdates:    *holdRollingUpdates,
+		VerifyScale:           *verifyScale,
+		OSAware:               *osAware,
+		DemandRoutes:          routes,
+		SyncCapabilities:      *syncCapabilities,
+		AgentNames:            agentNames,
+		RemoveDuplicateAgents: *removeDuplicateAgents,
+		RightSizingReport:     *rightSizingReport,
+		Recycle: RecycleArgs{
+			Outdated:       *recycleOutdated,
+			OutdatedPods:   *recycleOutdatedPods,
+			AfterJobs:      int32(*recycleAfterJobs),
+			MaxAge:         *recycleMaxAge,
+			MinVersion:     *minAgentVersion,
+			MaxUnavailable: int32(*recycleMaxUnavailable),
+		},
+		Quarantine: QuarantineArgs{
+			FailureRate: *quarantineFailureRate,
+			MinJobs:     int32(*quarantineMinJobs),
+		},
+		Rollover: RolloverArgs{
+			From: *rolloverFrom,
+			To:   *rolloverTo,
+		},
+		OfflineAgents: OfflineAgentsArgs{
+			Timeout:   *offlineAgentTimeout,
+			RateLimit: int32(*offlineAgentRateLimit),
+		},
+		Anomalies: AnomaliesArgs{
+			Window:    *anomalyWindow,
+			MaxPinned: *anomalyMaxPinned,
+		},
+		StalePods: StalePodsArgs{
+			Restarts:        int32(*stalePodRestarts),
+			NotReadyTimeout: *stalePodNotReadyTimeout,
+		},
+		OrdinalGaps: OrdinalGapsArgs{
+			Enabled:          *ordinalGaps,
+			ForceDeleteAfter: *forceDeleteTerminatingAfter,
+		},
 		ScaleDown: ScaleDownArgs{
-			Delay: *scaleDownDelay,
-			Max:   int32(*scaleDownMax),
+			Delay:     *scaleDownDelay,
+			Max:       int32(*scaleDownMax),
+			IdleDelay: *scaleDownIdle,
+
+			DrainTimeout:       *drainTimeout,
+			DrainTimeoutPolicy: strings.ToLower(*drainTimeoutPolicy),
+			DrainMaxRetries:    int32(*drainMaxRetries),
+		},
+		ScaleUp: ScaleUpArgs{
+			Steps: steps,
+		},
+		RateLimit: RateLimitArgs{
+			MaxScales: int32(*rateLimit),
+			Window:    *rateLimitWindow,
+		},
+		PendingBackoff: PendingBackoffArgs{
+			Delay: *pendingBackoff,
+			Max:   *pendingBackoffMax,
+		},
+		Registration: RegistrationArgs{
+			Timeout:    *registrationTimeout,
+			Backoff:    *registrationBackoff,
+			BackoffMax: *registrationBackoffMax,
+			Failures:   int32(*registrationFailures),
+		},
+		FailStatic: FailStaticArgs{
+			After: *failStaticAfter,
+			Min:   int32(*failStaticMin),
+		},
+		ManualScale: ManualScaleArgs{
+			Policy:   strings.ToLower(*manualScalePolicy),
+			Duration: *manualScaleDuration,
+		},
+		ExecHooks: ExecHookArgs{
+			Hooks:         hooks,
+			Timeout:       *execHookTimeout,
+			FailurePolicy: strings.ToLower(*execHookFailurePolicy),
+		},
+		DecisionHook: DecisionHookArgs{
+			URL:           *decisionHookURL,
+			Timeout:       *decisionHookTimeout,
+			FailurePolicy: strings.ToLower(*decisionHookFailurePolicy),
+		},
+		Policy: PolicyArgs{
+			Mode: strings.ToLower(*policy),
+			SLO: SLOArgs{
+				MaxQueueTime: *sloMaxQueueTime,
+				Window:       *sloWindow,
+			},
+		},
+		QueueAge: QueueAgeArgs{
+			WeightPeriod: *queueAgePeriod,
+			MaxWeight:    *queueAgeMaxWeight,
+		},
+		WaitingJobs: WaitingJobsArgs{
+			Gated:     *countGatedJobs,
+			Delayed:   *countDelayedJobs,
+			Lookahead: *delayedJobsLookahead,
+		},
+		Capacity: CapacityArgs{
+			Enabled:         *capacityCheck,
+			Overshoot:       *capacityOvershoot,
+			Quota:           *capacityQuota,
+			PriorityClasses: priorityClassPolicies,
+		},
+		HealthGates: HealthGateArgs{
+			Gates:          parseHealthGates(healthGates),
+			NodeReadyRatio: *healthGateNodeReadyRatio,
+			RegistryURL:    *healthGateRegistryURL,
+			MaxScaleUp:     int32(*healthGateMaxScaleUp),
+		},
+		Balloon: BalloonArgs{
+			Replicas:      int32(*balloonReplicas),
+			PriorityClass: *balloonPriorityClass,
+			Image:         *balloonImage,
 		},
 		Logging: LoggingArgs{
-			Level: logrusLevel,
+			Level:           logrusLevel,
+			ComponentLevels: componentLevels,
+			Format:          strings.ToLower(*logFormat),
+			File:            *logFile,
+			AuditLog:        *auditLog,
+			SampleFirst:     *logSampleFirst,
+			SampleWindow:    *logSampleWindow,
+		},
+		Notifications: NotificationArgs{
+			WebhookURLs:   webhookURLs,
+			WebhookSecret: *webhookSecret,
+
+			SlackWebhookURL:  *slackWebhookURL,
+			SlackMinSeverity: slackSeverity,
+			TeamsWebhookURL:  *teamsWebhookURL,
+			TeamsMinSeverity: teamsSeverity,
+			Template:         messageTemplate,
+		},
+		AzureMonitor: AzureMonitorArgs{
+			ConnectionString: *appInsightsConnectionString,
+		},
+		CloudEvents: CloudEventsArgs{
+			SinkURL: *cloudEventsSink,
+			Source:  *cloudEventsSource,
+		},
+		Tracing: TracingArgs{
+			OTLPEndpoint: *otlpEndpoint,
+			OTLPHeaders:  headers,
 		},
 		Kubernetes: KubernetesArgs{
 			Type:      *resourceType,
 			Name:      *resourceName,
-			Namespace: *resourceNamespace,
+			Namespace: namespace,
+			Priority:  int32(*resourcePriority),
+
+			AdditionalWorkloads: additionalWorkloads,
+			SpotWorkloads:       spotWorkloads,
+
+			Timeout:   *k8sTimeout,
+			RBACScope: strings.ToLower(*rbacScope),
+
+			MissingWorkload:        strings.ToLower(*missingWorkload),
+			MissingWorkloadTimeout: *missingWorkloadTimeout,
+		},
+		HPACheck: HPACheckArgs{
+			Disabled:     !*hpaCheck,
+			Namespaces:   hpaCheckNamespaces,
+			Acknowledged: *acknowledgeHPAConflicts,
 		},
+		Backend: *backend,
 		AZD: AzureDevopsArgs{
-			Token: *azpToken,
-			URL:   *azpURL,
+			Token:           *azpToken,
+			URL:             *azpURL,
+			URLFromWorkload: *azpURLFromWorkload,
+			Timeout:         *azpTimeout,
+			MaxIdleConns:    *azpMaxIdleConns,
+			IdleConnTimeout: *azpIdleConnTimeout,
+			HTTP2:           *azpHTTP2,
+			IPFamily:        strings.ToLower(*azpIPFamily),
+			DNSServers:      dnsServers,
+			Organizations:   additionalOrganizations,
+			KeyVault: KeyVaultArgs{
+				URL:             *keyVaultURL,
+				SecretName:      *keyVaultSecret,
+				ClientID:        *keyVaultClientID,
+				RefreshInterval: *keyVaultRefresh,
+			},
+			Vault: VaultArgs{
+				Address:         *vaultAddr,
+				Namespace:       *vaultNamespace,
+				AuthPath:        *vaultAuthPath,
+				Role:            *vaultRole,
+				SecretPath:      *vaultSecretPath,
+				SecretKey:       *vaultSecretKey,
+				RefreshInterval: *vaultRefresh,
+			},
+		},
+		GitHub: GitHubArgs{
+			URL:          *githubURL,
+			Token:        *githubToken,
+			Organization: *githubOrganization,
+			Repositories: githubRepositories,
+			Labels:       splitList(*githubLabels),
+			Timeout:      *githubTimeout,
+		},
+		GitLab: GitLabArgs{
+			URL:        *gitlabURL,
+			Token:      *gitlabToken,
+			Group:      *gitlabGroup,
+			Projects:   gitlabProjects,
+			RunnerTags: gitlabRunnerTags,
+			Timeout:    *gitlabTimeout,
 		},
 		Health: HealthArgs{
-			Port: *port,
+			Port:      *port,
+			DebugPort: *debugPort,
+			Token:     *metricsToken,
+		},
+		TLS: TLSArgs{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			ClientCAFile: *tlsClientCA,
+		},
+		Sharding: sharding,
+		Ownership: OwnershipArgs{
+			Enabled: *ownership,
+			Owner:   ownerIDOrHostname(*ownerID),
+			Lease:   *ownershipLease,
+		},
+		State: StateArgs{
+			ConfigMapName: sharding.ConfigMapName(*stateConfigMap),
+			Namespace:     namespace,
+		},
+		Store: StoreArgs{
+			Type: strings.ToLower(*storeType),
+			Path: *storePath,
+			Redis: RedisArgs{
+				Address:   *redisAddr,
+				Password:  *redisPassword,
+				DB:        *redisDB,
+				KeyPrefix: *redisKeyPrefix,
+				TLS:       *redisTLS,
+			},
+		},
+		History: HistoryArgs{
+			Size:          *historySize,
+			ConfigMapName: sharding.ConfigMapName(*historyConfigMap),
+			Namespace:     namespace,
+		},
+		Record: RecordArgs{
+			Dir:      *recordDir,
+			Interval: *recordInterval,
+			MaxSize:  int64(*recordMaxSize) * 1024 * 1024,
+		},
+		RetryBudget: RetryBudgetArgs{
+			Calls:  *retryBudgetCalls,
+			Window: *retryBudgetWindow,
+		},
+		Maintenance: MaintenanceArgs{
+			Windows: windows,
+		},
+		Admin: AdminArgs{
+			Port:  *adminPort,
+			Token: *adminToken,
+		},
+		Operator: OperatorArgs{
+			Enabled:      *operator,
+			Namespaces:   operatorNamespaces,
+			AllowedPools: allowedPools,
+			Webhook: AdmissionWebhookArgs{
+				Port:         *admissionWebhookPort,
+				CertFile:     *admissionWebhookCert,
+				KeyFile:      *admissionWebhookKey,
+				ClientCAFile: *admissionWebhookClientCA,
+			},
+		},
+		KEDA: KEDAArgs{
+			Port: *kedaPort,
+		},
+		MetricsAdapter: MetricsAdapterArgs{
+			Port:         *metricsAdapterPort,
+			CertFile:     *metricsAdapterCert,
+			KeyFile:      *metricsAdapterKey,
+			ClientCAFile: *metricsAdapterClientCA,
+		},
+		AKS: AKSArgs{
+			SubscriptionID: *aksSubscriptionID,
+			ResourceGroup:  *aksResourceGroup,
+			Cluster:        *aksCluster,
+			NodePool:       *aksNodePool,
+			ClientID:       *aksClientID,
+			MaxNodes:       int32(*aksMaxNodes),
+			PodsPerNode:    int32(*aksPodsPerNode),
+			Cooldown:       *aksCooldown,
 		},
 	}
 }
@@ -109,6 +2012,53 @@ func ValidateArgs() error {
 	if err != nil {
 		validationErrors = append(validationErrors, err.Error())
 	}
+	if _, err := parseLogLevels(*logLevels); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	}
+	if *logSampleFirst < 0 {
+		validationErrors = append(validationErrors, "Log-sample-first argument cannot be negative.")
+	} else if *logSampleFirst > 0 && *logSampleWindow < time.Second {
+		validationErrors = append(validationErrors, "Log-sample-window argument cannot be less than 1 second.")
+	}
+	if !strings.EqualFold(*output, OutputText) && !strings.EqualFold(*output, OutputJSON) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown output format %s.", *output))
+	}
+	if !strings.EqualFold(*migrateTo, MigrateToConfig) && !strings.EqualFold(*migrateTo, MigrateToResource) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown migrate-to format %s.", *migrateTo))
+	}
+	if !strings.EqualFold(*logFormat, logging.FormatText) && !strings.EqualFold(*logFormat, logging.FormatJSON) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown log format %s.", *logFormat))
+	}
+	for _, webhookURL := range webhookURLs {
+		if parsed, err := url.Parse(webhookURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			validationErrors = append(validationErrors, "Webhook-url arguments must be HTTP or HTTPS URLs.")
+		}
+	}
+	if *cloudEventsSink != "" {
+		if parsed, err := url.Parse(*cloudEventsSink); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			validationErrors = append(validationErrors, "Cloudevents-sink argument must be an HTTP or HTTPS URL.")
+		}
+		if *cloudEventsSource == "" {
+			validationErrors = append(validationErrors, "Cloudevents-source argument cannot be empty.")
+		}
+	}
+	if _, err := notify.ParseSeverity(*slackMinSeverity); err != nil {
+		validationErrors = append(validationErrors, "Invalid slack-min-severity argument: "+err.Error()+".")
+	}
+	if _, err := notify.ParseSeverity(*teamsMinSeverity); err != nil {
+		validationErrors = append(validationErrors, "Invalid teams-min-severity argument: "+err.Error()+".")
+	}
+	if _, err := notify.ParseTemplate(*notificationTemplate); err != nil {
+		validationErrors = append(validationErrors, "Invalid notification-template argument: "+err.Error()+".")
+	}
+	if *appInsightsConnectionString != "" {
+		if _, _, err := appinsights.ParseConnectionString(*appInsightsConnectionString); err != nil {
+			validationErrors = append(validationErrors, err.Error()+".")
+		}
+	}
+	if _, err := parseHeaders(*otlpHeaders); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	}
 	if *min < 1 {
 		validationErrors = append(validationErrors, "Min argument cannot be less than 1.")
 	}
@@ -120,27 +2070,532 @@ func ValidateArgs() error {
 	} else if rate.Seconds() <= 1 {
 		validationErrors = append(validationErrors, fmt.Sprintf("Rate '%s' is too low.", rate.String()))
 	}
+	if *rateMin < 0 || (*rateMin != 0 && rateMin.Seconds() <= 1) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Rate-min '%s' is too low.", rateMin.String()))
+	} else if rate != nil && *rateMin > *rate {
+		validationErrors = append(validationErrors, "Rate-min argument cannot be greater than the rate.")
+	}
+	if *rateMax < 0 || (rate != nil && *rateMax != 0 && *rateMax < *rate) {
+		validationErrors = append(validationErrors, "Rate-max argument cannot be less than the rate.")
+	}
+	if *concurrency < 1 {
+		validationErrors = append(validationErrors, "Concurrency argument cannot be less than 1.")
+	}
+	if *shards < 1 {
+		validationErrors = append(validationErrors, "The number of shards cannot be less than 1.")
+	} else if *shards > 1 {
+		if shardIndex, err := parseShard(*shard); err != nil {
+			validationErrors = append(validationErrors, fmt.Sprintf("The shard is required when the %s.", err.Error()))
+		} else if shardIndex >= *shards {
+			validationErrors = append(validationErrors, fmt.Sprintf("The shard must be less than the number of shards, %d.", *shards))
+		}
+	}
+	// The claims are renewed every few iterations, so they must outlast a couple of iterations
+	if minLease := 2 * math.MaxDuration(*rate, *rateMax); *ownership && *ownershipLease < minLease {
+		validationErrors = append(validationErrors, fmt.Sprintf("The ownership lease must be at least twice the rate, %s.", minLease.String()))
+	}
 	if *scaleDownMax < 1 {
 		validationErrors = append(validationErrors, fmt.Sprintf("Scale-down-max argument cannot be less than 1."))
 	}
-	if *resourceType != "StatefulSet" {
+	if *scaleDownIdle < 0 {
+		validationErrors = append(validationErrors, "Scale-down-delay argument cannot be negative.")
+	}
+	if *drainTimeout < 0 {
+		validationErrors = append(validationErrors, "Drain-timeout argument cannot be negative.")
+	}
+	if !IsDrainTimeoutPolicy(*drainTimeoutPolicy) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown drain-timeout-policy %s.", *drainTimeoutPolicy))
+	}
+	if *drainMaxRetries < 0 {
+		validationErrors = append(validationErrors, "Drain-max-retries argument cannot be negative.")
+	}
+	if _, err := parseScaleUpSteps(*scaleUpSteps); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	}
+	if *rateLimit < 0 {
+		validationErrors = append(validationErrors, "Rate-limit argument cannot be negative.")
+	} else if *rateLimit > 0 && rateLimitWindow.Minutes() < 1 {
+		validationErrors = append(validationErrors, "Rate-limit-window argument cannot be less than 1 minute.")
+	}
+	if *pendingBackoff < 0 {
+		validationErrors = append(validationErrors, "Pending-backoff argument cannot be negative.")
+	} else if *pendingBackoff > 0 && *pendingBackoffMax < *pendingBackoff {
+		validationErrors = append(validationErrors, "Pending-backoff-max argument cannot be less than pending-backoff.")
+	}
+	if *registrationTimeout < 0 {
+		validationErrors = append(validationErrors, "Registration-timeout argument cannot be negative.")
+	} else if *registrationTimeout > 0 && *registrationBackoff <= 0 {
+		validationErrors = append(validationErrors, "Registration-backoff argument must be positive.")
+	} else if *registrationTimeout > 0 && *registrationBackoffMax < *registrationBackoff {
+		validationErrors = append(validationErrors, "Registration-backoff-max argument cannot be less than registration-backoff.")
+	}
+	if *registrationFailures < 1 {
+		validationErrors = append(validationErrors, "Registration-failures argument cannot be less than 1.")
+	}
+	if *failStaticAfter < 0 {
+		validationErrors = append(validationErrors, "Fail-static-after argument cannot be negative.")
+	}
+	if *failStaticMin < 0 {
+		validationErrors = append(validationErrors, "Fail-static-min argument cannot be negative.")
+	} else if *failStaticMin > *max {
+		validationErrors = append(validationErrors, "Fail-static-min argument cannot be greater than max.")
+	}
+	if !strings.EqualFold(*manualScalePolicy, ManualScaleOverwrite) && !strings.EqualFold(*manualScalePolicy, ManualScaleAdopt) && !strings.EqualFold(*manualScalePolicy, ManualScaleRevert) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown manual-scale-policy %s.", *manualScalePolicy))
+	} else if strings.EqualFold(*manualScalePolicy, ManualScaleAdopt) && *manualScaleDuration <= 0 {
+		validationErrors = append(validationErrors, "Manual-scale-duration argument must be positive with the adopt manual-scale-policy.")
+	}
+	if *decisionHookURL != "" {
+		if parsed, err := url.Parse(*decisionHookURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			validationErrors = append(validationErrors, "Decision-hook-url argument must be an HTTP or HTTPS URL.")
+		}
+	}
+	if *decisionHookTimeout <= 0 {
+		validationErrors = append(validationErrors, "Decision-hook-timeout argument must be positive.")
+	}
+	if _, err := parseExecHooks(execHooks); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	}
+	if *execHookTimeout <= 0 {
+		validationErrors = append(validationErrors, "Exec-hook-timeout argument must be positive.")
+	}
+	if !strings.EqualFold(*execHookFailurePolicy, DecisionHookIgnore) && !strings.EqualFold(*execHookFailurePolicy, DecisionHookFail) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown exec-hook-failure-policy %s.", *execHookFailurePolicy))
+	}
+	if !strings.EqualFold(*decisionHookFailurePolicy, DecisionHookIgnore) && !strings.EqualFold(*decisionHookFailurePolicy, DecisionHookFail) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown decision-hook-failure-policy %s.", *decisionHookFailurePolicy))
+	}
+	if !strings.EqualFold(*policy, PolicyQueue) && !strings.EqualFold(*policy, PolicySLO) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown policy %s.", *policy))
+	} else if strings.EqualFold(*policy, PolicySLO) {
+		if sloMaxQueueTime.Minutes() < 1 {
+			validationErrors = append(validationErrors, "Slo-max-queue-time argument cannot be less than 1 minute.")
+		}
+		if sloWindow.Minutes() < 1 {
+			validationErrors = append(validationErrors, "Slo-window argument cannot be less than 1 minute.")
+		}
+	}
+	if *queueAgePeriod < 0 {
+		validationErrors = append(validationErrors, "Queue-age-weight-period argument cannot be negative.")
+	}
+	if *queueAgeMaxWeight < 1 {
+		validationErrors = append(validationErrors, "Queue-age-max-weight argument cannot be less than 1.")
+	}
+	if *countGatedJobs && *backend != BackendGitHub {
+		validationErrors = append(validationErrors, fmt.Sprintf("Count-gated-jobs argument is only supported by the %s backend.", BackendGitHub))
+	}
+	if *countDelayedJobs && *backend == BackendAzurePipelines {
+		validationErrors = append(validationErrors, fmt.Sprintf("Count-delayed-jobs argument is only supported by the %s and %s backends.", BackendGitHub, BackendGitLab))
+	}
+	if *delayedJobsLookahead < 0 {
+		validationErrors = append(validationErrors, "Delayed-jobs-lookahead argument cannot be negative.")
+	}
+	if *agentNamePattern != "" {
+		if _, err := ci.ParseAgentNamePattern(*agentNamePattern); err != nil {
+			validationErrors = append(validationErrors, fmt.Sprintf("Agent-name-pattern argument is invalid: %s.", err.Error()))
+		}
+	}
+	if *syncCapabilities && *backend != BackendAzurePipelines {
+		validationErrors = append(validationErrors, fmt.Sprintf("Sync-capabilities argument is only supported by the %s backend.", BackendAzurePipelines))
+	}
+	if *minAgentVersion != "" && !ci.IsVersion(*minAgentVersion) {
+		validationErrors = append(validationErrors, "Min-agent-version argument must be a version, ex: 3.232.1.")
+	}
+	if *recycleAfterJobs < 0 {
+		validationErrors = append(validationErrors, "Recycle-after-jobs argument cannot be negative.")
+	}
+	if *recycleMaxAge < 0 {
+		validationErrors = append(validationErrors, "Recycle-max-age argument cannot be negative.")
+	}
+	if *recycleMaxUnavailable < 1 {
+		validationErrors = append(validationErrors, "Recycle-max-unavailable argument cannot be less than 1.")
+	}
+	if *offlineAgentTimeout < 0 {
+		validationErrors = append(validationErrors, "Offline-agent-timeout argument cannot be negative.")
+	}
+	if *offlineAgentRateLimit < 1 {
+		validationErrors = append(validationErrors, "Offline-agent-rate-limit argument cannot be less than 1.")
+	}
+	if *forceDeleteTerminatingAfter < 0 {
+		validationErrors = append(validationErrors, "Force-delete-terminating-after argument cannot be negative.")
+	} else if *forceDeleteTerminatingAfter > 0 && *forceDeleteTerminatingAfter < time.Minute {
+		// The node of a pod can still be running it, so a StatefulSet would run two pods with the same identity
+		validationErrors = append(validationErrors, "Force-delete-terminating-after argument cannot be less than 1 minute.")
+	} else if *forceDeleteTerminatingAfter > 0 && !*ordinalGaps {
+		validationErrors = append(validationErrors, "Force-delete-terminating-after argument requires the ordinal-gaps argument.")
+	}
+	if *stalePodRestarts < 0 {
+		validationErrors = append(validationErrors, "Stale-pod-restarts argument cannot be negative.")
+	}
+	if *stalePodNotReadyTimeout < 0 {
+		validationErrors = append(validationErrors, "Stale-pod-not-ready-timeout argument cannot be negative.")
+	}
+	if *quarantineFailureRate < 0 || *quarantineFailureRate > 1 {
+		validationErrors = append(validationErrors, "Quarantine-failure-rate argument must be between 0 and 1.")
+	}
+	if *quarantineMinJobs < 1 {
+		validationErrors = append(validationErrors, "Quarantine-min-jobs argument cannot be less than 1.")
+	}
+	if *balloonReplicas < 0 {
+		validationErrors = append(validationErrors, "Balloon-replicas argument cannot be negative.")
+	} else if *balloonReplicas > 0 {
+		if *balloonPriorityClass == "" {
+			validationErrors = append(validationErrors, "Balloon-priority-class argument is required when balloon-replicas is set.")
+		}
+		if *balloonImage == "" {
+			validationErrors = append(validationErrors, "Balloon-image argument cannot be empty.")
+		}
+	}
+	if *aksNodePool != "" {
+		if *aksSubscriptionID == "" || *aksResourceGroup == "" || *aksCluster == "" {
+			validationErrors = append(validationErrors, "Aks-subscription-id, aks-resource-group and aks-cluster arguments are required when aks-node-pool is set.")
+		}
+		if *aksMaxNodes < 1 {
+			validationErrors = append(validationErrors, "Aks-max-nodes argument cannot be less than 1.")
+		}
+		if *aksPodsPerNode < 1 {
+			validationErrors = append(validationErrors, "Aks-pods-per-node argument cannot be less than 1.")
+		}
+		if *aksCooldown < 0 {
+			validationErrors = append(validationErrors, "Aks-cooldown argument cannot be negative.")
+		}
+	}
+	if _, err := parseMaintenanceWindows(maintenanceWindows, *scheduleTimeZone); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	}
+	if *resourceType != "" && *resourceType != "StatefulSet" && *resourceType != "DeploymentConfig" && *resourceType != "Deployment" {
 		validationErrors = append(validationErrors, fmt.Sprintf("Unknown resource type %s.", *resourceType))
+	} else if *resourceType == "Deployment" && !*targetedScaleDown {
+		validationErrors = append(validationErrors, "Deployments remove arbitrary pods when they're scaled down, the targeted-scale-down argument is required with the Deployment resource type.")
+	}
+	if *operator {
+		if len(workloads) > 0 || len(spotWorkloads) > 0 || *rolloverFrom != "" {
+			validationErrors = append(validationErrors, "Workload, spot-workload and rollover arguments cannot be set in operator mode.")
+		}
+		if *once {
+			validationErrors = append(validationErrors, "Once argument cannot be set in operator mode.")
+		}
+	} else {
+		if *resourceName == "" && *kedaPort == 0 && *metricsAdapterPort == 0 {
+			validationErrors = append(validationErrors, "Workload name is required.")
+		}
+		if len(operatorNamespaces) > 0 || len(operatorAllowedPools) > 0 {
+			validationErrors = append(validationErrors, "Operator-namespace and operator-allowed-pools arguments require operator mode.")
+		}
+	}
+	if _, err := parseAllowedPools(operatorAllowedPools); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	}
+	if additionalWorkloads, err := parseWorkloads(workloads); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	} else {
+		for _, spotWorkload := range spotWorkloads {
+			isWorkload := spotWorkload == *resourceName
+			for _, workload := range additionalWorkloads {
+				isWorkload = isWorkload || spotWorkload == workload.Name
+			}
+			if !isWorkload {
+				validationErrors = append(validationErrors, fmt.Sprintf("Spot workload %s must be the name or a workload argument.", spotWorkload))
+			}
+		}
+		if (*rolloverFrom == "") != (*rolloverTo == "") {
+			validationErrors = append(validationErrors, "Rollover-from and rollover-to arguments must be set together.")
+		} else if *rolloverFrom != "" && *rolloverFrom == *rolloverTo {
+			validationErrors = append(validationErrors, "Rollover-from and rollover-to arguments cannot be the same workload.")
+		}
+		for _, rolloverWorkload := range []string{*rolloverFrom, *rolloverTo} {
+			isWorkload := rolloverWorkload == *resourceName
+			for _, workload := range additionalWorkloads {
+				isWorkload = isWorkload || rolloverWorkload == workload.Name
+			}
+			if rolloverWorkload != "" && !isWorkload {
+				validationErrors = append(validationErrors, fmt.Sprintf("Rollover workload %s must be the name or a workload argument.", rolloverWorkload))
+			}
+		}
+	}
+	if _, err := parseDemandRoutes(demandRoutes); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
 	}
-	if *resourceName == "" {
-		validationErrors = append(validationErrors, fmt.Sprintf("%s name is required.", *resourceType))
+	if _, err := parseCapacityPriorityClasses(capacityPriorityClasses); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	} else if len(capacityPriorityClasses) > 0 && !*capacityCheck {
+		validationErrors = append(validationErrors, "Capacity-priority-class argument requires the capacity-check argument.")
 	}
-	if *resourceNamespace == "" {
-		validationErrors = append(validationErrors, "Namespace is required.")
+	for _, gate := range parseHealthGates(healthGates) {
+		if gate != HealthGateNodes && gate != HealthGateMetricsServer && gate != HealthGateRegistry {
+			validationErrors = append(validationErrors, fmt.Sprintf("Unknown health gate %s, it must be %s, %s or %s.", gate, HealthGateNodes, HealthGateMetricsServer, HealthGateRegistry))
+		}
 	}
-	if *azpToken == "" {
-		validationErrors = append(validationErrors, "The Azure Devops token is required.")
+	if *healthGateNodeReadyRatio < 0 || *healthGateNodeReadyRatio > 1 {
+		validationErrors = append(validationErrors, "Health-gate-node-ready-ratio argument must be between 0 and 1.")
 	}
-	if *azpURL == "" {
-		validationErrors = append(validationErrors, "The Azure Devops URL is required.")
+	if *healthGateRegistryURL != "" {
+		if parsed, err := url.Parse(*healthGateRegistryURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			validationErrors = append(validationErrors, "Health-gate-registry-url argument must be an HTTP or HTTPS URL.")
+		}
+	}
+	if *healthGateMaxScaleUp < 0 {
+		validationErrors = append(validationErrors, "Health-gate-max-scale-up argument cannot be negative.")
+	}
+	if kubernetesNamespace() == "" {
+		validationErrors = append(validationErrors, "Namespace is required when not running in a Kubernetes pod.")
+	}
+	switch *backend {
+	case BackendAzurePipelines:
+		tokenSources := 0
+		for _, source := range []string{*azpToken, *keyVaultURL, *vaultAddr} {
+			if source != "" {
+				tokenSources++
+			}
+		}
+		if tokenSources == 0 {
+			validationErrors = append(validationErrors, "The Azure Devops token is required.")
+		} else if tokenSources > 1 {
+			validationErrors = append(validationErrors, "Only one of the token, keyvault-url and vault-addr arguments can be set.")
+		}
+		if *azpURLFromWorkload {
+			if *azpURL != "" {
+				validationErrors = append(validationErrors, "Only one of the url and url-from-workload arguments can be set.")
+			}
+			// The URL is read from the workloads, which aren't known in advance in operator mode and aren't used by the external scalers
+			if *operator || *kedaPort != 0 || *metricsAdapterPort != 0 {
+				validationErrors = append(validationErrors, "Url-from-workload argument cannot be set in operator mode or with an external scaler.")
+			}
+		} else if *azpURL == "" {
+			validationErrors = append(validationErrors, "The Azure Devops URL is required.")
+		}
+		if additionalOrganizations, err := parseOrganizations(organizations); err != nil {
+			validationErrors = append(validationErrors, err.Error()+".")
+		} else if len(additionalOrganizations) > 0 {
+			// The workloads of each organization are only known by reading their AZP_URL, which isn't done in these modes
+			if *azpURLFromWorkload || *operator || *kedaPort != 0 || *metricsAdapterPort != 0 {
+				validationErrors = append(validationErrors, "Organization argument cannot be set with url-from-workload, in operator mode or with an external scaler.")
+			}
+			for _, organization := range additionalOrganizations {
+				if organization.Token == "" {
+					validationErrors = append(validationErrors, fmt.Sprintf("The token of organization %s is required in environment variable %s.", organization.URL, organization.TokenEnvVar))
+				}
+				if strings.EqualFold(organization.URL, strings.TrimSuffix(*azpURL, "/")) {
+					validationErrors = append(validationErrors, fmt.Sprintf("Organization %s is the url argument, the organization argument is only for the additional organizations.", organization.URL))
+				}
+			}
+		}
+	case BackendGitHub:
+		if parsed, err := url.Parse(*githubURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			validationErrors = append(validationErrors, "Github-url argument must be an HTTP or HTTPS URL.")
+		}
+		if *githubToken == "" {
+			validationErrors = append(validationErrors, "The GitHub token is required.")
+		}
+		if *githubOrganization == "" {
+			validationErrors = append(validationErrors, "Github-org argument is required.")
+		}
+		if len(githubRepositories) == 0 {
+			validationErrors = append(validationErrors, "At least one github-repository argument is required.")
+		}
+		if len(splitList(*githubLabels)) == 0 {
+			validationErrors = append(validationErrors, "Github-labels argument cannot be empty.")
+		}
+		if *githubTimeout < time.Second {
+			validationErrors = append(validationErrors, "Github-timeout argument cannot be less than 1 second.")
+		}
+	case BackendGitLab:
+		if parsed, err := url.Parse(*gitlabURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			validationErrors = append(validationErrors, "Gitlab-url argument must be an HTTP or HTTPS URL.")
+		}
+		if *gitlabToken == "" {
+			validationErrors = append(validationErrors, "The GitLab token is required.")
+		}
+		if *gitlabGroup == "" {
+			validationErrors = append(validationErrors, "Gitlab-group argument is required.")
+		}
+		if len(gitlabProjects) == 0 {
+			validationErrors = append(validationErrors, "At least one gitlab-project argument is required.")
+		}
+		if len(gitlabRunnerTags) == 0 {
+			validationErrors = append(validationErrors, "At least one gitlab-runner-tags argument is required.")
+		}
+		for _, tags := range gitlabRunnerTags {
+			if len(splitList(tags)) == 0 {
+				validationErrors = append(validationErrors, "Gitlab-runner-tags argument cannot be empty.")
+				break
+			}
+		}
+		if *gitlabTimeout < time.Second {
+			validationErrors = append(validationErrors, "Gitlab-timeout argument cannot be less than 1 second.")
+		}
+	default:
+		validationErrors = append(validationErrors, fmt.Sprintf("Backend argument must be %s, %s or %s.", BackendAzurePipelines, BackendGitHub, BackendGitLab))
+	}
+	if *keyVaultURL != "" {
+		if parsed, err := url.Parse(*keyVaultURL); err != nil || parsed.Scheme != "https" {
+			validationErrors = append(validationErrors, "Keyvault-url argument must be an HTTPS URL.")
+		}
+		if *keyVaultSecret == "" {
+			validationErrors = append(validationErrors, "Keyvault-secret argument is required when keyvault-url is set.")
+		}
+		if *keyVaultRefresh < time.Minute {
+			validationErrors = append(validationErrors, "Keyvault-refresh argument cannot be less than 1 minute.")
+		}
+	}
+	if *vaultAddr != "" {
+		if parsed, err := url.Parse(*vaultAddr); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			validationErrors = append(validationErrors, "Vault-addr argument must be an HTTP or HTTPS URL.")
+		}
+		if *vaultRole == "" {
+			validationErrors = append(validationErrors, "Vault-role argument is required when vault-addr is set.")
+		}
+		if *vaultAuthPath == "" {
+			validationErrors = append(validationErrors, "Vault-auth-path argument cannot be empty.")
+		}
+		if *vaultSecretPath == "" {
+			validationErrors = append(validationErrors, "Vault-secret-path argument is required when vault-addr is set.")
+		}
+		if *vaultSecretKey == "" {
+			validationErrors = append(validationErrors, "Vault-secret-key argument cannot be empty.")
+		}
+		if *vaultRefresh < 10*time.Second {
+			validationErrors = append(validationErrors, "Vault-refresh argument cannot be less than 10 seconds.")
+		}
+	}
+	if *azpTimeout < time.Second {
+		validationErrors = append(validationErrors, "Azure-devops-timeout argument cannot be less than 1 second.")
+	}
+	if *azpMaxIdleConns < 1 {
+		validationErrors = append(validationErrors, "Azure-devops-max-idle-conns argument cannot be less than 1.")
+	}
+	if *azpIdleConnTimeout < 0 {
+		validationErrors = append(validationErrors, "Azure-devops-idle-conn-timeout argument cannot be negative.")
+	}
+	if !strings.EqualFold(*azpIPFamily, IPFamilyDual) && !strings.EqualFold(*azpIPFamily, IPFamilyIPv4) && !strings.EqualFold(*azpIPFamily, IPFamilyIPv6) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown azure-devops-ip-family %s.", *azpIPFamily))
+	}
+	if _, err := parseDNSServers(azpDNSServers); err != nil {
+		validationErrors = append(validationErrors, err.Error()+".")
+	}
+	if *k8sTimeout < time.Second {
+		validationErrors = append(validationErrors, "Kubernetes-timeout argument cannot be less than 1 second.")
+	}
+	if !strings.EqualFold(*rbacScope, RBACScopeAuto) && !strings.EqualFold(*rbacScope, RBACScopeCluster) && !strings.EqualFold(*rbacScope, RBACScopeNamespace) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown RBAC scope %s.", *rbacScope))
+	}
+	if !strings.EqualFold(*missingWorkload, MissingWorkloadFail) && !strings.EqualFold(*missingWorkload, MissingWorkloadWait) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown missing workload policy %s.", *missingWorkload))
+	}
+	if *missingWorkloadTimeout < 0 {
+		validationErrors = append(validationErrors, "Missing-workload-timeout argument cannot be negative.")
+	}
+	if !*acknowledgeHPAConflicts {
+		if !*hpaCheck {
+			validationErrors = append(validationErrors, "Disabling the HPA check requires the acknowledge-hpa-conflicts argument.")
+		} else if len(hpaCheckNamespaces) > 0 {
+			validationErrors = append(validationErrors, "Hpa-check-namespace argument requires the acknowledge-hpa-conflicts argument.")
+		}
 	}
 	if *port < 0 {
 		validationErrors = append(validationErrors, "The port must be greater than 0.")
 	}
+	if *debugPort < 0 {
+		validationErrors = append(validationErrors, "The debug port cannot be negative.")
+	} else if *debugPort != 0 && *debugPort == *port {
+		validationErrors = append(validationErrors, "The debug port must be different from the port.")
+	}
+	if *adminPort < 0 {
+		validationErrors = append(validationErrors, "The admin port cannot be negative.")
+	} else if *adminPort != 0 {
+		if *adminPort == *port || *adminPort == *debugPort {
+			validationErrors = append(validationErrors, "The admin port must be different from the port and the debug port.")
+		}
+		if *adminToken == "" {
+			validationErrors = append(validationErrors, "The admin token is required when the admin API is enabled.")
+		}
+	}
+	if *admissionWebhookPort < 0 {
+		validationErrors = append(validationErrors, "The admission webhook port cannot be negative.")
+	} else if *admissionWebhookPort != 0 {
+		if !*operator {
+			validationErrors = append(validationErrors, "The admission webhook requires operator mode.")
+		}
+		if *admissionWebhookPort == *port || *admissionWebhookPort == *debugPort || *admissionWebhookPort == *adminPort {
+			validationErrors = append(validationErrors, "The admission webhook port must be different from the port, the debug port and the admin port.")
+		}
+		if *admissionWebhookCert == "" || *admissionWebhookKey == "" {
+			validationErrors = append(validationErrors, "The admission webhook cert and key are required when the admission webhook is enabled.")
+		}
+	}
+	if *retryBudgetCalls < 0 {
+		validationErrors = append(validationErrors, "The retry budget cannot be negative.")
+	} else if *retryBudgetCalls > 0 && *retryBudgetWindow < time.Second {
+		validationErrors = append(validationErrors, "The retry budget window cannot be less than 1 second.")
+	}
+	if *rightSizingReport < 0 {
+		validationErrors = append(validationErrors, "Right-sizing-report argument cannot be negative.")
+	} else if *rightSizingReport != 0 && *rightSizingReport < *rate {
+		validationErrors = append(validationErrors, "Right-sizing-report argument cannot be less than the rate argument.")
+	}
+	if *anomalyWindow < 0 {
+		validationErrors = append(validationErrors, "Anomaly-window argument cannot be negative.")
+	} else if *anomalyWindow != 0 && *anomalyWindow < *rate {
+		validationErrors = append(validationErrors, "Anomaly-window argument cannot be less than the rate argument.")
+	} else if *anomalyWindow != 0 && *anomalyMaxPinned < *anomalyWindow {
+		validationErrors = append(validationErrors, "Anomaly-max-pinned argument cannot be less than the anomaly-window argument.")
+	}
+	if *historySize < 1 {
+		validationErrors = append(validationErrors, "The history size must be at least 1.")
+	}
+	switch strings.ToLower(*storeType) {
+	case StoreConfigMap:
+	case StoreFile:
+		if *storePath == "" {
+			validationErrors = append(validationErrors, "The store path is required with the file store.")
+		}
+	case StoreRedis:
+		if *redisAddr == "" {
+			validationErrors = append(validationErrors, "The Redis address is required with the redis store.")
+		}
+		if *redisDB < 0 {
+			validationErrors = append(validationErrors, "The Redis database cannot be negative.")
+		}
+	default:
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown store %s.", *storeType))
+	}
+	if *recordInterval <= 0 {
+		validationErrors = append(validationErrors, "Record-interval argument must be positive.")
+	}
+	if *recordMaxSize < 1 {
+		validationErrors = append(validationErrors, "Record-max-size argument must be at least 1.")
+	}
+	if *historyConfigMap != "" && *historyConfigMap == *stateConfigMap {
+		validationErrors = append(validationErrors, "The history ConfigMap must be different from the state ConfigMap.")
+	}
+	if *kedaPort < 0 {
+		validationErrors = append(validationErrors, "The KEDA port cannot be negative.")
+	} else if *kedaPort != 0 {
+		if *operator || *once {
+			validationErrors = append(validationErrors, "The KEDA external scaler cannot be enabled in operator mode or with the once argument.")
+		}
+		if *kedaPort == *port || *kedaPort == *debugPort || *kedaPort == *adminPort {
+			validationErrors = append(validationErrors, "The KEDA port must be different from the port, the debug port and the admin port.")
+		}
+	}
+	if *metricsAdapterPort < 0 {
+		validationErrors = append(validationErrors, "The metrics adapter port cannot be negative.")
+	} else if *metricsAdapterPort != 0 {
+		if *operator || *once {
+			validationErrors = append(validationErrors, "The metrics adapter cannot be enabled in operator mode or with the once argument.")
+		}
+		if *metricsAdapterPort == *port || *metricsAdapterPort == *debugPort || *metricsAdapterPort == *adminPort || *metricsAdapterPort == *kedaPort {
+			validationErrors = append(validationErrors, "The metrics adapter port must be different from the port, the debug port, the admin port and the KEDA port.")
+		}
+		if *metricsAdapterCert == "" || *metricsAdapterKey == "" {
+			validationErrors = append(validationErrors, "The metrics adapter cert and key are required when the metrics adapter is enabled.")
+		}
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		validationErrors = append(validationErrors, "The TLS cert and key must be set together.")
+	} else if *tlsClientCA != "" && *tlsCert == "" {
+		validationErrors = append(validationErrors, "The TLS client CA requires the TLS cert and key.")
+	}
 	if len(validationErrors) > 0 {
 		return fmt.Errorf("Error(s) with arguments:\n%s", strings.Join(validationErrors, "\n"))
 	}
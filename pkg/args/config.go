@@ -0,0 +1,788 @@
+package args
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// commandLineFlags are the flags set on the command line, which take precedence over the config file
+	commandLineFlags map[string]bool
+	// configFlags are the flags set from the config file, which are reset when it's reloaded
+	configFlags = make(map[string]bool)
+)
+
+var (
+	configFile    = flag.String("config", "", "A YAML file with the arguments, see example-config.yaml. Arguments on the command line override the file.")
+	configProfile = flag.String("profile", "", "A profile in the --config file to apply over the rest of the file, ex: prod.")
+)
+
+// configFileSchema is the --config file, which is a Config with named profiles that override its values
+type configFileSchema struct {
+	Config   `yaml:",inline"`
+	Profiles map[string]Config `yaml:"profiles"`
+}
+
+// Config is the schema of the --config file.
+// Every value has the flag it sets in its flag tag, so the file is validated the same way as the command line.
+type Config struct {
+	Backend        *string              `yaml:"backend" flag:"backend"`
+	AzureDevops    AzureDevopsConfig    `yaml:"azureDevops"`
+	GitHub         GitHubConfig         `yaml:"github"`
+	GitLab         GitLabConfig         `yaml:"gitlab"`
+	Kubernetes     KubernetesConfig     `yaml:"kubernetes"`
+	Scaling        ScalingConfig        `yaml:"scaling"`
+	State          StateConfig          `yaml:"state"`
+	Store          StoreConfig          `yaml:"store"`
+	Sharding       ShardingConfig       `yaml:"sharding"`
+	Ownership      OwnershipConfig      `yaml:"ownership"`
+	History        HistoryConfig        `yaml:"history"`
+	Record         RecordConfig         `yaml:"record"`
+	RetryBudget    RetryBudgetConfig    `yaml:"retryBudget"`
+	Logging        LoggingConfig        `yaml:"logging"`
+	Health         HealthConfig         `yaml:"health"`
+	TLS            TLSConfig            `yaml:"tls"`
+	Admin          AdminConfig          `yaml:"admin"`
+	Tracing        TracingConfig        `yaml:"tracing"`
+	AzureMonitor   AzureMonitorConfig   `yaml:"azureMonitor"`
+	CloudEvents    CloudEventsConfig    `yaml:"cloudEvents"`
+	Notifications  NotificationsConfig  `yaml:"notifications"`
+	Operator       OperatorConfig       `yaml:"operator"`
+	KEDA           KEDAConfig           `yaml:"keda"`
+	MetricsAdapter MetricsAdapterConfig `yaml:"metricsAdapter"`
+	AKS            AKSConfig            `yaml:"aks"`
+}
+
+// AzureDevopsConfig is the Azure Devops section of the config file
+type AzureDevopsConfig struct {
+	URL             *string              `yaml:"url" flag:"url"`
+	URLFromWorkload *bool                `yaml:"urlFromWorkload" flag:"url-from-workload"`
+	Token           *string              `yaml:"token" flag:"token"`
+	Timeout         *string              `yaml:"timeout" flag:"azure-devops-timeout"`
+	Connections     AZDConnectionsConfig `yaml:"connections"`
+	KeyVault        KeyVaultConfig       `yaml:"keyVault"`
+	Vault           VaultConfig          `yaml:"vault"`
+
+	Organizations []OrganizationConfig `yaml:"organizations" flag:"organization"`
+}
+
+// AZDConnectionsConfig is the connections section of the Azure Devops section of the config file
+type AZDConnectionsConfig struct {
+	MaxIdle     *int     `yaml:"maxIdle" flag:"azure-devops-max-idle-conns"`
+	IdleTimeout *string  `yaml:"idleTimeout" flag:"azure-devops-idle-conn-timeout"`
+	HTTP2       *bool    `yaml:"http2" flag:"azure-devops-http2"`
+	IPFamily    *string  `yaml:"ipFamily" flag:"azure-devops-ip-family"`
+	DNSServers  []string `yaml:"dnsServers" flag:"azure-devops-dns-server"`
+}
+
+// OrganizationConfig is an additional Azure Devops organization in the config file.
+// The token is read from an environment variable, so it isn't stored in the config file.
+type OrganizationConfig struct {
+	URL         string `yaml:"url"`
+	TokenEnvVar string `yaml:"tokenEnvVar"`
+}
+
+func (c OrganizationConfig) flagValue() string {
+	return fmt.Sprintf("%s=%s", c.URL, c.TokenEnvVar)
+}
+
+func (c *OrganizationConfig) setFlagValue(value string) {
+	separator := strings.LastIndex(value, "=")
+	c.URL, c.TokenEnvVar = strings.TrimSpace(value[:separator]), strings.TrimSpace(value[separator+1:])
+}
+
+// GitHubConfig is the GitHub Actions section of the config file
+type GitHubConfig struct {
+	URL          *string  `yaml:"url" flag:"github-url"`
+	Token        *string  `yaml:"token" flag:"github-token"`
+	Organization *string  `yaml:"organization" flag:"github-org"`
+	Repositories []string `yaml:"repositories" flag:"github-repository"`
+	Labels       *string  `yaml:"labels" flag:"github-labels"`
+	Timeout      *string  `yaml:"timeout" flag:"github-timeout"`
+}
+
+// GitLabConfig is the GitLab runner section of the config file
+type GitLabConfig struct {
+	URL        *string  `yaml:"url" flag:"gitlab-url"`
+	Token      *string  `yaml:"token" flag:"gitlab-token"`
+	Group      *string  `yaml:"group" flag:"gitlab-group"`
+	Projects   []string `yaml:"projects" flag:"gitlab-project"`
+	RunnerTags []string `yaml:"runnerTags" flag:"gitlab-runner-tags"`
+	Timeout    *string  `yaml:"timeout" flag:"gitlab-timeout"`
+}
+
+// KeyVaultConfig is the Azure Key Vault section of the Azure Devops config
+type KeyVaultConfig struct {
+	URL      *string `yaml:"url" flag:"keyvault-url"`
+	Secret   *string `yaml:"secret" flag:"keyvault-secret"`
+	ClientID *string `yaml:"clientId" flag:"keyvault-client-id"`
+	Refresh  *string `yaml:"refresh" flag:"keyvault-refresh"`
+}
+
+// VaultConfig is the HashiCorp Vault section of the Azure Devops config
+type VaultConfig struct {
+	Address    *string `yaml:"address" flag:"vault-addr"`
+	Namespace  *string `yaml:"namespace" flag:"vault-namespace"`
+	AuthPath   *string `yaml:"authPath" flag:"vault-auth-path"`
+	Role       *string `yaml:"role" flag:"vault-role"`
+	SecretPath *string `yaml:"secretPath" flag:"vault-secret-path"`
+	SecretKey  *string `yaml:"secretKey" flag:"vault-secret-key"`
+	Refresh    *string `yaml:"refresh" flag:"vault-refresh"`
+}
+
+// KubernetesConfig is the Kubernetes section of the config file
+type KubernetesConfig struct {
+	Namespace     *string          `yaml:"namespace" flag:"namespace"`
+	Type          *string          `yaml:"type" flag:"type"`
+	Name          *string          `yaml:"name" flag:"name"`
+	Priority      *int             `yaml:"priority" flag:"priority"`
+	Workloads     []WorkloadConfig `yaml:"workloads" flag:"workload"`
+	SpotWorkloads []string         `yaml:"spotWorkloads" flag:"spot-workload"`
+	Timeout       *string          `yaml:"timeout" flag:"kubernetes-timeout"`
+	RBACScope     *string          `yaml:"rbacScope" flag:"rbac-scope"`
+	HPACheck      HPACheckConfig   `yaml:"hpaCheck"`
+
+	MissingWorkload        *string `yaml:"missingWorkload" flag:"missing-workload"`
+	MissingWorkloadTimeout *string `yaml:"missingWorkloadTimeout" flag:"missing-workload-timeout"`
+}
+
+// HPACheckConfig is the HorizontalPodAutoscaler conflict check section of the Kubernetes config
+type HPACheckConfig struct {
+	Enabled              *bool    `yaml:"enabled" flag:"hpa-check"`
+	Namespaces           []string `yaml:"namespaces" flag:"hpa-check-namespace"`
+	AcknowledgeConflicts *bool    `yaml:"acknowledgeConflicts" flag:"acknowledge-hpa-conflicts"`
+}
+
+// WorkloadConfig is an additional workload in the config file
+type WorkloadConfig struct {
+	Name     string `yaml:"name"`
+	Priority *int   `yaml:"priority"`
+}
+
+func (c WorkloadConfig) flagValue() string {
+	if c.Priority == nil {
+		return c.Name
+	}
+	return fmt.Sprintf("%s:%d", c.Name, *c.Priority)
+}
+
+func (c *WorkloadConfig) setFlagValue(value string) {
+	parts := strings.SplitN(strings.TrimSpace(value), ":", 2)
+	c.Name = parts[0]
+	if len(parts) == 2 {
+		priority, _ := strconv.Atoi(parts[1])
+		c.Priority = &priority
+	}
+}
+
+// ScalingConfig is the scaling section of the config file
+type ScalingConfig struct {
+	Min                   *int                 `yaml:"min" flag:"min"`
+	Max                   *int                 `yaml:"max" flag:"max"`
+	Rate                  *string              `yaml:"rate" flag:"rate"`
+	RateMin               *string              `yaml:"rateMin" flag:"rate-min"`
+	RateMax               *string              `yaml:"rateMax" flag:"rate-max"`
+	Concurrency           *int                 `yaml:"concurrency" flag:"concurrency"`
+	DryRun                *bool                `yaml:"dryRun" flag:"dry-run"`
+	Events                *bool                `yaml:"events" flag:"events"`
+	SafeToEvict           *bool                `yaml:"safeToEvict" flag:"safe-to-evict"`
+	DrainAnnotation       *bool                `yaml:"drainAnnotation" flag:"drain-annotation"`
+	TargetedScaleDown     *bool                `yaml:"targetedScaleDown" flag:"targeted-scale-down"`
+	HoldRollingUpdates    *bool                `yaml:"holdRollingUpdates" flag:"hold-rolling-updates"`
+	VerifyScale           *bool                `yaml:"verifyScale" flag:"verify-scale"`
+	OSAware               *bool                `yaml:"osAware" flag:"os-aware"`
+	SyncCapabilities      *bool                `yaml:"syncCapabilities" flag:"sync-capabilities"`
+	AgentNamePattern      *string              `yaml:"agentNamePattern" flag:"agent-name-pattern"`
+	RemoveDuplicateAgents *bool                `yaml:"removeDuplicateAgents" flag:"remove-duplicate-agents"`
+	RightSizingReport     *string              `yaml:"rightSizingReport" flag:"right-sizing-report"`
+	Recycle               RecycleConfig        `yaml:"recycle"`
+	OfflineAgents         OfflineAgentsConfig  `yaml:"offlineAgents"`
+	StalePods             StalePodsConfig      `yaml:"stalePods"`
+	OrdinalGaps           OrdinalGapsConfig    `yaml:"ordinalGaps"`
+	Anomalies             AnomaliesConfig      `yaml:"anomalies"`
+	Quarantine            QuarantineConfig     `yaml:"quarantine"`
+	Rollover              RolloverConfig       `yaml:"rollover"`
+	ScaleDown             ScaleDownConfig      `yaml:"scaleDown"`
+	ScaleUp               ScaleUpConfig        `yaml:"scaleUp"`
+	RateLimit             RateLimitConfig      `yaml:"rateLimit"`
+	PendingBackoff        PendingBackoffConfig `yaml:"pendingBackoff"`
+	Registration          RegistrationConfig   `yaml:"registration"`
+	ManualScale           ManualScaleConfig    `yaml:"manualScale"`
+	DecisionHook          DecisionHookConfig   `yaml:"decisionHook"`
+	ExecHooks             ExecHooksConfig      `yaml:"execHooks"`
+	FailStatic            FailStaticConfig     `yaml:"failStatic"`
+	Policy                PolicyConfig         `yaml:"policy"`
+	Capacity              CapacityConfig       `yaml:"capacity"`
+	HealthGates           HealthGatesConfig    `yaml:"healthGates"`
+	Balloon               BalloonConfig        `yaml:"balloon"`
+	MaintenanceWindows    []string             `yaml:"maintenanceWindows" flag:"maintenance-window"`
+	ScheduleTimeZone      *string              `yaml:"scheduleTimezone" flag:"schedule-timezone"`
+	DemandRoutes          []DemandRouteConfig  `yaml:"demandRoutes" flag:"demand-route"`
+}
+
+// DemandRouteConfig is a demand and the workloads that run its jobs in the config file
+type DemandRouteConfig struct {
+	Demand    string   `yaml:"demand"`
+	Workloads []string `yaml:"workloads"`
+}
+
+func (c DemandRouteConfig) flagValue() string {
+	return fmt.Sprintf("%s=%s", c.Demand, strings.Join(c.Workloads, ","))
+}
+
+func (c *DemandRouteConfig) setFlagValue(value string) {
+	parts := strings.SplitN(value, "=", 2)
+	c.Demand, c.Workloads = strings.TrimSpace(parts[0]), splitList(parts[1])
+}
+
+// ScaleDownConfig is the scale down section of the config file
+type ScaleDownConfig struct {
+	Delay     *string `yaml:"delay" flag:"scale-down"`
+	IdleDelay *string `yaml:"idleDelay" flag:"scale-down-delay"`
+	Max       *int    `yaml:"max" flag:"scale-down-max"`
+
+	DrainTimeout       *string `yaml:"drainTimeout" flag:"drain-timeout"`
+	DrainTimeoutPolicy *string `yaml:"drainTimeoutPolicy" flag:"drain-timeout-policy"`
+	DrainMaxRetries    *int    `yaml:"drainMaxRetries" flag:"drain-max-retries"`
+}
+
+// ScaleUpConfig is the scale up section of the config file
+type ScaleUpConfig struct {
+	Steps *string `yaml:"steps" flag:"scale-up-steps"`
+}
+
+// RateLimitConfig is the rate limit section of the config file
+type RateLimitConfig struct {
+	Max    *int    `yaml:"max" flag:"rate-limit"`
+	Window *string `yaml:"window" flag:"rate-limit-window"`
+}
+
+// PendingBackoffConfig is the pending backoff section of the config file
+type PendingBackoffConfig struct {
+	Initial *string `yaml:"initial" flag:"pending-backoff"`
+	Max     *string `yaml:"max" flag:"pending-backoff-max"`
+}
+
+// RegistrationConfig is the agent registration section of the config file
+type RegistrationConfig struct {
+	Timeout    *string `yaml:"timeout" flag:"registration-timeout"`
+	Backoff    *string `yaml:"backoff" flag:"registration-backoff"`
+	BackoffMax *string `yaml:"backoffMax" flag:"registration-backoff-max"`
+	Failures   *int    `yaml:"failures" flag:"registration-failures"`
+}
+
+// FailStaticConfig is the fail-static section of the config file
+type FailStaticConfig struct {
+	After *string `yaml:"after" flag:"fail-static-after"`
+	Min   *int    `yaml:"min" flag:"fail-static-min"`
+}
+
+// ManualScaleConfig is the manual scale section of the config file
+type ManualScaleConfig struct {
+	Policy   *string `yaml:"policy" flag:"manual-scale-policy"`
+	Duration *string `yaml:"duration" flag:"manual-scale-duration"`
+}
+
+// DecisionHookConfig is the decision hook section of the config file
+type DecisionHookConfig struct {
+	URL           *string `yaml:"url" flag:"decision-hook-url"`
+	Timeout       *string `yaml:"timeout" flag:"decision-hook-timeout"`
+	FailurePolicy *string `yaml:"failurePolicy" flag:"decision-hook-failure-policy"`
+}
+
+// ExecHooksConfig is the exec hooks section of the config file
+type ExecHooksConfig struct {
+	Hooks         []ExecHookConfig `yaml:"hooks" flag:"exec-hook"`
+	Timeout       *string          `yaml:"timeout" flag:"exec-hook-timeout"`
+	FailurePolicy *string          `yaml:"failurePolicy" flag:"exec-hook-failure-policy"`
+}
+
+// ExecHookConfig is an exec hook in the config file
+type ExecHookConfig struct {
+	Event   string `yaml:"event"`
+	Command string `yaml:"command"`
+}
+
+func (c ExecHookConfig) flagValue() string {
+	return fmt.Sprintf("%s=%s", c.Event, c.Command)
+}
+
+func (c *ExecHookConfig) setFlagValue(value string) {
+	parts := strings.SplitN(value, "=", 2)
+	c.Event, c.Command = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// PolicyConfig is the policy section of the config file
+type PolicyConfig struct {
+	Name                 *string  `yaml:"name" flag:"policy"`
+	SLOMaxQueueTime      *string  `yaml:"sloMaxQueueTime" flag:"slo-max-queue-time"`
+	SLOWindow            *string  `yaml:"sloWindow" flag:"slo-window"`
+	QueueAgeWeightPeriod *string  `yaml:"queueAgeWeightPeriod" flag:"queue-age-weight-period"`
+	QueueAgeMaxWeight    *float64 `yaml:"queueAgeMaxWeight" flag:"queue-age-max-weight"`
+	CountGatedJobs       *bool    `yaml:"countGatedJobs" flag:"count-gated-jobs"`
+	CountDelayedJobs     *bool    `yaml:"countDelayedJobs" flag:"count-delayed-jobs"`
+	DelayedJobsLookahead *string  `yaml:"delayedJobsLookahead" flag:"delayed-jobs-lookahead"`
+}
+
+// CapacityConfig is the capacity section of the config file
+type CapacityConfig struct {
+	Check           *bool                         `yaml:"check" flag:"capacity-check"`
+	Overshoot       *bool                         `yaml:"overshoot" flag:"capacity-overshoot"`
+	Quota           *bool                         `yaml:"quota" flag:"capacity-quota"`
+	PriorityClasses []CapacityPriorityClassConfig `yaml:"priorityClasses" flag:"capacity-priority-class"`
+}
+
+// HealthGatesConfig is the cluster health gates section of the config file
+type HealthGatesConfig struct {
+	Gates          []string `yaml:"gates" flag:"health-gate"`
+	NodeReadyRatio *float64 `yaml:"nodeReadyRatio" flag:"health-gate-node-ready-ratio"`
+	RegistryURL    *string  `yaml:"registryUrl" flag:"health-gate-registry-url"`
+	MaxScaleUp     *int     `yaml:"maxScaleUp" flag:"health-gate-max-scale-up"`
+}
+
+// CapacityPriorityClassConfig is how the capacity check treats the agents of a PriorityClass in the config file
+type CapacityPriorityClassConfig struct {
+	Name   string `yaml:"name"`
+	Policy string `yaml:"policy"`
+}
+
+func (c CapacityPriorityClassConfig) flagValue() string {
+	return fmt.Sprintf("%s=%s", c.Name, c.Policy)
+}
+
+func (c *CapacityPriorityClassConfig) setFlagValue(value string) {
+	parts := strings.SplitN(value, "=", 2)
+	c.Name, c.Policy = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// RecycleConfig is the agent recycling section of the config file
+type RecycleConfig struct {
+	Outdated        *bool   `yaml:"outdated" flag:"recycle-outdated-agents"`
+	MinAgentVersion *string `yaml:"minAgentVersion" flag:"min-agent-version"`
+	OutdatedPods    *bool   `yaml:"outdatedPods" flag:"recycle-outdated-pods"`
+	AfterJobs       *int    `yaml:"afterJobs" flag:"recycle-after-jobs"`
+	MaxAge          *string `yaml:"maxAge" flag:"recycle-max-age"`
+	MaxUnavailable  *int    `yaml:"maxUnavailable" flag:"recycle-max-unavailable"`
+}
+
+// OfflineAgentsConfig is the offline agents section of the config file
+type OfflineAgentsConfig struct {
+	Timeout   *string `yaml:"timeout" flag:"offline-agent-timeout"`
+	RateLimit *int    `yaml:"rateLimit" flag:"offline-agent-rate-limit"`
+}
+
+// StalePodsConfig is the stale agent pods section of the config file
+type StalePodsConfig struct {
+	Restarts        *int    `yaml:"restarts" flag:"stale-pod-restarts"`
+	NotReadyTimeout *string `yaml:"notReadyTimeout" flag:"stale-pod-not-ready-timeout"`
+}
+
+// OrdinalGapsConfig is the StatefulSet ordinal gaps section of the config file
+type OrdinalGapsConfig struct {
+	Enabled          *bool   `yaml:"enabled" flag:"ordinal-gaps"`
+	ForceDeleteAfter *string `yaml:"forceDeleteAfter" flag:"force-delete-terminating-after"`
+}
+
+// AnomaliesConfig is the anomaly detection section of the config file
+type AnomaliesConfig struct {
+	Window    *string `yaml:"window" flag:"anomaly-window"`
+	MaxPinned *string `yaml:"maxPinned" flag:"anomaly-max-pinned"`
+}
+
+// QuarantineConfig is the failing agent quarantine section of the config file
+type QuarantineConfig struct {
+	FailureRate *float64 `yaml:"failureRate" flag:"quarantine-failure-rate"`
+	MinJobs     *int     `yaml:"minJobs" flag:"quarantine-min-jobs"`
+}
+
+// RolloverConfig is the blue/green rollover section of the config file
+type RolloverConfig struct {
+	From *string `yaml:"from" flag:"rollover-from"`
+	To   *string `yaml:"to" flag:"rollover-to"`
+}
+
+// BalloonConfig is the balloon section of the config file
+type BalloonConfig struct {
+	Replicas      *int    `yaml:"replicas" flag:"balloon-replicas"`
+	PriorityClass *string `yaml:"priorityClass" flag:"balloon-priority-class"`
+	Image         *string `yaml:"image" flag:"balloon-image"`
+}
+
+// StateConfig is the state section of the config file
+type StateConfig struct {
+	ConfigMap *string `yaml:"configMap" flag:"state-configmap"`
+}
+
+// StoreConfig is the section of the config file of where the state and history are persisted
+type StoreConfig struct {
+	Type  *string     `yaml:"type" flag:"store"`
+	Path  *string     `yaml:"path" flag:"store-path"`
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// RedisConfig is the Redis section of the store of the config file
+type RedisConfig struct {
+	Address   *string `yaml:"address" flag:"redis-addr"`
+	Password  *string `yaml:"password" flag:"redis-password"`
+	DB        *int    `yaml:"db" flag:"redis-db"`
+	KeyPrefix *string `yaml:"keyPrefix" flag:"redis-key-prefix"`
+	TLS       *bool   `yaml:"tls" flag:"redis-tls"`
+}
+
+// ShardingConfig is the sharding section of the config file
+type ShardingConfig struct {
+	Shards *int `yaml:"shards" flag:"shards"`
+	Shard  *int `yaml:"shard" flag:"shard"`
+}
+
+// OwnershipConfig is the workload ownership section of the config file
+type OwnershipConfig struct {
+	Enabled *bool   `yaml:"enabled" flag:"ownership"`
+	OwnerID *string `yaml:"ownerId" flag:"owner-id"`
+	Lease   *string `yaml:"lease" flag:"ownership-lease"`
+}
+
+// RetryBudgetConfig is the retry budget section of the config file
+type RetryBudgetConfig struct {
+	Calls  *int    `yaml:"calls" flag:"retry-budget"`
+	Window *string `yaml:"window" flag:"retry-budget-window"`
+}
+
+// HistoryConfig is the decision history section of the config file
+type HistoryConfig struct {
+	Size      *int    `yaml:"size" flag:"history-size"`
+	ConfigMap *string `yaml:"configMap" flag:"history-configmap"`
+}
+
+// RecordConfig is the snapshot recording section of the config file
+type RecordConfig struct {
+	Dir      *string `yaml:"dir" flag:"record-dir"`
+	Interval *string `yaml:"interval" flag:"record-interval"`
+	MaxSize  *int    `yaml:"maxSize" flag:"record-max-size"`
+}
+
+// LoggingConfig is the logging section of the config file
+type LoggingConfig struct {
+	Level        *string           `yaml:"level" flag:"log-level"`
+	Levels       map[string]string `yaml:"levels" flag:"log-levels"`
+	Format       *string           `yaml:"format" flag:"log-format"`
+	SampleFirst  *int              `yaml:"sampleFirst" flag:"log-sample-first"`
+	SampleWindow *string           `yaml:"sampleWindow" flag:"log-sample-window"`
+	File         *string           `yaml:"file" flag:"log-file"`
+	AuditLog     *string           `yaml:"auditLog" flag:"audit-log"`
+}
+
+// HealthConfig is the health check section of the config file
+type HealthConfig struct {
+	Port         *int    `yaml:"port" flag:"port"`
+	DebugPort    *int    `yaml:"debugPort" flag:"debug-port"`
+	MetricsToken *string `yaml:"metricsToken" flag:"metrics-token"`
+}
+
+// TLSConfig is the TLS section of the config file
+type TLSConfig struct {
+	CertFile     *string `yaml:"certFile" flag:"tls-cert"`
+	KeyFile      *string `yaml:"keyFile" flag:"tls-key"`
+	ClientCAFile *string `yaml:"clientCAFile" flag:"tls-client-ca"`
+}
+
+// AdminConfig is the admin API section of the config file
+type AdminConfig struct {
+	Port  *int    `yaml:"port" flag:"admin-port"`
+	Token *string `yaml:"token" flag:"admin-token"`
+}
+
+// KEDAConfig is the KEDA external scaler section of the config file
+type KEDAConfig struct {
+	Port *int `yaml:"port" flag:"keda-port"`
+}
+
+// MetricsAdapterConfig is the external metrics adapter section of the config file
+type MetricsAdapterConfig struct {
+	Port         *int    `yaml:"port" flag:"metrics-adapter-port"`
+	CertFile     *string `yaml:"certFile" flag:"metrics-adapter-cert"`
+	KeyFile      *string `yaml:"keyFile" flag:"metrics-adapter-key"`
+	ClientCAFile *string `yaml:"clientCAFile" flag:"metrics-adapter-client-ca"`
+}
+
+// AKSConfig is the AKS node pool section of the config file
+type AKSConfig struct {
+	SubscriptionID *string `yaml:"subscriptionId" flag:"aks-subscription-id"`
+	ResourceGroup  *string `yaml:"resourceGroup" flag:"aks-resource-group"`
+	Cluster        *string `yaml:"cluster" flag:"aks-cluster"`
+	NodePool       *string `yaml:"nodePool" flag:"aks-node-pool"`
+	ClientID       *string `yaml:"clientId" flag:"aks-client-id"`
+	MaxNodes       *int    `yaml:"maxNodes" flag:"aks-max-nodes"`
+	PodsPerNode    *int    `yaml:"podsPerNode" flag:"aks-pods-per-node"`
+	Cooldown       *string `yaml:"cooldown" flag:"aks-cooldown"`
+}
+
+// TracingConfig is the tracing section of the config file
+type TracingConfig struct {
+	OTLPEndpoint *string           `yaml:"otlpEndpoint" flag:"otlp-endpoint"`
+	OTLPHeaders  map[string]string `yaml:"otlpHeaders" flag:"otlp-headers"`
+}
+
+// AzureMonitorConfig is the Azure Monitor section of the config file
+type AzureMonitorConfig struct {
+	ConnectionString *string `yaml:"connectionString" flag:"appinsights-connection-string"`
+}
+
+// CloudEventsConfig is the CloudEvents section of the config file
+type CloudEventsConfig struct {
+	Sink   *string `yaml:"sink" flag:"cloudevents-sink"`
+	Source *string `yaml:"source" flag:"cloudevents-source"`
+}
+
+// NotificationsConfig is the notifications section of the config file
+type NotificationsConfig struct {
+	Webhook  WebhookConfig `yaml:"webhook"`
+	Slack    ChatConfig    `yaml:"slack"`
+	Teams    ChatConfig    `yaml:"teams"`
+	Template *string       `yaml:"template" flag:"notification-template"`
+}
+
+// OperatorConfig is the operator mode section of the config file
+type OperatorConfig struct {
+	Enabled      *bool                  `yaml:"enabled" flag:"operator"`
+	Namespaces   []string               `yaml:"namespaces" flag:"operator-namespace"`
+	AllowedPools []AllowedPoolsConfig   `yaml:"allowedPools" flag:"operator-allowed-pools"`
+	Webhook      AdmissionWebhookConfig `yaml:"webhook"`
+}
+
+// AllowedPoolsConfig is the agent pools the AzpAgentAutoscaler resources of a namespace can reference in the config file
+type AllowedPoolsConfig struct {
+	Namespace string   `yaml:"namespace"`
+	Pools     []string `yaml:"pools"`
+}
+
+func (c AllowedPoolsConfig) flagValue() string {
+	return fmt.Sprintf("%s=%s", c.Namespace, strings.Join(c.Pools, ","))
+}
+
+func (c *AllowedPoolsConfig) setFlagValue(value string) {
+	parts := strings.SplitN(value, "=", 2)
+	c.Namespace, c.Pools = strings.TrimSpace(parts[0]), splitList(parts[1])
+}
+
+// AdmissionWebhookConfig is the admission webhook section of the operator section of the config file
+type AdmissionWebhookConfig struct {
+	Port         *int    `yaml:"port" flag:"admission-webhook-port"`
+	CertFile     *string `yaml:"certFile" flag:"admission-webhook-cert"`
+	KeyFile      *string `yaml:"keyFile" flag:"admission-webhook-key"`
+	ClientCAFile *string `yaml:"clientCAFile" flag:"admission-webhook-client-ca"`
+}
+
+// WebhookConfig is the webhook notifications section of the config file
+type WebhookConfig struct {
+	URLs   []string `yaml:"urls" flag:"webhook-url"`
+	Secret *string  `yaml:"secret" flag:"webhook-secret"`
+}
+
+// ChatConfig is the Slack or Microsoft Teams notifications section of the config file.
+// Its flags are prefixed with the section name.
+type ChatConfig struct {
+	WebhookURL  *string `yaml:"webhookUrl" flag:"webhook-url"`
+	MinSeverity *string `yaml:"minSeverity" flag:"min-severity"`
+}
+
+// configFlagValue is a config value that isn't set on its flag as-is
+type configFlagValue interface {
+	flagValue() string
+}
+
+// configFlagSetter parses the value of a flag back into a config value, the reverse of configFlagValue.
+// The value has already been validated.
+type configFlagSetter interface {
+	setFlagValue(value string)
+}
+
+// LoadConfig sets the arguments that weren't set on the command line from the --config file, if there is one.
+// It must be called after the flags are parsed and before ValidateArgs().
+func LoadConfig() error {
+	if *configFile == "" {
+		if *configProfile != "" {
+			return fmt.Errorf("Profile argument requires a config file")
+		}
+		return nil
+	}
+	data, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return fmt.Errorf("Error reading the config file %s: %w", *configFile, err)
+	}
+	var file configFileSchema
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("Error parsing the config file %s: %w", *configFile, err)
+	}
+	config := file.Config
+	if *configProfile != "" {
+		profile, exists := file.Profiles[*configProfile]
+		if !exists {
+			return fmt.Errorf("The config file %s has no profile %s", *configFile, *configProfile)
+		}
+		overlayConfig(reflect.ValueOf(&config).Elem(), reflect.ValueOf(profile))
+	}
+
+	if commandLineFlags == nil {
+		commandLineFlags = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			commandLineFlags[f.Name] = true
+		})
+	}
+	if err := applyConfig(reflect.ValueOf(config), "", ""); err != nil {
+		return fmt.Errorf("Error in the config file %s: %w", *configFile, err)
+	}
+	return nil
+}
+
+// ReloadConfig re-reads the --config file and returns the new arguments.
+// Values removed from the file are reset to their defaults, and the arguments set on the command line are kept.
+func ReloadConfig() (Args, error) {
+	for name := range configFlags {
+		resetFlag(flag.Lookup(name))
+	}
+	configFlags = make(map[string]bool)
+	if err := LoadConfig(); err != nil {
+		return Args{}, err
+	}
+	if err := ValidateArgs(); err != nil {
+		return Args{}, err
+	}
+	return ArgsFromFlags(), nil
+}
+
+// resetFlag sets a flag back to its default value
+func resetFlag(f *flag.Flag) {
+	if values, isSlice := f.Value.(*stringSliceFlag); isSlice {
+		*values = nil
+	} else {
+		f.Value.Set(f.DefValue)
+	}
+}
+
+// applyConfig sets the flags of every value in a config section
+func applyConfig(section reflect.Value, path string, flagPrefix string) error {
+	for i := 0; i < section.NumField(); i++ {
+		field := section.Type().Field(i)
+		value := section.Field(i)
+		fieldPath := strings.TrimPrefix(path+"."+strings.Split(field.Tag.Get("yaml"), ",")[0], ".")
+
+		flagName, hasFlag := field.Tag.Lookup("flag")
+		if !hasFlag {
+			// Slack and Teams share a section type, so their flags are prefixed with the section name
+			prefix := flagPrefix
+			if field.Type == reflect.TypeOf(ChatConfig{}) {
+				prefix = strings.ToLower(field.Name) + "-"
+			}
+			if err := applyConfig(value, fieldPath, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+		flagName = flagPrefix + flagName
+
+		// Arguments on the command line take precedence, including every value of repeatable flags
+		if commandLineFlags[flagName] {
+			continue
+		}
+		for _, flagValue := range configFlagValues(value) {
+			expanded, err := expandEnv(flagValue)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", fieldPath, err)
+			}
+			// The value is logged before expansion, so secrets from environment variables aren't
+			if err := flag.Set(flagName, expanded); err != nil {
+				return fmt.Errorf("invalid %s %q: %w", fieldPath, flagValue, err)
+			}
+			configFlags[flagName] = true
+		}
+	}
+	return nil
+}
+
+// overlayConfig replaces the values of a config section with the values set in a profile.
+// Lists and maps set in the profile replace the whole list or map.
+func overlayConfig(section reflect.Value, profile reflect.Value) {
+	for i := 0; i < section.NumField(); i++ {
+		value := profile.Field(i)
+		switch value.Kind() {
+		case reflect.Struct:
+			overlayConfig(section.Field(i), value)
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			if !value.IsNil() {
+				section.Field(i).Set(value)
+			}
+		}
+	}
+}
+
+// envVarPattern matches ${VAR}, ${VAR:-default} and the $$ escape
+var envVarPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} with the value of an environment variable, or ${VAR:-default} with a default if it is unset or empty.
+// $$ is a literal $. It is an error if a variable without a default is not set.
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envVarPattern.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		groups := envVarPattern.FindStringSubmatch(match)
+		name, hasDefault, defaultValue := groups[1], groups[2] != "", groups[3]
+		envValue, isSet := os.LookupEnv(name)
+		if hasDefault && envValue == "" {
+			return defaultValue
+		}
+		if !isSet {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) == 1 {
+		return "", fmt.Errorf("environment variable %s is not set", missing[0])
+	} else if len(missing) > 1 {
+		return "", fmt.Errorf("environment variables %s are not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// configFlagValues returns the flag values of a config value. Lists are a value per item, and maps are a single comma-separated list.
+func configFlagValues(value reflect.Value) []string {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return nil
+		}
+		return []string{fmt.Sprint(value.Elem().Interface())}
+	case reflect.Slice:
+		var values []string
+		for i := 0; i < value.Len(); i++ {
+			if item, isFlagValue := value.Index(i).Interface().(configFlagValue); isFlagValue {
+				values = append(values, item.flagValue())
+			} else {
+				values = append(values, fmt.Sprint(value.Index(i).Interface()))
+			}
+		}
+		return values
+	case reflect.Map:
+		if value.Len() == 0 {
+			return nil
+		}
+		var pairs []string
+		for _, key := range value.MapKeys() {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", key.Interface(), value.MapIndex(key).Interface()))
+		}
+		sort.Strings(pairs)
+		return []string{strings.Join(pairs, ",")}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package args
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// secretFlagEnvVars are the environment variables the secrets of a migrated config are read from,
+// so the secrets set on the command line aren't written to the config file
+var secretFlagEnvVars = map[string]string{
+	"token":                         "AZP_TOKEN",
+	"github-token":                  "GITHUB_TOKEN",
+	"gitlab-token":                  "GITLAB_TOKEN",
+	"admin-token":                   "ADMIN_TOKEN",
+	"metrics-token":                 "METRICS_TOKEN",
+	"webhook-secret":                "WEBHOOK_SECRET",
+	"slack-webhook-url":             "SLACK_WEBHOOK_URL",
+	"teams-webhook-url":             "TEAMS_WEBHOOK_URL",
+	"appinsights-connection-string": "APPLICATIONINSIGHTS_CONNECTION_STRING",
+	"redis-password":                "REDIS_PASSWORD",
+}
+
+// unmigratedFlags are the flags of the CLI itself, which don't belong in a config file
+var unmigratedFlags = map[string]bool{
+	"config":     true,
+	"profile":    true,
+	"output":     true,
+	"probe":      true,
+	"migrate-to": true,
+}
+
+// MigrateConfig returns a config file with every argument that was set on the command line or from the --config file,
+// and notes about what couldn't be migrated as-is, ex: a secret that is now read from an environment variable.
+// It must be called after LoadConfig() and ValidateArgs(). Arguments that default to an environment variable and weren't
+// set on the command line are left out, as they still default to it.
+func MigrateConfig() (Config, []string) {
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	var config Config
+	var notes []string
+	migrated := make(map[string]bool)
+	migrateConfig(reflect.ValueOf(&config).Elem(), "", setFlags, migrated, &notes)
+
+	var unknown []string
+	for name := range setFlags {
+		if !migrated[name] && !unmigratedFlags[name] {
+			unknown = append(unknown, "--"+name)
+		}
+	}
+	sort.Strings(unknown)
+	if len(unknown) > 0 {
+		notes = append(notes, fmt.Sprintf("The config file has no value for %s, keep it on the command line", strings.Join(unknown, ", ")))
+	}
+	return config, notes
+}
+
+// migrateConfig sets every value of a config section whose flag is set, the reverse of applyConfig
+func migrateConfig(section reflect.Value, flagPrefix string, setFlags map[string]bool, migrated map[string]bool, notes *[]string) {
+	for i := 0; i < section.NumField(); i++ {
+		field := section.Type().Field(i)
+		value := section.Field(i)
+
+		flagName, hasFlag := field.Tag.Lookup("flag")
+		if !hasFlag {
+			prefix := flagPrefix
+			if field.Type == reflect.TypeOf(ChatConfig{}) {
+				prefix = strings.ToLower(field.Name) + "-"
+			}
+			migrateConfig(value, prefix, setFlags, migrated, notes)
+			continue
+		}
+		flagName = flagPrefix + flagName
+		if !setFlags[flagName] {
+			continue
+		}
+		migrated[flagName] = true
+		f := flag.Lookup(flagName)
+
+		if envVar, isSecret := secretFlagEnvVars[flagName]; isSecret {
+			value.Set(reflect.ValueOf(stringPtr("${" + envVar + "}")))
+			if os.Getenv(envVar) != f.Value.String() {
+				*notes = append(*notes, fmt.Sprintf("The config file reads --%s from the %s environment variable, set it to the value of the argument", flagName, envVar))
+			}
+			continue
+		}
+		setConfigValue(value, f.Value)
+	}
+}
+
+// setConfigValue sets a config value from the value of its flag, which has already been validated
+func setConfigValue(value reflect.Value, flagValue flag.Value) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		text := flagValue.String()
+		parsed := reflect.New(value.Type().Elem())
+		switch parsed.Elem().Kind() {
+		case reflect.Bool:
+			b, _ := strconv.ParseBool(text)
+			parsed.Elem().SetBool(b)
+		case reflect.Int:
+			i, _ := strconv.ParseInt(text, 10, 64)
+			parsed.Elem().SetInt(i)
+		case reflect.Float64:
+			f, _ := strconv.ParseFloat(text, 64)
+			parsed.Elem().SetFloat(f)
+		default:
+			parsed.Elem().SetString(escapeEnv(text))
+		}
+		value.Set(parsed)
+	case reflect.Slice:
+		for _, item := range *flagValue.(*stringSliceFlag) {
+			parsed := reflect.New(value.Type().Elem())
+			if setter, isSetter := parsed.Interface().(configFlagSetter); isSetter {
+				setter.setFlagValue(item)
+			} else {
+				parsed.Elem().SetString(escapeEnv(item))
+			}
+			value.Set(reflect.Append(value, parsed.Elem()))
+		}
+	case reflect.Map:
+		pairs := reflect.MakeMap(value.Type())
+		for _, pair := range splitList(flagValue.String()) {
+			parts := strings.SplitN(pair, "=", 2)
+			pairs.SetMapIndex(reflect.ValueOf(strings.TrimSpace(parts[0])), reflect.ValueOf(escapeEnv(strings.TrimSpace(parts[1]))))
+		}
+		value.Set(pairs)
+	}
+}
+
+// escapeEnv escapes the $ of a value, so it isn't expanded as an environment variable when the config file is loaded
+func escapeEnv(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+func stringPtr(value string) *string {
+	return &value
+}
@@ -0,0 +1,63 @@
+package args
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+// redactedFlags are the flags that can contain credentials besides the secrets, ex: a webhook URL with a token in its
+// query string, or the headers of the OTLP endpoint with an API key
+var redactedFlags = map[string]bool{
+	"webhook-url":       true,
+	"decision-hook-url": true,
+	"otlp-headers":      true,
+}
+
+// ConfigSummary returns the arguments that were set on the command line or from the --config file as --name=value,
+// sorted by name, so the effective config of a running autoscaler can be logged. The secrets are redacted, and the
+// secrets that default to an environment variable are included if they're set, so it's known they were found.
+// It must be called after LoadConfig() and ValidateArgs().
+func ConfigSummary() []string {
+	values := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	for name := range secretFlagEnvVars {
+		if f := flag.Lookup(name); f != nil && f.Value.String() != "" {
+			values[name] = f.Value.String()
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	summary := make([]string, len(names))
+	for i, name := range names {
+		value := values[name]
+		if _, isSecret := secretFlagEnvVars[name]; (isSecret || redactedFlags[name]) && value != "" {
+			value = logging.Redacted
+		}
+		summary[i] = fmt.Sprintf("--%s=%s", name, value)
+	}
+	return summary
+}
+
+// redactSecrets makes the logs, errors and statuses redact the values of the secrets and of the flags that can contain
+// credentials
+func redactSecrets() {
+	for name := range secretFlagEnvVars {
+		if f := flag.Lookup(name); f != nil {
+			logging.RedactSecret(f.Value.String())
+		}
+	}
+	for name := range redactedFlags {
+		if f := flag.Lookup(name); f != nil {
+			logging.RedactSecret(f.Value.String())
+		}
+	}
+}
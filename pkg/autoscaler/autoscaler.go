@@ -0,0 +1,249 @@
+// Package autoscaler embeds the autoscaling loop of the agents in another binary, ex: a platform team's own controller.
+// The command line autoscaler is built on it, and serves the health checks, metrics and admin API around it.
+//
+// The scaling state, explanations, health and logging of the autoscaler are global to the process, so only one
+// Autoscaler can exist at a time. Another one can be created once it's closed.
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+var logger = logging.Component("autoscaler")
+
+// historyPersistInterval is how often the decision history is saved to its store while running
+const historyPersistInterval = time.Minute
+
+// ErrAutoscalerExists is returned when an Autoscaler is created while another one isn't closed, as they would share
+// the scaling state of the process
+var ErrAutoscalerExists = errors.New("Error - only one autoscaler can exist at a time")
+
+var (
+	instanceMutex sync.Mutex
+	instance      *Autoscaler
+)
+
+// Autoscaler autoscales the agent workloads of its config. It's safe to reload the config while it's running.
+type Autoscaler struct {
+	lock        sync.RWMutex
+	args        args.Args
+	backend     ci.Backend
+	k8sClient   kubernetes.ClientAsync
+	targets     TargetList
+	initialized bool
+}
+
+// New returns an autoscaler of the workloads of the config. The clients are created when it's initialized.
+// The config must be valid, ex: from args.ArgsFromFlags after args.ValidateArgs.
+// It returns ErrAutoscalerExists if another autoscaler isn't closed.
+func New(cfg args.Args) (*Autoscaler, error) {
+	return register(&Autoscaler{args: cfg})
+}
+
+// NewWithClients returns an autoscaler of the workloads of the config that uses the given CI backend and Kubernetes
+// client, ex: to share the clients of the embedding binary. It returns ErrAutoscalerExists if another autoscaler isn't
+// closed.
+func NewWithClients(cfg args.Args, backend ci.Backend, k8sClient kubernetes.ClientAsync) (*Autoscaler, error) {
+	return register(&Autoscaler{args: cfg, backend: backend, k8sClient: k8sClient})
+}
+
+// register makes the autoscaler the instance of the process, unless another one isn't closed
+func register(a *Autoscaler) (*Autoscaler, error) {
+	instanceMutex.Lock()
+	defer instanceMutex.Unlock()
+	if instance != nil {
+		return nil, ErrAutoscalerExists
+	}
+	instance = a
+	return a, nil
+}
+
+// Close releases the autoscaler once it isn't running, so another one can be created. The next autoscaler continues
+// with the scaling state of the workloads, ex: their scale down delays.
+func (a *Autoscaler) Close() {
+	instanceMutex.Lock()
+	defer instanceMutex.Unlock()
+	if instance == a {
+		instance = nil
+	}
+}
+
+// Init creates the clients, retrieves the agent workloads, discovers their agent pools and loads the persisted state
+// and history. It's called by Run and Once, and only initializes the autoscaler the first time it's called.
+func (a *Autoscaler) Init() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.initialized {
+		return nil
+	}
+	if a.args.Operator.Enabled || a.args.ExternallyScaled() {
+		return fmt.Errorf("Error - the autoscaler can't be embedded in operator mode, or when the agents are scaled by KEDA or a HorizontalPodAutoscaler")
+	}
+
+	var targets []scaling.Target
+	var err error
+	if a.k8sClient == nil {
+		if a.backend, a.k8sClient, targets, err = Initialize(&a.args); err != nil {
+			return err
+		}
+	} else {
+		if err := WaitForWorkloads(a.k8sClient.Sync(), a.args); err != nil {
+			return err
+		}
+		if a.backend == nil {
+			if a.backend, err = MakeBackend(a.args, a.k8sClient); err != nil {
+				return err
+			}
+		}
+		if targets, err = InitializeTargets(a.backend, a.k8sClient, a.args); err != nil {
+			return err
+		}
+	}
+	a.targets.Set(targets)
+
+	if a.args.State.ConfigMapName != "" {
+		if err := scaling.LoadState(scaling.StateStore(a.k8sClient.Sync(), a.args)); err != nil {
+			return err
+		}
+	}
+	if a.args.History.ConfigMapName != "" {
+		if err := scaling.LoadHistory(scaling.HistoryStore(a.k8sClient.Sync(), a.args)); err != nil {
+			return err
+		}
+	}
+	a.initialized = true
+	return nil
+}
+
+// Args returns the current config, with the features its RBAC scope doesn't allow disabled once it's initialized
+func (a *Autoscaler) Args() args.Args {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.args
+}
+
+// Targets returns the workloads that are autoscaled, which are empty until it's initialized
+func (a *Autoscaler) Targets() []scaling.Target {
+	return a.targets.Get()
+}
+
+// Reload applies a reloaded config. If it can't be applied, the error is returned and the current config is kept.
+// The sections of the config that need a restart to apply are logged.
+func (a *Autoscaler) Reload(reloaded args.Args) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.initialized {
+		a.args = reloaded
+		return nil
+	}
+	backend, targets, err := Reload(a.args, &reloaded, a.backend, a.k8sClient)
+	if err != nil {
+		return err
+	}
+	a.args, a.backend = reloaded, backend
+	a.targets.Set(targets)
+	logger.Infof("Reloaded the config with %d workloads", len(targets))
+	return nil
+}
+
+// snapshot returns the config and backend of an iteration, so a reload doesn't change them during the iteration
+func (a *Autoscaler) snapshot() (args.Args, ci.Backend) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.args, a.backend
+}
+
+// Once autoscales the workloads a single time, and returns the scaling decision of each workload
+func (a *Autoscaler) Once() ([]scaling.DecisionRecord, error) {
+	if err := a.Init(); err != nil {
+		return nil, err
+	}
+	onceArgs, backend := a.snapshot()
+	decisions, err := scaling.AutoscaleTargets(backend, a.k8sClient, a.targets.Get(), onceArgs)
+	a.saveHistory(onceArgs)
+	return decisions, err
+}
+
+// Run autoscales the workloads every iteration until the context is done, then returns nil. The errors retrying can
+// fix, ex: an outage of Azure Devops, are retried with a backoff, and the autoscaler is degraded until an iteration
+// succeeds. It returns the first error retrying won't fix, ex: rejected credentials.
+func (a *Autoscaler) Run(ctx context.Context) error {
+	if err := a.Init(); err != nil {
+		return err
+	}
+	go a.persistHistory(ctx)
+	defer func() {
+		runArgs, _ := a.snapshot()
+		a.saveHistory(runArgs)
+	}()
+
+	var backoff ErrorBackoff
+	for {
+		iterationArgs, backend := a.snapshot()
+		var wait error
+		// While the retry budget is exhausted, the iteration is skipped instead of retrying the failing dependencies
+		if err := health.CheckRetryBudget(); err != nil {
+			wait = sleep(ctx, backoff.Failed(err, ClassifyError(err), iterationArgs.Rate))
+		} else if _, err := scaling.AutoscaleTargets(backend, a.k8sClient, a.targets.Get(), iterationArgs); err == nil {
+			backoff.Succeeded()
+			wait = scaling.WaitForReconcile(ctx, scaling.NextRate(iterationArgs))
+		} else if class := ClassifyError(err); class.Fatal() {
+			// Only errors that retrying won't fix stop the autoscaler, so an outage doesn't crash loop it
+			return fmt.Errorf("Error autoscaling (%s): %w", class, err)
+		} else {
+			wait = sleep(ctx, backoff.Failed(err, class, iterationArgs.Rate))
+		}
+		if wait != nil {
+			return nil
+		}
+	}
+}
+
+// persistHistory saves the decision history to its store every minute until the context is done, instead of every
+// iteration of every workload
+func (a *Autoscaler) persistHistory(ctx context.Context) {
+	ticker := time.NewTicker(historyPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			historyArgs, _ := a.snapshot()
+			a.saveHistory(historyArgs)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// saveHistory saves the decision history to its store, if it's enabled and it isn't a dry run
+func (a *Autoscaler) saveHistory(historyArgs args.Args) {
+	if historyArgs.History.ConfigMapName == "" || historyArgs.DryRun {
+		return
+	}
+	if err := scaling.SaveHistory(scaling.HistoryStore(a.k8sClient.Sync(), historyArgs)); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// sleep waits for the delay to pass, and returns the error of the context if it's done first
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,187 @@
+package autoscaler
+
+import (
+	"fmt"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// The statuses of the doctor checks
+const (
+	CheckPass = "pass"
+	CheckFail = "fail"
+	// CheckSkip is a check that wasn't run because a check it depends on failed
+	CheckSkip = "skip"
+)
+
+// Check is the result of a doctor check
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// DoctorReport is the results of the doctor checks
+type DoctorReport struct {
+	Checks []Check
+	// Err is the error of the first failed check
+	Err error
+}
+
+func (r *DoctorReport) pass(name string, format string, a ...interface{}) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: CheckPass, Detail: fmt.Sprintf(format, a...)})
+}
+
+func (r *DoctorReport) fail(name string, err error) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: CheckFail, Detail: err.Error()})
+	if r.Err == nil {
+		r.Err = err
+	}
+}
+
+func (r *DoctorReport) skip(name string, reason string) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: CheckSkip, Detail: reason})
+}
+
+// Doctor runs every step of the autoscaler's startup and first iteration as separate checks, without scaling. A failed
+// check doesn't stop the others, and the checks that depend on a failed one are skipped.
+func Doctor(cfg args.Args) DoctorReport {
+	report := DoctorReport{}
+	k8sClient, err := kubernetes.MakeClient(cfg.Kubernetes.Timeout)
+	if err != nil {
+		report.fail("Kubernetes client", err)
+		return report
+	}
+	report.pass("Kubernetes client", "created the Kubernetes client")
+	report.run(nil, k8sClient, cfg)
+	return report
+}
+
+// DoctorWithClients runs the doctor checks with the given CI backend and Kubernetes client instead of creating them.
+// If the backend is nil, it's created like the autoscaler does.
+func DoctorWithClients(cfg args.Args, backend ci.Backend, k8sClient kubernetes.ClientAsync) DoctorReport {
+	report := DoctorReport{}
+	report.run(backend, k8sClient, cfg)
+	return report
+}
+
+// run runs the checks after the Kubernetes client is created. If the backend is nil, it's created from the args
+// resolved by the checks, ex: with the workload kind.
+func (r *DoctorReport) run(backend ci.Backend, k8sClient kubernetes.ClientAsync, cfg args.Args) {
+	if resolved, err := ResolveWorkloadType(k8sClient.Sync(), cfg); err != nil {
+		r.fail("Workload kind", err)
+	} else {
+		cfg = resolved
+		if cfg.Kubernetes.Type != "" {
+			r.pass("Workload kind", "the agents are in a %s", cfg.Kubernetes.Type)
+		}
+	}
+
+	if resolved, scope, err := ResolveRBACScope(k8sClient.Sync(), cfg); err != nil {
+		r.fail("RBAC scope", err)
+	} else {
+		cfg = resolved
+		r.pass("RBAC scope", "the autoscaler is %s-scoped", scope)
+	}
+
+	if err := kubernetes.VerifyPermissions(k8sClient.Sync(), cfg); err != nil {
+		r.fail("RBAC permissions", err)
+	} else {
+		r.pass("RBAC permissions", "%d permissions are granted", len(kubernetes.RequiredPermissions(cfg)))
+	}
+
+	// Without a backend, ex: if its token couldn't be retrieved, the agent pools can't be listed or found
+	var pools []ci.Pool
+	poolsFound := false
+	var err error
+	if backend == nil {
+		backend, err = MakeBackend(cfg, k8sClient)
+	}
+	if err != nil {
+		r.fail("CI client", fmt.Errorf("Error creating the %s client: %w", cfg.Backend, err))
+		r.skip("CI authentication", "the CI client couldn't be created")
+	} else if pools, err = backend.Pools(""); err != nil {
+		r.fail("CI authentication", fmt.Errorf("Error retrieving agent pools: %w", err))
+	} else {
+		r.pass("CI authentication", "found %d agent pools", len(pools))
+		poolsFound = true
+	}
+
+	if cfg.Operator.Enabled || cfg.ExternallyScaled() {
+		r.skip("Workloads", "the workloads aren't known from the arguments in this mode")
+		return
+	}
+	for _, workloadArgs := range cfg.Kubernetes.Workloads() {
+		r.checkWorkload(backend, pools, poolsFound, k8sClient, workloadArgs, cfg)
+	}
+}
+
+// checkWorkload checks that a workload can be autoscaled: that it exists and isn't scaled by another autoscaler, that
+// its agent pool can be found, that its pods can be listed, and what a scaling decision would be
+func (r *DoctorReport) checkWorkload(backend ci.Backend, pools []ci.Pool, poolsFound bool, k8sClient kubernetes.ClientAsync, workloadArgs args.KubernetesArgs, cfg args.Args) {
+	name := workloadArgs.FriendlyName()
+	workload, err := k8sClient.Sync().GetWorkload(workloadArgs)
+	if err != nil {
+		r.fail(name+": lookup", fmt.Errorf("Error retrieving %s in namespace %s: %w", name, workloadArgs.Namespace, err))
+		return
+	}
+	r.pass(name+": lookup", "found in namespace %s", workload.Namespace)
+
+	if !cfg.HPACheck.Checks(workloadArgs.Namespace) {
+		r.skip(name+": autoscaler conflicts", fmt.Sprintf("the HPA check doesn't verify namespace %s", workloadArgs.Namespace))
+	} else if warning, err := kubernetes.VerifyNoAutoscalerConflict(k8sClient.Sync(), workloadArgs, cfg.HPACheck); err != nil {
+		r.fail(name+": autoscaler conflicts", err)
+	} else if warning != "" {
+		r.skip(name+": autoscaler conflicts", warning)
+	} else {
+		r.pass(name+": autoscaler conflicts", "no HorizontalPodAutoscaler or ScaledObject targets it")
+	}
+
+	pods, err := k8sClient.Sync().GetPods(workload)
+	if err != nil {
+		r.fail(name+": pods", fmt.Errorf("Error retrieving the pods of %s: %w", name, err))
+	} else if warnings, err := scaling.VerifyPodSelectors(k8sClient.Sync(), []kubernetes.VerifiedWorkload{{Workload: workload, Pods: pods}}); err != nil {
+		r.fail(name+": pods", err)
+	} else if len(warnings) > 0 {
+		r.fail(name+": pods", fmt.Errorf("%s", warnings[0]))
+	} else {
+		r.pass(name+": pods", "found %d pods", len(pods))
+	}
+
+	poolNameEnvVar := cfg.PoolNameEnvVar()
+	poolName, err := k8sClient.Sync().GetEnvValue(*workload.PodTemplateSpec, workload.Namespace, poolNameEnvVar)
+	if err != nil {
+		r.fail(name+": agent pool", fmt.Errorf("Could not retrieve environment variable %s from %s: %w", poolNameEnvVar, name, err))
+		r.skip(name+": scaling decision", "the agent pool wasn't found")
+		return
+	} else if !poolsFound {
+		r.skip(name+": agent pool", "the agent pools couldn't be retrieved")
+		r.skip(name+": scaling decision", "the agent pools couldn't be retrieved")
+		return
+	}
+	var agentPoolID *int
+	for _, pool := range pools {
+		if pool.Name == poolName {
+			agentPoolID = &pool.ID
+			break
+		}
+	}
+	if agentPoolID == nil {
+		r.fail(name+": agent pool", fmt.Errorf("Error - could not find an agent pool with name %s", poolName))
+		r.skip(name+": scaling decision", "the agent pool wasn't found")
+		return
+	}
+	r.pass(name+": agent pool", "%s has ID %d", poolName, *agentPoolID)
+
+	decision, err := scaling.Plan(backend, *agentPoolID, k8sClient, workload, cfg)
+	if err != nil {
+		r.fail(name+": scaling decision", err)
+	} else if decision.IsScaling() {
+		r.pass(name+": scaling decision", "would scale from %d to %d pods: %s", decision.NumPods, decision.DesiredReplicas, decision.Reason)
+	} else {
+		r.pass(name+": scaling decision", "would stay at %d pods: %s", decision.NumPods, decision.Reason)
+	}
+}
@@ -0,0 +1,170 @@
+package autoscaler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/github"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/gitlab"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/notify"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/secrets"
+)
+
+// maxErrorBackoff is the longest the autoscaler waits after consecutive errors, unless the rate is longer or it's asked
+// to retry later
+const maxErrorBackoff = 5 * time.Minute
+
+// ErrorClass is how an error autoscaling the workloads is handled
+type ErrorClass string
+
+const (
+	// ErrorAuth is Azure Devops or Kubernetes rejecting the credentials or permissions, which retrying won't fix
+	ErrorAuth ErrorClass = "auth"
+	// ErrorNotFound is the agent pool or workload not existing, which retrying won't fix
+	ErrorNotFound ErrorClass = "not found"
+	// ErrorConfig is a workload the autoscaler can't scale, ex: a kind that isn't implemented, which retrying won't fix
+	ErrorConfig ErrorClass = "config"
+	// ErrorConflict is another autoscaler or an admission policy preventing the scale, which is retried in case it's
+	// removed, ex: a HorizontalPodAutoscaler of the workload or another autoscaler's claim on it
+	ErrorConflict ErrorClass = "conflict"
+	// ErrorThrottled is Azure Devops or Kubernetes rate limiting the autoscaler
+	ErrorThrottled ErrorClass = "throttled"
+	// ErrorNetwork is Azure Devops or Kubernetes not being reachable
+	ErrorNetwork ErrorClass = "network"
+	// ErrorTransient is any other error, ex: a server error or a conflict
+	ErrorTransient ErrorClass = "transient"
+	// ErrorRetryBudget is the failed calls exhausting the retry budget, which skips the autoscaling until it frees up
+	ErrorRetryBudget ErrorClass = "retry budget"
+)
+
+// Fatal returns true if the autoscaler should exit, as the error is a configuration that retrying won't fix
+func (c ErrorClass) Fatal() bool {
+	return c == ErrorAuth || c == ErrorNotFound || c == ErrorConfig
+}
+
+// ClassifyError returns the class of an error autoscaling the workloads
+func ClassifyError(err error) ErrorClass {
+	// A rejected scale wraps the error of the API server, which can be forbidden without the credentials being rejected
+	if errors.Is(err, kubernetes.ErrHPAConflict) || errors.Is(err, scaling.ErrWorkloadClaimed) || errors.Is(err, scaling.ErrScaleRejected) {
+		return ErrorConflict
+	}
+	var retrieveError secrets.RetrieveError
+	if errors.Is(err, ci.ErrUnauthorized) || kubernetes.IsAuthError(err) || errors.As(err, &retrieveError) {
+		return ErrorAuth
+	}
+	if errors.Is(err, scaling.ErrPoolNotFound) {
+		return ErrorNotFound
+	}
+	if errors.Is(err, kubernetes.ErrNotImplementedKind) {
+		return ErrorConfig
+	}
+	if errors.Is(err, ci.ErrThrottled) {
+		return ErrorThrottled
+	}
+	var retryBudgetError health.RetryBudgetError
+	if errors.As(err, &retryBudgetError) {
+		return ErrorRetryBudget
+	}
+
+	statusCode := 0
+	var azdError *azuredevops.HTTPError
+	var githubError *github.HTTPError
+	var gitlabError *gitlab.HTTPError
+	var k8sError k8serrors.APIStatus
+	if errors.As(err, &azdError) {
+		statusCode = azdError.StatusCode
+	} else if errors.As(err, &githubError) {
+		statusCode = githubError.StatusCode
+	} else if errors.As(err, &gitlabError) {
+		statusCode = gitlabError.StatusCode
+	} else if errors.As(err, &k8sError) {
+		status := k8sError.Status()
+		switch status.Reason {
+		case metav1.StatusReasonNotFound:
+			return ErrorNotFound
+		case metav1.StatusReasonTooManyRequests:
+			return ErrorThrottled
+		case metav1.StatusReasonTimeout, metav1.StatusReasonServerTimeout, metav1.StatusReasonServiceUnavailable:
+			return ErrorNetwork
+		}
+		statusCode = int(status.Code)
+	}
+	switch {
+	case statusCode == http.StatusNotFound:
+		return ErrorNotFound
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorThrottled
+	case statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout:
+		return ErrorNetwork
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) {
+		return ErrorNetwork
+	}
+	return ErrorTransient
+}
+
+// retryAfter returns how long Azure Devops asked the autoscaler to wait before calling it again, or 0
+func retryAfter(err error) time.Duration {
+	var azdError *azuredevops.HTTPError
+	if errors.As(err, &azdError) && azdError.RetryAfter != nil {
+		return *azdError.RetryAfter
+	}
+	return 0
+}
+
+// ErrorBackoff delays the iterations after errors, doubling the delay each consecutive error up to the max, so an
+// outage isn't retried every iteration. The autoscaler is degraded until an iteration succeeds.
+type ErrorBackoff struct {
+	failures int
+}
+
+// Failed records an error of an iteration, and returns how long to wait before the next iteration, starting at the rate.
+// A notification is only sent for the first consecutive error, so an outage doesn't send one every iteration.
+func (b *ErrorBackoff) Failed(err error, class ErrorClass, rate time.Duration) time.Duration {
+	b.failures++
+	limit := math.MaxDuration(rate, maxErrorBackoff)
+	delay := rate
+	for i := 1; i < b.failures && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = math.MinDuration(delay, limit)
+	if after := retryAfter(err); after > delay {
+		delay = after
+	}
+
+	health.SetDegraded(fmt.Sprintf("%s error: %s", class, err.Error()))
+	logger.Warnf("Error autoscaling (%s, %d consecutive), retrying in %s: %s", class, b.failures, delay.String(), err.Error())
+	if b.failures == 1 {
+		notify.Send(notify.Notification{
+			Type:     notify.TypeAutoscaleDegraded,
+			Severity: notify.SeverityWarning,
+			Time:     time.Now(),
+			Reason:   string(class),
+			Error:    err.Error(),
+		})
+	}
+	return delay
+}
+
+// Succeeded records a successful iteration, which ends the backoff
+func (b *ErrorBackoff) Succeeded() {
+	if b.failures > 0 {
+		logger.Infof("Recovered after %d consecutive errors", b.failures)
+		health.SetDegraded("")
+	}
+	b.failures = 0
+}
@@ -0,0 +1,493 @@
+package autoscaler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/github"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/gitlab"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/operator"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/secrets"
+)
+
+// Initialize creates the clients, retrieves the agent workloads and discovers their agent pools. The features the
+// RBAC scope of the autoscaler doesn't allow are disabled in the args.
+func Initialize(args *args.Args) (ci.Backend, kubernetes.ClientAsync, []scaling.Target, error) {
+	k8sClient, err := kubernetes.MakeClient(args.Kubernetes.Timeout)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Error creating the Kubernetes client: %w", err)
+	}
+	if err := WaitForWorkloads(k8sClient.Sync(), *args); err != nil {
+		return nil, nil, nil, err
+	}
+	if *args, err = ResolveWorkloadType(k8sClient.Sync(), *args); err != nil {
+		return nil, nil, nil, err
+	}
+	if *args, _, err = ResolveRBACScope(k8sClient.Sync(), *args); err != nil {
+		return nil, nil, nil, err
+	}
+	if args.HPACheck.Disabled {
+		logger.Warn("The HPA check is disabled, so a workload scaled by a HorizontalPodAutoscaler or a KEDA ScaledObject isn't detected")
+	}
+	// The permissions are verified first, so a missing permission is reported with the others instead of when it's used
+	if err := kubernetes.VerifyPermissions(k8sClient.Sync(), *args); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Initialize the Azure Pipelines backend, whose URL can be read from the workloads
+	backend, err := MakeBackend(*args, k8sClient)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	targets, err := InitializeTargets(backend, k8sClient, *args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if *args, err = ResolveTokenPermissions(backend, targets, *args); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return backend, k8sClient, targets, nil
+}
+
+// missingWorkloadPollInterval is how often a missing workload is checked for if the rate isn't set
+const missingWorkloadPollInterval = 10 * time.Second
+
+// WaitForWorkloads waits for the agent workloads to be created with --missing-workload=wait, ex: when the agents are
+// deployed with the autoscaler, and the autoscaler is degraded until they are. It's an error if they aren't created
+// before the timeout. With --missing-workload=fail, it returns immediately, and the missing workload fails the startup
+// when it's retrieved.
+func WaitForWorkloads(client kubernetes.Client, waitArgs args.Args) error {
+	if waitArgs.Kubernetes.MissingWorkload != args.MissingWorkloadWait || waitArgs.Operator.Enabled || waitArgs.ExternallyScaled() {
+		return nil
+	}
+	interval := waitArgs.Rate
+	if interval <= 0 {
+		interval = missingWorkloadPollInterval
+	}
+	start := time.Now()
+	var waitingFor string
+	for _, workloadArgs := range waitArgs.Kubernetes.Workloads() {
+		name := workloadArgs.FriendlyName()
+		if workloadArgs.Type == "" {
+			name = "workload " + workloadArgs.Name
+		}
+		for {
+			kinds, err := client.GetWorkloadKinds(workloadArgs.Namespace, workloadArgs.Name)
+			if err != nil {
+				return fmt.Errorf("Error retrieving %s in namespace %s: %w", name, workloadArgs.Namespace, err)
+			}
+			if hasKind(kinds, workloadArgs.Type) {
+				break
+			}
+			if waitArgs.Kubernetes.MissingWorkloadTimeout > 0 && time.Since(start) >= waitArgs.Kubernetes.MissingWorkloadTimeout {
+				health.SetDegraded("")
+				return fmt.Errorf("Error - %s in namespace %s wasn't created after waiting %s", name, workloadArgs.Namespace, waitArgs.Kubernetes.MissingWorkloadTimeout)
+			}
+			if waitingFor != name {
+				waitingFor = name
+				logger.Warnf("%s doesn't exist in namespace %s, waiting for it to be created", waitingFor, workloadArgs.Namespace)
+				health.SetDegraded(fmt.Sprintf("Waiting for %s to be created in namespace %s", waitingFor, workloadArgs.Namespace))
+			}
+			time.Sleep(interval)
+		}
+	}
+	if waitingFor != "" {
+		logger.Infof("The agent workloads were created after waiting %s", time.Since(start).Round(time.Second))
+		health.SetDegraded("")
+	}
+	return nil
+}
+
+// hasKind returns true if a workload of the kind exists, or of any kind if it's empty
+func hasKind(kinds []string, kind string) bool {
+	for _, existing := range kinds {
+		if kind == "" || existing == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveTokenPermissions probes what the token of the CI backend is allowed in the agent pools of the targets, and returns
+// the args with the features it isn't allowed disabled, so they're reported at startup instead of failing when they're
+// used. It's an error if the token can't read the agents and jobs of a pool, as they can't be autoscaled without them.
+// Managing the agents is only probed if a feature needs it and it isn't a dry run, by setting the user capabilities of
+// an agent to those it already has, which doesn't change the agent.
+func ResolveTokenPermissions(backend ci.Backend, targets []scaling.Target, tokenArgs args.Args) (args.Args, error) {
+	probedPools := make(map[string]bool)
+	probeManage := tokenArgs.ManagesAgents() && !tokenArgs.DryRun
+	for _, target := range targets {
+		key := fmt.Sprintf("%s/%d", target.Organization, target.AgentPoolID)
+		if probedPools[key] {
+			continue
+		}
+		probedPools[key] = true
+
+		targetBackend := target.BackendOr(backend)
+		agents, err := targetBackend.Agents(target.AgentPoolID)
+		if err == nil {
+			_, err = targetBackend.Jobs(target.AgentPoolID)
+		}
+		if errors.Is(err, ci.ErrUnauthorized) {
+			return tokenArgs, fmt.Errorf("Error - the token isn't allowed to read the agents and jobs of agent pool %d%s, it needs the Agent Pools (Read) scope: %w", target.AgentPoolID, organizationDescription(organizationOf(target)), err)
+		} else if err != nil {
+			return tokenArgs, fmt.Errorf("Error retrieving the agents and jobs of agent pool %d%s: %w", target.AgentPoolID, organizationDescription(organizationOf(target)), err)
+		}
+
+		// A pool without agents can't be probed, so the next one is
+		if !probeManage || len(agents) == 0 {
+			continue
+		}
+		probeManage = false
+		capabilities := agents[0].Capabilities
+		if capabilities == nil {
+			capabilities = make(map[string]string)
+		}
+		err = targetBackend.SetCapabilities(target.AgentPoolID, agents[0], capabilities)
+		if errors.Is(err, ci.ErrUnauthorized) {
+			var disabled []string
+			tokenArgs, disabled = tokenArgs.WithoutAgentManagement()
+			logger.Warnf("The token isn't allowed to manage the agents of agent pool %d%s, so %s are disabled. Grant it the Agent Pools (Read & manage) scope to enable them.", target.AgentPoolID, organizationDescription(organizationOf(target)), strings.Join(append(disabled, "disabling the agents of a rollover"), ", "))
+		} else if err != nil && !errors.Is(err, ci.ErrNotSupported) {
+			logger.Warnf("Error verifying that the token can manage the agents of agent pool %d: %s", target.AgentPoolID, err.Error())
+		}
+	}
+	return tokenArgs, nil
+}
+
+// organizationOf returns the additional organization of a target, or nil if it's in the main organization
+func organizationOf(target scaling.Target) *args.OrganizationArgs {
+	if target.Organization == "" {
+		return nil
+	}
+	return &args.OrganizationArgs{URL: target.Organization}
+}
+
+// SetDecisionHook sets the hook that reviews the scaling decisions, or disables it if it isn't enabled
+func SetDecisionHook(hookArgs args.Args) {
+	if !hookArgs.DecisionHook.Enabled() {
+		scaling.SetDecisionHook(nil)
+		return
+	}
+	scaling.SetDecisionHook(scaling.NewWebhookDecisionHook(hookArgs.DecisionHook.URL, hookArgs.Notifications.WebhookSecret, hookArgs.DecisionHook.Timeout))
+}
+
+// ResolveWorkloadType returns the args with the kind of the agents workload detected, if --type isn't set.
+// The additional, spot and rollover workloads are in the same namespace and are the same kind.
+func ResolveWorkloadType(client kubernetes.Client, typeArgs args.Args) (args.Args, error) {
+	if typeArgs.Kubernetes.Type != "" || typeArgs.Operator.Enabled || typeArgs.ExternallyScaled() {
+		return typeArgs, nil
+	}
+	kind, err := kubernetes.DetectWorkloadType(client, typeArgs.Kubernetes.Namespace, typeArgs.Kubernetes.Name)
+	if err != nil {
+		return typeArgs, err
+	}
+	logger.Debugf("Detected that workload %s in namespace %s is a %s", typeArgs.Kubernetes.Name, typeArgs.Kubernetes.Namespace, kind)
+	typeArgs.Kubernetes.Type = kind
+	return typeArgs, nil
+}
+
+// ResolveRBACScope returns the RBAC scope of the autoscaler, and the args with the features that need cluster-wide RBAC
+// permissions disabled if it's namespace-scoped. With --rbac-scope=auto, it's namespace-scoped if its service account
+// isn't allowed them. With --rbac-scope=cluster, the missing permissions fail the permission check instead.
+func ResolveRBACScope(client kubernetes.Client, scopeArgs args.Args) (args.Args, string, error) {
+	scope := scopeArgs.Kubernetes.RBACScope
+	if scope == args.RBACScopeAuto {
+		var missing []kubernetes.Permission
+		var err error
+		if scope, missing, err = kubernetes.DetectRBACScope(client, scopeArgs); err != nil {
+			return scopeArgs, "", err
+		}
+		for _, permission := range missing {
+			logger.Warnf("The service account isn't allowed to %s", permission)
+		}
+	}
+	if scope != args.RBACScopeNamespace {
+		return scopeArgs, scope, nil
+	}
+	namespaceArgs, disabled := scopeArgs.NamespaceScoped()
+	if len(disabled) > 0 {
+		logger.Warnf("The autoscaler is namespace-scoped, so %s are disabled. Grant the cluster-wide permissions with a ClusterRole to enable them.", strings.Join(disabled, ", "))
+	}
+	return namespaceArgs, scope, nil
+}
+
+// azdToken is the Azure Devops token refreshed from Key Vault or Vault, if enabled
+var azdToken *secrets.Token
+
+// MakeBackend creates the backend of the CI system of the agents. The Kubernetes client is only used to read the
+// Azure Devops URL from the workloads, and can be nil otherwise.
+func MakeBackend(backendArgs args.Args, k8sClient kubernetes.ClientAsync) (ci.Backend, error) {
+	if backendArgs.Backend == args.BackendAzurePipelines {
+		azdArgs := backendArgs.AZD
+		if azdArgs.URLFromWorkload {
+			var err error
+			if azdArgs.URL, err = workloadAzureDevopsURL(k8sClient, backendArgs.Kubernetes); err != nil {
+				return nil, err
+			}
+		}
+		return makeAzurePipelinesBackend(azdArgs)
+	}
+	if azdToken != nil {
+		azdToken.Stop()
+		azdToken = nil
+	}
+	if backendArgs.Backend == args.BackendGitLab {
+		return gitlab.NewBackend(backendArgs.GitLab), nil
+	}
+	return github.NewBackend(backendArgs.GitHub), nil
+}
+
+// makeAzurePipelinesBackend creates the Azure Pipelines backend with an Azure Devops client. If the token is stored in Key Vault or Vault,
+// it is retrieved and refreshed in the background, replacing the refreshed token of a previous client.
+func makeAzurePipelinesBackend(azdArgs args.AzureDevopsArgs) (ci.Backend, error) {
+	var token *secrets.Token
+	var err error
+	if azdArgs.KeyVault.URL != "" {
+		keyVault := secrets.NewKeyVault(azdArgs.KeyVault.URL, azdArgs.KeyVault.SecretName, azdArgs.KeyVault.ClientID)
+		if token, err = secrets.Watch(keyVault, azdArgs.KeyVault.RefreshInterval); err != nil {
+			return nil, err
+		}
+	} else if azdArgs.Vault.Address != "" {
+		vault := secrets.NewVault(azdArgs.Vault.Address, azdArgs.Vault.Namespace, azdArgs.Vault.AuthPath, azdArgs.Vault.Role, azdArgs.Vault.SecretPath, azdArgs.Vault.SecretKey)
+		if token, err = secrets.Watch(vault, azdArgs.Vault.RefreshInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	if azdToken != nil {
+		azdToken.Stop()
+	}
+	azdToken = token
+	if token == nil {
+		return newAzureDevopsBackend(azdArgs.URL, azdArgs.Token, azdArgs), nil
+	}
+	return azuredevops.NewBackend(azuredevops.MakeClientWithConnections(azdArgs.URL, token.Get, azdArgs.Timeout, azureDevopsConnections(azdArgs))), nil
+}
+
+// newAzureDevopsBackend returns the backend of an Azure Devops organization with a static token
+func newAzureDevopsBackend(url string, token string, azdArgs args.AzureDevopsArgs) ci.Backend {
+	return azuredevops.NewBackend(azuredevops.MakeClientWithConnections(url, func() string { return token }, azdArgs.Timeout, azureDevopsConnections(azdArgs)))
+}
+
+// azureDevopsConnections returns how the connections to Azure Devops are kept alive
+func azureDevopsConnections(azdArgs args.AzureDevopsArgs) azuredevops.Connections {
+	return azuredevops.Connections{
+		MaxIdlePerHost: azdArgs.MaxIdleConns,
+		IdleTimeout:    azdArgs.IdleConnTimeout,
+		DisableHTTP2:   !azdArgs.HTTP2,
+		Network:        azureDevopsNetwork(azdArgs.IPFamily),
+		DNSServers:     azdArgs.DNSServers,
+	}
+}
+
+// azureDevopsNetwork returns the network the connections to Azure Devops are dialed on for the IP family
+func azureDevopsNetwork(ipFamily string) string {
+	switch ipFamily {
+	case args.IPFamilyIPv4:
+		return "tcp4"
+	case args.IPFamilyIPv6:
+		return "tcp6"
+	default:
+		return ""
+	}
+}
+
+// workloadAzureDevopsURL reads the Azure Devops URL from the AZP_URL environment variable of the workloads,
+// which must all have the same URL as they share an Azure Devops client
+func workloadAzureDevopsURL(k8sClient kubernetes.ClientAsync, kubernetesArgs args.KubernetesArgs) (string, error) {
+	var azdURL string
+	for _, workloadArgs := range kubernetesArgs.Workloads() {
+		workload, err := k8sClient.Sync().GetWorkload(workloadArgs)
+		if err != nil {
+			return "", fmt.Errorf("Error retrieving %s in namespace %s: %w", workloadArgs.FriendlyName(), workloadArgs.Namespace, err)
+		}
+		workloadURL, err := k8sClient.Sync().GetEnvValue(*workload.PodTemplateSpec, workload.Namespace, "AZP_URL")
+		if err != nil {
+			return "", fmt.Errorf("Could not retrieve the Azure Devops URL from %s: %w", workload.FriendlyName, err)
+		}
+		workloadURL = strings.TrimSuffix(workloadURL, "/")
+		if azdURL != "" && workloadURL != azdURL {
+			return "", fmt.Errorf("Error - the workloads have different Azure Devops URLs, %s and %s", azdURL, workloadURL)
+		}
+		azdURL = workloadURL
+	}
+	logger.Infof("Found the Azure Devops URL %s from the workloads", azdURL)
+	return azdURL, nil
+}
+
+// InitializeTargets retrieves every agent workload and discovers their agent pools.
+// In operator mode, the workloads are those of the AzpAgentAutoscaler resources.
+func InitializeTargets(backend ci.Backend, k8sClient kubernetes.ClientAsync, args args.Args) ([]scaling.Target, error) {
+	if args.Operator.Enabled {
+		return OperatorTargets(backend, k8sClient, args)
+	}
+	// KEDA or a HorizontalPodAutoscaler scales the agents, so the autoscaler has no workloads
+	if args.ExternallyScaled() {
+		return nil, nil
+	}
+
+	// The agent pools of each organization, by its URL. The main organization's URL is empty.
+	organizationPools := make(map[string][]ci.Pool)
+	var targets []scaling.Target
+	var verified []kubernetes.VerifiedWorkload
+	for _, workloadArgs := range args.Kubernetes.Workloads() {
+		organization, err := workloadOrganization(k8sClient, args.AZD, workloadArgs)
+		if err != nil {
+			return nil, err
+		}
+		organizationBackend := backend
+		if organization != nil {
+			organizationBackend = newAzureDevopsBackend(organization.URL, organization.Token, args.AZD)
+		}
+
+		agentPools, retrieved := organizationPools[organizationURL(organization)]
+		if !retrieved {
+			if agentPools, err = organizationBackend.Pools(""); err != nil {
+				return nil, fmt.Errorf("Error retrieving agent pools%s: %w", organizationDescription(organization), err)
+			} else if len(agentPools) == 0 {
+				return nil, fmt.Errorf("Error - did not find any agent pools%s", organizationDescription(organization))
+			}
+			organizationPools[organizationURL(organization)] = agentPools
+		}
+
+		target, workload, err := initializeTarget(k8sClient, agentPools, workloadArgs, args)
+		if err != nil {
+			return nil, err
+		}
+		if organization != nil {
+			target.Organization, target.Backend = organization.URL, organizationBackend
+		}
+		// The agent pools of the other shards are autoscaled by the other replicas
+		if poolName := poolNameOf(agentPools, target.AgentPoolID); !args.Sharding.Owns(poolName) {
+			logger.Debugf("Skipping %s, agent pool %s is in another shard", target.Workload.FriendlyName, poolName)
+			continue
+		}
+		if workload.Warning != "" {
+			logger.Warn(workload.Warning)
+		}
+		targets = append(targets, target)
+		verified = append(verified, workload)
+	}
+
+	// Agents counted from the wrong pods would be scaled without any errors
+	warnings, err := scaling.VerifyPodSelectors(k8sClient.Sync(), verified)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		logger.Warn(warning)
+	}
+	return targets, nil
+}
+
+// workloadOrganization returns the additional Azure Devops organization of a workload from its AZP_URL environment variable,
+// or nil if it's in the main organization. The environment variable is only read if there are additional organizations.
+func workloadOrganization(k8sClient kubernetes.ClientAsync, azdArgs args.AzureDevopsArgs, workloadArgs args.KubernetesArgs) (*args.OrganizationArgs, error) {
+	if len(azdArgs.Organizations) == 0 {
+		return nil, nil
+	}
+	workload, err := k8sClient.Sync().GetWorkload(workloadArgs)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving %s in namespace %s: %w", workloadArgs.FriendlyName(), workloadArgs.Namespace, err)
+	}
+	workloadURL, err := k8sClient.Sync().GetEnvValue(*workload.PodTemplateSpec, workload.Namespace, "AZP_URL")
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the Azure Devops URL of the organization of %s: %w", workload.FriendlyName, err)
+	}
+	organization := azdArgs.Organization(workloadURL)
+	if organization == nil && !strings.EqualFold(strings.TrimSuffix(workloadURL, "/"), strings.TrimSuffix(azdArgs.URL, "/")) {
+		return nil, fmt.Errorf("Error - the Azure Devops URL %s of %s isn't the url argument or an organization argument", workloadURL, workload.FriendlyName)
+	}
+	if organization != nil {
+		logger.Debugf("%s is in organization %s", workload.FriendlyName, organization.URL)
+	}
+	return organization, nil
+}
+
+// organizationURL returns the URL of an additional organization, or an empty string for the main organization
+func organizationURL(organization *args.OrganizationArgs) string {
+	if organization == nil {
+		return ""
+	}
+	return organization.URL
+}
+
+// organizationDescription describes an additional organization for an error message
+func organizationDescription(organization *args.OrganizationArgs) string {
+	if organization == nil {
+		return ""
+	}
+	return fmt.Sprintf(" of organization %s", organization.URL)
+}
+
+// poolNameOf returns the name of the agent pool with the ID
+func poolNameOf(agentPools []ci.Pool, agentPoolID int) string {
+	for _, agentPool := range agentPools {
+		if agentPool.ID == agentPoolID {
+			return agentPool.Name
+		}
+	}
+	return ""
+}
+
+// initializeTarget retrieves and verifies an agent workload, and discovers its agent pool. The workload is returned with its pods.
+func initializeTarget(k8sClient kubernetes.ClientAsync, agentPools []ci.Pool, workloadArgs args.KubernetesArgs, args args.Args) (scaling.Target, kubernetes.VerifiedWorkload, error) {
+	// Get AZP agent workload, verify there isn't a HorizontalPodAutoscaler and list its pods
+	verified, err := kubernetes.VerifyWorkload(k8sClient, workloadArgs, args.HPACheck, args.Kubernetes.Timeout)
+	if err != nil {
+		return scaling.Target{}, kubernetes.VerifiedWorkload{}, err
+	}
+	deployment := verified.Workload
+
+	// Discover the pool name from the environment variables
+	poolNameEnvVar := args.PoolNameEnvVar()
+	agentPoolName, err := k8sClient.Sync().GetEnvValue(*deployment.PodTemplateSpec, deployment.Namespace, poolNameEnvVar)
+	if err != nil {
+		return scaling.Target{}, kubernetes.VerifiedWorkload{}, fmt.Errorf("Could not retrieve environment variable %s from %s: %w", poolNameEnvVar, deployment.FriendlyName, err)
+	}
+	logger.Debugf("Found agent pool %s from %s", agentPoolName, deployment.FriendlyName)
+
+	var agentPoolID *int
+	for _, agentPool := range agentPools {
+		if agentPool.Name == agentPoolName {
+			agentPoolID = &agentPool.ID
+			break
+		}
+	}
+	if agentPoolID == nil {
+		return scaling.Target{}, kubernetes.VerifiedWorkload{}, fmt.Errorf("Error - could not find an agent pool with name %s", agentPoolName)
+	}
+	logger.Debugf("Agent pool %s has ID %d", agentPoolName, *agentPoolID)
+
+	return scaling.Target{
+		Workload:    deployment,
+		AgentPoolID: *agentPoolID,
+		Priority:    workloadArgs.Priority,
+	}, verified, nil
+}
+
+// OperatorTargets returns the targets of the AzpAgentAutoscaler resources in the operator's namespaces.
+// It is an error if any of the resources can't be autoscaled.
+func OperatorTargets(backend ci.Backend, k8sClient kubernetes.ClientAsync, args args.Args) ([]scaling.Target, error) {
+	autoscalers, err := operator.Resolve(backend, k8sClient, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, autoscaler := range autoscalers {
+		if autoscaler.Err != nil {
+			return nil, fmt.Errorf("Error in AzpAgentAutoscaler %s: %w", autoscaler.Name(), autoscaler.Err)
+		}
+	}
+	return operator.Targets(autoscalers), nil
+}
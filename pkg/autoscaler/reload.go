@@ -0,0 +1,104 @@
+package autoscaler
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// TargetList holds the autoscaled targets, which change when the config is reloaded
+type TargetList struct {
+	lock    sync.RWMutex
+	targets []scaling.Target
+}
+
+// Get returns the current targets
+func (l *TargetList) Get() []scaling.Target {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.targets
+}
+
+// Set replaces the targets
+func (l *TargetList) Set(targets []scaling.Target) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.targets = targets
+}
+
+// Reload applies reloaded arguments. The CI backend is recreated if it, or its URL, token or timeout changed,
+// and the workloads are retrieved again. The scaling state of the workloads, such as the last scale down, is kept.
+// The features the RBAC scope of the autoscaler doesn't allow are disabled in the reloaded args, so a ClusterRole
+// granted after startup is used with --rbac-scope=auto.
+func Reload(current args.Args, reloaded *args.Args, backend ci.Backend, k8sClient kubernetes.ClientAsync) (ci.Backend, []scaling.Target, error) {
+	// The KEDA external scaler and the metrics adapter don't have a Kubernetes client
+	if k8sClient != nil {
+		resolved, err := ResolveWorkloadType(k8sClient.Sync(), *reloaded)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved, _, err = ResolveRBACScope(k8sClient.Sync(), resolved)
+		if err != nil {
+			return nil, nil, err
+		}
+		*reloaded = resolved
+	}
+
+	if reloaded.Backend != current.Backend || !reflect.DeepEqual(reloaded.AZD, current.AZD) || !reflect.DeepEqual(reloaded.GitHub, current.GitHub) || !reflect.DeepEqual(reloaded.GitLab, current.GitLab) {
+		logger.Infof("Using the reloaded %s backend config", reloaded.Backend)
+		var err error
+		if backend, err = MakeBackend(*reloaded, k8sClient); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// In operator mode, the targets are resolved from the AzpAgentAutoscaler resources every iteration,
+	// and there are no targets when KEDA or a HorizontalPodAutoscaler scales the agents
+	var targets []scaling.Target
+	if !reloaded.Operator.Enabled && !reloaded.ExternallyScaled() {
+		var err error
+		if targets, err = InitializeTargets(backend, k8sClient, *reloaded); err != nil {
+			return nil, nil, err
+		}
+		if *reloaded, err = ResolveTokenPermissions(backend, targets, *reloaded); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	health.SetHistorySize(reloaded.History.Size)
+	if reloaded.RetryBudget != current.RetryBudget {
+		health.SetRetryBudget(reloaded.RetryBudget.Calls, reloaded.RetryBudget.Window)
+	}
+	if reloaded.DecisionHook != current.DecisionHook || reloaded.Notifications.WebhookSecret != current.Notifications.WebhookSecret {
+		SetDecisionHook(*reloaded)
+	}
+
+	// The namespaces and allowed pools of operator mode are applied on the next iteration without a restart
+	restartRequired := map[string]bool{
+		"health":             !reflect.DeepEqual(current.Health, reloaded.Health),
+		"admin":              !reflect.DeepEqual(current.Admin, reloaded.Admin),
+		"logging":            !reflect.DeepEqual(current.Logging, reloaded.Logging),
+		"tracing":            !reflect.DeepEqual(current.Tracing, reloaded.Tracing),
+		"Azure Monitor":      !reflect.DeepEqual(current.AzureMonitor, reloaded.AzureMonitor),
+		"CloudEvents":        !reflect.DeepEqual(current.CloudEvents, reloaded.CloudEvents),
+		"state":              !reflect.DeepEqual(current.State, reloaded.State),
+		"history ConfigMap":  current.History.ConfigMapName != reloaded.History.ConfigMapName,
+		"store":              current.Store != reloaded.Store,
+		"Kubernetes timeout": current.Kubernetes.Timeout != reloaded.Kubernetes.Timeout,
+		"operator":           current.Operator.Enabled != reloaded.Operator.Enabled || current.Operator.Webhook != reloaded.Operator.Webhook,
+		"KEDA":               current.KEDA != reloaded.KEDA,
+		"metrics adapter":    current.MetricsAdapter != reloaded.MetricsAdapter,
+		"AKS":                current.AKS != reloaded.AKS,
+	}
+	for section, changed := range restartRequired {
+		if changed {
+			logger.Warnf("The %s config changed, which requires a restart to apply", section)
+		}
+	}
+	return backend, targets, nil
+}
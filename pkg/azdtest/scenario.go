@@ -0,0 +1,84 @@
+package azdtest
+
+import (
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+)
+
+// Step changes the fake organization between autoscaling iterations
+type Step func(s *Server)
+
+// Scenario is a script of steps, ex: a burst of queued jobs that are picked up and finished
+type Scenario []Step
+
+// Play replaces the scenario, whose steps are run one at a time by Next
+func (s *Server) Play(scenario Scenario) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scenario = scenario
+}
+
+// Next runs the next step of the scenario, returning false once every step has been run
+func (s *Server) Next() bool {
+	s.lock.Lock()
+	if len(s.scenario) == 0 {
+		s.lock.Unlock()
+		return false
+	}
+	step := s.scenario[0]
+	s.scenario = s.scenario[1:]
+	s.lock.Unlock()
+
+	step(s)
+	return true
+}
+
+// QueueJobs queues jobs with the demands
+func QueueJobs(poolID int, count int, demands ...string) Step {
+	return func(s *Server) {
+		for i := 0; i < count; i++ {
+			s.QueueJob(poolID, demands...)
+		}
+	}
+}
+
+// DispatchJobs assigns the queued jobs to the idle agents
+func DispatchJobs(poolID int) Step {
+	return func(s *Server) {
+		s.DispatchJobs(poolID)
+	}
+}
+
+// FinishJobs finishes up to count running jobs with the result
+func FinishJobs(poolID int, count int, result azuredevops.JobResult) Step {
+	return func(s *Server) {
+		s.FinishJobs(poolID, count, result)
+	}
+}
+
+// Fail responds to the next count requests with the HTTP status code, or to every request if count is negative
+func Fail(status int, count int) Step {
+	return func(s *Server) {
+		s.Fail(status, count)
+	}
+}
+
+// Recover stops failing the requests
+func Recover() Step {
+	return func(s *Server) {
+		s.Recover()
+	}
+}
+
+// Steps runs several steps as one step of a scenario
+func Steps(steps ...Step) Step {
+	return func(s *Server) {
+		for _, step := range steps {
+			step(s)
+		}
+	}
+}
+
+// Wait is a step that doesn't change anything, for an autoscaling iteration without changes
+func Wait() Step {
+	return func(s *Server) {}
+}
@@ -0,0 +1,514 @@
+// Package azdtest is a fake Azure Devops organization for testing the autoscaler end-to-end, and for testing configs,
+// without a real organization. It serves the agent pool, agent and job request endpoints the autoscaler calls from an
+// httptest.Server, with agents and jobs that are changed by the test or by a scripted Scenario.
+package azdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+)
+
+var (
+	poolsPath            = regexp.MustCompile(`^/_apis/distributedtask/pools$`)
+	agentsPath           = regexp.MustCompile(`^/_apis/distributedtask/pools/(\d+)/agents$`)
+	agentPath            = regexp.MustCompile(`^/_apis/distributedtask/pools/(\d+)/agents/(\d+)$`)
+	userCapabilitiesPath = regexp.MustCompile(`^/_apis/distributedtask/pools/(\d+)/agents/(\d+)/usercapabilities$`)
+	jobRequestsPath      = regexp.MustCompile(`^/_apis/distributedtask/pools/(\d+)/jobrequests$`)
+)
+
+// Server is a fake Azure Devops organization. Its methods are safe to call while the autoscaler calls it.
+type Server struct {
+	// URL is the organization URL, to pass to azuredevops.MakeClient or --url
+	URL string
+	// Token is the token every request must have, or any token is accepted if it's empty
+	Token string
+
+	server *httptest.Server
+
+	lock     sync.Mutex
+	pools    map[int]*pool
+	nextID   int
+	failures []failure
+	calls    map[string]int
+	scenario Scenario
+}
+
+type pool struct {
+	details azuredevops.PoolDetails
+	agents  map[int]*azuredevops.AgentDetails
+	jobs    []*azuredevops.JobRequest
+}
+
+// failure is a status code to respond with instead of the response
+type failure struct {
+	status int
+	// remaining is the number of requests left to fail, or -1 to fail every request
+	remaining int
+}
+
+// NewServer starts a fake Azure Devops organization that requires the token. Close it when the test finishes.
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:  token,
+		pools:  make(map[int]*pool),
+		nextID: 1,
+		calls:  make(map[string]int),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// id returns the next pool, agent or job request ID. The lock must be held.
+func (s *Server) id() int {
+	id := s.nextID
+	s.nextID++
+	return id
+}
+
+// AddPool adds a self-hosted agent pool, returning its ID
+func (s *Server) AddPool(name string) int {
+	return s.addPool(name, false)
+}
+
+// AddHostedPool adds a Microsoft-hosted agent pool, which the autoscaler ignores, returning its ID
+func (s *Server) AddHostedPool(name string) int {
+	return s.addPool(name, true)
+}
+
+func (s *Server) addPool(name string, hosted bool) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := s.id()
+	s.pools[id] = &pool{
+		details: azuredevops.PoolDetails{
+			Definition: azuredevops.Definition{ID: id, Name: name},
+			IsHosted:   hosted,
+			PoolType:   "automation",
+		},
+		agents: make(map[int]*azuredevops.AgentDetails),
+	}
+	return id
+}
+
+// AddAgent registers an online agent running in a pod, returning its ID. The agent is named after the pod.
+func (s *Server) AddAgent(poolID int, podName string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.addAgent(s.pool(poolID), podName)
+}
+
+func (s *Server) addAgent(p *pool, podName string) int {
+	id := s.id()
+	p.agents[id] = &azuredevops.AgentDetails{
+		Agent: azuredevops.Agent{
+			Definition:        azuredevops.Definition{ID: id, Name: podName},
+			Version:           "2.0.0",
+			Enabled:           true,
+			Status:            "online",
+			ProvisioningState: "Provisioned",
+		},
+		SystemCapabilities: map[string]string{"HOSTNAME": podName, "Agent.Name": podName},
+		UserCapabilities:   map[string]string{},
+		MaxParallelism:     1,
+		CreatedOn:          formatTime(time.Now()),
+	}
+	return id
+}
+
+// SetAgents registers an online agent for every pod that doesn't have one, and deregisters the agents of other pods,
+// like the agents of a workload that was scaled
+func (s *Server) SetAgents(poolID int, podNames ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.pool(poolID)
+	registered := make(map[string]bool)
+	for id, agent := range p.agents {
+		podName := agent.SystemCapabilities["HOSTNAME"]
+		if !contains(podNames, podName) {
+			delete(p.agents, id)
+		} else {
+			registered[podName] = true
+		}
+	}
+	for _, podName := range podNames {
+		if !registered[podName] {
+			s.addAgent(p, podName)
+		}
+	}
+}
+
+// SetAgentStatus sets the status of an agent, ex: online or offline
+func (s *Server) SetAgentStatus(poolID int, agentID int, status string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.agent(poolID, agentID).Status = status
+}
+
+// Agent returns an agent, or false if it isn't registered
+func (s *Server) Agent(poolID int, agentID int) (azuredevops.AgentDetails, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agent, exists := s.pool(poolID).agents[agentID]
+	if !exists {
+		return azuredevops.AgentDetails{}, false
+	}
+	return *agent, true
+}
+
+// Agents returns the agents of a pool, ordered by ID
+func (s *Server) Agents(poolID int) []azuredevops.AgentDetails {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.agents(s.pool(poolID))
+}
+
+func (s *Server) agents(p *pool) []azuredevops.AgentDetails {
+	agents := make([]azuredevops.AgentDetails, 0, len(p.agents))
+	for _, agent := range p.agents {
+		agents = append(agents, *agent)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+// QueueJob queues a job with the demands, returning its request ID. A job without demands matches every agent.
+func (s *Server) QueueJob(poolID int, demands ...string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.pool(poolID)
+	id := s.id()
+	p.jobs = append(p.jobs, &azuredevops.JobRequest{
+		RequestID:              id,
+		QueueTime:              formatTime(time.Now()),
+		PlanType:               "Build",
+		JobID:                  strconv.Itoa(id),
+		Demands:                demands,
+		PoolID:                 poolID,
+		MatchesAllAgentsInPool: len(demands) == 0,
+		Definition:             &azuredevops.Definition{ID: 1, Name: "pipeline"},
+	})
+	return id
+}
+
+// DispatchJobs assigns the queued jobs to the idle, online and enabled agents whose capabilities match their demands,
+// oldest first, like Azure Devops does, returning the number of jobs assigned
+func (s *Server) DispatchJobs(poolID int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.pool(poolID)
+	dispatched := 0
+	for _, job := range p.jobs {
+		if job.ReservedAgent != nil || job.Result != "" {
+			continue
+		}
+		for _, agent := range s.agents(p) {
+			if agent.Enabled && strings.EqualFold(agent.Status, "online") && agent.AssignedRequest == nil && matches(agent, job.Demands) {
+				s.start(job, p.agents[agent.ID])
+				dispatched++
+				break
+			}
+		}
+	}
+	return dispatched
+}
+
+// StartJob assigns a queued job to an agent
+func (s *Server) StartJob(poolID int, requestID int, agentID int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.pool(poolID)
+	s.start(s.job(p, requestID), s.agent(poolID, agentID))
+}
+
+func (s *Server) start(job *azuredevops.JobRequest, agent *azuredevops.AgentDetails) {
+	now := formatTime(time.Now())
+	job.AssignTime = now
+	job.ReceiveTime = now
+	reserved := agent.Agent
+	job.ReservedAgent = &reserved
+	job.MatchedAgents = []azuredevops.Agent{reserved}
+	agent.AssignedRequest = job
+}
+
+// FinishJob finishes a running or queued job with the result, freeing its agent
+func (s *Server) FinishJob(poolID int, requestID int, result azuredevops.JobResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.pool(poolID)
+	s.finish(p, s.job(p, requestID), result)
+}
+
+// FinishJobs finishes up to count running jobs with the result, oldest first, returning the number of jobs finished
+func (s *Server) FinishJobs(poolID int, count int, result azuredevops.JobResult) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.pool(poolID)
+	finished := 0
+	for _, job := range p.jobs {
+		if finished < count && job.ReservedAgent != nil && job.Result == "" {
+			s.finish(p, job, result)
+			finished++
+		}
+	}
+	return finished
+}
+
+func (s *Server) finish(p *pool, job *azuredevops.JobRequest, result azuredevops.JobResult) {
+	job.FinishTime = formatTime(time.Now())
+	job.Result = string(result)
+	for _, agent := range p.agents {
+		if agent.AssignedRequest == job {
+			agent.AssignedRequest = nil
+			finished := *job
+			agent.LastCompletedRequest = &finished
+		}
+	}
+}
+
+// Jobs returns the job requests of a pool, in the order they were queued
+func (s *Server) Jobs(poolID int) []azuredevops.JobRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var jobs []azuredevops.JobRequest
+	for _, job := range s.pool(poolID).jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// Fail responds to the next count requests with the HTTP status code instead of the response, or to every request until
+// Recover is called if count is negative, ex: 429 to test throttling or 503 to test an outage
+func (s *Server) Fail(status int, count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if count == 0 {
+		return
+	} else if count < 0 {
+		count = -1
+	}
+	s.failures = append(s.failures, failure{status: status, remaining: count})
+}
+
+// Recover stops failing the requests
+func (s *Server) Recover() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = nil
+}
+
+// Calls returns the number of requests of an operation: ListPools, ListPoolAgents, ListJobRequests, DisableAgent, EnableAgent,
+// DeleteAgent or UpdateUserCapabilities
+func (s *Server) Calls(operation string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[operation]
+}
+
+// pool returns a pool, panicking if it doesn't exist as it's a mistake in the test. The lock must be held.
+func (s *Server) pool(poolID int) *pool {
+	p, exists := s.pools[poolID]
+	if !exists {
+		panic(fmt.Sprintf("azdtest: pool %d doesn't exist", poolID))
+	}
+	return p
+}
+
+// agent returns an agent, panicking if it doesn't exist as it's a mistake in the test. The lock must be held.
+func (s *Server) agent(poolID int, agentID int) *azuredevops.AgentDetails {
+	agent, exists := s.pool(poolID).agents[agentID]
+	if !exists {
+		panic(fmt.Sprintf("azdtest: agent %d doesn't exist in pool %d", agentID, poolID))
+	}
+	return agent
+}
+
+// job returns a job request, panicking if it doesn't exist as it's a mistake in the test. The lock must be held.
+func (s *Server) job(p *pool, requestID int) *azuredevops.JobRequest {
+	for _, job := range p.jobs {
+		if job.RequestID == requestID {
+			return job
+		}
+	}
+	panic(fmt.Sprintf("azdtest: job request %d doesn't exist in pool %d", requestID, p.details.ID))
+}
+
+func (s *Server) serveHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, token, ok := request.BasicAuth(); !ok || (s.Token != "" && token != s.Token) {
+		// Azure Devops responds to an invalid token with a sign in page
+		writer.WriteHeader(http.StatusNonAuthoritativeInfo)
+		return
+	}
+
+	operation, response, status := s.route(request)
+	if operation != "" {
+		s.calls[operation]++
+	}
+	if len(s.failures) > 0 {
+		failure := &s.failures[0]
+		status = failure.status
+		if failure.remaining > 0 {
+			failure.remaining--
+			if failure.remaining == 0 {
+				s.failures = s.failures[1:]
+			}
+		}
+		if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+			writer.Header().Set("Retry-After", "1")
+		}
+		writer.WriteHeader(status)
+		return
+	}
+
+	if response == nil {
+		writer.WriteHeader(status)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(response)
+}
+
+// route handles a request, returning its operation, response body and HTTP status. The lock must be held.
+func (s *Server) route(request *http.Request) (string, interface{}, int) {
+	path := request.URL.Path
+	if poolsPath.MatchString(path) && request.Method == http.MethodGet {
+		name := request.URL.Query().Get("poolName")
+		pools := []azuredevops.PoolDetails{}
+		for _, p := range s.pools {
+			if name == "" || strings.EqualFold(p.details.Name, name) {
+				pools = append(pools, p.details)
+			}
+		}
+		sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+		return "ListPools", azuredevops.PoolList{Count: len(pools), Value: pools}, http.StatusOK
+	}
+
+	if match := agentsPath.FindStringSubmatch(path); match != nil && request.Method == http.MethodGet {
+		p, exists := s.pools[atoi(match[1])]
+		if !exists {
+			return "ListPoolAgents", nil, http.StatusNotFound
+		}
+		agents := s.agents(p)
+		return "ListPoolAgents", azuredevops.Pool{Count: len(agents), Value: agents}, http.StatusOK
+	}
+
+	if match := jobRequestsPath.FindStringSubmatch(path); match != nil && request.Method == http.MethodGet {
+		p, exists := s.pools[atoi(match[1])]
+		if !exists {
+			return "ListJobRequests", nil, http.StatusNotFound
+		}
+		jobs := make([]azuredevops.JobRequest, len(p.jobs))
+		for i, job := range p.jobs {
+			jobs[i] = *job
+		}
+		return "ListJobRequests", azuredevops.JobRequests{Count: len(jobs), Value: jobs}, http.StatusOK
+	}
+
+	if match := agentPath.FindStringSubmatch(path); match != nil {
+		p, exists := s.pools[atoi(match[1])]
+		if !exists {
+			return "", nil, http.StatusNotFound
+		}
+		agentID := atoi(match[2])
+		agent, exists := p.agents[agentID]
+		switch request.Method {
+		case http.MethodPatch:
+			if !exists {
+				return "DisableAgent", nil, http.StatusNotFound
+			}
+			var update struct {
+				Enabled *bool `json:"enabled"`
+			}
+			if err := json.NewDecoder(request.Body).Decode(&update); err != nil {
+				return "DisableAgent", nil, http.StatusBadRequest
+			}
+			if update.Enabled != nil {
+				agent.Enabled = *update.Enabled
+				if agent.Enabled {
+					return "EnableAgent", agent, http.StatusOK
+				}
+			}
+			return "DisableAgent", agent, http.StatusOK
+		case http.MethodDelete:
+			if !exists {
+				return "DeleteAgent", nil, http.StatusNotFound
+			}
+			delete(p.agents, agentID)
+			return "DeleteAgent", nil, http.StatusNoContent
+		}
+	}
+
+	if match := userCapabilitiesPath.FindStringSubmatch(path); match != nil && request.Method == http.MethodPut {
+		p, exists := s.pools[atoi(match[1])]
+		if !exists {
+			return "UpdateUserCapabilities", nil, http.StatusNotFound
+		}
+		agent, exists := p.agents[atoi(match[2])]
+		if !exists {
+			return "UpdateUserCapabilities", nil, http.StatusNotFound
+		}
+		capabilities := make(map[string]string)
+		if err := json.NewDecoder(request.Body).Decode(&capabilities); err != nil {
+			return "UpdateUserCapabilities", nil, http.StatusBadRequest
+		}
+		agent.UserCapabilities = capabilities
+		return "UpdateUserCapabilities", agent, http.StatusOK
+	}
+
+	return "", nil, http.StatusNotFound
+}
+
+// matches returns true if an agent has the capabilities of every demand, ex: "java" or "Agent.OS -equals Linux"
+func matches(agent azuredevops.AgentDetails, demands []string) bool {
+	for _, demand := range demands {
+		fields := strings.Fields(demand)
+		if len(fields) == 0 {
+			continue
+		}
+		value, exists := agent.UserCapabilities[fields[0]]
+		if !exists {
+			value, exists = agent.SystemCapabilities[fields[0]]
+		}
+		if !exists || (len(fields) == 3 && strings.EqualFold(fields[1], "-equals") && !strings.EqualFold(value, fields[2])) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func atoi(value string) int {
+	i, _ := strconv.Atoi(value)
+	return i
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -16,6 +16,7 @@ type Agent struct {
 type AgentDetails struct {
 	Agent
 	SystemCapabilities   map[string]string `json:"systemCapabilities"`
+	UserCapabilities     map[string]string `json:"userCapabilities"`
 	MaxParallelism       int               `json:"maxParallelism"`
 	CreatedOn            string            `json:"createdOn"`
 	AssignedRequest      *JobRequest       `json:"assignedRequest"`
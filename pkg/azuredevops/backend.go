@@ -0,0 +1,144 @@
+package azuredevops
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+)
+
+// Backend is the Azure Pipelines CI backend
+type Backend struct {
+	client ClientAsync
+}
+
+// NewBackend returns the Azure Pipelines CI backend that calls Azure Devops with the client
+func NewBackend(client ClientAsync) ci.Backend {
+	return Backend{client: client}
+}
+
+// Pools returns the self-hosted agent pools, or only the pools with the name if it is set
+func (b Backend) Pools(name string) ([]ci.Pool, error) {
+	poolsChan := make(chan PoolDetailsResponse, 1)
+	if name == "" {
+		go b.client.ListPoolsAsync(poolsChan)
+	} else {
+		go b.client.ListPoolsByNameAsync(poolsChan, name)
+	}
+	response := <-poolsChan
+	if response.Err != nil {
+		return nil, response.Err
+	}
+	var pools []ci.Pool
+	for _, pool := range response.Pools {
+		// Microsoft-hosted agents can't be autoscaled
+		if !pool.IsHosted && (name == "" || pool.Name == name) {
+			pools = append(pools, ci.Pool{ID: pool.ID, Name: pool.Name})
+		}
+	}
+	return pools, nil
+}
+
+// Agents returns every agent registered in a pool. The pod name of an agent is its HOSTNAME capability.
+func (b Backend) Agents(poolID int) ([]ci.Agent, error) {
+	agentsChan := make(chan PoolAgentsResponse, 1)
+	go b.client.ListPoolAgentsAsync(agentsChan, poolID)
+	response := <-agentsChan
+	if response.Err != nil {
+		return nil, response.Err
+	}
+	agents := make([]ci.Agent, 0, len(response.Agents))
+	for _, agent := range response.Agents {
+		ciAgent := ci.Agent{
+			ID:      agent.ID,
+			Name:    agent.Name,
+			PodName: agent.SystemCapabilities["HOSTNAME"],
+			Status:  agent.Status,
+			Online:  strings.EqualFold(agent.Status, "online"),
+			Enabled: agent.Enabled,
+			Busy:    agent.AssignedRequest != nil,
+			Version: agent.Version,
+			// The system capabilities are reported by the agent itself
+			Capabilities: agent.UserCapabilities,
+		}
+		if agent.LastCompletedRequest != nil {
+			ciAgent.LastJobFinished = parseTime(agent.LastCompletedRequest.FinishTime)
+		}
+		agents = append(agents, ciAgent)
+	}
+	return agents, nil
+}
+
+// Jobs returns the job requests of a pool, which include the jobs that finished recently
+func (b Backend) Jobs(poolID int) ([]ci.Job, error) {
+	jobsChan := make(chan JobRequestsResponse, 1)
+	go b.client.ListJobRequestsAsync(jobsChan, poolID)
+	response := <-jobsChan
+	if response.Err != nil {
+		return nil, response.Err
+	}
+	jobs := make([]ci.Job, 0, len(response.Jobs))
+	for _, job := range response.Jobs {
+		ciJob := ci.Job{
+			QueueTime:        parseTime(job.QueueTime),
+			StartTime:        parseTime(job.ReceiveTime),
+			FinishTime:       parseTime(job.FinishTime),
+			Finished:         !job.IsQueuedOrRunning(),
+			Failed:           strings.EqualFold(job.Result, string(JobResultFailed)),
+			MatchesAllAgents: job.MatchesAllAgentsInPool,
+			Demands:          job.Demands,
+		}
+		if job.ReservedAgent != nil {
+			ciJob.AgentName = job.ReservedAgent.Name
+		}
+		for _, agent := range job.MatchedAgents {
+			ciJob.MatchedAgents = append(ciJob.MatchedAgents, agent.Name)
+		}
+		jobs = append(jobs, ciJob)
+	}
+	return jobs, nil
+}
+
+// Drain disables an agent, so it isn't assigned new jobs
+func (b Backend) Drain(poolID int, agent ci.Agent) error {
+	errChan := make(chan error, 1)
+	go b.client.DisableAgentAsync(errChan, poolID, agent.ID)
+	return <-errChan
+}
+
+// Undrain enables a disabled agent, so it's assigned new jobs again
+func (b Backend) Undrain(poolID int, agent ci.Agent) error {
+	errChan := make(chan error, 1)
+	go b.client.EnableAgentAsync(errChan, poolID, agent.ID)
+	return <-errChan
+}
+
+// Remove deletes an agent from a pool
+func (b Backend) Remove(poolID int, agent ci.Agent) error {
+	errChan := make(chan error, 1)
+	go b.client.DeleteAgentAsync(errChan, poolID, agent.ID)
+	// The agent can have deregistered itself when its pod stopped
+	var httpError *HTTPError
+	if err := <-errChan; err != nil && !(errors.As(err, &httpError) && httpError.StatusCode == http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
+
+// SetCapabilities replaces the user capabilities of an agent
+func (b Backend) SetCapabilities(poolID int, agent ci.Agent, capabilities map[string]string) error {
+	errChan := make(chan error, 1)
+	go b.client.UpdateUserCapabilitiesAsync(errChan, poolID, agent.ID, capabilities)
+	return <-errChan
+}
+
+// parseTime parses a time returned by Azure Devops, returning zero if it isn't set
+func parseTime(value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
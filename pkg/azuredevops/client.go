@@ -1,12 +1,25 @@
 package azuredevops
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
 )
 
 const getPoolsEndpoint = "/_apis/distributedtask/pools?poolName=%s"
@@ -16,6 +29,12 @@ const getPoolAgentsEndpoint = "/_apis/distributedtask/pools/%d/agents?includeCap
 
 const getPoolJobRequestsEndpoint = "/_apis/distributedtask/pools/%d/jobrequests"
 
+// Parameter 1 is the Pool ID, parameter 2 is the Agent ID
+const poolAgentEndpoint = "/_apis/distributedtask/pools/%d/agents/%d"
+
+// Parameter 1 is the Pool ID, parameter 2 is the Agent ID
+const userCapabilitiesEndpoint = "/_apis/distributedtask/pools/%d/agents/%d/usercapabilities"
+
 const acceptHeader = "application/json;api-version=5.0-preview.1"
 
 var (
@@ -29,10 +48,25 @@ var (
 		Help: "Counts of Azure Devops calls",
 	}, []string{"operation"})
 
+	azdErrorCounts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_azd_call_error_count",
+		Help: "Counts of Azure Devops calls that returned an error",
+	}, []string{"operation"})
+
 	azd429Counts = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "azp_agent_autoscaler_azd_call_429_count",
 		Help: "Counts of Azure Devops calls returning HTTP 429 (Too Many Requests)",
 	})
+
+	azdConnectionCounts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_azd_connection_count",
+		Help: "Counts of the connections Azure Devops calls were sent on, by whether the connection was reused",
+	}, []string{"reused"})
+
+	azdDNSDurations = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "azp_agent_autoscaler_azd_dns_lookup_duration_seconds",
+		Help: "Duration of the DNS lookups of the new connections to Azure Devops",
+	})
 )
 
 // Client is used to call Azure Devops
@@ -41,17 +75,122 @@ type Client interface {
 	ListPoolsByName(poolName string) ([]PoolDetails, error)
 	ListPoolAgents(poolID int) ([]AgentDetails, error)
 	ListJobRequests(poolID int) ([]JobRequest, error)
+	DisableAgent(poolID int, agentID int) error
+	EnableAgent(poolID int, agentID int) error
+	DeleteAgent(poolID int, agentID int) error
+	UpdateUserCapabilities(poolID int, agentID int, capabilities map[string]string) error
 }
 
 // ClientImpl is the interface implementation that calls Azure Devops
 type ClientImpl struct {
 	baseURL string
 
-	token string
+	// token returns the current token, which can change when it's refreshed from a secret store
+	token func() string
+
+	// httpClient is shared by every request, so the connections to Azure Devops are kept alive between polls.
+	// Its timeout limits each request, so a slow Azure Devops API can't stall autoscaling.
+	httpClient *http.Client
+}
+
+// Connections tunes the connections kept alive to Azure Devops
+type Connections struct {
+	// MaxIdlePerHost is the number of idle connections kept alive to each host
+	MaxIdlePerHost int
+	// IdleTimeout is how long an idle connection is kept alive, or forever if it's 0
+	IdleTimeout time.Duration
+	// DisableHTTP2 only uses HTTP/1.1, ex: behind a proxy that doesn't support HTTP/2
+	DisableHTTP2 bool
+	// Network is tcp4 or tcp6 to only connect over IPv4 or IPv6, ex: with IPv6-only egress. If empty, the addresses of
+	// both are dialed, falling back from the preferred address after a delay.
+	Network string
+	// DNSServers resolve the hosts instead of the resolvers of the system, as <IP>:<port>. They're used in turn, so a
+	// retried lookup is sent to the next server.
+	DNSServers []string
+}
+
+// DefaultConnections keep a connection alive for each of the agents, job requests and pools of the workloads autoscaled
+// concurrently, instead of the default of 2, and negotiate HTTP/2, which sends every call on a single connection
+var DefaultConnections = Connections{MaxIdlePerHost: 16, IdleTimeout: 90 * time.Second}
+
+// newHTTPClient returns an HTTP client with a pooled transport for Azure Devops
+func newHTTPClient(timeout time.Duration, connections Connections) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = connections.MaxIdlePerHost
+	transport.IdleConnTimeout = connections.IdleTimeout
+	transport.DialContext = dialContext(connections)
+	if connections.DisableHTTP2 {
+		// A non-nil empty map disables the HTTP/2 upgrade of the TLS connections
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// dialContext returns the dial function of the connections, with the timeouts of the default transport
+func dialContext(connections Connections) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if len(connections.DNSServers) > 0 {
+		var next uint32
+		servers := connections.DNSServers
+		serverDialer := &net.Dialer{Timeout: 5 * time.Second}
+		dialer.Resolver = &net.Resolver{
+			// The resolver of the system can't be given other servers
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				server := servers[(atomic.AddUint32(&next, 1)-1)%uint32(len(servers))]
+				return serverDialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if connections.Network != "" {
+			network = connections.Network
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+// connectionTrace records whether a call reused a connection, and the duration of the DNS lookup of a new connection
+func connectionTrace() *httptrace.ClientTrace {
+	var dnsStart time.Time
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			azdDNSDurations.Observe(time.Since(dnsStart).Seconds())
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			azdConnectionCounts.With(prometheus.Labels{"reused": strconv.FormatBool(info.Reused)}).Inc()
+		},
+	}
+}
+
+// bodyBuffers are reused to encode the request bodies
+var bodyBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
 }
 
 func (c ClientImpl) executeGETRequest(endpoint string, response interface{}) error {
-	request, err := http.NewRequest("GET", c.baseURL+endpoint, nil)
+	return c.executeRequest(http.MethodGet, endpoint, nil, response)
+}
+
+// executeRequest calls Azure Devops with a JSON body if it isn't nil, and decodes the response into response if it isn't nil
+func (c ClientImpl) executeRequest(method string, endpoint string, body interface{}, response interface{}) error {
+	var requestBody io.Reader
+	if body != nil {
+		buffer := bodyBuffers.Get().(*bytes.Buffer)
+		buffer.Reset()
+		defer bodyBuffers.Put(buffer)
+		if err := json.NewEncoder(buffer).Encode(body); err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(buffer.Bytes())
+	}
+	request, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), connectionTrace()), method, c.baseURL+endpoint, requestBody)
 
 	if err != nil {
 		return err
@@ -59,30 +198,43 @@ func (c ClientImpl) executeGETRequest(endpoint string, response interface{}) err
 
 	request.Header.Set("Accept", acceptHeader)
 	request.Header.Set("User-Agent", "go-azp-agent-autoscaler")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
 
-	request.SetBasicAuth("user", c.token)
+	request.SetBasicAuth("user", c.token())
 
-	httpClient := http.Client{}
-	httpResponse, err := httpClient.Do(request)
+	httpResponse, err := c.httpClient.Do(request)
 	if err != nil {
+		health.RecordFailedCall("azure-devops")
 		return err
 	}
 
-	defer httpResponse.Body.Close()
+	// The rest of the body is read, so the connection can be reused
+	defer func() {
+		io.Copy(ioutil.Discard, httpResponse.Body)
+		httpResponse.Body.Close()
+	}()
 
-	if httpResponse.StatusCode != 200 {
+	if httpResponse.StatusCode != 200 && !(method == http.MethodDelete && httpResponse.StatusCode == http.StatusNoContent) {
 		httpErr := NewHTTPError(httpResponse)
 		if httpErr.RetryAfter != nil {
 			azd429Counts.Inc()
 		}
+		if health.IsRetryableStatus(httpResponse.StatusCode) {
+			health.RecordFailedCall("azure-devops")
+		}
 		return httpErr
 	}
 
-	err = json.NewDecoder(httpResponse.Body).Decode(response)
-	if err != nil {
-		return fmt.Errorf("Error - could not parse JSON response from %s: %s", endpoint, err.Error())
+	if response != nil {
+		err = json.NewDecoder(httpResponse.Body).Decode(response)
+		if err != nil {
+			return fmt.Errorf("Error - could not parse JSON response from %s: %w", endpoint, err)
+		}
 	}
 
+	health.RecordAZDPoll()
 	return nil
 }
 
@@ -101,6 +253,7 @@ func (c ClientImpl) ListPoolsByName(poolName string) ([]PoolDetails, error) {
 	endpoint := fmt.Sprintf(getPoolsEndpoint, poolName)
 	err := c.executeGETRequest(endpoint, response)
 	if err != nil {
+		azdErrorCounts.With(prometheus.Labels{"operation": "ListPools"}).Inc()
 		return nil, err
 	} else {
 		return response.Value, nil
@@ -117,6 +270,7 @@ func (c ClientImpl) ListPoolAgents(poolID int) ([]AgentDetails, error) {
 	endpoint := fmt.Sprintf(getPoolAgentsEndpoint, poolID)
 	err := c.executeGETRequest(endpoint, response)
 	if err != nil {
+		azdErrorCounts.With(prometheus.Labels{"operation": "ListPoolAgents"}).Inc()
 		return nil, err
 	} else {
 		return response.Value, nil
@@ -133,8 +287,73 @@ func (c ClientImpl) ListJobRequests(poolID int) ([]JobRequest, error) {
 	endpoint := fmt.Sprintf(getPoolJobRequestsEndpoint, poolID)
 	err := c.executeGETRequest(endpoint, response)
 	if err != nil {
+		azdErrorCounts.With(prometheus.Labels{"operation": "ListJobRequests"}).Inc()
 		return nil, err
 	} else {
 		return response.Value, nil
 	}
 }
+
+// agentEnabledUpdate is the body of a request that enables or disables an agent
+type agentEnabledUpdate struct {
+	ID      int  `json:"id"`
+	Enabled bool `json:"enabled"`
+}
+
+// DisableAgent disables an agent, so it isn't assigned new jobs. A job it is running isn't cancelled.
+func (c ClientImpl) DisableAgent(poolID int, agentID int) error {
+	timer := prometheus.NewTimer(azdDurations.With(prometheus.Labels{"operation": "DisableAgent"}))
+	defer timer.ObserveDuration()
+	azdCounts.With(prometheus.Labels{"operation": "DisableAgent"}).Inc()
+
+	endpoint := fmt.Sprintf(poolAgentEndpoint, poolID, agentID)
+	body := agentEnabledUpdate{ID: agentID, Enabled: false}
+	if err := c.executeRequest(http.MethodPatch, endpoint, body, nil); err != nil {
+		azdErrorCounts.With(prometheus.Labels{"operation": "DisableAgent"}).Inc()
+		return err
+	}
+	return nil
+}
+
+// EnableAgent enables a disabled agent, so it's assigned new jobs again
+func (c ClientImpl) EnableAgent(poolID int, agentID int) error {
+	timer := prometheus.NewTimer(azdDurations.With(prometheus.Labels{"operation": "EnableAgent"}))
+	defer timer.ObserveDuration()
+	azdCounts.With(prometheus.Labels{"operation": "EnableAgent"}).Inc()
+
+	endpoint := fmt.Sprintf(poolAgentEndpoint, poolID, agentID)
+	body := agentEnabledUpdate{ID: agentID, Enabled: true}
+	if err := c.executeRequest(http.MethodPatch, endpoint, body, nil); err != nil {
+		azdErrorCounts.With(prometheus.Labels{"operation": "EnableAgent"}).Inc()
+		return err
+	}
+	return nil
+}
+
+// DeleteAgent deregisters an agent from a pool
+func (c ClientImpl) DeleteAgent(poolID int, agentID int) error {
+	timer := prometheus.NewTimer(azdDurations.With(prometheus.Labels{"operation": "DeleteAgent"}))
+	defer timer.ObserveDuration()
+	azdCounts.With(prometheus.Labels{"operation": "DeleteAgent"}).Inc()
+
+	endpoint := fmt.Sprintf(poolAgentEndpoint, poolID, agentID)
+	if err := c.executeRequest(http.MethodDelete, endpoint, nil, nil); err != nil {
+		azdErrorCounts.With(prometheus.Labels{"operation": "DeleteAgent"}).Inc()
+		return err
+	}
+	return nil
+}
+
+// UpdateUserCapabilities replaces the user capabilities of an agent
+func (c ClientImpl) UpdateUserCapabilities(poolID int, agentID int, capabilities map[string]string) error {
+	timer := prometheus.NewTimer(azdDurations.With(prometheus.Labels{"operation": "UpdateUserCapabilities"}))
+	defer timer.ObserveDuration()
+	azdCounts.With(prometheus.Labels{"operation": "UpdateUserCapabilities"}).Inc()
+
+	endpoint := fmt.Sprintf(userCapabilitiesEndpoint, poolID, agentID)
+	if err := c.executeRequest(http.MethodPut, endpoint, capabilities, nil); err != nil {
+		azdErrorCounts.With(prometheus.Labels{"operation": "UpdateUserCapabilities"}).Inc()
+		return err
+	}
+	return nil
+}
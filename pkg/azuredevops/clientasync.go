@@ -2,6 +2,7 @@ package azuredevops
 
 import (
 	"strings"
+	"time"
 )
 
 // ClientAsync is an async version of Client
@@ -10,6 +11,10 @@ type ClientAsync interface {
 	ListPoolsByNameAsync(channel chan<- PoolDetailsResponse, poolName string)
 	ListPoolAgentsAsync(channel chan<- PoolAgentsResponse, poolID int)
 	ListJobRequestsAsync(channel chan<- JobRequestsResponse, poolID int)
+	DisableAgentAsync(channel chan<- error, poolID int, agentID int)
+	EnableAgentAsync(channel chan<- error, poolID int, agentID int)
+	DeleteAgentAsync(channel chan<- error, poolID int, agentID int)
+	UpdateUserCapabilitiesAsync(channel chan<- error, poolID int, agentID int, capabilities map[string]string)
 }
 
 // ClientAsyncImpl is the async interface implementation that calls Azure Devops
@@ -17,15 +22,28 @@ type ClientAsyncImpl struct {
 	client Client
 }
 
-// MakeClient creates a new Azure Devops client
-func MakeClient(baseURL string, token string) ClientAsync {
+// MakeClient creates a new Azure Devops client. Requests time out after the timeout, or never if it's 0.
+func MakeClient(baseURL string, token string, timeout time.Duration) ClientAsync {
+	return MakeClientWithTokenSource(baseURL, func() string { return token }, timeout)
+}
+
+// MakeClientWithTokenSource creates a new Azure Devops client that gets the token before every request,
+// so a token refreshed from a secret store is used without recreating the client
+func MakeClientWithTokenSource(baseURL string, token func() string, timeout time.Duration) ClientAsync {
+	return MakeClientWithConnections(baseURL, token, timeout, DefaultConnections)
+}
+
+// MakeClientWithConnections creates a new Azure Devops client that gets the token before every request, and keeps its
+// connections alive as configured
+func MakeClientWithConnections(baseURL string, token func() string, timeout time.Duration, connections Connections) ClientAsync {
 	if !strings.HasSuffix(baseURL, "") {
 		baseURL = strings.TrimSuffix(baseURL, "/")
 	}
 	return ClientAsyncImpl{
 		client: ClientImpl{
-			baseURL: baseURL,
-			token:   token,
+			baseURL:    baseURL,
+			token:      token,
+			httpClient: newHTTPClient(timeout, connections),
 		},
 	}
 }
@@ -71,3 +89,23 @@ func (c ClientAsyncImpl) ListJobRequestsAsync(channel chan<- JobRequestsResponse
 	response, err := c.client.ListJobRequests(poolID)
 	channel <- JobRequestsResponse{response, err}
 }
+
+// DisableAgentAsync disables an agent, so it isn't assigned new jobs
+func (c ClientAsyncImpl) DisableAgentAsync(channel chan<- error, poolID int, agentID int) {
+	channel <- c.client.DisableAgent(poolID, agentID)
+}
+
+// EnableAgentAsync enables a disabled agent, so it's assigned new jobs again
+func (c ClientAsyncImpl) EnableAgentAsync(channel chan<- error, poolID int, agentID int) {
+	channel <- c.client.EnableAgent(poolID, agentID)
+}
+
+// DeleteAgentAsync deregisters an agent from a pool
+func (c ClientAsyncImpl) DeleteAgentAsync(channel chan<- error, poolID int, agentID int) {
+	channel <- c.client.DeleteAgent(poolID, agentID)
+}
+
+// UpdateUserCapabilitiesAsync replaces the user capabilities of an agent
+func (c ClientAsyncImpl) UpdateUserCapabilitiesAsync(channel chan<- error, poolID int, agentID int, capabilities map[string]string) {
+	channel <- c.client.UpdateUserCapabilities(poolID, agentID, capabilities)
+}
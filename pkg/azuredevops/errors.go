@@ -1,9 +1,13 @@
 package azuredevops
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
 )
 
 // HTTPError is returned when an HTTP response does not return 200
@@ -19,12 +23,10 @@ type HTTPError struct {
 func NewHTTPError(response *http.Response) *HTTPError {
 	var retryAfter *time.Duration
 	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
-		retryAfterStr, exists := response.Header["Retry-After"]
-		if exists {
-			retryAfterVal, err := time.ParseDuration(fmt.Sprintf("%ss", retryAfterStr))
-			if err != nil {
-				retryAfter = &retryAfterVal
-			}
+		// Retry-After is a number of seconds
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			retryAfterVal := time.Duration(seconds) * time.Second
+			retryAfter = &retryAfterVal
 		}
 	}
 
@@ -38,3 +40,21 @@ func NewHTTPError(response *http.Response) *HTTPError {
 func (err HTTPError) Error() string {
 	return fmt.Sprintf("Error - received HTTP status code %d when calling call to %s", err.StatusCode, err.Endpoint)
 }
+
+// Is matches ci.ErrUnauthorized if Azure Devops rejected the token, and ci.ErrThrottled if it's rate limiting the autoscaler
+func (err HTTPError) Is(target error) bool {
+	switch target {
+	case ci.ErrUnauthorized:
+		// Azure Devops responds to an invalid token with a 203 and a sign in page
+		return err.StatusCode == http.StatusUnauthorized || err.StatusCode == http.StatusForbidden || err.StatusCode == http.StatusNonAuthoritativeInfo
+	case ci.ErrThrottled:
+		return err.StatusCode == http.StatusTooManyRequests
+	default:
+		return false
+	}
+}
+
+// IsAuthError returns true if an error is Azure Devops rejecting the token
+func IsAuthError(err error) bool {
+	return errors.Is(err, ci.ErrUnauthorized)
+}
@@ -1,6 +1,9 @@
 package azuredevops
 
-import "strings"
+import (
+	"strings"
+	"time"
+)
 
 // JobRequests is the response received when retrieving a pool's jobs.
 // curl -u user:token https://dev.azure.com/organization/_apis/distributedtask/pools/9/jobrequests'
@@ -44,7 +47,7 @@ type JobRequest struct {
 	OrchestrationID        string            `json:"orchestrationId"`
 	MatchesAllAgentsInPool bool              `json:"matchesAllAgentsInPool"`
 	Definition             *Definition       `json:"definition"`
-	Owner                  *Definition       `json:"definition"`
+	Owner                  *Definition       `json:"owner"`
 	// AgentDelays            []struct{}        `json:"agentDelays"`
 }
 
@@ -55,3 +58,18 @@ func (j *JobRequest) IsQueuedOrRunning() bool {
 		!strings.EqualFold(j.Result, string(JobResultSucceeded)) &&
 		(len(j.MatchedAgents) > 0 || j.Result == "")
 }
+
+// GetQueueTime parses the time the job was queued
+func (j *JobRequest) GetQueueTime() (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, j.QueueTime)
+}
+
+// GetReceiveTime parses the time the job was received by an agent
+func (j *JobRequest) GetReceiveTime() (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, j.ReceiveTime)
+}
+
+// GetFinishTime parses the time the job finished
+func (j *JobRequest) GetFinishTime() (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, j.FinishTime)
+}
@@ -0,0 +1,127 @@
+package ci
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotSupported is returned by a backend when its CI system can't perform an operation, ex: draining an agent
+var ErrNotSupported = errors.New("Not supported by the CI system")
+
+// ErrUnauthorized matches the errors of a CI system rejecting the credentials of the autoscaler, with errors.Is
+var ErrUnauthorized = errors.New("The CI system rejected the credentials")
+
+// ErrThrottled matches the errors of a CI system rate limiting the autoscaler, with errors.Is
+var ErrThrottled = errors.New("The CI system is throttling the autoscaler")
+
+// Backend retrieves the agents and jobs of a CI system, so the scaling engine doesn't depend on a specific one.
+// Azure Pipelines is implemented by azuredevops.NewBackend, GitHub Actions by github.NewBackend and GitLab by gitlab.NewBackend.
+type Backend interface {
+	// Pools returns the self-hosted agent pools, or only the pools with the name if it is set
+	Pools(name string) ([]Pool, error)
+	// Agents returns every agent registered in a pool
+	Agents(poolID int) ([]Agent, error)
+	// Jobs returns the queued and running jobs of a pool, and the jobs that finished recently if the CI system returns them.
+	// Use QueuedJobs and RunningJobs to filter them.
+	Jobs(poolID int) ([]Job, error)
+	// Drain stops an agent from being assigned new jobs, its running job isn't canceled.
+	// It returns ErrNotSupported if the CI system can't.
+	Drain(poolID int, agent Agent) error
+	// Undrain lets a drained agent be assigned new jobs again.
+	// It returns ErrNotSupported if the CI system can't drain agents.
+	Undrain(poolID int, agent Agent) error
+	// Remove deregisters an agent from a pool. It returns nil if the agent was already deregistered.
+	Remove(poolID int, agent Agent) error
+	// SetCapabilities replaces the user capabilities of an agent.
+	// It returns ErrNotSupported if the CI system doesn't have user capabilities.
+	SetCapabilities(poolID int, agent Agent, capabilities map[string]string) error
+}
+
+// Pool is a pool of self-hosted agents
+type Pool struct {
+	ID   int
+	Name string
+}
+
+// Agent is an agent registered in a pool
+type Agent struct {
+	ID   int
+	Name string
+	// PodName is the name of the pod running the agent, or an empty string if it isn't known
+	PodName string
+	// Status is the status reported by the CI system, ex: online or offline
+	Status  string
+	Online  bool
+	Enabled bool
+	// Busy is true if the agent is running a job
+	Busy bool
+	// LastJobFinished is when the agent last finished a job, or zero if it didn't
+	LastJobFinished time.Time
+	// Version is the version of the agent, or an empty string if the CI system doesn't report it
+	Version string
+	// Capabilities are the user capabilities of the agent, which jobs can demand
+	Capabilities map[string]string
+}
+
+// Job is a job request of a pool
+type Job struct {
+	QueueTime time.Time
+	// StartTime is when an agent started the job, or zero if it didn't
+	StartTime time.Time
+	// FinishTime is zero if the job didn't finish
+	FinishTime time.Time
+	Finished   bool
+	// Failed is true if the job finished with a failure, canceled jobs didn't fail
+	Failed bool
+	// AgentName is the name of the agent the job is assigned to, or an empty string if it is queued
+	AgentName string
+	// MatchesAllAgents is true if any agent of the pool can run the job, otherwise only the matched agents can
+	MatchesAllAgents bool
+	MatchedAgents    []string
+	// Demands are the capabilities an agent needs to run the job, ex: Agent.OS -equals Windows_NT
+	Demands []string
+	// Gated is true if the job is waiting for an approval or a check before it is queued for an agent
+	Gated bool
+	// Delayed is true if the job is waiting for a delay before it is queued for an agent
+	Delayed bool
+	// ReleaseTime is when a delayed job is queued for an agent, or zero if the CI system doesn't report it
+	ReleaseTime time.Time
+}
+
+// IsWaiting returns true if the job is waiting for an approval, a check or a delay before it is queued for an agent
+func (j Job) IsWaiting() bool {
+	return j.Gated || j.Delayed
+}
+
+// QueuedJobs returns the jobs that are waiting for an agent
+func QueuedJobs(jobs []Job) []Job {
+	var queuedJobs []Job
+	for _, job := range jobs {
+		if !job.Finished && job.AgentName == "" && !job.IsWaiting() {
+			queuedJobs = append(queuedJobs, job)
+		}
+	}
+	return queuedJobs
+}
+
+// WaitingJobs returns the jobs that are waiting for an approval, a check or a delay before they are queued
+func WaitingJobs(jobs []Job) []Job {
+	var waitingJobs []Job
+	for _, job := range jobs {
+		if !job.Finished && job.AgentName == "" && job.IsWaiting() {
+			waitingJobs = append(waitingJobs, job)
+		}
+	}
+	return waitingJobs
+}
+
+// RunningJobs returns the jobs that are assigned to an agent and didn't finish
+func RunningJobs(jobs []Job) []Job {
+	var runningJobs []Job
+	for _, job := range jobs {
+		if !job.Finished && job.AgentName != "" {
+			runningJobs = append(runningJobs, job)
+		}
+	}
+	return runningJobs
+}
@@ -0,0 +1,35 @@
+package ci
+
+import (
+	"strings"
+)
+
+// OSDemand is the capability of the operating system of an agent, which jobs can demand, ex: Agent.OS -equals Windows_NT
+const OSDemand = "Agent.OS"
+
+// DemandedOS returns the operating system a job demands as its Kubernetes name, ex: windows for Windows_NT,
+// or an empty string if the job doesn't demand one
+func (j Job) DemandedOS() string {
+	for _, demand := range j.Demands {
+		fields := strings.Fields(demand)
+		if len(fields) != 3 || !strings.EqualFold(fields[0], OSDemand) || !strings.EqualFold(fields[1], "-equals") {
+			continue
+		}
+		if os := strings.ToLower(fields[2]); os != "windows_nt" {
+			return os
+		}
+		return "windows"
+	}
+	return ""
+}
+
+// DemandNames returns the lowercase names of the capabilities a job demands, ex: java for java -gtVersion 17
+func (j Job) DemandNames() []string {
+	names := make([]string, 0, len(j.Demands))
+	for _, demand := range j.Demands {
+		if fields := strings.Fields(demand); len(fields) > 0 {
+			names = append(names, strings.ToLower(fields[0]))
+		}
+	}
+	return names
+}
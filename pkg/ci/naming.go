@@ -0,0 +1,113 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// namePlaceholders are the placeholders of an agent name template and the regular expressions they match, the workload
+// placeholder matches the name of the workload
+var namePlaceholders = map[string]string{
+	"{{pod}}":     `(?P<pod>.+)`,
+	"{{ordinal}}": `(?P<ordinal>[0-9]+)`,
+}
+
+const workloadPlaceholder = "{{workload}}"
+
+// AgentNamePattern maps the names of the agents to the names of their pods, for agents that aren't named after their pod
+type AgentNamePattern struct {
+	// template is the pattern if it's a template, which depends on the workload
+	template string
+	// regexp is the pattern if it's a regular expression
+	regexp *regexp.Regexp
+}
+
+// ParseAgentNamePattern parses a template of the agent names, with the {{workload}}, {{ordinal}} and {{pod}} placeholders,
+// ex: {{workload}}-{{ordinal}} or ci-{{pod}}, or a regular expression with a pod or ordinal named group, ex:
+// ^(?P<pod>azp-agent-[a-z0-9]+)-[0-9]+$. An ordinal is the ordinal of a pod of a StatefulSet, named <workload>-<ordinal>.
+func ParseAgentNamePattern(pattern string) (AgentNamePattern, error) {
+	if strings.Contains(pattern, "{{") {
+		compiled, err := compileNameTemplate(pattern, "workload")
+		if err != nil {
+			return AgentNamePattern{}, err
+		}
+		if len(compiled.SubexpNames()) == 1 {
+			return AgentNamePattern{}, fmt.Errorf("The agent name template %s doesn't have a {{pod}} or {{ordinal}} placeholder", pattern)
+		}
+		return AgentNamePattern{template: pattern}, nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return AgentNamePattern{}, fmt.Errorf("The agent name pattern %s isn't a valid regular expression: %w", pattern, err)
+	}
+	if compiled.SubexpIndex("pod") < 0 && compiled.SubexpIndex("ordinal") < 0 {
+		return AgentNamePattern{}, fmt.Errorf("The agent name pattern %s doesn't have a pod or ordinal named group", pattern)
+	}
+	return AgentNamePattern{regexp: compiled}, nil
+}
+
+// IsSet returns true if the pattern maps the agent names to the pod names
+func (p AgentNamePattern) IsSet() bool {
+	return p.template != "" || p.regexp != nil
+}
+
+// PodNames returns the agents with the pod names of the agents whose name matches the pattern, for the pods of the
+// workload. The other agents keep the pod name reported by the CI system. The agents aren't modified.
+func (p AgentNamePattern) PodNames(agents []Agent, workload string) []Agent {
+	if !p.IsSet() {
+		return agents
+	}
+	compiled := p.regexp
+	if compiled == nil {
+		// The template was validated when it was parsed
+		compiled, _ = compileNameTemplate(p.template, workload)
+	}
+	podIndex, ordinalIndex := compiled.SubexpIndex("pod"), compiled.SubexpIndex("ordinal")
+	mapped := make([]Agent, len(agents))
+	for i, agent := range agents {
+		mapped[i] = agent
+		match := compiled.FindStringSubmatch(agent.Name)
+		if match == nil {
+			continue
+		}
+		if podIndex >= 0 && match[podIndex] != "" {
+			mapped[i].PodName = match[podIndex]
+		} else if ordinalIndex >= 0 && match[ordinalIndex] != "" {
+			mapped[i].PodName = fmt.Sprintf("%s-%s", workload, match[ordinalIndex])
+		}
+	}
+	return mapped
+}
+
+// compileNameTemplate compiles an agent name template of a workload to a regular expression matching the whole name
+func compileNameTemplate(template string, workload string) (*regexp.Regexp, error) {
+	var expression strings.Builder
+	expression.WriteString("^")
+	for rest := template; rest != ""; {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			expression.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		expression.WriteString(regexp.QuoteMeta(rest[:start]))
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("The agent name template %s has an unclosed placeholder", template)
+		}
+		placeholder := rest[start : start+end+2]
+		if placeholder == workloadPlaceholder {
+			expression.WriteString(regexp.QuoteMeta(workload))
+		} else if group, ok := namePlaceholders[placeholder]; ok {
+			if strings.Contains(expression.String(), group) {
+				return nil, fmt.Errorf("The agent name template %s has the %s placeholder more than once", template, placeholder)
+			}
+			expression.WriteString(group)
+		} else {
+			return nil, fmt.Errorf("The agent name template %s has the unknown placeholder %s, it can have {{workload}}, {{ordinal}} and {{pod}}", template, placeholder)
+		}
+		rest = rest[start+end+2:]
+	}
+	expression.WriteString("$")
+	return regexp.Compile(expression.String())
+}
@@ -0,0 +1,143 @@
+package cloudevents
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+const (
+	// SpecVersion is the version of the CloudEvents specification the events conform to
+	SpecVersion = "1.0"
+	// ContentType is the content type of events sent in the structured content mode
+	ContentType = "application/cloudevents+json"
+	// maxQueuedEvents limits the memory used while the sink is unreachable
+	maxQueuedEvents = 100
+)
+
+var logger = logging.Component("cloudevents")
+
+// Event is a CloudEvent in the structured JSON format
+type Event struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// publisher sends events to an HTTP sink in the order they were published
+type publisher struct {
+	sinkURL    string
+	source     string
+	httpClient *http.Client
+	events     chan Event
+	// pending tracks the queued events, so they can be flushed before the process exits
+	pending sync.WaitGroup
+}
+
+// client is nil unless Init is called
+var client *publisher
+
+// Init starts sending the published events to an HTTP sink, ex: a Knative broker or a Kafka HTTP bridge
+func Init(sinkURL string, source string) {
+	client = &publisher{
+		sinkURL:    sinkURL,
+		source:     source,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		events:     make(chan Event, maxQueuedEvents),
+	}
+	go client.run()
+}
+
+// Publish queues an event to be sent to the sink, if enabled.
+// Events are dropped if the sink can't keep up, so autoscaling is never blocked.
+func Publish(eventType string, subject string, data interface{}) {
+	if client == nil {
+		return
+	}
+	event := Event{
+		SpecVersion:     SpecVersion,
+		ID:              newID(),
+		Source:          client.source,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	client.pending.Add(1)
+	select {
+	case client.events <- event:
+	default:
+		client.pending.Done()
+		logger.Warnf("Dropping CloudEvent %s for %s - %d events are already queued", eventType, subject, maxQueuedEvents)
+	}
+}
+
+func (p *publisher) run() {
+	for event := range p.events {
+		if err := p.send(event); err != nil {
+			logger.Errorf("Error sending CloudEvent %s: %s", event.Type, err.Error())
+		}
+		p.pending.Done()
+	}
+}
+
+// Flush waits until the queued events are sent or the timeout passes.
+// This should be used before the process exits.
+func Flush(timeout time.Duration) {
+	if client == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		client.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warnf("Timed out sending %d queued CloudEvents after %s", len(client.events), timeout.String())
+	}
+}
+
+func (p *publisher) send(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", p.sinkURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", ContentType)
+	response, err := p.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%s returned HTTP %d", request.URL.Host, response.StatusCode)
+	}
+	return nil
+}
+
+// newID returns a random event ID
+func newID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
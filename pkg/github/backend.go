@@ -0,0 +1,333 @@
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+)
+
+const (
+	apiVersion = "2022-11-28"
+	perPage    = 100
+)
+
+// HTTPError is returned when the GitHub API responds with an error status
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err HTTPError) Error() string {
+	return fmt.Sprintf("GitHub responded with HTTP %d: %s", err.StatusCode, err.Message)
+}
+
+// Is matches ci.ErrUnauthorized if GitHub rejected the token, and ci.ErrThrottled if it's rate limiting the autoscaler
+func (err HTTPError) Is(target error) bool {
+	switch target {
+	case ci.ErrUnauthorized:
+		return err.StatusCode == http.StatusUnauthorized
+	case ci.ErrThrottled:
+		return err.StatusCode == http.StatusTooManyRequests
+	default:
+		return false
+	}
+}
+
+// IsAuthError returns true if an error is GitHub rejecting the token
+func IsAuthError(err error) bool {
+	return errors.Is(err, ci.ErrUnauthorized)
+}
+
+// Backend is the GitHub Actions CI backend. The pools are the runner groups of the organization,
+// and the agents are its self-hosted runners, whose names must be the names of their pods.
+type Backend struct {
+	args       args.GitHubArgs
+	labels     collections.StringSet
+	httpClient *http.Client
+}
+
+// NewBackend returns the GitHub Actions CI backend of an organization
+func NewBackend(githubArgs args.GitHubArgs) ci.Backend {
+	labels := make(collections.StringSet)
+	for _, label := range githubArgs.Labels {
+		labels.Add(strings.ToLower(label))
+	}
+	return &Backend{
+		args:       githubArgs,
+		labels:     labels,
+		httpClient: &http.Client{Timeout: githubArgs.Timeout},
+	}
+}
+
+type runnerGroup struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type runner struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Busy   bool   `json:"busy"`
+}
+
+type workflowRun struct {
+	ID int64 `json:"id"`
+}
+
+// pendingDeployment is a deployment of a waiting workflow run to an environment with protection rules
+type pendingDeployment struct {
+	// WaitTimer is the number of minutes the deployment is delayed
+	WaitTimer          int        `json:"wait_timer"`
+	WaitTimerStartedAt *time.Time `json:"wait_timer_started_at"`
+	Reviewers          []struct {
+		Type string `json:"type"`
+	} `json:"reviewers"`
+}
+
+type workflowJob struct {
+	Status        string     `json:"status"`
+	Conclusion    string     `json:"conclusion"`
+	Labels        []string   `json:"labels"`
+	RunnerName    string     `json:"runner_name"`
+	RunnerGroupID *int       `json:"runner_group_id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     time.Time  `json:"started_at"`
+	CompletedAt   *time.Time `json:"completed_at"`
+}
+
+// Pools returns the runner groups of the organization, or only the runner group with the name if it is set
+func (b *Backend) Pools(name string) ([]ci.Pool, error) {
+	var groups []runnerGroup
+	if err := b.list(fmt.Sprintf("/orgs/%s/actions/runner-groups", url.PathEscape(b.args.Organization)), nil, "runner_groups", &groups); err != nil {
+		return nil, err
+	}
+	var pools []ci.Pool
+	for _, group := range groups {
+		if name == "" || group.Name == name {
+			pools = append(pools, ci.Pool{ID: group.ID, Name: group.Name})
+		}
+	}
+	return pools, nil
+}
+
+// Agents returns the runners of a runner group. GitHub doesn't return when a runner last finished a job.
+func (b *Backend) Agents(poolID int) ([]ci.Agent, error) {
+	var runners []runner
+	if err := b.list(fmt.Sprintf("/orgs/%s/actions/runner-groups/%d/runners", url.PathEscape(b.args.Organization), poolID), nil, "runners", &runners); err != nil {
+		return nil, err
+	}
+	agents := make([]ci.Agent, 0, len(runners))
+	for _, runner := range runners {
+		agents = append(agents, ci.Agent{
+			ID:      runner.ID,
+			Name:    runner.Name,
+			PodName: runner.Name,
+			Status:  runner.Status,
+			Online:  strings.EqualFold(runner.Status, "online"),
+			// GitHub runners can't be disabled
+			Enabled: true,
+			Busy:    runner.Busy,
+		})
+	}
+	return agents, nil
+}
+
+// Jobs returns the jobs of the queued, waiting and in progress workflow runs of the repositories. Queued jobs are returned if
+// the runners have all of their labels, as GitHub only assigns them a runner group once a runner picks them up.
+// Running and completed jobs are returned if they ran in the runner group. The jobs waiting for the protection rules of an
+// environment are gated if it has reviewers, otherwise they're delayed by its wait timer.
+func (b *Backend) Jobs(poolID int) ([]ci.Job, error) {
+	var jobs []ci.Job
+	for _, repository := range b.args.Repositories {
+		repositoryPath := fmt.Sprintf("/repos/%s/%s/actions/runs", url.PathEscape(b.args.Organization), url.PathEscape(repository))
+		runIDs := make(map[int64]bool)
+		for _, status := range []string{"queued", "waiting", "in_progress"} {
+			var runs []workflowRun
+			if err := b.list(repositoryPath, url.Values{"status": {status}}, "workflow_runs", &runs); err != nil {
+				return nil, err
+			}
+			for _, run := range runs {
+				runIDs[run.ID] = true
+			}
+		}
+
+		for runID := range runIDs {
+			var workflowJobs []workflowJob
+			if err := b.list(fmt.Sprintf("%s/%d/jobs", repositoryPath, runID), nil, "jobs", &workflowJobs); err != nil {
+				return nil, err
+			}
+			var deployments []pendingDeployment
+			deploymentsRetrieved := false
+			for _, workflowJob := range workflowJobs {
+				job, inPool := b.job(workflowJob, poolID)
+				if !inPool {
+					continue
+				}
+				if workflowJob.Status == "waiting" {
+					if !deploymentsRetrieved {
+						if err := b.do(http.MethodGet, fmt.Sprintf("%s/%d/pending_deployments", repositoryPath, runID), &deployments); err != nil {
+							return nil, err
+						}
+						deploymentsRetrieved = true
+					}
+					setWaiting(&job, deployments)
+				}
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// job converts a workflow job, returning false if it isn't a job of the runner group
+func (b *Backend) job(workflowJob workflowJob, poolID int) (ci.Job, bool) {
+	job := ci.Job{
+		QueueTime:        workflowJob.CreatedAt,
+		StartTime:        workflowJob.StartedAt,
+		Finished:         workflowJob.Status == "completed",
+		Failed:           workflowJob.Conclusion == "failure",
+		AgentName:        workflowJob.RunnerName,
+		MatchesAllAgents: true,
+	}
+	if workflowJob.CompletedAt != nil {
+		job.FinishTime = *workflowJob.CompletedAt
+	}
+	if workflowJob.RunnerGroupID != nil {
+		return job, *workflowJob.RunnerGroupID == poolID
+	}
+	if job.Finished || job.AgentName != "" {
+		return job, false
+	}
+	for _, label := range workflowJob.Labels {
+		if !b.labels.Contains(strings.ToLower(label)) {
+			return job, false
+		}
+	}
+	return job, len(workflowJob.Labels) > 0
+}
+
+// setWaiting sets a waiting job as gated if a pending deployment of its run needs a review,
+// otherwise as delayed until the last wait timer of the pending deployments ends
+func setWaiting(job *ci.Job, deployments []pendingDeployment) {
+	for _, deployment := range deployments {
+		if len(deployment.Reviewers) > 0 {
+			job.Gated = true
+			return
+		}
+	}
+	job.Delayed = true
+	for _, deployment := range deployments {
+		if deployment.WaitTimer > 0 && deployment.WaitTimerStartedAt != nil {
+			releaseTime := deployment.WaitTimerStartedAt.Add(time.Duration(deployment.WaitTimer) * time.Minute)
+			if releaseTime.After(job.ReleaseTime) {
+				job.ReleaseTime = releaseTime
+			}
+		}
+	}
+}
+
+// Drain returns ci.ErrNotSupported, as GitHub runners can't be stopped from being assigned jobs
+func (b *Backend) Drain(poolID int, agent ci.Agent) error {
+	return ci.ErrNotSupported
+}
+
+// Undrain returns ci.ErrNotSupported, as GitHub runners can't be drained
+func (b *Backend) Undrain(poolID int, agent ci.Agent) error {
+	return ci.ErrNotSupported
+}
+
+// SetCapabilities returns ci.ErrNotSupported, as GitHub runners have labels instead of capabilities
+func (b *Backend) SetCapabilities(poolID int, agent ci.Agent, capabilities map[string]string) error {
+	return ci.ErrNotSupported
+}
+
+// Remove deletes a runner from the organization
+func (b *Backend) Remove(poolID int, agent ci.Agent) error {
+	err := b.do(http.MethodDelete, fmt.Sprintf("/orgs/%s/actions/runners/%d", url.PathEscape(b.args.Organization), agent.ID), nil)
+	// The runner can have removed itself when its pod stopped
+	var httpError *HTTPError
+	if err != nil && !(errors.As(err, &httpError) && httpError.StatusCode == http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
+
+// list retrieves every page of a list endpoint and decodes the items of the key into items, which is a slice pointer
+func (b *Backend) list(path string, query url.Values, key string, items interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("per_page", strconv.Itoa(perPage))
+	var allItems []json.RawMessage
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		response := make(map[string]json.RawMessage)
+		if err := b.do(http.MethodGet, path+"?"+query.Encode(), &response); err != nil {
+			return err
+		}
+		var pageItems []json.RawMessage
+		if err := json.Unmarshal(response[key], &pageItems); err != nil {
+			return fmt.Errorf("Error - could not parse the %s of %s: %w", key, path, err)
+		}
+		allItems = append(allItems, pageItems...)
+		if len(pageItems) < perPage {
+			break
+		}
+	}
+	body, err := json.Marshal(allItems)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, items)
+}
+
+// do calls the GitHub API and decodes the JSON response into response if it isn't nil
+func (b *Backend) do(method string, path string, response interface{}) error {
+	request, err := http.NewRequest(method, strings.TrimSuffix(b.args.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	request.Header.Set("Authorization", "Bearer "+b.args.Token)
+	request.Header.Set("User-Agent", "go-azp-agent-autoscaler")
+	request.Header.Set("X-GitHub-Api-Version", apiVersion)
+
+	httpResponse, err := b.httpClient.Do(request)
+	if err != nil {
+		health.RecordFailedCall("github")
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		var errorResponse struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &errorResponse)
+		if health.IsRetryableStatus(httpResponse.StatusCode) {
+			health.RecordFailedCall("github")
+		}
+		return &HTTPError{StatusCode: httpResponse.StatusCode, Message: errorResponse.Message}
+	}
+	health.RecordAZDPoll()
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(body, response)
+}
@@ -0,0 +1,314 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+)
+
+const perPage = 100
+
+// HTTPError is returned when the GitLab API responds with an error status
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err HTTPError) Error() string {
+	return fmt.Sprintf("GitLab responded with HTTP %d: %s", err.StatusCode, err.Message)
+}
+
+// Is matches ci.ErrUnauthorized if GitLab rejected the token, and ci.ErrThrottled if it's rate limiting the autoscaler
+func (err HTTPError) Is(target error) bool {
+	switch target {
+	case ci.ErrUnauthorized:
+		return err.StatusCode == http.StatusUnauthorized
+	case ci.ErrThrottled:
+		return err.StatusCode == http.StatusTooManyRequests
+	default:
+		return false
+	}
+}
+
+// IsAuthError returns true if an error is GitLab rejecting the token
+func IsAuthError(err error) bool {
+	return errors.Is(err, ci.ErrUnauthorized)
+}
+
+// Backend is the GitLab runner CI backend. The pools are the tags of the runners of each workload,
+// and the agents are the runners of the group with the tags, whose descriptions must be the names of their pods.
+type Backend struct {
+	args       args.GitLabArgs
+	pools      []pool
+	httpClient *http.Client
+}
+
+// pool is the tags of the runners of a workload
+type pool struct {
+	ci.Pool
+	tags collections.StringSet
+	// tagList is the sorted, comma-separated tags
+	tagList string
+}
+
+// NewBackend returns the GitLab runner CI backend of a group
+func NewBackend(gitlabArgs args.GitLabArgs) ci.Backend {
+	pools := make([]pool, 0, len(gitlabArgs.RunnerTags))
+	for _, runnerTags := range gitlabArgs.RunnerTags {
+		tags := make(collections.StringSet)
+		for _, tag := range strings.Split(runnerTags, ",") {
+			if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+				tags.Add(tag)
+			}
+		}
+		tagList := sortedTagList(tags)
+		hash := fnv.New32a()
+		hash.Write([]byte(tagList))
+		// The ID is a hash of the tags, so it doesn't change when the config is reloaded
+		pools = append(pools, pool{Pool: ci.Pool{ID: int(hash.Sum32() & 0x7fffffff), Name: runnerTags}, tags: tags, tagList: tagList})
+	}
+	return &Backend{
+		args:       gitlabArgs,
+		pools:      pools,
+		httpClient: &http.Client{Timeout: gitlabArgs.Timeout},
+	}
+}
+
+func sortedTagList(tags collections.StringSet) string {
+	sortedTags := make([]string, 0, len(tags))
+	for tag := range tags {
+		sortedTags = append(sortedTags, tag)
+	}
+	sort.Strings(sortedTags)
+	return strings.Join(sortedTags, ",")
+}
+
+type runner struct {
+	ID          int    `json:"id"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	Online      bool   `json:"online"`
+	Paused      bool   `json:"paused"`
+}
+
+type job struct {
+	Status     string     `json:"status"`
+	TagList    []string   `json:"tag_list"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Runner     *runner    `json:"runner"`
+}
+
+// Pools returns the configured runner tags, or only the runner tags with the name if it is set
+func (b *Backend) Pools(name string) ([]ci.Pool, error) {
+	var pools []ci.Pool
+	for _, pool := range b.pools {
+		if name == "" || pool.Name == name {
+			pools = append(pools, pool.Pool)
+		}
+	}
+	return pools, nil
+}
+
+// pool returns the runner tags of a pool ID
+func (b *Backend) pool(poolID int) (pool, error) {
+	for _, pool := range b.pools {
+		if pool.ID == poolID {
+			return pool, nil
+		}
+	}
+	return pool{}, fmt.Errorf("Error - could not find runner tags with pool ID %d", poolID)
+}
+
+// Agents returns the runners of the group that have all of the tags of a pool.
+// GitLab doesn't return when a runner last finished a job.
+func (b *Backend) Agents(poolID int) ([]ci.Agent, error) {
+	pool, err := b.pool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	var runners []runner
+	query := url.Values{"tag_list": {pool.tagList}}
+	if err := b.list(fmt.Sprintf("/groups/%s/runners", url.PathEscape(b.args.Group)), query, &runners); err != nil {
+		return nil, err
+	}
+	agents := make([]ci.Agent, 0, len(runners))
+	for _, runner := range runners {
+		// The runner list doesn't include the running jobs
+		var runningJobs []job
+		if err := b.do(http.MethodGet, fmt.Sprintf("/runners/%d/jobs?status=running&per_page=1", runner.ID), nil, &runningJobs); err != nil {
+			return nil, err
+		}
+		agents = append(agents, ci.Agent{
+			ID:      runner.ID,
+			Name:    runner.Description,
+			PodName: runner.Description,
+			Status:  runner.Status,
+			Online:  runner.Online,
+			Enabled: !runner.Paused,
+			Busy:    len(runningJobs) > 0,
+		})
+	}
+	return agents, nil
+}
+
+// Jobs returns the pending, scheduled and running jobs of the projects that the runners of a pool can run,
+// which are the jobs whose tags are all tags of the pool. Untagged jobs aren't returned.
+// Scheduled jobs are delayed jobs whose delay hasn't ended, GitLab doesn't return when it ends.
+func (b *Backend) Jobs(poolID int) ([]ci.Job, error) {
+	pool, err := b.pool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []ci.Job
+	for _, project := range b.args.Projects {
+		var projectJobs []job
+		query := url.Values{"scope[]": {"pending", "scheduled", "running"}}
+		if err := b.list(fmt.Sprintf("/projects/%s/jobs", url.PathEscape(project)), query, &projectJobs); err != nil {
+			return nil, err
+		}
+		for _, projectJob := range projectJobs {
+			if !pool.runs(projectJob) {
+				continue
+			}
+			ciJob := ci.Job{
+				QueueTime:        projectJob.CreatedAt,
+				Finished:         projectJob.Status != "pending" && projectJob.Status != "scheduled" && projectJob.Status != "running",
+				Failed:           projectJob.Status == "failed",
+				Delayed:          projectJob.Status == "scheduled",
+				MatchesAllAgents: true,
+			}
+			if projectJob.StartedAt != nil {
+				ciJob.StartTime = *projectJob.StartedAt
+			}
+			if projectJob.FinishedAt != nil {
+				ciJob.FinishTime = *projectJob.FinishedAt
+			}
+			if projectJob.Runner != nil {
+				ciJob.AgentName = projectJob.Runner.Description
+			}
+			jobs = append(jobs, ciJob)
+		}
+	}
+	return jobs, nil
+}
+
+// runs returns true if the runners of the pool can run a job
+func (p pool) runs(job job) bool {
+	for _, tag := range job.TagList {
+		if !p.tags.Contains(strings.ToLower(tag)) {
+			return false
+		}
+	}
+	return len(job.TagList) > 0
+}
+
+// Drain pauses a runner, so it isn't assigned new jobs
+func (b *Backend) Drain(poolID int, agent ci.Agent) error {
+	return b.do(http.MethodPut, fmt.Sprintf("/runners/%d", agent.ID), url.Values{"paused": {"true"}}, nil)
+}
+
+// Undrain resumes a paused runner, so it's assigned new jobs again
+func (b *Backend) Undrain(poolID int, agent ci.Agent) error {
+	return b.do(http.MethodPut, fmt.Sprintf("/runners/%d", agent.ID), url.Values{"paused": {"false"}}, nil)
+}
+
+// SetCapabilities returns ci.ErrNotSupported, as GitLab runners have tags instead of capabilities
+func (b *Backend) SetCapabilities(poolID int, agent ci.Agent, capabilities map[string]string) error {
+	return ci.ErrNotSupported
+}
+
+// Remove deletes a runner
+func (b *Backend) Remove(poolID int, agent ci.Agent) error {
+	err := b.do(http.MethodDelete, fmt.Sprintf("/runners/%d", agent.ID), nil, nil)
+	// The runner can have unregistered itself when its pod stopped
+	var httpError *HTTPError
+	if err != nil && !(errors.As(err, &httpError) && httpError.StatusCode == http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
+
+// list retrieves every page of a list endpoint and decodes them into items, which is a slice pointer
+func (b *Backend) list(path string, query url.Values, items interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("per_page", strconv.Itoa(perPage))
+	var allItems []json.RawMessage
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		var pageItems []json.RawMessage
+		if err := b.do(http.MethodGet, path+"?"+query.Encode(), nil, &pageItems); err != nil {
+			return err
+		}
+		allItems = append(allItems, pageItems...)
+		if len(pageItems) < perPage {
+			break
+		}
+	}
+	body, err := json.Marshal(allItems)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, items)
+}
+
+// do calls the GitLab API with the form values if they aren't nil, and decodes the JSON response into response if it isn't nil
+func (b *Backend) do(method string, path string, form url.Values, response interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	request, err := http.NewRequest(method, strings.TrimSuffix(b.args.URL, "/")+"/api/v4"+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	request.Header.Set("PRIVATE-TOKEN", b.args.Token)
+	request.Header.Set("User-Agent", "go-azp-agent-autoscaler")
+
+	httpResponse, err := b.httpClient.Do(request)
+	if err != nil {
+		health.RecordFailedCall("gitlab")
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		var errorResponse struct {
+			Message interface{} `json:"message"`
+		}
+		json.Unmarshal(responseBody, &errorResponse)
+		if health.IsRetryableStatus(httpResponse.StatusCode) {
+			health.RecordFailedCall("gitlab")
+		}
+		return &HTTPError{StatusCode: httpResponse.StatusCode, Message: fmt.Sprint(errorResponse.Message)}
+	}
+	health.RecordAZDPoll()
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, response)
+}
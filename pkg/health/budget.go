@@ -0,0 +1,117 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	failedCallCounts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_failed_call_count",
+		Help: "The total number of failed calls to the CI backend and Kubernetes that spent the retry budget",
+	}, []string{"dependency"})
+	retryBudgetExhaustedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_retry_budget_exhausted",
+		Help: "1 while the retry budget is exhausted and the autoscaling is skipped, otherwise 0",
+	})
+	retryBudgetSkipCounts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_retry_budget_skip_count",
+		Help: "The total number of autoscaling iterations and agent pools skipped because the retry budget was exhausted",
+	})
+
+	budgetLock   sync.Mutex
+	budgetCalls  int
+	budgetWindow time.Duration
+	failedCalls  []failedCall
+)
+
+// failedCall is a failed call to a dependency that spent the retry budget
+type failedCall struct {
+	time       time.Time
+	dependency string
+}
+
+// RetryBudgetError is returned when the failed calls to the dependencies within the window exhausted the retry budget
+type RetryBudgetError struct {
+	// FailedCalls are the number of failed calls within the window by dependency
+	FailedCalls map[string]int
+	Window      time.Duration
+}
+
+func (e RetryBudgetError) Error() string {
+	var dependencies []string
+	for dependency := range e.FailedCalls {
+		dependencies = append(dependencies, dependency)
+	}
+	sort.Strings(dependencies)
+	calls := make([]string, len(dependencies))
+	for i, dependency := range dependencies {
+		calls[i] = fmt.Sprintf("%d to %s", e.FailedCalls[dependency], dependency)
+	}
+	return fmt.Sprintf("The retry budget is exhausted by the failed calls in the last %s: %s", e.Window.String(), strings.Join(calls, ", "))
+}
+
+// SetRetryBudget sets how many failed calls to the dependencies are allowed within the window before the autoscaling is
+// skipped, and forgets the previous failed calls. The retry budget is disabled if calls is 0.
+func SetRetryBudget(calls int, window time.Duration) {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	budgetCalls, budgetWindow = calls, window
+	failedCalls = nil
+	retryBudgetExhaustedGauge.Set(0)
+}
+
+// RecordFailedCall records a failed call to a dependency that will be retried, which spends the retry budget shared by
+// every dependency, so an outage of several dependencies at once doesn't multiply the retries
+func RecordFailedCall(dependency string) {
+	failedCallCounts.With(prometheus.Labels{"dependency": dependency}).Inc()
+
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	if budgetCalls <= 0 {
+		return
+	}
+	failedCalls = append(failedCalls, failedCall{time: time.Now(), dependency: dependency})
+	// Only the failed calls needed to tell if the budget is exhausted are kept
+	if len(failedCalls) > budgetCalls {
+		failedCalls = failedCalls[len(failedCalls)-budgetCalls:]
+	}
+}
+
+// IsRetryableStatus returns true if an HTTP status code is a failure that's retried, which spends the retry budget
+func IsRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// CheckRetryBudget returns a RetryBudgetError if the failed calls within the window exhausted the retry budget, in which
+// case the autoscaling should be skipped until the oldest of them is out of the window
+func CheckRetryBudget() error {
+	budgetLock.Lock()
+	defer budgetLock.Unlock()
+	if budgetCalls <= 0 {
+		return nil
+	}
+	since := time.Now().Add(-budgetWindow)
+	for len(failedCalls) > 0 && failedCalls[0].time.Before(since) {
+		failedCalls = failedCalls[1:]
+	}
+	if len(failedCalls) < budgetCalls {
+		retryBudgetExhaustedGauge.Set(0)
+		return nil
+	}
+
+	retryBudgetExhaustedGauge.Set(1)
+	retryBudgetSkipCounts.Inc()
+	err := RetryBudgetError{FailedCalls: make(map[string]int), Window: budgetWindow}
+	for _, call := range failedCalls {
+		err.FailedCalls[call.dependency]++
+	}
+	return err
+}
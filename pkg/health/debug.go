@@ -0,0 +1,17 @@
+package health
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// DebugHandler returns an HTTP Handler that serves the pprof profiles and goroutine dumps at /debug/pprof/
+func DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
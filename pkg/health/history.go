@@ -0,0 +1,147 @@
+package health
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// maxRecentDecisions is the number of scale operations and errors kept per workload for the dashboard
+	maxRecentDecisions = 50
+)
+
+// historySize is the number of decisions kept per workload, an hour at the default rate
+var historySize = 360
+
+// HistorySample is the queue depth and replicas of a workload at one scaling decision
+type HistorySample struct {
+	Time            time.Time `json:"time"`
+	Action          string    `json:"action"`
+	QueuedJobs      int32     `json:"queuedJobs"`
+	CurrentReplicas int32     `json:"currentReplicas"`
+	DesiredReplicas int32     `json:"desiredReplicas"`
+	ActiveAgents    int32     `json:"activeAgents"`
+	IdleAgents      int32     `json:"idleAgents"`
+}
+
+// WorkloadHistory is the recent history of a workload's scaling decisions
+type WorkloadHistory struct {
+	Namespace   string `json:"namespace"`
+	Workload    string `json:"workload"`
+	AgentPoolID int    `json:"poolId"`
+	// Samples are the queue depth and replicas of every decision, oldest first
+	Samples []HistorySample `json:"samples"`
+	// AgentStates are the number of agents in the pool by state at the last decision
+	AgentStates map[string]int `json:"agentStates"`
+	// RecentDecisions are the decisions that scaled the workload or failed, newest first
+	RecentDecisions []DecisionStatus `json:"recentDecisions"`
+}
+
+// histories are the histories of the workloads, with the recent decisions oldest first
+var histories = make(map[string]*WorkloadHistory)
+
+// SetHistorySize sets the number of decisions kept per workload
+func SetHistorySize(size int) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	historySize = size
+	for _, history := range histories {
+		history.trim()
+	}
+}
+
+// recordHistory adds a decision to the history of its workload. The status lock must be held.
+func recordHistory(key string, decision DecisionStatus) {
+	history, exists := histories[key]
+	if !exists {
+		history = &WorkloadHistory{}
+		histories[key] = history
+	}
+	history.Namespace = decision.Namespace
+	history.Workload = decision.Workload
+	history.AgentPoolID = decision.AgentPoolID
+	history.AgentStates = decision.AgentStates
+
+	history.Samples = append(history.Samples, HistorySample{
+		Time:            decision.Time,
+		Action:          decision.Action,
+		QueuedJobs:      decision.QueuedJobs,
+		CurrentReplicas: decision.CurrentReplicas,
+		DesiredReplicas: decision.DesiredReplicas,
+		ActiveAgents:    decision.ActiveAgents,
+		IdleAgents:      decision.IdleAgents,
+	})
+	if decision.Action != "none" || decision.Error != "" {
+		history.RecentDecisions = append(history.RecentDecisions, decision)
+	}
+	history.trim()
+}
+
+// recordFailureHistory adds a failed cycle to the recent decisions of its workload. The status lock must be held.
+func recordFailureHistory(key string, decision DecisionStatus) {
+	history, exists := histories[key]
+	if !exists {
+		history = &WorkloadHistory{Namespace: decision.Namespace, Workload: decision.Workload, AgentPoolID: decision.AgentPoolID}
+		histories[key] = history
+	}
+	history.RecentDecisions = append(history.RecentDecisions, decision)
+	history.trim()
+}
+
+// trim removes the oldest samples and decisions over the limits
+func (h *WorkloadHistory) trim() {
+	if len(h.Samples) > historySize {
+		h.Samples = h.Samples[len(h.Samples)-historySize:]
+	}
+	if len(h.RecentDecisions) > maxRecentDecisions {
+		h.RecentDecisions = h.RecentDecisions[len(h.RecentDecisions)-maxRecentDecisions:]
+	}
+}
+
+// GetHistory returns the recent history of every workload's scaling decisions
+func GetHistory() []WorkloadHistory {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	result := []WorkloadHistory{}
+	for _, history := range histories {
+		workloadHistory := *history
+		workloadHistory.Samples = append([]HistorySample{}, history.Samples...)
+		if workloadHistory.AgentStates == nil {
+			workloadHistory.AgentStates = map[string]int{}
+		}
+		workloadHistory.RecentDecisions = make([]DecisionStatus, len(history.RecentDecisions))
+		for i, decision := range history.RecentDecisions {
+			workloadHistory.RecentDecisions[len(history.RecentDecisions)-1-i] = decision
+		}
+		result = append(result, workloadHistory)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Namespace+"/"+result[i].Workload < result[j].Namespace+"/"+result[j].Workload
+	})
+	return result
+}
+
+// RestoreHistory restores the histories returned by GetHistory, ex: after a restart.
+// The decisions recorded since the autoscaler started are kept after the restored ones.
+func RestoreHistory(restored []WorkloadHistory) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	for _, workloadHistory := range restored {
+		key := workloadHistory.Namespace + "/" + workloadHistory.Workload
+		history := &WorkloadHistory{}
+		*history = workloadHistory
+		history.RecentDecisions = make([]DecisionStatus, len(workloadHistory.RecentDecisions))
+		for i, decision := range workloadHistory.RecentDecisions {
+			history.RecentDecisions[len(workloadHistory.RecentDecisions)-1-i] = decision
+		}
+		if current, exists := histories[key]; exists {
+			history.AgentPoolID = current.AgentPoolID
+			history.AgentStates = current.AgentStates
+			history.Samples = append(history.Samples, current.Samples...)
+			history.RecentDecisions = append(history.RecentDecisions, current.RecentDecisions...)
+		}
+		history.trim()
+		histories[key] = history
+	}
+}
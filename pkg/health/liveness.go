@@ -9,6 +9,8 @@ import (
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
 )
 
+var logger = logging.Component("health")
+
 var (
 	livenessProbeCounter = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "azp_agent_autoscaler_liveness_probe_count",
@@ -21,7 +23,7 @@ type LivenessCheck struct {
 }
 
 func (c LivenessCheck) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	logging.Logger.Trace("Liveness probe")
+	logger.Trace("Liveness probe")
 
 	livenessProbeCounter.Inc()
 
@@ -0,0 +1,43 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ReadinessCheck is an HTTP Handler that is ready once the autoscaler is initialized
+// and has recently reached Azure Devops and Kubernetes
+type ReadinessCheck struct {
+	// MaxStaleness is how long ago the last successful Azure Devops and Kubernetes calls can be
+	MaxStaleness time.Duration
+	// InitializedOnly doesn't check when Azure Devops and Kubernetes were last reached,
+	// for when they're only called on request, ex: by KEDA
+	InitializedOnly bool
+}
+
+func (c ReadinessCheck) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	logger.Trace("Readiness probe")
+
+	status := GetStatus()
+	var notReadyReason string
+	if !status.Ready {
+		notReadyReason = "not initialized"
+	} else if !c.InitializedOnly && (status.LastAZDPoll == nil || time.Since(*status.LastAZDPoll) > c.MaxStaleness) {
+		notReadyReason = fmt.Sprintf("Azure Devops has not been reached in %s", c.MaxStaleness.String())
+	} else if !c.InitializedOnly && (status.LastK8sContact == nil || time.Since(*status.LastK8sContact) > c.MaxStaleness) {
+		notReadyReason = fmt.Sprintf("Kubernetes has not been reached in %s", c.MaxStaleness.String())
+	} else if len(status.OpenCircuitBreakers) > 0 {
+		notReadyReason = fmt.Sprintf("circuit breakers are open: %v", status.OpenCircuitBreakers)
+	}
+
+	if notReadyReason != "" {
+		logger.Debugf("Readiness probe failed: %s", notReadyReason)
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		writer.Write([]byte(notReadyReason))
+		return
+	}
+
+	writer.WriteHeader(200)
+	writer.Write([]byte("OK"))
+}
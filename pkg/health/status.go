@@ -0,0 +1,163 @@
+package health
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/version"
+)
+
+// DecisionStatus is the last scaling decision of a workload
+type DecisionStatus struct {
+	Time            time.Time `json:"time"`
+	Namespace       string    `json:"namespace"`
+	Workload        string    `json:"workload"`
+	AgentPoolID     int       `json:"poolId"`
+	CurrentReplicas int32     `json:"currentReplicas"`
+	DesiredReplicas int32     `json:"desiredReplicas"`
+	Action          string    `json:"action"`
+	Reason          string    `json:"reason"`
+	Suppressors     []string  `json:"suppressors,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	// Rollout describes how an update of the pod template is rolled out to the pods, if there's one
+	Rollout string `json:"rollout,omitempty"`
+
+	QueuedJobs   int32 `json:"queuedJobs"`
+	ActiveAgents int32 `json:"activeAgents"`
+	IdleAgents   int32 `json:"idleAgents"`
+	// AgentStates are the number of agents in the pool by state: busy, idle, offline or disabled
+	AgentStates map[string]int `json:"agentStates,omitempty"`
+}
+
+// Status is the current status of the autoscaler
+type Status struct {
+	Ready bool `json:"ready"`
+	// Build is the version the autoscaler was built as
+	Build version.Info `json:"build"`
+	// LastAZDPoll is the last successful call to Azure Devops
+	LastAZDPoll *time.Time `json:"lastAzdPoll"`
+	// LastK8sContact is the last successful call to Kubernetes
+	LastK8sContact *time.Time `json:"lastK8sContact"`
+	// Decisions are the last scaling decision of each workload
+	Decisions []DecisionStatus `json:"decisions"`
+	// OpenCircuitBreakers are the dependencies currently not being called after repeated errors
+	OpenCircuitBreakers []string `json:"openCircuitBreakers"`
+	// Degraded is the last error while the autoscaler is retrying after errors
+	Degraded string `json:"degraded,omitempty"`
+}
+
+var (
+	statusLock      sync.RWMutex
+	ready           bool
+	lastAZDPoll     time.Time
+	lastK8sContact  time.Time
+	decisions       = make(map[string]DecisionStatus)
+	circuitBreakers = make(map[string]bool)
+	degraded        string
+)
+
+// SetReady marks the autoscaler as ready once it has been initialized
+func SetReady() {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	ready = true
+}
+
+// RecordAZDPoll records a successful call to Azure Devops
+func RecordAZDPoll() {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	lastAZDPoll = time.Now()
+}
+
+// RecordK8sContact records a successful call to Kubernetes
+func RecordK8sContact() {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	lastK8sContact = time.Now()
+}
+
+// RecordDecision records the last scaling decision of a workload, and adds it to the workload's history.
+// The credentials of its error and reason are redacted.
+func RecordDecision(decision DecisionStatus) {
+	decision.Reason = logging.Redact(decision.Reason)
+	decision.Error = logging.Redact(decision.Error)
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	key := decision.Namespace + "/" + decision.Workload
+	decisions[key] = decision
+	recordHistory(key, decision)
+}
+
+// RecordFailure records a cycle of a workload that failed before a scaling decision was made. The replicas its last
+// decision scaled to and its agents are kept, and the failure is added to the recent decisions of its history, but not
+// as a sample. The credentials of its error are redacted.
+func RecordFailure(decision DecisionStatus) {
+	decision.Error = logging.Redact(decision.Error)
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	key := decision.Namespace + "/" + decision.Workload
+	if last, exists := decisions[key]; exists {
+		decision.CurrentReplicas = last.CurrentReplicas
+		if last.Error == "" {
+			decision.CurrentReplicas = last.DesiredReplicas
+		}
+		decision.DesiredReplicas = decision.CurrentReplicas
+		decision.AgentStates = last.AgentStates
+	}
+	decisions[key] = decision
+	recordFailureHistory(key, decision)
+}
+
+// SetCircuitBreaker records if the circuit breaker of a dependency is open
+func SetCircuitBreaker(name string, open bool) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	if open {
+		circuitBreakers[name] = true
+	} else {
+		delete(circuitBreakers, name)
+	}
+}
+
+// SetDegraded records the last error while the autoscaler is retrying after errors, or that it recovered if empty
+func SetDegraded(reason string) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	degraded = logging.Redact(reason)
+}
+
+// GetStatus returns the current status of the autoscaler
+func GetStatus() Status {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	status := Status{
+		Ready:               ready,
+		Build:               version.Get(),
+		Decisions:           []DecisionStatus{},
+		OpenCircuitBreakers: []string{},
+		Degraded:            degraded,
+	}
+	if !lastAZDPoll.IsZero() {
+		t := lastAZDPoll
+		status.LastAZDPoll = &t
+	}
+	if !lastK8sContact.IsZero() {
+		t := lastK8sContact
+		status.LastK8sContact = &t
+	}
+	for _, decision := range decisions {
+		status.Decisions = append(status.Decisions, decision)
+	}
+	sort.Slice(status.Decisions, func(i, j int) bool {
+		return status.Decisions[i].Namespace+"/"+status.Decisions[i].Workload < status.Decisions[j].Namespace+"/"+status.Decisions[j].Workload
+	})
+	for name := range circuitBreakers {
+		status.OpenCircuitBreakers = append(status.OpenCircuitBreakers, name)
+	}
+	sort.Strings(status.OpenCircuitBreakers)
+	return status
+}
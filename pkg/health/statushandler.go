@@ -0,0 +1,18 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// StatusHandler is an HTTP Handler that returns the Status as JSON
+type StatusHandler struct {
+}
+
+func (h StatusHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(200)
+	if err := json.NewEncoder(writer).Encode(GetStatus()); err != nil {
+		logger.Errorf("Error writing the status: %s", err.Error())
+	}
+}
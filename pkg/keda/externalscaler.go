@@ -0,0 +1,78 @@
+package keda
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// The messages of KEDA's external scaler API, package externalscaler.
+// Ref: https://github.com/kedacore/keda/blob/main/pkg/scalers/externalscaler/externalscaler.proto
+
+// ScaledObjectRef is the ScaledObject a request is for, with the metadata of its external trigger
+type ScaledObjectRef struct {
+	Name           string            `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Namespace      string            `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	ScalerMetadata map[string]string `protobuf:"bytes,3,rep,name=scalerMetadata,proto3" json:"scalerMetadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *ScaledObjectRef) Reset()         { *m = ScaledObjectRef{} }
+func (m *ScaledObjectRef) String() string { return proto.CompactTextString(m) }
+func (*ScaledObjectRef) ProtoMessage()    {}
+
+// IsActiveResponse is whether a ScaledObject should be scaled up from zero
+type IsActiveResponse struct {
+	Result bool `protobuf:"varint,1,opt,name=result,proto3" json:"result,omitempty"`
+}
+
+func (m *IsActiveResponse) Reset()         { *m = IsActiveResponse{} }
+func (m *IsActiveResponse) String() string { return proto.CompactTextString(m) }
+func (*IsActiveResponse) ProtoMessage()    {}
+
+// GetMetricSpecResponse is the metrics a ScaledObject is scaled on
+type GetMetricSpecResponse struct {
+	MetricSpecs []*MetricSpec `protobuf:"bytes,1,rep,name=metricSpecs,proto3" json:"metricSpecs,omitempty"`
+}
+
+func (m *GetMetricSpecResponse) Reset()         { *m = GetMetricSpecResponse{} }
+func (m *GetMetricSpecResponse) String() string { return proto.CompactTextString(m) }
+func (*GetMetricSpecResponse) ProtoMessage()    {}
+
+// MetricSpec is a metric and its target value per replica
+type MetricSpec struct {
+	MetricName      string  `protobuf:"bytes,1,opt,name=metricName,proto3" json:"metricName,omitempty"`
+	TargetSize      int64   `protobuf:"varint,2,opt,name=targetSize,proto3" json:"targetSize,omitempty"`
+	TargetSizeFloat float64 `protobuf:"fixed64,3,opt,name=targetSizeFloat,proto3" json:"targetSizeFloat,omitempty"`
+}
+
+func (m *MetricSpec) Reset()         { *m = MetricSpec{} }
+func (m *MetricSpec) String() string { return proto.CompactTextString(m) }
+func (*MetricSpec) ProtoMessage()    {}
+
+// GetMetricsRequest requests the value of a metric of a ScaledObject
+type GetMetricsRequest struct {
+	ScaledObjectRef *ScaledObjectRef `protobuf:"bytes,1,opt,name=scaledObjectRef,proto3" json:"scaledObjectRef,omitempty"`
+	MetricName      string           `protobuf:"bytes,2,opt,name=metricName,proto3" json:"metricName,omitempty"`
+}
+
+func (m *GetMetricsRequest) Reset()         { *m = GetMetricsRequest{} }
+func (m *GetMetricsRequest) String() string { return proto.CompactTextString(m) }
+func (*GetMetricsRequest) ProtoMessage()    {}
+
+// GetMetricsResponse is the values of the metrics of a ScaledObject
+type GetMetricsResponse struct {
+	MetricValues []*MetricValue `protobuf:"bytes,1,rep,name=metricValues,proto3" json:"metricValues,omitempty"`
+}
+
+func (m *GetMetricsResponse) Reset()         { *m = GetMetricsResponse{} }
+func (m *GetMetricsResponse) String() string { return proto.CompactTextString(m) }
+func (*GetMetricsResponse) ProtoMessage()    {}
+
+// MetricValue is the value of a metric
+type MetricValue struct {
+	MetricName       string  `protobuf:"bytes,1,opt,name=metricName,proto3" json:"metricName,omitempty"`
+	MetricValue      int64   `protobuf:"varint,2,opt,name=metricValue,proto3" json:"metricValue,omitempty"`
+	MetricValueFloat float64 `protobuf:"fixed64,3,opt,name=metricValueFloat,proto3" json:"metricValueFloat,omitempty"`
+}
+
+func (m *MetricValue) Reset()         { *m = MetricValue{} }
+func (m *MetricValue) String() string { return proto.CompactTextString(m) }
+func (*MetricValue) ProtoMessage()    {}
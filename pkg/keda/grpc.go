@@ -0,0 +1,139 @@
+package keda
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The gRPC status codes returned by the server
+// Ref: https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	codeOK              = 0
+	codeInvalidArgument = 3
+	codeNotFound        = 5
+	codeUnimplemented   = 12
+	codeInternal        = 13
+	codeUnavailable     = 14
+)
+
+// maxMessageSize is the maximum size of a request message
+const maxMessageSize = 1 << 20
+
+// statusError is an error with a gRPC status code
+type statusError struct {
+	code    int
+	message string
+}
+
+func (err statusError) Error() string {
+	return err.message
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return statusError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// grpcHandler serves a gRPC method over HTTP/2. The request message is read into request,
+// and call writes the response messages with send.
+// Ref: https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+func grpcHandler(newRequest func() proto.Message, call func(request proto.Message, send func(proto.Message) error, stop <-chan struct{}) error) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writer.Header().Set("Allow", http.MethodPost)
+			http.Error(writer, fmt.Sprintf("Method %s is not allowed", request.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if !strings.HasPrefix(request.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(writer, "The content type must be application/grpc", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/grpc")
+		writer.WriteHeader(http.StatusOK)
+
+		message := newRequest()
+		err := readMessage(request.Body, message)
+		if err == nil {
+			send := func(response proto.Message) error {
+				return writeMessage(writer, response)
+			}
+			err = call(message, send, request.Context().Done())
+		}
+		writeStatus(writer, err)
+	}
+}
+
+// readMessage reads a length-prefixed message
+func readMessage(body io.Reader, message proto.Message) error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return errorf(codeInvalidArgument, "Error reading the request message: %s", err.Error())
+	}
+	if header[0] != 0 {
+		return errorf(codeUnimplemented, "Compressed messages aren't supported")
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxMessageSize {
+		return errorf(codeInvalidArgument, "The request message is larger than %d bytes", maxMessageSize)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return errorf(codeInvalidArgument, "Error reading the request message: %s", err.Error())
+	}
+	if err := proto.Unmarshal(data, message); err != nil {
+		return errorf(codeInvalidArgument, "Error decoding the request message: %s", err.Error())
+	}
+	return nil
+}
+
+// writeMessage writes a length-prefixed message and flushes it, so streamed messages are sent immediately
+func writeMessage(writer http.ResponseWriter, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return errorf(codeInternal, "Error encoding the response message: %s", err.Error())
+	}
+	frame := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+	if _, err := writer.Write(frame); err != nil {
+		return errorf(codeUnavailable, "Error writing the response message: %s", err.Error())
+	}
+	if flusher, ok := writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// writeStatus writes the status of the call as trailers
+func writeStatus(writer http.ResponseWriter, err error) {
+	code, message := codeOK, ""
+	if err != nil {
+		code, message = codeInternal, err.Error()
+		if statusErr, ok := err.(statusError); ok {
+			code = statusErr.code
+		}
+	}
+	writer.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		writer.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeStatusMessage(message))
+	}
+}
+
+// encodeStatusMessage percent-encodes the status message, as required for the grpc-message trailer
+func encodeStatusMessage(message string) string {
+	var builder strings.Builder
+	for _, b := range []byte(message) {
+		if b >= ' ' && b <= '~' && b != '%' {
+			builder.WriteByte(b)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,186 @@
+package keda
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+var logger = logging.Component("keda")
+
+// servicePath is the path prefix of the methods of the ExternalScaler gRPC service
+const servicePath = "/externalscaler.ExternalScaler/"
+
+const (
+	// poolMetadata is the trigger metadata of the agent pool name, which is required
+	poolMetadata = "pool"
+	// statefulSetMetadata is the trigger metadata of the agents' StatefulSet. If it is set, only its agents are counted
+	// and scale downs keep its busy agents.
+	statefulSetMetadata = "statefulSet"
+)
+
+var invalidMetricNameChars = regexp.MustCompile("[^a-z0-9]+")
+
+// Scaler is a KEDA external scaler that exposes the number of agents an agent pool needs, so KEDA and a
+// HorizontalPodAutoscaler scale the agents instead of the autoscaler.
+// Ref: https://keda.sh/docs/latest/concepts/external-scalers/
+type Scaler struct {
+	lock    sync.RWMutex
+	backend ci.Backend
+	args    args.Args
+}
+
+// NewScaler creates an external scaler that retrieves the agent pools with the CI backend
+func NewScaler(backend ci.Backend, args args.Args) *Scaler {
+	return &Scaler{backend: backend, args: args}
+}
+
+// Set replaces the CI backend and the arguments when the config is reloaded
+func (s *Scaler) Set(backend ci.Backend, args args.Args) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.backend, s.args = backend, args
+}
+
+func (s *Scaler) get() (ci.Backend, args.Args) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.backend, s.args
+}
+
+// Handler returns the gRPC methods of the external scaler. KEDA connects to external scalers without TLS by default,
+// so HTTP/2 is also served in cleartext.
+func (s *Scaler) Handler() http.Handler {
+	newScaledObjectRef := func() proto.Message { return &ScaledObjectRef{} }
+	mux := http.NewServeMux()
+	mux.HandleFunc(servicePath+"IsActive", grpcHandler(newScaledObjectRef, unary(func(request proto.Message) (proto.Message, error) {
+		return s.IsActive(request.(*ScaledObjectRef))
+	})))
+	mux.HandleFunc(servicePath+"StreamIsActive", grpcHandler(newScaledObjectRef, s.streamIsActive))
+	mux.HandleFunc(servicePath+"GetMetricSpec", grpcHandler(newScaledObjectRef, unary(func(request proto.Message) (proto.Message, error) {
+		return s.GetMetricSpec(request.(*ScaledObjectRef))
+	})))
+	mux.HandleFunc(servicePath+"GetMetrics", grpcHandler(func() proto.Message { return &GetMetricsRequest{} }, unary(func(request proto.Message) (proto.Message, error) {
+		return s.GetMetrics(request.(*GetMetricsRequest))
+	})))
+	return h2c.NewHandler(mux, &http2.Server{})
+}
+
+// unary adapts a method with a single response message to a gRPC call
+func unary(method func(request proto.Message) (proto.Message, error)) func(proto.Message, func(proto.Message) error, <-chan struct{}) error {
+	return func(request proto.Message, send func(proto.Message) error, stop <-chan struct{}) error {
+		response, err := method(request)
+		if err != nil {
+			return err
+		}
+		return send(response)
+	}
+}
+
+// IsActive returns true if the agent pool has a busy agent or a queued job, so KEDA scales it up from zero
+func (s *Scaler) IsActive(ref *ScaledObjectRef) (*IsActiveResponse, error) {
+	demand, err := s.demand(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &IsActiveResponse{Result: demand.Agents() > 0}, nil
+}
+
+// streamIsActive sends whether the agent pool is active when it changes, checking it at the autoscaling rate,
+// so KEDA scales up from zero as soon as a job is queued instead of at its polling interval
+func (s *Scaler) streamIsActive(request proto.Message, send func(proto.Message) error, stop <-chan struct{}) error {
+	ref := request.(*ScaledObjectRef)
+	var active *bool
+	for {
+		response, err := s.IsActive(ref)
+		if statusErr, ok := err.(statusError); ok && (statusErr.code == codeInvalidArgument || statusErr.code == codeNotFound) {
+			return err
+		} else if err != nil {
+			logger.Warnf("Error checking if ScaledObject %s/%s is active: %s", ref.Namespace, ref.Name, err.Error())
+		} else if active == nil || response.Result != *active {
+			if err := send(response); err != nil {
+				return err
+			}
+			active = &response.Result
+		}
+
+		_, args := s.get()
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(args.Rate):
+		}
+	}
+}
+
+// GetMetricSpec returns the metric of the agent pool, which targets 1 agent per replica
+func (s *Scaler) GetMetricSpec(ref *ScaledObjectRef) (*GetMetricSpecResponse, error) {
+	pool, err := poolName(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &GetMetricSpecResponse{
+		MetricSpecs: []*MetricSpec{{MetricName: metricName(pool), TargetSize: 1}},
+	}, nil
+}
+
+// GetMetrics returns the number of agents the agent pool needs
+func (s *Scaler) GetMetrics(request *GetMetricsRequest) (*GetMetricsResponse, error) {
+	ref := request.ScaledObjectRef
+	if ref == nil {
+		return nil, errorf(codeInvalidArgument, "The ScaledObject is required")
+	}
+	demand, err := s.demand(ref)
+	if err != nil {
+		return nil, err
+	}
+	pool, _ := poolName(ref)
+	agents := demand.Agents()
+	logger.Debugf("ScaledObject %s/%s needs %d agents: %d busy agents, %d queued jobs with a demand of %d agents and %d replicas to keep the busy agents",
+		ref.Namespace, ref.Name, agents, demand.BusyAgents, demand.QueuedJobs, demand.QueueDemand, demand.DrainReplicas)
+	return &GetMetricsResponse{
+		MetricValues: []*MetricValue{{MetricName: metricName(pool), MetricValue: int64(agents)}},
+	}, nil
+}
+
+// demand retrieves the agents and jobs of the agent pool of a ScaledObject
+func (s *Scaler) demand(ref *ScaledObjectRef) (scaling.ExternalDemand, error) {
+	pool, err := poolName(ref)
+	if err != nil {
+		return scaling.ExternalDemand{}, err
+	}
+	backend, args := s.get()
+	demand, err := scaling.ObserveExternalDemand(backend, pool, ref.ScalerMetadata[statefulSetMetadata], args.QueueAge, args.AgentNames)
+	if errors.Is(err, scaling.ErrPoolNotFound) {
+		return demand, errorf(codeNotFound, "%s", err.Error())
+	} else if err != nil {
+		return demand, errorf(codeUnavailable, "%s", err.Error())
+	}
+	return demand, nil
+}
+
+// poolName returns the agent pool name from the trigger metadata of a ScaledObject
+func poolName(ref *ScaledObjectRef) (string, error) {
+	pool := strings.TrimSpace(ref.ScalerMetadata[poolMetadata])
+	if pool == "" {
+		return "", errorf(codeInvalidArgument, "The %s metadata of ScaledObject %s/%s is required", poolMetadata, ref.Namespace, ref.Name)
+	}
+	return pool, nil
+}
+
+// metricName returns the name of the metric of an agent pool, which is a valid Kubernetes metric name
+func metricName(pool string) string {
+	return "azp-agents-" + strings.Trim(invalidMetricNameChars.ReplaceAllString(strings.ToLower(pool), "-"), "-")
+}
@@ -0,0 +1,263 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Permission is an action on a Kubernetes resource the autoscaler needs to be allowed to perform
+type Permission struct {
+	Namespace   string
+	Verb        string
+	Group       string
+	Resource    string
+	Subresource string
+	Name        string
+}
+
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	if p.Name != "" {
+		resource += " " + p.Name
+	}
+	if p.Namespace == "" {
+		return fmt.Sprintf("%s %s cluster-wide", p.Verb, resource)
+	}
+	return fmt.Sprintf("%s %s in namespace %s", p.Verb, resource, p.Namespace)
+}
+
+// RequiredPermissions returns the permissions the autoscaler needs with the given args.
+// A dry run only reads the workloads and pods, so it doesn't need to be allowed to change them.
+func RequiredPermissions(args args.Args) []Permission {
+	// The KEDA external scaler and the metrics adapter only call Azure Devops
+	if args.ExternallyScaled() {
+		return nil
+	}
+	var permissions []Permission
+	namespaces := []string{args.Kubernetes.Namespace}
+	if args.Operator.Enabled {
+		// The workloads of the AzpAgentAutoscaler resources aren't known in advance
+		namespaces = args.OperatorNamespaces()
+		for _, namespace := range namespaces {
+			permissions = append(permissions,
+				Permission{Namespace: namespace, Verb: "list", Group: AutoscalerGroup, Resource: AutoscalerResource},
+				Permission{Namespace: namespace, Verb: "update", Group: AutoscalerGroup, Resource: AutoscalerResource},
+				Permission{Namespace: namespace, Verb: "update", Group: AutoscalerGroup, Resource: AutoscalerResource, Subresource: "status"},
+				Permission{Namespace: namespace, Verb: "get", Group: "apps", Resource: "statefulsets"},
+				Permission{Namespace: namespace, Verb: "get", Group: "apps", Resource: "statefulsets", Subresource: "scale"},
+			)
+			// The scales are verified with a server-side dry run, which is authorized like a scale
+			if !args.DryRun || args.VerifyScale {
+				permissions = append(permissions, Permission{Namespace: namespace, Verb: "update", Group: "apps", Resource: "statefulsets", Subresource: "scale"})
+			}
+			// The workloads are claimed with the owner annotations
+			if args.Ownership.Enabled && !args.DryRun {
+				permissions = append(permissions, Permission{Namespace: namespace, Verb: "patch", Group: "apps", Resource: "statefulsets"})
+			}
+		}
+	} else {
+		for _, workload := range args.Kubernetes.Workloads() {
+			group, resource := workloadResource(workload.Type)
+			permissions = append(permissions,
+				Permission{Namespace: workload.Namespace, Verb: "get", Group: group, Resource: resource, Name: workload.Name},
+				Permission{Namespace: workload.Namespace, Verb: "get", Group: group, Resource: resource, Subresource: "scale", Name: workload.Name},
+			)
+			if !args.DryRun || args.VerifyScale {
+				permissions = append(permissions, Permission{Namespace: workload.Namespace, Verb: "update", Group: group, Resource: resource, Subresource: "scale", Name: workload.Name})
+			}
+			if args.Ownership.Enabled && !args.DryRun {
+				permissions = append(permissions, Permission{Namespace: workload.Namespace, Verb: "patch", Group: group, Resource: resource, Name: workload.Name})
+			}
+		}
+	}
+
+	for _, namespace := range namespaces {
+		permissions = append(permissions,
+			Permission{Namespace: namespace, Verb: "list", Resource: "pods"},
+			// The pods of the agents are cached from a watch
+			Permission{Namespace: namespace, Verb: "watch", Resource: "pods"},
+		)
+		// With acknowledged conflicts, the autoscalers not being allowed to be listed is only a warning
+		if args.HPACheck.Checks(namespace) && !args.HPACheck.Acknowledged {
+			permissions = append(permissions,
+				Permission{Namespace: namespace, Verb: "list", Group: "autoscaling", Resource: "horizontalpodautoscalers"},
+				Permission{Namespace: namespace, Verb: "list", Group: "keda.sh", Resource: "scaledobjects"},
+			)
+		}
+		if args.Capacity.Quota {
+			permissions = append(permissions, Permission{Namespace: namespace, Verb: "list", Resource: "resourcequotas"})
+		}
+		if args.DryRun {
+			continue
+		}
+		if args.Events {
+			permissions = append(permissions, Permission{Namespace: namespace, Verb: "create", Resource: "events"})
+		}
+		if args.SafeToEvict || args.DrainAnnotation {
+			permissions = append(permissions, Permission{Namespace: namespace, Verb: "patch", Resource: "pods"})
+		}
+		if args.Recycle.Enabled() || args.OfflineAgents.Timeout > 0 || args.Quarantine.Enabled() || args.TargetedScaleDown || args.OrdinalGaps.ForceDeleteAfter > 0 {
+			permissions = append(permissions, Permission{Namespace: namespace, Verb: "delete", Resource: "pods"})
+		}
+		if args.Balloon.Replicas > 0 {
+			permissions = append(permissions,
+				Permission{Namespace: namespace, Verb: "get", Group: "apps", Resource: "deployments"},
+				Permission{Namespace: namespace, Verb: "create", Group: "apps", Resource: "deployments"},
+				Permission{Namespace: namespace, Verb: "update", Group: "apps", Resource: "deployments"},
+			)
+		}
+	}
+	// The state and history are only ConfigMaps with the ConfigMap store
+	if args.State.ConfigMapName != "" && args.Store.UsesConfigMaps() {
+		permissions = append(permissions,
+			Permission{Namespace: args.State.Namespace, Verb: "get", Resource: "configmaps", Name: args.State.ConfigMapName},
+		)
+		if !args.DryRun {
+			permissions = append(permissions,
+				Permission{Namespace: args.State.Namespace, Verb: "update", Resource: "configmaps", Name: args.State.ConfigMapName},
+				Permission{Namespace: args.State.Namespace, Verb: "create", Resource: "configmaps"},
+			)
+		}
+	}
+	if args.History.ConfigMapName != "" && args.Store.UsesConfigMaps() {
+		permissions = append(permissions,
+			Permission{Namespace: args.History.Namespace, Verb: "get", Resource: "configmaps", Name: args.History.ConfigMapName},
+		)
+		if !args.DryRun {
+			permissions = append(permissions,
+				Permission{Namespace: args.History.Namespace, Verb: "update", Resource: "configmaps", Name: args.History.ConfigMapName},
+				Permission{Namespace: args.History.Namespace, Verb: "create", Resource: "configmaps"},
+			)
+		}
+	}
+	if args.Capacity.Enabled {
+		permissions = append(permissions,
+			Permission{Verb: "list", Resource: "nodes"},
+			Permission{Verb: "list", Resource: "pods"},
+		)
+		if args.Capacity.Preempts() {
+			permissions = append(permissions, Permission{Verb: "get", Group: "scheduling.k8s.io", Resource: "priorityclasses"})
+		}
+	} else if args.HealthGates.ChecksNodes() {
+		permissions = append(permissions, Permission{Verb: "list", Resource: "nodes"})
+	}
+	return permissions
+}
+
+// workloadResource returns the API group and resource of a workload kind
+func workloadResource(kind string) (string, string) {
+	if strings.EqualFold(kind, "DeploymentConfig") {
+		return deploymentConfigGVR.Group, deploymentConfigGVR.Resource
+	}
+	return "apps", strings.ToLower(kind) + "s"
+}
+
+// ClusterPermissions returns the cluster-wide permissions the autoscaler needs with the given args, which a Role can't grant
+func ClusterPermissions(args args.Args) []Permission {
+	var permissions []Permission
+	for _, permission := range RequiredPermissions(args) {
+		if permission.Namespace == "" {
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions
+}
+
+// DetectRBACScope returns args.RBACScopeCluster if the autoscaler's service account is allowed every cluster-wide
+// permission it needs with the given args, otherwise args.RBACScopeNamespace and the permissions it isn't allowed
+func DetectRBACScope(client Client, scopeArgs args.Args) (string, []Permission, error) {
+	var missing []Permission
+	for _, permission := range ClusterPermissions(scopeArgs) {
+		allowed, err := client.IsAllowed(permission)
+		if err != nil {
+			return "", nil, fmt.Errorf("Error detecting the RBAC scope: %w", err)
+		} else if !allowed {
+			missing = append(missing, permission)
+		}
+	}
+	if len(missing) > 0 {
+		return args.RBACScopeNamespace, missing, nil
+	}
+	return args.RBACScopeCluster, nil, nil
+}
+
+// IsAllowed returns whether the autoscaler's service account is allowed a permission
+func (c ClientImpl) IsAllowed(permission Permission) (_ bool, err error) {
+	defer observeCall("IsAllowed", time.Now(), &err)
+
+	review, err := c.client.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   permission.Namespace,
+				Verb:        permission.Verb,
+				Group:       permission.Group,
+				Resource:    permission.Resource,
+				Subresource: permission.Subresource,
+				Name:        permission.Name,
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
+// MissingPermissionsError is returned when the service account of the autoscaler is missing RBAC permissions
+type MissingPermissionsError struct {
+	Permissions []Permission
+}
+
+func (e MissingPermissionsError) Error() string {
+	missing := make([]string, len(e.Permissions))
+	for i, permission := range e.Permissions {
+		missing[i] = permission.String()
+	}
+	return fmt.Sprintf("Error: the service account is missing %d RBAC permissions, grant them with a Role or ClusterRole bound to it: %s", len(e.Permissions), strings.Join(missing, ", "))
+}
+
+// VerifyPermissions returns a MissingPermissionsError with every required permission the autoscaler's service account
+// isn't allowed, so a missing permission fails at startup instead of the first time it's used
+func VerifyPermissions(client Client, args args.Args) error {
+	var missing []Permission
+	for _, permission := range RequiredPermissions(args) {
+		allowed, err := client.IsAllowed(permission)
+		if err != nil {
+			return fmt.Errorf("Error verifying the RBAC permissions: %w", err)
+		} else if !allowed {
+			missing = append(missing, permission)
+		}
+	}
+	if len(missing) > 0 {
+		return MissingPermissionsError{Permissions: missing}
+	}
+	return nil
+}
+
+// IsAuthError returns true if an error is the Kubernetes API rejecting the credentials or permissions of the autoscaler,
+// or a MissingPermissionsError
+func IsAuthError(err error) bool {
+	var missingPermissions MissingPermissionsError
+	if errors.As(err, &missingPermissions) {
+		return true
+	}
+	var status k8serrors.APIStatus
+	if !errors.As(err, &status) {
+		return false
+	}
+	reason := status.Status().Reason
+	return reason == metav1.StatusReasonUnauthorized || reason == metav1.StatusReasonForbidden
+}
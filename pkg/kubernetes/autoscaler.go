@@ -0,0 +1,177 @@
+package kubernetes
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// AutoscalerGroup is the API group of the AzpAgentAutoscaler custom resource
+	AutoscalerGroup = "azp.ogmaresca.github.io"
+	// AutoscalerVersion is the API version of the AzpAgentAutoscaler custom resource
+	AutoscalerVersion = "v1alpha1"
+	// AutoscalerResource is the plural resource name of the AzpAgentAutoscaler custom resource
+	AutoscalerResource = "azpagentautoscalers"
+)
+
+// TeardownFinalizer is added to AzpAgentAutoscaler resources, so their agents are drained and deregistered before they're deleted
+const TeardownFinalizer = AutoscalerGroup + "/teardown"
+
+// autoscalerGVR identifies the AzpAgentAutoscaler resource to the dynamic client
+var autoscalerGVR = schema.GroupVersionResource{Group: AutoscalerGroup, Version: AutoscalerVersion, Resource: AutoscalerResource}
+
+// AzpAgentAutoscaler is a custom resource that declares an agent workload to autoscale in operator mode
+type AzpAgentAutoscaler struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AzpAgentAutoscalerSpec   `json:"spec"`
+	Status AzpAgentAutoscalerStatus `json:"status,omitempty"`
+}
+
+// AzpAgentAutoscalerSpec is the workload, agent pool and scaling policy of an AzpAgentAutoscaler.
+// The optional values default to the arguments of the operator.
+type AzpAgentAutoscalerSpec struct {
+	// Pool is the name of the agent pool. It is discovered from the AZP_POOL environment variable of the workload if empty.
+	Pool        string            `json:"pool,omitempty"`
+	WorkloadRef WorkloadReference `json:"workloadRef"`
+	Priority    int32             `json:"priority,omitempty"`
+
+	Min       *int32                   `json:"min,omitempty"`
+	Max       *int32                   `json:"max,omitempty"`
+	ScaleDown *AutoscalerScaleDownSpec `json:"scaleDown,omitempty"`
+	Policy    *AutoscalerPolicySpec    `json:"policy,omitempty"`
+	DryRun    *bool                    `json:"dryRun,omitempty"`
+	Teardown  *AutoscalerTeardownSpec  `json:"teardown,omitempty"`
+}
+
+// WorkloadReference is the agent workload of an AzpAgentAutoscaler, in the same namespace
+type WorkloadReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// AutoscalerScaleDownSpec is the scale down section of an AzpAgentAutoscaler
+type AutoscalerScaleDownSpec struct {
+	Delay     *metav1.Duration `json:"delay,omitempty"`
+	IdleDelay *metav1.Duration `json:"idleDelay,omitempty"`
+	Max       *int32           `json:"max,omitempty"`
+	// DrainTimeout is how long the drained agents of the pods a scale down removes can stay busy
+	DrainTimeout *metav1.Duration `json:"drainTimeout,omitempty"`
+	// DrainTimeoutPolicy is what happens when a drained agent is still busy after the drain timeout: abort, force or retry
+	DrainTimeoutPolicy string `json:"drainTimeoutPolicy,omitempty"`
+	// DrainMaxRetries is how many times the retry policy waits for the drained agents again before aborting, unlimited if 0
+	DrainMaxRetries *int32 `json:"drainMaxRetries,omitempty"`
+}
+
+// AutoscalerPolicySpec is the scaling policy section of an AzpAgentAutoscaler
+type AutoscalerPolicySpec struct {
+	Name            string           `json:"name,omitempty"`
+	SLOMaxQueueTime *metav1.Duration `json:"sloMaxQueueTime,omitempty"`
+	SLOWindow       *metav1.Duration `json:"sloWindow,omitempty"`
+}
+
+// AutoscalerTeardownSpec is what happens to the workload when an AzpAgentAutoscaler is deleted
+type AutoscalerTeardownSpec struct {
+	// ParkedReplicas scales the workload to this many replicas and keeps their agents registered.
+	// If it isn't set, the workload isn't scaled and all of its agents are deregistered.
+	ParkedReplicas *int32 `json:"parkedReplicas,omitempty"`
+}
+
+// AzpAgentAutoscalerStatus is the observed state of an AzpAgentAutoscaler, written by the operator every iteration
+type AzpAgentAutoscalerStatus struct {
+	// ObservedGeneration is the generation of the spec the status was observed with
+	ObservedGeneration int64                 `json:"observedGeneration,omitempty"`
+	AgentPoolName      string                `json:"pool,omitempty"`
+	AgentPoolID        int                   `json:"poolId,omitempty"`
+	CurrentReplicas    int32                 `json:"currentReplicas"`
+	DesiredReplicas    int32                 `json:"desiredReplicas"`
+	QueuedJobs         int32                 `json:"queuedJobs"`
+	LastScaleTime      *metav1.Time          `json:"lastScaleTime,omitempty"`
+	Conditions         []AutoscalerCondition `json:"conditions,omitempty"`
+}
+
+// The condition types of an AzpAgentAutoscaler
+const (
+	// ConditionReady is true when the workload and agent pool were found and the spec is valid
+	ConditionReady = "Ready"
+	// ConditionDegraded is true when the workload couldn't be autoscaled, ex: Azure Devops couldn't be reached or scaling failed
+	ConditionDegraded = "Degraded"
+	// ConditionScalingSuppressed is true when a limit prevented or reduced the last scaling decision
+	ConditionScalingSuppressed = "ScalingSuppressed"
+)
+
+// AutoscalerCondition is a condition of an AzpAgentAutoscaler
+type AutoscalerCondition struct {
+	Type   string                 `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+	// LastTransitionTime is when the status last changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+}
+
+// ListAutoscalers lists the AzpAgentAutoscaler resources in a namespace
+func (c ClientImpl) ListAutoscalers(namespace string) (_ []AzpAgentAutoscaler, err error) {
+	defer observeCall("ListAutoscalers", time.Now(), &err)
+
+	list, err := c.dynamic.Resource(autoscalerGVR).Namespace(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	autoscalers := make([]AzpAgentAutoscaler, len(list.Items))
+	for i, item := range list.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &autoscalers[i]); err != nil {
+			return nil, err
+		}
+	}
+	return autoscalers, nil
+}
+
+// UpdateAutoscaler replaces the metadata and spec of an AzpAgentAutoscaler resource, ex: to change its finalizers, and returns the updated resource
+func (c ClientImpl) UpdateAutoscaler(autoscaler AzpAgentAutoscaler) (_ AzpAgentAutoscaler, err error) {
+	defer observeCall("UpdateAutoscaler", time.Now(), &err)
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&autoscaler)
+	if err != nil {
+		return AzpAgentAutoscaler{}, err
+	}
+	updated, err := c.dynamic.Resource(autoscalerGVR).Namespace(autoscaler.Namespace).Update(&unstructured.Unstructured{Object: object}, metav1.UpdateOptions{})
+	if err != nil {
+		return AzpAgentAutoscaler{}, err
+	}
+	result := AzpAgentAutoscaler{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(updated.Object, &result)
+	return result, err
+}
+
+// UpdateAutoscalerStatus replaces the status of an AzpAgentAutoscaler resource
+func (c ClientImpl) UpdateAutoscalerStatus(autoscaler AzpAgentAutoscaler) (err error) {
+	defer observeCall("UpdateAutoscalerStatus", time.Now(), &err)
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&autoscaler)
+	if err != nil {
+		return err
+	}
+	_, err = c.dynamic.Resource(autoscalerGVR).Namespace(autoscaler.Namespace).UpdateStatus(&unstructured.Unstructured{Object: object}, metav1.UpdateOptions{})
+	return err
+}
+
+// CreateAutoscalerEvent creates an Event on an AzpAgentAutoscaler resource
+func (c ClientImpl) CreateAutoscalerEvent(autoscaler AzpAgentAutoscaler, eventType string, reason string, message string) (err error) {
+	defer observeCall("CreateAutoscalerEvent", time.Now(), &err)
+
+	return c.createEvent(corev1.ObjectReference{
+		APIVersion:      AutoscalerGroup + "/" + AutoscalerVersion,
+		Kind:            "AzpAgentAutoscaler",
+		Name:            autoscaler.Name,
+		Namespace:       autoscaler.Namespace,
+		UID:             autoscaler.UID,
+		ResourceVersion: autoscaler.ResourceVersion,
+	}, eventType, reason, message)
+}
@@ -0,0 +1,233 @@
+package kubernetes
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// GetPodRequests returns the CPU and memory requests of a pod spec.
+// Init containers run before the containers, so the largest init container request is used if it is bigger.
+func GetPodRequests(podSpec corev1.PodSpec) corev1.ResourceList {
+	requests := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.Quantity{},
+		corev1.ResourceMemory: resource.Quantity{},
+	}
+	for _, container := range podSpec.Containers {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if quantity, exists := container.Resources.Requests[name]; exists {
+				total := requests[name]
+				total.Add(quantity)
+				requests[name] = total
+			}
+		}
+	}
+	for _, container := range podSpec.InitContainers {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if quantity, exists := container.Resources.Requests[name]; exists {
+				if quantity.Cmp(requests[name]) > 0 {
+					requests[name] = quantity.DeepCopy()
+				}
+			}
+		}
+	}
+	return requests
+}
+
+// IsNodeSchedulable returns true if a node is ready and not cordoned
+func IsNodeSchedulable(node corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// IsNodeEligible returns true if a pod with the given spec can be scheduled onto a node based on the pod's node name,
+// node selector, required node affinity and tolerations. Preferred node affinity doesn't prevent scheduling, so it's ignored.
+func IsNodeEligible(node corev1.Node, podSpec corev1.PodSpec) bool {
+	if podSpec.NodeName != "" && podSpec.NodeName != node.Name {
+		return false
+	}
+	for key, value := range podSpec.NodeSelector {
+		if nodeValue, exists := node.Labels[key]; !exists || nodeValue != value {
+			return false
+		}
+	}
+	if affinity := podSpec.Affinity; affinity != nil && affinity.NodeAffinity != nil {
+		if required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil && !matchesNodeSelector(node, *required) {
+			return false
+		}
+	}
+	for i := range node.Spec.Taints {
+		taint := node.Spec.Taints[i]
+		if taint.Effect != corev1.TaintEffectNoSchedule && taint.Effect != corev1.TaintEffectNoExecute {
+			continue
+		}
+		if !toleratesTaint(podSpec.Tolerations, &taint) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesNodeSelector returns true if a node matches any of the terms of a node selector
+func matchesNodeSelector(node corev1.Node, selector corev1.NodeSelector) bool {
+	for _, term := range selector.NodeSelectorTerms {
+		// A term without requirements matches no nodes
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+		matches := true
+		for _, requirement := range term.MatchExpressions {
+			value, exists := node.Labels[requirement.Key]
+			if !matchesNodeSelectorRequirement(requirement, value, exists) {
+				matches = false
+				break
+			}
+		}
+		for _, requirement := range term.MatchFields {
+			// metadata.name is the only field that can be matched
+			if requirement.Key != "metadata.name" || !matchesNodeSelectorRequirement(requirement, node.Name, true) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesNodeSelectorRequirement returns true if a node's label or field value matches a node selector requirement
+func matchesNodeSelectorRequirement(requirement corev1.NodeSelectorRequirement, value string, exists bool) bool {
+	switch requirement.Operator {
+	case corev1.NodeSelectorOpIn:
+		return exists && containsString(requirement.Values, value)
+	case corev1.NodeSelectorOpNotIn:
+		return !exists || !containsString(requirement.Values, value)
+	case corev1.NodeSelectorOpExists:
+		return exists
+	case corev1.NodeSelectorOpDoesNotExist:
+		return !exists
+	case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+		if !exists || len(requirement.Values) != 1 {
+			return false
+		}
+		nodeValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		requirementValue, err := strconv.ParseInt(requirement.Values[0], 10, 64)
+		if err != nil {
+			return false
+		}
+		if requirement.Operator == corev1.NodeSelectorOpGt {
+			return nodeValue > requirementValue
+		}
+		return nodeValue < requirementValue
+	default:
+		return false
+	}
+}
+
+// toleratesTaint returns true if any of the tolerations tolerates a taint
+func toleratesTaint(tolerations []corev1.Toleration, taint *corev1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ExcludePreemptedPods returns the pods the scheduler wouldn't preempt for a pod with the priority, whose priority
+// is at least as high. Pods without a priority have the priority of 0, like without a default PriorityClass.
+func ExcludePreemptedPods(pods []corev1.Pod, priority int32) []corev1.Pod {
+	remaining := make([]corev1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		podPriority := int32(0)
+		if pod.Spec.Priority != nil {
+			podPriority = *pod.Spec.Priority
+		}
+		if podPriority >= priority {
+			remaining = append(remaining, pod)
+		}
+	}
+	return remaining
+}
+
+// EstimateSchedulablePods estimates how many pods with the given spec can be scheduled onto the nodes,
+// based on the nodes' allocatable CPU and memory and the requests of the pods already running on them.
+// Only the nodes the pods are eligible for are counted, ex: the dedicated node pool of the agents.
+func EstimateSchedulablePods(nodes []corev1.Node, pods []corev1.Pod, podSpec corev1.PodSpec) int32 {
+	podRequests := GetPodRequests(podSpec)
+
+	nodeRequests := make(map[string]corev1.ResourceList)
+	nodePodCounts := make(map[string]int64)
+	for _, pod := range pods {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		nodePodCounts[pod.Spec.NodeName]++
+		requests, exists := nodeRequests[pod.Spec.NodeName]
+		if !exists {
+			requests = corev1.ResourceList{}
+			nodeRequests[pod.Spec.NodeName] = requests
+		}
+		for name, quantity := range GetPodRequests(pod.Spec) {
+			total := requests[name]
+			total.Add(quantity)
+			requests[name] = total
+		}
+	}
+
+	numPods := int32(0)
+	for _, node := range nodes {
+		if !IsNodeSchedulable(node) || !IsNodeEligible(node, podSpec) {
+			continue
+		}
+		numPods = numPods + estimateSchedulablePodsOnNode(node, nodeRequests[node.Name], nodePodCounts[node.Name], podRequests)
+	}
+	return numPods
+}
+
+func estimateSchedulablePodsOnNode(node corev1.Node, nodeRequests corev1.ResourceList, nodePodCount int64, podRequests corev1.ResourceList) int32 {
+	// The node's pod capacity is always a limit
+	maxPods := node.Status.Allocatable[corev1.ResourcePods]
+	numPods := maxPods.Value() - nodePodCount
+	if numPods <= 0 {
+		return 0
+	}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		podRequest := podRequests[name]
+		if podRequest.IsZero() {
+			continue
+		}
+		allocatable := node.Status.Allocatable[name]
+		requested := nodeRequests[name]
+		free := allocatable.MilliValue() - requested.MilliValue()
+		if free <= 0 {
+			return 0
+		}
+		if fits := free / podRequest.MilliValue(); fits < numPods {
+			numPods = fits
+		}
+	}
+	return int32(numPods)
+}
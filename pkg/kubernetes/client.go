@@ -1,66 +1,116 @@
 package kubernetes
 
 import (
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	appsv1 "k8s.io/api/apps/v1"
 	autoscalingv1 "k8s.io/api/autoscaling/v1"
 	corev1 "k8s.io/api/core/v1"
-	apimachinery "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	k8srest "k8s.io/client-go/rest"
 	k8sclientcmd "k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
 // Client is a wrapper around the client-go package for Kubernetes
 type Client interface {
 	GetWorkload(args args.KubernetesArgs) (*Workload, error)
+	GetWorkloadKinds(namespace string, name string) ([]string, error)
 	VerifyNoHorizontalPodAutoscaler(args args.KubernetesArgs) error
 	Scale(resource *Workload, replicas int32) error
-	GetEnvValue(podSpec corev1.PodSpec, namespace string, envName string) (string, error)
+	VerifyScale(resource *Workload, replicas int32) error
+	GetReplicas(resource *Workload) (int32, error)
+	GetRollingUpdate(resource *Workload) (*RollingUpdate, error)
+	GetEnvValue(template corev1.PodTemplateSpec, namespace string, envName string) (string, error)
 	GetPods(workload *Workload) ([]corev1.Pod, error)
+	AnnotatePod(pod corev1.Pod, key string, value string) error
+	AnnotateWorkload(workload *Workload, annotations map[string]string) error
+	DeletePod(pod corev1.Pod) error
+	ForceDeletePod(pod corev1.Pod) error
+	GetConfigMapData(namespace string, name string) (map[string]string, error)
+	GetSecretData(namespace string, name string) (map[string][]byte, error)
+	SaveConfigMapData(namespace string, name string, data map[string]string) error
+	SaveDeployment(deployment *appsv1.Deployment) error
+	CreateEvent(workload *Workload, eventType string, reason string, message string) error
+	GetNodes() ([]corev1.Node, error)
+	VerifyAPIAvailable(groupVersion string) error
+	GetAllPods() ([]corev1.Pod, error)
+	GetPriorityClassValue(name string) (int32, error)
+	GetResourceQuotas(namespace string) ([]corev1.ResourceQuota, error)
+	IsAllowed(permission Permission) (bool, error)
+	ListAutoscalers(namespace string) ([]AzpAgentAutoscaler, error)
+	UpdateAutoscaler(autoscaler AzpAgentAutoscaler) (AzpAgentAutoscaler, error)
+	UpdateAutoscalerStatus(autoscaler AzpAgentAutoscaler) error
+	CreateAutoscalerEvent(autoscaler AzpAgentAutoscaler, eventType string, reason string, message string) error
 }
 
 // ClientImpl is the interface implementation of Client
 type ClientImpl struct {
 	client *k8s.Clientset
+	// dynamic accesses the custom resources
+	dynamic dynamic.Interface
+	// scaleTargets caches the HorizontalPodAutoscalers and KEDA ScaledObjects of each namespace
+	scaleTargets *scaleTargetsCache
 }
 
-// makeClient returns a Client
-func makeClient() (Client, error) {
+// makeClient returns a Client whose requests time out after the timeout, or never if it's 0
+func makeClient(timeout time.Duration) (Client, error) {
 	k8sConfig, err := k8srest.InClusterConfig()
 	if err != nil {
-		kubeconfigEnv := os.Getenv("KUBECONFIG")
-		k8sConfig, err = k8sclientcmd.BuildConfigFromFlags("", kubeconfigEnv)
+		// Out of a cluster, the kubeconfig is loaded like kubectl does: the files of the KUBECONFIG environment variable,
+		// separated by the OS path list separator, or .kube/config in the home directory, which is USERPROFILE on Windows
+		loadingRules := k8sclientcmd.NewDefaultClientConfigLoadingRules()
+		k8sConfig, err = k8sclientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &k8sclientcmd.ConfigOverrides{}).ClientConfig()
 		if err != nil {
-			home := os.Getenv("HOME")
-			if home == "" {
-				home = os.Getenv("USERPROFILE") // windows
-			}
-			k8sConfig, err = k8sclientcmd.BuildConfigFromFlags("", fmt.Sprintf("%s/.kube/config", home))
-			if err != nil {
-				return nil, fmt.Errorf("Error initializing Kubernetes config: %s", err.Error())
-			}
+			return nil, fmt.Errorf("Error initializing Kubernetes config: %w", err)
 		}
 	}
 
+	// The errors of client-go can include the credentials of the kubeconfig
+	logging.RedactSecret(k8sConfig.BearerToken)
+	logging.RedactSecret(k8sConfig.Password)
+	k8sConfig.Timeout = timeout
 	clientset, err := k8s.NewForConfig(k8sConfig)
 	if err != nil {
 		return nil, err
 	}
-	return ClientImpl{clientset}, nil
+	dynamicClient, err := dynamic.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, err
+	}
+	return ClientImpl{client: clientset, dynamic: dynamicClient, scaleTargets: newScaleTargetsCache(hpaCheckInterval)}, nil
 }
 
 // GetWorkload retrieves a Workload
-func (c ClientImpl) GetWorkload(args args.KubernetesArgs) (*Workload, error) {
+func (c ClientImpl) GetWorkload(args args.KubernetesArgs) (_ *Workload, err error) {
+	defer observeCall("GetWorkload", time.Now(), &err)
+
 	if strings.EqualFold(args.Type, "StatefulSet") {
 		return c.getStatefulSet(args.Namespace, args.Name)
+	} else if strings.EqualFold(args.Type, "DeploymentConfig") {
+		deploymentConfig, err := c.getDeploymentConfig(args.Namespace, args.Name)
+		if err != nil {
+			return nil, err
+		}
+		return GetDeploymentConfigWorkload(deploymentConfig), nil
+	} else if strings.EqualFold(args.Type, "Deployment") {
+		deployment, err := c.getDeployment(args.Namespace, args.Name)
+		if err != nil {
+			return nil, err
+		}
+		return GetDeploymentWorkload(deployment), nil
 	} else {
-		return nil, fmt.Errorf("Resource kind %s is not implemented", args.Type)
+		return nil, NotImplementedKindError{Kind: args.Type}
 	}
 }
 
@@ -75,23 +125,35 @@ func (c ClientImpl) getStatefulSet(namespace string, name string) (*Workload, er
 	}
 }
 
-// VerifyNoHorizontalPodAutoscaler returns an error if the given resource has a HorizontalPodAutoscaler
-func (c ClientImpl) VerifyNoHorizontalPodAutoscaler(args args.KubernetesArgs) error {
-	hpas, err := c.client.AutoscalingV1().HorizontalPodAutoscalers(args.Namespace).List(metav1.ListOptions{})
-	if err != nil {
-		return err
+// GetWorkloadKinds returns the kinds of the StatefulSet, DeploymentConfig and Deployment with the given name that exist in
+// the namespace. DeploymentConfigs are skipped outside of OpenShift, and DeploymentConfigs and Deployments the service
+// account isn't allowed to get are skipped, as only StatefulSets are in the default RBAC permissions.
+func (c ClientImpl) GetWorkloadKinds(namespace string, name string) (_ []string, err error) {
+	defer observeCall("GetWorkloadKinds", time.Now(), &err)
+
+	var kinds []string
+	if _, err := c.client.AppsV1().StatefulSets(namespace).Get(name, metav1.GetOptions{}); err == nil {
+		kinds = append(kinds, "StatefulSet")
+	} else if !k8serrors.IsNotFound(err) {
+		return nil, err
 	}
-	for _, hpa := range hpas.Items {
-		if strings.EqualFold(hpa.Spec.ScaleTargetRef.Kind, args.Type) && hpa.Spec.ScaleTargetRef.Name == args.Name {
-			return fmt.Errorf("Error: %s cannot have a HorizontalPodAutoscaler attached for azp-agent-autoscaler to work", args.FriendlyName())
-		}
+	if _, err := c.dynamic.Resource(deploymentConfigGVR).Namespace(namespace).Get(name, metav1.GetOptions{}); err == nil {
+		kinds = append(kinds, "DeploymentConfig")
+	} else if !k8serrors.IsNotFound(err) && !k8serrors.IsForbidden(err) {
+		return nil, err
 	}
-
-	return nil
+	if _, err := c.client.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{}); err == nil {
+		kinds = append(kinds, "Deployment")
+	} else if !k8serrors.IsNotFound(err) && !k8serrors.IsForbidden(err) {
+		return nil, err
+	}
+	return kinds, nil
 }
 
-// Scale scales a given Kubernetes resource
-func (c ClientImpl) Scale(resource *Workload, replicas int32) error {
+// Scale scales a given Kubernetes resource, retrying if it was updated concurrently
+func (c ClientImpl) Scale(resource *Workload, replicas int32) (err error) {
+	defer observeCall("Scale", time.Now(), &err)
+
 	var getScaleFunc func() (*autoscalingv1.Scale, error)
 	var doScaleFunc func(scale *autoscalingv1.Scale) error
 	if strings.EqualFold(resource.Kind, "StatefulSet") {
@@ -103,70 +165,356 @@ func (c ClientImpl) Scale(resource *Workload, replicas int32) error {
 			scale, err := statefulsets.UpdateScale(resource.Name, scale)
 			return err
 		}
+	} else if strings.EqualFold(resource.Kind, "Deployment") {
+		deployments := c.client.AppsV1().Deployments(resource.Namespace)
+		getScaleFunc = func() (*autoscalingv1.Scale, error) {
+			return deployments.GetScale(resource.Name, metav1.GetOptions{})
+		}
+		doScaleFunc = func(scale *autoscalingv1.Scale) error {
+			scale, err := deployments.UpdateScale(resource.Name, scale)
+			return err
+		}
+	} else if strings.EqualFold(resource.Kind, "DeploymentConfig") {
+		return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			scale, current, err := c.getDeploymentConfigScale(resource.Namespace, resource.Name)
+			if err != nil || current == replicas {
+				return err
+			}
+			return c.updateDeploymentConfigScale(resource.Namespace, scale, replicas, metav1.UpdateOptions{})
+		})
 	} else {
-		return fmt.Errorf("Resource kind %s is not implemented", resource.Kind)
+		return NotImplementedKindError{Kind: resource.Kind}
+	}
+
+	// The scale is retrieved again if the workload was updated since it was retrieved, ex: by CD tooling,
+	// so a concurrent update doesn't fail the scaling with a conflict
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scale, err := getScaleFunc()
+		if err != nil {
+			return err
+		}
+		if scale.Spec.Replicas == replicas {
+			return nil
+		}
+		scale.Spec.Replicas = replicas
+		return doScaleFunc(scale)
+	})
+}
+
+// VerifyScale scales a given Kubernetes resource with a server-side dry run, which runs the admission webhooks and
+// checks the resource quotas without changing anything
+func (c ClientImpl) VerifyScale(resource *Workload, replicas int32) (err error) {
+	defer observeCall("VerifyScale", time.Now(), &err)
+
+	dryRun := metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}}
+	if strings.EqualFold(resource.Kind, "StatefulSet") || strings.EqualFold(resource.Kind, "Deployment") {
+		var scale *autoscalingv1.Scale
+		var err error
+		if strings.EqualFold(resource.Kind, "Deployment") {
+			scale, err = c.client.AppsV1().Deployments(resource.Namespace).GetScale(resource.Name, metav1.GetOptions{})
+		} else {
+			scale, err = c.client.AppsV1().StatefulSets(resource.Namespace).GetScale(resource.Name, metav1.GetOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		scale.Spec.Replicas = replicas
+		// The typed client of this client-go version can't send update options
+		return c.client.AppsV1().RESTClient().Put().
+			Namespace(resource.Namespace).
+			Resource(strings.ToLower(resource.Kind)+"s").
+			Name(resource.Name).
+			SubResource("scale").
+			VersionedParams(&dryRun, scheme.ParameterCodec).
+			Body(scale).
+			Do().
+			Error()
+	} else if strings.EqualFold(resource.Kind, "DeploymentConfig") {
+		scale, _, err := c.getDeploymentConfigScale(resource.Namespace, resource.Name)
+		if err != nil {
+			return err
+		}
+		return c.updateDeploymentConfigScale(resource.Namespace, scale, replicas, dryRun)
+	}
+	return NotImplementedKindError{Kind: resource.Kind}
+}
+
+// IsScaleRejected returns true if the API server rejected a scale, ex: an admission webhook denied it or it would exceed
+// a resource quota, as opposed to failing to process it
+func IsScaleRejected(err error) bool {
+	return k8serrors.IsForbidden(err) || k8serrors.IsInvalid(err)
+}
+
+// GetReplicas gets the replicas a given Kubernetes resource is scaled to, which can differ from the number of its pods
+func (c ClientImpl) GetReplicas(resource *Workload) (_ int32, err error) {
+	defer observeCall("GetReplicas", time.Now(), &err)
+
+	if strings.EqualFold(resource.Kind, "DeploymentConfig") {
+		_, replicas, err := c.getDeploymentConfigScale(resource.Namespace, resource.Name)
+		return replicas, err
+	} else if strings.EqualFold(resource.Kind, "Deployment") {
+		scale, err := c.client.AppsV1().Deployments(resource.Namespace).GetScale(resource.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return scale.Spec.Replicas, nil
+	} else if !strings.EqualFold(resource.Kind, "StatefulSet") {
+		return 0, NotImplementedKindError{Kind: resource.Kind}
+	}
+	scale, err := c.client.AppsV1().StatefulSets(resource.Namespace).GetScale(resource.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return scale.Spec.Replicas, nil
+}
+
+// GetRollingUpdate gets the rolling update of a given Kubernetes resource, or nil if it isn't being updated
+func (c ClientImpl) GetRollingUpdate(resource *Workload) (_ *RollingUpdate, err error) {
+	defer observeCall("GetRollingUpdate", time.Now(), &err)
+
+	if strings.EqualFold(resource.Kind, "DeploymentConfig") {
+		deploymentConfig, err := c.getDeploymentConfig(resource.Namespace, resource.Name)
+		if err != nil {
+			return nil, err
+		}
+		return GetDeploymentConfigRollingUpdate(deploymentConfig), nil
+	} else if strings.EqualFold(resource.Kind, "Deployment") {
+		deployment, err := c.getDeployment(resource.Namespace, resource.Name)
+		if err != nil {
+			return nil, err
+		}
+		return GetDeploymentRollingUpdate(deployment), nil
+	} else if !strings.EqualFold(resource.Kind, "StatefulSet") {
+		return nil, NotImplementedKindError{Kind: resource.Kind}
+	}
+	statefulSet, err := c.client.AppsV1().StatefulSets(resource.Namespace).Get(resource.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return GetRollingUpdate(statefulSet), nil
+}
+
+// GetEnvValue gets an environment variable value from a pod template, see ResolveEnvValue
+func (c ClientImpl) GetEnvValue(template corev1.PodTemplateSpec, namespace string, envName string) (_ string, err error) {
+	defer observeCall("GetEnvValue", time.Now(), &err)
+
+	return ResolveEnvValue(c, template, namespace, envName)
+}
+
+// GetPods gets all pods attached to some workload from the watched pods of its namespace
+func (c ClientImpl) GetPods(workload *Workload) (_ []corev1.Pod, err error) {
+	defer observeCall("GetPods", time.Now(), &err)
+
+	return c.getCachedPods(workload)
+}
+
+// AnnotatePod sets an annotation on a pod with a merge patch, so the rest of the pod isn't overwritten
+func (c ClientImpl) AnnotatePod(pod corev1.Pod, key string, value string) (err error) {
+	defer observeCall("AnnotatePod", time.Now(), &err)
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
 	}
+	_, err = c.client.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patch)
+	return err
+}
+
+// AnnotateWorkload sets annotations on a workload with a merge patch. The patch fails with a conflict if the workload
+// was updated since it was retrieved, so concurrent annotations don't overwrite each other.
+func (c ClientImpl) AnnotateWorkload(workload *Workload, annotations map[string]string) (err error) {
+	defer observeCall("AnnotateWorkload", time.Now(), &err)
 
-	scale, err := getScaleFunc()
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations":     annotations,
+			"resourceVersion": workload.ResourceVersion,
+		},
+	})
 	if err != nil {
 		return err
 	}
-	if scale.Spec.Replicas == replicas {
-		return nil
+	if strings.EqualFold(workload.Kind, "StatefulSet") {
+		_, err = c.client.AppsV1().StatefulSets(workload.Namespace).Patch(workload.Name, types.MergePatchType, patch)
+		return err
+	} else if strings.EqualFold(workload.Kind, "Deployment") {
+		_, err = c.client.AppsV1().Deployments(workload.Namespace).Patch(workload.Name, types.MergePatchType, patch)
+		return err
+	} else if strings.EqualFold(workload.Kind, "DeploymentConfig") {
+		_, err = c.dynamic.Resource(deploymentConfigGVR).Namespace(workload.Namespace).Patch(workload.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
 	}
-	scale.Spec.Replicas = replicas
-	return doScaleFunc(scale)
+	return NotImplementedKindError{Kind: workload.Kind}
+}
+
+// DeletePod deletes a pod, so its workload recreates it
+func (c ClientImpl) DeletePod(pod corev1.Pod) (err error) {
+	defer observeCall("DeletePod", time.Now(), &err)
+
+	return c.client.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
 }
 
-// GetEnvValue gets an environment variable value from a pod
-func (c ClientImpl) GetEnvValue(podSpec corev1.PodSpec, namespace string, envName string) (string, error) {
-	env := GetEnvVar(podSpec, envName)
-	if env == nil {
-		return "", fmt.Errorf("Could not retrieve environment variable %s", envName)
+// ForceDeletePod deletes a pod without waiting for its node to confirm its containers stopped. The pod is only deleted
+// if it has the same UID, so a pod recreated with the same name isn't.
+func (c ClientImpl) ForceDeletePod(pod corev1.Pod) (err error) {
+	defer observeCall("ForceDeletePod", time.Now(), &err)
+
+	gracePeriodSeconds := int64(0)
+	return c.client.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriodSeconds,
+		Preconditions:      &metav1.Preconditions{UID: &pod.UID},
+	})
+}
+
+// GetConfigMapData gets the data of a ConfigMap. If the ConfigMap doesn't exist, nil is returned.
+func (c ClientImpl) GetConfigMapData(namespace string, name string) (_ map[string]string, err error) {
+	defer observeCall("GetConfigMapData", time.Now(), &err)
+
+	configmap, err := c.client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
+	return configmap.Data, nil
+}
 
-	if env.Value != "" {
-		return env.Value, nil
-	} else if env.ValueFrom != nil {
-		if env.ValueFrom.FieldRef != nil {
-			return "", fmt.Errorf("Error getting value for environment variable %s: fieldRef is not supported", env.Name)
-		} else if env.ValueFrom.ResourceFieldRef != nil {
-			return "", fmt.Errorf("Error getting value for environment variable %s: resourceFieldRef is not supported", env.Name)
-		} else if env.ValueFrom.ConfigMapKeyRef != nil {
-			configmap, err := c.client.CoreV1().ConfigMaps(namespace).Get(env.ValueFrom.ConfigMapKeyRef.Name, metav1.GetOptions{})
-			if err != nil {
-				return "", fmt.Errorf("Error getting value from configmap %s for environment variable %s: %s", env.ValueFrom.ConfigMapKeyRef.Name, envName, err.Error())
-			}
-			value, exists := configmap.Data[env.ValueFrom.ConfigMapKeyRef.Key]
-			if !exists {
-				return "", fmt.Errorf("Error getting value from configmap %s for environment variable %s: key %s does not exist", env.ValueFrom.ConfigMapKeyRef.Name, envName, env.ValueFrom.ConfigMapKeyRef.Key)
-			}
-			return value, nil
-		} else if env.ValueFrom.SecretKeyRef != nil {
-			secret, err := c.client.CoreV1().Secrets(namespace).Get(env.ValueFrom.SecretKeyRef.Name, metav1.GetOptions{})
-			if err != nil {
-				return "", fmt.Errorf("Error getting value from secret %s for environment variable %s: %s", env.ValueFrom.SecretKeyRef.Name, envName, err.Error())
-			}
-			value, exists := secret.Data[env.ValueFrom.SecretKeyRef.Key]
-			if !exists {
-				return "", fmt.Errorf("Error getting value from secret %s for environment variable %s: key %s does not exist", env.ValueFrom.SecretKeyRef.Name, envName, env.ValueFrom.SecretKeyRef.Key)
-			}
-			decodedValue, err := base64.StdEncoding.DecodeString(string(value))
-			if err != nil {
-				return "", fmt.Errorf("Error getting value from secret %s for environment variable %s: could not decode value for %s", env.ValueFrom.SecretKeyRef.Name, envName, env.ValueFrom.SecretKeyRef.Key)
-			}
-			return string(decodedValue), nil
-		}
+// GetSecretData gets the data of a Secret. If the Secret doesn't exist, nil is returned.
+func (c ClientImpl) GetSecretData(namespace string, name string) (_ map[string][]byte, err error) {
+	defer observeCall("GetSecretData", time.Now(), &err)
+
+	secret, err := c.client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// SaveConfigMapData replaces the data of a ConfigMap, creating it if it doesn't exist
+func (c ClientImpl) SaveConfigMapData(namespace string, name string, data map[string]string) (err error) {
+	defer observeCall("SaveConfigMapData", time.Now(), &err)
+
+	configmaps := c.client.CoreV1().ConfigMaps(namespace)
+	configmap, err := configmaps.Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = configmaps.Create(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Data: data,
+		})
+		return err
+	} else if err != nil {
+		return err
 	}
-	return "", fmt.Errorf("Error getting value for environment variable %s", env.Name)
+	configmap.Data = data
+	_, err = configmaps.Update(configmap)
+	return err
 }
 
-// GetPods gets all pods attached to some workload
-func (c ClientImpl) GetPods(workload *Workload) ([]corev1.Pod, error) {
+// SaveDeployment replaces the spec, labels and owners of a Deployment, creating it if it doesn't exist
+func (c ClientImpl) SaveDeployment(deployment *appsv1.Deployment) (err error) {
+	defer observeCall("SaveDeployment", time.Now(), &err)
+
+	deployments := c.client.AppsV1().Deployments(deployment.Namespace)
+	existing, err := deployments.Get(deployment.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = deployments.Create(deployment)
+		return err
+	} else if err != nil {
+		return err
+	}
+	existing.Labels = deployment.Labels
+	existing.OwnerReferences = deployment.OwnerReferences
+	existing.Spec = deployment.Spec
+	_, err = deployments.Update(existing)
+	return err
+}
+
+// CreateEvent creates an Event on a workload
+func (c ClientImpl) CreateEvent(workload *Workload, eventType string, reason string, message string) (err error) {
+	defer observeCall("CreateEvent", time.Now(), &err)
+
+	return c.createEvent(corev1.ObjectReference{
+		APIVersion:      workload.APIVersion,
+		Kind:            workload.Kind,
+		Name:            workload.Name,
+		Namespace:       workload.Namespace,
+		UID:             workload.UID,
+		ResourceVersion: workload.ResourceVersion,
+	}, eventType, reason, message)
+}
+
+// createEvent creates an Event on an object
+func (c ClientImpl) createEvent(object corev1.ObjectReference, eventType string, reason string, message string) error {
+	now := metav1.Now()
+	_, err := c.client.CoreV1().Events(object.Namespace).Create(&corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: object.Name + ".",
+			Namespace:    object.Namespace,
+		},
+		InvolvedObject: object,
+		Type:           eventType,
+		Reason:         reason,
+		Message:        logging.Redact(message),
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source: corev1.EventSource{
+			Component: "azp-agent-autoscaler",
+		},
+	})
+	return err
+}
+
+// GetNodes gets all nodes in the cluster
+func (c ClientImpl) GetNodes() (_ []corev1.Node, err error) {
+	defer observeCall("GetNodes", time.Now(), &err)
+
+	nodes, err := c.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return nodes.Items, nil
+}
+
+// GetPriorityClassValue gets the priority of a PriorityClass
+func (c ClientImpl) GetPriorityClassValue(name string) (_ int32, err error) {
+	defer observeCall("GetPriorityClass", time.Now(), &err)
+
+	priorityClass, err := c.client.SchedulingV1().PriorityClasses().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return priorityClass.Value, nil
+}
+
+// GetResourceQuotas gets the ResourceQuotas of a namespace
+func (c ClientImpl) GetResourceQuotas(namespace string) (_ []corev1.ResourceQuota, err error) {
+	defer observeCall("GetResourceQuotas", time.Now(), &err)
+
+	quotas, err := c.client.CoreV1().ResourceQuotas(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return quotas.Items, nil
+}
+
+// GetAllPods gets all scheduled pods that haven't completed in every namespace
+func (c ClientImpl) GetAllPods() (_ []corev1.Pod, err error) {
+	defer observeCall("GetAllPods", time.Now(), &err)
+
 	listOptions := metav1.ListOptions{
-		LabelSelector: apimachinery.FormatLabelSelector(workload.PodSelector),
+		FieldSelector: "spec.nodeName!=,status.phase!=Succeeded,status.phase!=Failed",
 	}
-	pods, err := c.client.CoreV1().Pods(workload.Namespace).List(listOptions)
+	pods, err := c.client.CoreV1().Pods(metav1.NamespaceAll).List(listOptions)
 	if err != nil {
 		return nil, err
 	}
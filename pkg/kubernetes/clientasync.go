@@ -1,6 +1,8 @@
 package kubernetes
 
 import (
+	"time"
+
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
 
 	corev1 "k8s.io/api/core/v1"
@@ -19,7 +21,7 @@ type ClientAsync interface {
 	GetWorkloadAsync(channel chan<- WorkloadReturn, args args.KubernetesArgs)
 	VerifyNoHorizontalPodAutoscalerAsync(channel chan<- error, args args.KubernetesArgs)
 	ScaleAsync(channel chan<- error, resource *Workload, replicas int32)
-	GetEnvValueAsync(channel chan<- EnvValueReturn, podSpec corev1.PodSpec, namespace string, envName string)
+	GetEnvValueAsync(channel chan<- EnvValueReturn, template corev1.PodTemplateSpec, namespace string, envName string)
 	GetPodsAsync(channel chan<- Pods, workload *Workload)
 }
 
@@ -28,9 +30,9 @@ type ClientAsyncImpl struct {
 	syncClient Client
 }
 
-// MakeClient returns a ClientAsync
-func MakeClient() (ClientAsync, error) {
-	syncClient, err := makeClient()
+// MakeClient returns a ClientAsync whose requests time out after the timeout, or never if it's 0
+func MakeClient(timeout time.Duration) (ClientAsync, error) {
+	syncClient, err := makeClient(timeout)
 	if err == nil {
 		return ClientAsyncImpl{syncClient}, nil
 	}
@@ -69,9 +71,9 @@ type EnvValueReturn struct {
 	Err   error
 }
 
-// GetEnvValueAsync gets an environment variable value from a pod
-func (c ClientAsyncImpl) GetEnvValueAsync(channel chan<- EnvValueReturn, podSpec corev1.PodSpec, namespace string, envName string) {
-	value, err := c.syncClient.GetEnvValue(podSpec, namespace, envName)
+// GetEnvValueAsync gets an environment variable value from a pod template
+func (c ClientAsyncImpl) GetEnvValueAsync(channel chan<- EnvValueReturn, template corev1.PodTemplateSpec, namespace string, envName string) {
+	value, err := c.syncClient.GetEnvValue(template, namespace, envName)
 	channel <- EnvValueReturn{value, err}
 }
 
@@ -0,0 +1,51 @@
+package kubernetes
+
+import (
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// MetricsAPIGroupVersion is the API the metrics-server serves through the API aggregation layer
+const MetricsAPIGroupVersion = "metrics.k8s.io/v1beta1"
+
+// dockerHubRegistry is the registry of the images without a registry host
+const dockerHubRegistry = "registry-1.docker.io"
+
+// VerifyAPIAvailable returns an error if the API server doesn't serve an API group version, ex: when the service of an
+// aggregated API is down
+func (c ClientImpl) VerifyAPIAvailable(groupVersion string) (err error) {
+	defer observeCall("GetServerResources", time.Now(), &err)
+
+	_, err = c.client.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	return err
+}
+
+// CountReadyNodes returns the number of Ready nodes and the number of nodes. The cordoned nodes aren't counted, as
+// they're taken out of the cluster on purpose, ex: during an upgrade.
+func CountReadyNodes(nodes []corev1.Node) (int, int) {
+	ready, total := 0, 0
+	for _, node := range nodes {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		total++
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == corev1.NodeReady && condition.Status == corev1.ConditionTrue {
+				ready++
+				break
+			}
+		}
+	}
+	return ready, total
+}
+
+// ImageRegistry returns the host of the registry of an image, which is Docker Hub if the image doesn't have one
+func ImageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 || (!strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost") {
+		return dockerHubRegistry
+	}
+	return parts[0]
+}
@@ -0,0 +1,43 @@
+package kubernetes
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// deploymentRevisionAnnotation is the revision of a Deployment's latest rollout, set by the Deployment controller
+const deploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+
+// GetDeploymentWorkload creates a KubernetesWorkload from a Deployment. Its ReplicaSet removes arbitrary pods when it's
+// scaled down, so Deployments are only supported with --targeted-scale-down.
+func GetDeploymentWorkload(resource *appsv1.Deployment) *Workload {
+	workload := &Workload{
+		ObjectMeta:      resource.ObjectMeta,
+		FriendlyName:    fmt.Sprintf("deployment/%s", resource.Name),
+		PodSelector:     resource.Spec.Selector,
+		PodTemplateSpec: &resource.Spec.Template,
+	}
+	workload.Kind = "Deployment"
+	workload.APIVersion = "apps/v1"
+	return workload
+}
+
+// GetDeploymentRollingUpdate returns the rollout of a Deployment, or nil if it isn't being rolled out
+func GetDeploymentRollingUpdate(resource *appsv1.Deployment) *RollingUpdate {
+	status := resource.Status
+	if status.ObservedGeneration >= resource.Generation && status.UpdatedReplicas >= status.Replicas {
+		return nil
+	}
+	revision := resource.Annotations[deploymentRevisionAnnotation]
+	return &RollingUpdate{
+		UpdateRevision:  fmt.Sprintf("%s-%s", resource.Name, revision),
+		UpdatedReplicas: status.UpdatedReplicas,
+		Replicas:        status.Replicas,
+	}
+}
+
+func (c ClientImpl) getDeployment(namespace string, name string) (*appsv1.Deployment, error) {
+	return c.client.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{})
+}
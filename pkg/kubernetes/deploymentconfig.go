@@ -0,0 +1,101 @@
+package kubernetes
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// deploymentConfigGVR identifies OpenShift DeploymentConfigs to the dynamic client, so the OpenShift client isn't needed
+var deploymentConfigGVR = schema.GroupVersionResource{Group: "apps.openshift.io", Version: "v1", Resource: "deploymentconfigs"}
+
+// DeploymentConfig is the subset of an OpenShift DeploymentConfig the autoscaler reads
+type DeploymentConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DeploymentConfigSpec   `json:"spec"`
+	Status DeploymentConfigStatus `json:"status,omitempty"`
+}
+
+// DeploymentConfigSpec is the spec of a DeploymentConfig
+type DeploymentConfigSpec struct {
+	Replicas int32 `json:"replicas"`
+	// Selector are the labels of the pods, DeploymentConfigs don't have label selector expressions
+	Selector map[string]string      `json:"selector,omitempty"`
+	Template corev1.PodTemplateSpec `json:"template,omitempty"`
+}
+
+// DeploymentConfigStatus is the status of a DeploymentConfig
+type DeploymentConfigStatus struct {
+	// LatestVersion is the version of the latest rollout, whose ReplicationController is named <name>-<version>
+	LatestVersion      int64 `json:"latestVersion,omitempty"`
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	Replicas           int32 `json:"replicas,omitempty"`
+	UpdatedReplicas    int32 `json:"updatedReplicas,omitempty"`
+}
+
+// GetDeploymentConfigWorkload creates a KubernetesWorkload from a DeploymentConfig
+func GetDeploymentConfigWorkload(resource *DeploymentConfig) *Workload {
+	workload := &Workload{
+		ObjectMeta:      resource.ObjectMeta,
+		FriendlyName:    fmt.Sprintf("deploymentconfig/%s", resource.Name),
+		PodSelector:     &metav1.LabelSelector{MatchLabels: resource.Spec.Selector},
+		PodTemplateSpec: &resource.Spec.Template,
+	}
+	workload.Kind = "DeploymentConfig"
+	workload.APIVersion = deploymentConfigGVR.GroupVersion().String()
+	return workload
+}
+
+// GetDeploymentConfigRollingUpdate returns the rollout of a DeploymentConfig, or nil if it isn't being rolled out
+func GetDeploymentConfigRollingUpdate(resource *DeploymentConfig) *RollingUpdate {
+	status := resource.Status
+	if status.ObservedGeneration >= resource.Generation && status.UpdatedReplicas >= status.Replicas {
+		return nil
+	}
+	return &RollingUpdate{
+		CurrentRevision: fmt.Sprintf("%s-%d", resource.Name, status.LatestVersion-1),
+		UpdateRevision:  fmt.Sprintf("%s-%d", resource.Name, status.LatestVersion),
+		UpdatedReplicas: status.UpdatedReplicas,
+		Replicas:        status.Replicas,
+	}
+}
+
+func (c ClientImpl) getDeploymentConfig(namespace string, name string) (*DeploymentConfig, error) {
+	object, err := c.dynamic.Resource(deploymentConfigGVR).Namespace(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	deploymentConfig := &DeploymentConfig{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, deploymentConfig); err != nil {
+		return nil, err
+	}
+	return deploymentConfig, nil
+}
+
+// getDeploymentConfigScale returns the scale subresource of a DeploymentConfig. OpenShift serves it as an
+// extensions/v1beta1 Scale, so it's kept unstructured and only its replicas are read and changed.
+func (c ClientImpl) getDeploymentConfigScale(namespace string, name string) (*unstructured.Unstructured, int32, error) {
+	scale, err := c.dynamic.Resource(deploymentConfigGVR).Namespace(namespace).Get(name, metav1.GetOptions{}, "scale")
+	if err != nil {
+		return nil, 0, err
+	}
+	replicas, _, err := unstructured.NestedInt64(scale.Object, "spec", "replicas")
+	if err != nil {
+		return nil, 0, err
+	}
+	return scale, int32(replicas), nil
+}
+
+func (c ClientImpl) updateDeploymentConfigScale(namespace string, scale *unstructured.Unstructured, replicas int32, options metav1.UpdateOptions) error {
+	if err := unstructured.SetNestedField(scale.Object, int64(replicas), "spec", "replicas"); err != nil {
+		return err
+	}
+	_, err := c.dynamic.Resource(deploymentConfigGVR).Namespace(namespace).Update(scale, options, "scale")
+	return err
+}
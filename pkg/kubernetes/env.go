@@ -0,0 +1,124 @@
+package kubernetes
+
+import (
+	"fmt"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// EnvSource retrieves the ConfigMaps and Secrets that environment variables are read from.
+// Their data is nil if they don't exist.
+type EnvSource interface {
+	GetConfigMapData(namespace string, name string) (map[string]string, error)
+	GetSecretData(namespace string, name string) (map[string][]byte, error)
+}
+
+// metadataFieldPath matches the labels and annotations a fieldRef can select, ex: metadata.labels['app']
+var metadataFieldPath = regexp.MustCompile(`^metadata\.(labels|annotations)\['(.+)'\]$`)
+
+// ResolveEnvValue gets the value of an environment variable of the first container of a pod template that sets it,
+// either with env or envFrom. Like the kubelet, env overrides envFrom, and a later envFrom source overrides an earlier
+// one. Only the fieldRefs that are known from the pod template can be resolved.
+func ResolveEnvValue(source EnvSource, template corev1.PodTemplateSpec, namespace string, envName string) (string, error) {
+	for _, container := range template.Spec.Containers {
+		var env *corev1.EnvVar
+		for i := range container.Env {
+			if container.Env[i].Name == envName {
+				env = &container.Env[i]
+			}
+		}
+		if env != nil {
+			return resolveEnvVar(source, template, namespace, *env)
+		}
+
+		for i := len(container.EnvFrom) - 1; i >= 0; i-- {
+			value, exists, err := resolveEnvFrom(source, namespace, container.EnvFrom[i], envName)
+			if err != nil {
+				return "", fmt.Errorf("Error getting value for environment variable %s: %w", envName, err)
+			} else if exists {
+				return value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Could not retrieve environment variable %s", envName)
+}
+
+// resolveEnvVar gets the value of an environment variable
+func resolveEnvVar(source EnvSource, template corev1.PodTemplateSpec, namespace string, env corev1.EnvVar) (string, error) {
+	if env.ValueFrom == nil {
+		return env.Value, nil
+	}
+
+	if fieldRef := env.ValueFrom.FieldRef; fieldRef != nil {
+		if fieldRef.FieldPath == "metadata.namespace" {
+			return namespace, nil
+		} else if fieldRef.FieldPath == "spec.serviceAccountName" {
+			return template.Spec.ServiceAccountName, nil
+		} else if match := metadataFieldPath.FindStringSubmatch(fieldRef.FieldPath); match != nil {
+			if match[1] == "labels" {
+				return template.Labels[match[2]], nil
+			}
+			return template.Annotations[match[2]], nil
+		}
+		return "", fmt.Errorf("Error getting value for environment variable %s: fieldRef %s is only known once a pod is running", env.Name, fieldRef.FieldPath)
+	} else if env.ValueFrom.ResourceFieldRef != nil {
+		return "", fmt.Errorf("Error getting value for environment variable %s: resourceFieldRef is not supported", env.Name)
+	} else if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+		data, err := source.GetConfigMapData(namespace, ref.Name)
+		if err != nil {
+			return "", fmt.Errorf("Error getting value from configmap %s for environment variable %s: %w", ref.Name, env.Name, err)
+		}
+		value, exists := data[ref.Key]
+		if !exists && !isOptional(ref.Optional) {
+			return "", fmt.Errorf("Error getting value from configmap %s for environment variable %s: key %s does not exist", ref.Name, env.Name, ref.Key)
+		}
+		return value, nil
+	} else if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+		data, err := source.GetSecretData(namespace, ref.Name)
+		if err != nil {
+			return "", fmt.Errorf("Error getting value from secret %s for environment variable %s: %w", ref.Name, env.Name, err)
+		}
+		value, exists := data[ref.Key]
+		if !exists && !isOptional(ref.Optional) {
+			return "", fmt.Errorf("Error getting value from secret %s for environment variable %s: key %s does not exist", ref.Name, env.Name, ref.Key)
+		}
+		return string(value), nil
+	}
+	return "", fmt.Errorf("Error getting value for environment variable %s", env.Name)
+}
+
+// resolveEnvFrom gets the value of an environment variable from the ConfigMap or Secret of an envFrom source,
+// and whether the source has it
+func resolveEnvFrom(source EnvSource, namespace string, envFrom corev1.EnvFromSource, envName string) (string, bool, error) {
+	if len(envName) < len(envFrom.Prefix) || envName[:len(envFrom.Prefix)] != envFrom.Prefix {
+		return "", false, nil
+	}
+	key := envName[len(envFrom.Prefix):]
+
+	if ref := envFrom.ConfigMapRef; ref != nil {
+		data, err := source.GetConfigMapData(namespace, ref.Name)
+		if err != nil {
+			return "", false, fmt.Errorf("Error getting configmap %s: %w", ref.Name, err)
+		} else if data == nil && !isOptional(ref.Optional) {
+			return "", false, fmt.Errorf("configmap %s does not exist", ref.Name)
+		}
+		value, exists := data[key]
+		return value, exists, nil
+	} else if ref := envFrom.SecretRef; ref != nil {
+		data, err := source.GetSecretData(namespace, ref.Name)
+		if err != nil {
+			return "", false, fmt.Errorf("Error getting secret %s: %w", ref.Name, err)
+		} else if data == nil && !isOptional(ref.Optional) {
+			return "", false, fmt.Errorf("secret %s does not exist", ref.Name)
+		}
+		value, exists := data[key]
+		return string(value), exists, nil
+	}
+	return "", false, nil
+}
+
+// isOptional returns true if an optional reference is set to true
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
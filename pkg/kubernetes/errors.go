@@ -0,0 +1,94 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotImplementedKind matches the errors of a workload kind the autoscaler can't scale, with errors.Is
+var ErrNotImplementedKind = errors.New("Resource kind is not implemented")
+
+// ErrHPAConflict matches the errors of a workload that's also scaled by a HorizontalPodAutoscaler or a KEDA ScaledObject,
+// with errors.Is
+var ErrHPAConflict = errors.New("The workload is scaled by another autoscaler")
+
+// NotImplementedKindError is returned for a workload kind the autoscaler can't scale
+type NotImplementedKindError struct {
+	Kind string
+}
+
+func (e NotImplementedKindError) Error() string {
+	return fmt.Sprintf("Resource kind %s is not implemented", e.Kind)
+}
+
+// Is matches ErrNotImplementedKind
+func (e NotImplementedKindError) Is(target error) bool {
+	return target == ErrNotImplementedKind
+}
+
+// HPAConflictError is returned for a workload that's also scaled by a HorizontalPodAutoscaler or a KEDA ScaledObject,
+// so the autoscaler doesn't fight it
+type HPAConflictError struct {
+	// Workload is the friendly name of the workload
+	Workload string
+	// Controller describes the object that scales the workload, ex: HorizontalPodAutoscaler azp-agent
+	Controller string
+}
+
+func (e HPAConflictError) Error() string {
+	return fmt.Sprintf("Error: %s cannot have a %s attached for azp-agent-autoscaler to work", e.Workload, e.Controller)
+}
+
+// Is matches ErrHPAConflict
+func (e HPAConflictError) Is(target error) bool {
+	return target == ErrHPAConflict
+}
+
+// Errors are the errors of calls made concurrently, so every error is reported instead of only the first. errors.Is and
+// errors.As match any of them.
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Is matches the target with any of the errors
+func (e Errors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches the target
+func (e Errors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinErrors returns the errors that aren't nil as Errors, the error if there's only one, or nil if there are none
+func JoinErrors(errs ...error) error {
+	var joined Errors
+	for _, err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+	if len(joined) == 0 {
+		return nil
+	} else if len(joined) == 1 {
+		return joined[0]
+	}
+	return joined
+}
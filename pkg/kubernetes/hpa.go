@@ -0,0 +1,186 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// hpaCheckInterval is how long the HorizontalPodAutoscalers and KEDA ScaledObjects of a namespace are cached, as the
+// operator verifies the workload of every AzpAgentAutoscaler resource each iteration
+const hpaCheckInterval = 5 * time.Minute
+
+// hpaGVRs are the HorizontalPodAutoscaler API versions, newest first. autoscaling/v2 is served since Kubernetes 1.23,
+// and autoscaling/v1 is used on older clusters. Every version has the same scaleTargetRef.
+var hpaGVRs = []schema.GroupVersionResource{
+	{Group: "autoscaling", Version: "v2", Resource: "horizontalpodautoscalers"},
+	{Group: "autoscaling", Version: "v1", Resource: "horizontalpodautoscalers"},
+}
+
+// listOptions lists the autoscalers from the watch cache of the API server instead of etcd, as they're cached for the
+// check interval anyway
+var listOptions = metav1.ListOptions{ResourceVersion: "0"}
+
+// scaledObjectGVR is the KEDA ScaledObject resource. KEDA ScaledJobs aren't listed, as they create Jobs from a template
+// instead of scaling a workload.
+var scaledObjectGVR = schema.GroupVersionResource{Group: "keda.sh", Version: "v1alpha1", Resource: "scaledobjects"}
+
+// scaleTarget is the scaleTargetRef of a HorizontalPodAutoscaler or a KEDA ScaledObject
+type scaleTarget struct {
+	kind string
+	name string
+	// controller describes the object that scales the target, ex: HorizontalPodAutoscaler keda-hpa-azp-agent owned by ScaledObject azp-agent
+	controller string
+}
+
+// namespaceScaleTargets are the scale targets of the autoscalers of a namespace, and when they were listed
+type namespaceScaleTargets struct {
+	targets []scaleTarget
+	listed  time.Time
+}
+
+// scaleTargetsCache caches the scale targets of each namespace for the check interval. Each client has its own cache,
+// so clients of different clusters don't share their autoscalers.
+type scaleTargetsCache struct {
+	mutex      sync.Mutex
+	interval   time.Duration
+	namespaces map[string]namespaceScaleTargets
+}
+
+func newScaleTargetsCache(interval time.Duration) *scaleTargetsCache {
+	return &scaleTargetsCache{interval: interval, namespaces: make(map[string]namespaceScaleTargets)}
+}
+
+// MakeFromDynamicClient returns a Client of the custom resources and HorizontalPodAutoscalers of the dynamic client,
+// ex: a fake client, whose scale targets are cached for the check interval. Only the dynamic client is set, so the
+// methods of the core APIs can't be called.
+func MakeFromDynamicClient(dynamicClient dynamic.Interface, checkInterval time.Duration) Client {
+	return ClientImpl{dynamic: dynamicClient, scaleTargets: newScaleTargetsCache(checkInterval)}
+}
+
+// VerifyNoHorizontalPodAutoscaler returns an error if the given resource has a HorizontalPodAutoscaler or a KEDA
+// ScaledObject, so the autoscaler doesn't fight another autoscaler. The HorizontalPodAutoscalers and ScaledObjects of
+// its namespace are listed at most once per check interval.
+func (c ClientImpl) VerifyNoHorizontalPodAutoscaler(args args.KubernetesArgs) (err error) {
+	defer observeCall("VerifyNoHorizontalPodAutoscaler", time.Now(), &err)
+
+	targets, err := c.getScaleTargets(args.Namespace)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		// The kind is case-insensitive, like the workload types
+		if strings.ToLower(target.kind) == strings.ToLower(args.Type) && target.name == args.Name {
+			return HPAConflictError{Workload: args.FriendlyName(), Controller: target.controller}
+		}
+	}
+
+	return nil
+}
+
+// VerifyNoAutoscalerConflict verifies that a workload isn't scaled by a HorizontalPodAutoscaler or a KEDA ScaledObject
+// if the HPA check verifies its namespace. If the service account isn't allowed to list them and the conflicts are
+// acknowledged, the error is returned as a warning instead, so a restricted service account can still autoscale.
+func VerifyNoAutoscalerConflict(client Client, workloadArgs args.KubernetesArgs, check args.HPACheckArgs) (warning string, err error) {
+	if !check.Checks(workloadArgs.Namespace) {
+		return "", nil
+	}
+	err = client.VerifyNoHorizontalPodAutoscaler(workloadArgs)
+	if err != nil && check.Acknowledged && isForbidden(err) {
+		return fmt.Sprintf("%s in namespace %s isn't verified not to be scaled by another autoscaler: %s", workloadArgs.FriendlyName(), workloadArgs.Namespace, err.Error()), nil
+	}
+	return "", err
+}
+
+// isForbidden returns true if the error, or an error it wraps, is a Forbidden error of the Kubernetes API
+func isForbidden(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if k8serrors.IsForbidden(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// getScaleTargets returns the scale targets of the HorizontalPodAutoscalers and ScaledObjects of a namespace, listing
+// them if they weren't listed within the check interval
+func (c ClientImpl) getScaleTargets(namespace string) ([]scaleTarget, error) {
+	c.scaleTargets.mutex.Lock()
+	cached, exists := c.scaleTargets.namespaces[namespace]
+	c.scaleTargets.mutex.Unlock()
+	if exists && time.Since(cached.listed) < c.scaleTargets.interval {
+		return cached.targets, nil
+	}
+
+	// The ScaledObjects are listed first, as they describe the HorizontalPodAutoscalers that KEDA creates for them
+	targets, err := c.listScaledObjectTargets(namespace)
+	if err != nil {
+		return nil, err
+	}
+	hpaTargets, err := c.listHPATargets(namespace)
+	if err != nil {
+		return nil, err
+	}
+	targets = append(targets, hpaTargets...)
+	c.scaleTargets.mutex.Lock()
+	c.scaleTargets.namespaces[namespace] = namespaceScaleTargets{targets: targets, listed: time.Now()}
+	c.scaleTargets.mutex.Unlock()
+	return targets, nil
+}
+
+// listScaledObjectTargets lists the KEDA ScaledObjects of a namespace. There are none if KEDA isn't installed.
+func (c ClientImpl) listScaledObjectTargets(namespace string) ([]scaleTarget, error) {
+	list, err := c.dynamic.Resource(scaledObjectGVR).Namespace(namespace).List(listOptions)
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error listing the KEDA ScaledObjects in namespace %s: %w", namespace, err)
+	}
+	targets := make([]scaleTarget, 0, len(list.Items))
+	for _, item := range list.Items {
+		kind, _, _ := unstructured.NestedString(item.Object, "spec", "scaleTargetRef", "kind")
+		name, _, _ := unstructured.NestedString(item.Object, "spec", "scaleTargetRef", "name")
+		// KEDA scales a Deployment if the kind isn't set
+		if kind == "" {
+			kind = "Deployment"
+		}
+		targets = append(targets, scaleTarget{kind: kind, name: name, controller: "KEDA ScaledObject " + item.GetName()})
+	}
+	return targets, nil
+}
+
+// listHPATargets lists the HorizontalPodAutoscalers of a namespace with the newest API version the cluster serves
+func (c ClientImpl) listHPATargets(namespace string) ([]scaleTarget, error) {
+	for _, gvr := range hpaGVRs {
+		list, err := c.dynamic.Resource(gvr).Namespace(namespace).List(listOptions)
+		if k8serrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		targets := make([]scaleTarget, 0, len(list.Items))
+		for _, item := range list.Items {
+			kind, _, _ := unstructured.NestedString(item.Object, "spec", "scaleTargetRef", "kind")
+			name, _, _ := unstructured.NestedString(item.Object, "spec", "scaleTargetRef", "name")
+			controller := "HorizontalPodAutoscaler " + item.GetName()
+			// ex: KEDA and other operators create HorizontalPodAutoscalers for their own resources
+			for _, owner := range item.GetOwnerReferences() {
+				if owner.Controller != nil && *owner.Controller {
+					controller = fmt.Sprintf("%s owned by %s %s", controller, owner.Kind, owner.Name)
+				}
+			}
+			targets = append(targets, scaleTarget{kind: kind, name: name, controller: controller})
+		}
+		return targets, nil
+	}
+	return nil, fmt.Errorf("Error - the cluster doesn't serve the HorizontalPodAutoscaler API")
+}
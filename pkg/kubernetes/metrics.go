@@ -0,0 +1,55 @@
+package kubernetes
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+)
+
+var (
+	k8sDurations = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "azp_agent_autoscaler_k8s_call_duration_seconds",
+		Help: "Duration of Kubernetes calls",
+	}, []string{"operation"})
+
+	k8sCounts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_k8s_call_count",
+		Help: "Counts of Kubernetes calls",
+	}, []string{"operation"})
+
+	k8sErrorCounts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_k8s_call_error_count",
+		Help: "Counts of Kubernetes calls that returned an error",
+	}, []string{"operation"})
+)
+
+// observeCall records the duration of a Kubernetes call that started at the given time, and counts it and its error.
+// Successful calls are recorded in the status.
+func observeCall(operation string, start time.Time, err *error) {
+	labels := prometheus.Labels{"operation": operation}
+	k8sDurations.With(labels).Observe(time.Since(start).Seconds())
+	k8sCounts.With(labels).Inc()
+	if *err != nil {
+		k8sErrorCounts.With(labels).Inc()
+		if isRetryable(*err) {
+			health.RecordFailedCall("kubernetes")
+		}
+	} else {
+		health.RecordK8sContact()
+	}
+}
+
+// isRetryable returns true if a Kubernetes error is a failure that's retried, which spends the retry budget: the API
+// server not being reachable, being unavailable or throttling. Expected errors, ex: a conflict or a missing ConfigMap, aren't.
+func isRetryable(err error) bool {
+	var status k8serrors.APIStatus
+	if !errors.As(err, &status) {
+		return true
+	}
+	return k8serrors.IsTooManyRequests(err) || k8serrors.IsServerTimeout(err) || k8serrors.IsTimeout(err) || k8serrors.IsServiceUnavailable(err) || k8serrors.IsInternalError(err)
+}
@@ -0,0 +1,42 @@
+package kubernetes
+
+import (
+	"time"
+)
+
+const (
+	// OwnerAnnotation is the identity of the autoscaler that claimed a workload
+	OwnerAnnotation = "azp-agent-autoscaler/owner"
+	// OwnerRenewTimeAnnotation is when the owner of a workload last renewed its claim, in RFC 3339 format
+	OwnerRenewTimeAnnotation = "azp-agent-autoscaler/owner-renew-time"
+)
+
+// Claim is the claim of an autoscaler on a workload
+type Claim struct {
+	Owner     string
+	RenewTime time.Time
+}
+
+// GetClaim returns the claim on a workload from its annotations, or nil if it isn't claimed. A claim without a valid
+// renew time has expired.
+func GetClaim(workload *Workload) *Claim {
+	owner := workload.Annotations[OwnerAnnotation]
+	if owner == "" {
+		return nil
+	}
+	renewTime, _ := time.Parse(time.RFC3339, workload.Annotations[OwnerRenewTimeAnnotation])
+	return &Claim{Owner: owner, RenewTime: renewTime}
+}
+
+// ExpiresAt returns when the claim expires if it isn't renewed
+func (c Claim) ExpiresAt(lease time.Duration) time.Time {
+	return c.RenewTime.Add(lease)
+}
+
+// ClaimAnnotations returns the annotations that claim a workload for the owner at the given time
+func ClaimAnnotations(owner string, now time.Time) map[string]string {
+	return map[string]string{
+		OwnerAnnotation:          owner,
+		OwnerRenewTimeAnnotation: now.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,131 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// podResyncInterval is how often the cached pods of a namespace are resynced, in case a watch event was missed
+	podResyncInterval = 10 * time.Minute
+	// podCacheSyncTimeout is how long the pods of a namespace can take to be listed the first time
+	podCacheSyncTimeout = 30 * time.Second
+	// podInformerIdleTimeout is how long the pods of a namespace are watched after they were last retrieved, so the
+	// namespaces of deleted AzpAgentAutoscaler resources stop being watched
+	podInformerIdleTimeout = 30 * time.Minute
+	// podLabelIndex indexes pods by each of their labels, formatted as key=value
+	podLabelIndex = "label"
+)
+
+// podInformer watches the pods of a namespace
+type podInformer struct {
+	informer cache.SharedIndexInformer
+	stop     chan struct{}
+	lastUsed time.Time
+}
+
+var (
+	podInformers      = make(map[string]*podInformer)
+	podInformersMutex sync.Mutex
+)
+
+// indexPodLabels returns the labels of a pod formatted as key=value
+func indexPodLabels(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("Expected a pod, got %T", obj)
+	}
+	keys := make([]string, 0, len(pod.Labels))
+	for key, value := range pod.Labels {
+		keys = append(keys, key+"="+value)
+	}
+	return keys, nil
+}
+
+// getCachedPods returns the pods of a workload from the cached pods of its namespace. The pods of a namespace are
+// listed and watched the first time they're retrieved, and are looked up by a label of the workload's selector.
+func (c ClientImpl) getCachedPods(workload *Workload) ([]corev1.Pod, error) {
+	selector, err := metav1.LabelSelectorAsSelector(workload.PodSelector)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the pod selector of %s: %w", workload.FriendlyName, err)
+	}
+	informer, err := c.getPodInformer(workload.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []interface{}
+	if workload.PodSelector != nil && len(workload.PodSelector.MatchLabels) > 0 {
+		for key, value := range workload.PodSelector.MatchLabels {
+			objects, err = informer.GetIndexer().ByIndex(podLabelIndex, key+"="+value)
+			break
+		}
+	} else {
+		objects = informer.GetStore().List()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pods := make([]corev1.Pod, 0, len(objects))
+	for _, object := range objects {
+		pod := object.(*corev1.Pod)
+		if selector.Matches(labels.Set(pod.Labels)) {
+			pods = append(pods, *pod)
+		}
+	}
+	// Listing the pods returns them by name
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Name < pods[j].Name
+	})
+	return pods, nil
+}
+
+// getPodInformer returns the informer of the pods of a namespace, starting it if it isn't running. The informers of
+// the namespaces that weren't used within the idle timeout are stopped.
+func (c ClientImpl) getPodInformer(namespace string) (cache.SharedIndexInformer, error) {
+	podInformersMutex.Lock()
+	defer podInformersMutex.Unlock()
+
+	now := time.Now()
+	for otherNamespace, informer := range podInformers {
+		if otherNamespace != namespace && now.Sub(informer.lastUsed) >= podInformerIdleTimeout {
+			close(informer.stop)
+			delete(podInformers, otherNamespace)
+		}
+	}
+	if informer, exists := podInformers[namespace]; exists {
+		informer.lastUsed = now
+		return informer.informer, nil
+	}
+
+	pods := c.client.CoreV1().Pods(namespace)
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return pods.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return pods.Watch(options)
+		},
+	}, &corev1.Pod{}, podResyncInterval, cache.Indexers{podLabelIndex: indexPodLabels})
+	stop := make(chan struct{})
+	go informer.Run(stop)
+	if err := wait.PollImmediate(100*time.Millisecond, podCacheSyncTimeout, func() (bool, error) {
+		return informer.HasSynced(), nil
+	}); err != nil {
+		close(stop)
+		return nil, fmt.Errorf("Error listing the pods in namespace %s: the pods weren't retrieved within %s", namespace, podCacheSyncTimeout.String())
+	}
+	podInformers[namespace] = &podInformer{informer: informer, stop: stop, lastUsed: now}
+	return informer, nil
+}
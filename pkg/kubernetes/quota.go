@@ -0,0 +1,186 @@
+package kubernetes
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// resourceCountPods is the object count quota of the pods of a namespace
+const resourceCountPods corev1.ResourceName = "count/pods"
+
+// QuotaLimit is how many more pods a ResourceQuota allows, and the resource of the quota that limits them
+type QuotaLimit struct {
+	Pods     int32
+	Quota    string
+	Resource corev1.ResourceName
+}
+
+func (l QuotaLimit) String() string {
+	return fmt.Sprintf("ResourceQuota %s allows %d more agent pods by %s", l.Quota, l.Pods, l.Resource)
+}
+
+// EstimateQuotaPods estimates how many more pods with the given spec the ResourceQuotas of their namespace allow, from
+// the hard limits and the usage in the status of the quotas. Only the quotas whose scopes match the pods are counted.
+// It returns nil if no quota limits the pods.
+func EstimateQuotaPods(quotas []corev1.ResourceQuota, podSpec corev1.PodSpec) *QuotaLimit {
+	usage := getPodQuotaUsage(podSpec)
+
+	var limit *QuotaLimit
+	for _, quota := range quotas {
+		if !matchesQuotaScopes(quota.Spec, podSpec) {
+			continue
+		}
+		// The resources are sorted, so the same resource is reported if several limit the pods as much
+		names := make([]string, 0, len(quota.Status.Hard))
+		for name := range quota.Status.Hard {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			podUsage := usage[corev1.ResourceName(name)]
+			if podUsage.IsZero() {
+				continue
+			}
+			hard := quota.Status.Hard[corev1.ResourceName(name)]
+			used := quota.Status.Used[corev1.ResourceName(name)]
+			pods := int64(0)
+			if free := hard.MilliValue() - used.MilliValue(); free > 0 {
+				pods = free / podUsage.MilliValue()
+			}
+			if pods > math.MaxInt32 {
+				pods = math.MaxInt32
+			}
+			if limit == nil || int32(pods) < limit.Pods {
+				limit = &QuotaLimit{Pods: int32(pods), Quota: quota.Name, Resource: corev1.ResourceName(name)}
+			}
+		}
+	}
+	return limit
+}
+
+// getPodQuotaUsage returns the quota resources a pod with the given spec uses: the pod itself, and the requests and
+// limits of its containers. A container without a request for a limited resource requests its limit, like the API server
+// defaults it to.
+func getPodQuotaUsage(podSpec corev1.PodSpec) corev1.ResourceList {
+	usage := corev1.ResourceList{
+		corev1.ResourcePods: *resource.NewQuantity(1, resource.DecimalSI),
+		resourceCountPods:   *resource.NewQuantity(1, resource.DecimalSI),
+	}
+	requests := getPodResources(podSpec, func(container corev1.Container) corev1.ResourceList {
+		requests := corev1.ResourceList{}
+		for name, quantity := range container.Resources.Limits {
+			requests[name] = quantity
+		}
+		for name, quantity := range container.Resources.Requests {
+			requests[name] = quantity
+		}
+		return requests
+	})
+	for name, quantity := range requests {
+		usage[corev1.ResourceName("requests."+name)] = quantity
+		// The standard resources can also be limited without the requests prefix
+		if name == corev1.ResourceCPU || name == corev1.ResourceMemory || name == corev1.ResourceEphemeralStorage {
+			usage[name] = quantity
+		}
+	}
+	limits := getPodResources(podSpec, func(container corev1.Container) corev1.ResourceList {
+		return container.Resources.Limits
+	})
+	for name, quantity := range limits {
+		usage[corev1.ResourceName("limits."+name)] = quantity
+	}
+	return usage
+}
+
+// getPodResources returns the total resources of the containers of a pod spec.
+// Init containers run before the containers, so the largest init container resource is used if it is bigger.
+func getPodResources(podSpec corev1.PodSpec, containerResources func(container corev1.Container) corev1.ResourceList) corev1.ResourceList {
+	resources := corev1.ResourceList{}
+	for _, container := range podSpec.Containers {
+		for name, quantity := range containerResources(container) {
+			total := resources[name]
+			total.Add(quantity)
+			resources[name] = total
+		}
+	}
+	for _, container := range podSpec.InitContainers {
+		for name, quantity := range containerResources(container) {
+			if quantity.Cmp(resources[name]) > 0 {
+				resources[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	return resources
+}
+
+// matchesQuotaScopes returns true if a ResourceQuota with the given scopes applies to the pods with the given spec
+func matchesQuotaScopes(quotaSpec corev1.ResourceQuotaSpec, podSpec corev1.PodSpec) bool {
+	for _, scope := range quotaSpec.Scopes {
+		if !matchesQuotaScope(scope, corev1.ScopeSelectorOpExists, nil, podSpec) {
+			return false
+		}
+	}
+	if quotaSpec.ScopeSelector != nil {
+		for _, requirement := range quotaSpec.ScopeSelector.MatchExpressions {
+			if !matchesQuotaScope(requirement.ScopeName, requirement.Operator, requirement.Values, podSpec) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchesQuotaScope returns true if the pods with the given spec match a scope of a ResourceQuota. Unknown scopes don't
+// match, ex: the pods with cross-namespace affinity terms, which the agents aren't expected to have.
+func matchesQuotaScope(scope corev1.ResourceQuotaScope, operator corev1.ScopeSelectorOperator, values []string, podSpec corev1.PodSpec) bool {
+	if scope == corev1.ResourceQuotaScopePriorityClass {
+		switch operator {
+		case corev1.ScopeSelectorOpIn:
+			return containsString(values, podSpec.PriorityClassName)
+		case corev1.ScopeSelectorOpNotIn:
+			return !containsString(values, podSpec.PriorityClassName)
+		case corev1.ScopeSelectorOpDoesNotExist:
+			return podSpec.PriorityClassName == ""
+		default:
+			return podSpec.PriorityClassName != ""
+		}
+	}
+
+	var matches bool
+	switch scope {
+	case corev1.ResourceQuotaScopeTerminating:
+		matches = podSpec.ActiveDeadlineSeconds != nil
+	case corev1.ResourceQuotaScopeNotTerminating:
+		matches = podSpec.ActiveDeadlineSeconds == nil
+	case corev1.ResourceQuotaScopeBestEffort:
+		matches = isBestEffort(podSpec)
+	case corev1.ResourceQuotaScopeNotBestEffort:
+		matches = !isBestEffort(podSpec)
+	default:
+		return false
+	}
+	if operator == corev1.ScopeSelectorOpDoesNotExist {
+		return !matches
+	}
+	return matches
+}
+
+// isBestEffort returns true if the pods with the given spec have the BestEffort QoS class, as none of their containers
+// request or limit CPU or memory
+func isBestEffort(podSpec corev1.PodSpec) bool {
+	for _, container := range append(append([]corev1.Container{}, podSpec.InitContainers...), podSpec.Containers...) {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if _, exists := container.Resources.Requests[name]; exists {
+				return false
+			}
+			if _, exists := container.Resources.Limits[name]; exists {
+				return false
+			}
+		}
+	}
+	return true
+}
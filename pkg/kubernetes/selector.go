@@ -0,0 +1,53 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ForeignPods returns the pods matched by the pod selector of a workload that aren't controlled by it, ex: the pods of
+// another workload whose labels overlap, or pods created without a workload
+func ForeignPods(workload *Workload, pods []corev1.Pod) []corev1.Pod {
+	var foreign []corev1.Pod
+	for _, pod := range pods {
+		owner := metav1.GetControllerOf(&pod)
+		if owner == nil || !isOwner(workload, *owner) {
+			foreign = append(foreign, pod)
+		}
+	}
+	return foreign
+}
+
+// isOwner returns true if the owner reference is to the workload. The UID is compared when both have one, as a workload
+// can be recreated with the same name.
+func isOwner(workload *Workload, owner metav1.OwnerReference) bool {
+	if owner.UID != "" && workload.UID != "" {
+		return owner.UID == workload.UID
+	}
+	return strings.EqualFold(owner.Kind, workload.Kind) && owner.Name == workload.Name
+}
+
+// OverlappingSelectors returns a message for each workload whose pod selector matches the pods of another workload in
+// the same namespace, from the labels of their pod templates, as the pods of both would be counted as its agents
+func OverlappingSelectors(workloads []*Workload) ([]string, error) {
+	var overlaps []string
+	for _, workload := range workloads {
+		selector, err := metav1.LabelSelectorAsSelector(workload.PodSelector)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing the pod selector of %s: %w", workload.FriendlyName, err)
+		}
+		for _, other := range workloads {
+			if other == workload || other.Namespace != workload.Namespace || other.PodTemplateSpec == nil {
+				continue
+			}
+			if selector.Matches(labels.Set(other.PodTemplateSpec.Labels)) {
+				overlaps = append(overlaps, fmt.Sprintf("The pod selector %s of %s also matches the pods of %s", selector.String(), workload.FriendlyName, other.FriendlyName))
+			}
+		}
+	}
+	return overlaps, nil
+}
@@ -0,0 +1,81 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+)
+
+// VerifiedWorkload is a workload retrieved by VerifyWorkload, and its pods
+type VerifiedWorkload struct {
+	Workload *Workload
+	Pods     []corev1.Pod
+	// Warning is why the workload wasn't verified not to be scaled by another autoscaler, if the conflicts were
+	// acknowledged
+	Warning string
+}
+
+// VerifyWorkload retrieves a workload, verifies it isn't scaled by a HorizontalPodAutoscaler or a KEDA ScaledObject with
+// the HPA check, and lists its pods. The workload and its autoscalers are retrieved concurrently, and the pods as soon as the workload is,
+// all within the deadline if it isn't 0, so a remote API server's latency is waited on twice instead of three times.
+// The errors of every call are returned together as Errors.
+func VerifyWorkload(client ClientAsync, workloadArgs args.KubernetesArgs, hpaCheck args.HPACheckArgs, deadline time.Duration) (VerifiedWorkload, error) {
+	ctx := context.Background()
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+
+	// The channels are buffered so the calls still finish once the deadline passed
+	workloadChan := make(chan WorkloadReturn, 1)
+	verifyHPAChan := make(chan hpaCheckResponse, 1)
+	podsChan := make(chan Pods, 1)
+	go client.GetWorkloadAsync(workloadChan, workloadArgs)
+	go func() {
+		warning, err := VerifyNoAutoscalerConflict(client.Sync(), workloadArgs, hpaCheck)
+		verifyHPAChan <- hpaCheckResponse{warning, err}
+	}()
+
+	var verified VerifiedWorkload
+	var errs []error
+	for pending := 2; pending > 0; pending-- {
+		select {
+		case workload := <-workloadChan:
+			if workload.Err != nil {
+				errs = append(errs, fmt.Errorf("Error retrieving %s in namespace %s: %w", workloadArgs.FriendlyName(), workloadArgs.Namespace, workload.Err))
+				continue
+			}
+			verified.Workload = workload.Resource
+			go client.GetPodsAsync(podsChan, workload.Resource)
+			pending++
+		case hpaCheck := <-verifyHPAChan:
+			if hpaCheck.Err != nil {
+				errs = append(errs, hpaCheck.Err)
+			}
+			verified.Warning = hpaCheck.Warning
+		case pods := <-podsChan:
+			if pods.Err != nil {
+				errs = append(errs, fmt.Errorf("Error retrieving the pods of %s: %w", verified.Workload.FriendlyName, pods.Err))
+			}
+			verified.Pods = pods.Pods
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("Error - %s in namespace %s wasn't verified within %s", workloadArgs.FriendlyName(), workloadArgs.Namespace, deadline.String()))
+			return VerifiedWorkload{}, JoinErrors(errs...)
+		}
+	}
+	if len(errs) > 0 {
+		return VerifiedWorkload{}, JoinErrors(errs...)
+	}
+	return verified, nil
+}
+
+// hpaCheckResponse is a wrapper for the warning of VerifyNoAutoscalerConflict to allow also returning an error in channels
+type hpaCheckResponse struct {
+	Warning string
+	Err     error
+}
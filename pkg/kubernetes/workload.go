@@ -44,3 +44,86 @@ func GetWorkload(resource *appsv1.StatefulSet) (*Workload, error) {
 
 	return &copy, err
 }
+
+// RollingUpdate is an update of the pod template of a workload that is being rolled out to its pods
+type RollingUpdate struct {
+	CurrentRevision string
+	UpdateRevision  string
+	// UpdatedReplicas are the number of pods that have the updated pod template
+	UpdatedReplicas int32
+	Replicas        int32
+	// OnDelete is true if the StatefulSet has the OnDelete update strategy, so its pods are only updated as they're deleted
+	OnDelete bool
+}
+
+// InProgress returns true if the update is being rolled out to the pods by the StatefulSet controller, which isn't the
+// case with the OnDelete update strategy
+func (u *RollingUpdate) InProgress() bool {
+	return u != nil && !u.OnDelete
+}
+
+// GetRollingUpdate returns the rolling update of a StatefulSet, or nil if it isn't being updated. StatefulSets updated
+// with a partition are only partially updated, so they aren't rolling updates. StatefulSets updated with the OnDelete
+// strategy are only updated as their pods are deleted, so their updates aren't in progress.
+func GetRollingUpdate(resource *appsv1.StatefulSet) *RollingUpdate {
+	strategy := resource.Spec.UpdateStrategy
+	onDelete := strategy.Type == appsv1.OnDeleteStatefulSetStrategyType
+	if !onDelete && strategy.RollingUpdate != nil && strategy.RollingUpdate.Partition != nil && *strategy.RollingUpdate.Partition > 0 {
+		return nil
+	}
+
+	status := resource.Status
+	if status.ObservedGeneration >= resource.Generation && status.CurrentRevision == status.UpdateRevision && status.UpdatedReplicas >= status.Replicas {
+		return nil
+	}
+	return &RollingUpdate{
+		CurrentRevision: status.CurrentRevision,
+		UpdateRevision:  status.UpdateRevision,
+		UpdatedReplicas: status.UpdatedReplicas,
+		Replicas:        status.Replicas,
+		OnDelete:        onDelete,
+	}
+}
+
+// IsOutdatedPod returns true if a pod of a StatefulSet doesn't have the pod template of the update
+func (u RollingUpdate) IsOutdatedPod(pod corev1.Pod) bool {
+	revision, hasRevision := pod.Labels[appsv1.StatefulSetRevisionLabel]
+	return hasRevision && revision != u.UpdateRevision
+}
+
+// OS returns the operating system of the pods of a workload from the kubernetes.io/os node selector of its pod template.
+// Without the node selector, the pods are assumed to run on Linux, as Windows nodes are usually tainted.
+func (w Workload) OS() string {
+	if w.PodTemplateSpec != nil {
+		for _, label := range []string{"kubernetes.io/os", "beta.kubernetes.io/os"} {
+			if os := w.PodTemplateSpec.Spec.NodeSelector[label]; os != "" {
+				return strings.ToLower(os)
+			}
+		}
+	}
+	return "linux"
+}
+
+// DetectWorkloadType returns the kind of the workload with the given name in the namespace, for when --type isn't set.
+// It's an error if there's no such workload, if it's a Deployment, whose scale downs remove arbitrary pods unless
+// they're targeted, or if more than one kind of workload has the name, as it's ambiguous which one the agents run in.
+func DetectWorkloadType(client Client, namespace string, name string) (string, error) {
+	kinds, err := client.GetWorkloadKinds(namespace, name)
+	if err != nil {
+		return "", fmt.Errorf("Error detecting the kind of workload %s in namespace %s: %w", name, namespace, err)
+	}
+	switch {
+	case len(kinds) == 0:
+		return "", fmt.Errorf("Could not find a StatefulSet, DeploymentConfig or Deployment named %s in namespace %s", name, namespace)
+	case len(kinds) > 1:
+		return "", fmt.Errorf("More than one workload is named %s in namespace %s (%s), set --type to the kind of the agents workload", name, namespace, strings.Join(kinds, ", "))
+	case !IsSupportedWorkloadType(kinds[0]):
+		return "", fmt.Errorf("%s/%s in namespace %s is a %s, only StatefulSets and DeploymentConfigs are supported, or Deployments with --type=Deployment and --targeted-scale-down", strings.ToLower(kinds[0]), name, namespace, kinds[0])
+	}
+	return kinds[0], nil
+}
+
+// IsSupportedWorkloadType returns true if the agents can be deployed in a workload of the given kind
+func IsSupportedWorkloadType(kind string) bool {
+	return kind == "StatefulSet" || kind == "DeploymentConfig"
+}
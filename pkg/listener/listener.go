@@ -0,0 +1,90 @@
+package listener
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+var logger = logging.Component("listener")
+
+// TLSConfig returns a TLS config that loads the certificate from its files on every handshake, so a renewed certificate,
+// ex: in a mounted Secret, is served without a restart. If the client CA file is set, the client certificates are
+// verified with it, and the client auth type sets whether they're required.
+func TLSConfig(name string, certFile string, keyFile string, clientCAFile string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				logger.Errorf("Error loading the %s certificate: %s", name, err.Error())
+				return nil, err
+			}
+			return &certificate, nil
+		},
+	}
+	if clientCAFile != "" {
+		clientCA, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the %s client CA: %w", name, err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(clientCA) {
+			return nil, fmt.Errorf("The %s client CA %s doesn't have a PEM certificate", name, clientCAFile)
+		}
+		config.ClientAuth = clientAuth
+	}
+	return config, nil
+}
+
+// ListenAndServe serves a handler on a port, over TLS if the TLS args have a certificate. The client certificates are
+// verified if they're given, so the handler can be authenticated with Authenticate.
+func ListenAndServe(name string, port int, handler http.Handler, tlsArgs args.TLSArgs) error {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler,
+	}
+	if !tlsArgs.Enabled() {
+		return server.ListenAndServe()
+	}
+	tlsConfig, err := TLSConfig(name, tlsArgs.CertFile, tlsArgs.KeyFile, tlsArgs.ClientCAFile, tls.VerifyClientCertIfGiven)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = tlsConfig
+	// The certificate is loaded by the TLS config
+	return server.ListenAndServeTLS("", "")
+}
+
+// HasClientCertificate returns true if a request has a client certificate verified by the TLS config of its listener
+func HasClientCertificate(request *http.Request) bool {
+	return request.TLS != nil && len(request.TLS.VerifiedChains) > 0
+}
+
+// Authenticate returns a handler that requires the bearer token, or a verified client certificate if clientCertificates
+// is true, on every request. The requests aren't authenticated if neither is required.
+func Authenticate(handler http.Handler, token string, clientCertificates bool) http.Handler {
+	if token == "" && !clientCertificates {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if clientCertificates && HasClientCertificate(request) {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		header := request.Header.Get("Authorization")
+		if token != "" && strings.HasPrefix(header, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1 {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		writer.Header().Set("WWW-Authenticate", `Bearer realm="azp-agent-autoscaler"`)
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+	})
+}
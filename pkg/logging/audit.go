@@ -0,0 +1,32 @@
+package logging
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditLogger logs a structured record of every scaling decision. It is nil unless InitAuditLogger is called.
+var AuditLogger *log.Logger
+
+// InitAuditLogger creates the AuditLogger, which writes JSON to the given file, or to stdout if the path is "-"
+func InitAuditLogger(path string) error {
+	out := os.Stdout
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	AuditLogger = &log.Logger{
+		Out:          out,
+		Formatter:    redactingFormatter{&log.JSONFormatter{}},
+		Hooks:        make(log.LevelHooks),
+		Level:        log.InfoLevel,
+		ExitFunc:     os.Exit,
+		ReportCaller: false,
+	}
+	return nil
+}
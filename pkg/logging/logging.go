@@ -1,20 +1,101 @@
 package logging
 
 import (
+	"io"
 	"os"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// FormatText logs human readable lines
+	FormatText = "text"
+	// FormatJSON logs a JSON object per line
+	FormatJSON = "json"
+)
+
+// Components are the names of the components that can have their own log level
+var Components = []string{"main", "scaling", "health", "tracing", "appinsights", "notify", "admin", "cloudevents", "secrets", "operator", "autoscaler"}
+
 // Logger is the logger to use in azp-agent-autoscaler
-var Logger = log.Logger{
-	Out: os.Stderr,
-	Formatter: &log.TextFormatter{
+var Logger = newLogger("main", log.InfoLevel)
+
+var (
+	// componentsMutex guards the loggers of the components and their config, as packages can create their loggers concurrently
+	componentsMutex sync.Mutex
+	components                = map[string]*log.Logger{"main": Logger}
+	componentLevels           = map[string]log.Level{}
+	formatter                 = newFormatter(FormatText)
+	output          io.Writer = os.Stderr
+)
+
+func newLogger(component string, level log.Level) *log.Logger {
+	return &log.Logger{
+		Out:          output,
+		Formatter:    samplingFormatter{Formatter: formatter, component: component},
+		Hooks:        make(log.LevelHooks),
+		Level:        level,
+		ExitFunc:     os.Exit,
+		ReportCaller: false,
+	}
+}
+
+// newFormatter returns the formatter of a log format, which redacts the credentials
+func newFormatter(format string) log.Formatter {
+	if format == FormatJSON {
+		return redactingFormatter{&log.JSONFormatter{}}
+	}
+	return redactingFormatter{&log.TextFormatter{
 		DisableColors: true,
 		FullTimestamp: true,
-	},
-	Hooks:        make(log.LevelHooks),
-	Level:        log.InfoLevel,
-	ExitFunc:     os.Exit,
-	ReportCaller: false,
+	}}
+}
+
+// Component returns the logger of a component, which uses the component's log level if one is configured
+func Component(name string) *log.Logger {
+	componentsMutex.Lock()
+	defer componentsMutex.Unlock()
+	logger, exists := components[name]
+	if !exists {
+		logger = newLogger(name, Logger.Level)
+		if level, hasLevel := componentLevels[name]; hasLevel {
+			logger.SetLevel(level)
+		}
+		components[name] = logger
+	}
+	return logger
+}
+
+// Configure sets the format and level of every logger. Components without a configured level use the default level.
+// It should be called before logging concurrently.
+func Configure(format string, level log.Level, levels map[string]log.Level) {
+	componentsMutex.Lock()
+	defer componentsMutex.Unlock()
+	componentLevels = levels
+	formatter = newFormatter(format)
+	for name, logger := range components {
+		logger.Formatter = samplingFormatter{Formatter: formatter, component: name}
+		if componentLevel, hasLevel := levels[name]; hasLevel {
+			logger.SetLevel(componentLevel)
+		} else {
+			logger.SetLevel(level)
+		}
+	}
+}
+
+// SetOutputFile makes every logger append to the file instead of stderr, ex: when running as a Windows service, which
+// has no console. It should be called before logging concurrently.
+func SetOutputFile(path string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	componentsMutex.Lock()
+	defer componentsMutex.Unlock()
+	output = file
+	for _, logger := range components {
+		logger.SetOutput(file)
+	}
+	return nil
 }
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces a credential in the logs, errors and statuses
+const Redacted = "<redacted>"
+
+// minRedactedLength is the shortest secret that is redacted wherever it appears. Shorter values, ex: a placeholder
+// token in a test, would redact unrelated words.
+const minRedactedLength = 8
+
+// redactedPatterns are the credentials that are redacted without being known, as the HTTP clients commonly include them
+// in their errors: the value of an Authorization header, the bearer and basic credentials, a token in a query string
+// and the password of a URL. A pattern is only matched if the lowercased value contains one of its keywords, as matching
+// every log line against the patterns is slow.
+var redactedPatterns = []struct {
+	keywords    []string
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{[]string{"authorization", "private-token", "x-api-key"}, regexp.MustCompile(`(?i)((?:authorization|private-token|x-api-key)["']?\s*[:=]\s*["']?)(?:(?:bearer|basic|token)\s+)?[^\s"',;}\]]+`), "${1}" + Redacted},
+	{[]string{"bearer", "basic"}, regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9\-._~+/]{8,}=*`), "${1} " + Redacted},
+	{[]string{"token=", "sig=", "code="}, regexp.MustCompile(`(?i)([?&](?:access_token|token|private_token|sig|code)=)[^&\s"']+`), "${1}" + Redacted},
+	{[]string{"@"}, regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), "${1}" + Redacted + "@"},
+}
+
+var (
+	secretsLock sync.RWMutex
+	// secrets are the known credentials, longest first so a secret containing another one is redacted whole
+	secrets []string
+)
+
+// RedactSecret makes Redact replace a credential wherever it appears, ex: the Azure Devops token or the bearer token
+// of the kubeconfig. It's safe to call concurrently, and values shorter than 8 characters are ignored.
+func RedactSecret(secret string) {
+	secret = strings.TrimSpace(secret)
+	if len(secret) < minRedactedLength {
+		return
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	for _, known := range secrets {
+		if known == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+	sort.SliceStable(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Redact replaces the known secrets and the credentials of the HTTP clients' errors in a log line, error or status
+func Redact(value string) string {
+	if value == "" {
+		return value
+	}
+	secretsLock.RLock()
+	for _, secret := range secrets {
+		value = strings.ReplaceAll(value, secret, Redacted)
+	}
+	secretsLock.RUnlock()
+	lowered := strings.ToLower(value)
+	for _, redacted := range redactedPatterns {
+		if containsAny(lowered, redacted.keywords) {
+			value = redacted.pattern.ReplaceAllString(value, redacted.replacement)
+		}
+	}
+	return value
+}
+
+// containsAny returns if the value contains any of the substrings
+func containsAny(value string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(value, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactingFormatter redacts the credentials of every formatted entry, including its fields and errors
+type redactingFormatter struct {
+	log.Formatter
+}
+
+func (f redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	formatted, err := f.Formatter.Format(entry)
+	if err != nil || len(formatted) == 0 {
+		return formatted, err
+	}
+	return []byte(Redact(string(formatted))), nil
+}
@@ -0,0 +1,122 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSampledMessages is the number of distinct messages tracked before expired ones are removed
+const maxSampledMessages = 1000
+
+var (
+	loggedErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_logged_errors_count",
+		Help: "The total number of errors and warnings, including the ones that weren't logged because of sampling",
+	}, []string{"component", "level"})
+	suppressedLogsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_suppressed_logs_count",
+		Help: "The total number of repeated errors and warnings that weren't logged because of sampling",
+	}, []string{"component", "level"})
+)
+
+// logSampler limits how often the same error or warning is logged.
+// The first occurrences of a message within the window are logged, the rest are counted,
+// and the next occurrence after the window is logged with the number of times it was seen.
+type logSampler struct {
+	first  int
+	window time.Duration
+
+	mutex    sync.Mutex
+	messages map[string]*sampledMessage
+}
+
+type sampledMessage struct {
+	windowStart time.Time
+	count       int
+}
+
+var sampler = &logSampler{messages: make(map[string]*sampledMessage)}
+
+// ConfigureSampling logs the first occurrences of an error or warning within the window, then summarizes the repeats.
+// Sampling is disabled if first is 0.
+func ConfigureSampling(first int, window time.Duration) {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+	sampler.first = first
+	sampler.window = window
+	sampler.messages = make(map[string]*sampledMessage)
+}
+
+// sample returns whether a message should be logged, and if it was suppressed in the previous window, how many times it was seen then
+func (s *logSampler) sample(key string, now time.Time) (bool, int, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.first <= 0 {
+		return true, 0, s.window
+	}
+
+	message, exists := s.messages[key]
+	if !exists || now.Sub(message.windowStart) >= s.window {
+		previousCount := 0
+		if exists && message.count > s.first {
+			previousCount = message.count
+		}
+		if !exists && len(s.messages) >= maxSampledMessages {
+			s.removeExpired(now)
+		}
+		s.messages[key] = &sampledMessage{windowStart: now, count: 1}
+		return true, previousCount, s.window
+	}
+
+	message.count++
+	return message.count <= s.first, 0, s.window
+}
+
+// removeExpired removes the messages whose window has passed
+func (s *logSampler) removeExpired(now time.Time) {
+	for key, message := range s.messages {
+		if now.Sub(message.windowStart) >= s.window {
+			delete(s.messages, key)
+		}
+	}
+}
+
+// samplingFormatter samples the errors and warnings of a component before formatting them.
+// Suppressed entries are formatted to nothing, so they aren't written.
+type samplingFormatter struct {
+	log.Formatter
+	component string
+}
+
+func (f samplingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	// Panics and fatal errors are always logged
+	if entry.Level != log.ErrorLevel && entry.Level != log.WarnLevel {
+		return f.Formatter.Format(entry)
+	}
+
+	level := entry.Level.String()
+	loggedErrorsCounter.WithLabelValues(f.component, level).Inc()
+
+	shouldLog, previousCount, window := sampler.sample(f.component+"|"+level+"|"+entry.Message, entry.Time)
+	if !shouldLog {
+		suppressedLogsCounter.WithLabelValues(f.component, level).Inc()
+		return nil, nil
+	}
+	if previousCount > 0 {
+		summary := *entry
+		summary.Data = make(log.Fields, len(entry.Data)+1)
+		for key, value := range entry.Data {
+			summary.Data[key] = value
+		}
+		summary.Data["repeated"] = previousCount
+		summary.Message = fmt.Sprintf("%s (seen %d times in the last %s)", entry.Message, previousCount, window.String())
+		return f.Formatter.Format(&summary)
+	}
+	return f.Formatter.Format(entry)
+}
@@ -0,0 +1,247 @@
+package metricsadapter
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/listener"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+var logger = logging.Component("metricsadapter")
+
+const (
+	// Group is the API group served by the adapter
+	Group = "external.metrics.k8s.io"
+	// Version is the API version served by the adapter
+	Version  = "v1beta1"
+	basePath = "/apis/" + Group + "/" + Version
+)
+
+// The metrics served by the adapter
+const (
+	// MetricQueuedJobs is the number of jobs waiting for an agent
+	MetricQueuedJobs = "azp_pool_queued_jobs"
+	// MetricBusyAgents is the number of agents running a job
+	MetricBusyAgents = "azp_pool_busy_agents"
+	// MetricRequiredAgents is the number of agents needed for the busy agents and queued jobs, see scaling.ExternalDemand
+	MetricRequiredAgents = "azp_pool_required_agents"
+)
+
+var metricNames = []string{MetricQueuedJobs, MetricBusyAgents, MetricRequiredAgents}
+
+const (
+	// poolLabel is the label of the agent pool name in the metric selector, which is required
+	poolLabel = "pool"
+	// statefulSetLabel is the label of the agents' StatefulSet in the metric selector. If it is set, only its agents are counted
+	// and scale downs keep its busy agents.
+	statefulSetLabel = "statefulSet"
+)
+
+// ExternalMetricValueList is the response of an external metric
+type ExternalMetricValueList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []ExternalMetricValue `json:"items"`
+}
+
+// ExternalMetricValue is the value of an external metric with its labels
+type ExternalMetricValue struct {
+	MetricName   string            `json:"metricName"`
+	MetricLabels map[string]string `json:"metricLabels"`
+	Timestamp    metav1.Time       `json:"timestamp"`
+	Value        resource.Quantity `json:"value"`
+}
+
+// Adapter serves the agent pool metrics with the external metrics API, so a HorizontalPodAutoscaler scales the agents
+// instead of the autoscaler. The Kubernetes API aggregator proxies the API to it, see the metrics adapter section of the README.
+type Adapter struct {
+	lock    sync.RWMutex
+	backend ci.Backend
+	args    args.Args
+}
+
+// NewAdapter creates a metrics adapter that retrieves the agent pools with the CI backend
+func NewAdapter(backend ci.Backend, args args.Args) *Adapter {
+	return &Adapter{backend: backend, args: args}
+}
+
+// Set replaces the CI backend and the arguments when the config is reloaded
+func (a *Adapter) Set(backend ci.Backend, args args.Args) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.backend, a.args = backend, args
+}
+
+// Handler returns the routes of the external metrics API and its discovery
+func (a *Adapter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis", get(apiGroupList))
+	mux.HandleFunc("/apis/"+Group, get(apiGroup))
+	mux.HandleFunc(basePath, get(apiResourceList))
+	mux.HandleFunc(basePath+"/", get(a.metric))
+	return mux
+}
+
+// TLSConfig returns a TLS config that loads the certificate from its files on every handshake, so a renewed certificate
+// is served without a restart. If the client CA is set, requests must have a client certificate signed by it.
+func TLSConfig(adapterArgs args.MetricsAdapterArgs) (*tls.Config, error) {
+	return listener.TLSConfig("metrics adapter", adapterArgs.CertFile, adapterArgs.KeyFile, adapterArgs.ClientCAFile, tls.RequireAndVerifyClientCert)
+}
+
+// handlerFunc handles a request, returning the response body or an HTTP status and error
+type handlerFunc func(request *http.Request) (interface{}, int, error)
+
+func get(handler handlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var response interface{}
+		status, err := http.StatusOK, error(nil)
+		if request.Method != http.MethodGet {
+			writer.Header().Set("Allow", http.MethodGet)
+			status, err = http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", request.Method)
+		} else {
+			response, status, err = handler(request)
+		}
+		if err != nil {
+			response = &metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Message:  err.Error(),
+				Reason:   metav1.StatusReason(strings.ReplaceAll(http.StatusText(status), " ", "")),
+				Code:     int32(status),
+			}
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		if err := json.NewEncoder(writer).Encode(response); err != nil {
+			logger.Errorf("Error writing the response: %s", err.Error())
+		}
+	}
+}
+
+func apiGroup(*http.Request) (interface{}, int, error) {
+	groupVersion := metav1.GroupVersionForDiscovery{GroupVersion: Group + "/" + Version, Version: Version}
+	return &metav1.APIGroup{
+		TypeMeta:         metav1.TypeMeta{Kind: "APIGroup", APIVersion: "v1"},
+		Name:             Group,
+		Versions:         []metav1.GroupVersionForDiscovery{groupVersion},
+		PreferredVersion: groupVersion,
+	}, http.StatusOK, nil
+}
+
+func apiGroupList(request *http.Request) (interface{}, int, error) {
+	group, _, _ := apiGroup(request)
+	return &metav1.APIGroupList{
+		TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+		Groups:   []metav1.APIGroup{*group.(*metav1.APIGroup)},
+	}, http.StatusOK, nil
+}
+
+func apiResourceList(*http.Request) (interface{}, int, error) {
+	resources := &metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: Group + "/" + Version,
+	}
+	for _, metricName := range metricNames {
+		resources.APIResources = append(resources.APIResources, metav1.APIResource{
+			Name:       metricName,
+			Namespaced: true,
+			Kind:       "ExternalMetricValueList",
+			Verbs:      []string{"get"},
+		})
+	}
+	return resources, http.StatusOK, nil
+}
+
+// metric returns the value of a metric of the agent pool in the label selector, at /namespaces/<namespace>/<metric>.
+// The metrics are the same in every namespace.
+func (a *Adapter) metric(request *http.Request) (interface{}, int, error) {
+	parts := strings.Split(strings.TrimPrefix(request.URL.Path, basePath+"/"), "/")
+	if len(parts) != 3 || parts[0] != "namespaces" {
+		return nil, http.StatusNotFound, fmt.Errorf("The path %s was not found", request.URL.Path)
+	}
+	metricName := parts[2]
+	if !isMetric(metricName) {
+		return nil, http.StatusNotFound, fmt.Errorf("Unknown metric %s, the metrics are %s", metricName, strings.Join(metricNames, ", "))
+	}
+
+	selector, err := labels.Parse(request.URL.Query().Get("labelSelector"))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid label selector: %w", err)
+	}
+	pool, statefulSet := exactMatch(selector, poolLabel), exactMatch(selector, statefulSetLabel)
+	if pool == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("The label selector of metric %s must select a %s, ex: %s=linux", metricName, poolLabel, poolLabel)
+	}
+
+	a.lock.RLock()
+	backend, queueAgeArgs, agentNames := a.backend, a.args.QueueAge, a.args.AgentNames
+	a.lock.RUnlock()
+	demand, err := scaling.ObserveExternalDemand(backend, pool, statefulSet, queueAgeArgs, agentNames)
+	if errors.Is(err, scaling.ErrPoolNotFound) {
+		return nil, http.StatusNotFound, err
+	} else if err != nil {
+		logger.Warnf("Error retrieving metric %s of agent pool %s: %s", metricName, pool, err.Error())
+		return nil, http.StatusServiceUnavailable, err
+	}
+
+	value := demand.Agents()
+	switch metricName {
+	case MetricQueuedJobs:
+		value = demand.QueuedJobs
+	case MetricBusyAgents:
+		value = demand.BusyAgents
+	}
+	metricLabels := map[string]string{poolLabel: pool}
+	if statefulSet != "" {
+		metricLabels[statefulSetLabel] = statefulSet
+	}
+	logger.Debugf("Metric %s of agent pool %s is %d", metricName, pool, value)
+	return &ExternalMetricValueList{
+		TypeMeta: metav1.TypeMeta{Kind: "ExternalMetricValueList", APIVersion: Group + "/" + Version},
+		Items: []ExternalMetricValue{{
+			MetricName:   metricName,
+			MetricLabels: metricLabels,
+			Timestamp:    metav1.Time{Time: time.Now().Truncate(time.Second)},
+			Value:        *resource.NewQuantity(int64(value), resource.DecimalSI),
+		}},
+	}, http.StatusOK, nil
+}
+
+func isMetric(metricName string) bool {
+	for _, name := range metricNames {
+		if name == metricName {
+			return true
+		}
+	}
+	return false
+}
+
+// exactMatch returns the value a label selector requires a label to equal, or an empty string if it doesn't
+func exactMatch(selector labels.Selector, label string) string {
+	requirements, _ := selector.Requirements()
+	for _, requirement := range requirements {
+		if requirement.Key() != label {
+			continue
+		}
+		values := requirement.Values()
+		if (requirement.Operator() == selection.Equals || requirement.Operator() == selection.DoubleEquals || requirement.Operator() == selection.In) && values.Len() == 1 {
+			return values.List()[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// SlackNotifier sends notifications to a Slack incoming webhook
+type SlackNotifier struct {
+	URL        string
+	Template   *template.Template
+	HTTPClient *http.Client
+}
+
+// NewSlackNotifier creates a SlackNotifier
+func NewSlackNotifier(url string, messageTemplate *template.Template) SlackNotifier {
+	return SlackNotifier{
+		URL:        url,
+		Template:   messageTemplate,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the notifier in logs
+func (n SlackNotifier) Name() string {
+	return "Slack"
+}
+
+// Notify sends the notification as a Slack message
+func (n SlackNotifier) Notify(notification Notification) error {
+	message, err := renderMessage(n.Template, notification)
+	if err != nil {
+		return err
+	}
+	return postJSON(n.HTTPClient, n.URL, map[string]string{
+		"text": severityEmoji[notification.Severity] + " " + message,
+	})
+}
+
+// TeamsNotifier sends notifications to a Microsoft Teams incoming webhook
+type TeamsNotifier struct {
+	URL        string
+	Template   *template.Template
+	HTTPClient *http.Client
+}
+
+// NewTeamsNotifier creates a TeamsNotifier
+func NewTeamsNotifier(url string, messageTemplate *template.Template) TeamsNotifier {
+	return TeamsNotifier{
+		URL:        url,
+		Template:   messageTemplate,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the notifier in logs
+func (n TeamsNotifier) Name() string {
+	return "Microsoft Teams"
+}
+
+// Notify sends the notification as a Teams message card
+func (n TeamsNotifier) Notify(notification Notification) error {
+	message, err := renderMessage(n.Template, notification)
+	if err != nil {
+		return err
+	}
+	return postJSON(n.HTTPClient, n.URL, map[string]string{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    message,
+		"themeColor": severityColors[notification.Severity],
+		"title":      "azp-agent-autoscaler",
+		"text":       message,
+	})
+}
+
+var severityEmoji = map[Severity]string{
+	SeverityInfo:    ":information_source:",
+	SeverityWarning: ":warning:",
+	SeverityError:   ":rotating_light:",
+}
+
+var severityColors = map[Severity]string{
+	SeverityInfo:    "0076D7",
+	SeverityWarning: "FFA500",
+	SeverityError:   "D70000",
+}
+
+func postJSON(httpClient *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return doRequest(httpClient, request)
+}
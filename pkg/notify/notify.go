@@ -0,0 +1,181 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+// Type is the type of a notification
+type Type string
+
+const (
+	// TypeScaledUp is sent when a workload is scaled up
+	TypeScaledUp Type = "scaled_up"
+	// TypeScaledDown is sent when a workload is scaled down
+	TypeScaledDown Type = "scaled_down"
+	// TypeScaleFailed is sent when scaling a workload fails
+	TypeScaleFailed Type = "scale_failed"
+	// TypeAutoscaleFailed is sent when the autoscaler stops due to an Azure Devops or Kubernetes API error
+	TypeAutoscaleFailed Type = "autoscale_failed"
+	// TypeAutoscaleDegraded is sent when the autoscaler starts retrying after an Azure Devops or Kubernetes API error
+	TypeAutoscaleDegraded Type = "autoscale_degraded"
+	// TypeAnomalyDetected is sent when an anomaly of the queue and replicas of a workload is detected
+	TypeAnomalyDetected Type = "anomaly_detected"
+	// TypeDrainTimedOut is sent when the drained agents of a scale down are still busy after the drain timeout
+	TypeDrainTimedOut Type = "drain_timed_out"
+)
+
+// Severity is the severity of a notification
+type Severity string
+
+// severityOrder orders the severities from least to most severe
+var severityOrder = map[Severity]int{
+	SeverityInfo:    0,
+	SeverityWarning: 1,
+	SeverityError:   2,
+}
+
+// ParseSeverity parses a severity
+func ParseSeverity(value string) (Severity, error) {
+	severity := Severity(strings.ToLower(value))
+	if _, exists := severityOrder[severity]; !exists {
+		return "", fmt.Errorf("Unknown severity %s", value)
+	}
+	return severity, nil
+}
+
+// AtLeast returns true if the severity is at least as severe as the given severity
+func (s Severity) AtLeast(severity Severity) bool {
+	return severityOrder[s] >= severityOrder[severity]
+}
+
+const (
+	// SeverityInfo is for expected events
+	SeverityInfo Severity = "info"
+	// SeverityWarning is for events that may need attention
+	SeverityWarning Severity = "warning"
+	// SeverityError is for failures
+	SeverityError Severity = "error"
+)
+
+// Notification is an event sent to the notifiers
+type Notification struct {
+	Type         Type      `json:"type"`
+	Severity     Severity  `json:"severity"`
+	Time         time.Time `json:"time"`
+	Namespace    string    `json:"namespace"`
+	Workload     string    `json:"workload"`
+	AgentPoolID  int       `json:"poolId"`
+	FromReplicas int32     `json:"fromReplicas"`
+	ToReplicas   int32     `json:"toReplicas"`
+	Reason       string    `json:"reason"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Notifier sends notifications to an external system
+type Notifier interface {
+	// Name identifies the notifier in logs
+	Name() string
+	Notify(notification Notification) error
+}
+
+const (
+	maxAttempts  = 4
+	initialRetry = time.Second
+)
+
+var logger = logging.Component("notify")
+
+// registration is a notifier and the minimum severity of the notifications it is sent
+type registration struct {
+	notifier    Notifier
+	minSeverity Severity
+}
+
+var registrations []registration
+
+// pending tracks every notification being sent, so they can be flushed before the process exits
+var pending sync.WaitGroup
+
+// Register adds a notifier that is sent notifications of at least the given severity.
+// It should be called before sending notifications.
+func Register(notifier Notifier, minSeverity Severity) {
+	registrations = append(registrations, registration{notifier, minSeverity})
+}
+
+// Send sends a notification to every notifier in the background, retrying failures with an exponential backoff
+func Send(notification Notification) {
+	send(notification)
+}
+
+// SendAndWait sends a notification to every notifier, and waits until they're sent or the timeout passes.
+// This should be used before the process exits.
+func SendAndWait(notification Notification, timeout time.Duration) {
+	if !waitTimeout(send(notification), timeout) {
+		logger.Warnf("Timed out sending the %s notification after %s", notification.Type, timeout.String())
+	}
+}
+
+// Flush waits until every notification being sent is sent or the timeout passes.
+// This should be used before the process exits.
+func Flush(timeout time.Duration) {
+	if !waitTimeout(&pending, timeout) {
+		logger.Warnf("Timed out sending the notifications after %s", timeout.String())
+	}
+}
+
+// waitTimeout waits for a WaitGroup, returning false if the timeout passes first
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func send(notification Notification) *sync.WaitGroup {
+	notification.Reason = logging.Redact(notification.Reason)
+	notification.Error = logging.Redact(notification.Error)
+	var wg sync.WaitGroup
+	for _, r := range registrations {
+		if !notification.Severity.AtLeast(r.minSeverity) {
+			continue
+		}
+		wg.Add(1)
+		pending.Add(1)
+		go func(notifier Notifier) {
+			defer wg.Done()
+			defer pending.Done()
+			sendWithRetry(notifier, notification)
+		}(r.notifier)
+	}
+	return &wg
+}
+
+func sendWithRetry(notifier Notifier, notification Notification) {
+	retry := initialRetry
+	for attempt := 1; ; attempt++ {
+		err := notifier.Notify(notification)
+		if err == nil {
+			logger.Tracef("Sent the %s notification of %s to %s", notification.Type, notification.Workload, notifier.Name())
+			return
+		}
+		if attempt == maxAttempts {
+			logger.Errorf("Error sending the %s notification of %s to %s after %d attempts: %s", notification.Type, notification.Workload, notifier.Name(), attempt, err.Error())
+			return
+		}
+		logger.Warnf("Error sending the %s notification of %s to %s, retrying in %s: %s", notification.Type, notification.Workload, notifier.Name(), retry.String(), err.Error())
+		time.Sleep(retry)
+		retry = 2 * retry
+	}
+}
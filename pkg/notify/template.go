@@ -0,0 +1,29 @@
+package notify
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// DefaultTemplate is the text/template of the Slack and Teams messages, executed with a Notification
+const DefaultTemplate = `{{ if eq .Type "scaled_up" }}Scaled up {{ .Workload }} from {{ .FromReplicas }} to {{ .ToReplicas }} agents: {{ .Reason }}
+{{- else if eq .Type "scaled_down" }}Scaled down {{ .Workload }} from {{ .FromReplicas }} to {{ .ToReplicas }} agents: {{ .Reason }}
+{{- else if eq .Type "scale_failed" }}Failed to scale {{ .Workload }} from {{ .FromReplicas }} to {{ .ToReplicas }} agents: {{ .Error }}
+{{- else if eq .Type "autoscale_failed" }}The autoscaler stopped after an error: {{ .Error }}
+{{- else if eq .Type "autoscale_degraded" }}The autoscaler is retrying after a {{ .Reason }} error: {{ .Error }}
+{{- else if eq .Type "anomaly_detected" }}Anomaly in {{ .Workload }}: {{ .Reason }}
+{{- else }}{{ .Type }} {{ .Workload }}: {{ .Reason }}{{ end }}`
+
+// ParseTemplate parses a message template
+func ParseTemplate(text string) (*template.Template, error) {
+	return template.New("notification").Option("missingkey=zero").Parse(text)
+}
+
+// renderMessage executes the template with the notification
+func renderMessage(messageTemplate *template.Template, notification Notification) (string, error) {
+	var message bytes.Buffer
+	if err := messageTemplate.Execute(&message, notification); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
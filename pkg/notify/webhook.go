@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// SignatureHeader is the header with the HMAC-SHA256 signature of the webhook body, in the format sha256=<hex>
+const SignatureHeader = "X-Azp-Agent-Autoscaler-Signature"
+
+// WebhookNotifier POSTs notifications as JSON to a URL
+type WebhookNotifier struct {
+	URL string
+	// Secret signs the body if it is not empty
+	Secret     string
+	HTTPClient *http.Client
+}
+
+// NewWebhookNotifier creates a WebhookNotifier
+func NewWebhookNotifier(url string, secret string) WebhookNotifier {
+	return WebhookNotifier{
+		URL:        url,
+		Secret:     secret,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the notifier in logs. Only the host is included, as webhook URLs often contain a token.
+func (n WebhookNotifier) Name() string {
+	return "webhook " + urlHost(n.URL)
+}
+
+func urlHost(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return parsed.Host
+}
+
+// Notify POSTs the notification
+func (n WebhookNotifier) Notify(notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "go-azp-agent-autoscaler")
+	if n.Secret != "" {
+		request.Header.Set(SignatureHeader, "sha256="+Sign(body, n.Secret))
+	}
+	return doRequest(n.HTTPClient, request)
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the body
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// doRequest executes the request, and returns an error if it doesn't return a 2xx status
+func doRequest(httpClient *http.Client, request *http.Request) error {
+	response, err := httpClient.Do(request)
+	if urlErr, isURLErr := err.(*url.Error); isURLErr {
+		// Don't include the URL in the error
+		return fmt.Errorf("%s %s: %s", urlErr.Op, request.URL.Host, urlErr.Err.Error())
+	} else if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned HTTP %d", request.URL.Host, response.StatusCode)
+	}
+	return nil
+}
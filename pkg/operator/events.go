@@ -0,0 +1,78 @@
+package operator
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+const (
+	eventReasonResolved        = "Resolved"
+	eventReasonResolveFailed   = "ResolveFailed"
+	eventReasonAutoscaled      = "Autoscaled"
+	eventReasonAutoscaleFailed = "AutoscaleFailed"
+	eventReasonScaledUp        = "ScaledUp"
+	eventReasonScaledDown      = "ScaledDown"
+	eventReasonDraining        = "Draining"
+	eventReasonTornDown        = "TornDown"
+)
+
+// createEvent creates an event on an AzpAgentAutoscaler resource, unless events are disabled. Errors are only logged.
+func createEvent(k8sClient kubernetes.ClientAsync, resource kubernetes.AzpAgentAutoscaler, defaults args.Args, eventType string, reason string, message string) {
+	if !defaults.Events {
+		return
+	}
+	if err := k8sClient.Sync().CreateAutoscalerEvent(resource, eventType, reason, message); err != nil {
+		logger.Errorf("Error creating a %s event for AzpAgentAutoscaler %s/%s: %s", reason, resource.Namespace, resource.Name, err.Error())
+	}
+}
+
+// createEvents creates the events of a reconciled autoscaler: when its workload was scaled, and when its Ready or Degraded
+// condition changed from its current status. The events aren't repeated every iteration while a condition doesn't change.
+func createEvents(k8sClient kubernetes.ClientAsync, autoscaler Autoscaler, status kubernetes.AzpAgentAutoscalerStatus, defaults args.Args) {
+	resource := autoscaler.Resource
+	for _, condition := range status.Conditions {
+		if condition.Type != kubernetes.ConditionReady && condition.Type != kubernetes.ConditionDegraded {
+			continue
+		}
+		if current := findCondition(resource.Status, condition.Type); current != nil && current.Status == condition.Status {
+			continue
+		}
+		switch {
+		case condition.Type == kubernetes.ConditionReady && condition.Status == corev1.ConditionTrue:
+			createEvent(k8sClient, resource, defaults, corev1.EventTypeNormal, eventReasonResolved,
+				fmt.Sprintf("Autoscaling %s with agent pool %d", autoscaler.Target.Workload.FriendlyName, autoscaler.Target.AgentPoolID))
+		case condition.Type == kubernetes.ConditionReady:
+			createEvent(k8sClient, resource, defaults, corev1.EventTypeWarning, eventReasonResolveFailed, condition.Message)
+		case condition.Status == corev1.ConditionTrue && condition.Reason == eventReasonAutoscaleFailed:
+			createEvent(k8sClient, resource, defaults, corev1.EventTypeWarning, eventReasonAutoscaleFailed, condition.Message)
+		case condition.Status == corev1.ConditionFalse && findCondition(resource.Status, condition.Type) != nil:
+			createEvent(k8sClient, resource, defaults, corev1.EventTypeNormal, eventReasonAutoscaled, "Recovered and autoscaled the workload")
+		}
+	}
+
+	decision := autoscaler.Decision
+	if autoscaler.Err != nil || decision == nil || !decision.IsScaling() || autoscaler.Target.ArgsOr(defaults).DryRun {
+		return
+	}
+	reason := eventReasonScaledUp
+	if decision.Action() == scaling.ActionScaleDown {
+		reason = eventReasonScaledDown
+	}
+	createEvent(k8sClient, resource, defaults, corev1.EventTypeNormal, reason,
+		fmt.Sprintf("Scaled %s from %d to %d replicas: %s", autoscaler.Target.Workload.FriendlyName, decision.NumPods, decision.DesiredReplicas, decision.Reason))
+}
+
+// findCondition returns the condition of a type, or nil if the status doesn't have it
+func findCondition(status kubernetes.AzpAgentAutoscalerStatus, conditionType string) *kubernetes.AutoscalerCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
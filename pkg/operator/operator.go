@@ -0,0 +1,374 @@
+package operator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+var logger = logging.Component("operator")
+
+// conflictCheckWarnings are the last warnings of the workloads of the resources that weren't verified not to be scaled
+// by another autoscaler, so a warning is only logged when it changes
+var (
+	conflictCheckWarnings      = make(map[string]string)
+	conflictCheckWarningsMutex sync.Mutex
+)
+
+// Autoscaler is an AzpAgentAutoscaler resource and the workload it autoscales
+type Autoscaler struct {
+	Resource kubernetes.AzpAgentAutoscaler
+	// Target is the workload and agent pool of the resource, with the arguments from its spec
+	Target        scaling.Target
+	AgentPoolName string
+	// Decision is the last scaling decision of the workload, if one was made
+	Decision *scaling.Decision
+	// Err is why the resource couldn't be autoscaled, ex: it is invalid or its workload doesn't exist
+	Err error
+}
+
+// Name returns the namespace and name of the resource
+func (a Autoscaler) Name() string {
+	return fmt.Sprintf("%s/%s", a.Resource.Namespace, a.Resource.Name)
+}
+
+// Targets returns the targets of the autoscalers that could be resolved
+func Targets(autoscalers []Autoscaler) []scaling.Target {
+	var targets []scaling.Target
+	for _, autoscaler := range autoscalers {
+		if autoscaler.Target.Workload != nil {
+			targets = append(targets, autoscaler.Target)
+		}
+	}
+	return targets
+}
+
+// Reconcile autoscales the workload of every AzpAgentAutoscaler resource in the operator's namespaces concurrently, up to
+// the concurrency argument, and updates their status.
+// Deleted resources have their agents torn down instead, see teardown.
+// A resource that can't be autoscaled has its error logged and set, without affecting the other resources.
+// An error is only returned if the resources or the agent pools couldn't be listed.
+func Reconcile(backend ci.Backend, k8sClient kubernetes.ClientAsync, defaults args.Args) ([]Autoscaler, error) {
+	resources, agentPools, err := list(backend, k8sClient, defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	autoscalers := make([]Autoscaler, len(resources))
+	workers := make(chan struct{}, math.MaxInt32(1, defaults.Concurrency))
+	var wg sync.WaitGroup
+	for i, resource := range resources {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, resource kubernetes.AzpAgentAutoscaler) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			if resource.DeletionTimestamp != nil {
+				autoscalers[i] = Autoscaler{Resource: resource}
+				if hasFinalizer(resource) {
+					if _, err := teardown(backend, k8sClient, agentPools, resource, defaults); err != nil {
+						logger.Errorf("Error tearing down AzpAgentAutoscaler %s: %s", autoscalers[i].Name(), err.Error())
+						autoscalers[i].Err = err
+					}
+				}
+				return
+			}
+			if !hasFinalizer(resource) {
+				updated, err := addFinalizer(k8sClient, resource)
+				if err != nil {
+					logger.Warnf("Error adding the finalizer to AzpAgentAutoscaler %s/%s: %s", resource.Namespace, resource.Name, err.Error())
+				} else {
+					resource = updated
+				}
+			}
+
+			autoscaler := resolve(k8sClient, agentPools, resource, defaults)
+			if autoscaler.Err == nil {
+				autoscaler.Decision, autoscaler.Err = scaling.AutoscaleTarget(backend, k8sClient, autoscaler.Target, defaults)
+			}
+			if autoscaler.Err != nil {
+				logger.Errorf("Error autoscaling AzpAgentAutoscaler %s: %s", autoscaler.Name(), autoscaler.Err.Error())
+			}
+			// The times are stored with a precision of seconds, so they're compared at that precision
+			status := Status(autoscaler, time.Now().Truncate(time.Second))
+			createEvents(k8sClient, autoscaler, status, defaults)
+			updateStatus(k8sClient, autoscaler, status)
+			autoscalers[i] = autoscaler
+		}(i, resource)
+	}
+	wg.Wait()
+	return autoscalers, nil
+}
+
+// Resolve retrieves the workload and agent pool of every AzpAgentAutoscaler resource in the operator's namespaces that isn't being deleted, without autoscaling them.
+// A resource that can't be autoscaled has an error instead of a target.
+func Resolve(backend ci.Backend, k8sClient kubernetes.ClientAsync, defaults args.Args) ([]Autoscaler, error) {
+	resources, agentPools, err := list(backend, k8sClient, defaults)
+	if err != nil {
+		return nil, err
+	}
+	var autoscalers []Autoscaler
+	for _, resource := range resources {
+		// Deleted resources are only torn down
+		if resource.DeletionTimestamp == nil {
+			autoscalers = append(autoscalers, resolve(k8sClient, agentPools, resource, defaults))
+		}
+	}
+	return autoscalers, nil
+}
+
+// list retrieves the AzpAgentAutoscaler resources in the operator's namespaces and the agent pools they can reference.
+// A namespace whose resources can't be listed is logged and skipped, so one tenant doesn't stop the others from being autoscaled.
+func list(backend ci.Backend, k8sClient kubernetes.ClientAsync, defaults args.Args) ([]kubernetes.AzpAgentAutoscaler, []ci.Pool, error) {
+	agentPoolsChan := make(chan poolsResponse, 1)
+	go func() {
+		agentPools, err := backend.Pools("")
+		agentPoolsChan <- poolsResponse{agentPools, err}
+	}()
+
+	var resources []kubernetes.AzpAgentAutoscaler
+	var listErr error
+	namespaces := defaults.OperatorNamespaces()
+	for _, namespace := range namespaces {
+		namespaceResources, err := k8sClient.Sync().ListAutoscalers(namespace)
+		if err != nil {
+			listErr = fmt.Errorf("Error listing the AzpAgentAutoscaler resources in namespace %s: %w", namespace, err)
+			if len(namespaces) > 1 {
+				logger.Error(listErr.Error())
+			}
+			continue
+		}
+		for _, resource := range namespaceResources {
+			if defaults.Sharding.Owns(ShardKey(resource)) {
+				resources = append(resources, resource)
+			}
+		}
+	}
+	agentPools := <-agentPoolsChan
+	if listErr != nil && len(resources) == 0 {
+		return nil, nil, listErr
+	}
+	if agentPools.Err != nil {
+		return nil, nil, fmt.Errorf("Error retrieving agent pools: %w", agentPools.Err)
+	}
+	return resources, agentPools.Pools, nil
+}
+
+// ShardKey returns the key that assigns an AzpAgentAutoscaler resource to a shard. It's the agent pool if it's set, so
+// the resources of a pool are autoscaled by the same replica as they are without the operator, or the namespace and
+// name of the resource, as the agent pool can't be discovered without retrieving the workload.
+func ShardKey(resource kubernetes.AzpAgentAutoscaler) string {
+	if resource.Spec.Pool != "" {
+		return resource.Spec.Pool
+	}
+	return resource.Namespace + "/" + resource.Name
+}
+
+// resolve retrieves the workload and agent pool of an AzpAgentAutoscaler resource
+func resolve(k8sClient kubernetes.ClientAsync, agentPools []ci.Pool, resource kubernetes.AzpAgentAutoscaler, defaults args.Args) Autoscaler {
+	autoscaler := Autoscaler{Resource: resource}
+	resourceArgs, err := ResourceArgs(resource, defaults)
+	if err != nil {
+		autoscaler.Err = err
+		return autoscaler
+	}
+
+	workload, err := k8sClient.Sync().GetWorkload(resourceArgs.Kubernetes)
+	if err != nil {
+		autoscaler.Err = fmt.Errorf("Error retrieving %s: %w", resourceArgs.Kubernetes.FriendlyName(), err)
+		return autoscaler
+	}
+	warning, err := kubernetes.VerifyNoAutoscalerConflict(k8sClient.Sync(), resourceArgs.Kubernetes, resourceArgs.HPACheck)
+	if err != nil {
+		autoscaler.Err = err
+		return autoscaler
+	}
+	warnConflictCheck(autoscaler.Name(), warning)
+
+	agentPoolName, err := poolName(k8sClient, resource, workload, defaults)
+	if err != nil {
+		autoscaler.Err = err
+		return autoscaler
+	}
+	if err := verifyPoolAllowed(resource, agentPoolName, defaults); err != nil {
+		autoscaler.Err = err
+		return autoscaler
+	}
+	agentPool, err := findPool(agentPools, agentPoolName)
+	if err != nil {
+		autoscaler.Err = err
+		return autoscaler
+	}
+	autoscaler.Target = scaling.Target{
+		Workload:    workload,
+		AgentPoolID: agentPool.ID,
+		Priority:    resourceArgs.Kubernetes.Priority,
+		Args:        &resourceArgs,
+	}
+	autoscaler.AgentPoolName = agentPool.Name
+	return autoscaler
+}
+
+// poolName returns the agent pool name of an AzpAgentAutoscaler resource, discovering it from its workload if it isn't set
+func poolName(k8sClient kubernetes.ClientAsync, resource kubernetes.AzpAgentAutoscaler, workload *kubernetes.Workload, defaults args.Args) (string, error) {
+	poolNameEnvVar := defaults.PoolNameEnvVar()
+	if resource.Spec.Pool != "" {
+		return resource.Spec.Pool, nil
+	}
+	agentPoolName, err := k8sClient.Sync().GetEnvValue(*workload.PodTemplateSpec, workload.Namespace, poolNameEnvVar)
+	if err != nil {
+		return "", fmt.Errorf("The pool is not set and could not be discovered from environment variable %s of %s: %w", poolNameEnvVar, workload.FriendlyName, err)
+	}
+	return agentPoolName, nil
+}
+
+// verifyPoolAllowed returns an error if the namespace of an AzpAgentAutoscaler resource isn't allowed to autoscale an agent pool
+func verifyPoolAllowed(resource kubernetes.AzpAgentAutoscaler, agentPoolName string, defaults args.Args) error {
+	if !defaults.Operator.IsPoolAllowed(resource.Namespace, agentPoolName) {
+		return fmt.Errorf("Agent pool %s is not allowed in namespace %s", agentPoolName, resource.Namespace)
+	}
+	return nil
+}
+
+// poolsResponse is a wrapper for []ci.Pool to allow also returning an error in channels
+type poolsResponse struct {
+	Pools []ci.Pool
+	Err   error
+}
+
+// findPool returns the self-hosted agent pool with the given name
+func findPool(agentPools []ci.Pool, agentPoolName string) (ci.Pool, error) {
+	for _, agentPool := range agentPools {
+		if agentPool.Name == agentPoolName {
+			return agentPool, nil
+		}
+	}
+	return ci.Pool{}, fmt.Errorf("Could not find an agent pool with name %s", agentPoolName)
+}
+
+// ResourceArgs returns the arguments to autoscale the workload of an AzpAgentAutoscaler resource with.
+// The values that aren't set in its spec are the operator's arguments. An error is returned if the spec is invalid.
+func ResourceArgs(resource kubernetes.AzpAgentAutoscaler, defaults args.Args) (args.Args, error) {
+	spec := resource.Spec
+	resourceArgs := defaults
+	resourceArgs.Kubernetes.Type = spec.WorkloadRef.Kind
+	resourceArgs.Kubernetes.Name = spec.WorkloadRef.Name
+	resourceArgs.Kubernetes.Namespace = resource.Namespace
+	resourceArgs.Kubernetes.Priority = spec.Priority
+	resourceArgs.Kubernetes.AdditionalWorkloads = nil
+	// Each resource claims its workload, so another resource or autoscaler targeting it is detected
+	resourceArgs.Ownership.Owner = fmt.Sprintf("AzpAgentAutoscaler %s/%s", resource.Namespace, resource.Name)
+	if spec.Min != nil {
+		resourceArgs.Min = *spec.Min
+	}
+	if spec.Max != nil {
+		resourceArgs.Max = *spec.Max
+	}
+	if spec.DryRun != nil {
+		resourceArgs.DryRun = *spec.DryRun
+	}
+	if scaleDown := spec.ScaleDown; scaleDown != nil {
+		if scaleDown.Delay != nil {
+			resourceArgs.ScaleDown.Delay = scaleDown.Delay.Duration
+		}
+		if scaleDown.IdleDelay != nil {
+			resourceArgs.ScaleDown.IdleDelay = scaleDown.IdleDelay.Duration
+		}
+		if scaleDown.Max != nil {
+			resourceArgs.ScaleDown.Max = *scaleDown.Max
+		}
+		if scaleDown.DrainTimeout != nil {
+			resourceArgs.ScaleDown.DrainTimeout = scaleDown.DrainTimeout.Duration
+		}
+		if scaleDown.DrainTimeoutPolicy != "" {
+			resourceArgs.ScaleDown.DrainTimeoutPolicy = strings.ToLower(scaleDown.DrainTimeoutPolicy)
+		}
+		if scaleDown.DrainMaxRetries != nil {
+			resourceArgs.ScaleDown.DrainMaxRetries = *scaleDown.DrainMaxRetries
+		}
+	}
+	if policy := spec.Policy; policy != nil {
+		if policy.Name != "" {
+			resourceArgs.Policy.Mode = strings.ToLower(policy.Name)
+		}
+		if policy.SLOMaxQueueTime != nil {
+			resourceArgs.Policy.SLO.MaxQueueTime = policy.SLOMaxQueueTime.Duration
+		}
+		if policy.SLOWindow != nil {
+			resourceArgs.Policy.SLO.Window = policy.SLOWindow.Duration
+		}
+	}
+
+	var validationErrors []string
+	if !strings.EqualFold(spec.WorkloadRef.Kind, "StatefulSet") {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown workload kind %s.", spec.WorkloadRef.Kind))
+	}
+	if spec.WorkloadRef.Name == "" {
+		validationErrors = append(validationErrors, "The workload name is required.")
+	}
+	if resourceArgs.Min < 1 {
+		validationErrors = append(validationErrors, "Min cannot be less than 1.")
+	}
+	if resourceArgs.Max <= resourceArgs.Min {
+		validationErrors = append(validationErrors, "Max must be greater than the minimum.")
+	}
+	if resourceArgs.ScaleDown.Delay < 0 {
+		validationErrors = append(validationErrors, "The scale down delay cannot be negative.")
+	}
+	if resourceArgs.ScaleDown.IdleDelay < 0 {
+		validationErrors = append(validationErrors, "The scale down idle delay cannot be negative.")
+	}
+	if resourceArgs.ScaleDown.Max < 1 {
+		validationErrors = append(validationErrors, "The scale down max cannot be less than 1.")
+	}
+	if resourceArgs.ScaleDown.DrainTimeout < 0 {
+		validationErrors = append(validationErrors, "The drain timeout cannot be negative.")
+	}
+	if resourceArgs.ScaleDown.DrainTimeoutPolicy != "" && !args.IsDrainTimeoutPolicy(resourceArgs.ScaleDown.DrainTimeoutPolicy) {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown drain timeout policy %s.", resourceArgs.ScaleDown.DrainTimeoutPolicy))
+	}
+	if resourceArgs.ScaleDown.DrainMaxRetries < 0 {
+		validationErrors = append(validationErrors, "The drain max retries cannot be negative.")
+	}
+	if spec.Teardown != nil && spec.Teardown.ParkedReplicas != nil && *spec.Teardown.ParkedReplicas < 0 {
+		validationErrors = append(validationErrors, "The parked replicas cannot be negative.")
+	}
+	if resourceArgs.Policy.Mode != args.PolicyQueue && resourceArgs.Policy.Mode != args.PolicySLO {
+		validationErrors = append(validationErrors, fmt.Sprintf("Unknown policy %s.", resourceArgs.Policy.Mode))
+	} else if resourceArgs.Policy.IsSLO() {
+		if resourceArgs.Policy.SLO.MaxQueueTime.Minutes() < 1 {
+			validationErrors = append(validationErrors, "The SLO max queue time cannot be less than 1 minute.")
+		}
+		if resourceArgs.Policy.SLO.Window.Minutes() < 1 {
+			validationErrors = append(validationErrors, "The SLO window cannot be less than 1 minute.")
+		}
+	}
+	if len(validationErrors) > 0 {
+		return args.Args{}, fmt.Errorf("Invalid spec: %s", strings.Join(validationErrors, " "))
+	}
+	return resourceArgs, nil
+}
+
+// warnConflictCheck logs the warning of a resource whose workload wasn't verified not to be scaled by another
+// autoscaler, if it changed
+func warnConflictCheck(name string, warning string) {
+	conflictCheckWarningsMutex.Lock()
+	defer conflictCheckWarningsMutex.Unlock()
+	if conflictCheckWarnings[name] == warning {
+		return
+	}
+	conflictCheckWarnings[name] = warning
+	if warning != "" {
+		logger.Warnf("AzpAgentAutoscaler %s: %s", name, warning)
+	}
+}
@@ -0,0 +1,82 @@
+package operator
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// Status returns the observed state of an autoscaler after it was reconciled.
+// The transition time of a condition is kept from the resource's current status if the condition didn't change.
+func Status(autoscaler Autoscaler, now time.Time) kubernetes.AzpAgentAutoscalerStatus {
+	current := autoscaler.Resource.Status
+	status := kubernetes.AzpAgentAutoscalerStatus{
+		ObservedGeneration: autoscaler.Resource.Generation,
+		AgentPoolName:      autoscaler.AgentPoolName,
+		AgentPoolID:        autoscaler.Target.AgentPoolID,
+		// The replicas and queued jobs are kept until the next decision if one couldn't be made
+		CurrentReplicas: current.CurrentReplicas,
+		DesiredReplicas: current.DesiredReplicas,
+		QueuedJobs:      current.QueuedJobs,
+		LastScaleTime:   current.LastScaleTime,
+	}
+
+	ready := condition(kubernetes.ConditionReady, corev1.ConditionTrue, "Resolved", "The workload and agent pool were found")
+	degraded := condition(kubernetes.ConditionDegraded, corev1.ConditionFalse, "Autoscaled", "")
+	suppressed := condition(kubernetes.ConditionScalingSuppressed, corev1.ConditionFalse, "NotSuppressed", "")
+	if autoscaler.Target.Workload == nil {
+		ready = condition(kubernetes.ConditionReady, corev1.ConditionFalse, "ResolveFailed", autoscaler.Err.Error())
+		degraded = condition(kubernetes.ConditionDegraded, corev1.ConditionTrue, "ResolveFailed", autoscaler.Err.Error())
+	} else {
+		if autoscaler.Err != nil {
+			degraded = condition(kubernetes.ConditionDegraded, corev1.ConditionTrue, "AutoscaleFailed", autoscaler.Err.Error())
+		}
+		if state := scaling.GetState(autoscaler.Target.Workload); state.LastScaleTime.After(time.Unix(0, 0)) {
+			status.LastScaleTime = &metav1.Time{Time: state.LastScaleTime.Truncate(time.Second)}
+		}
+	}
+	if decision := autoscaler.Decision; decision != nil {
+		status.CurrentReplicas = decision.NumPods
+		status.DesiredReplicas = decision.DesiredReplicas
+		status.QueuedJobs = decision.NumQueuedJobs
+		if len(decision.Suppressors) > 0 {
+			suppressed = condition(kubernetes.ConditionScalingSuppressed, corev1.ConditionTrue, "Suppressed",
+				fmt.Sprintf("Limited by %s: %s", strings.Join(decision.SuppressorNames(), ", "), decision.Reason))
+		}
+	}
+
+	for _, c := range []kubernetes.AutoscalerCondition{ready, degraded, suppressed} {
+		c.LastTransitionTime = metav1.Time{Time: now}
+		for _, currentCondition := range current.Conditions {
+			if currentCondition.Type == c.Type && currentCondition.Status == c.Status {
+				c.LastTransitionTime = currentCondition.LastTransitionTime
+			}
+		}
+		status.Conditions = append(status.Conditions, c)
+	}
+	return status
+}
+
+func condition(conditionType string, status corev1.ConditionStatus, reason string, message string) kubernetes.AutoscalerCondition {
+	return kubernetes.AutoscalerCondition{Type: conditionType, Status: status, Reason: reason, Message: message}
+}
+
+// updateStatus writes the status of an autoscaler to its resource if it changed.
+// Errors are only logged, as the status isn't required to autoscale.
+func updateStatus(k8sClient kubernetes.ClientAsync, autoscaler Autoscaler, status kubernetes.AzpAgentAutoscalerStatus) {
+	if equality.Semantic.DeepEqual(status, autoscaler.Resource.Status) {
+		return
+	}
+	resource := autoscaler.Resource
+	resource.Status = status
+	if err := k8sClient.Sync().UpdateAutoscalerStatus(resource); err != nil {
+		logger.Warnf("Error updating the status of AzpAgentAutoscaler %s: %s", autoscaler.Name(), err.Error())
+	}
+}
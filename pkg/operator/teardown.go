@@ -0,0 +1,180 @@
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// hasFinalizer returns true if a resource has the teardown finalizer
+func hasFinalizer(resource kubernetes.AzpAgentAutoscaler) bool {
+	for _, finalizer := range resource.Finalizers {
+		if finalizer == kubernetes.TeardownFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// addFinalizer adds the teardown finalizer to a resource, and returns the updated resource
+func addFinalizer(k8sClient kubernetes.ClientAsync, resource kubernetes.AzpAgentAutoscaler) (kubernetes.AzpAgentAutoscaler, error) {
+	resource.Finalizers = append(append([]string{}, resource.Finalizers...), kubernetes.TeardownFinalizer)
+	return k8sClient.Sync().UpdateAutoscaler(resource)
+}
+
+// removeFinalizer removes the teardown finalizer from a resource, so Kubernetes can delete it
+func removeFinalizer(k8sClient kubernetes.ClientAsync, resource kubernetes.AzpAgentAutoscaler) error {
+	var finalizers []string
+	for _, finalizer := range resource.Finalizers {
+		if finalizer != kubernetes.TeardownFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	resource.Finalizers = finalizers
+	_, err := k8sClient.Sync().UpdateAutoscaler(resource)
+	return err
+}
+
+// teardown drains and deregisters the agents of a deleted AzpAgentAutoscaler resource, then removes its finalizer.
+// The agents are disabled so they aren't assigned new jobs, and are only deregistered once their running jobs finished,
+// so teardown returns false while jobs are running and continues on the next iteration.
+// If the resource's parked replicas are set, the workload is scaled to them and the agents of the parked pods are kept.
+func teardown(backend ci.Backend, k8sClient kubernetes.ClientAsync, agentPools []ci.Pool, resource kubernetes.AzpAgentAutoscaler, defaults args.Args) (bool, error) {
+	name := fmt.Sprintf("%s/%s", resource.Namespace, resource.Name)
+	spec := resource.Spec
+	var parkedReplicas *int32
+	if spec.Teardown != nil {
+		parkedReplicas = spec.Teardown.ParkedReplicas
+	}
+	dryRun := defaults.DryRun
+	if spec.DryRun != nil {
+		dryRun = *spec.DryRun
+	}
+
+	workloadArgs := args.KubernetesArgs{Type: spec.WorkloadRef.Kind, Name: spec.WorkloadRef.Name, Namespace: resource.Namespace}
+	if !strings.EqualFold(workloadArgs.Type, "StatefulSet") {
+		logger.Warnf("AzpAgentAutoscaler %s has unknown workload kind %s, so it is deleted without a teardown", name, workloadArgs.Type)
+		return true, removeFinalizer(k8sClient, resource)
+	}
+	workload, err := k8sClient.Sync().GetWorkload(workloadArgs)
+	if k8serrors.IsNotFound(err) {
+		// The workload can be deleted with the resource, ex: when the namespace is deleted
+		workload = nil
+	} else if err != nil {
+		return false, fmt.Errorf("Error retrieving %s: %w", workloadArgs.FriendlyName(), err)
+	}
+
+	agentPoolName := spec.Pool
+	if agentPoolName == "" {
+		if workload == nil {
+			logger.Warnf("The agents of AzpAgentAutoscaler %s can't be deregistered, as its pool isn't set and %s doesn't exist", name, workloadArgs.FriendlyName())
+			return true, removeFinalizer(k8sClient, resource)
+		}
+		if agentPoolName, err = poolName(k8sClient, resource, workload, defaults); err != nil {
+			return false, err
+		}
+	}
+	// The agents of a pool the namespace isn't allowed to use belong to another tenant
+	if err := verifyPoolAllowed(resource, agentPoolName, defaults); err != nil {
+		logger.Warnf("The agents of AzpAgentAutoscaler %s can't be deregistered: %s", name, err.Error())
+		return true, removeFinalizer(k8sClient, resource)
+	}
+	agentPool, err := findPool(agentPools, agentPoolName)
+	if err != nil {
+		logger.Warnf("The agents of AzpAgentAutoscaler %s can't be deregistered: %s", name, err.Error())
+		return true, removeFinalizer(k8sClient, resource)
+	}
+
+	agents, err := backend.Agents(agentPool.ID)
+	if err != nil {
+		return false, fmt.Errorf("Error retrieving the agents of pool %s: %w", agentPool.Name, err)
+	}
+	var removedAgents []ci.Agent
+	for _, agent := range defaults.AgentNames.PodNames(agents, workloadArgs.Name) {
+		if isRemovedPod(agent.PodName, workloadArgs.Name, parkedReplicas) {
+			removedAgents = append(removedAgents, agent)
+		}
+	}
+
+	numRunning, numDisabled := 0, 0
+	for _, agent := range removedAgents {
+		if agent.Busy {
+			numRunning++
+		}
+		if !agent.Enabled {
+			continue
+		}
+		if dryRun {
+			logger.Infof("Dry run - would disable agent %s of AzpAgentAutoscaler %s", agent.Name, name)
+			continue
+		}
+		// Agents that can't be drained are deregistered once their jobs finished
+		if err := backend.Drain(agentPool.ID, agent); errors.Is(err, ci.ErrNotSupported) {
+			continue
+		} else if err != nil {
+			return false, fmt.Errorf("Error disabling agent %s: %w", agent.Name, err)
+		}
+		logger.Infof("Disabled agent %s of deleted AzpAgentAutoscaler %s", agent.Name, name)
+		numDisabled++
+	}
+	if numDisabled > 0 {
+		createEvent(k8sClient, resource, defaults, corev1.EventTypeNormal, eventReasonDraining,
+			fmt.Sprintf("Disabled %d agents so they aren't assigned new jobs, they're deregistered once their jobs finished", numDisabled))
+	}
+	if numRunning > 0 && !dryRun {
+		logger.Infof("Waiting for %d agents of deleted AzpAgentAutoscaler %s to finish their jobs", numRunning, name)
+		return false, nil
+	}
+
+	// The workload is scaled down before the agents are deregistered, so its removed pods don't register them again
+	if parkedReplicas != nil && workload != nil {
+		if dryRun {
+			logger.Infof("Dry run - would scale %s to %d parked replicas", workload.FriendlyName, *parkedReplicas)
+		} else if err := k8sClient.Sync().Scale(workload, *parkedReplicas); err != nil {
+			return false, fmt.Errorf("Error scaling %s to %d parked replicas: %w", workload.FriendlyName, *parkedReplicas, err)
+		} else {
+			logger.Infof("Scaled %s to %d parked replicas", workload.FriendlyName, *parkedReplicas)
+		}
+	}
+
+	for _, agent := range removedAgents {
+		if dryRun {
+			logger.Infof("Dry run - would deregister agent %s of AzpAgentAutoscaler %s", agent.Name, name)
+			continue
+		}
+		if err := backend.Remove(agentPool.ID, agent); err != nil {
+			return false, fmt.Errorf("Error deregistering agent %s: %w", agent.Name, err)
+		}
+		logger.Infof("Deregistered agent %s of deleted AzpAgentAutoscaler %s", agent.Name, name)
+	}
+
+	if !dryRun {
+		createEvent(k8sClient, resource, defaults, corev1.EventTypeNormal, eventReasonTornDown, fmt.Sprintf("Deregistered %d agents", len(removedAgents)))
+	}
+	if err := removeFinalizer(k8sClient, resource); err != nil {
+		return false, fmt.Errorf("Error removing the finalizer: %w", err)
+	}
+	logger.Infof("Tore down AzpAgentAutoscaler %s", name)
+	return true, nil
+}
+
+// isRemovedPod returns true if a pod name is a pod of the StatefulSet that isn't kept when it is scaled to the parked replicas.
+// All of its pods are removed if the parked replicas aren't set.
+func isRemovedPod(podName string, statefulSetName string, parkedReplicas *int32) bool {
+	if !strings.HasPrefix(podName, statefulSetName+"-") {
+		return false
+	}
+	ordinal, err := strconv.Atoi(strings.TrimPrefix(podName, statefulSetName+"-"))
+	if err != nil || ordinal < 0 {
+		return false
+	}
+	return parkedReplicas == nil || int32(ordinal) >= *parkedReplicas
+}
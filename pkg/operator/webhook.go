@@ -0,0 +1,158 @@
+package operator
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/listener"
+)
+
+// maxAdmissionReviewSize is the maximum size of an AdmissionReview request body
+const maxAdmissionReviewSize = 1 << 20
+
+// Webhook is a validating admission webhook that rejects invalid AzpAgentAutoscaler resources when they're created or updated,
+// instead of them only failing when they're reconciled
+type Webhook struct {
+	k8sClient kubernetes.ClientAsync
+
+	lock     sync.RWMutex
+	backend  ci.Backend
+	defaults args.Args
+}
+
+// NewWebhook creates an admission webhook that validates resources with the operator's arguments
+func NewWebhook(backend ci.Backend, k8sClient kubernetes.ClientAsync, defaults args.Args) *Webhook {
+	return &Webhook{k8sClient: k8sClient, backend: backend, defaults: defaults}
+}
+
+// Set replaces the CI backend and the operator's arguments when the config is reloaded
+func (w *Webhook) Set(backend ci.Backend, defaults args.Args) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.backend, w.defaults = backend, defaults
+}
+
+// Handler returns the route of the admission webhook
+func (w *Webhook) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", w.validate)
+	return mux
+}
+
+// TLSConfig returns a TLS config that loads the certificate from its files on every handshake, so a renewed certificate
+// is served without a restart. If the client CA is set, requests must have a client certificate signed by it.
+func TLSConfig(webhookArgs args.AdmissionWebhookArgs) (*tls.Config, error) {
+	return listener.TLSConfig("admission webhook", webhookArgs.CertFile, webhookArgs.KeyFile, webhookArgs.ClientCAFile, tls.RequireAndVerifyClientCert)
+}
+
+func (w *Webhook) validate(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, fmt.Sprintf("Method %s is not allowed", request.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxAdmissionReviewSize))
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error reading the request body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	review := admissionv1beta1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(writer, "The request body must be an AdmissionReview with a request", http.StatusBadRequest)
+		return
+	}
+
+	// The response has the API version of the request, as admission.k8s.io/v1 and v1beta1 have the same schema
+	review.Response = w.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(review); err != nil {
+		logger.Errorf("Error writing the AdmissionReview response: %s", err.Error())
+	}
+}
+
+// review allows or denies an admission request
+func (w *Webhook) review(request *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	if request.Operation != admissionv1beta1.Create && request.Operation != admissionv1beta1.Update {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	resource := kubernetes.AzpAgentAutoscaler{}
+	if err := json.Unmarshal(request.Object.Raw, &resource); err != nil {
+		return deny(fmt.Errorf("Error decoding the AzpAgentAutoscaler: %w", err))
+	}
+	// The namespace isn't set in the object when it is created without one
+	if resource.Namespace == "" {
+		resource.Namespace = request.Namespace
+	}
+
+	w.lock.RLock()
+	backend, defaults := w.backend, w.defaults
+	w.lock.RUnlock()
+	if err := Validate(backend, w.k8sClient, resource, defaults); err != nil {
+		logger.Infof("Denied AzpAgentAutoscaler %s/%s: %s", resource.Namespace, resource.Name, err.Error())
+		return deny(err)
+	}
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
+
+func deny(err error) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+// Validate returns an error if an AzpAgentAutoscaler resource can't be autoscaled: its spec is invalid,
+// its workload has a HorizontalPodAutoscaler, or its agent pool isn't set and can't be discovered, isn't allowed in its namespace or doesn't exist.
+// A workload that doesn't exist yet is allowed if the pool is set, so the resource can be created before its workload.
+func Validate(backend ci.Backend, k8sClient kubernetes.ClientAsync, resource kubernetes.AzpAgentAutoscaler, defaults args.Args) error {
+	resourceArgs, err := ResourceArgs(resource, defaults)
+	if err != nil {
+		return err
+	}
+	// A warning is logged when the resource is reconciled
+	if _, err := kubernetes.VerifyNoAutoscalerConflict(k8sClient.Sync(), resourceArgs.Kubernetes, resourceArgs.HPACheck); err != nil {
+		return err
+	}
+
+	agentPoolName := resource.Spec.Pool
+	if agentPoolName == "" {
+		workload, err := k8sClient.Sync().GetWorkload(resourceArgs.Kubernetes)
+		if k8serrors.IsNotFound(err) {
+			return fmt.Errorf("The pool is required when %s doesn't exist, as it can't be discovered", resourceArgs.Kubernetes.FriendlyName())
+		} else if err != nil {
+			return fmt.Errorf("Error retrieving %s: %w", resourceArgs.Kubernetes.FriendlyName(), err)
+		}
+		if agentPoolName, err = poolName(k8sClient, resource, workload, defaults); err != nil {
+			return err
+		}
+	}
+
+	if err := verifyPoolAllowed(resource, agentPoolName, defaults); err != nil {
+		return err
+	}
+
+	agentPools, err := backend.Pools(agentPoolName)
+	if err != nil {
+		return fmt.Errorf("Error retrieving agent pool %s: %w", agentPoolName, err)
+	}
+	_, err = findPool(agentPools, agentPoolName)
+	return err
+}
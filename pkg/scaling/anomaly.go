@@ -0,0 +1,162 @@
+package scaling
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/notify"
+)
+
+// Anomaly is a pattern of the queue and replicas of a workload that usually means a CI capacity incident
+type Anomaly string
+
+const (
+	// AnomalyQueueWithIdleAgents is when jobs stay queued, and the queue doesn't shrink, while agents are idle
+	AnomalyQueueWithIdleAgents Anomaly = "queue_with_idle_agents"
+	// AnomalyQueueNotScaledUp is when jobs stay queued without any free agents, and the workload isn't scaled up
+	AnomalyQueueNotScaledUp Anomaly = "queue_not_scaled_up"
+	// AnomalyPinnedAtMax is when the maximum keeps limiting the scale ups
+	AnomalyPinnedAtMax Anomaly = "pinned_at_max"
+)
+
+const (
+	eventReasonAnomalyDetected = "AnomalyDetected"
+	eventReasonAnomalyResolved = "AnomalyResolved"
+)
+
+var (
+	anomalyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_anomaly",
+		Help: "1 while an anomaly of the queue and replicas of a workload is detected, ex: jobs queued while agents are idle",
+	}, append(metricLabelNames, "anomaly"))
+	anomalyCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_anomalies_count",
+		Help: "The total number of anomalies detected",
+	}, append(metricLabelNames, "anomaly"))
+
+	// anomalyStates are the anomalies of each workload that are ongoing or detected, by namespace and name.
+	// It is guarded by statesMutex.
+	anomalyStates = make(map[string]map[Anomaly]*anomalyState)
+)
+
+// anomalyState is an anomaly of a workload whose pattern is ongoing
+type anomalyState struct {
+	// Since is when the pattern started
+	Since time.Time
+	// QueuedJobs and Pods are the queued jobs and pods when the pattern started
+	QueuedJobs int32
+	Pods       int32
+	// Detected is true once the pattern lasted long enough to be reported
+	Detected bool
+}
+
+// anomalyObservation is whether the pattern of an anomaly is observed in a decision, and its suggested cause
+type anomalyObservation struct {
+	Observed    bool
+	Description string
+	Cause       string
+}
+
+// recordAnomalies tracks the patterns of the anomalies in the decisions of a workload, and reports an anomaly once its
+// pattern lasted the anomaly window, or the max pinned duration, and when it's resolved
+func recordAnomalies(decision *Decision, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if !args.Anomalies.Enabled() {
+		return
+	}
+	key := stateKey(deployment)
+	states, exists := anomalyStates[key]
+	if !exists {
+		states = make(map[Anomaly]*anomalyState)
+		anomalyStates[key] = states
+	}
+	now := time.Now()
+	for _, anomaly := range []Anomaly{AnomalyQueueWithIdleAgents, AnomalyQueueNotScaledUp, AnomalyPinnedAtMax} {
+		state := states[anomaly]
+		observation := observeAnomaly(anomaly, decision, state)
+		labels := anomalyLabels(agentPoolID, deployment, anomaly)
+		if !observation.Observed {
+			if state != nil && state.Detected {
+				anomalyGauge.With(labels).Set(0)
+				message := fmt.Sprintf("Resolved after %s: %s", now.Sub(state.Since).Round(time.Second), anomaly)
+				workloadLogger(agentPoolID, deployment).Info(message)
+				createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, eventReasonAnomalyResolved, message)
+			}
+			delete(states, anomaly)
+			continue
+		}
+		if state == nil {
+			state = &anomalyState{Since: now, QueuedJobs: decision.NumQueuedJobs, Pods: decision.NumPods}
+			states[anomaly] = state
+		}
+		window := args.Anomalies.Window
+		if anomaly == AnomalyPinnedAtMax {
+			window = args.Anomalies.MaxPinned
+		}
+		if state.Detected || now.Sub(state.Since) < window {
+			continue
+		}
+		state.Detected = true
+		anomalyGauge.With(labels).Set(1)
+		anomalyCounter.With(labels).Inc()
+		message := fmt.Sprintf("%s for %s. Suggested cause: %s", observation.Description, now.Sub(state.Since).Round(time.Second), observation.Cause)
+		workloadLogger(agentPoolID, deployment).Warn(message)
+		createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonAnomalyDetected, message)
+		notify.Send(notify.Notification{
+			Type:         notify.TypeAnomalyDetected,
+			Severity:     notify.SeverityWarning,
+			Time:         now,
+			Namespace:    deployment.Namespace,
+			Workload:     deployment.FriendlyName,
+			AgentPoolID:  agentPoolID,
+			FromReplicas: decision.NumPods,
+			ToReplicas:   decision.DesiredReplicas,
+			Reason:       message,
+		})
+	}
+}
+
+// observeAnomaly returns whether the pattern of an anomaly is observed in a decision. The state is the ongoing pattern,
+// or nil if it isn't ongoing.
+func observeAnomaly(anomaly Anomaly, decision *Decision, state *anomalyState) anomalyObservation {
+	switch anomaly {
+	case AnomalyQueueWithIdleAgents:
+		// A shrinking queue is the idle agents being assigned the jobs
+		return anomalyObservation{
+			Observed:    decision.NumQueuedJobs > 0 && decision.NumIdleAgents > 0 && (state == nil || decision.NumQueuedJobs >= state.QueuedJobs),
+			Description: fmt.Sprintf("%d jobs are queued while %d agents are idle", decision.NumQueuedJobs, decision.NumIdleAgents),
+			Cause:       "the queued jobs demand capabilities the idle agents don't have, the idle agents are disabled, or the organization is out of parallel jobs",
+		}
+	case AnomalyQueueNotScaledUp:
+		cause := "the new agents don't come online, ex: their pods can't be scheduled or pull their image, or the agents can't register"
+		if suppressors := decision.SuppressorNames(); len(suppressors) > 0 {
+			cause = fmt.Sprintf("the scale ups are suppressed by %s", strings.Join(suppressors, ", "))
+		}
+		// The maximum limiting the scale ups is reported as pinned at max
+		return anomalyObservation{
+			Observed:    decision.NumQueuedJobs > 0 && decision.NumIdleAgents == 0 && !decision.HasSuppressor(SuppressorMax) && (state == nil || decision.NumPods <= state.Pods),
+			Description: fmt.Sprintf("%d jobs are queued without any free agents and the workload isn't scaled up from %d replicas", decision.NumQueuedJobs, decision.NumPods),
+			Cause:       cause,
+		}
+	case AnomalyPinnedAtMax:
+		return anomalyObservation{
+			Observed:    decision.HasSuppressor(SuppressorMax),
+			Description: fmt.Sprintf("The workload is pinned at its maximum of %d replicas with %d jobs queued", decision.NumPods, decision.NumQueuedJobs),
+			Cause:       "the demand exceeds the maximum, raise it, or look for stuck or unusually long jobs keeping the agents busy",
+		}
+	}
+	return anomalyObservation{}
+}
+
+// anomalyLabels returns the metric labels of an anomaly of a workload
+func anomalyLabels(agentPoolID int, deployment *kubernetes.Workload, anomaly Anomaly) prometheus.Labels {
+	labels := metricLabels(agentPoolID, deployment)
+	labels["anomaly"] = string(anomaly)
+	return labels
+}
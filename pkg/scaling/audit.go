@@ -0,0 +1,50 @@
+package scaling
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+// audit writes a structured record of a scaling decision to the audit log. The decision is nil if the cycle failed
+// before it was made.
+func audit(decision *Decision, agentPoolID int, deployment *kubernetes.Workload, args args.Args, err error) {
+	if logging.AuditLogger == nil {
+		return
+	}
+
+	fields := log.Fields{
+		"workload":       deployment.FriendlyName,
+		"namespace":      deployment.Namespace,
+		"poolId":         agentPoolID,
+		"dryRun":         args.DryRun,
+		"min":            args.Min,
+		"max":            args.Max,
+		"scaleDownMax":   args.ScaleDown.Max,
+		"scaleDownDelay": args.ScaleDown.Delay.String(),
+	}
+	if decision != nil {
+		fields["queued"] = decision.NumQueuedJobs
+		fields["running"] = decision.NumActiveAgents
+		fields["idle"] = decision.NumIdleAgents
+		fields["pods"] = decision.NumPods
+		fields["pendingPods"] = decision.NumPendingPods
+		fields["failedPods"] = decision.NumFailedPods
+		fields["stalePods"] = decision.NumStalePods
+		fields["missingPods"] = decision.NumMissingPods
+		fields["desired"] = decision.DesiredReplicas
+		fields["action"] = string(decision.Action())
+		fields["reason"] = decision.Reason
+		fields["suppressors"] = decision.SuppressorNames()
+	}
+	entry := logging.AuditLogger.WithFields(fields)
+	if decision == nil {
+		entry.WithError(err).Error("Scaling cycle failed before a decision was made")
+	} else if err != nil {
+		entry.WithError(err).Error("Scaling decision failed")
+	} else {
+		entry.Info("Scaling decision")
+	}
+}
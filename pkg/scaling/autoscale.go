@@ -2,95 +2,594 @@ package scaling
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
-	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/tracing"
 )
 
+var logger = logging.Component("scaling")
+
+// cycle is incremented every autoscaling iteration, to correlate the logs of an iteration
+var cycle uint64
+
+// workloadLogger returns a logger with the fields of the workload and the autoscaling iteration.
+// The entry is created with its fields instead of with WithFields, which copies them, as it's created several times an iteration.
+func workloadLogger(agentPoolID int, deployment *kubernetes.Workload) *log.Entry {
+	return &log.Entry{
+		Logger: logger,
+		Data: log.Fields{
+			"pool":      agentPoolID,
+			"namespace": deployment.Namespace,
+			"workload":  deployment.FriendlyName,
+			"cycle":     atomic.LoadUint64(&cycle),
+		},
+	}
+}
+
+// startCycle starts the trace of an autoscaling iteration, and increments the iteration its logs are correlated with
+func startCycle() *tracing.Span {
+	span := tracing.StartTrace("autoscale")
+	span.SetAttribute("cycle", atomic.AddUint64(&cycle, 1))
+	return span
+}
+
+// metricLabelNames are the labels of the autoscaling metrics
+var metricLabelNames = []string{"pool", "namespace", "workload"}
+
 var (
-	lastScaleDown    = time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC)
-	scaleDownCounter = promauto.NewCounter(prometheus.CounterOpts{
+	scaleDownCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "azp_agent_autoscaler_scale_down_count",
 		Help: "The total number of scale downs",
-	})
-	scaleUpCounter = promauto.NewCounter(prometheus.CounterOpts{
+	}, metricLabelNames)
+	scaleUpCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "azp_agent_autoscaler_scale_up_count",
 		Help: "The total number of scale ups",
-	})
-	scaleDownLimitedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	}, metricLabelNames)
+	scaleDownLimitedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "azp_agent_autoscaler_scale_down_limited_count",
 		Help: "The total number of scale downs prevented due to limits",
-	})
-	scaleSizeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	}, metricLabelNames)
+	scaleSizeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azp_agent_autoscaler_scale_size",
 		Help: "The size of the agent scaling",
-	})
-	totalAgentsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	}, metricLabelNames)
+	totalAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azp_agent_autoscaler_total_agents_count",
-		Help: "The total number of agents",
-	})
-	activeAgentsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Help: "The total number of agent pods, which is the current number of replicas",
+	}, metricLabelNames)
+	desiredReplicasGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_desired_replicas_count",
+		Help: "The desired number of replicas",
+	}, metricLabelNames)
+	activeAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azp_agent_autoscaler_active_agents_count",
 		Help: "The number of active agents",
-	})
-	pendingAgentsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	}, metricLabelNames)
+	idleAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_idle_agents_count",
+		Help: "The number of idle agents",
+	}, metricLabelNames)
+	registeredAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_registered_agents_count",
+		Help: "The number of agents registered in the agent pool",
+	}, metricLabelNames)
+	onlineAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_online_agents_count",
+		Help: "The number of online agents in the agent pool",
+	}, metricLabelNames)
+	runningJobsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_running_jobs_count",
+		Help: "The number of jobs running in the agent pool",
+	}, metricLabelNames)
+	pendingAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azp_agent_autoscaler_pending_agents_count",
 		Help: "The number of pending agents",
-	})
-	failedAgentsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	}, metricLabelNames)
+	failedAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azp_agent_autoscaler_failed_agents_count",
 		Help: "The number of failed agents",
-	})
-	queuedPodsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	}, metricLabelNames)
+	queuedPodsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "azp_agent_autoscaler_queued_pods_count",
-		Help: "The number of queued pods",
-	})
+		Help: "The number of queued jobs",
+	}, metricLabelNames)
+	rateLimitedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_scale_rate_limited_count",
+		Help: "The total number of scale operations prevented by the rate limit",
+	}, metricLabelNames)
+	lastSuccessfulPollGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_last_successful_poll_timestamp",
+		Help: "The Unix time the agents, jobs and pods were last retrieved without an error",
+	}, metricLabelNames)
+	lastSuccessfulScaleGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_last_successful_scale_timestamp",
+		Help: "The Unix time the agents were last scaled without an error",
+	}, metricLabelNames)
+	decisionCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_decision_count",
+		Help: "The total number of scaling decisions, by action and by the reason the replicas were chosen",
+	}, append(metricLabelNames, "action", "reason"))
 )
 
+// metricLabels returns the metric labels of a workload
+func metricLabels(agentPoolID int, deployment *kubernetes.Workload) prometheus.Labels {
+	return prometheus.Labels{
+		"pool":      strconv.Itoa(agentPoolID),
+		"namespace": deployment.Namespace,
+		"workload":  deployment.FriendlyName,
+	}
+}
+
 // Autoscale the agent deployment
-func Autoscale(azdClient azuredevops.ClientAsync, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) error {
-	agentsChan := make(chan azuredevops.PoolAgentsResponse)
-	jobsChan := make(chan azuredevops.JobRequestsResponse)
-	podsChan := make(chan kubernetes.Pods)
-
-	// Get all active agents
-	go azdClient.ListPoolAgentsAsync(agentsChan, agentPoolID)
-	// Get all queued jobs
-	go azdClient.ListJobRequestsAsync(jobsChan, agentPoolID)
-	// Get all pods
-	go k8sClient.GetPodsAsync(podsChan, deployment)
+func Autoscale(backend ci.Backend, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) error {
+	_, err := AutoscaleTarget(backend, k8sClient, Target{Workload: deployment, AgentPoolID: agentPoolID}, args)
+	return err
+}
+
+// AutoscaleTarget autoscales a single workload independently of the other workloads, with the target's arguments if it has them.
+// It is safe to call concurrently for different workloads. The decision is nil if it couldn't be made.
+func AutoscaleTarget(backend ci.Backend, k8sClient kubernetes.ClientAsync, target Target, args args.Args) (*Decision, error) {
+	span := startCycle()
+	defer span.End()
+
+	decision, err := autoscale(target.BackendOr(backend), target.pool(), k8sClient, target.Workload, target.ArgsOr(args), false, nil, span)
+	span.SetError(err)
+	return decision, err
+}
+
+// autoscale plans and applies the scaling of the agent deployment.
+// If constrained, a higher priority workload is limited by the cluster capacity.
+// The agents and jobs of the snapshot are used if it isn't nil, instead of retrieving them.
+func autoscale(backend ci.Backend, pool poolKey, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, constrained bool, snapshot *poolSnapshot, parentSpan *tracing.Span) (decision *Decision, err error) {
+	agentPoolID := pool.AgentPoolID
+	span := parentSpan.StartChild("reconcile")
+	defer span.End()
+	span.SetAttribute("pool", agentPoolID)
+	span.SetAttribute("namespace", deployment.Namespace)
+	span.SetAttribute("workload", deployment.FriendlyName)
+
+	// A cycle that fails before a decision is made is still audited and reported with its error
+	defer func() {
+		if decision == nil && err != nil {
+			recordFailure(agentPoolID, deployment, args, err)
+		}
+	}()
+
+	// The agents, jobs and pods are retrieved before locking, so other workloads can be autoscaled concurrently
+	timings := newCycleTimings()
+	observed, err := observe(backend, agentPoolID, k8sClient, deployment, snapshot, args, span, timings)
+	if err != nil {
+		span.SetError(err)
+		timings.report(workloadLogger(agentPoolID, deployment), agentPoolID, deployment)
+		failStatic(err, agentPoolID, k8sClient, deployment, args)
+		return nil, err
+	}
+
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	recordBackendAvailable(agentPoolID, deployment)
+
+	if err := claimWorkload(agentPoolID, k8sClient, deployment, args); err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	// The last scale up is verified before deciding the next, so a failed registration pauses it
+	verifyRegistration(observed, agentPoolID, k8sClient, deployment, args)
+	// The stale duplicates of the agents are left out before they're counted
+	observed = removeDuplicateAgents(observed, agentPoolID, backend, k8sClient, deployment, args)
+
+	policyStart := time.Now()
+	decision, err = evaluate(observed, pool, k8sClient, deployment, args, constrained, span)
+	timings.record(phasePolicy, time.Since(policyStart))
+	if err != nil {
+		span.SetError(err)
+		timings.report(workloadLogger(agentPoolID, deployment), agentPoolID, deployment)
+		return nil, err
+	}
+	drainScaleDown(observed, decision, getState(deployment), agentPoolID, backend, k8sClient, deployment, args, decision.Time)
+	if args.Kubernetes.IsSpot(deployment.Name) {
+		spotBackfills[pool] = getSpotBackfill(decision)
+	}
+	lastSuccessfulPollGauge.With(metricLabels(agentPoolID, deployment)).SetToCurrentTime()
+	recordActivity(decision)
+	span.SetAttribute("action", string(decision.Action()))
+	span.SetAttribute("desiredReplicas", decision.DesiredReplicas)
+
+	err = apply(decision, agentPoolID, k8sClient, deployment, args, span, timings)
+	span.SetError(err)
+	timings.report(workloadLogger(agentPoolID, deployment), agentPoolID, deployment)
+	checkPodSelector(observed, agentPoolID, k8sClient, deployment, args)
+	annotateSafeToEvict(observed, decision, agentPoolID, k8sClient, deployment, args)
+	recycleAgents(observed, decision, agentPoolID, k8sClient, deployment, args)
+	replaceOfflineAgents(observed, agentPoolID, k8sClient, deployment, args)
+	forceDeleteTerminatingPods(observed, agentPoolID, k8sClient, deployment, args)
+	quarantineAgents(observed, agentPoolID, backend, k8sClient, deployment, args)
+	syncCapabilities(observed, agentPoolID, backend, deployment, args)
+	rollover(observed, decision, agentPoolID, backend, k8sClient, deployment, args)
+	reconcileBalloon(agentPoolID, k8sClient, deployment, args)
+	audit(decision, agentPoolID, deployment, args, err)
+	publishDecision(decision, agentPoolID, deployment, args, err)
+	recordStatus(decision, agentPoolID, deployment, err)
+	recordExplanation(decision, agentPoolID, deployment, args, err)
+	recordRightSizing(observed, decision, agentPoolID, deployment, args)
+	recordAnomalies(decision, agentPoolID, k8sClient, deployment, args)
+
+	// Save changes made through the admin API that didn't result in a scale operation
+	if state := getState(deployment); state.changed {
+		state.changed = false
+		saveState(k8sClient, deployment, args)
+	}
+	return decision, err
+}
+
+// recordFailure audits a cycle that failed before a scaling decision was made, and records its error in the status and
+// explain endpoints. It's deferred, so it locks statesMutex itself.
+func recordFailure(agentPoolID int, deployment *kubernetes.Workload, args args.Args, err error) {
+	audit(nil, agentPoolID, deployment, args, err)
+	health.RecordFailure(health.DecisionStatus{
+		Time:        time.Now(),
+		Namespace:   deployment.Namespace,
+		Workload:    deployment.FriendlyName,
+		AgentPoolID: agentPoolID,
+		Action:      string(ActionNone),
+		Error:       err.Error(),
+	})
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	recordExplanation(nil, agentPoolID, deployment, args, err)
+}
+
+// recordStatus records the scaling decision in the status endpoint
+func recordStatus(decision *Decision, agentPoolID int, deployment *kubernetes.Workload, err error) {
+	status := health.DecisionStatus{
+		Time:            time.Now(),
+		Namespace:       deployment.Namespace,
+		Workload:        deployment.FriendlyName,
+		AgentPoolID:     agentPoolID,
+		CurrentReplicas: decision.NumPods,
+		DesiredReplicas: decision.DesiredReplicas,
+		Action:          string(decision.Action()),
+		Reason:          decision.Reason,
+		Suppressors:     decision.SuppressorNames(),
+		Rollout:         decision.Rollout,
+		QueuedJobs:      decision.NumQueuedJobs,
+		ActiveAgents:    decision.NumActiveAgents,
+		IdleAgents:      decision.NumIdleAgents,
+		AgentStates:     make(map[string]int),
+	}
+	for _, agent := range decision.Agents {
+		if !agent.Enabled {
+			status.AgentStates["disabled"]++
+		} else if !agent.Online {
+			status.AgentStates["offline"]++
+		} else if agent.Busy {
+			status.AgentStates["busy"]++
+		} else {
+			status.AgentStates["idle"]++
+		}
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	health.RecordDecision(status)
+}
+
+// apply scales the agent deployment according to the decision
+func apply(decision *Decision, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, span *tracing.Span, timings *cycleTimings) error {
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	// Apply metrics
+	labels := metricLabels(agentPoolID, deployment)
+	numRegisteredAgents, numOnlineAgents, numRunningJobs := 0, 0, 0
+	for _, agent := range decision.Agents {
+		numRegisteredAgents++
+		if agent.Online {
+			numOnlineAgents++
+		}
+		if agent.Busy {
+			numRunningJobs++
+		}
+	}
+	totalAgentsGauge.With(labels).Set(float64(decision.NumPods))
+	desiredReplicasGauge.With(labels).Set(float64(decision.DesiredReplicas))
+	activeAgentsGauge.With(labels).Set(float64(decision.NumActiveAgents))
+	idleAgentsGauge.With(labels).Set(float64(decision.NumIdleAgents))
+	registeredAgentsGauge.With(labels).Set(float64(numRegisteredAgents))
+	onlineAgentsGauge.With(labels).Set(float64(numOnlineAgents))
+	runningJobsGauge.With(labels).Set(float64(numRunningJobs))
+	pendingAgentsGauge.With(labels).Set(float64(decision.NumPendingPods))
+	failedAgentsGauge.With(labels).Set(float64(decision.NumFailedPods))
+	staleAgentsGauge.With(labels).Set(float64(decision.NumStalePods))
+	missingOrdinalsGauge.With(labels).Set(float64(decision.NumMissingPods))
+	queuedPodsGauge.With(labels).Set(float64(decision.NumQueuedJobs))
+	recordAgentIdleTimes(labels, decision.AgentIdleTimes)
+	decisionLabels := metricLabels(agentPoolID, deployment)
+	decisionLabels["action"] = string(decision.Action())
+	decisionLabels["reason"] = decision.ReasonLabel()
+	decisionCounter.With(decisionLabels).Inc()
+	if decision.ScaleDownLimited {
+		scaleDownLimitedCounter.With(labels).Inc()
+	}
+	if decision.HasSuppressor(SuppressorRateLimit) {
+		rateLimitedCounter.With(labels).Inc()
+	}
+	if decision.HasSuppressor(SuppressorQuota) {
+		quotaLimitedCounter.With(labels).Inc()
+	}
+	if decision.HasSuppressor(SuppressorHealthGate) {
+		healthGateLimitedCounter.With(labels).Inc()
+	}
+
+	exportDecision(decision, agentPoolID, deployment)
 
-	agents := <-agentsChan
-	if agents.Err != nil {
-		return agents.Err
+	applyPendingBackoff(decision, agentPoolID, labels, k8sClient, deployment, args)
+	createBlockedEvent(decision, k8sClient, deployment, args)
+	createQuotaEvent(decision, k8sClient, deployment, args)
+	createHealthGateEvent(decision, k8sClient, deployment, args)
+	scaleUpNodePool(decision, agentPoolID, k8sClient, deployment, args)
+
+	if !decision.IsScaling() {
+		scaleSizeGauge.With(labels).Set(0)
+		return nil
+	}
+
+	numPods, podsToScaleTo := decision.NumPods, decision.DesiredReplicas
+	if podsToScaleTo < numPods {
+		scaleDownCounter.With(labels).Inc()
+	} else {
+		scaleUpCounter.With(labels).Inc()
+	}
+	scaleSizeGauge.With(labels).Set(float64(podsToScaleTo - numPods))
+
+	if err := verifyScale(decision, agentPoolID, k8sClient, deployment, args); err != nil {
+		return err
+	}
+	removedPodNames := getRemovedPodNames(decision, deployment)
+	annotateDrain(agentPoolID, k8sClient, deployment, args, removedPodNames)
+	if args.DryRun {
+		workloadLogger.Infof("Dry run - would scale %s from %d to %d pods", deployment.FriendlyName, numPods, podsToScaleTo)
+		logDryRunRemovals(workloadLogger, decision.Agents, removedPodNames)
+		return nil
+	}
+
+	preEvent, postEvent := execHookEvents(podsToScaleTo < numPods)
+	if err := runExecHooks(preEvent, decision, agentPoolID, deployment, args.ExecHooks, nil); err != nil {
+		if args.ExecHooks.IsFail() {
+			return fmt.Errorf("Not scaling %s: %w", deployment.FriendlyName, err)
+		}
+		workloadLogger.Warnf("Scaling %s anyway: %s", deployment.FriendlyName, err.Error())
 	}
-	jobs := <-jobsChan
-	if jobs.Err != nil {
-		return jobs.Err
+
+	if len(decision.PodsToRemove) > 0 {
+		removed, err := removeTargetedPods(decision, agentPoolID, k8sClient, deployment)
+		if removed == 0 {
+			return fmt.Errorf("Error deleting the idle agent pods of %s: %w", deployment.FriendlyName, err)
+		} else if err != nil {
+			workloadLogger.Warnf("Error deleting the idle agent pods of %s, only scaling down by the %d deleted pods: %s", deployment.FriendlyName, removed, err.Error())
+			podsToScaleTo = numPods - removed
+			decision.DesiredReplicas = podsToScaleTo
+		}
+	}
+
+	workloadLogger.Infof("Scaling %s from %d to %d pods", deployment.FriendlyName, numPods, podsToScaleTo)
+	scaleSpan := span.StartChild("kubernetes.Scale")
+	scaleStart := time.Now()
+	err := k8sClient.Sync().Scale(deployment, podsToScaleTo)
+	timings.record(phaseScale, time.Since(scaleStart))
+	scaleSpan.SetError(err)
+	scaleSpan.End()
+	createScaleEvent(decision, k8sClient, deployment, args, err)
+	exportScale(decision, agentPoolID, deployment, err)
+	notifyScale(decision, agentPoolID, deployment, err)
+	if hookErr := runExecHooks(postEvent, decision, agentPoolID, deployment, args.ExecHooks, err); hookErr != nil {
+		workloadLogger.Warn(hookErr.Error())
+	}
+	if err != nil {
+		return err
+	}
+	lastSuccessfulScaleGauge.With(labels).SetToCurrentTime()
+
+	if podsToScaleTo < numPods {
+		recordScale(deployment, ScaleDirectionDown, podsToScaleTo, args.RateLimit.Window)
+	} else {
+		recordScale(deployment, ScaleDirectionUp, podsToScaleTo, args.RateLimit.Window)
+		startRegistration(deployment, numPods, args)
+	}
+	saveState(k8sClient, deployment, args)
+	return nil
+}
+
+// saveState persists the scaling state if enabled. Errors are only logged, as the state is not required to scale.
+// A dry run doesn't change anything in the cluster, so it only loads the state.
+func saveState(k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if args.State.ConfigMapName != "" && !args.DryRun {
+		if err := SaveState(StateStore(k8sClient.Sync(), args)); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// Plan determines the number of pods the agent deployment should be scaled to, without scaling it
+func Plan(backend ci.Backend, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) (*Decision, error) {
+	return plan(backend, agentPoolID, k8sClient, deployment, args, false, nil)
+}
+
+// Preview determines how an autoscaling cycle would scale the agent deployment from its scaling state, including the
+// limits applied after the decision, ex: holding a scale down while its agents are drained. It doesn't scale the agent
+// deployment, drain its agents, create events or change its scaling state.
+func Preview(backend ci.Backend, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) (*Decision, error) {
+	observed, err := observe(backend, agentPoolID, k8sClient, deployment, nil, args, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	decision, err := evaluate(observed, poolKey{AgentPoolID: agentPoolID}, k8sClient, deployment, args, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	args.Events = false
+	drainScaleDown(observed, decision, copyDrainState(getState(deployment)), agentPoolID, newPreviewBackend(backend, args.Backend), k8sClient, deployment, args, decision.Time)
+	return decision, nil
+}
+
+// plan determines how the agent deployment should be scaled.
+// If constrained, the workload isn't scaled up and doesn't keep free agents, to give capacity to higher priority workloads.
+func plan(backend ci.Backend, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, constrained bool, span *tracing.Span) (*Decision, error) {
+	observed, err := observe(backend, agentPoolID, k8sClient, deployment, nil, args, span, nil)
+	if err != nil {
+		return nil, err
+	}
+	return evaluate(observed, poolKey{AgentPoolID: agentPoolID}, k8sClient, deployment, args, constrained, span)
+}
+
+// observation is the agents, jobs and pods a scaling decision is made from.
+// The agents and jobs can be shared with the other workloads of the pool, so they must not be modified.
+type observation struct {
+	Agents []ci.Agent
+	Jobs   []ci.Job
+	Pods   []corev1.Pod
+}
+
+// observe retrieves the pods of the agent deployment, and the agents and jobs of the agent pool if there isn't a snapshot
+// of them from this iteration, within the rate. The agents have the pod names of the agent name pattern.
+// It doesn't read the scaling state, so it can be called without holding statesMutex.
+func observe(backend ci.Backend, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, snapshot *poolSnapshot, args args.Args, span *tracing.Span, timings *cycleTimings) (observation, error) {
+	podsChan := make(chan kubernetes.Pods, 1)
+	podsDuration := make(chan time.Duration, 1)
+	podsSpan := span.StartChild("kubernetes.GetPods")
+
+	// Get all pods
+	go func() {
+		defer podsSpan.End()
+		start := time.Now()
+		k8sClient.GetPodsAsync(podsChan, deployment)
+		podsDuration <- time.Since(start)
+	}()
+
+	var err error
+	if snapshot == nil {
+		var fetched poolSnapshot
+		fetched, err = fetchSnapshot(backend, agentPoolID, args.Rate, span)
+		snapshot = &fetched
 	}
 	pods := <-podsChan
+	podsSpan.SetError(pods.Err)
+	timings.record(phasePods, <-podsDuration)
+	if err != nil {
+		return observation{}, err
+	}
+	timings.record(phaseAgents, snapshot.AgentsDuration)
+	timings.record(phaseJobs, snapshot.JobsDuration)
 	if pods.Err != nil {
-		return pods.Err
+		return observation{}, pods.Err
+	}
+	// The snapshot of the pool is shared by its workloads, so its agents aren't modified
+	agents := args.AgentNames.PodNames(snapshot.Agents, deployment.Name)
+	return observation{Agents: agents, Jobs: snapshot.Jobs, Pods: pods.Pods}, nil
+}
+
+// evaluate determines how the agent deployment should be scaled from the observed agents, jobs and pods, by taking a
+// snapshot of the workload and deciding its replicas from it. The caller must hold statesMutex while autoscaling.
+func evaluate(observed observation, pool poolKey, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, constrained bool, span *tracing.Span) (*Decision, error) {
+	evaluateSpan := span.StartChild("policy.evaluate")
+	defer evaluateSpan.End()
+
+	snapshot, err := takeSnapshot(observed, pool, k8sClient, deployment, args, constrained, evaluateSpan)
+	if err != nil {
+		return nil, err
 	}
+	decision := DecideReplicas(snapshot, args)
 
-	// Get all pod names and statuses
+	// Listing the nodes and pods of the cluster is expensive, so the capacity is only retrieved for a scale up,
+	// and the scale up is decided again with it. The agents of an ignored PriorityClass preempt any pod they need to.
+	if args.Capacity.Checks(deployment.PodTemplateSpec.Spec.PriorityClassName) && snapshot.Capacity == nil && decision.DesiredReplicas > decision.NumPods {
+		capacitySpan := evaluateSpan.StartChild("kubernetes.GetCapacity")
+		capacity, err := getCapacity(pool.AgentPoolID, k8sClient, deployment, args.Capacity)
+		capacitySpan.SetError(err)
+		capacitySpan.End()
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Capacity = &capacity
+		decision = DecideReplicas(snapshot, args)
+	}
+
+	// The quotas are also only retrieved for a scale up, after it's limited by the capacity
+	if args.Capacity.Quota && decision.DesiredReplicas > decision.NumPods {
+		quotaSpan := evaluateSpan.StartChild("kubernetes.GetResourceQuotas")
+		quotas, err := k8sClient.Sync().GetResourceQuotas(deployment.Namespace)
+		quotaSpan.SetError(err)
+		quotaSpan.End()
+		if err != nil {
+			return nil, fmt.Errorf("Error listing the ResourceQuotas of namespace %s: %w", deployment.Namespace, err)
+		}
+		if snapshot.Quota = kubernetes.EstimateQuotaPods(quotas, deployment.PodTemplateSpec.Spec); snapshot.Quota != nil {
+			decision = DecideReplicas(snapshot, args)
+		}
+	}
+
+	// The health gates are only checked for a scale up they would limit, after it's limited by the capacity and quotas
+	if args.HealthGates.Enabled() && decision.DesiredReplicas > decision.NumPods+args.HealthGates.MaxScaleUp {
+		healthSpan := evaluateSpan.StartChild("healthGates.Check")
+		snapshot.UnhealthyGates = checkHealthGates(k8sClient, deployment, args.HealthGates)
+		healthSpan.End()
+		if len(snapshot.UnhealthyGates) > 0 {
+			decision = DecideReplicas(snapshot, args)
+		}
+	}
+
+	hookSpan := evaluateSpan.StartChild("decisionHook.Review")
+	err = reviewDecision(decision, snapshot, args)
+	hookSpan.SetError(err)
+	hookSpan.End()
+	if err != nil {
+		return nil, err
+	}
+	recordSnapshot(snapshot, decision, args.Record)
+	return decision, nil
+}
+
+// DecideReplicas determines how the workload of a snapshot should be scaled with the given scaling policy.
+// It only reads the snapshot, so the same snapshot and policy always make the same decision.
+func DecideReplicas(snapshot Snapshot, args args.Args) *Decision {
+	agentPoolID, deployment, now := snapshot.AgentPoolID, snapshot.Workload, snapshot.Time
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	decision := &Decision{Time: now, Agents: snapshot.Agents}
+
+	// Get all pod names and statuses. The stale pods can't take jobs, so they aren't available agents, and don't
+	// prevent scaling like the pending and failed pods.
 	podNames := make(collections.StringSet)
-	numPods := int32(len(pods.Pods))
-	numRunningPods, numPendingPods, numUnschedulablePods := int32(0), int32(0), int32(0)
-	for _, pod := range pods.Pods {
+	numPods := int32(len(snapshot.Pods))
+	stalePodNames := getStalePodNames(snapshot.Pods, snapshot.Agents, args.StalePods, now)
+	numStalePods := int32(len(stalePodNames))
+	numRunningPods, numPendingPods, numUnschedulablePods, numTerminatingPods := int32(0), int32(0), int32(0), int32(0)
+	for _, pod := range snapshot.Pods {
 		podNames.Add(pod.Name)
-		if pod.Status.Phase == corev1.PodRunning {
+		if stalePodNames.Contains(pod.Name) {
+			continue
+		} else if snapshot.Replicas != nil && pod.DeletionTimestamp != nil {
+			// The ordinals of the terminating pods are counted as missing
+			numTerminatingPods = numTerminatingPods + 1
+		} else if pod.Status.Phase == corev1.PodRunning {
 			allContainersRunning := true
 			for _, containerStatus := range pod.Status.ContainerStatuses {
 				if containerStatus.State.Running == nil || containerStatus.State.Terminated != nil {
@@ -112,69 +611,263 @@ func Autoscale(azdClient azuredevops.ClientAsync, agentPoolID int, k8sClient kub
 			}
 		}
 	}
-	numFailedPods := numPods - numRunningPods - numPendingPods
+	numFailedPods := numPods - numRunningPods - numPendingPods - numStalePods - numTerminatingPods
+	// The stale pods are counted in the pods to scale from, but not in the available agents
+	numAvailablePods := numPods - numStalePods
+	// With the ordinal gaps, a StatefulSet is scaled from its replicas, and its missing ordinals aren't available agents
+	numMissingPods := int32(0)
+	if snapshot.Replicas != nil {
+		numMissingPods = getNumMissingOrdinals(snapshot.Pods, deployment.Name, *snapshot.Replicas)
+		numPods = *snapshot.Replicas
+		numAvailablePods = math.MaxInt32(0, numPods-numMissingPods-numStalePods)
+	}
 
-	logging.Logger.Tracef("%d pods (%d running, %d pending, %d failed)", numPods, numRunningPods, numPendingPods, numFailedPods)
+	workloadLogger.Tracef("%d pods (%d running, %d pending, %d failed, %d stale)", numPods, numRunningPods, numPendingPods, numFailedPods, numStalePods)
+	if numMissingPods > 0 {
+		workloadLogger.Debugf("%d of the %d ordinals of %s don't have a pod or their pod is terminating - not counting them as available agents", numMissingPods, numPods, deployment.FriendlyName)
+	}
+	if numStalePods > 0 {
+		workloadLogger.Debugf("%d pods are crash looping, restarting or not ready and their agent isn't online - not counting them as available agents", numStalePods)
+	}
 
-	// Get number of active agents
-	activeAgentNames := getActiveAgentNames(agents.Agents, podNames)
-	activeAgentPodNames := getActiveAgentPodNames(agents.Agents, podNames)
-	numActiveAgents := int32(len(activeAgentNames))
+	// Get number of active agents, which are the busy agents and the agents with a running job, as the agents and jobs
+	// aren't retrieved at the same time and an agent can go offline while its job is still running
+	activeAgentNames := getActiveAgentNames(snapshot.Agents, podNames)
+	activeAgentPodNames := getActiveAgentPodNames(snapshot.Agents, snapshot.Jobs, podNames)
+	numActiveAgents := int32(len(activeAgentPodNames))
+	// The busy agents of a drain forced after its timeout are still counted as active, but don't hold the scale down
+	forcedPodNames := getForcedDrainPodNames(snapshot.State.Drain, args.ScaleDown, now)
+	numForcedAgents := int32(0)
+	for podName := range forcedPodNames {
+		if activeAgentPodNames.Contains(podName) {
+			numForcedAgents = numForcedAgents + 1
+		}
+	}
+	if numBusyAgents := int32(len(activeAgentNames)); numActiveAgents > numBusyAgents {
+		workloadLogger.Debugf("%d agents aren't busy or are offline, but are running a job", numActiveAgents-numBusyAgents)
+	}
 
 	// Determine the number of jobs that are queued
-	numQueuedJobs := getNumQueuedJobs(jobs.Jobs, activeAgentNames)
+	routing := getJobRouting(deployment, args)
+	queuedJobs := getQueuedJobs(snapshot.Jobs, activeAgentNames, routing)
+	numQueuedJobs := int32(len(queuedJobs))
 
-	logging.Logger.Debugf("Found %d active agents out of %d agents in the cluster. There are %d queued jobs.", numActiveAgents, numPods, numQueuedJobs)
-
-	// Apply metrics
-	totalAgentsGauge.Set(float64(numPods))
-	activeAgentsGauge.Set(float64(numActiveAgents))
-	pendingAgentsGauge.Set(float64(numPendingPods))
-	failedAgentsGauge.Set(float64(numFailedPods))
-	queuedPodsGauge.Set(float64(numQueuedJobs))
+	// Weight the queued jobs by how long they have been waiting
+	queueDemand := getQueueDemand(queuedJobs, args.QueueAge, now)
+	if queueDemand != numQueuedJobs {
+		workloadLogger.Debugf("The %d queued jobs have a demand of %d agents after weighting by their queue time", numQueuedJobs, queueDemand)
+	}
 
-	if numRunningPods != numPods {
-		if !(numUnschedulablePods == numPendingPods && numFailedPods == 0) {
-			logging.Logger.Infof("Not scaling - there are %d pending pods and %d failed pods.", numPendingPods, numFailedPods)
-			scaleSizeGauge.Set(0)
-			return nil
+	// In the SLO policy, the demand is the number of agents needed to start jobs within the max queue time
+	if args.Policy.IsSLO() {
+		if estimate := estimateSLO(snapshot.Jobs, numQueuedJobs, args.Policy.SLO, now); estimate != nil {
+			decision.SLO = estimate
+			queueDemand = math.MaxInt32(0, estimate.RequiredAgents-numActiveAgents)
+			workloadLogger.Debugf("%.2f jobs are queued per minute with an average duration of %s - %d busy agents are needed to start jobs within %s", estimate.ArrivalRate, estimate.AverageDuration.String(), estimate.RequiredAgents, args.Policy.SLO.MaxQueueTime.String())
+		} else {
+			workloadLogger.Debugf("No jobs finished in the last %s - using the queued jobs as the demand", args.Policy.SLO.Window.String())
 		}
 	}
 
+	// The jobs waiting for an approval, a check or a delay warm up agents before they're queued
+	numWaitingJobs := int32(len(getWaitingJobs(snapshot.Jobs, activeAgentNames, routing, args.WaitingJobs, now)))
+	if numWaitingJobs > 0 {
+		workloadLogger.Debugf("Counting %d jobs waiting for an approval, a check or a delay as queued jobs", numWaitingJobs)
+		queueDemand = queueDemand + numWaitingJobs
+	}
+
+	// The other workloads of a pool with a spot workload only scale up for the agents the spot workload can't run
+	isSpot := args.Kubernetes.IsSpot(deployment.Name)
+	if snapshot.SpotBackfill != nil && !isSpot && len(args.Kubernetes.SpotWorkloads) > 0 {
+		workloadLogger.Debugf("The spot workload of the pool can't run %d of the agents it needs", *snapshot.SpotBackfill)
+		queueDemand = *snapshot.SpotBackfill
+	}
+
+	// The blue workload of a rollover keeps the free agents the green workload doesn't have yet, and doesn't run the queued jobs
+	isRolloverFrom := args.Rollover.From != "" && deployment.Name == args.Rollover.From
+	if isRolloverFrom {
+		workloadLogger.Debugf("Rolling over to %s - not scaling up for the %d queued jobs", args.Rollover.To, numQueuedJobs)
+		queueDemand = 0
+	}
+
+	workloadLogger.Debugf("Found %d active agents out of %d agents in the cluster. There are %d queued jobs.", numActiveAgents, numPods, numQueuedJobs)
+
+	decision.NumPods = numPods
+	decision.NumRunningPods = numRunningPods
+	decision.NumPendingPods = numPendingPods
+	decision.NumUnschedulablePods = numUnschedulablePods
+	decision.NumFailedPods = numFailedPods
+	decision.NumStalePods = numStalePods
+	decision.NumMissingPods = numMissingPods
+	decision.NumActiveAgents = numActiveAgents
+	decision.NumQueuedJobs = numQueuedJobs
+	decision.NumWaitingJobs = numWaitingJobs
+	decision.QueueDemand = queueDemand
+	decision.NumIdleAgents = getNumIdleAgents(snapshot.Agents, podNames, activeAgentPodNames)
+	decision.AgentIdleTimes = getAgentIdleTimes(snapshot.Agents, snapshot.Pods, activeAgentPodNames, now)
+	decision.RollingUpdate = snapshot.RollingUpdate
+	decision.Rollout = describeRollout(snapshot.RollingUpdate, args)
+	decision.DesiredReplicas = numPods
+
 	// Determine delta for how much to scale by
+	minFreeAgents := args.Min
+	// The other workloads of the pool keep the free agents, so the spot workload only runs the jobs above them
+	if snapshot.Constrained || isSpot {
+		minFreeAgents = 0
+	}
+	if isRolloverFrom {
+		minFreeAgents = math.MaxInt32(0, minFreeAgents-getRolloverOnlineAgents(snapshot.Agents, args.Rollover))
+	}
 	scale := int32(0)
-	if numActiveAgents+numQueuedJobs+args.Min > numPods {
+	if numActiveAgents+queueDemand+minFreeAgents > numAvailablePods {
 		// Scale up
-		scale = numActiveAgents + numQueuedJobs + args.Min - numPods
-	} else if numActiveAgents+args.Min+numQueuedJobs < numPods {
+		scale = numActiveAgents + queueDemand + minFreeAgents - numAvailablePods
+	} else if numActiveAgents+minFreeAgents+queueDemand < numAvailablePods {
 		// Scale down
-		scale = -numPods + numActiveAgents + args.Min + numQueuedJobs
+		scale = -numAvailablePods + numActiveAgents + minFreeAgents + queueDemand
+	}
+
+	decision.NumAvailablePods = numAvailablePods
+	decision.MinFreeAgents = minFreeAgents
+	decision.DemandedReplicas = numPods + scale
+
+	// Pausing and force scaling through the admin API take precedence over everything else
+	if state := snapshot.State; state.ForcedReplicas != nil {
+		workloadLogger.Infof("%s is force scaled to %d pods", deployment.FriendlyName, *state.ForcedReplicas)
+		decision.DesiredReplicas = *state.ForcedReplicas
+		decision.Reason = fmt.Sprintf("force scaled to %d pods", *state.ForcedReplicas)
+		decision.Cause = CauseForced
+		return decision
+	} else if state.Paused {
+		workloadLogger.Infof("Not scaling %s - autoscaling is paused", deployment.FriendlyName)
+		decision.Reason = "autoscaling is paused"
+		decision.limit(SuppressorPaused, numPods+scale, numPods)
+		return decision
+	}
+
+	// Don't interfere with a rolling update of the pods, ex: an image rollout. With the OnDelete update strategy, the
+	// StatefulSet controller doesn't roll the update out, so scaling isn't held.
+	if args.HoldRollingUpdates {
+		if update := snapshot.RollingUpdate; update.InProgress() {
+			workloadLogger.Infof("Not scaling %s - a rolling update to revision %s is in progress, %d of %d pods are updated", deployment.FriendlyName, update.UpdateRevision, update.UpdatedReplicas, update.Replicas)
+			decision.Reason = fmt.Sprintf("a rolling update to revision %s is in progress", update.UpdateRevision)
+			decision.limit(SuppressorRollingUpdate, numPods+scale, numPods)
+			return decision
+		}
+	}
+
+	// Scale a workload that was scaled outside of the autoscaler back with the revert manual scale policy
+	if revertTo := snapshot.RevertTo; revertTo != nil {
+		decision.DesiredReplicas = *revertTo
+		decision.Reason = fmt.Sprintf("reverting a manual scale to %d replicas", *revertTo)
+		decision.Cause = CauseRevertManualScale
+		return decision
+	}
+
+	if numRunningPods != numAvailablePods {
+		if !(numUnschedulablePods == numPendingPods && numFailedPods == 0) {
+			workloadLogger.Infof("Not scaling - there are %d pending pods and %d failed pods.", numPendingPods, numFailedPods)
+			decision.Reason = fmt.Sprintf("there are %d pending pods and %d failed pods", numPendingPods, numFailedPods)
+			decision.limit(SuppressorPendingPods, numPods+scale, numPods)
+			return decision
+		}
+	}
+
+	// Give the cluster capacity to higher priority workloads
+	if scale > 0 && snapshot.Constrained {
+		workloadLogger.Infof("Not scaling up %s - a higher priority workload is limited by the cluster capacity", deployment.FriendlyName)
+		decision.Reason = "a higher priority workload is limited by the cluster capacity"
+		decision.limit(SuppressorPriority, numPods+scale, numPods)
+		return decision
+	}
+
+	// Limit the scale up by the queue depth
+	if scale > 0 {
+		if maxScaleUp := args.ScaleUp.MaxAgentsForQueueDepth(queueDemand); maxScaleUp > 0 && scale > maxScaleUp {
+			workloadLogger.Debugf("Limiting the scale up from %d to %d agents for a queue depth of %d", scale, maxScaleUp, queueDemand)
+			decision.limit(SuppressorScaleUpStep, numPods+scale, numPods+maxScaleUp)
+			scale = maxScaleUp
+		}
 	}
 
 	// Allow scaling down if there are unschedulable pods
 	// This way node(s) don't have to be allocated and all of the pods launched before a scale down is allowed
 	if scale > 0 && numUnschedulablePods > 0 {
-		logging.Logger.Infof("Not scaling up - there are %d unschedulable pods.", numUnschedulablePods)
-		scaleSizeGauge.Set(0)
-		return nil
+		workloadLogger.Infof("Not scaling up - there are %d unschedulable pods.", numUnschedulablePods)
+		decision.Reason = fmt.Sprintf("there are %d unschedulable pods", numUnschedulablePods)
+		decision.limit(SuppressorUnschedulablePods, numPods+scale, numPods)
+		return decision
 	}
 
+	// Don't scale up while backing off from unschedulable pods
+	if scale > 0 {
+		if pausedUntil := snapshot.State.ScaleUpPausedUntil; now.Before(pausedUntil) {
+			workloadLogger.Infof("Not scaling up - scale ups are paused until %s after pods were unschedulable.", pausedUntil.String())
+			decision.Reason = fmt.Sprintf("scale ups are paused until %s after pods were unschedulable", pausedUntil.String())
+			decision.limit(SuppressorPendingBackoff, numPods+scale, numPods)
+			return decision
+		}
+		if pausedUntil := snapshot.State.RegistrationPausedUntil; now.Before(pausedUntil) {
+			workloadLogger.Infof("Not scaling up - scale ups are paused until %s after the agent pods didn't register.", pausedUntil.String())
+			decision.Reason = fmt.Sprintf("scale ups are paused until %s after the agent pods didn't register", pausedUntil.String())
+			decision.limit(SuppressorRegistration, numPods+scale, numPods)
+			return decision
+		}
+	}
+
+	// Agents that have been idle for less than the idle delay are kept, so they can be reused by the next job
+	recentlyActiveAgentPodNames := getRecentlyActiveAgentPodNames(decision.AgentIdleTimes, args.ScaleDown.IdleDelay)
+
 	// If there are currently 10 pods and 1 active job, but azp-agent-9 (statefulset pod names are zero-indexed)
 	// is currently active, then don't scale down
-	if scale < 0 && numActiveAgents > 0 && strings.EqualFold(deployment.Kind, "StatefulSet") {
+	if scale < 0 && (numActiveAgents > 0 || len(recentlyActiveAgentPodNames) > 0) && strings.EqualFold(deployment.Kind, "StatefulSet") {
 		maxActivePod := int32(0)
+		maxActivePodIsIdle := false
 		for i := numPods - 1; i > 0 && maxActivePod == 0; i-- {
-			if activeAgentPodNames.Contains(fmt.Sprintf("%s-%d", deployment.Name, i)) {
+			podName := fmt.Sprintf("%s-%d", deployment.Name, i)
+			if forcedPodNames.Contains(podName) {
+				continue
+			}
+			if activeAgentPodNames.Contains(podName) || recentlyActiveAgentPodNames.Contains(podName) {
 				maxActivePod = i
+				maxActivePodIsIdle = !activeAgentPodNames.Contains(podName)
 				break
 			}
 		}
 		if maxActivePod > 0 {
+			if 0-numPods+1+maxActivePod > scale {
+				if maxActivePodIsIdle {
+					decision.limit(SuppressorIdleDelay, numPods+scale, maxActivePod+1)
+				} else {
+					decision.limit(SuppressorBusyAgent, numPods+scale, maxActivePod+1)
+				}
+			}
 			scale = math.MaxInt32(0-numPods+1+maxActivePod, scale)
 			if scale == 0 {
-				logging.Logger.Debugf("Not scaling down - the last agent pod is active")
-				scaleSizeGauge.Set(0)
-				return nil
+				maxActivePodName := fmt.Sprintf("%s-%d", deployment.Name, maxActivePod)
+				if maxActivePodIsIdle {
+					idleTime := decision.AgentIdleTimes[maxActivePodName].Round(time.Second).String()
+					workloadLogger.Debugf("Not scaling down - the last agent pod %s has been idle for %s, less than %s", maxActivePodName, idleTime, args.ScaleDown.IdleDelay.String())
+					decision.Reason = fmt.Sprintf("the last agent pod %s has been idle for %s, less than %s", maxActivePodName, idleTime, args.ScaleDown.IdleDelay.String())
+				} else {
+					workloadLogger.Debugf("Not scaling down - the last agent pod %s is active", maxActivePodName)
+					decision.Reason = fmt.Sprintf("the last agent pod %s is active", maxActivePodName)
+				}
+				return decision
+			}
+		}
+	}
+
+	// The pods a Deployment removes are chosen by its ReplicaSet unless the scale down is targeted, so it keeps as many
+	// pods as its active agents and the agents idle for less than the idle delay
+	if scale < 0 && len(recentlyActiveAgentPodNames) > 0 && !strings.EqualFold(deployment.Kind, "StatefulSet") && !targetsScaleDown(deployment, args) {
+		if minPods := math.MinInt32(numPods, numActiveAgents+int32(len(recentlyActiveAgentPodNames))); numPods+scale < minPods {
+			decision.limit(SuppressorIdleDelay, numPods+scale, minPods)
+			scale = minPods - numPods
+			if scale == 0 {
+				workloadLogger.Debugf("Not scaling down - %d agents have been idle for less than %s", len(recentlyActiveAgentPodNames), args.ScaleDown.IdleDelay.String())
+				decision.Reason = fmt.Sprintf("%d agents have been idle for less than %s", len(recentlyActiveAgentPodNames), args.ScaleDown.IdleDelay.String())
+				return decision
 			}
 		}
 	}
@@ -184,106 +877,259 @@ func Autoscale(azdClient azuredevops.ClientAsync, agentPoolID int, k8sClient kub
 	if scale > 0 {
 		// Scale up
 		podsToScaleTo = math.MaxInt32(numActiveAgents, math.MinInt32(args.Max, numPods+scale), numPods-args.ScaleDown.Max)
+		if numPods+scale > args.Max {
+			decision.limit(SuppressorMax, numPods+scale, podsToScaleTo)
+		}
+		decision.Reason = fmt.Sprintf("%d active agents and %d queued jobs (demand of %d) with a minimum of %d free agents", numActiveAgents, numQueuedJobs, queueDemand, args.Min)
 	} else if scale < 0 {
 		// Scale down, don't kill active agents
-		podsToScaleTo = math.MaxInt32(numActiveAgents, math.MinInt32(args.Max, math.MaxInt32(args.Min, numPods+scale)))
+		// The blue workload of a rollover is scaled down to zero
+		minPods := args.Min
+		if isRolloverFrom {
+			minPods = 0
+		}
+		podsToScaleTo = math.MaxInt32(numActiveAgents-numForcedAgents, math.MinInt32(args.Max, math.MaxInt32(minPods, numPods+scale)))
+		if numPods+scale < minPods {
+			decision.limit(SuppressorMin, numPods+scale, podsToScaleTo)
+		}
+		decision.Reason = fmt.Sprintf("%d active agents and %d queued jobs (demand of %d) with a minimum of %d free agents", numActiveAgents, numQueuedJobs, queueDemand, args.Min)
 	} else if podsToScaleTo > args.Max {
 		// If there happens to be more pods than the max arg
 		if numActiveAgents > args.Max {
 			podsToScaleTo = numActiveAgents
-			logging.Logger.Warningf("There are %d pods over the max of %d - limiting the scale down to %d active agents", numPods, args.Max, numActiveAgents)
+			workloadLogger.Warningf("There are %d pods over the max of %d - limiting the scale down to %d active agents", numPods, args.Max, numActiveAgents)
 		} else {
 			podsToScaleTo = math.MaxInt32(args.Max, numPods-args.ScaleDown.Max)
-			logging.Logger.Warningf("There are %d pods over the max of %d - scaling down to meet the max", numPods, args.Max)
+			workloadLogger.Warningf("There are %d pods over the max of %d - scaling down to meet the max", numPods, args.Max)
+		}
+		decision.Reason = fmt.Sprintf("there are %d pods over the max of %d", numPods, args.Max)
+		decision.Cause = CauseOverMax
+		if numActiveAgents > args.Max {
+			decision.limit(SuppressorBusyAgent, args.Max, podsToScaleTo)
 		}
 	} else {
-		logging.Logger.Tracef("Not scaling %s from %d pods", deployment.FriendlyName, numPods)
-		scaleSizeGauge.Set(0)
-		return nil
+		workloadLogger.Tracef("Not scaling %s from %d pods", deployment.FriendlyName, numPods)
+		decision.Reason = "the number of free agents matches the minimum"
+		return decision
+	}
+
+	// Keep an adopted manual scale
+	podsToScaleTo = limitToManualScale(decision, snapshot, podsToScaleTo)
+
+	// Apply cluster capacity limits
+	if podsToScaleTo > numPods && args.Capacity.Enabled && snapshot.Capacity != nil {
+		capacity := *snapshot.Capacity
+		maxPodsToScaleTo := numPods + capacity
+		if args.Capacity.Overshoot {
+			// Allow one unschedulable pod to trigger the cluster autoscaler
+			maxPodsToScaleTo = maxPodsToScaleTo + 1
+		}
+		if podsToScaleTo > maxPodsToScaleTo {
+			workloadLogger.Infof("Limiting the scale up of %s from %d to %d pods - the cluster has capacity for %d more agent pods", deployment.FriendlyName, podsToScaleTo, maxPodsToScaleTo, capacity)
+			decision.limit(SuppressorCapacity, podsToScaleTo, maxPodsToScaleTo)
+			podsToScaleTo = maxPodsToScaleTo
+		}
+	}
+
+	// Apply the ResourceQuota limits of the namespace
+	if podsToScaleTo > numPods && snapshot.Quota != nil {
+		if maxPodsToScaleTo := numPods + snapshot.Quota.Pods; podsToScaleTo > maxPodsToScaleTo {
+			workloadLogger.Infof("Limiting the scale up of %s from %d to %d pods - %s", deployment.FriendlyName, podsToScaleTo, maxPodsToScaleTo, snapshot.Quota.String())
+			decision.limit(SuppressorQuota, podsToScaleTo, maxPodsToScaleTo)
+			podsToScaleTo = maxPodsToScaleTo
+			decision.Quota = snapshot.Quota
+		}
+	}
+
+	// Limit the scale up while a cluster health gate fails, to not add load to an ongoing cluster incident
+	if podsToScaleTo > numPods && len(snapshot.UnhealthyGates) > 0 {
+		if maxPodsToScaleTo := numPods + args.HealthGates.MaxScaleUp; podsToScaleTo > maxPodsToScaleTo {
+			failures := strings.Join(snapshot.UnhealthyGates, ", ")
+			workloadLogger.Warnf("Limiting the scale up of %s from %d to %d pods - %s", deployment.FriendlyName, podsToScaleTo, maxPodsToScaleTo, failures)
+			decision.limit(SuppressorHealthGate, podsToScaleTo, maxPodsToScaleTo)
+			podsToScaleTo = maxPodsToScaleTo
+			decision.UnhealthyGates = snapshot.UnhealthyGates
+			if podsToScaleTo == numPods {
+				decision.Reason = fmt.Sprintf("scale ups are paused while the health gates fail: %s", failures)
+			}
+		}
 	}
 
 	// Apply scale-down limits
 	if podsToScaleTo < numPods {
-		now := time.Now()
-		nextAllowedScaleDown := lastScaleDown.Add(args.ScaleDown.Delay)
+		nextAllowedScaleDown := snapshot.State.LastScaleDown.Add(args.ScaleDown.Delay)
 		if now.Before(nextAllowedScaleDown) {
-			logging.Logger.Debugf("Not scaling down %s from %d to %d pods - cannot scale down until %s", deployment.FriendlyName, numPods, podsToScaleTo, nextAllowedScaleDown.String())
-			scaleDownLimitedCounter.Inc()
-			scaleSizeGauge.Set(0)
-			return nil
+			workloadLogger.Debugf("Not scaling down %s from %d to %d pods - cannot scale down until %s", deployment.FriendlyName, numPods, podsToScaleTo, nextAllowedScaleDown.String())
+			decision.Reason = fmt.Sprintf("cannot scale down until %s", nextAllowedScaleDown.String())
+			decision.ScaleDownLimited = true
+			decision.limit(SuppressorCooldown, podsToScaleTo, numPods)
+			return decision
 		}
 
 		podsToScaleToMin := numPods - args.ScaleDown.Max
 		if podsToScaleTo < podsToScaleToMin {
-			logging.Logger.Debugf("Capping the scale down from %d to %d pods", podsToScaleTo, podsToScaleToMin)
+			workloadLogger.Debugf("Capping the scale down from %d to %d pods", podsToScaleTo, podsToScaleToMin)
+			decision.limit(SuppressorScaleDownMax, podsToScaleTo, podsToScaleToMin)
 			podsToScaleTo = podsToScaleToMin
 		}
 	}
 
-	if numPods != podsToScaleTo {
-		// Apply metrics
-		if podsToScaleTo < numPods {
-			scaleDownCounter.Inc()
-		} else {
-			scaleUpCounter.Inc()
+	// Don't scale during maintenance windows, but still report the decision
+	if podsToScaleTo != numPods {
+		if window := args.Maintenance.ActiveWindow(now); window != nil {
+			until := args.Maintenance.ActiveUntil(now)
+			workloadLogger.Infof("Not scaling %s from %d to %d pods - in the maintenance window %s until %s", deployment.FriendlyName, numPods, podsToScaleTo, window.String(), until.Format(time.RFC3339))
+			decision.Reason = fmt.Sprintf("in the maintenance window %s until %s", window.String(), until.Format(time.RFC3339))
+			decision.limit(SuppressorMaintenanceWindow, podsToScaleTo, numPods)
+			return decision
 		}
-		scaleSizeGauge.Set(float64(podsToScaleTo - numPods))
+	}
 
-		logging.Logger.Infof("Scaling %s from %d to %d pods", deployment.FriendlyName, numPods, podsToScaleTo)
-		err := k8sClient.Sync().Scale(deployment, podsToScaleTo)
-		if err == nil && scale < 0 {
-			lastScaleDown = time.Now()
+	// Limit the number of scale operations within the rate limit window
+	if podsToScaleTo != numPods && args.RateLimit.MaxScales > 0 {
+		recentScales := snapshot.State.getScalesSince(now.Add(-args.RateLimit.Window))
+		if int32(len(recentScales)) >= args.RateLimit.MaxScales {
+			nextAllowedScale := recentScales[0].Add(args.RateLimit.Window)
+			workloadLogger.Warnf("Not scaling %s from %d to %d pods - it was scaled %d times in the last %s, cannot scale until %s", deployment.FriendlyName, numPods, podsToScaleTo, len(recentScales), args.RateLimit.Window.String(), nextAllowedScale.String())
+			decision.Reason = fmt.Sprintf("scaled %d times in the last %s, cannot scale until %s", len(recentScales), args.RateLimit.Window.String(), nextAllowedScale.String())
+			decision.limit(SuppressorRateLimit, podsToScaleTo, numPods)
+			return decision
 		}
-		return err
 	}
 
-	scaleSizeGauge.Set(0)
+	// A targeted scale down only deletes the pods of idle agents, so it's limited to the pods it can delete
+	if podsToScaleTo < numPods && targetsScaleDown(deployment, args) {
+		excludedPodNames := make(collections.StringSet)
+		for podName := range activeAgentPodNames {
+			excludedPodNames.Add(podName)
+		}
+		for podName := range recentlyActiveAgentPodNames {
+			excludedPodNames.Add(podName)
+		}
+		decision.PodsToRemove = getPodsToRemove(snapshot.Pods, snapshot.Agents, stalePodNames, decision.AgentIdleTimes, excludedPodNames, forcedPodNames, numPods-podsToScaleTo)
+		if numRemovable := int32(len(decision.PodsToRemove)); numPods-podsToScaleTo > numRemovable {
+			workloadLogger.Debugf("Limiting the scale down of %s from %d to %d pods - only %d agent pods can be removed", deployment.FriendlyName, podsToScaleTo, numPods-numRemovable, numRemovable)
+			if len(recentlyActiveAgentPodNames) > 0 {
+				decision.limit(SuppressorIdleDelay, podsToScaleTo, numPods-numRemovable)
+			} else {
+				decision.limit(SuppressorBusyAgent, podsToScaleTo, numPods-numRemovable)
+			}
+			podsToScaleTo = numPods - numRemovable
+			if numRemovable == 0 {
+				workloadLogger.Debugf("Not scaling down %s - none of its agent pods can be removed", deployment.FriendlyName)
+				decision.Reason = "none of the agent pods are idle long enough to be removed"
+				return decision
+			}
+		}
+	}
 
-	logging.Logger.Debugf("Not scaling from %d pods", numPods)
-	return nil
+	decision.DesiredReplicas = podsToScaleTo
+	if numPods == podsToScaleTo {
+		workloadLogger.Debugf("Not scaling from %d pods", numPods)
+	}
+
+	return decision
+}
+
+// getRemovedPodNames returns the pods that a scale down removes: the pods chosen by a targeted scale down, or the pods
+// with the highest ordinals of a StatefulSet. The other workloads remove arbitrary pods, so they aren't known.
+func getRemovedPodNames(decision *Decision, deployment *kubernetes.Workload) []string {
+	if decision.DesiredReplicas >= decision.NumPods {
+		return nil
+	} else if len(decision.PodsToRemove) > 0 {
+		return decision.PodsToRemove
+	} else if !strings.EqualFold(deployment.Kind, "StatefulSet") {
+		return nil
+	}
+	var podNames []string
+	for i := decision.NumPods - 1; i >= decision.DesiredReplicas; i-- {
+		podNames = append(podNames, fmt.Sprintf("%s-%d", deployment.Name, i))
+	}
+	return podNames
 }
 
-func getActiveAgentNames(agents []azuredevops.AgentDetails, podNames collections.StringSet) collections.StringSet {
+// logDryRunRemovals logs the pods and agents that a scale down would remove
+func logDryRunRemovals(workloadLogger *log.Entry, agents []ci.Agent, podNames []string) {
+	agentsByPodName := make(map[string]ci.Agent)
+	for _, agent := range agents {
+		agentsByPodName[agent.PodName] = agent
+	}
+	for _, podName := range podNames {
+		if agent, exists := agentsByPodName[podName]; exists {
+			workloadLogger.Infof("Dry run - would remove pod %s and agent %s (status %s)", podName, agent.Name, agent.Status)
+		} else {
+			workloadLogger.Infof("Dry run - would remove pod %s, which has no registered agent", podName)
+		}
+	}
+}
+
+func getActiveAgentNames(agents []ci.Agent, podNames collections.StringSet) collections.StringSet {
 	activeAgentNames := make(collections.StringSet)
 	for _, agent := range agents {
-		if strings.EqualFold(agent.Status, "online") {
-			podName := agent.SystemCapabilities["HOSTNAME"]
-			if podNames.Contains(podName) && agent.AssignedRequest != nil {
-				activeAgentNames.Add(agent.Name)
-			}
+		if agent.Online && agent.Busy && podNames.Contains(agent.PodName) {
+			activeAgentNames.Add(agent.Name)
 		}
 	}
 	return activeAgentNames
 }
 
-func getActiveAgentPodNames(agents []azuredevops.AgentDetails, podNames collections.StringSet) collections.StringSet {
+func getNumIdleAgents(agents []ci.Agent, podNames collections.StringSet, activeAgentPodNames collections.StringSet) int32 {
+	numIdleAgents := int32(0)
+	for _, agent := range agents {
+		if agent.Online && !agent.Busy && podNames.Contains(agent.PodName) && !activeAgentPodNames.Contains(agent.PodName) {
+			numIdleAgents = numIdleAgents + 1
+		}
+	}
+	return numIdleAgents
+}
+
+// getActiveAgentPodNames returns the pods of the busy agents and of the agents a running job is assigned to
+func getActiveAgentPodNames(agents []ci.Agent, jobs []ci.Job, podNames collections.StringSet) collections.StringSet {
+	runningJobAgentNames := make(collections.StringSet)
+	for _, job := range ci.RunningJobs(jobs) {
+		runningJobAgentNames.Add(job.AgentName)
+	}
 	activeAgentPodNames := make(collections.StringSet)
 	for _, agent := range agents {
-		if strings.EqualFold(agent.Status, "online") {
-			podName := agent.SystemCapabilities["HOSTNAME"]
-			if podNames.Contains(podName) && agent.AssignedRequest != nil {
-				activeAgentPodNames.Add(podName)
-			}
+		if !podNames.Contains(agent.PodName) {
+			continue
+		}
+		if (agent.Online && agent.Busy) || runningJobAgentNames.Contains(agent.Name) {
+			activeAgentPodNames.Add(agent.PodName)
 		}
 	}
 	return activeAgentPodNames
 }
 
-func getNumQueuedJobs(jobs []azuredevops.JobRequest, activeAgentNames collections.StringSet) int32 {
-	numQueuedJobs := int32(0)
+func getQueuedJobs(jobs []ci.Job, activeAgentNames collections.StringSet, routing jobRouting) []ci.Job {
+	return routeJobs(ci.QueuedJobs(jobs), activeAgentNames, routing)
+}
+
+// routeJobs returns the jobs that the agents of the workload can run
+func routeJobs(jobs []ci.Job, activeAgentNames collections.StringSet, routing jobRouting) []ci.Job {
+	var queuedJobs []ci.Job
 	for _, job := range jobs {
-		if job.IsQueuedOrRunning() && job.ReservedAgent == nil {
-			if job.MatchesAllAgentsInPool {
-				numQueuedJobs = numQueuedJobs + 1
-			} else if len(job.MatchedAgents) > 0 {
-				for _, agent := range job.MatchedAgents {
-					if activeAgentNames.Contains(agent.Name) {
-						numQueuedJobs = numQueuedJobs + 1
-						break
-					}
+		if routed, toWorkload := routing.route(job); routed {
+			// The jobs routed to another workload are queued for it
+			if !toWorkload {
+				continue
+			}
+			// The jobs routed to the workload are counted even if no agent matches them, ex: when its agents are scaled to zero
+			if len(job.MatchedAgents) == 0 {
+				queuedJobs = append(queuedJobs, job)
+				continue
+			}
+		}
+		if job.MatchesAllAgents {
+			queuedJobs = append(queuedJobs, job)
+		} else {
+			for _, agentName := range job.MatchedAgents {
+				if activeAgentNames.Contains(agentName) {
+					queuedJobs = append(queuedJobs, job)
+					break
 				}
 			}
 		}
 	}
-	return numQueuedJobs
+	return queuedJobs
 }
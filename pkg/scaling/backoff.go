@@ -0,0 +1,68 @@
+package scaling
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+)
+
+var (
+	scaleUpPausedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_scale_up_paused",
+		Help: "Set to 1 while scale ups are paused after agent pods were unschedulable",
+	}, metricLabelNames)
+	scaleUpBackoffCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_scale_up_backoff_count",
+		Help: "The total number of times scale ups were paused after agent pods were unschedulable",
+	}, metricLabelNames)
+)
+
+// applyPendingBackoff pauses scale ups when a scale up was blocked by unschedulable pods.
+// Each consecutive pause doubles in length, up to the maximum. The pause length resets once
+// the pods have been schedulable for as long as the last pause.
+func applyPendingBackoff(decision *Decision, agentPoolID int, labels prometheus.Labels, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if args.PendingBackoff.Delay <= 0 {
+		return
+	}
+
+	state := getState(deployment)
+	now := time.Now()
+	paused := now.Before(state.ScaleUpPausedUntil)
+
+	if !decision.HasSuppressor(SuppressorUnschedulablePods) {
+		if !paused {
+			scaleUpPausedGauge.With(labels).Set(0)
+			if state.PendingBackoff > 0 && now.After(state.ScaleUpPausedUntil.Add(state.PendingBackoff)) {
+				workloadLogger(agentPoolID, deployment).Debugf("Resetting the scale up backoff of %s", deployment.FriendlyName)
+				state.PendingBackoff = 0
+				saveState(k8sClient, deployment, args)
+			}
+		}
+		return
+	}
+	if paused {
+		return
+	}
+
+	backoff := args.PendingBackoff.Delay
+	if state.PendingBackoff > 0 {
+		backoff = math.MinDuration(2*state.PendingBackoff, args.PendingBackoff.Max)
+	}
+	state.PendingBackoff = backoff
+	state.ScaleUpPausedUntil = now.Add(backoff)
+
+	scaleUpPausedGauge.With(labels).Set(1)
+	scaleUpBackoffCounter.With(labels).Inc()
+
+	message := fmt.Sprintf("%d agent pods are unschedulable, pausing scale ups for %s", decision.NumUnschedulablePods, backoff.String())
+	workloadLogger(agentPoolID, deployment).Warnf("%s: %s", deployment.FriendlyName, message)
+	createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, "ScaleUpPaused", message)
+	saveState(k8sClient, deployment, args)
+}
@@ -0,0 +1,118 @@
+package scaling
+
+import (
+	"encoding/json"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// BalloonLabel is the label of the balloon pods, with the name of the workload they keep a node warm for
+const BalloonLabel = "azp-agent-autoscaler/balloon"
+
+// lastBalloons are the last saved balloon Deployments of each workload, so they're only saved when they change.
+// It is guarded by statesMutex.
+var lastBalloons = make(map[string]string)
+
+// BalloonName returns the name of the balloon Deployment of a workload
+func BalloonName(deployment *kubernetes.Workload) string {
+	return deployment.Name + "-balloon"
+}
+
+// reconcileBalloon saves the balloon Deployment of the workload: low-priority pause pods with the requests, node selector,
+// affinity and tolerations of an agent pod. When agents are scaled up, they preempt the balloon pods and start on
+// their nodes immediately, and the pending balloon pods trigger the cluster autoscaler to add a node for them.
+// Errors are only logged, as the balloon pods are not required to scale.
+func reconcileBalloon(agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	key := deployment.Namespace + "/" + deployment.FriendlyName
+	_, saved := lastBalloons[key]
+	if (args.Balloon.Replicas == 0 && !saved) || deployment.PodTemplateSpec == nil || !strings.EqualFold(deployment.Kind, "StatefulSet") {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	balloon := getBalloonDeployment(deployment, args.Balloon)
+	data, err := json.Marshal(balloon)
+	if err != nil {
+		workloadLogger.Errorf("Error serializing the balloon Deployment %s: %s", balloon.Name, err.Error())
+		return
+	} else if lastBalloons[key] == string(data) {
+		return
+	}
+
+	if args.DryRun {
+		workloadLogger.Infof("Dry run - would save the balloon Deployment %s with %d replicas", balloon.Name, args.Balloon.Replicas)
+	} else if err := k8sClient.Sync().SaveDeployment(balloon); err != nil {
+		workloadLogger.Warnf("Error saving the balloon Deployment %s: %s", balloon.Name, err.Error())
+		return
+	} else {
+		workloadLogger.Infof("Saved the balloon Deployment %s with %d replicas", balloon.Name, args.Balloon.Replicas)
+	}
+	lastBalloons[key] = string(data)
+}
+
+// getBalloonDeployment returns the balloon Deployment of a workload, which is owned by the workload so it's deleted with it
+func getBalloonDeployment(deployment *kubernetes.Workload, balloonArgs args.BalloonArgs) *appsv1.Deployment {
+	name := BalloonName(deployment)
+	labels := map[string]string{BalloonLabel: deployment.Name}
+	podSpec := deployment.PodTemplateSpec.Spec
+
+	requests := corev1.ResourceList{}
+	for resourceName, quantity := range kubernetes.GetPodRequests(podSpec) {
+		if !quantity.IsZero() {
+			requests[resourceName] = quantity
+		}
+	}
+	replicas := balloonArgs.Replicas
+	terminationGracePeriodSeconds := int64(0)
+
+	balloon := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: deployment.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					PriorityClassName:             balloonArgs.PriorityClass,
+					TerminationGracePeriodSeconds: &terminationGracePeriodSeconds,
+					AutomountServiceAccountToken:  new(bool),
+					NodeSelector:                  podSpec.NodeSelector,
+					Affinity:                      podSpec.Affinity,
+					Tolerations:                   podSpec.Tolerations,
+					Containers: []corev1.Container{{
+						Name:      "pause",
+						Image:     balloonArgs.Image,
+						Resources: corev1.ResourceRequirements{Requests: requests},
+					}},
+				},
+			},
+		},
+	}
+	if deployment.UID != "" {
+		controller := false
+		balloon.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: deployment.APIVersion,
+			Kind:       deployment.Kind,
+			Name:       deployment.Name,
+			UID:        deployment.UID,
+			Controller: &controller,
+		}}
+	}
+	return balloon
+}
+
+// isBalloonPod returns true if a pod is a balloon pod, which agents can preempt
+func isBalloonPod(pod corev1.Pod) bool {
+	_, exists := pod.Labels[BalloonLabel]
+	return exists
+}
@@ -0,0 +1,76 @@
+package scaling
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// CapabilityPrefix is the prefix of the pod labels and annotations that declare a user capability of the pod's agent,
+// ex: capability.azp-agent-autoscaler/java=17
+const CapabilityPrefix = "capability.azp-agent-autoscaler/"
+
+// syncCapabilities sets the user capabilities of the agents to the capabilities declared by their pods, keeping the user
+// capabilities that aren't declared. Agents are only updated when a declared capability differs, and errors are only
+// logged, as the capabilities are not required to scale.
+func syncCapabilities(observed observation, agentPoolID int, backend ci.Backend, deployment *kubernetes.Workload, args args.Args) {
+	if !args.SyncCapabilities {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	agents := make(map[string]ci.Agent)
+	for _, agent := range observed.Agents {
+		if agent.PodName != "" {
+			agents[agent.PodName] = agent
+		}
+	}
+
+	for _, pod := range observed.Pods {
+		agent, exists := agents[pod.Name]
+		declared := podCapabilities(pod)
+		if !exists || len(declared) == 0 {
+			continue
+		}
+		capabilities := make(map[string]string)
+		for name, value := range agent.Capabilities {
+			capabilities[name] = value
+		}
+		changed := false
+		for name, value := range declared {
+			if current, exists := capabilities[name]; !exists || current != value {
+				capabilities[name] = value
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would set the user capabilities of agent %s to the capabilities of pod %s", agent.Name, pod.Name)
+		} else if err := backend.SetCapabilities(agentPoolID, agent, capabilities); err != nil {
+			workloadLogger.Warnf("Error setting the user capabilities of agent %s: %s", agent.Name, err.Error())
+		} else {
+			workloadLogger.Infof("Set the user capabilities of agent %s to the capabilities of pod %s", agent.Name, pod.Name)
+		}
+	}
+}
+
+// podCapabilities returns the capabilities declared by the labels and annotations of a pod.
+// An annotation overrides a label with the same name, as annotation values aren't limited to label values.
+func podCapabilities(pod corev1.Pod) map[string]string {
+	capabilities := make(map[string]string)
+	for _, metadata := range []map[string]string{pod.Labels, pod.Annotations} {
+		for key, value := range metadata {
+			if name := strings.TrimPrefix(key, CapabilityPrefix); name != key && name != "" {
+				capabilities[name] = value
+			}
+		}
+	}
+	return capabilities
+}
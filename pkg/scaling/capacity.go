@@ -0,0 +1,44 @@
+package scaling
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// getCapacity estimates how many more agent pods the cluster's nodes can schedule. If the agents' PriorityClass
+// preempts, the requests of the pods with a lower priority are available to them.
+func getCapacity(agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, capacityArgs args.CapacityArgs) (int32, error) {
+	nodes, err := k8sClient.Sync().GetNodes()
+	if err != nil {
+		return 0, fmt.Errorf("Error listing nodes for the capacity check: %w", err)
+	}
+	allPods, err := k8sClient.Sync().GetAllPods()
+	if err != nil {
+		return 0, fmt.Errorf("Error listing pods for the capacity check: %w", err)
+	}
+	// Agents preempt the balloon pods, so their requests are available to them
+	pods := make([]corev1.Pod, 0, len(allPods))
+	for _, pod := range allPods {
+		if !isBalloonPod(pod) {
+			pods = append(pods, pod)
+		}
+	}
+
+	priorityClassName := deployment.PodTemplateSpec.Spec.PriorityClassName
+	if capacityArgs.PriorityClassPolicy(priorityClassName) == args.CapacityPreempt {
+		priority, err := k8sClient.Sync().GetPriorityClassValue(priorityClassName)
+		if err != nil {
+			return 0, fmt.Errorf("Error retrieving PriorityClass %s for the capacity check: %w", priorityClassName, err)
+		}
+		pods = kubernetes.ExcludePreemptedPods(pods, priority)
+		workloadLogger(agentPoolID, deployment).Debugf("The %s pods have PriorityClass %s with priority %d, so the pods with a lower priority are counted as capacity", deployment.FriendlyName, priorityClassName, priority)
+	}
+
+	capacity := kubernetes.EstimateSchedulablePods(nodes, pods, deployment.PodTemplateSpec.Spec)
+	workloadLogger(agentPoolID, deployment).Debugf("The cluster has capacity for %d more %s pods", capacity, deployment.FriendlyName)
+	return capacity, nil
+}
@@ -0,0 +1,222 @@
+package scaling
+
+import (
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// Action is the scaling action taken from a Decision
+type Action string
+
+const (
+	// ActionNone is when the agents are not scaled
+	ActionNone Action = "none"
+	// ActionScaleUp is when the agents are scaled up
+	ActionScaleUp Action = "scale_up"
+	// ActionScaleDown is when the agents are scaled down
+	ActionScaleDown Action = "scale_down"
+)
+
+// Suppressor is a limit that prevented or reduced a scaling operation
+type Suppressor string
+
+const (
+	// SuppressorPendingPods is when there are pending or failed pods
+	SuppressorPendingPods Suppressor = "pending_pods"
+	// SuppressorUnschedulablePods is when there are unschedulable pods
+	SuppressorUnschedulablePods Suppressor = "unschedulable_pods"
+	// SuppressorPendingBackoff is when scale ups are paused after pods were unschedulable
+	SuppressorPendingBackoff Suppressor = "pending_backoff"
+	// SuppressorRegistration is when scale ups are paused after the agent pods of a scale up didn't register
+	SuppressorRegistration Suppressor = "registration"
+	// SuppressorBusyAgent is when a scale down would remove a busy agent
+	SuppressorBusyAgent Suppressor = "busy_agent"
+	// SuppressorIdleDelay is when a scale down would remove an agent that finished a job within the idle delay
+	SuppressorIdleDelay Suppressor = "idle_delay"
+	// SuppressorMin is when the minimum limited a scale down
+	SuppressorMin Suppressor = "min"
+	// SuppressorMax is when the maximum limited a scale up
+	SuppressorMax Suppressor = "max"
+	// SuppressorScaleUpStep is when the scale up step for the queue depth limited a scale up
+	SuppressorScaleUpStep Suppressor = "scale_up_step"
+	// SuppressorCapacity is when the cluster capacity limited a scale up
+	SuppressorCapacity Suppressor = "capacity"
+	// SuppressorQuota is when a ResourceQuota of the agents' namespace limited a scale up
+	SuppressorQuota Suppressor = "quota"
+	// SuppressorHealthGate is when a failing cluster health gate limited a scale up
+	SuppressorHealthGate Suppressor = "health_gate"
+	// SuppressorPriority is when a higher priority workload was limited by the cluster capacity
+	SuppressorPriority Suppressor = "priority"
+	// SuppressorCooldown is when the scale down delay prevented a scale down
+	SuppressorCooldown Suppressor = "cooldown"
+	// SuppressorScaleDownMax is when the scale down max limited a scale down
+	SuppressorScaleDownMax Suppressor = "scale_down_max"
+	// SuppressorRateLimit is when the maximum number of scale operations within the rate limit window prevented scaling
+	SuppressorRateLimit Suppressor = "rate_limit"
+	// SuppressorMaintenanceWindow is when scaling was prevented by a maintenance window
+	SuppressorMaintenanceWindow Suppressor = "maintenance_window"
+	// SuppressorPaused is when autoscaling was paused through the admin API
+	SuppressorPaused Suppressor = "paused"
+	// SuppressorRollingUpdate is when scaling was held during a rolling update of the pods
+	SuppressorRollingUpdate Suppressor = "rolling_update"
+	// SuppressorManualScale is when an adopted manual scale limited scaling
+	SuppressorManualScale Suppressor = "manual_scale"
+	// SuppressorDecisionHook is when the decision hook vetoed or adjusted scaling
+	SuppressorDecisionHook Suppressor = "decision_hook"
+	// SuppressorDraining is when a scale down waited for the drained agents of the pods it removes to be idle
+	SuppressorDraining Suppressor = "draining"
+)
+
+// Cause is why the replicas of a decision were chosen, when it isn't the demand of the agents and jobs
+type Cause string
+
+const (
+	// CauseQueue is when the agents are scaled up for the active agents, the queued jobs and the minimum free agents
+	CauseQueue Cause = "queue"
+	// CauseIdle is when the idle agents over the minimum free agents are scaled down
+	CauseIdle Cause = "idle"
+	// CauseSteady is when the free agents match the minimum
+	CauseSteady Cause = "steady"
+	// CauseForced is when the workload was force scaled through the admin API
+	CauseForced Cause = "forced"
+	// CauseRevertManualScale is when a workload scaled outside of the autoscaler is scaled back
+	CauseRevertManualScale Cause = "revert_manual_scale"
+	// CauseOverMax is when there are more pods than the maximum
+	CauseOverMax Cause = "over_max"
+)
+
+// Decision is the result of evaluating the scaling policy against the current state of the agents
+type Decision struct {
+	// Time is the time of the snapshot the decision was made from
+	Time time.Time
+
+	// Agents are all of the agents registered in the agent pool
+	Agents []ci.Agent
+
+	NumPods              int32
+	NumRunningPods       int32
+	NumPendingPods       int32
+	NumUnschedulablePods int32
+	NumFailedPods        int32
+	NumStalePods         int32
+	// NumMissingPods are the ordinals of a StatefulSet below its replicas without a pod that isn't terminating
+	NumMissingPods  int32
+	NumActiveAgents int32
+	NumIdleAgents   int32
+	NumQueuedJobs   int32
+	// NumWaitingJobs are the jobs waiting for an approval, a check or a delay that are counted as queued jobs
+	NumWaitingJobs int32
+	// AgentIdleTimes are how long the idle agents have been idle by pod name, since their last job finished or their pod started
+	AgentIdleTimes map[string]time.Duration
+
+	// QueueDemand is the number of agents needed for the queued jobs, after weighting by queue time, and the counted waiting jobs
+	QueueDemand int32
+	// NumAvailablePods are the pods that can run an agent, which the demand is compared to
+	NumAvailablePods int32
+	// MinFreeAgents is the minimum of free agents kept by the workload, which is 0 for a constrained or spot workload
+	MinFreeAgents int32
+	// DemandedReplicas are the replicas the active agents, the demand and the minimum free agents need, before the limits
+	DemandedReplicas int32
+
+	// SLO is set when the SLO policy determined the demand
+	SLO *SLOEstimate
+
+	// RollingUpdate is the update of the pod template of the workload, if it's being updated and it was retrieved
+	RollingUpdate *kubernetes.RollingUpdate
+	// Rollout describes how the update is rolled out to the pods, if there's one
+	Rollout string
+
+	// Quota is the ResourceQuota that limited a scale up, if any
+	Quota *kubernetes.QuotaLimit
+	// UnhealthyGates are why the failing health gates that limited a scale up failed, if any
+	UnhealthyGates []string
+
+	// DesiredReplicas is the number of pods the agent workload should be scaled to
+	DesiredReplicas int32
+	// PodsToRemove are the idle agent pods a targeted scale down deletes before lowering the replicas
+	PodsToRemove []string
+
+	// Reason describes why the desired replicas were chosen
+	Reason string
+	// Cause is why the desired replicas were chosen, if it isn't the demand of the agents and jobs
+	Cause Cause
+
+	// Suppressors are the limits that prevented or reduced scaling
+	Suppressors []Suppressor
+	// Limits are how each suppressor changed the replicas to scale to, in the order they were applied
+	Limits []Limit
+
+	// ScaleDownLimited is set when a scale down was prevented by the scale down delay
+	ScaleDownLimited bool
+}
+
+// Limit is a suppressor applied to the replicas to scale to, and the replicas before and after it
+type Limit struct {
+	Suppressor Suppressor `json:"suppressor"`
+	From       int32      `json:"from"`
+	To         int32      `json:"to"`
+}
+
+// limit records a suppressor that limited the replicas to scale to, or held them if to is the current number of pods
+func (d *Decision) limit(suppressor Suppressor, from int32, to int32) {
+	d.Suppressors = append(d.Suppressors, suppressor)
+	d.Limits = append(d.Limits, Limit{Suppressor: suppressor, From: from, To: to})
+}
+
+// HasSuppressor returns true if the given suppressor limited the decision
+func (d Decision) HasSuppressor(suppressor Suppressor) bool {
+	for _, s := range d.Suppressors {
+		if s == suppressor {
+			return true
+		}
+	}
+	return false
+}
+
+// SuppressorNames returns the names of the suppressors
+func (d Decision) SuppressorNames() []string {
+	names := make([]string, len(d.Suppressors))
+	for i, suppressor := range d.Suppressors {
+		names[i] = string(suppressor)
+	}
+	return names
+}
+
+// ReasonLabel returns why the desired replicas were chosen from a bounded set of values, unlike the Reason, so it can
+// label a metric: the last suppressor, which prevented or limited the scaling, otherwise the cause
+func (d Decision) ReasonLabel() string {
+	if len(d.Suppressors) > 0 {
+		suppressor := d.Suppressors[len(d.Suppressors)-1]
+		if suppressor == SuppressorDraining {
+			// The scale down is blocked by the agents it drains, not draining them
+			return "drain_blocked"
+		}
+		return string(suppressor)
+	} else if d.Cause != "" {
+		return string(d.Cause)
+	}
+	switch d.Action() {
+	case ActionScaleUp:
+		return string(CauseQueue)
+	case ActionScaleDown:
+		return string(CauseIdle)
+	}
+	return string(CauseSteady)
+}
+
+// IsScaling returns true if the desired replicas differ from the current number of pods
+func (d Decision) IsScaling() bool {
+	return d.DesiredReplicas != d.NumPods
+}
+
+// Action returns the scaling action of the decision
+func (d Decision) Action() Action {
+	if d.DesiredReplicas > d.NumPods {
+		return ActionScaleUp
+	} else if d.DesiredReplicas < d.NumPods {
+		return ActionScaleDown
+	}
+	return ActionNone
+}
@@ -0,0 +1,49 @@
+package scaling
+
+import (
+	gomath "math"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+)
+
+// getQueueDemand returns the number of agents needed for the queued jobs. If weighting by queue time is enabled,
+// each job counts as 1 agent plus 1 more per period it has been waiting (prorated), up to the max weight.
+// The total is rounded up, so a few jobs that have waited a long time add agents on their own.
+func getQueueDemand(queuedJobs []ci.Job, queueAgeArgs args.QueueAgeArgs, now time.Time) int32 {
+	if queueAgeArgs.WeightPeriod <= 0 {
+		return int32(len(queuedJobs))
+	}
+
+	demand := float64(0)
+	for _, job := range queuedJobs {
+		demand = demand + getQueueAgeWeight(job, queueAgeArgs, now)
+	}
+	return int32(gomath.Ceil(demand))
+}
+
+func getQueueAgeWeight(job ci.Job, queueAgeArgs args.QueueAgeArgs, now time.Time) float64 {
+	if job.QueueTime.IsZero() || job.QueueTime.After(now) {
+		return 1
+	}
+	weight := 1 + float64(now.Sub(job.QueueTime))/float64(queueAgeArgs.WeightPeriod)
+	return gomath.Min(weight, queueAgeArgs.MaxWeight)
+}
+
+// getWaitingJobs returns the waiting jobs of the workload that are counted as queued jobs: the gated jobs if they're
+// counted, and the delayed jobs if they're counted and released within the lookahead or their release time isn't known
+func getWaitingJobs(jobs []ci.Job, activeAgentNames collections.StringSet, routing jobRouting, waitingArgs args.WaitingJobsArgs, now time.Time) []ci.Job {
+	var countedJobs []ci.Job
+	for _, job := range ci.WaitingJobs(jobs) {
+		if job.Gated {
+			if waitingArgs.Gated {
+				countedJobs = append(countedJobs, job)
+			}
+		} else if waitingArgs.Delayed && (job.ReleaseTime.IsZero() || !job.ReleaseTime.After(now.Add(waitingArgs.Lookahead))) {
+			countedJobs = append(countedJobs, job)
+		}
+	}
+	return routeJobs(countedJobs, activeAgentNames, routing)
+}
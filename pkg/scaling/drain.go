@@ -0,0 +1,317 @@
+package scaling
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/notify"
+)
+
+// DrainAnnotation is set to true on the agent pods that a scale down removes, so the preStop hook of the agent
+// container can deregister the agent, ex: by reading it from a downward API volume
+const DrainAnnotation = "azp-agent-autoscaler/drain"
+
+const eventReasonDrainTimedOut = "DrainTimedOut"
+
+var drainTimeoutsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "azp_agent_autoscaler_drain_timeouts_count",
+	Help: "The total number of scale downs whose drained agents were still busy after the drain timeout, by the policy applied",
+}, append(metricLabelNames, "policy"))
+
+// Drain is a scale down whose agents are drained, so they aren't assigned new jobs, before their pods are removed
+type Drain struct {
+	// Since is when the agents were drained, or when the drain was last retried
+	Since time.Time `json:"since"`
+	// Replicas are the replicas the scale down scales the workload to
+	Replicas int32 `json:"replicas"`
+	// PodNames are the pods the scale down removes
+	PodNames []string `json:"podNames"`
+	// Targeted is set if the pods are deleted by a targeted scale down, instead of being the highest ordinals of a StatefulSet
+	Targeted bool `json:"targeted,omitempty"`
+	// AgentIDs are the IDs of the agents that were drained by pod name, which are undrained if the scale down is canceled
+	AgentIDs map[string]int `json:"agentIds,omitempty"`
+	// Retries are how many times the drain was retried after the drain timeout
+	Retries int32 `json:"retries,omitempty"`
+}
+
+// annotateDrain sets the drain annotation on the pods that a scale down removes, before the workload is scaled. These are
+// the pods with the highest ordinals of a StatefulSet, or the pods chosen by a targeted scale down. Deployments without a
+// targeted scale down remove arbitrary pods, so they aren't annotated.
+// Errors are only logged, so a pod that couldn't be annotated doesn't stop the scale down.
+func annotateDrain(agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, podNames []string) {
+	if !args.DrainAnnotation {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	for _, podName := range podNames {
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: deployment.Namespace}}
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would set %s=true on pod %s", DrainAnnotation, pod.Name)
+			continue
+		}
+		workloadLogger.Debugf("Setting %s=true on pod %s", DrainAnnotation, pod.Name)
+		if err := k8sClient.Sync().AnnotatePod(pod, DrainAnnotation, "true"); err != nil {
+			workloadLogger.Warnf("Error setting %s on pod %s: %s", DrainAnnotation, pod.Name, err.Error())
+		}
+	}
+}
+
+// drainScaleDown drains the agents of the pods a scale down removes with --drain-timeout, and holds the scale down until
+// they're idle, as an agent can be assigned a job between the decision and its pod stopping. The scale down is canceled,
+// and its agents undrained, once the workload isn't scaled down anymore, ex: when jobs are queued. A drained agent still
+// busy after the drain timeout is handled by the drain timeout policy. The drain is timed from now, the time of the
+// decision. The caller must hold statesMutex.
+func drainScaleDown(observed observation, decision *Decision, state *State, agentPoolID int, backend ci.Backend, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, now time.Time) {
+	if args.ScaleDown.DrainTimeout <= 0 {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+	drain := state.Drain
+	removedPodNames := getRemovedPodNames(decision, deployment)
+	// The decision doesn't remove the pod of a busy agent, so the drain continues while a drained agent holds it back
+	heldByBusyAgents := decision.HasSuppressor(SuppressorBusyAgent)
+
+	if drain == nil {
+		if len(removedPodNames) == 0 {
+			return
+		} else if args.DryRun {
+			workloadLogger.Infof("Dry run - would drain the agents of pods %s before scaling down", strings.Join(removedPodNames, ", "))
+			return
+		}
+		startDrain(observed, decision, state, removedPodNames, nil, agentPoolID, backend, deployment, now)
+		return
+	}
+
+	if (len(removedPodNames) == 0 && !heldByBusyAgents) || drain.Replicas >= decision.NumPods {
+		workloadLogger.Infof("%s isn't scaled down anymore - undraining the agents of pods %s", deployment.FriendlyName, strings.Join(drain.PodNames, ", "))
+		undrainAgents(observed, drain.AgentIDs, nil, agentPoolID, backend, deployment)
+		state.Drain = nil
+		state.changed = true
+		return
+	}
+	if !heldByBusyAgents && !isSubset(removedPodNames, drain.PodNames) {
+		// The scale down removes other pods, ex: after a scale up, so their agents are drained instead
+		startDrain(observed, decision, state, removedPodNames, drain, agentPoolID, backend, deployment, now)
+		return
+	}
+
+	var busyAgentNames []string
+	drainedPodNames := toStringSet(drain.PodNames)
+	for _, agent := range observed.Agents {
+		if agent.Busy && drainedPodNames.Contains(agent.PodName) {
+			busyAgentNames = append(busyAgentNames, agent.Name)
+		}
+	}
+	if len(busyAgentNames) == 0 {
+		// The drained pods that the scale down doesn't remove anymore can be assigned jobs again
+		workloadLogger.Infof("The drained agents of pods %s are idle - scaling down", strings.Join(drain.PodNames, ", "))
+		undrainAgents(observed, drain.AgentIDs, toStringSet(removedPodNames), agentPoolID, backend, deployment)
+		state.Drain = nil
+		state.changed = true
+		return
+	}
+	busyFor := now.Sub(drain.Since)
+	if busyFor < args.ScaleDown.DrainTimeout || (args.ScaleDown.IsDrainForced() && len(removedPodNames) == 0) {
+		// A forced drain that timed out after the decision was made is forced by the decision of the next iteration
+		workloadLogger.Infof("Waiting for the drained agents %s to finish their jobs before scaling down", strings.Join(busyAgentNames, ", "))
+		holdForDrain(decision, fmt.Sprintf("waiting for the drained agents %s to finish their jobs", strings.Join(busyAgentNames, ", ")))
+		return
+	}
+
+	labels := metricLabels(agentPoolID, deployment)
+	labels["policy"] = drainTimeoutPolicyLabel(args.ScaleDown, drain.Retries)
+	drainTimeoutsCounter.With(labels).Inc()
+	message := fmt.Sprintf("The drained agents %s were still busy after the drain timeout of %s", strings.Join(busyAgentNames, ", "), args.ScaleDown.DrainTimeout.String())
+	if args.ScaleDown.IsDrainForced() {
+		// The decision removes the pods of the busy agents, limited like any other scale down, ex: by the min and the
+		// scale down max. The drained pods it doesn't remove can be assigned jobs again.
+		message = message + " - forcing the scale down, which cancels their jobs"
+		undrainAgents(observed, drain.AgentIDs, toStringSet(removedPodNames), agentPoolID, backend, deployment)
+		decision.Reason = fmt.Sprintf("forcing the scale down after the drain timeout of %s", args.ScaleDown.DrainTimeout.String())
+		state.Drain = nil
+	} else if args.ScaleDown.CanRetryDrain(drain.Retries) {
+		drain.Retries = drain.Retries + 1
+		message = message + fmt.Sprintf(" - waiting for them again (retry %d)", drain.Retries)
+		drain.Since = now
+		holdForDrain(decision, fmt.Sprintf("retrying the drain of the agents %s", strings.Join(busyAgentNames, ", ")))
+	} else {
+		if args.ScaleDown.IsDrainRetried() {
+			message = message + fmt.Sprintf(" %d times", drain.Retries+1)
+		}
+		message = message + " - aborting the scale down and undraining them"
+		undrainAgents(observed, drain.AgentIDs, nil, agentPoolID, backend, deployment)
+		state.Drain = nil
+		holdForDrain(decision, fmt.Sprintf("the drained agents %s were still busy after the drain timeout", strings.Join(busyAgentNames, ", ")))
+	}
+	state.changed = true
+	workloadLogger.Warn(message)
+	createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonDrainTimedOut, message)
+	if _, preview := backend.(previewBackend); preview {
+		// A preview doesn't create events, so it doesn't notify either
+		return
+	}
+	notify.Send(notify.Notification{
+		Type:         notify.TypeDrainTimedOut,
+		Severity:     notify.SeverityWarning,
+		Time:         now,
+		Namespace:    deployment.Namespace,
+		Workload:     deployment.FriendlyName,
+		AgentPoolID:  agentPoolID,
+		FromReplicas: decision.NumPods,
+		ToReplicas:   decision.DesiredReplicas,
+		Reason:       message,
+	})
+}
+
+// startDrain drains the agents of the pods a scale down removes and holds the scale down, replacing the previous drain
+// if there's one. The agents of the previous drain that are still removed stay drained, the others are undrained. The
+// scale down isn't held if there are no agents to drain, or the CI system can't drain them.
+func startDrain(observed observation, decision *Decision, state *State, removedPodNames []string, previous *Drain, agentPoolID int, backend ci.Backend, deployment *kubernetes.Workload, now time.Time) {
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+	removed := toStringSet(removedPodNames)
+	agentIDs := make(map[string]int)
+	if previous != nil {
+		undrainAgents(observed, previous.AgentIDs, removed, agentPoolID, backend, deployment)
+		for podName, agentID := range previous.AgentIDs {
+			if removed.Contains(podName) {
+				agentIDs[podName] = agentID
+			}
+		}
+		state.Drain = nil
+		state.changed = true
+	}
+
+	for _, agent := range observed.Agents {
+		if !agent.Enabled || !removed.Contains(agent.PodName) {
+			continue
+		}
+		err := backend.Drain(agentPoolID, agent)
+		if errors.Is(err, ci.ErrNotSupported) {
+			workloadLogger.Debugf("The agents can't be drained - scaling down %s without draining them", deployment.FriendlyName)
+			return
+		} else if err != nil {
+			workloadLogger.Warnf("Error draining agent %s before scaling down: %s", agent.Name, err.Error())
+			continue
+		}
+		agentIDs[agent.PodName] = agent.ID
+	}
+	if len(agentIDs) == 0 {
+		return
+	}
+
+	workloadLogger.Infof("Drained the agents of pods %s - scaling down once they're idle", strings.Join(removedPodNames, ", "))
+	state.Drain = &Drain{
+		Since:    now,
+		Replicas: decision.DesiredReplicas,
+		PodNames: removedPodNames,
+		Targeted: len(decision.PodsToRemove) > 0,
+		AgentIDs: agentIDs,
+	}
+	state.changed = true
+	holdForDrain(decision, fmt.Sprintf("draining the agents of pods %s", strings.Join(removedPodNames, ", ")))
+}
+
+// undrainAgents undrains the drained agents, except the agents of the kept pods. The agents that were deregistered
+// aren't undrained. Errors are only logged.
+func undrainAgents(observed observation, agentIDs map[string]int, keptPodNames collections.StringSet, agentPoolID int, backend ci.Backend, deployment *kubernetes.Workload) {
+	for _, agent := range observed.Agents {
+		if agentID, drained := agentIDs[agent.PodName]; !drained || agentID != agent.ID || keptPodNames.Contains(agent.PodName) {
+			continue
+		}
+		if err := backend.Undrain(agentPoolID, agent); err != nil {
+			workloadLogger(agentPoolID, deployment).Warnf("Error undraining agent %s: %s", agent.Name, err.Error())
+		}
+	}
+}
+
+// previewBackend is a CI backend that doesn't drain or undrain the agents, to preview the drain of a scale down
+type previewBackend struct {
+	ci.Backend
+	// canDrain is false if the CI system can't drain agents, ex: GitHub
+	canDrain bool
+}
+
+// newPreviewBackend returns a previewBackend of a CI backend by the name of its CI system
+func newPreviewBackend(backend ci.Backend, name string) previewBackend {
+	return previewBackend{Backend: backend, canDrain: name != args.BackendGitHub}
+}
+
+func (b previewBackend) Drain(poolID int, agent ci.Agent) error {
+	if !b.canDrain {
+		return ci.ErrNotSupported
+	}
+	return nil
+}
+
+func (b previewBackend) Undrain(poolID int, agent ci.Agent) error {
+	return b.Drain(poolID, agent)
+}
+
+// copyDrainState returns a copy of the state whose drain can be changed without changing the state
+func copyDrainState(state *State) *State {
+	copied := *state
+	if state.Drain != nil {
+		drain := *state.Drain
+		copied.Drain = &drain
+	}
+	return &copied
+}
+
+// holdForDrain keeps the replicas of a scale down while its agents are drained
+func holdForDrain(decision *Decision, reason string) {
+	decision.limit(SuppressorDraining, decision.DesiredReplicas, decision.NumPods)
+	decision.DesiredReplicas = decision.NumPods
+	decision.PodsToRemove = nil
+	decision.Reason = reason
+}
+
+// drainTimeoutPolicyLabel returns the drain timeout policy applied after the retries of a drain for the metrics, which is
+// abort if it isn't set or the retries are exhausted
+func drainTimeoutPolicyLabel(scaleDownArgs args.ScaleDownArgs, retries int32) string {
+	if scaleDownArgs.IsDrainForced() {
+		return args.DrainTimeoutForce
+	} else if scaleDownArgs.CanRetryDrain(retries) {
+		return args.DrainTimeoutRetry
+	}
+	return args.DrainTimeoutAbort
+}
+
+// getForcedDrainPodNames returns the pods of a drain that timed out with the force policy, whose busy agents don't hold
+// the scale down back anymore
+func getForcedDrainPodNames(drain *Drain, scaleDownArgs args.ScaleDownArgs, now time.Time) collections.StringSet {
+	if drain == nil || !scaleDownArgs.IsDrainForced() || scaleDownArgs.DrainTimeout <= 0 || now.Sub(drain.Since) < scaleDownArgs.DrainTimeout {
+		return nil
+	}
+	return toStringSet(drain.PodNames)
+}
+
+// isSubset returns true if every value is in the other values
+func isSubset(values []string, otherValues []string) bool {
+	others := toStringSet(otherValues)
+	for _, value := range values {
+		if !others.Contains(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func toStringSet(values []string) collections.StringSet {
+	set := make(collections.StringSet, len(values))
+	for _, value := range values {
+		set.Add(value)
+	}
+	return set
+}
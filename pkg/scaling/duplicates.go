@@ -0,0 +1,116 @@
+package scaling
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonDuplicateAgentsRemoved = "DuplicateAgentsRemoved"
+
+var (
+	duplicateAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_duplicate_agents_count",
+		Help: "The number of stale agents registered with the pod name of another agent of the workload",
+	}, metricLabelNames)
+	duplicateAgentsRemovedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_duplicate_agents_removed_count",
+		Help: "The total number of stale duplicate agents deregistered from the agent pool",
+	}, metricLabelNames)
+)
+
+// getDuplicateAgents returns the stale agents registered with the same pod name as another agent of a pod of the
+// workload, which a pod that restarted without replacing its agent leaves behind. Of the agents of a pod, the busy agent
+// is kept, then the online agent, then the agent registered last. Only offline agents that aren't running a job are
+// stale, so two online agents claiming the same pod are both kept.
+func getDuplicateAgents(agents []ci.Agent, pods []corev1.Pod) []ci.Agent {
+	podNames := make(map[string]bool)
+	for _, pod := range pods {
+		podNames[pod.Name] = true
+	}
+	agentsByPod := make(map[string][]ci.Agent)
+	for _, agent := range agents {
+		if agent.PodName != "" && podNames[agent.PodName] {
+			agentsByPod[agent.PodName] = append(agentsByPod[agent.PodName], agent)
+		}
+	}
+
+	var duplicates []ci.Agent
+	for _, podAgents := range agentsByPod {
+		if len(podAgents) < 2 {
+			continue
+		}
+		sort.Slice(podAgents, func(i, j int) bool {
+			if podAgents[i].Busy != podAgents[j].Busy {
+				return podAgents[i].Busy
+			}
+			if podAgents[i].Online != podAgents[j].Online {
+				return podAgents[i].Online
+			}
+			return podAgents[i].ID > podAgents[j].ID
+		})
+		for _, agent := range podAgents[1:] {
+			if !agent.Online && !agent.Busy {
+				duplicates = append(duplicates, agent)
+			}
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].ID < duplicates[j].ID })
+	return duplicates
+}
+
+// removeDuplicateAgents returns the observation without the stale duplicate agents of the workload's pods, so they aren't
+// counted as the agents of their pod, and deregisters them from the agent pool if --remove-duplicate-agents is set.
+// Errors are only logged, and an agent that couldn't be deregistered is still left out of the observation.
+func removeDuplicateAgents(observed observation, agentPoolID int, backend ci.Backend, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) observation {
+	duplicates := getDuplicateAgents(observed.Agents, observed.Pods)
+	labels := metricLabels(agentPoolID, deployment)
+	duplicateAgentsGauge.With(labels).Set(float64(len(duplicates)))
+	if len(duplicates) == 0 {
+		return observed
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	duplicateIDs := make(map[int]bool)
+	for _, agent := range duplicates {
+		duplicateIDs[agent.ID] = true
+	}
+	agents := make([]ci.Agent, 0, len(observed.Agents)-len(duplicates))
+	for _, agent := range observed.Agents {
+		if !duplicateIDs[agent.ID] {
+			agents = append(agents, agent)
+		}
+	}
+	observed.Agents = agents
+
+	if !args.RemoveDuplicateAgents {
+		workloadLogger.Debugf("Ignoring %d stale agents registered with the pod name of another agent", len(duplicates))
+		return observed
+	}
+	var removed []string
+	for _, agent := range duplicates {
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would remove agent %s, a stale duplicate of the agent of pod %s", agent.Name, agent.PodName)
+			continue
+		}
+		if err := backend.Remove(agentPoolID, agent); err != nil {
+			workloadLogger.Warnf("Error removing agent %s, a stale duplicate of the agent of pod %s: %s", agent.Name, agent.PodName, err.Error())
+			continue
+		}
+		workloadLogger.Infof("Removed agent %s, a stale duplicate of the agent of pod %s", agent.Name, agent.PodName)
+		duplicateAgentsRemovedCounter.With(labels).Inc()
+		removed = append(removed, agent.Name)
+	}
+	if len(removed) > 0 {
+		createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, eventReasonDuplicateAgentsRemoved, fmt.Sprintf("Removed %d stale duplicate agents: %s", len(removed), strings.Join(removed, ", ")))
+	}
+	return observed
+}
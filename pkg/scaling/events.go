@@ -0,0 +1,108 @@
+package scaling
+
+import (
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const (
+	eventReasonScaledUp         = "ScaledUp"
+	eventReasonScaledDown       = "ScaledDown"
+	eventReasonScaleFailed      = "ScaleFailed"
+	eventReasonScaleUpBlocked   = "ScaleUpBlocked"
+	eventReasonScaleDownBlocked = "ScaleDownBlocked"
+	eventReasonScalingBlocked   = "ScalingBlocked"
+)
+
+// scaleUpSuppressors are the suppressors that only block scale ups
+var scaleUpSuppressors = map[Suppressor]bool{
+	SuppressorUnschedulablePods: true,
+	SuppressorPendingBackoff:    true,
+	SuppressorRegistration:      true,
+	SuppressorMax:               true,
+	SuppressorScaleUpStep:       true,
+	SuppressorCapacity:          true,
+	SuppressorQuota:             true,
+	SuppressorHealthGate:        true,
+	SuppressorPriority:          true,
+}
+
+// scaleDownSuppressors are the suppressors that only block scale downs
+var scaleDownSuppressors = map[Suppressor]bool{
+	SuppressorBusyAgent:    true,
+	SuppressorIdleDelay:    true,
+	SuppressorMin:          true,
+	SuppressorCooldown:     true,
+	SuppressorScaleDownMax: true,
+}
+
+var (
+	// lastBlockedEventsMutex guards lastBlockedEvents, as the workloads are autoscaled concurrently
+	lastBlockedEventsMutex sync.Mutex
+	// lastBlockedEvents are the last blocked event messages of each workload, so they're only created when they change
+	lastBlockedEvents = make(map[string]string)
+)
+
+// createEvent creates an event on the workload, unless events are disabled or this is a dry run. Errors are only logged.
+func createEvent(k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, eventType string, reason string, message string) {
+	if !args.Events || args.DryRun {
+		return
+	}
+	if err := k8sClient.Sync().CreateEvent(deployment, eventType, reason, message); err != nil {
+		logger.Errorf("Error creating a %s event for %s: %s", reason, deployment.FriendlyName, err.Error())
+	}
+}
+
+// createScaleEvent creates an event for a scale operation
+func createScaleEvent(decision *Decision, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, err error) {
+	if err != nil {
+		message := fmt.Sprintf("Failed to scale from %d to %d replicas: %s", decision.NumPods, decision.DesiredReplicas, err.Error())
+		createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonScaleFailed, message)
+		return
+	}
+
+	reason := eventReasonScaledUp
+	if decision.Action() == ActionScaleDown {
+		reason = eventReasonScaledDown
+	}
+	message := fmt.Sprintf("Scaled from %d to %d replicas: %s", decision.NumPods, decision.DesiredReplicas, decision.Reason)
+	createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, reason, message)
+}
+
+// createBlockedEvent creates an event when scaling was prevented by a suppressor. The event is only created when the
+// reason changes, as scaling is usually blocked for several iterations.
+func createBlockedEvent(decision *Decision, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if !changeBlockedEvent(decision, deployment) {
+		return
+	}
+
+	reason := eventReasonScalingBlocked
+	lastSuppressor := decision.Suppressors[len(decision.Suppressors)-1]
+	if scaleUpSuppressors[lastSuppressor] {
+		reason = eventReasonScaleUpBlocked
+	} else if scaleDownSuppressors[lastSuppressor] {
+		reason = eventReasonScaleDownBlocked
+	}
+	createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, reason, decision.Reason)
+}
+
+// changeBlockedEvent records the blocked event message of a workload, and returns true if a blocked event has to be created
+func changeBlockedEvent(decision *Decision, deployment *kubernetes.Workload) bool {
+	key := stateKey(deployment)
+	lastBlockedEventsMutex.Lock()
+	defer lastBlockedEventsMutex.Unlock()
+	if decision.IsScaling() || len(decision.Suppressors) == 0 {
+		delete(lastBlockedEvents, key)
+		return false
+	}
+	if lastBlockedEvents[key] == decision.Reason {
+		return false
+	}
+	lastBlockedEvents[key] = decision.Reason
+	return true
+}
@@ -0,0 +1,44 @@
+package scaling
+
+import (
+	"strconv"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// SafeToEvictAnnotation is the annotation the cluster autoscaler checks before evicting a pod to remove its node
+const SafeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+
+// annotateSafeToEvict sets the safe-to-evict annotation of the agent pods: false if the agent is running a job
+// or jobs are queued, as an idle agent may be assigned one, and true otherwise. Pods are only patched when
+// their annotation changes, and errors are only logged, as the annotation is not required to scale.
+func annotateSafeToEvict(observed observation, decision *Decision, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if !args.SafeToEvict {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	busyPodNames := make(collections.StringSet)
+	for _, agent := range observed.Agents {
+		if agent.Busy && agent.Online {
+			busyPodNames.Add(agent.PodName)
+		}
+	}
+
+	for _, pod := range observed.Pods {
+		safeToEvict := strconv.FormatBool(decision.NumQueuedJobs == 0 && !busyPodNames.Contains(pod.Name))
+		if pod.Annotations[SafeToEvictAnnotation] == safeToEvict {
+			continue
+		}
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would set %s=%s on pod %s", SafeToEvictAnnotation, safeToEvict, pod.Name)
+			continue
+		}
+		workloadLogger.Debugf("Setting %s=%s on pod %s", SafeToEvictAnnotation, safeToEvict, pod.Name)
+		if err := k8sClient.Sync().AnnotatePod(pod, SafeToEvictAnnotation, safeToEvict); err != nil {
+			workloadLogger.Warnf("Error setting %s on pod %s: %s", SafeToEvictAnnotation, pod.Name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package scaling
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+var execHookCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "azp_agent_autoscaler_exec_hook_count",
+	Help: "The total number of exec hooks run, by event and result: success, failed or timeout",
+}, append(metricLabelNames, "event", "result"))
+
+// maxExecHookOutput is how much of the output of a failed exec hook is included in its error
+const maxExecHookOutput = 1024
+
+// execHookPassedEnv are the environment variables of the autoscaler passed to the exec hooks. The others aren't
+// passed, as they include the tokens of the CI system.
+var execHookPassedEnv = []string{"PATH", "HOME", "TMPDIR", "TZ", "SYSTEMROOT", "KUBERNETES_SERVICE_HOST", "KUBERNETES_SERVICE_PORT"}
+
+// execHookEvents returns the events of the exec hooks run before and after a scale up or a scale down
+func execHookEvents(scaleDown bool) (pre string, post string) {
+	if scaleDown {
+		return args.ExecHookPreScaleDown, args.ExecHookPostScaleDown
+	}
+	return args.ExecHookPreScaleUp, args.ExecHookPostScaleUp
+}
+
+// runExecHooks runs the exec hooks of the event of a scale operation in order, and returns the error of the first one
+// that failed. The hooks after it aren't run. scaleErr is the error of the scale operation for the post hooks.
+func runExecHooks(event string, decision *Decision, agentPoolID int, deployment *kubernetes.Workload, hookArgs args.ExecHookArgs, scaleErr error) error {
+	for _, hook := range hookArgs.Hooks {
+		if hook.Event != event {
+			continue
+		}
+		err := runExecHook(hook, decision, agentPoolID, deployment, hookArgs, scaleErr)
+		labels := metricLabels(agentPoolID, deployment)
+		labels["event"] = event
+		switch {
+		case err == nil:
+			labels["result"] = "success"
+		case err == context.DeadlineExceeded:
+			labels["result"] = "timeout"
+			err = fmt.Errorf("the %s hook %s didn't finish within %s", event, hook.Command[0], hookArgs.Timeout.String())
+		default:
+			labels["result"] = "failed"
+		}
+		execHookCounter.With(labels).Inc()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runExecHook runs an exec hook with the details of the decision in its environment variables, and kills it once the
+// timeout passed. It returns context.DeadlineExceeded if it timed out.
+func runExecHook(hook args.ExecHook, decision *Decision, agentPoolID int, deployment *kubernetes.Workload, hookArgs args.ExecHookArgs, scaleErr error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookArgs.Timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	command.Env = execHookEnv(hook.Event, decision, agentPoolID, deployment, scaleErr)
+	// The output is read from a pipe the hook doesn't own, as the processes it started would keep the pipe of
+	// exec.Cmd open after it's killed, and Wait would wait for them past the timeout
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	command.Stdout, command.Stderr = writer, writer
+	err = command.Start()
+	writer.Close()
+	if err != nil {
+		return fmt.Errorf("the %s hook %s failed to start: %w", hook.Event, hook.Command[0], err)
+	}
+	var output bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&output, reader)
+		close(copied)
+	}()
+	err = command.Wait()
+	select {
+	case <-copied:
+	case <-ctx.Done():
+		reader.Close()
+		<-copied
+	}
+	workloadLogger(agentPoolID, deployment).Debugf("The %s hook %s of %s returned: %s", hook.Event, hook.Command[0], deployment.FriendlyName, output.String())
+	if ctx.Err() == context.DeadlineExceeded {
+		return context.DeadlineExceeded
+	} else if err != nil {
+		message := strings.TrimSpace(output.String())
+		if len(message) > maxExecHookOutput {
+			message = message[len(message)-maxExecHookOutput:]
+		}
+		if message == "" {
+			return fmt.Errorf("the %s hook %s failed: %w", hook.Event, hook.Command[0], err)
+		}
+		return fmt.Errorf("the %s hook %s failed: %w: %s", hook.Event, hook.Command[0], err, message)
+	}
+	return nil
+}
+
+// execHookEnv returns the environment variables of an exec hook: the details of the decision, prefixed with
+// AZP_AUTOSCALER_, with the credentials of the reason and error redacted, and the passed environment variables of the
+// autoscaler
+func execHookEnv(event string, decision *Decision, agentPoolID int, deployment *kubernetes.Workload, scaleErr error) []string {
+	env := []string{
+		"AZP_AUTOSCALER_EVENT=" + event,
+		"AZP_AUTOSCALER_NAMESPACE=" + deployment.Namespace,
+		"AZP_AUTOSCALER_WORKLOAD=" + deployment.FriendlyName,
+		"AZP_AUTOSCALER_POOL_ID=" + strconv.Itoa(agentPoolID),
+		"AZP_AUTOSCALER_ACTION=" + string(decision.Action()),
+		"AZP_AUTOSCALER_FROM_REPLICAS=" + strconv.Itoa(int(decision.NumPods)),
+		"AZP_AUTOSCALER_TO_REPLICAS=" + strconv.Itoa(int(decision.DesiredReplicas)),
+		"AZP_AUTOSCALER_QUEUED_JOBS=" + strconv.Itoa(int(decision.NumQueuedJobs)),
+		"AZP_AUTOSCALER_ACTIVE_AGENTS=" + strconv.Itoa(int(decision.NumActiveAgents)),
+		"AZP_AUTOSCALER_IDLE_AGENTS=" + strconv.Itoa(int(decision.NumIdleAgents)),
+		"AZP_AUTOSCALER_REASON=" + logging.Redact(decision.Reason),
+	}
+	if scaleErr != nil {
+		env = append(env, "AZP_AUTOSCALER_ERROR="+logging.Redact(scaleErr.Error()))
+	}
+	for _, name := range execHookPassedEnv {
+		if value, set := os.LookupEnv(name); set {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
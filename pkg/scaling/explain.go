@@ -0,0 +1,164 @@
+package scaling
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+// Explanation is a human-readable breakdown of how the desired replicas of a workload were decided
+type Explanation struct {
+	Time            time.Time `json:"time"`
+	Namespace       string    `json:"namespace"`
+	Workload        string    `json:"workload"`
+	AgentPoolID     int       `json:"poolId"`
+	CurrentReplicas int32     `json:"currentReplicas"`
+	DesiredReplicas int32     `json:"desiredReplicas"`
+	Action          string    `json:"action"`
+	// Inputs are the pods, agents and jobs the decision was made from, and the scaling limits
+	Inputs []string `json:"inputs"`
+	// Computation is how the replicas the demand needs were computed from the inputs
+	Computation []string `json:"computation"`
+	// Limits are the limits, holds and cooldowns that changed the replicas to scale to, in the order they were applied
+	Limits []string `json:"limits"`
+	// Outcome is the replicas the workload is scaled to, and why
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// explanations explain the last decision of each workload, guarded by statesMutex. They're only built when requested,
+// as a workload is autoscaled far more often than its decision is explained.
+var explanations = make(map[string]func() Explanation)
+
+// Explain returns the breakdown of a scaling decision, and the error applying it if there was one
+func Explain(decision *Decision, agentPoolID int, deployment *kubernetes.Workload, args args.Args, err error) Explanation {
+	explanation := Explanation{
+		Time:            time.Now(),
+		Namespace:       deployment.Namespace,
+		Workload:        deployment.FriendlyName,
+		AgentPoolID:     agentPoolID,
+		CurrentReplicas: decision.NumPods,
+		DesiredReplicas: decision.DesiredReplicas,
+		Action:          string(decision.Action()),
+		Inputs:          []string{},
+		Computation:     []string{},
+		Limits:          []string{},
+	}
+
+	pods := fmt.Sprintf("%d pods: %d running, %d pending (%d unschedulable), %d failed, %d stale", decision.NumPods, decision.NumRunningPods, decision.NumPendingPods, decision.NumUnschedulablePods, decision.NumFailedPods, decision.NumStalePods)
+	if decision.NumMissingPods > 0 {
+		pods = fmt.Sprintf("%s, %d missing ordinals", pods, decision.NumMissingPods)
+	}
+	explanation.Inputs = append(explanation.Inputs,
+		pods,
+		fmt.Sprintf("%d active agents and %d idle agents of the %d agents in the pool", decision.NumActiveAgents, decision.NumIdleAgents, len(decision.Agents)),
+		fmt.Sprintf("%d queued jobs and %d jobs waiting for an approval, a check or a delay", decision.NumQueuedJobs, decision.NumWaitingJobs),
+		fmt.Sprintf("A minimum of %d free agents and a maximum of %d pods", args.Min, args.Max),
+	)
+	if decision.SLO != nil {
+		explanation.Inputs = append(explanation.Inputs, fmt.Sprintf("%.2f jobs queued per minute with an average duration of %s", decision.SLO.ArrivalRate, decision.SLO.AverageDuration.Round(time.Second).String()))
+	}
+
+	if decision.SLO != nil {
+		explanation.Computation = append(explanation.Computation, fmt.Sprintf("Demand: %d agents, as %d busy agents are needed to start the jobs within the max queue time", decision.QueueDemand, decision.SLO.RequiredAgents))
+	} else {
+		explanation.Computation = append(explanation.Computation, fmt.Sprintf("Demand: %d agents for the queued jobs after weighting by their queue time, and the waiting jobs", decision.QueueDemand))
+	}
+	neededAgents := decision.NumActiveAgents + decision.QueueDemand + decision.MinFreeAgents
+	explanation.Computation = append(explanation.Computation,
+		fmt.Sprintf("Needed agents: %d active + %d demand + %d free = %d", decision.NumActiveAgents, decision.QueueDemand, decision.MinFreeAgents, neededAgents),
+		fmt.Sprintf("Available agents: %d of the %d pods, without the stale pods and missing ordinals", decision.NumAvailablePods, decision.NumPods),
+		fmt.Sprintf("Demanded replicas: %d pods + %d needed - %d available = %d", decision.NumPods, neededAgents, decision.NumAvailablePods, decision.DemandedReplicas),
+	)
+
+	for _, limit := range decision.Limits {
+		if limit.From == limit.To {
+			explanation.Limits = append(explanation.Limits, fmt.Sprintf("%s: held at %d replicas", limit.Suppressor, limit.To))
+		} else if limit.To == decision.NumPods {
+			explanation.Limits = append(explanation.Limits, fmt.Sprintf("%s: held at %d replicas instead of %d", limit.Suppressor, limit.To, limit.From))
+		} else {
+			explanation.Limits = append(explanation.Limits, fmt.Sprintf("%s: limited from %d to %d replicas", limit.Suppressor, limit.From, limit.To))
+		}
+	}
+
+	reason := logging.Redact(decision.Reason)
+	if decision.IsScaling() {
+		explanation.Outcome = fmt.Sprintf("Scaling from %d to %d replicas - %s", decision.NumPods, decision.DesiredReplicas, reason)
+	} else {
+		explanation.Outcome = fmt.Sprintf("Not scaling from %d replicas - %s", decision.NumPods, reason)
+	}
+	if err != nil {
+		explanation.Error = logging.Redact(err.Error())
+	}
+	return explanation
+}
+
+// String returns the explanation as text, one section per line
+func (e Explanation) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%s (namespace %s, agent pool %d) at %s\n", e.Workload, e.Namespace, e.AgentPoolID, e.Time.UTC().Format(time.RFC3339))
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"Inputs", e.Inputs},
+		{"Computation", e.Computation},
+		{"Limits", e.Limits},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(&builder, "%s:\n", section.title)
+		if len(section.lines) == 0 {
+			builder.WriteString("  none\n")
+		}
+		for _, line := range section.lines {
+			fmt.Fprintf(&builder, "  %s\n", line)
+		}
+	}
+	fmt.Fprintf(&builder, "Outcome: %s\n", e.Outcome)
+	if e.Error != "" {
+		fmt.Fprintf(&builder, "Error: %s\n", e.Error)
+	}
+	return builder.String()
+}
+
+// recordExplanation records the explanation of the last decision of a workload, or the error of a cycle that failed
+// before the decision was made if it's nil. The caller must hold statesMutex.
+func recordExplanation(decision *Decision, agentPoolID int, deployment *kubernetes.Workload, args args.Args, err error) {
+	now := time.Now()
+	if decision != nil {
+		explanations[stateKey(deployment)] = func() Explanation {
+			explanation := Explain(decision, agentPoolID, deployment, args, err)
+			explanation.Time = now
+			return explanation
+		}
+		return
+	}
+	explanation := Explanation{
+		Time:        now,
+		Namespace:   deployment.Namespace,
+		Workload:    deployment.FriendlyName,
+		AgentPoolID: agentPoolID,
+		Action:      string(ActionNone),
+		Inputs:      []string{},
+		Computation: []string{},
+		Limits:      []string{},
+		Outcome:     "No decision was made - the cycle failed",
+		Error:       logging.Redact(err.Error()),
+	}
+	explanations[stateKey(deployment)] = func() Explanation { return explanation }
+}
+
+// GetExplanation returns the explanation of the last decision of a workload, if it has been autoscaled
+func GetExplanation(workload *kubernetes.Workload) (Explanation, bool) {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	explain, exists := explanations[stateKey(workload)]
+	if !exists {
+		return Explanation{}, false
+	}
+	return explain(), true
+}
@@ -0,0 +1,136 @@
+package scaling
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/appinsights"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/cloudevents"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/notify"
+)
+
+// exportProperties returns the Application Insights properties of a workload
+func exportProperties(agentPoolID int, deployment *kubernetes.Workload) map[string]string {
+	return map[string]string{
+		"pool":      strconv.Itoa(agentPoolID),
+		"namespace": deployment.Namespace,
+		"workload":  deployment.FriendlyName,
+	}
+}
+
+// exportDecision sends the core metrics of a scaling decision to Application Insights, if enabled
+func exportDecision(decision *Decision, agentPoolID int, deployment *kubernetes.Workload) {
+	appinsights.TrackMetrics(exportProperties(agentPoolID, deployment), map[string]float64{
+		"QueuedJobs":      float64(decision.NumQueuedJobs),
+		"QueueDemand":     float64(decision.QueueDemand),
+		"ActiveAgents":    float64(decision.NumActiveAgents),
+		"IdleAgents":      float64(decision.NumIdleAgents),
+		"CurrentReplicas": float64(decision.NumPods),
+		"DesiredReplicas": float64(decision.DesiredReplicas),
+	})
+}
+
+// exportScale sends a scale operation to Application Insights as an event, if enabled
+func exportScale(decision *Decision, agentPoolID int, deployment *kubernetes.Workload, err error) {
+	name := eventReasonScaledUp
+	if decision.Action() == ActionScaleDown {
+		name = eventReasonScaledDown
+	}
+	properties := exportProperties(agentPoolID, deployment)
+	properties["reason"] = decision.Reason
+	if err != nil {
+		name = eventReasonScaleFailed
+		properties["error"] = err.Error()
+	}
+	appinsights.TrackEvent(name, properties, map[string]float64{
+		"FromReplicas": float64(decision.NumPods),
+		"ToReplicas":   float64(decision.DesiredReplicas),
+	})
+}
+
+// notifyScale sends a scale operation to the notifiers
+func notifyScale(decision *Decision, agentPoolID int, deployment *kubernetes.Workload, err error) {
+	notification := notify.Notification{
+		Type:         notify.TypeScaledUp,
+		Severity:     notify.SeverityInfo,
+		Time:         time.Now(),
+		Namespace:    deployment.Namespace,
+		Workload:     deployment.FriendlyName,
+		AgentPoolID:  agentPoolID,
+		FromReplicas: decision.NumPods,
+		ToReplicas:   decision.DesiredReplicas,
+		Reason:       decision.Reason,
+	}
+	if decision.Action() == ActionScaleDown {
+		notification.Type = notify.TypeScaledDown
+	}
+	if err != nil {
+		notification.Type = notify.TypeScaleFailed
+		notification.Severity = notify.SeverityError
+		notification.Error = err.Error()
+	}
+	notify.Send(notification)
+}
+
+// CloudEventTypeDecision is the CloudEvent type of scaling decisions
+const CloudEventTypeDecision = "com.github.ogmaresca.azp-agent-autoscaler.decision"
+
+// DecisionRecord is the JSON summary of a scaling decision, sent as the data of the decision CloudEvents
+type DecisionRecord struct {
+	AgentPoolID     int    `json:"poolId"`
+	Namespace       string `json:"namespace"`
+	Workload        string `json:"workload"`
+	Action          string `json:"action"`
+	CurrentReplicas int32  `json:"currentReplicas"`
+	DesiredReplicas int32  `json:"desiredReplicas"`
+	QueuedJobs      int32  `json:"queuedJobs"`
+	QueueDemand     int32  `json:"queueDemand"`
+	ActiveAgents    int32  `json:"activeAgents"`
+	IdleAgents      int32  `json:"idleAgents"`
+	// AgentIdleSeconds are how long the idle agents have been idle by pod name
+	AgentIdleSeconds map[string]int64 `json:"agentIdleSeconds,omitempty"`
+	Reason           string           `json:"reason"`
+	Suppressors      []string         `json:"suppressors,omitempty"`
+	DryRun           bool             `json:"dryRun"`
+	Error            string           `json:"error,omitempty"`
+}
+
+// NewDecisionRecord returns the JSON summary of a scaling decision, and the error applying it if there was one.
+// The credentials of its reason and error are redacted, as the records leave the autoscaler.
+func NewDecisionRecord(decision *Decision, agentPoolID int, deployment *kubernetes.Workload, args args.Args, err error) DecisionRecord {
+	record := DecisionRecord{
+		AgentPoolID:     agentPoolID,
+		Namespace:       deployment.Namespace,
+		Workload:        deployment.FriendlyName,
+		Action:          string(decision.Action()),
+		CurrentReplicas: decision.NumPods,
+		DesiredReplicas: decision.DesiredReplicas,
+		QueuedJobs:      decision.NumQueuedJobs,
+		QueueDemand:     decision.QueueDemand,
+		ActiveAgents:    decision.NumActiveAgents,
+		IdleAgents:      decision.NumIdleAgents,
+		Reason:          logging.Redact(decision.Reason),
+		Suppressors:     decision.SuppressorNames(),
+		DryRun:          args.DryRun,
+	}
+	for podName, idleTime := range decision.AgentIdleTimes {
+		if record.AgentIdleSeconds == nil {
+			record.AgentIdleSeconds = make(map[string]int64, len(decision.AgentIdleTimes))
+		}
+		record.AgentIdleSeconds[podName] = int64(idleTime.Seconds())
+	}
+	if err != nil {
+		record.Error = logging.Redact(err.Error())
+	}
+	return record
+}
+
+// publishDecision publishes a scaling decision as a CloudEvent, if enabled
+func publishDecision(decision *Decision, agentPoolID int, deployment *kubernetes.Workload, args args.Args, err error) {
+	data := NewDecisionRecord(decision, agentPoolID, deployment, args, err)
+	cloudevents.Publish(CloudEventTypeDecision, fmt.Sprintf("%s/%s", deployment.Namespace, deployment.FriendlyName), data)
+}
@@ -0,0 +1,105 @@
+package scaling
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+)
+
+// ExternalDemand is the number of agents an agent pool needs, for an external autoscaler that scales the agents itself, ex: KEDA
+type ExternalDemand struct {
+	QueuedJobs int32
+	// QueueDemand is the number of agents needed for the queued jobs, weighted by their queue time if enabled
+	QueueDemand int32
+	BusyAgents  int32
+	// DrainReplicas is the number of replicas that keeps every busy agent of the StatefulSet, as it removes its highest ordinals first.
+	// It is 0 if the StatefulSet isn't known.
+	DrainReplicas int32
+}
+
+// Agents returns the number of agents needed: one per busy agent and queued job, and at least the drain replicas,
+// so a scale down doesn't remove the pod of a busy agent
+func (d ExternalDemand) Agents() int32 {
+	return math.MaxInt32(d.BusyAgents+d.QueueDemand, d.DrainReplicas)
+}
+
+// ErrPoolNotFound is returned when an agent pool with the name doesn't exist
+var ErrPoolNotFound = errors.New("Could not find an agent pool")
+
+// ObserveExternalDemand retrieves the agents and jobs of an agent pool by name and returns its demand, see GetExternalDemand.
+// The agents have the pod names of the agent name pattern. The error wraps ErrPoolNotFound if the pool doesn't exist.
+func ObserveExternalDemand(backend ci.Backend, poolName string, statefulSetName string, queueAgeArgs args.QueueAgeArgs, agentNames ci.AgentNamePattern) (ExternalDemand, error) {
+	agentPools, err := backend.Pools(poolName)
+	if err != nil {
+		return ExternalDemand{}, fmt.Errorf("Error retrieving agent pool %s: %w", poolName, err)
+	}
+	if len(agentPools) == 0 {
+		return ExternalDemand{}, fmt.Errorf("%w with name %s", ErrPoolNotFound, poolName)
+	}
+	agentPoolID := agentPools[0].ID
+
+	agentsChan := make(chan agentsResponse, 1)
+	jobsChan := make(chan jobsResponse, 1)
+	go func() {
+		agents, err := backend.Agents(agentPoolID)
+		agentsChan <- agentsResponse{Agents: agents, Err: err}
+	}()
+	go func() {
+		jobs, err := backend.Jobs(agentPoolID)
+		jobsChan <- jobsResponse{Jobs: jobs, Err: err}
+	}()
+	agents := <-agentsChan
+	jobs := <-jobsChan
+	if agents.Err != nil {
+		return ExternalDemand{}, fmt.Errorf("Error retrieving the agents of pool %s: %w", poolName, agents.Err)
+	}
+	if jobs.Err != nil {
+		return ExternalDemand{}, fmt.Errorf("Error retrieving the jobs of pool %s: %w", poolName, jobs.Err)
+	}
+	return GetExternalDemand(agentNames.PodNames(agents.Agents, statefulSetName), jobs.Jobs, statefulSetName, queueAgeArgs, time.Now()), nil
+}
+
+// GetExternalDemand returns the demand of an agent pool from its agents and jobs. If the StatefulSet name is set,
+// only the agents of its pods are counted, otherwise every agent in the pool is.
+func GetExternalDemand(agents []ci.Agent, jobs []ci.Job, statefulSetName string, queueAgeArgs args.QueueAgeArgs, now time.Time) ExternalDemand {
+	demand := ExternalDemand{}
+	agentNames := make(collections.StringSet)
+	for _, agent := range agents {
+		ordinal, isPod := statefulSetOrdinal(agent.PodName, statefulSetName)
+		if statefulSetName != "" && !isPod {
+			continue
+		}
+		agentNames.Add(agent.Name)
+		if !agent.Busy || !agent.Online {
+			continue
+		}
+		demand.BusyAgents++
+		if isPod {
+			demand.DrainReplicas = math.MaxInt32(demand.DrainReplicas, ordinal+1)
+		}
+	}
+
+	queuedJobs := getQueuedJobs(jobs, agentNames, jobRouting{})
+	demand.QueuedJobs = int32(len(queuedJobs))
+	demand.QueueDemand = getQueueDemand(queuedJobs, queueAgeArgs, now)
+	return demand
+}
+
+// statefulSetOrdinal returns the ordinal of a pod of a StatefulSet, and false if the pod isn't one of its pods
+func statefulSetOrdinal(podName string, statefulSetName string) (int32, bool) {
+	if statefulSetName == "" || !strings.HasPrefix(podName, statefulSetName+"-") {
+		return 0, false
+	}
+	ordinal, err := strconv.ParseInt(strings.TrimPrefix(podName, statefulSetName+"-"), 10, 32)
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+	return int32(ordinal), true
+}
@@ -0,0 +1,112 @@
+package scaling
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonFailStatic = "FailStaticScaledUp"
+
+// failStatic holds the workload while the agents and jobs of its pool can't be retrieved, as they aren't scaled without
+// them, and once they couldn't be retrieved for the fail-static window, scales the workload up to the fail-static minimum,
+// so an outage of the CI system doesn't leave too few agents once it recovers. The workload must be claimed, and the
+// scale up is held like any other while autoscaling is paused, during a rolling update or a maintenance window, or
+// once the rate limit is reached. Errors are only logged.
+func failStatic(err error, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	var unavailable backendError
+	if !errors.As(err, &unavailable) {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+
+	state := getState(deployment)
+	now := time.Now()
+	if state.BackendUnavailableSince.IsZero() {
+		state.BackendUnavailableSince = now
+		saveState(k8sClient, deployment, args)
+	}
+	unavailableFor := now.Sub(state.BackendUnavailableSince)
+	if !args.FailStatic.Enabled() || unavailableFor < args.FailStatic.After {
+		return
+	}
+
+	if err := claimWorkload(agentPoolID, k8sClient, deployment, args); err != nil {
+		workloadLogger.Warnf("Not scaling %s to the fail-static minimum of %d pods: %s", deployment.FriendlyName, args.FailStatic.Min, err.Error())
+		return
+	}
+	replicas, err := k8sClient.Sync().GetReplicas(deployment)
+	if err != nil {
+		workloadLogger.Errorf("Error retrieving the replicas of %s to keep the fail-static minimum: %s", deployment.FriendlyName, err.Error())
+		return
+	} else if replicas >= args.FailStatic.Min {
+		workloadLogger.Debugf("Holding %s at %d pods - the agents and jobs couldn't be retrieved for %s", deployment.FriendlyName, replicas, unavailableFor.String())
+		return
+	}
+	if reason, err := failStaticHold(state, k8sClient, deployment, args, now); err != nil {
+		workloadLogger.Errorf("Error checking if %s can be scaled to the fail-static minimum: %s", deployment.FriendlyName, err.Error())
+		return
+	} else if reason != "" {
+		workloadLogger.Infof("Not scaling %s from %d to the fail-static minimum of %d pods - %s", deployment.FriendlyName, replicas, args.FailStatic.Min, reason)
+		return
+	}
+
+	message := fmt.Sprintf("Scaled from %d to the fail-static minimum of %d replicas - the agents and jobs couldn't be retrieved for %s", replicas, args.FailStatic.Min, unavailableFor.Truncate(time.Second).String())
+	if args.DryRun {
+		workloadLogger.Infof("Dry run - would scale %s from %d to the fail-static minimum of %d pods", deployment.FriendlyName, replicas, args.FailStatic.Min)
+		return
+	}
+	if err := k8sClient.Sync().Scale(deployment, args.FailStatic.Min); err != nil {
+		workloadLogger.Errorf("Error scaling %s to the fail-static minimum of %d pods: %s", deployment.FriendlyName, args.FailStatic.Min, err.Error())
+		return
+	}
+	workloadLogger.Warn(message)
+	createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonFailStatic, message)
+	recordScale(deployment, ScaleDirectionUp, args.FailStatic.Min, args.RateLimit.Window)
+	saveState(k8sClient, deployment, args)
+}
+
+// failStaticHold returns why the fail-static scale up is held, with the same suppressors as DecideReplicas, or an empty
+// string if it isn't. The caller must hold statesMutex.
+func failStaticHold(state *State, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, now time.Time) (string, error) {
+	if state.Paused {
+		return "autoscaling is paused", nil
+	}
+	if args.HoldRollingUpdates {
+		update, err := k8sClient.Sync().GetRollingUpdate(deployment)
+		if err != nil {
+			return "", err
+		} else if update.InProgress() {
+			return fmt.Sprintf("a rolling update to revision %s is in progress", update.UpdateRevision), nil
+		}
+	}
+	if window := args.Maintenance.ActiveWindow(now); window != nil {
+		return fmt.Sprintf("in the maintenance window %s until %s", window.String(), args.Maintenance.ActiveUntil(now).Format(time.RFC3339)), nil
+	}
+	if args.RateLimit.MaxScales > 0 {
+		if recentScales := state.getScalesSince(now.Add(-args.RateLimit.Window)); int32(len(recentScales)) >= args.RateLimit.MaxScales {
+			return fmt.Sprintf("scaled %d times in the last %s, cannot scale until %s", len(recentScales), args.RateLimit.Window.String(), recentScales[0].Add(args.RateLimit.Window).String()), nil
+		}
+	}
+	return "", nil
+}
+
+// recordBackendAvailable records that the agents and jobs of the workload's pool were retrieved, which ends the
+// fail-static window. The caller must hold statesMutex.
+func recordBackendAvailable(agentPoolID int, deployment *kubernetes.Workload) {
+	state := getState(deployment)
+	if state.BackendUnavailableSince.IsZero() {
+		return
+	}
+	workloadLogger(agentPoolID, deployment).Infof("The agents and jobs were retrieved again after %s", time.Since(state.BackendUnavailableSince).Truncate(time.Second).String())
+	state.BackendUnavailableSince = time.Time{}
+	state.changed = true
+}
@@ -0,0 +1,125 @@
+package scaling
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonScaleUpLimitedByHealthGates = "ScaleUpLimitedByHealthGates"
+
+var (
+	healthGateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_health_gate_healthy",
+		Help: "1 if the health gate passed when it was last checked before a scale up, otherwise 0",
+	}, []string{"gate"})
+	healthGateLimitedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_health_gate_limited_count",
+		Help: "The total number of scale ups limited by a failing health gate",
+	}, metricLabelNames)
+)
+
+// registryProbeClient probes the registry of the agent image. The probe only needs a response, so it doesn't follow redirects.
+var registryProbeClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// lastHealthGateEvents are the failing health gates that last limited the scale up of each workload, so an event is
+// only created when they change
+var lastHealthGateEvents = make(map[string]string)
+
+// checkHealthGates returns why each failing health gate failed, in the order of the gates. An error checking a gate
+// fails it, as the cluster components it checks are what the error usually comes from.
+func checkHealthGates(k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, gateArgs args.HealthGateArgs) []string {
+	var failures []string
+	for _, gate := range gateArgs.Gates {
+		var failure string
+		switch gate {
+		case args.HealthGateNodes:
+			failure = checkNodesGate(k8sClient, gateArgs.NodeReadyRatio)
+		case args.HealthGateMetricsServer:
+			if err := k8sClient.Sync().VerifyAPIAvailable(kubernetes.MetricsAPIGroupVersion); err != nil {
+				failure = fmt.Sprintf("the metrics-server isn't available: %s", err.Error())
+			}
+		case args.HealthGateRegistry:
+			failure = checkRegistryGate(deployment, gateArgs.RegistryURL)
+		}
+		if failure == "" {
+			healthGateGauge.WithLabelValues(gate).Set(1)
+		} else {
+			healthGateGauge.WithLabelValues(gate).Set(0)
+			failures = append(failures, failure)
+		}
+	}
+	return failures
+}
+
+// checkNodesGate returns why the nodes gate failed, or an empty string if enough of the nodes are Ready
+func checkNodesGate(k8sClient kubernetes.ClientAsync, readyRatio float64) string {
+	nodes, err := k8sClient.Sync().GetNodes()
+	if err != nil {
+		return fmt.Sprintf("the nodes couldn't be listed: %s", err.Error())
+	}
+	ready, total := kubernetes.CountReadyNodes(nodes)
+	if total > 0 && float64(ready) < readyRatio*float64(total) {
+		return fmt.Sprintf("only %d of %d nodes are Ready", ready, total)
+	}
+	return ""
+}
+
+// checkRegistryGate returns why the registry gate failed, or an empty string if the registry responded. Any response
+// but a server error passes, as the registries require authentication and respond 401 without it.
+func checkRegistryGate(deployment *kubernetes.Workload, registryURL string) string {
+	if registryURL == "" {
+		containers := deployment.PodTemplateSpec.Spec.Containers
+		if len(containers) == 0 {
+			return ""
+		}
+		registryURL = fmt.Sprintf("https://%s/v2/", kubernetes.ImageRegistry(containers[0].Image))
+	}
+	response, err := registryProbeClient.Get(registryURL)
+	if err != nil {
+		// The URL is already in the failure
+		if urlErr, isURLErr := err.(*url.Error); isURLErr {
+			err = urlErr.Err
+		}
+		return fmt.Sprintf("the registry %s isn't reachable: %s", registryURL, err.Error())
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= 500 {
+		return fmt.Sprintf("the registry %s responded %s", registryURL, response.Status)
+	}
+	return ""
+}
+
+// createHealthGateEvent creates a warning event when failing health gates limited a scale up
+func createHealthGateEvent(decision *Decision, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	key := stateKey(deployment)
+	if len(decision.UnhealthyGates) == 0 {
+		delete(lastHealthGateEvents, key)
+		return
+	}
+	failures := strings.Join(decision.UnhealthyGates, ", ")
+	if lastHealthGateEvents[key] == failures {
+		return
+	}
+	lastHealthGateEvents[key] = failures
+
+	message := fmt.Sprintf("Limited the scale up to %d replicas - %s", decision.DesiredReplicas, failures)
+	createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonScaleUpLimitedByHealthGates, message)
+}
@@ -0,0 +1,51 @@
+package scaling
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/store"
+)
+
+// historyKey is the key of the decision history in its store
+const historyKey = "history.json"
+
+// LoadHistory restores the decision history from a store. If nothing was persisted yet, nothing is loaded.
+func LoadHistory(historyStore store.Store) error {
+	data, err := historyStore.Load()
+	if err != nil {
+		return fmt.Errorf("Error loading the decision history from %s: %w", historyStore.Name(), err)
+	}
+	value, exists := data[historyKey]
+	if !exists {
+		return nil
+	}
+	var history []health.WorkloadHistory
+	if err := json.Unmarshal([]byte(value), &history); err != nil {
+		logger.Warnf("Ignoring the invalid decision history in %s: %s", historyStore.Name(), err.Error())
+		return nil
+	}
+	logger.Debugf("Loaded the decision history of %d workloads from %s", len(history), historyStore.Name())
+	health.RestoreHistory(history)
+	return nil
+}
+
+// SaveHistory persists the decision history to a store
+func SaveHistory(historyStore store.Store) error {
+	value, err := json.Marshal(health.GetHistory())
+	if err != nil {
+		return err
+	}
+	if err := historyStore.Save(map[string]string{historyKey: string(value)}); err != nil {
+		return fmt.Errorf("Error saving the decision history to %s: %w", historyStore.Name(), err)
+	}
+	return nil
+}
+
+// HistoryStore returns the store of the decision history of the args
+func HistoryStore(k8sClient kubernetes.Client, historyArgs args.Args) store.Store {
+	return store.New(historyArgs.Store, k8sClient, historyArgs.History.Namespace, historyArgs.History.ConfigMapName)
+}
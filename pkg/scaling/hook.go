@@ -0,0 +1,159 @@
+package scaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/notify"
+)
+
+var decisionHookCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "azp_agent_autoscaler_decision_hook_count",
+	Help: "The total number of scaling decisions reviewed by the decision hook, by result: allowed, vetoed, adjusted or failed",
+}, append(metricLabelNames, "result"))
+
+// DecisionReview is the response of a decision hook to a scaling decision
+type DecisionReview struct {
+	// Allowed is false to veto the scaling decision, so the workload isn't scaled
+	Allowed bool `json:"allowed"`
+	// DesiredReplicas adjusts the replicas the workload is scaled to, if it's set
+	DesiredReplicas *int32 `json:"desiredReplicas,omitempty"`
+	// Reason is why the scaling decision was vetoed or adjusted
+	Reason string `json:"reason,omitempty"`
+}
+
+// DecisionHook reviews the scaling decisions before they're applied, so rules specific to an organization can veto or
+// adjust them without changing the autoscaler, ex: to keep agents during a release freeze
+type DecisionHook interface {
+	Review(record DecisionRecord) (DecisionReview, error)
+}
+
+// WebhookDecisionHook POSTs the scaling decisions as a DecisionRecord JSON to a URL, which responds with a DecisionReview JSON
+type WebhookDecisionHook struct {
+	URL string
+	// Secret signs the body like the webhook notifications, if it is not empty
+	Secret     string
+	HTTPClient *http.Client
+}
+
+// NewWebhookDecisionHook creates a WebhookDecisionHook
+func NewWebhookDecisionHook(url string, secret string, timeout time.Duration) WebhookDecisionHook {
+	return WebhookDecisionHook{
+		URL:        url,
+		Secret:     secret,
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Review POSTs the scaling decision and returns the review of the response
+func (h WebhookDecisionHook) Review(record DecisionRecord) (DecisionReview, error) {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return DecisionReview{}, err
+	}
+	request, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return DecisionReview{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "go-azp-agent-autoscaler")
+	if h.Secret != "" {
+		request.Header.Set(notify.SignatureHeader, "sha256="+notify.Sign(body, h.Secret))
+	}
+
+	response, err := h.HTTPClient.Do(request)
+	if urlErr, isURLErr := err.(*url.Error); isURLErr {
+		// Don't include the URL in the error, as it can contain a token
+		return DecisionReview{}, fmt.Errorf("%s %s: %s", urlErr.Op, request.URL.Host, urlErr.Err.Error())
+	} else if err != nil {
+		return DecisionReview{}, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return DecisionReview{}, err
+	} else if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return DecisionReview{}, fmt.Errorf("POST %s returned status %d", request.URL.Host, response.StatusCode)
+	}
+	review := DecisionReview{}
+	if err := json.Unmarshal(responseBody, &review); err != nil {
+		return DecisionReview{}, fmt.Errorf("Error parsing the response of %s: %w", request.URL.Host, err)
+	}
+	return review, nil
+}
+
+var (
+	decisionHookMutex sync.RWMutex
+	decisionHook      DecisionHook
+)
+
+// SetDecisionHook sets the hook that reviews the scaling decisions, or disables it if it's nil
+func SetDecisionHook(hook DecisionHook) {
+	decisionHookMutex.Lock()
+	defer decisionHookMutex.Unlock()
+	decisionHook = hook
+}
+
+func getDecisionHook() DecisionHook {
+	decisionHookMutex.RLock()
+	defer decisionHookMutex.RUnlock()
+	return decisionHook
+}
+
+// reviewDecision has the decision hook review a decision that scales the workload, and applies its veto or adjustment.
+// An adjustment is limited to the maximum, and isn't allowed to remove the active agents. If the hook fails, the decision
+// is applied with the ignore failure policy, and an error is returned with the fail failure policy.
+func reviewDecision(decision *Decision, snapshot Snapshot, args args.Args) error {
+	hook := getDecisionHook()
+	if hook == nil || !decision.IsScaling() {
+		return nil
+	}
+	agentPoolID, deployment := snapshot.AgentPoolID, snapshot.Workload
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+	labels := metricLabels(agentPoolID, deployment)
+
+	review, err := hook.Review(NewDecisionRecord(decision, agentPoolID, deployment, args, nil))
+	if err != nil {
+		labels["result"] = "failed"
+		decisionHookCounter.With(labels).Inc()
+		if args.DecisionHook.IsFail() {
+			return fmt.Errorf("Error reviewing the scaling of %s with the decision hook: %w", deployment.FriendlyName, err)
+		}
+		workloadLogger.Warnf("Error reviewing the scaling of %s with the decision hook, scaling as if it was allowed: %s", deployment.FriendlyName, err.Error())
+		return nil
+	}
+
+	reason := "the decision hook"
+	if review.Reason != "" {
+		reason = fmt.Sprintf("the decision hook: %s", review.Reason)
+	}
+	if !review.Allowed {
+		labels["result"] = "vetoed"
+		workloadLogger.Infof("Not scaling %s from %d to %d pods - vetoed by %s", deployment.FriendlyName, decision.NumPods, decision.DesiredReplicas, reason)
+		decision.limit(SuppressorDecisionHook, decision.DesiredReplicas, decision.NumPods)
+		decision.DesiredReplicas = decision.NumPods
+		decision.Reason = "vetoed by " + reason
+	} else if review.DesiredReplicas != nil && *review.DesiredReplicas != decision.DesiredReplicas {
+		labels["result"] = "adjusted"
+		adjusted := math.MaxInt32(decision.NumActiveAgents, math.MinInt32(args.Max, *review.DesiredReplicas))
+		workloadLogger.Infof("Scaling %s to %d instead of %d pods - adjusted by %s", deployment.FriendlyName, adjusted, decision.DesiredReplicas, reason)
+		decision.limit(SuppressorDecisionHook, decision.DesiredReplicas, adjusted)
+		decision.DesiredReplicas = adjusted
+		decision.Reason = "adjusted by " + reason
+	} else {
+		labels["result"] = "allowed"
+	}
+	decisionHookCounter.With(labels).Inc()
+	return nil
+}
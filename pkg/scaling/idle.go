@@ -0,0 +1,99 @@
+package scaling
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+)
+
+var (
+	agentIdleGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_agent_idle_seconds",
+		Help: "How long an idle agent has been idle, since its last job finished or its pod started",
+	}, append(metricLabelNames, "agent"))
+
+	// idleAgentsReported are the agents whose idle time was reported by the workload's metric labels, so the agents that
+	// are no longer idle are removed from the metric
+	idleAgentsReported      = make(map[string]collections.StringSet)
+	idleAgentsReportedMutex sync.Mutex
+)
+
+// getAgentIdleTimes returns how long the online agents of the pods that aren't active have been idle by pod name.
+// An agent is idle since its last job finished, or since its pod started if it's later, ex: when the pod of an agent
+// was recreated. The agents whose last job and pod start time aren't known aren't returned.
+func getAgentIdleTimes(agents []ci.Agent, pods []corev1.Pod, activeAgentPodNames collections.StringSet, now time.Time) map[string]time.Duration {
+	podStartTimes := make(map[string]time.Time, len(pods))
+	for _, pod := range pods {
+		podStartTimes[pod.Name] = time.Time{}
+		if pod.Status.StartTime != nil {
+			podStartTimes[pod.Name] = pod.Status.StartTime.Time
+		}
+	}
+	idleTimes := make(map[string]time.Duration)
+	for _, agent := range agents {
+		podStartTime, isPod := podStartTimes[agent.PodName]
+		if !isPod || !agent.Online || agent.Busy || activeAgentPodNames.Contains(agent.PodName) {
+			continue
+		}
+		idleSince := agent.LastJobFinished
+		if podStartTime.After(idleSince) {
+			idleSince = podStartTime
+		}
+		if idleSince.IsZero() {
+			continue
+		}
+		if idleTime := now.Sub(idleSince); idleTime > 0 {
+			idleTimes[agent.PodName] = idleTime
+		} else {
+			idleTimes[agent.PodName] = 0
+		}
+	}
+	return idleTimes
+}
+
+// getRecentlyActiveAgentPodNames returns the pods of the agents that have been idle for less than the idle delay
+func getRecentlyActiveAgentPodNames(idleTimes map[string]time.Duration, idleDelay time.Duration) collections.StringSet {
+	recentlyActiveAgentPodNames := make(collections.StringSet)
+	if idleDelay <= 0 {
+		return recentlyActiveAgentPodNames
+	}
+	for podName, idleTime := range idleTimes {
+		if idleTime < idleDelay {
+			recentlyActiveAgentPodNames.Add(podName)
+		}
+	}
+	return recentlyActiveAgentPodNames
+}
+
+// recordAgentIdleTimes sets the idle time metric of the idle agents of a workload, and removes the agents that aren't idle
+func recordAgentIdleTimes(labels prometheus.Labels, idleTimes map[string]time.Duration) {
+	idleAgentsReportedMutex.Lock()
+	defer idleAgentsReportedMutex.Unlock()
+
+	key := labels["pool"] + "/" + labels["namespace"] + "/" + labels["workload"]
+	reported := make(collections.StringSet)
+	for podName, idleTime := range idleTimes {
+		agentIdleGauge.With(agentLabels(labels, podName)).Set(idleTime.Seconds())
+		reported.Add(podName)
+	}
+	for podName := range idleAgentsReported[key] {
+		if !reported.Contains(podName) {
+			agentIdleGauge.Delete(agentLabels(labels, podName))
+		}
+	}
+	idleAgentsReported[key] = reported
+}
+
+func agentLabels(labels prometheus.Labels, podName string) prometheus.Labels {
+	agentLabels := prometheus.Labels{"agent": podName}
+	for name, value := range labels {
+		agentLabels[name] = value
+	}
+	return agentLabels
+}
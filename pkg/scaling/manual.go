@@ -0,0 +1,105 @@
+package scaling
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+)
+
+const (
+	eventReasonManualScaleAdopted  = "ManualScaleAdopted"
+	eventReasonManualScaleReverted = "ManualScaleReverted"
+)
+
+var manualScaleCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "azp_agent_autoscaler_manual_scale_count",
+	Help: "The total number of times the workload was scaled outside of the autoscaler",
+}, metricLabelNames)
+
+// detectManualScale compares the replicas of the workload to the replicas the autoscaler last scaled it to, to find when
+// it was scaled outside of the autoscaler, ex: with kubectl scale. With the revert policy, it returns the replicas to
+// scale the workload back to. With the adopt policy, the manual scale is kept in the state for the manual scale duration.
+// The caller must hold statesMutex.
+func detectManualScale(agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) (*int32, error) {
+	if !args.ManualScale.IsAdopt() && !args.ManualScale.IsRevert() {
+		return nil, nil
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	replicas, err := k8sClient.Sync().GetReplicas(deployment)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving the replicas of %s: %w", deployment.FriendlyName, err)
+	}
+	state := getState(deployment)
+	if state.LastReplicas == nil {
+		state.LastReplicas = &replicas
+		state.changed = true
+		return nil, nil
+	} else if *state.LastReplicas == replicas {
+		return nil, nil
+	}
+	lastReplicas := *state.LastReplicas
+	manualScaleCounter.With(metricLabels(agentPoolID, deployment)).Inc()
+
+	if args.ManualScale.IsRevert() {
+		message := fmt.Sprintf("Reverting the manual scale from %d to %d replicas", lastReplicas, replicas)
+		workloadLogger.Warnf("%s was scaled outside of the autoscaler - %s", deployment.FriendlyName, message)
+		createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonManualScaleReverted, message)
+		return &lastReplicas, nil
+	}
+
+	state.ManualReplicas = &replicas
+	state.ManualScaleUntil = time.Now().Add(args.ManualScale.Duration)
+	limit := "minimum"
+	state.ManualScaleDirection = ScaleDirectionUp
+	if replicas < lastReplicas {
+		limit = "maximum"
+		state.ManualScaleDirection = ScaleDirectionDown
+	}
+	message := fmt.Sprintf("Keeping the manual scale from %d to %d replicas as the %s until %s", lastReplicas, replicas, limit, state.ManualScaleUntil.Format(time.RFC3339))
+	workloadLogger.Infof("%s was scaled outside of the autoscaler - %s", deployment.FriendlyName, message)
+	createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, eventReasonManualScaleAdopted, message)
+	state.LastReplicas = &replicas
+	state.changed = true
+	return nil, nil
+}
+
+// expireManualScale forgets an adopted manual scale after the manual scale duration. The caller must hold statesMutex.
+func expireManualScale(agentPoolID int, deployment *kubernetes.Workload, now time.Time) {
+	state := getState(deployment)
+	if state.ManualReplicas != nil && !now.Before(state.ManualScaleUntil) {
+		workloadLogger(agentPoolID, deployment).Infof("The manual scale of %s to %d replicas expired", deployment.FriendlyName, *state.ManualReplicas)
+		state.ManualReplicas = nil
+		state.ManualScaleDirection = ""
+		state.changed = true
+	}
+}
+
+// limitToManualScale limits the replicas to scale to by an adopted manual scale, as the minimum after a manual scale up
+// or the maximum after a manual scale down
+func limitToManualScale(decision *Decision, snapshot Snapshot, podsToScaleTo int32) int32 {
+	state := snapshot.State
+	if state.ManualReplicas == nil || !snapshot.Time.Before(state.ManualScaleUntil) {
+		return podsToScaleTo
+	}
+
+	limited := podsToScaleTo
+	if state.ManualScaleDirection == ScaleDirectionUp {
+		limited = math.MaxInt32(podsToScaleTo, *state.ManualReplicas)
+	} else {
+		limited = math.MinInt32(podsToScaleTo, *state.ManualReplicas)
+	}
+	if limited != podsToScaleTo {
+		workloadLogger(snapshot.AgentPoolID, snapshot.Workload).Debugf("Limiting the scale from %d to %d pods by the manual scale until %s", podsToScaleTo, limited, state.ManualScaleUntil.String())
+		decision.Reason = fmt.Sprintf("manually scaled to %d replicas until %s", *state.ManualReplicas, state.ManualScaleUntil.String())
+		decision.limit(SuppressorManualScale, podsToScaleTo, limited)
+	}
+	return limited
+}
@@ -0,0 +1,41 @@
+package scaling
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/aks"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonNodePoolScaledUp = "NodePoolScaledUp"
+
+var nodePoolScaleUpCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "azp_agent_autoscaler_node_pool_scale_up_count",
+	Help: "The total number of AKS node pool scale ups for unschedulable agent pods",
+}, []string{"node_pool"})
+
+// scaleUpNodePool scales up the AKS node pool when agent pods are unschedulable, if enabled.
+// Errors are only logged, as the agents are scaled regardless.
+func scaleUpNodePool(decision *Decision, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if decision.NumUnschedulablePods == 0 {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	scaleUp, err := aks.ScaleUpNodePool(decision.NumUnschedulablePods, args.DryRun)
+	if err != nil {
+		workloadLogger.Warnf("Error scaling up the node pool for %d unschedulable pods: %s", decision.NumUnschedulablePods, err.Error())
+		return
+	} else if scaleUp == nil || args.DryRun {
+		return
+	}
+	message := fmt.Sprintf("Scaled node pool %s from %d to %d nodes for %d unschedulable pods", scaleUp.NodePool, scaleUp.FromNodes, scaleUp.ToNodes, decision.NumUnschedulablePods)
+	workloadLogger.Info(message)
+	nodePoolScaleUpCounter.With(prometheus.Labels{"node_pool": scaleUp.NodePool}).Inc()
+	createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, eventReasonNodePoolScaledUp, message)
+}
@@ -0,0 +1,108 @@
+package scaling
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonOfflineAgentReplaced = "OfflineAgentReplaced"
+
+// offlineAgentsRateLimitWindow is the window of the offline agent rate limit
+const offlineAgentsRateLimitWindow = time.Hour
+
+var offlineAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "azp_agent_autoscaler_offline_agents_count",
+	Help: "The number of agents reported as offline while their pod is running",
+}, metricLabelNames)
+
+// offlineSince is when the agent of each running pod was first seen offline, by workload state key and pod name.
+// It is guarded by statesMutex.
+var offlineSince = make(map[string]map[string]time.Time)
+
+// replaceOfflineAgents deletes the running pods of agents that the CI system reported as offline for the offline agent
+// timeout, so the workload recreates them with a fresh agent instead of its capacity silently shrinking. The timeout
+// starts when the agent is first seen offline or when its pod started, whichever is later, so starting agents aren't
+// replaced. No more pods are deleted once the rate limit is reached. Errors are only logged.
+func replaceOfflineAgents(observed observation, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	now := time.Now()
+	pods := make(map[string]*corev1.Pod)
+	for i := range observed.Pods {
+		if pod := &observed.Pods[i]; pod.DeletionTimestamp == nil && pod.Status.Phase == corev1.PodRunning {
+			pods[pod.Name] = pod
+		}
+	}
+	// The pod of an online agent can also have the offline agent registered by a previous pod with the same name
+	onlinePodNames := make(map[string]bool)
+	for _, agent := range observed.Agents {
+		if agent.Online {
+			onlinePodNames[agent.PodName] = true
+		}
+	}
+
+	key := stateKey(deployment)
+	lastOfflineSince := offlineSince[key]
+	currentOfflineSince := make(map[string]time.Time)
+	var offlineAgents []ci.Agent
+	for _, agent := range observed.Agents {
+		if _, exists := pods[agent.PodName]; !exists || onlinePodNames[agent.PodName] {
+			continue
+		}
+		since, seen := lastOfflineSince[agent.PodName]
+		if !seen {
+			since = now
+		}
+		currentOfflineSince[agent.PodName] = since
+		offlineAgents = append(offlineAgents, agent)
+	}
+	offlineSince[key] = currentOfflineSince
+	offlineAgentsGauge.With(metricLabels(agentPoolID, deployment)).Set(float64(len(offlineAgents)))
+	if args.OfflineAgents.Timeout <= 0 {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	state := getState(deployment)
+	for i, agent := range offlineAgents {
+		pod := *pods[agent.PodName]
+		since := currentOfflineSince[agent.PodName]
+		if podStartTime := podStartTime(pod); podStartTime.After(since) {
+			since = podStartTime
+		}
+		offlineFor := now.Sub(since)
+		if offlineFor < args.OfflineAgents.Timeout {
+			continue
+		}
+
+		recentReplacements := timesAfter(state.RecentOfflineReplacements, now.Add(-offlineAgentsRateLimitWindow))
+		if int32(len(recentReplacements)) >= args.OfflineAgents.RateLimit {
+			workloadLogger.Warnf("Not replacing up to %d offline agents, the rate limit of %d per hour was reached", len(offlineAgents)-i, args.OfflineAgents.RateLimit)
+			return
+		}
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would delete pod %s of agent %s, which has been offline for %s", pod.Name, agent.Name, offlineFor.Round(time.Second).String())
+			continue
+		}
+		if err := k8sClient.Sync().DeletePod(pod); err != nil {
+			workloadLogger.Warnf("Error deleting pod %s of offline agent %s: %s", pod.Name, agent.Name, err.Error())
+			continue
+		}
+		state.RecentOfflineReplacements = append(recentReplacements, now)
+		state.changed = true
+		delete(currentOfflineSince, agent.PodName)
+
+		message := fmt.Sprintf("Deleted pod %s of agent %s, which has been offline for %s", pod.Name, agent.Name, offlineFor.Round(time.Second).String())
+		workloadLogger.Warn(message)
+		labels := metricLabels(agentPoolID, deployment)
+		labels["reason"] = string(recycleReasonOffline)
+		recycledPodsCounter.With(labels).Inc()
+		createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonOfflineAgentReplaced, message)
+	}
+}
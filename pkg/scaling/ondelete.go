@@ -0,0 +1,33 @@
+package scaling
+
+import (
+	"fmt"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// describeRollout describes how an update of the pod template is rolled out to the pods of a workload. A StatefulSet with
+// the OnDelete update strategy only updates the pods that are deleted, so its outdated pods are kept until they're
+// recycled, and a scale down removes the pods with the highest ordinals whether they're updated or not.
+func describeRollout(update *kubernetes.RollingUpdate, args args.Args) string {
+	if update == nil {
+		return ""
+	}
+	progress := fmt.Sprintf("%d of %d pods are updated to revision %s", update.UpdatedReplicas, update.Replicas, update.UpdateRevision)
+	if !update.OnDelete {
+		if args.HoldRollingUpdates {
+			return fmt.Sprintf("rolling update, %s - scaling is held until it's rolled out", progress)
+		}
+		return fmt.Sprintf("rolling update, %s", progress)
+	} else if args.Recycle.OutdatedPods {
+		return fmt.Sprintf("OnDelete update, %s - the outdated pods are recycled when their agent is idle", progress)
+	}
+	return fmt.Sprintf("OnDelete update, %s - the outdated pods are only updated when they're deleted", progress)
+}
+
+// isKeptPod returns true if a pod of a StatefulSet is kept when it's scaled to the given replicas
+func isKeptPod(podName string, statefulSetName string, replicas int32) bool {
+	ordinal, isPod := statefulSetOrdinal(podName, statefulSetName)
+	return isPod && ordinal < replicas
+}
@@ -0,0 +1,81 @@
+package scaling
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonTerminatingPodForceDeleted = "TerminatingPodForceDeleted"
+
+var (
+	missingOrdinalsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_missing_ordinals_count",
+		Help: "The number of ordinals of a StatefulSet below its replicas that don't have a pod, or whose pod is terminating",
+	}, metricLabelNames)
+	forceDeletedPodsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_force_deleted_pods_count",
+		Help: "The total number of pods force deleted after they were stuck terminating",
+	}, metricLabelNames)
+)
+
+// checksOrdinalGaps returns true if the ordinal gaps of the workload are detected, which only StatefulSets have
+func checksOrdinalGaps(deployment *kubernetes.Workload, ordinalGapsArgs args.OrdinalGapsArgs) bool {
+	return ordinalGapsArgs.Enabled && strings.EqualFold(deployment.Kind, "StatefulSet")
+}
+
+// getNumMissingOrdinals returns the number of ordinals of a StatefulSet below its replicas that don't have a pod that
+// isn't terminating. The StatefulSet controller recreates them, but its agents can't take jobs until then, and a pod
+// stuck terminating, ex: on an unreachable node, keeps its ordinal missing.
+func getNumMissingOrdinals(pods []corev1.Pod, statefulSetName string, replicas int32) int32 {
+	present := make(map[int32]bool)
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		if ordinal, isPod := statefulSetOrdinal(pod.Name, statefulSetName); isPod && ordinal < replicas {
+			present[ordinal] = true
+		}
+	}
+	return replicas - int32(len(present))
+}
+
+// forceDeleteTerminatingPods force deletes the pods of a StatefulSet that are still terminating the force delete timeout
+// after their grace period ended, so the StatefulSet controller recreates their ordinal. The deletion timestamp of a
+// pod is when its grace period ends. Errors are only logged.
+func forceDeleteTerminatingPods(observed observation, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if !checksOrdinalGaps(deployment, args.OrdinalGaps) || args.OrdinalGaps.ForceDeleteAfter <= 0 {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+	now := time.Now()
+	for _, pod := range observed.Pods {
+		if pod.DeletionTimestamp == nil {
+			continue
+		}
+		stuckFor := now.Sub(pod.DeletionTimestamp.Time)
+		if stuckFor < args.OrdinalGaps.ForceDeleteAfter {
+			continue
+		}
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would force delete pod %s, which has been terminating for %s after its grace period", pod.Name, stuckFor.Round(time.Second).String())
+			continue
+		}
+		if err := k8sClient.Sync().ForceDeletePod(pod); err != nil {
+			workloadLogger.Warnf("Error force deleting pod %s, which is stuck terminating: %s", pod.Name, err.Error())
+			continue
+		}
+
+		message := fmt.Sprintf("Force deleted pod %s, which has been terminating for %s after its grace period", pod.Name, stuckFor.Round(time.Second).String())
+		workloadLogger.Warn(message)
+		forceDeletedPodsCounter.With(metricLabels(agentPoolID, deployment)).Inc()
+		createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonTerminatingPodForceDeleted, message)
+	}
+}
@@ -0,0 +1,90 @@
+package scaling
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonWorkloadClaimed = "WorkloadClaimed"
+
+var workloadClaimedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "azp_agent_autoscaler_workload_claimed",
+	Help: "1 if the agent workload isn't autoscaled because another autoscaler claimed it, 0 otherwise",
+}, metricLabelNames)
+
+// ErrWorkloadClaimed matches the errors of a workload claimed by another autoscaler, with errors.Is
+var ErrWorkloadClaimed = errors.New("The workload is claimed by another autoscaler")
+
+// ClaimedError is returned when a workload isn't autoscaled because another autoscaler's claim on it hasn't expired
+type ClaimedError struct {
+	// Workload is the friendly name of the workload
+	Workload  string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func (e ClaimedError) Error() string {
+	return fmt.Sprintf("Not autoscaling %s - it's claimed by %s until %s", e.Workload, e.Owner, e.ExpiresAt.Format(time.RFC3339))
+}
+
+// Is matches ErrWorkloadClaimed
+func (e ClaimedError) Is(target error) bool {
+	return target == ErrWorkloadClaimed
+}
+
+// lastClaimedEvents are the owners that last claimed each workload, so an event is only created when the owner changes
+var lastClaimedEvents = make(map[string]string)
+
+// claimWorkload claims the agent workload with the owner annotations if ownership is enabled, and returns an error if
+// another autoscaler has a claim on it that hasn't expired, so two autoscalers don't oscillate its replicas. The claim is
+// renewed when a third of the lease has passed. The caller must hold statesMutex.
+func claimWorkload(agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) error {
+	if !args.Ownership.Enabled {
+		return nil
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+	key := stateKey(deployment)
+	labels := metricLabels(agentPoolID, deployment)
+
+	// The workload is retrieved again, as its annotations may have changed since it was validated
+	workloadArgs := args.Kubernetes
+	workloadArgs.Type, workloadArgs.Name, workloadArgs.Namespace = deployment.Kind, deployment.Name, deployment.Namespace
+	workload, err := k8sClient.Sync().GetWorkload(workloadArgs)
+	if err != nil {
+		return fmt.Errorf("Error retrieving the owner of %s: %w", deployment.FriendlyName, err)
+	}
+
+	now := time.Now()
+	claim := kubernetes.GetClaim(workload)
+	if claim != nil && claim.Owner != args.Ownership.Owner {
+		if expiresAt := claim.ExpiresAt(args.Ownership.Lease); now.Before(expiresAt) {
+			workloadClaimedGauge.With(labels).Set(1)
+			err := ClaimedError{Workload: deployment.FriendlyName, Owner: claim.Owner, ExpiresAt: expiresAt}
+			if lastClaimedEvents[key] != claim.Owner {
+				lastClaimedEvents[key] = claim.Owner
+				createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonWorkloadClaimed, err.Error())
+			}
+			return err
+		}
+		workloadLogger.Infof("Taking over %s from %s, whose claim expired at %s", deployment.FriendlyName, claim.Owner, claim.ExpiresAt(args.Ownership.Lease).Format(time.RFC3339))
+	}
+	workloadClaimedGauge.With(labels).Set(0)
+	delete(lastClaimedEvents, key)
+
+	if args.DryRun || (claim != nil && claim.Owner == args.Ownership.Owner && now.Sub(claim.RenewTime) < args.Ownership.Lease/3) {
+		return nil
+	}
+	// A conflict means another autoscaler annotated the workload first, so its claim is checked in the next iteration
+	if err := k8sClient.Sync().AnnotateWorkload(workload, kubernetes.ClaimAnnotations(args.Ownership.Owner, now)); err != nil {
+		return fmt.Errorf("Error claiming %s: %w", deployment.FriendlyName, err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package scaling
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/tracing"
+)
+
+// Target is a workload to autoscale and the agent pool its agents are registered to
+type Target struct {
+	Workload    *kubernetes.Workload
+	AgentPoolID int
+	Priority    int32
+
+	// Args overrides the arguments the workload is autoscaled with, ex: from an AzpAgentAutoscaler resource
+	Args *args.Args
+
+	// Organization is the URL of the additional Azure Devops organization of the agent pool, or empty for the main one.
+	// The agent pool IDs are only unique within an organization.
+	Organization string
+	// Backend overrides the CI backend of the agent pool, ex: for an additional Azure Devops organization
+	Backend ci.Backend
+}
+
+// poolKey identifies an agent pool across the organizations
+type poolKey struct {
+	Organization string
+	AgentPoolID  int
+}
+
+// pool returns the key of the target's agent pool
+func (t Target) pool() poolKey {
+	return poolKey{Organization: t.Organization, AgentPoolID: t.AgentPoolID}
+}
+
+// ArgsOr returns the target's arguments, or the given arguments if it doesn't have its own
+func (t Target) ArgsOr(args args.Args) args.Args {
+	if t.Args != nil {
+		return *t.Args
+	}
+	return args
+}
+
+// BackendOr returns the target's backend, or the given backend if it doesn't have its own
+func (t Target) BackendOr(backend ci.Backend) ci.Backend {
+	if t.Backend != nil {
+		return t.Backend
+	}
+	return backend
+}
+
+// AutoscaleTargets autoscales every workload in order of priority, and returns the decisions that were made.
+// When a workload's scale up is limited by the cluster capacity, lower priority workloads
+// aren't scaled up and are scaled down to their active agents, so the capacity goes to the higher priority workload.
+// The workloads with the same priority are autoscaled concurrently, up to the concurrency argument, but the workloads of
+// an agent pool are autoscaled one at a time in order, as they share its state. A workload that fails doesn't stop the
+// others from being autoscaled, and the first error in order of priority is returned.
+// If a workload's decision couldn't be made, there is no record of it, and if it couldn't be applied, its record has the error.
+func AutoscaleTargets(backend ci.Backend, k8sClient kubernetes.ClientAsync, targets []Target, args args.Args) ([]DecisionRecord, error) {
+	span := startCycle()
+	defer span.End()
+
+	var records []DecisionRecord
+	var firstErr error
+	constrained := false
+	for _, priorityTargets := range groupByPriority(sortTargets(targets, args)) {
+		// Workloads with the same priority don't constrain each other
+		if constrained {
+			logger.Debugf("The workloads with priority %d are constrained by a higher priority workload", priorityTargets[0].Priority)
+		}
+		decisions, errs := autoscaleConcurrently(backend, k8sClient, priorityTargets, args, constrained, span)
+
+		for i, target := range priorityTargets {
+			targetArgs := target.ArgsOr(args)
+			if decisions[i] != nil {
+				records = append(records, NewDecisionRecord(decisions[i], target.AgentPoolID, target.Workload, targetArgs, errs[i]))
+			}
+			if errs[i] != nil {
+				span.SetError(errs[i])
+				workloadLogger(target.AgentPoolID, target.Workload).Errorf("Error autoscaling %s: %s", target.Workload.FriendlyName, errs[i].Error())
+				// The error isn't wrapped, so Retry-After can still be read from Azure Devops errors
+				if firstErr == nil {
+					firstErr = errs[i]
+				}
+				continue
+			}
+			if decisions[i].HasSuppressor(SuppressorCapacity) {
+				constrained = true
+			}
+		}
+	}
+	return records, firstErr
+}
+
+// autoscaleConcurrently autoscales workloads of the same priority with at most the concurrency argument at once, and
+// returns their decisions and errors by index. The workloads of an agent pool are autoscaled one at a time in order,
+// from a single snapshot of its agents and jobs.
+func autoscaleConcurrently(backend ci.Backend, k8sClient kubernetes.ClientAsync, targets []Target, args args.Args, constrained bool, span *tracing.Span) ([]*Decision, []error) {
+	decisions := make([]*Decision, len(targets))
+	errs := make([]error, len(targets))
+
+	// The indexes of the targets of each agent pool, in order
+	var pools [][]int
+	poolIndexes := make(map[poolKey]int)
+	for i, target := range targets {
+		poolIndex, exists := poolIndexes[target.pool()]
+		if !exists {
+			poolIndex = len(pools)
+			poolIndexes[target.pool()] = poolIndex
+			pools = append(pools, nil)
+		}
+		pools[poolIndex] = append(pools[poolIndex], i)
+	}
+
+	workers := make(chan struct{}, math.MaxInt32(1, args.Concurrency))
+	var wg sync.WaitGroup
+	for _, indexes := range pools {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(indexes []int) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			// Once the retry budget is exhausted, the remaining pools aren't autoscaled until it frees up
+			if err := health.CheckRetryBudget(); err != nil {
+				for _, i := range indexes {
+					errs[i] = err
+					recordFailure(targets[i].AgentPoolID, targets[i].Workload, targets[i].ArgsOr(args), err)
+				}
+				return
+			}
+			// The agents and jobs of the pool are retrieved once for all of its workloads
+			poolBackend := targets[indexes[0]].BackendOr(backend)
+			snapshot, err := fetchSnapshot(poolBackend, targets[indexes[0]].AgentPoolID, args.Rate, span)
+			for _, i := range indexes {
+				if err != nil {
+					errs[i] = err
+					failStatic(err, targets[i].AgentPoolID, k8sClient, targets[i].Workload, targets[i].ArgsOr(args))
+					recordFailure(targets[i].AgentPoolID, targets[i].Workload, targets[i].ArgsOr(args), err)
+					continue
+				}
+				decisions[i], errs[i] = autoscale(poolBackend, targets[i].pool(), k8sClient, targets[i].Workload, targets[i].ArgsOr(args), constrained, &snapshot, span)
+			}
+		}(indexes)
+	}
+	wg.Wait()
+	return decisions, errs
+}
+
+// groupByPriority splits sorted targets into the targets of each priority, in order
+func groupByPriority(targets []Target) [][]Target {
+	var groups [][]Target
+	for i, target := range targets {
+		if i == 0 || target.Priority != targets[i-1].Priority {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], target)
+	}
+	return groups
+}
+
+// sortTargets returns the targets sorted by descending priority, with the spot workloads first within a priority,
+// so the other workloads of their pools know which agents they can't run
+func sortTargets(targets []Target, args args.Args) []Target {
+	sorted := make([]Target, len(targets))
+	copy(sorted, targets)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority > sorted[j].Priority
+		}
+		return args.Kubernetes.IsSpot(sorted[i].Workload.Name) && !args.Kubernetes.IsSpot(sorted[j].Workload.Name)
+	})
+	return sorted
+}
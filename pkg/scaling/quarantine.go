@@ -0,0 +1,130 @@
+package scaling
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonAgentQuarantined = "AgentQuarantined"
+
+var failingAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "azp_agent_autoscaler_failing_agents_count",
+	Help: "The number of agents whose share of failed jobs since their pod started is at least the quarantine failure rate",
+}, metricLabelNames)
+
+// jobResults are the number of jobs an agent finished and the number of them that failed
+type jobResults struct {
+	finished int32
+	failed   int32
+}
+
+// quarantineAgents disables the agents whose share of failed jobs since their pod started is at least the quarantine
+// failure rate, which usually means the pod has broken local state, so they aren't assigned new jobs. Once their running
+// job finished, their pod is deleted so the workload recreates it, and the agent is removed so the new pod registers an
+// enabled agent. Pods are deleted a few at a time, like recycled pods. Errors are only logged.
+func quarantineAgents(observed observation, agentPoolID int, backend ci.Backend, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if !args.Quarantine.Enabled() {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	onlinePodNames := make(map[string]bool)
+	for _, agent := range observed.Agents {
+		if agent.Online {
+			onlinePodNames[agent.PodName] = true
+		}
+	}
+	pods := make(map[string]corev1.Pod)
+	numUnavailable := int32(0)
+	for _, pod := range observed.Pods {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning || !onlinePodNames[pod.Name] {
+			numUnavailable++
+		} else {
+			pods[pod.Name] = pod
+		}
+	}
+
+	results := countJobResultsSincePodStart(observed.Agents, observed.Jobs, pods)
+	numFailing := 0
+	for _, agent := range observed.Agents {
+		pod, exists := pods[agent.PodName]
+		result := results[agent.Name]
+		if !exists || result.finished < args.Quarantine.MinJobs || float64(result.failed) < args.Quarantine.FailureRate*float64(result.finished) {
+			continue
+		}
+		numFailing++
+		reason := fmt.Sprintf("%d of the %d jobs it finished since its pod started failed", result.failed, result.finished)
+
+		if agent.Enabled {
+			if args.DryRun {
+				workloadLogger.Infof("Dry run - would quarantine agent %s: %s", agent.Name, reason)
+				continue
+			}
+			// Agents that can't be disabled are recycled once their running job finished
+			if err := backend.Drain(agentPoolID, agent); err != nil && !errors.Is(err, ci.ErrNotSupported) {
+				workloadLogger.Warnf("Error disabling failing agent %s: %s", agent.Name, err.Error())
+				continue
+			}
+			message := fmt.Sprintf("Quarantined agent %s: %s", agent.Name, reason)
+			workloadLogger.Warn(message)
+			createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonAgentQuarantined, message)
+		}
+
+		if agent.Busy || numUnavailable >= args.Recycle.MaxUnavailable {
+			continue
+		}
+		numUnavailable++
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would recycle pod %s of quarantined agent %s", pod.Name, agent.Name)
+			continue
+		}
+		if err := k8sClient.Sync().DeletePod(pod); err != nil {
+			workloadLogger.Warnf("Error recycling pod %s of quarantined agent %s: %s", pod.Name, agent.Name, err.Error())
+			continue
+		}
+		if err := backend.Remove(agentPoolID, agent); err != nil {
+			workloadLogger.Warnf("Error removing quarantined agent %s: %s", agent.Name, err.Error())
+		}
+		message := fmt.Sprintf("Recycled pod %s of quarantined agent %s: %s", pod.Name, agent.Name, reason)
+		workloadLogger.Info(message)
+		labels := metricLabels(agentPoolID, deployment)
+		labels["reason"] = string(recycleReasonFailing)
+		recycledPodsCounter.With(labels).Inc()
+		createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, eventReasonAgentRecycled, message)
+	}
+	failingAgentsGauge.With(metricLabels(agentPoolID, deployment)).Set(float64(numFailing))
+}
+
+// countJobResultsSincePodStart returns the number of jobs each agent finished since its pod started and how many of them
+// failed, by agent name. Only the jobs the CI system still returns are counted.
+func countJobResultsSincePodStart(agents []ci.Agent, jobs []ci.Job, pods map[string]corev1.Pod) map[string]jobResults {
+	podStartTimes := make(map[string]time.Time)
+	for _, agent := range agents {
+		if pod, exists := pods[agent.PodName]; exists {
+			podStartTimes[agent.Name] = podStartTime(pod)
+		}
+	}
+	results := make(map[string]jobResults)
+	for _, job := range jobs {
+		podStartTime, exists := podStartTimes[job.AgentName]
+		if !exists || !job.Finished || job.StartTime.Before(podStartTime) {
+			continue
+		}
+		result := results[job.AgentName]
+		result.finished++
+		if job.Failed {
+			result.failed++
+		}
+		results[job.AgentName] = result
+	}
+	return results
+}
@@ -0,0 +1,40 @@
+package scaling
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonScaleUpLimitedByQuota = "ScaleUpLimitedByQuota"
+
+var quotaLimitedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "azp_agent_autoscaler_quota_limited_count",
+	Help: "The total number of scale ups limited by a ResourceQuota of the agents' namespace",
+}, metricLabelNames)
+
+// lastQuotaEvents are the quotas and resources that last limited the scale up of each workload, so an event is only
+// created when the limiting quota changes
+var lastQuotaEvents = make(map[string]string)
+
+// createQuotaEvent creates a warning event when a ResourceQuota limited a scale up
+func createQuotaEvent(decision *Decision, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	key := stateKey(deployment)
+	if decision.Quota == nil {
+		delete(lastQuotaEvents, key)
+		return
+	}
+	quota := fmt.Sprintf("%s/%s", decision.Quota.Quota, decision.Quota.Resource)
+	if lastQuotaEvents[key] == quota {
+		return
+	}
+	lastQuotaEvents[key] = quota
+
+	message := fmt.Sprintf("Limited the scale up to %d replicas - %s", decision.DesiredReplicas, decision.Quota.String())
+	createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonScaleUpLimitedByQuota, message)
+}
@@ -0,0 +1,85 @@
+package scaling
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+)
+
+var pollIntervalGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "azp_agent_autoscaler_poll_interval_seconds",
+	Help: "The interval until the next autoscaling iteration",
+})
+
+// reconcileRequests wakes up the autoscaling loop. It is buffered so requests made during an iteration aren't lost.
+var reconcileRequests = make(chan struct{}, 1)
+
+var (
+	// pollInterval is the interval of the last autoscaling iteration
+	pollInterval time.Duration
+	// activeIteration is true if a workload had queued jobs or was scaled since the interval was last adapted
+	activeIteration bool
+)
+
+// Reconcile requests an autoscaling iteration without waiting for the rate
+func Reconcile() {
+	select {
+	case reconcileRequests <- struct{}{}:
+	default:
+		// An iteration was already requested
+	}
+}
+
+// WaitForReconcile waits for the rate to pass or for an iteration to be requested. It returns the error of the context
+// if it's done first.
+func WaitForReconcile(ctx context.Context, rate time.Duration) error {
+	timer := time.NewTimer(rate)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-reconcileRequests:
+		logger.Debug("Reconciling on request")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// recordActivity marks the iteration as active if the workload has queued jobs or is being scaled. The caller must hold
+// statesMutex.
+func recordActivity(decision *Decision) {
+	if decision.NumQueuedJobs > 0 || decision.IsScaling() {
+		activeIteration = true
+	}
+}
+
+// NextRate returns how long to wait for the next autoscaling iteration. After an iteration with queued jobs or a scale,
+// it's the minimum rate, and it doubles after every idle iteration up to the maximum rate, so the agents are polled less
+// while they're idle without slowing down the response to new jobs for long.
+func NextRate(args args.Args) time.Duration {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+
+	previous := pollInterval
+	if pollInterval == 0 {
+		pollInterval = args.Rate
+	} else if activeIteration {
+		pollInterval = args.MinRate()
+	} else {
+		pollInterval *= 2
+	}
+	// The rates may have changed since the last iteration if the config was reloaded
+	pollInterval = math.MinDuration(math.MaxDuration(pollInterval, args.MinRate()), args.MaxRate())
+	activeIteration = false
+
+	if pollInterval != previous {
+		logger.Debugf("Polling every %s", pollInterval.String())
+	}
+	pollIntervalGauge.Set(pollInterval.Seconds())
+	return pollInterval
+}
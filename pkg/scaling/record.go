@@ -0,0 +1,118 @@
+package scaling
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+// Recording is a snapshot of a workload recorded with --record-dir, with the decision the autoscaler made from it, so
+// the snapshot can be replayed against another scaling policy
+type Recording struct {
+	Snapshot        Snapshot `json:"snapshot"`
+	DesiredReplicas int32    `json:"desiredReplicas"`
+	Reason          string   `json:"reason"`
+	Suppressors     []string `json:"suppressors,omitempty"`
+}
+
+// lastRecorded is when the snapshot of each workload was last recorded
+var lastRecorded = make(map[string]time.Time)
+
+// recordSnapshot appends the snapshot of a workload and its decision to the recording of the workload, at most once per
+// --record-interval. Recording is best effort, so an error is logged instead of failing the iteration. The caller must
+// hold statesMutex.
+func recordSnapshot(snapshot Snapshot, decision *Decision, recordArgs args.RecordArgs) {
+	if recordArgs.Dir == "" {
+		return
+	}
+	key := stateKey(snapshot.Workload)
+	if last, recorded := lastRecorded[key]; recorded && snapshot.Time.Sub(last) < recordArgs.Interval {
+		return
+	}
+	lastRecorded[key] = snapshot.Time
+
+	// The managed fields are only bookkeeping of the Kubernetes API, but they're most of the size of a pod. The pods are
+	// shared with the other workloads of the pool, so they're copied.
+	pods := make([]corev1.Pod, len(snapshot.Pods))
+	for i, pod := range snapshot.Pods {
+		pod.ManagedFields = nil
+		pods[i] = pod
+	}
+	snapshot.Pods = pods
+
+	path := filepath.Join(recordArgs.Dir, key+".jsonl")
+	recording := Recording{Snapshot: snapshot, DesiredReplicas: decision.DesiredReplicas, Reason: decision.Reason, Suppressors: decision.SuppressorNames()}
+	if err := appendRecording(path, recording, recordArgs.MaxSize); err != nil {
+		logging.Logger.Warnf("Error recording the snapshot of %s to %s: %s", snapshot.Workload.FriendlyName, path, err.Error())
+	}
+}
+
+// appendRecording appends a recording to the file as a line of JSON. Once the file is larger than the max size, it's
+// rotated to a .1 file, replacing the previous one, so a recording takes at most twice the max size.
+func appendRecording(path string, recording Recording, maxSize int64) error {
+	line, err := json.Marshal(recording)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && maxSize > 0 && info.Size() >= maxSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadRecordings reads the recordings of a file written with --record-dir, in the order they were recorded
+func ReadRecordings(path string) ([]Recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var recordings []Recording
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var recording Recording
+			if jsonErr := json.Unmarshal(line, &recording); jsonErr != nil {
+				// The last line is partial if the autoscaler was killed while writing it
+				if err == io.EOF {
+					break
+				}
+				return nil, fmt.Errorf("Error parsing line %d of %s: %w", lineNumber, path, jsonErr)
+			}
+			if recording.Snapshot.Workload == nil {
+				return nil, fmt.Errorf("Line %d of %s doesn't have a workload", lineNumber, path)
+			}
+			recordings = append(recordings, recording)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return recordings, nil
+}
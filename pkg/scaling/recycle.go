@@ -0,0 +1,212 @@
+package scaling
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonAgentRecycled = "AgentRecycled"
+
+// recycleReason is why an agent is recycled
+type recycleReason string
+
+const (
+	recycleReasonOutdated recycleReason = "outdated"
+	recycleReasonRevision recycleReason = "revision"
+	recycleReasonJobs     recycleReason = "jobs"
+	recycleReasonAge      recycleReason = "age"
+	recycleReasonOffline  recycleReason = "offline"
+	recycleReasonFailing  recycleReason = "failing"
+)
+
+var (
+	outdatedAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_outdated_agents_count",
+		Help: "The number of agents with an older version than the newest agent of the pool or the minimum agent version",
+	}, metricLabelNames)
+	recycledPodsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_recycled_pods_count",
+		Help: "The total number of agent pods deleted to recycle their agent or replace an offline agent",
+	}, append(metricLabelNames, "reason"))
+)
+
+// recycleCandidate is an agent to recycle and the pod to delete
+type recycleCandidate struct {
+	agent   ci.Agent
+	pod     corev1.Pod
+	reason  recycleReason
+	message string
+}
+
+// recycleAgents deletes the pods of idle agents so the workload recreates them: agents with an older version than the
+// newest agent of the pool or the minimum version, pods with an outdated pod template of a StatefulSet with the OnDelete
+// update strategy, agents that ran the maximum number of jobs since their pod started, and agents whose pod is older than
+// the maximum age. Pods are recycled a few at a time: no more pods are deleted while max unavailable pods are terminating,
+// not running or don't have an online agent. Nothing is recycled while jobs are queued. While the workload is scaled
+// down, only the outdated pods it keeps are recycled, as the pods with the highest ordinals are removed whether they're
+// updated or not. Errors are only logged.
+func recycleAgents(observed observation, decision *Decision, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	outdatedAgents := getOutdatedAgents(observed.Agents, args.Recycle.MinVersion)
+	outdatedAgentsGauge.With(metricLabels(agentPoolID, deployment)).Set(float64(len(outdatedAgents)))
+	scalingDown := decision.DesiredReplicas < decision.NumPods
+	if !args.Recycle.Enabled() || decision.NumQueuedJobs > 0 || (scalingDown && !args.Recycle.OutdatedPods) {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	onlinePodNames := make(map[string]bool)
+	for _, agent := range observed.Agents {
+		if agent.Online {
+			onlinePodNames[agent.PodName] = true
+		}
+	}
+	pods := make(map[string]corev1.Pod)
+	numUnavailable := int32(0)
+	for _, pod := range observed.Pods {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning || !onlinePodNames[pod.Name] {
+			numUnavailable++
+		} else {
+			pods[pod.Name] = pod
+		}
+	}
+
+	candidates := getRecycleCandidates(observed, outdatedAgents, pods, decision.RollingUpdate, args.Recycle, time.Now())
+	for _, candidate := range candidates {
+		if numUnavailable >= args.Recycle.MaxUnavailable {
+			break
+		} else if scalingDown && (candidate.reason != recycleReasonRevision || !isKeptPod(candidate.pod.Name, deployment.Name, decision.DesiredReplicas)) {
+			continue
+		}
+		numUnavailable++
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would recycle pod %s of agent %s: %s", candidate.pod.Name, candidate.agent.Name, candidate.message)
+			continue
+		}
+		if err := k8sClient.Sync().DeletePod(candidate.pod); err != nil {
+			workloadLogger.Warnf("Error recycling pod %s of agent %s: %s", candidate.pod.Name, candidate.agent.Name, err.Error())
+			continue
+		}
+		message := fmt.Sprintf("Recycled pod %s of agent %s: %s", candidate.pod.Name, candidate.agent.Name, candidate.message)
+		workloadLogger.Info(message)
+		labels := metricLabels(agentPoolID, deployment)
+		labels["reason"] = string(candidate.reason)
+		recycledPodsCounter.With(labels).Inc()
+		createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, eventReasonAgentRecycled, message)
+	}
+}
+
+// getRecycleCandidates returns the idle agents to recycle with their available pods: the outdated agents, oldest version
+// first, then the outdated pods of an OnDelete update, then the agents that ran the most jobs, then the agents with the
+// oldest pods. Each agent is returned once.
+func getRecycleCandidates(observed observation, outdatedAgents []ci.Agent, pods map[string]corev1.Pod, update *kubernetes.RollingUpdate, recycleArgs args.RecycleArgs, now time.Time) []recycleCandidate {
+	var candidates []recycleCandidate
+	recycled := make(map[string]bool)
+	add := func(agent ci.Agent, reason recycleReason, message string) {
+		pod, exists := pods[agent.PodName]
+		if !exists || agent.Busy || recycled[agent.PodName] {
+			return
+		}
+		recycled[agent.PodName] = true
+		candidates = append(candidates, recycleCandidate{agent: agent, pod: pod, reason: reason, message: message})
+	}
+
+	if recycleArgs.Outdated {
+		for _, agent := range outdatedAgents {
+			add(agent, recycleReasonOutdated, fmt.Sprintf("outdated version %s", agent.Version))
+		}
+	}
+
+	if recycleArgs.OutdatedPods && update != nil && update.OnDelete {
+		for _, agent := range observed.Agents {
+			if pod, exists := pods[agent.PodName]; exists && update.IsOutdatedPod(pod) {
+				add(agent, recycleReasonRevision, fmt.Sprintf("outdated pod template, updating to revision %s", update.UpdateRevision))
+			}
+		}
+	}
+
+	if recycleArgs.AfterJobs > 0 {
+		numJobs := countJobsSincePodStart(observed.Agents, observed.Jobs, pods)
+		agents := append([]ci.Agent{}, observed.Agents...)
+		sort.SliceStable(agents, func(i, j int) bool {
+			return numJobs[agents[i].Name] > numJobs[agents[j].Name]
+		})
+		for _, agent := range agents {
+			if numJobs[agent.Name] >= recycleArgs.AfterJobs {
+				add(agent, recycleReasonJobs, fmt.Sprintf("ran %d jobs", numJobs[agent.Name]))
+			}
+		}
+	}
+
+	if recycleArgs.MaxAge > 0 {
+		agents := append([]ci.Agent{}, observed.Agents...)
+		sort.SliceStable(agents, func(i, j int) bool {
+			return podStartTime(pods[agents[i].PodName]).Before(podStartTime(pods[agents[j].PodName]))
+		})
+		for _, agent := range agents {
+			pod, exists := pods[agent.PodName]
+			if age := now.Sub(podStartTime(pod)); exists && age >= recycleArgs.MaxAge {
+				add(agent, recycleReasonAge, fmt.Sprintf("pod is %s old", age.Round(time.Minute).String()))
+			}
+		}
+	}
+	return candidates
+}
+
+// countJobsSincePodStart returns the number of jobs each agent started since its pod started, by agent name.
+// Only the jobs the CI system still returns are counted.
+func countJobsSincePodStart(agents []ci.Agent, jobs []ci.Job, pods map[string]corev1.Pod) map[string]int32 {
+	podStartTimes := make(map[string]time.Time)
+	for _, agent := range agents {
+		if pod, exists := pods[agent.PodName]; exists {
+			podStartTimes[agent.Name] = podStartTime(pod)
+		}
+	}
+	numJobs := make(map[string]int32)
+	for _, job := range jobs {
+		if podStartTime, exists := podStartTimes[job.AgentName]; exists && !job.StartTime.Before(podStartTime) {
+			numJobs[job.AgentName]++
+		}
+	}
+	return numJobs
+}
+
+// podStartTime returns when a pod started, or when it was created if it didn't
+func podStartTime(pod corev1.Pod) time.Time {
+	if pod.Status.StartTime != nil {
+		return pod.Status.StartTime.Time
+	}
+	return pod.CreationTimestamp.Time
+}
+
+// getOutdatedAgents returns the agents with an older version than the minimum version, or than the newest agent if
+// the minimum version is empty, oldest first. Agents that don't report a version are never outdated.
+func getOutdatedAgents(agents []ci.Agent, minVersion string) []ci.Agent {
+	targetVersion := minVersion
+	if targetVersion == "" {
+		for _, agent := range agents {
+			if agent.Version != "" && ci.CompareVersions(agent.Version, targetVersion) > 0 {
+				targetVersion = agent.Version
+			}
+		}
+	}
+
+	var outdatedAgents []ci.Agent
+	for _, agent := range agents {
+		if agent.Version != "" && ci.CompareVersions(agent.Version, targetVersion) < 0 {
+			outdatedAgents = append(outdatedAgents, agent)
+		}
+	}
+	sort.SliceStable(outdatedAgents, func(i, j int) bool {
+		return ci.CompareVersions(outdatedAgents[i].Version, outdatedAgents[j].Version) < 0
+	})
+	return outdatedAgents
+}
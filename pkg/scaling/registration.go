@@ -0,0 +1,182 @@
+package scaling
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+)
+
+const eventReasonAgentsNotRegistered = "AgentsNotRegistered"
+
+var (
+	registrationPausedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_registration_paused",
+		Help: "Set to 1 while scale ups are paused after the agent pods of a scale up didn't register",
+	}, metricLabelNames)
+	registrationFailedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "azp_agent_autoscaler_registration_failed_count",
+		Help: "The total number of scale ups whose agent pods didn't register an online agent within the timeout",
+	}, metricLabelNames)
+	registrationFailuresGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_registration_consecutive_failures",
+		Help: "The number of consecutive scale ups whose agent pods didn't register an online agent",
+	}, metricLabelNames)
+)
+
+// failingPodReasons are the reasons of a waiting container that won't start without a change to the pod template or the
+// image, ex: a broken agent image
+var failingPodReasons = map[string]bool{
+	reasonCrashLoopBackOff:       true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Registration is a scale up whose agent pods are waiting to register an online agent
+type Registration struct {
+	// Since is when the workload was scaled up
+	Since time.Time `json:"since"`
+	// FromReplicas are the replicas the workload was scaled up from, so the pods of a StatefulSet with a higher ordinal
+	// are the new pods
+	FromReplicas int32 `json:"fromReplicas"`
+}
+
+// startRegistration starts waiting for the agent pods of a scale up to register, unless the pods of an earlier scale up
+// are still being waited for. The caller must hold statesMutex.
+func startRegistration(deployment *kubernetes.Workload, fromReplicas int32, args args.Args) {
+	if args.Registration.Timeout <= 0 {
+		return
+	}
+	state := getState(deployment)
+	if state.Registration == nil {
+		state.Registration = &Registration{Since: time.Now(), FromReplicas: fromReplicas}
+	}
+}
+
+// verifyRegistration checks whether the agent pods of the last scale up registered an online agent, from the pods and
+// agents observed after it. A scale up failed if none of them did within the registration timeout, or as soon as all of
+// them are failing, ex: crash looping or failing to pull the image. The usual cause is a bad token or agent image that
+// more pods won't fix, so scale ups are paused once the registration failures consecutive scale ups failed. Each
+// consecutive pause doubles in length, up to the maximum, and the failures and the pause length reset once the pods of a
+// scale up register. The caller must hold statesMutex.
+func verifyRegistration(observed observation, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	labels := metricLabels(agentPoolID, deployment)
+	state := getState(deployment)
+	now := time.Now()
+	if !now.Before(state.RegistrationPausedUntil) {
+		registrationPausedGauge.With(labels).Set(0)
+	}
+	registration := state.Registration
+	if registration == nil {
+		return
+	} else if args.Registration.Timeout <= 0 {
+		state.Registration = nil
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	onlinePodNames := make(map[string]bool)
+	for _, agent := range observed.Agents {
+		if agent.Online {
+			onlinePodNames[agent.PodName] = true
+		}
+	}
+	var newPods, registeredPods, failingPods int
+	for _, pod := range observed.Pods {
+		if pod.DeletionTimestamp != nil || !isRegistrationPod(pod, registration, deployment) {
+			continue
+		}
+		newPods++
+		if onlinePodNames[pod.Name] {
+			registeredPods++
+		} else if isFailingPod(pod) {
+			failingPods++
+		}
+	}
+
+	if newPods == 0 {
+		// The pods that are never created, ex: because of a quota, or that were scaled down aren't verified
+		if now.Sub(registration.Since) >= args.Registration.Timeout {
+			workloadLogger.Debugf("Not verifying the registration of the agents of %s - it has no new pods", deployment.FriendlyName)
+			state.Registration = nil
+		}
+		return
+	} else if registeredPods > 0 {
+		workloadLogger.Debugf("%d of the %d new pods of %s registered an online agent", registeredPods, newPods, deployment.FriendlyName)
+		state.Registration = nil
+		registrationFailuresGauge.With(labels).Set(0)
+		if state.RegistrationBackoff > 0 || state.RegistrationFailures > 0 {
+			state.RegistrationBackoff = 0
+			state.RegistrationFailures = 0
+			saveState(k8sClient, deployment, args)
+		}
+		return
+	} else if failingPods < newPods && now.Sub(registration.Since) < args.Registration.Timeout {
+		return
+	}
+
+	failure := fmt.Sprintf("None of the %d agent pods created by the scale up at %s registered an online agent within %s", newPods, registration.Since.Format(time.RFC3339), args.Registration.Timeout.String())
+	if failingPods == newPods {
+		failure = fmt.Sprintf("All of the %d agent pods created by the scale up at %s are failing", newPods, registration.Since.Format(time.RFC3339))
+	}
+	state.Registration = nil
+	state.RegistrationFailures++
+	registrationFailuresGauge.With(labels).Set(float64(state.RegistrationFailures))
+	registrationFailedCounter.With(labels).Inc()
+	if state.RegistrationFailures < args.Registration.Failures {
+		workloadLogger.Warnf("%s, %d of %d consecutive failed scale ups before scale ups are paused", failure, state.RegistrationFailures, args.Registration.Failures)
+		saveState(k8sClient, deployment, args)
+		return
+	}
+
+	backoff := args.Registration.Backoff
+	if state.RegistrationBackoff > 0 {
+		backoff = math.MinDuration(2*state.RegistrationBackoff, args.Registration.BackoffMax)
+	}
+	state.RegistrationBackoff = backoff
+	state.RegistrationPausedUntil = now.Add(backoff)
+	registrationPausedGauge.With(labels).Set(1)
+
+	if state.RegistrationFailures > 1 {
+		failure = fmt.Sprintf("%s, the %d last scale ups failed", failure, state.RegistrationFailures)
+	}
+	message := fmt.Sprintf("%s, pausing scale ups for %s - check the agent token and image", failure, backoff.String())
+	workloadLogger.Warn(message)
+	createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonAgentsNotRegistered, message)
+	saveState(k8sClient, deployment, args)
+}
+
+// isRegistrationPod returns true if a pod was created by the scale up of a registration. The new pods of a StatefulSet
+// have the ordinals above the replicas it was scaled up from, and the other pods were created after the scale up.
+func isRegistrationPod(pod corev1.Pod, registration *Registration, deployment *kubernetes.Workload) bool {
+	if strings.EqualFold(deployment.Kind, "StatefulSet") {
+		ordinal, isPod := statefulSetOrdinal(pod.Name, deployment.Name)
+		return isPod && ordinal >= registration.FromReplicas
+	}
+	// The creation timestamps only have a precision of seconds
+	return !pod.CreationTimestamp.Time.Before(registration.Since.Truncate(time.Second))
+}
+
+// isFailingPod returns true if a pod failed or one of its containers is waiting for a reason it won't recover from
+// without a change, ex: crash looping or failing to pull the image
+func isFailingPod(pod corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodFailed {
+		return true
+	}
+	for _, containerStatus := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if waiting := containerStatus.State.Waiting; waiting != nil && failingPodReasons[waiting.Reason] {
+			return true
+		}
+	}
+	return false
+}
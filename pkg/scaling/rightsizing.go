@@ -0,0 +1,259 @@
+package scaling
+
+import (
+	"fmt"
+	gomath "math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+)
+
+// rightSizingMaxWait is the p95 time the jobs can wait for an agent before the report suggests more free agents
+const rightSizingMaxWait = time.Minute
+
+var (
+	jobDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "azp_agent_autoscaler_job_duration_seconds",
+		Help:    "The duration of the jobs the agents of a workload finished, from when they started to when they finished",
+		Buckets: []float64{30, 60, 120, 300, 600, 900, 1800, 3600, 7200, 14400},
+	}, metricLabelNames)
+	suggestedMinGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_right_sizing_suggested_min",
+		Help: "The minimum free agents suggested by the last right-sizing report",
+	}, metricLabelNames)
+	suggestedMaxGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_right_sizing_suggested_max",
+		Help: "The maximum agents suggested by the last right-sizing report",
+	}, metricLabelNames)
+	suggestedScaleDownDelayGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_right_sizing_suggested_scale_down_delay_seconds",
+		Help: "The scale down delay suggested by the last right-sizing report",
+	}, metricLabelNames)
+	delayedIdleAgentHoursGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azp_agent_autoscaler_right_sizing_delayed_idle_agent_hours_per_day",
+		Help: "The agent hours per day the scale down delay kept idle agents for in the last right-sizing report",
+	}, metricLabelNames)
+
+	// rightSizingStats are the statistics of the current right-sizing report of each workload, by namespace and name.
+	// It is guarded by statesMutex.
+	rightSizingStats = make(map[string]*RightSizingStats)
+)
+
+// RightSizingStats are the job durations and agents of a workload a right-sizing report is made from
+type RightSizingStats struct {
+	// Since is when the statistics started to be collected. The jobs that finished before aren't counted.
+	Since time.Time
+	// LastSample is when the agents were last counted
+	LastSample time.Time
+
+	// JobDurations are the durations of the jobs the agents of the workload finished
+	JobDurations []time.Duration
+	// JobWaits are how long the jobs were queued before an agent started them
+	JobWaits []time.Duration
+	// BusyAgents are the active agents of every iteration
+	BusyAgents []int32
+	// PeakDemand is the most agents needed for the active agents and queued jobs of an iteration
+	PeakDemand int32
+	// MaxLimited is the number of iterations whose scale up was limited by the maximum
+	MaxLimited int
+	// DelayedIdleTime is the agent time idle agents were only kept for by the scale down delay
+	DelayedIdleTime time.Duration
+
+	// recordedJobs are the jobs whose duration was recorded, by agent name and start time
+	recordedJobs collections.StringSet
+}
+
+// RightSizingReport summarizes the jobs and agents of a workload over a period, and the scaling arguments they suggest
+type RightSizingReport struct {
+	Period time.Duration
+
+	Jobs           int
+	JobDurationP50 time.Duration
+	JobDurationP95 time.Duration
+	JobDurationMax time.Duration
+	JobWaitP95     time.Duration
+
+	PeakBusyAgents int32
+	P95BusyAgents  int32
+	// DelayedIdleAgentHoursPerDay are the agent hours per day the scale down delay kept idle agents for
+	DelayedIdleAgentHoursPerDay float64
+
+	SuggestedMin            int32
+	SuggestedMax            int32
+	SuggestedScaleDownDelay time.Duration
+	// Suggestions explain the suggested arguments that differ from the current ones
+	Suggestions []string
+}
+
+// Report makes the right-sizing report of the statistics collected until now.
+// The suggestions are estimates from the observed period, so a period without the usual peak suggests too few agents.
+func (s RightSizingStats) Report(now time.Time, args args.Args) RightSizingReport {
+	report := RightSizingReport{
+		Period:                  now.Sub(s.Since),
+		Jobs:                    len(s.JobDurations),
+		JobDurationP50:          percentileDuration(s.JobDurations, 0.5),
+		JobDurationP95:          percentileDuration(s.JobDurations, 0.95),
+		JobDurationMax:          percentileDuration(s.JobDurations, 1),
+		JobWaitP95:              percentileDuration(s.JobWaits, 0.95),
+		PeakBusyAgents:          percentileInt32(s.BusyAgents, 1),
+		P95BusyAgents:           percentileInt32(s.BusyAgents, 0.95),
+		SuggestedMin:            args.Min,
+		SuggestedMax:            args.Max,
+		SuggestedScaleDownDelay: args.ScaleDown.IdleDelay,
+	}
+	if report.Period <= 0 {
+		return report
+	}
+	report.DelayedIdleAgentHoursPerDay = s.DelayedIdleTime.Hours() * (24 * time.Hour).Hours() / report.Period.Hours()
+
+	// By Little's law, the jobs arriving at rate λ that wait W for an agent are λW jobs without a free agent on average
+	if report.JobWaitP95 > rightSizingMaxWait {
+		arrivalRate := float64(len(s.JobWaits)) / report.Period.Minutes()
+		report.SuggestedMin = math.MinInt32(args.Max, args.Min+int32(gomath.Ceil(arrivalRate*report.JobWaitP95.Minutes())))
+		if report.SuggestedMin > args.Min {
+			report.Suggestions = append(report.Suggestions, fmt.Sprintf("The p95 job waited %s for an agent, a min of %d free agents instead of %d would start them sooner.",
+				report.JobWaitP95.Round(time.Second), report.SuggestedMin, args.Min))
+		}
+	}
+
+	if s.MaxLimited > 0 && s.PeakDemand > args.Max {
+		report.SuggestedMax = s.PeakDemand
+		report.Suggestions = append(report.Suggestions, fmt.Sprintf("Scale ups were limited by the max of %d in %d iterations, and up to %d agents were needed. Consider a max of %d.",
+			args.Max, s.MaxLimited, s.PeakDemand, report.SuggestedMax))
+	} else if len(s.BusyAgents) > 0 && s.MaxLimited == 0 && report.PeakBusyAgents+report.SuggestedMin < args.Max {
+		report.SuggestedMax = math.MaxInt32(1, report.PeakBusyAgents+report.SuggestedMin)
+		report.Suggestions = append(report.Suggestions, fmt.Sprintf("The busy agents peaked at %d, a max of %d instead of %d would still run every job with the free agents.",
+			report.PeakBusyAgents, report.SuggestedMax, args.Max))
+	}
+
+	// The jobs of the next stages and runs usually queue within a job's duration, so a delay much longer than the p95 job
+	// mostly keeps agents idle
+	if report.Jobs > 0 && args.ScaleDown.IdleDelay > 0 {
+		suggestedDelay := roundUpDuration(2*report.JobDurationP95, time.Minute)
+		if suggestedDelay < args.ScaleDown.IdleDelay {
+			report.SuggestedScaleDownDelay = suggestedDelay
+			report.Suggestions = append(report.Suggestions, fmt.Sprintf("The p95 job is %s, the current %s scale down delay keeps ~%.1f idle agent-hours/day. Consider a delay of %s.",
+				report.JobDurationP95.Round(time.Second), args.ScaleDown.IdleDelay, report.DelayedIdleAgentHoursPerDay, suggestedDelay))
+		}
+	}
+	return report
+}
+
+// String summarizes the report in a single line
+func (r RightSizingReport) String() string {
+	summary := fmt.Sprintf("%d jobs in %s (p50 %s, p95 %s, max %s, p95 wait %s), %d peak and %d p95 busy agents, %.1f idle agent-hours/day kept by the scale down delay",
+		r.Jobs, r.Period.Round(time.Minute), r.JobDurationP50.Round(time.Second), r.JobDurationP95.Round(time.Second), r.JobDurationMax.Round(time.Second),
+		r.JobWaitP95.Round(time.Second), r.PeakBusyAgents, r.P95BusyAgents, r.DelayedIdleAgentHoursPerDay)
+	if len(r.Suggestions) == 0 {
+		return summary + ". The scaling arguments fit the workload."
+	}
+	return summary + ". " + strings.Join(r.Suggestions, " ")
+}
+
+// recordRightSizing adds the finished jobs and the agents of an iteration to the right-sizing statistics of the workload,
+// and logs its report once the report interval passed. The caller must hold statesMutex.
+func recordRightSizing(observed observation, decision *Decision, agentPoolID int, deployment *kubernetes.Workload, args args.Args) {
+	if args.RightSizingReport <= 0 {
+		return
+	}
+	now := time.Now()
+	key := deployment.Namespace + "/" + deployment.FriendlyName
+	stats, exists := rightSizingStats[key]
+	if !exists {
+		stats = &RightSizingStats{Since: now, recordedJobs: make(collections.StringSet)}
+		rightSizingStats[key] = stats
+	}
+	labels := metricLabels(agentPoolID, deployment)
+
+	podNames := make(collections.StringSet, len(observed.Pods))
+	for _, pod := range observed.Pods {
+		podNames.Add(pod.Name)
+	}
+	agentNames := make(collections.StringSet)
+	for _, agent := range observed.Agents {
+		if podNames.Contains(agent.PodName) {
+			agentNames.Add(agent.Name)
+		}
+	}
+	for _, job := range observed.Jobs {
+		if !job.Finished || job.StartTime.IsZero() || job.FinishTime.Before(stats.Since) || !agentNames.Contains(job.AgentName) {
+			continue
+		}
+		jobKey := job.AgentName + "/" + job.StartTime.UTC().Format(time.RFC3339Nano)
+		if stats.recordedJobs.Contains(jobKey) {
+			continue
+		}
+		stats.recordedJobs.Add(jobKey)
+		duration := job.FinishTime.Sub(job.StartTime)
+		stats.JobDurations = append(stats.JobDurations, duration)
+		if !job.QueueTime.IsZero() && job.StartTime.After(job.QueueTime) {
+			stats.JobWaits = append(stats.JobWaits, job.StartTime.Sub(job.QueueTime))
+		}
+		jobDurationHistogram.With(labels).Observe(duration.Seconds())
+	}
+
+	stats.BusyAgents = append(stats.BusyAgents, decision.NumActiveAgents)
+	stats.PeakDemand = math.MaxInt32(stats.PeakDemand, decision.NumActiveAgents+decision.QueueDemand)
+	if decision.HasSuppressor(SuppressorMax) {
+		stats.MaxLimited++
+	}
+	// The idle agents above the minimum that haven't been idle for the scale down delay are only kept for it.
+	// Iterations missed while the autoscaler failed aren't counted.
+	if !stats.LastSample.IsZero() {
+		elapsed := math.MinDuration(now.Sub(stats.LastSample), 2*args.MaxRate())
+		recentlyActive := int32(len(getRecentlyActiveAgentPodNames(decision.AgentIdleTimes, args.ScaleDown.IdleDelay)))
+		delayed := math.MinInt32(recentlyActive, math.MaxInt32(0, decision.NumIdleAgents-args.Min))
+		stats.DelayedIdleTime += time.Duration(delayed) * elapsed
+	}
+	stats.LastSample = now
+
+	if now.Sub(stats.Since) < args.RightSizingReport {
+		return
+	}
+	report := stats.Report(now, args)
+	suggestedMinGauge.With(labels).Set(float64(report.SuggestedMin))
+	suggestedMaxGauge.With(labels).Set(float64(report.SuggestedMax))
+	suggestedScaleDownDelayGauge.With(labels).Set(report.SuggestedScaleDownDelay.Seconds())
+	delayedIdleAgentHoursGauge.With(labels).Set(report.DelayedIdleAgentHoursPerDay)
+	workloadLogger(agentPoolID, deployment).Infof("Right-sizing report of %s: %s", deployment.FriendlyName, report)
+	rightSizingStats[key] = &RightSizingStats{Since: now, LastSample: now, recordedJobs: make(collections.StringSet)}
+}
+
+// percentileDuration returns the nearest-rank percentile of the durations, or 0 if there are none
+func percentileDuration(durations []time.Duration, percentile float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[percentileIndex(len(sorted), percentile)]
+}
+
+// percentileInt32 returns the nearest-rank percentile of the values, or 0 if there are none
+func percentileInt32(values []int32, percentile float64) int32 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]int32, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[percentileIndex(len(sorted), percentile)]
+}
+
+func percentileIndex(length int, percentile float64) int {
+	return math.MaxInt(0, math.MinInt(length-1, int(gomath.Ceil(percentile*float64(length)))-1))
+}
+
+// roundUpDuration rounds a duration up to a multiple of the unit, and at least one unit
+func roundUpDuration(duration time.Duration, unit time.Duration) time.Duration {
+	return math.MaxDuration(unit, ((duration+unit-1)/unit)*unit)
+}
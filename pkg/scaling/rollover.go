@@ -0,0 +1,98 @@
+package scaling
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+)
+
+const (
+	eventReasonRolloverDraining = "RolloverDraining"
+	eventReasonRolloverComplete = "RolloverComplete"
+)
+
+// isRolloverPod returns true if a pod is a pod of the green workload of a rollover. The blue workload's pods are excluded
+// when its name starts with the green workload's name, ex: azp-agent and azp-agent-v2.
+func isRolloverPod(podName string, rollover args.RolloverArgs) bool {
+	if !strings.HasPrefix(podName, rollover.To+"-") {
+		return false
+	}
+	return !(len(rollover.From) > len(rollover.To) && strings.HasPrefix(podName, rollover.From+"-"))
+}
+
+// getRolloverOnlineAgents returns the number of online and enabled agents of the green workload of a rollover
+func getRolloverOnlineAgents(agents []ci.Agent, rollover args.RolloverArgs) int32 {
+	numOnline := int32(0)
+	for _, agent := range agents {
+		if agent.Online && agent.Enabled && isRolloverPod(agent.PodName, rollover) {
+			numOnline++
+		}
+	}
+	return numOnline
+}
+
+// rollover drains the agents of the blue workload of a rollover once the green workload has the minimum number of free
+// agents online, so they aren't assigned new jobs and are scaled down once their jobs finished. The completion is
+// reported once the blue workload is scaled down to zero. Errors are only logged.
+func rollover(observed observation, decision *Decision, agentPoolID int, backend ci.Backend, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	if args.Rollover.From == "" || deployment.Name != args.Rollover.From {
+		return
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+	state := getState(deployment)
+
+	if decision.NumPods == 0 && decision.DesiredReplicas == 0 {
+		if state.RolloverCompleteTo != args.Rollover.To {
+			state.RolloverCompleteTo = args.Rollover.To
+			state.changed = true
+			message := fmt.Sprintf("Rolled the agents of %s over to %s", deployment.FriendlyName, args.Rollover.To)
+			workloadLogger.Info(message)
+			createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, eventReasonRolloverComplete, message)
+		}
+		return
+	} else if state.RolloverCompleteTo != "" {
+		state.RolloverCompleteTo = ""
+		state.changed = true
+	}
+
+	greenOnline := getRolloverOnlineAgents(observed.Agents, args.Rollover)
+	if greenOnline < math.MaxInt32(1, args.Min) {
+		workloadLogger.Infof("Waiting for %d agents of %s to come online before draining the agents of %s - %d are online", math.MaxInt32(1, args.Min), args.Rollover.To, deployment.FriendlyName, greenOnline)
+		return
+	}
+
+	podNames := make(map[string]bool)
+	for _, pod := range observed.Pods {
+		podNames[pod.Name] = true
+	}
+	numDrained := 0
+	for _, agent := range observed.Agents {
+		if !agent.Enabled || !podNames[agent.PodName] {
+			continue
+		}
+		if args.DryRun {
+			workloadLogger.Infof("Dry run - would disable agent %s to roll it over to %s", agent.Name, args.Rollover.To)
+			continue
+		}
+		// Agents that can't be drained stop being assigned the queued jobs as they're scaled down
+		if err := backend.Drain(agentPoolID, agent); errors.Is(err, ci.ErrNotSupported) {
+			return
+		} else if err != nil {
+			workloadLogger.Warnf("Error disabling agent %s to roll it over to %s: %s", agent.Name, args.Rollover.To, err.Error())
+			continue
+		}
+		workloadLogger.Infof("Disabled agent %s to roll it over to %s", agent.Name, args.Rollover.To)
+		numDrained++
+	}
+	if numDrained > 0 {
+		createEvent(k8sClient, deployment, args, corev1.EventTypeNormal, eventReasonRolloverDraining,
+			fmt.Sprintf("Disabled %d agents to roll them over to %s, they're scaled down once their jobs finished", numDrained, args.Rollover.To))
+	}
+}
@@ -0,0 +1,48 @@
+package scaling
+
+import (
+	"strings"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// jobRouting decides which workload of a pool counts a queued job, by its demands
+type jobRouting struct {
+	// workload is the name of the workload counting the jobs
+	workload string
+	// os is the OS of the workload if the jobs are split by their Agent.OS demand, otherwise it is empty
+	os string
+	// demandRoutes are the workloads of each demand
+	demandRoutes map[string][]string
+}
+
+// getJobRouting returns how the queued jobs are routed to a workload
+func getJobRouting(deployment *kubernetes.Workload, args args.Args) jobRouting {
+	routing := jobRouting{workload: deployment.Name, demandRoutes: args.DemandRoutes}
+	if args.OSAware {
+		routing.os = deployment.OS()
+	}
+	return routing
+}
+
+// route returns whether a job is routed by its demands, and if so whether it is routed to the workload.
+// A demand route takes precedence over the Agent.OS demand.
+func (r jobRouting) route(job ci.Job) (routed bool, toWorkload bool) {
+	for _, demand := range job.DemandNames() {
+		for _, workload := range r.demandRoutes[demand] {
+			routed = true
+			if strings.EqualFold(workload, r.workload) {
+				return true, true
+			}
+		}
+	}
+	if routed {
+		return true, false
+	}
+	if jobOS := job.DemandedOS(); r.os != "" && jobOS != "" {
+		return true, jobOS == r.os
+	}
+	return false, false
+}
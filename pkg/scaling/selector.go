@@ -0,0 +1,91 @@
+package scaling
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonPodSelectorMismatch = "PodSelectorMismatch"
+
+// podSelectorGracePeriod is how long after a scale the pods of a workload can be missing, before they're created
+const podSelectorGracePeriod = time.Minute
+
+// lastSelectorWarnings are the last pod selector warnings of each workload, so they're only logged when they change
+var lastSelectorWarnings = make(map[string]string)
+
+// podSelectorWarning returns why the pod selector of a workload matches the wrong pods, or an empty string if it doesn't.
+// The pods are the ones matched by the selector. If checkReplicas, it also matches the wrong pods if it doesn't match
+// any while the workload has replicas.
+func podSelectorWarning(k8sClient kubernetes.Client, deployment *kubernetes.Workload, pods []corev1.Pod, checkReplicas bool) (string, error) {
+	if foreign := kubernetes.ForeignPods(deployment, pods); len(foreign) > 0 {
+		names := make([]string, len(foreign))
+		for i, pod := range foreign {
+			names[i] = pod.Name
+		}
+		return fmt.Sprintf("The pod selector of %s matches %d pods it doesn't control, which are counted as its agents: %s", deployment.FriendlyName, len(foreign), strings.Join(names, ", ")), nil
+	}
+	if len(pods) == 0 && checkReplicas {
+		replicas, err := k8sClient.GetReplicas(deployment)
+		if err != nil {
+			return "", fmt.Errorf("Error retrieving the replicas of %s: %w", deployment.FriendlyName, err)
+		} else if replicas > 0 {
+			return fmt.Sprintf("The pod selector of %s doesn't match any pods, but it has %d replicas", deployment.FriendlyName, replicas), nil
+		}
+	}
+	return "", nil
+}
+
+// checkPodSelector warns when the pod selector of the workload matches the wrong pods. The warning is logged and created
+// as an event when it changes, as it would otherwise be repeated every iteration. Errors are only logged.
+// The caller must hold statesMutex.
+func checkPodSelector(observed observation, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) {
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	// The pods of a scale up from zero may not be created yet
+	checkReplicas := time.Since(getState(deployment).LastScaleTime) >= podSelectorGracePeriod
+	warning, err := podSelectorWarning(k8sClient.Sync(), deployment, observed.Pods, checkReplicas)
+	if err != nil {
+		workloadLogger.Errorf("Error verifying the pod selector of %s: %s", deployment.FriendlyName, err.Error())
+		return
+	}
+	key := stateKey(deployment)
+	if lastSelectorWarnings[key] == warning {
+		return
+	}
+	lastSelectorWarnings[key] = warning
+	if warning == "" {
+		workloadLogger.Infof("The pod selector of %s matches its pods again", deployment.FriendlyName)
+		return
+	}
+	workloadLogger.Warn(warning)
+	createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonPodSelectorMismatch, warning)
+}
+
+// VerifyPodSelectors returns a warning for each workload whose pod selector matches the pods of another workload, matches
+// pods it doesn't control, or doesn't match any pods while it has replicas, as its agents would be counted from the
+// wrong pods. The pods are the ones the workloads were verified with.
+func VerifyPodSelectors(k8sClient kubernetes.Client, verified []kubernetes.VerifiedWorkload) ([]string, error) {
+	workloads := make([]*kubernetes.Workload, len(verified))
+	for i, workload := range verified {
+		workloads[i] = workload.Workload
+	}
+	warnings, err := kubernetes.OverlappingSelectors(workloads)
+	if err != nil {
+		return nil, err
+	}
+	for _, workload := range verified {
+		warning, err := podSelectorWarning(k8sClient, workload.Workload, workload.Pods, true)
+		if err != nil {
+			return nil, err
+		} else if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings, nil
+}
@@ -0,0 +1,57 @@
+package scaling
+
+import (
+	gomath "math"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+)
+
+// SLOEstimate is the number of agents needed to start jobs within the maximum queue time
+type SLOEstimate struct {
+	// ArrivalRate is the number of jobs queued per minute
+	ArrivalRate float64
+	// AverageDuration is the average duration of finished jobs
+	AverageDuration time.Duration
+	// RequiredAgents is the number of busy agents needed to meet the maximum queue time
+	RequiredAgents int32
+}
+
+// estimateSLO derives the number of agents needed to start jobs within the maximum queue time from the jobs
+// queued and finished within the observation window. Within the max queue time W, c agents finish c*W/S jobs of
+// average duration S, which has to cover the Q queued jobs and the jobs arriving at rate λ: c >= S * (Q/W + λ).
+// Returns nil if no jobs finished within the window, as the job duration is unknown.
+func estimateSLO(jobs []ci.Job, numQueuedJobs int32, sloArgs args.SLOArgs, now time.Time) *SLOEstimate {
+	windowStart := now.Add(-sloArgs.Window)
+
+	numArrivals := 0
+	numFinished := 0
+	totalDuration := time.Duration(0)
+	for _, job := range jobs {
+		if job.QueueTime.After(windowStart) {
+			numArrivals++
+		}
+		if job.FinishTime.IsZero() || job.FinishTime.Before(windowStart) {
+			continue
+		}
+		if job.StartTime.IsZero() || job.StartTime.After(job.FinishTime) {
+			continue
+		}
+		numFinished++
+		totalDuration = totalDuration + job.FinishTime.Sub(job.StartTime)
+	}
+	if numFinished == 0 {
+		return nil
+	}
+
+	arrivalRate := float64(numArrivals) / sloArgs.Window.Minutes()
+	averageDuration := totalDuration / time.Duration(numFinished)
+	requiredAgents := averageDuration.Minutes() * (float64(numQueuedJobs)/sloArgs.MaxQueueTime.Minutes() + arrivalRate)
+
+	return &SLOEstimate{
+		ArrivalRate:     arrivalRate,
+		AverageDuration: averageDuration,
+		RequiredAgents:  int32(gomath.Ceil(requiredAgents)),
+	}
+}
@@ -0,0 +1,187 @@
+package scaling
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/tracing"
+)
+
+// Snapshot is everything the scaling decision of a workload is made from, taken once per iteration, so DecideReplicas
+// doesn't call the CI backend or Kubernetes or read the scaling state. Its slices and pointers can be shared with the
+// other workloads of the pool, so they must not be modified.
+type Snapshot struct {
+	// Time is when the snapshot was taken, which the queue times, idle times, delays and windows are measured from
+	Time        time.Time
+	AgentPoolID int
+	Workload    *kubernetes.Workload
+	Agents      []ci.Agent
+	Jobs        []ci.Job
+	Pods        []corev1.Pod
+	// State is a copy of the scaling state of the workload
+	State State
+	// RollingUpdate is the rolling update of the workload, only retrieved with --hold-rolling-updates or --recycle-outdated-pods
+	RollingUpdate *kubernetes.RollingUpdate
+	// Replicas are the replicas of a StatefulSet, only retrieved with --ordinal-gaps
+	Replicas *int32
+	// RevertTo is the replicas to scale a workload scaled outside of the autoscaler back to, with the revert manual scale policy
+	RevertTo *int32
+	// Capacity is how many more agent pods the cluster can schedule, or nil if it wasn't retrieved
+	Capacity *int32
+	// Quota is how many more agent pods the ResourceQuotas of the namespace allow, or nil if it wasn't retrieved or they
+	// don't limit the agents
+	Quota *kubernetes.QuotaLimit
+	// UnhealthyGates are why the failing health gates failed, or nil if they weren't checked or passed
+	UnhealthyGates []string
+	// SpotBackfill is the number of agents the spot workload of the pool needs but can't run, if the pool has one
+	SpotBackfill *int32
+	// Constrained is true if a higher priority workload is limited by the cluster capacity
+	Constrained bool
+}
+
+// poolSnapshot is the agents and jobs of an agent pool, retrieved together once per iteration and shared by the
+// workloads of the pool, so its slices must not be modified
+type poolSnapshot struct {
+	Agents []ci.Agent
+	Jobs   []ci.Job
+	// AgentsDuration and JobsDuration are how long the agents and jobs took to retrieve
+	AgentsDuration time.Duration
+	JobsDuration   time.Duration
+}
+
+// agentsResponse is a wrapper for []ci.Agent to allow also returning an error in channels
+type agentsResponse struct {
+	Agents   []ci.Agent
+	Err      error
+	Duration time.Duration
+}
+
+// jobsResponse is a wrapper for []ci.Job to allow also returning an error in channels
+type jobsResponse struct {
+	Jobs     []ci.Job
+	Err      error
+	Duration time.Duration
+}
+
+// backendError is an error retrieving the agents and jobs of an agent pool from the CI system
+type backendError struct {
+	err error
+}
+
+func (e backendError) Error() string {
+	return e.err.Error()
+}
+
+func (e backendError) Unwrap() error {
+	return e.err
+}
+
+// fetchSnapshot retrieves the agents and jobs of an agent pool concurrently. Both must be retrieved within the deadline,
+// if it isn't 0, so a slow call doesn't leave the workloads of the pool with a stale view of the other.
+// Errors are returned as a backendError.
+func fetchSnapshot(backend ci.Backend, agentPoolID int, deadline time.Duration, span *tracing.Span) (poolSnapshot, error) {
+	// The channels are buffered so each span ends when its call finishes, regardless of the order the results are read in
+	agentsChan := make(chan agentsResponse, 1)
+	jobsChan := make(chan jobsResponse, 1)
+	agentsSpan := span.StartChild("backend.Agents")
+	jobsSpan := span.StartChild("backend.Jobs")
+
+	start := time.Now()
+
+	// Get all active agents
+	go func() {
+		defer agentsSpan.End()
+		agents, err := backend.Agents(agentPoolID)
+		agentsSpan.SetError(err)
+		agentsChan <- agentsResponse{Agents: agents, Err: err, Duration: time.Since(start)}
+	}()
+	// Get all queued jobs
+	go func() {
+		defer jobsSpan.End()
+		jobs, err := backend.Jobs(agentPoolID)
+		jobsSpan.SetError(err)
+		jobsChan <- jobsResponse{Jobs: jobs, Err: err, Duration: time.Since(start)}
+	}()
+
+	var timeout <-chan time.Time
+	if deadline > 0 {
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var agents agentsResponse
+	var jobs jobsResponse
+	for received := 0; received < 2; received++ {
+		select {
+		case agents = <-agentsChan:
+			if agents.Err != nil {
+				return poolSnapshot{}, backendError{agents.Err}
+			}
+		case jobs = <-jobsChan:
+			if jobs.Err != nil {
+				return poolSnapshot{}, backendError{jobs.Err}
+			}
+		case <-timeout:
+			return poolSnapshot{}, backendError{fmt.Errorf("Error - the agents and jobs of agent pool %d weren't retrieved within %s", agentPoolID, deadline.String())}
+		}
+	}
+	return poolSnapshot{Agents: agents.Agents, Jobs: jobs.Jobs, AgentsDuration: agents.Duration, JobsDuration: jobs.Duration}, nil
+}
+
+// takeSnapshot takes the snapshot of a workload from the observed agents, jobs and pods. The manual scales are detected,
+// and adopted manual scales that expired are forgotten, before the scaling state is copied. The capacity isn't retrieved,
+// as it's only needed for a scale up. The caller must hold statesMutex.
+func takeSnapshot(observed observation, pool poolKey, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args, constrained bool, span *tracing.Span) (Snapshot, error) {
+	agentPoolID := pool.AgentPoolID
+	snapshot := Snapshot{
+		Time:        time.Now(),
+		AgentPoolID: agentPoolID,
+		Workload:    deployment,
+		Agents:      observed.Agents,
+		Jobs:        observed.Jobs,
+		Pods:        observed.Pods,
+		Constrained: constrained,
+	}
+
+	if args.HoldRollingUpdates || args.Recycle.OutdatedPods {
+		rollingUpdateSpan := span.StartChild("kubernetes.GetRollingUpdate")
+		update, err := k8sClient.Sync().GetRollingUpdate(deployment)
+		rollingUpdateSpan.SetError(err)
+		rollingUpdateSpan.End()
+		if err != nil {
+			return Snapshot{}, err
+		}
+		snapshot.RollingUpdate = update
+	}
+
+	if checksOrdinalGaps(deployment, args.OrdinalGaps) {
+		replicas, err := k8sClient.Sync().GetReplicas(deployment)
+		if err != nil {
+			return Snapshot{}, fmt.Errorf("Error retrieving the replicas of %s: %w", deployment.FriendlyName, err)
+		}
+		snapshot.Replicas = &replicas
+	}
+
+	// The manual scales aren't detected while the workload is paused, force scaled or held for a rolling update,
+	// as it isn't scaled by the autoscaler then
+	heldForRollingUpdate := args.HoldRollingUpdates && snapshot.RollingUpdate.InProgress()
+	if state := getState(deployment); state.ForcedReplicas == nil && !state.Paused && !heldForRollingUpdate {
+		revertTo, err := detectManualScale(agentPoolID, k8sClient, deployment, args)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		snapshot.RevertTo = revertTo
+		expireManualScale(agentPoolID, deployment, snapshot.Time)
+	}
+
+	if backfill, hasSpot := spotBackfills[pool]; hasSpot {
+		snapshot.SpotBackfill = &backfill
+	}
+	snapshot.State = *getState(deployment)
+	return snapshot, nil
+}
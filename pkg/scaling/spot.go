@@ -0,0 +1,18 @@
+package scaling
+
+import (
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/math"
+)
+
+// spotBackfills are the number of agents the spot workload of each agent pool needs but can't run, by agent pool.
+// The other workloads of the pool scale up for them instead of for the queued jobs. It is guarded by statesMutex.
+var spotBackfills = make(map[poolKey]int32)
+
+// getSpotBackfill returns the number of agents a spot workload needs for its busy agents and queued jobs
+// that it won't run: pods that are unschedulable, ex: when the spot nodes were evicted and couldn't be replaced,
+// pods that failed, and agents above its maximum or that it isn't allowed to scale up to.
+func getSpotBackfill(decision *Decision) int32 {
+	needed := decision.NumActiveAgents + decision.QueueDemand
+	usable := decision.DesiredReplicas - decision.NumUnschedulablePods - decision.NumFailedPods
+	return math.MaxInt32(0, needed-usable)
+}
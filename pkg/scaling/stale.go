@@ -0,0 +1,66 @@
+package scaling
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+)
+
+// reasonCrashLoopBackOff is the reason of a container waiting to be restarted after crashing repeatedly
+const reasonCrashLoopBackOff = "CrashLoopBackOff"
+
+var staleAgentsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "azp_agent_autoscaler_stale_agents_count",
+	Help: "The number of agent pods that aren't counted as available agents, as they're crash looping, restarting or not ready and their agent isn't online",
+}, metricLabelNames)
+
+// getStalePodNames returns the pods that can't take jobs even though they're running or starting: the pods that are crash
+// looping, whose containers restarted the stale pod restarts, or that have been not ready for the stale pod timeout.
+// The pods of online agents are never stale, as the CI system can assign them jobs.
+func getStalePodNames(pods []corev1.Pod, agents []ci.Agent, stalePodsArgs args.StalePodsArgs, now time.Time) collections.StringSet {
+	stalePodNames := make(collections.StringSet)
+	if !stalePodsArgs.Enabled() {
+		return stalePodNames
+	}
+	onlinePodNames := make(collections.StringSet)
+	for _, agent := range agents {
+		if agent.Online {
+			onlinePodNames.Add(agent.PodName)
+		}
+	}
+	for _, pod := range pods {
+		if !onlinePodNames.Contains(pod.Name) && isStalePod(pod, stalePodsArgs, now) {
+			stalePodNames.Add(pod.Name)
+		}
+	}
+	return stalePodNames
+}
+
+// isStalePod returns true if a pod is crash looping, restarted too many times or has been not ready for too long
+func isStalePod(pod corev1.Pod, stalePodsArgs args.StalePodsArgs, now time.Time) bool {
+	if pod.DeletionTimestamp != nil || (pod.Status.Phase != corev1.PodRunning && pod.Status.Phase != corev1.PodPending) {
+		return false
+	}
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if waiting := containerStatus.State.Waiting; waiting != nil && waiting.Reason == reasonCrashLoopBackOff {
+			return true
+		}
+		if stalePodsArgs.Restarts > 0 && containerStatus.RestartCount >= stalePodsArgs.Restarts {
+			return true
+		}
+	}
+	if stalePodsArgs.NotReadyTimeout > 0 && pod.Status.Phase == corev1.PodRunning {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionFalse && now.Sub(condition.LastTransitionTime.Time) >= stalePodsArgs.NotReadyTimeout {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package scaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/store"
+)
+
+// ScaleDirection is the direction of a scaling operation
+type ScaleDirection string
+
+const (
+	// ScaleDirectionUp is set when the agents were scaled up
+	ScaleDirectionUp ScaleDirection = "up"
+	// ScaleDirectionDown is set when the agents were scaled down
+	ScaleDirectionDown ScaleDirection = "down"
+)
+
+// State is the scaling state of a workload that is kept between autoscaling iterations
+type State struct {
+	LastScaleTime      time.Time      `json:"lastScaleTime"`
+	LastScaleDirection ScaleDirection `json:"lastScaleDirection,omitempty"`
+	LastScaleDown      time.Time      `json:"lastScaleDown"`
+
+	// ScaleUpPausedUntil is when scale ups are allowed again after pods were unschedulable
+	ScaleUpPausedUntil time.Time `json:"scaleUpPausedUntil"`
+	// PendingBackoff is the duration of the last scale up pause
+	PendingBackoff time.Duration `json:"pendingBackoff,omitempty"`
+
+	// Registration is the scale up whose agent pods haven't registered yet, if the registration is verified
+	Registration *Registration `json:"registration,omitempty"`
+	// RegistrationPausedUntil is when scale ups are allowed again after the agent pods of a scale up didn't register
+	RegistrationPausedUntil time.Time `json:"registrationPausedUntil"`
+	// RegistrationBackoff is the duration of the last scale up pause after the agent pods didn't register
+	RegistrationBackoff time.Duration `json:"registrationBackoff,omitempty"`
+	// RegistrationFailures is the number of consecutive scale ups whose agent pods didn't register
+	RegistrationFailures int32 `json:"registrationFailures,omitempty"`
+
+	// LastReplicas are the replicas the autoscaler last scaled the workload to, to detect when it's scaled manually
+	LastReplicas *int32 `json:"lastReplicas,omitempty"`
+	// ManualReplicas are the replicas of a manual scale kept until ManualScaleUntil with the adopt manual scale policy,
+	// as the minimum after a manual scale up or as the maximum after a manual scale down
+	ManualReplicas       *int32         `json:"manualReplicas,omitempty"`
+	ManualScaleDirection ScaleDirection `json:"manualScaleDirection,omitempty"`
+	ManualScaleUntil     time.Time      `json:"manualScaleUntil"`
+
+	// BackendUnavailableSince is when the agents and jobs of the workload's pool first couldn't be retrieved, if they
+	// can't be retrieved
+	BackendUnavailableSince time.Time `json:"backendUnavailableSince"`
+
+	// RecentScales are the times of the scale operations within the rate limit window
+	RecentScales []time.Time `json:"recentScales,omitempty"`
+
+	// RecentOfflineReplacements are the times the pods of offline agents were deleted within the last hour
+	RecentOfflineReplacements []time.Time `json:"recentOfflineReplacements,omitempty"`
+
+	// RolloverCompleteTo is the green workload that the agents were rolled over to, once the rollover completed
+	RolloverCompleteTo string `json:"rolloverCompleteTo,omitempty"`
+
+	// Drain is the scale down whose agents are drained before their pods are removed, with --drain-timeout
+	Drain *Drain `json:"drain,omitempty"`
+
+	// Paused is set when autoscaling was paused through the admin API
+	Paused bool `json:"paused,omitempty"`
+	// ForcedReplicas holds the workload at a number of replicas until autoscaling is resumed
+	ForcedReplicas *int32 `json:"forcedReplicas,omitempty"`
+
+	// changed is set when the state was changed outside of scaling, so it is saved on the next iteration
+	changed bool
+}
+
+var states = make(map[string]*State)
+
+// statesMutex guards the states, which are read and changed by the admin API while autoscaling
+var statesMutex sync.Mutex
+
+// stateKey returns the key of a workload's state, which is also a valid ConfigMap key
+func stateKey(workload *kubernetes.Workload) string {
+	return strings.ToLower(workload.Namespace + "." + workload.Kind + "." + workload.Name)
+}
+
+// getState returns the state of a workload, creating it if it doesn't exist
+func getState(workload *kubernetes.Workload) *State {
+	key := stateKey(workload)
+	state, exists := states[key]
+	if !exists {
+		state = &State{
+			LastScaleTime: time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC),
+			LastScaleDown: time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC),
+		}
+		states[key] = state
+	}
+	return state
+}
+
+// recordScale updates the state of a workload after it has been scaled.
+// Scale operations are kept for the rate limit window.
+func recordScale(workload *kubernetes.Workload, direction ScaleDirection, replicas int32, rateLimitWindow time.Duration) {
+	state := getState(workload)
+	state.LastReplicas = &replicas
+	state.LastScaleTime = time.Now()
+	state.LastScaleDirection = direction
+	if direction == ScaleDirectionDown {
+		state.LastScaleDown = state.LastScaleTime
+	}
+	if rateLimitWindow > 0 {
+		state.RecentScales = append(state.getScalesSince(state.LastScaleTime.Add(-rateLimitWindow)), state.LastScaleTime)
+	}
+}
+
+// getScalesSince returns the recent scale operations after the given time
+func (s *State) getScalesSince(since time.Time) []time.Time {
+	return timesAfter(s.RecentScales, since)
+}
+
+// timesAfter returns the times after the given time
+func timesAfter(times []time.Time, since time.Time) []time.Time {
+	var after []time.Time
+	for _, t := range times {
+		if t.After(since) {
+			after = append(after, t)
+		}
+	}
+	return after
+}
+
+// GetState returns a copy of the state of a workload
+func GetState(workload *kubernetes.Workload) State {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	return *getState(workload)
+}
+
+// Pause stops autoscaling a workload until it is resumed
+func Pause(workload *kubernetes.Workload) {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	state := getState(workload)
+	state.Paused = true
+	state.changed = true
+}
+
+// ForceScale scales a workload to a number of replicas and holds it there until autoscaling is resumed
+func ForceScale(workload *kubernetes.Workload, replicas int32) {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	state := getState(workload)
+	state.Paused = true
+	state.ForcedReplicas = &replicas
+	state.changed = true
+}
+
+// Resume resumes autoscaling a paused or force scaled workload
+func Resume(workload *kubernetes.Workload) {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	state := getState(workload)
+	state.Paused = false
+	state.ForcedReplicas = nil
+	// The workload can be scaled manually while autoscaling is paused, which isn't a manual scale to handle
+	state.LastReplicas = nil
+	state.changed = true
+}
+
+// ResetState forgets the scaling state of every workload, as if the autoscaler was restarted
+func ResetState() {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	states = make(map[string]*State)
+}
+
+// LoadState restores the scaling state from a store. If nothing was persisted yet, nothing is loaded.
+func LoadState(stateStore store.Store) error {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+
+	data, err := stateStore.Load()
+	if err != nil {
+		return fmt.Errorf("Error loading state from %s: %w", stateStore.Name(), err)
+	}
+	for key, value := range data {
+		state := &State{}
+		if err := json.Unmarshal([]byte(value), state); err != nil {
+			logger.Warnf("Ignoring invalid state %s in %s: %s", key, stateStore.Name(), err.Error())
+			continue
+		}
+		logger.Debugf("Loaded state %s from %s: last scaled %s at %s", key, stateStore.Name(), state.LastScaleDirection, state.LastScaleTime.String())
+		states[key] = state
+	}
+	return nil
+}
+
+// SaveState persists the scaling state to a store.
+// It is called while autoscaling, so the caller must hold statesMutex.
+func SaveState(stateStore store.Store) error {
+	data := make(map[string]string)
+	for key, state := range states {
+		value, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		data[key] = string(value)
+	}
+	if err := stateStore.Save(data); err != nil {
+		return fmt.Errorf("Error saving state to %s: %w", stateStore.Name(), err)
+	}
+	return nil
+}
+
+// StateStore returns the store of the scaling state of the args
+func StateStore(k8sClient kubernetes.Client, stateArgs args.Args) store.Store {
+	return store.New(stateArgs.Store, k8sClient, stateArgs.State.Namespace, stateArgs.State.ConfigMapName)
+}
@@ -0,0 +1,77 @@
+package scaling
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// targetsScaleDown returns true if the scale downs of a workload delete the pods of chosen idle agents. StatefulSets
+// always remove the pods with the highest ordinals, and recreate any other deleted pod, so they can't be targeted.
+func targetsScaleDown(deployment *kubernetes.Workload, args args.Args) bool {
+	return args.TargetedScaleDown && !strings.EqualFold(deployment.Kind, "StatefulSet")
+}
+
+// getPodsToRemove returns up to count pods a targeted scale down can delete: the pods of a forced drain, then the stale
+// pods, whose agents can't take jobs, then the pods of the agents that have been idle the longest. The pods of the
+// active agents, of the agents idle for less than the idle delay and of the agents that aren't online yet are never
+// removed, unless their drain is forced.
+func getPodsToRemove(pods []corev1.Pod, agents []ci.Agent, stalePodNames collections.StringSet, idleTimes map[string]time.Duration, excludedPodNames collections.StringSet, forcedPodNames collections.StringSet, count int32) []string {
+	idleAgentPodNames := make(collections.StringSet)
+	for _, agent := range agents {
+		if agent.Online && !agent.Busy {
+			idleAgentPodNames.Add(agent.PodName)
+		}
+	}
+	var forced, stale, idle []string
+	for _, pod := range pods {
+		if forcedPodNames.Contains(pod.Name) {
+			forced = append(forced, pod.Name)
+		} else if excludedPodNames.Contains(pod.Name) {
+			continue
+		} else if stalePodNames.Contains(pod.Name) {
+			stale = append(stale, pod.Name)
+		} else if idleAgentPodNames.Contains(pod.Name) {
+			idle = append(idle, pod.Name)
+		}
+	}
+	sort.Strings(stale)
+	sort.Slice(idle, func(i, j int) bool {
+		if idleTimes[idle[i]] != idleTimes[idle[j]] {
+			return idleTimes[idle[i]] > idleTimes[idle[j]]
+		}
+		return idle[i] < idle[j]
+	})
+	sort.Strings(forced)
+	podNames := append(append(forced, stale...), idle...)
+	if int32(len(podNames)) > count {
+		podNames = podNames[:count]
+	}
+	return podNames
+}
+
+// removeTargetedPods deletes the pods chosen by a targeted scale down, before the replicas are lowered to the remaining
+// pods. The ReplicaSet or ReplicationController doesn't count the terminating pods, so lowering the replicas right after
+// doesn't remove any other pod, and it removes the pending pods it may have created to replace them first.
+// It returns the number of pods deleted, which is less than chosen if deleting a pod failed.
+func removeTargetedPods(decision *Decision, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload) (int32, error) {
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+	removed := int32(0)
+	for _, podName := range decision.PodsToRemove {
+		workloadLogger.Infof("Deleting the idle agent pod %s of %s", podName, deployment.FriendlyName)
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: deployment.Namespace}}
+		if err := k8sClient.Sync().DeletePod(pod); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,80 @@
+package scaling
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const (
+	// phaseAgents is the retrieval of the agents of the pool from the CI system
+	phaseAgents = "agents"
+	// phaseJobs is the retrieval of the jobs of the pool from the CI system
+	phaseJobs = "jobs"
+	// phasePods is the listing of the pods of the workload
+	phasePods = "pods"
+	// phasePolicy is the decision of the replicas, with the capacity, quotas, health gates and decision hook it needs
+	phasePolicy = "policy"
+	// phaseScale is the scale call of the workload
+	phaseScale = "scale"
+)
+
+// phases are the phases of an autoscaling iteration, in the order they're logged
+var phases = []string{phaseAgents, phaseJobs, phasePods, phasePolicy, phaseScale}
+
+var phaseDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "azp_agent_autoscaler_cycle_phase_duration_seconds",
+	Help:    "How long each phase of an autoscaling iteration took, by phase: agents, jobs, pods, policy or scale",
+	Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+}, append(metricLabelNames, "phase"))
+
+// cycleTimings are how long the phases of an autoscaling iteration of a workload took. A phase that didn't run, ex:
+// the scale call when the workload isn't scaled, isn't recorded. All methods are safe to call on nil cycleTimings,
+// which plan uses as it doesn't report the timings.
+type cycleTimings struct {
+	start     time.Time
+	durations map[string]time.Duration
+}
+
+func newCycleTimings() *cycleTimings {
+	return &cycleTimings{start: time.Now(), durations: make(map[string]time.Duration)}
+}
+
+// record records how long a phase took. It must be called by the goroutine of the iteration.
+func (t *cycleTimings) record(phase string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+	t.durations[phase] = duration
+}
+
+// report observes the durations of the phases in the metrics, and logs them at debug level, so the dependency causing
+// a slow iteration can be told apart. The durations are only formatted if they're logged, as it's done every iteration.
+func (t *cycleTimings) report(workloadLogger *log.Entry, agentPoolID int, deployment *kubernetes.Workload) {
+	if t == nil {
+		return
+	}
+	debug := workloadLogger.Logger.IsLevelEnabled(log.DebugLevel)
+	pool := strconv.Itoa(agentPoolID)
+	var logged []string
+	for _, phase := range phases {
+		duration, recorded := t.durations[phase]
+		if !recorded {
+			continue
+		}
+		// The label values are in the order of metricLabelNames
+		phaseDurationHistogram.WithLabelValues(pool, deployment.Namespace, deployment.FriendlyName, phase).Observe(duration.Seconds())
+		if debug {
+			logged = append(logged, phase+" "+duration.String())
+		}
+	}
+	if debug {
+		workloadLogger.Debugf("The iteration took %s: %s", time.Since(t.start).String(), strings.Join(logged, ", "))
+	}
+}
@@ -0,0 +1,67 @@
+package scaling
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+const eventReasonScaleRejected = "ScaleRejected"
+
+var scaleRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "azp_agent_autoscaler_scale_rejected_count",
+	Help: "The total number of scales rejected by a server-side dry run, ex: by an admission webhook or a resource quota",
+}, metricLabelNames)
+
+// ErrScaleRejected matches the errors of a scale rejected by a server-side dry run, with errors.Is
+var ErrScaleRejected = errors.New("The scale was rejected by a server-side dry run")
+
+// ScaleRejectedError is returned when the API server rejected a scale in a server-side dry run, ex: an admission webhook
+// denied it. It wraps the error of the API server.
+type ScaleRejectedError struct {
+	From int32
+	To   int32
+	Err  error
+}
+
+func (e ScaleRejectedError) Error() string {
+	return fmt.Sprintf("Scaling from %d to %d replicas was rejected by a server-side dry run: %s", e.From, e.To, e.Err.Error())
+}
+
+// Is matches ErrScaleRejected
+func (e ScaleRejectedError) Is(target error) bool {
+	return target == ErrScaleRejected
+}
+
+// Unwrap returns the error of the API server
+func (e ScaleRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// verifyScale scales the agent deployment with a server-side dry run if enabled, and returns an error if the API server
+// rejected it, so the scale isn't applied. The other errors of the dry run are only logged, ex: an API server that
+// doesn't support dry runs, as the scale itself can still succeed.
+func verifyScale(decision *Decision, agentPoolID int, k8sClient kubernetes.ClientAsync, deployment *kubernetes.Workload, args args.Args) error {
+	if !args.VerifyScale {
+		return nil
+	}
+	workloadLogger := workloadLogger(agentPoolID, deployment)
+
+	err := k8sClient.Sync().VerifyScale(deployment, decision.DesiredReplicas)
+	if err == nil {
+		return nil
+	} else if !kubernetes.IsScaleRejected(err) {
+		workloadLogger.Warnf("Error verifying the scale of %s with a dry run: %s", deployment.FriendlyName, err.Error())
+		return nil
+	}
+	scaleRejectedCounter.With(metricLabels(agentPoolID, deployment)).Inc()
+	rejected := ScaleRejectedError{From: decision.NumPods, To: decision.DesiredReplicas, Err: err}
+	createEvent(k8sClient, deployment, args, corev1.EventTypeWarning, eventReasonScaleRejected, rejected.Error())
+	return rejected
+}
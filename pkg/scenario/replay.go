@@ -0,0 +1,79 @@
+package scenario
+
+import (
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// Replayed is the decision a policy made from a recorded snapshot, compared to the decision the autoscaler made from it
+type Replayed struct {
+	Recording scaling.Recording
+	Decision  *scaling.Decision
+}
+
+// Changed returns true if the policy decided other replicas than the autoscaler did
+func (r Replayed) Changed() bool {
+	return r.Decision.DesiredReplicas != r.Recording.DesiredReplicas
+}
+
+// ReplaySummary compares the decisions a policy made from the recordings of a workload to the recorded decisions
+type ReplaySummary struct {
+	Workload string `json:"workload"`
+	// Snapshots are the number of recorded snapshots
+	Snapshots int `json:"snapshots"`
+	// Changed are the number of snapshots the policy decided other replicas from
+	Changed int `json:"changed"`
+	// RecordedReplicas and ReplayedReplicas are the average replicas of the recorded and replayed decisions, which the
+	// cost of the agents follows
+	RecordedReplicas float64 `json:"recordedReplicas"`
+	ReplayedReplicas float64 `json:"replayedReplicas"`
+	// RecordedScaleUps and ReplayedScaleUps are the number of recorded and replayed decisions to scale up
+	RecordedScaleUps int `json:"recordedScaleUps"`
+	ReplayedScaleUps int `json:"replayedScaleUps"`
+}
+
+// Replay decides the replicas of each recorded snapshot with the scaling policy. Each snapshot is decided with its
+// recorded pods and scaling state, which followed the recorded decisions, so a replay compares single decisions rather
+// than simulating how the workload would have been scaled by the policy over time.
+func Replay(recordings []scaling.Recording, policy args.Args) []Replayed {
+	replayed := make([]Replayed, len(recordings))
+	for i, recording := range recordings {
+		replayed[i] = Replayed{Recording: recording, Decision: scaling.DecideReplicas(recording.Snapshot, policy)}
+	}
+	return replayed
+}
+
+// SummarizeReplay summarizes the replayed decisions of each workload, in the order the workloads were first recorded
+func SummarizeReplay(replayed []Replayed) []ReplaySummary {
+	var summaries []ReplaySummary
+	indexes := make(map[string]int)
+	for _, r := range replayed {
+		workload := r.Recording.Snapshot.Workload
+		name := workload.Namespace + "/" + workload.FriendlyName
+		index, found := indexes[name]
+		if !found {
+			index = len(summaries)
+			indexes[name] = index
+			summaries = append(summaries, ReplaySummary{Workload: name})
+		}
+		summary := &summaries[index]
+		summary.Snapshots++
+		if r.Changed() {
+			summary.Changed++
+		}
+		summary.RecordedReplicas += float64(r.Recording.DesiredReplicas)
+		summary.ReplayedReplicas += float64(r.Decision.DesiredReplicas)
+		numPods := r.Decision.NumPods
+		if r.Recording.DesiredReplicas > numPods {
+			summary.RecordedScaleUps++
+		}
+		if r.Decision.DesiredReplicas > numPods {
+			summary.ReplayedScaleUps++
+		}
+	}
+	for i := range summaries {
+		summaries[i].RecordedReplicas /= float64(summaries[i].Snapshots)
+		summaries[i].ReplayedReplicas /= float64(summaries[i].Snapshots)
+	}
+	return summaries
+}
@@ -0,0 +1,221 @@
+// Package scenario tests a scaling policy against scenarios, which describe the agents, jobs and state of a workload and
+// the decision expected from them, without a cluster or a CI system. Scenarios are written as YAML files, for the
+// test-policy subcommand, or as Go tables.
+package scenario
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// DefaultTime is the time of the scenarios that don't set one, so they always make the same decision
+var DefaultTime = time.Date(2021, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+// agentPoolID is the pool of the scenarios' agents, which the policy doesn't depend on
+const agentPoolID = 1
+
+// File is a YAML file of scenarios
+type File struct {
+	Scenarios []Scenario `yaml:"scenarios"`
+}
+
+// Scenario is the agents, jobs and scaling state of a workload at a point in time, and the decision expected from them
+type Scenario struct {
+	Name string `yaml:"name"`
+	// Time is when the decision is made, which the queue times, idle times and delays are measured from, and which
+	// the maintenance windows apply to. Defaults to DefaultTime.
+	Time time.Time `yaml:"time"`
+	// Kind is the kind of the workload, StatefulSet by default
+	Kind   string `yaml:"kind"`
+	Agents Agents `yaml:"agents"`
+	Jobs   Jobs   `yaml:"jobs"`
+	State  State  `yaml:"state"`
+	Expect Expect `yaml:"expect"`
+}
+
+// Agents are the number of agent pods in each state. The pods are named <workload>-<n> in the order of the fields.
+type Agents struct {
+	// Busy agents are running a job
+	Busy int `yaml:"busy"`
+	// Idle agents are online without a job
+	Idle int `yaml:"idle"`
+	// IdleFor is how long the idle agents have been idle, 1h by default
+	IdleFor time.Duration `yaml:"idleFor"`
+	// Offline agents have a running pod whose agent is offline
+	Offline int `yaml:"offline"`
+	// Pending pods are starting and their agent isn't registered yet
+	Pending int `yaml:"pending"`
+	// Unschedulable pods are pending because no node can run them
+	Unschedulable int `yaml:"unschedulable"`
+}
+
+// Jobs are the number of jobs of the pool that are waiting for an agent. The running jobs are those of the busy agents.
+type Jobs struct {
+	Queued int `yaml:"queued"`
+	// QueuedFor is how long the queued jobs have been queued, 1m by default
+	QueuedFor time.Duration `yaml:"queuedFor"`
+	// Waiting jobs are waiting for an approval or a check before they're queued
+	Waiting int `yaml:"waiting"`
+}
+
+// State is the scaling state of the workload from its previous decisions
+type State struct {
+	// LastScaleDown is how long ago the workload was last scaled down, never if 0
+	LastScaleDown time.Duration `yaml:"lastScaleDown"`
+	// Paused is true if autoscaling was paused through the admin API
+	Paused bool `yaml:"paused"`
+	// ForcedReplicas are the replicas the workload was force scaled to through the admin API
+	ForcedReplicas *int32 `yaml:"forcedReplicas"`
+}
+
+// Expect is the decision expected from a scenario. Only the fields that are set are checked.
+type Expect struct {
+	Replicas *int32 `yaml:"replicas"`
+	// Suppressors are the limits that prevented or reduced the scaling, ex: max or cooldown. An empty list expects none.
+	Suppressors *[]string `yaml:"suppressors"`
+	// Reason is text the reason of the decision must contain
+	Reason string `yaml:"reason"`
+}
+
+// Result is the decision a policy made from a scenario
+type Result struct {
+	Scenario Scenario
+	Decision *scaling.Decision
+	// Failures describe how the decision differs from the expected decision
+	Failures []string
+}
+
+// Passed returns true if the policy made the expected decision
+func (r Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// Load reads the scenarios of a YAML file
+func Load(path string) ([]Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file File
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, err)
+	}
+	if len(file.Scenarios) == 0 {
+		return nil, fmt.Errorf("%s doesn't have any scenarios", path)
+	}
+	for i, scenario := range file.Scenarios {
+		if scenario.Name == "" {
+			return nil, fmt.Errorf("Scenario %d of %s doesn't have a name", i+1, path)
+		}
+	}
+	return file.Scenarios, nil
+}
+
+// Run decides the replicas of the scenario with the scaling policy and compares the decision to the expected decision
+func Run(scenario Scenario, policy args.Args) Result {
+	decision := scaling.DecideReplicas(scenario.Snapshot(policy), policy)
+	result := Result{Scenario: scenario, Decision: decision}
+	expect := scenario.Expect
+	if expect.Replicas != nil && decision.DesiredReplicas != *expect.Replicas {
+		result.Failures = append(result.Failures, fmt.Sprintf("expected %d replicas, but got %d", *expect.Replicas, decision.DesiredReplicas))
+	}
+	if expect.Suppressors != nil {
+		expected, actual := strings.Join(*expect.Suppressors, ","), strings.Join(decision.SuppressorNames(), ",")
+		if expected != actual {
+			result.Failures = append(result.Failures, fmt.Sprintf("expected the suppressors [%s], but got [%s]", expected, actual))
+		}
+	}
+	if expect.Reason != "" && !strings.Contains(decision.Reason, expect.Reason) {
+		result.Failures = append(result.Failures, fmt.Sprintf("expected the reason to contain %q, but got %q", expect.Reason, decision.Reason))
+	}
+	return result
+}
+
+// Snapshot returns the snapshot of the workload of the policy described by the scenario
+func (s Scenario) Snapshot(policy args.Args) scaling.Snapshot {
+	now := s.Time
+	if now.IsZero() {
+		now = DefaultTime
+	}
+	kind := s.Kind
+	if kind == "" {
+		kind = "StatefulSet"
+	}
+	name := policy.Kubernetes.Name
+	if name == "" {
+		name = "azp-agent"
+	}
+	workload := &kubernetes.Workload{
+		ObjectMeta:      metav1.ObjectMeta{Name: name, Namespace: policy.Kubernetes.Namespace},
+		TypeMeta:        metav1.TypeMeta{Kind: kind},
+		FriendlyName:    fmt.Sprintf("%s/%s", strings.ToLower(kind), name),
+		PodTemplateSpec: &corev1.PodTemplateSpec{},
+	}
+	snapshot := scaling.Snapshot{Time: now, AgentPoolID: agentPoolID, Workload: workload}
+
+	idleFor, queuedFor := s.Agents.IdleFor, s.Jobs.QueuedFor
+	if idleFor == 0 {
+		idleFor = time.Hour
+	}
+	if queuedFor == 0 {
+		queuedFor = time.Minute
+	}
+	startTime := metav1.NewTime(now.Add(-24 * time.Hour))
+	running := corev1.PodStatus{
+		Phase:             corev1.PodRunning,
+		StartTime:         &startTime,
+		ContainerStatuses: []corev1.ContainerStatus{{State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}},
+	}
+	pending := corev1.PodStatus{Phase: corev1.PodPending}
+	unschedulable := corev1.PodStatus{
+		Phase:      corev1.PodPending,
+		Conditions: []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: corev1.PodReasonUnschedulable}},
+	}
+
+	addPods := func(count int, status corev1.PodStatus, agent *ci.Agent) {
+		for i := 0; i < count; i++ {
+			podName := fmt.Sprintf("%s-%d", name, len(snapshot.Pods))
+			snapshot.Pods = append(snapshot.Pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: workload.Namespace}, Status: status})
+			if agent == nil {
+				continue
+			}
+			podAgent := *agent
+			podAgent.ID, podAgent.Name, podAgent.PodName = len(snapshot.Agents)+1, podName, podName
+			snapshot.Agents = append(snapshot.Agents, podAgent)
+			if podAgent.Busy {
+				snapshot.Jobs = append(snapshot.Jobs, ci.Job{QueueTime: now.Add(-time.Hour), StartTime: now.Add(-30 * time.Minute), AgentName: podName, MatchesAllAgents: true})
+			}
+		}
+	}
+	addPods(s.Agents.Busy, running, &ci.Agent{Status: "online", Online: true, Enabled: true, Busy: true})
+	addPods(s.Agents.Idle, running, &ci.Agent{Status: "online", Online: true, Enabled: true, LastJobFinished: now.Add(-idleFor)})
+	addPods(s.Agents.Offline, running, &ci.Agent{Status: "offline", Enabled: true})
+	addPods(s.Agents.Pending, pending, nil)
+	addPods(s.Agents.Unschedulable, unschedulable, nil)
+
+	for i := 0; i < s.Jobs.Queued; i++ {
+		snapshot.Jobs = append(snapshot.Jobs, ci.Job{QueueTime: now.Add(-queuedFor), MatchesAllAgents: true})
+	}
+	for i := 0; i < s.Jobs.Waiting; i++ {
+		snapshot.Jobs = append(snapshot.Jobs, ci.Job{QueueTime: now.Add(-queuedFor), MatchesAllAgents: true, Gated: true})
+	}
+
+	if s.State.LastScaleDown > 0 {
+		snapshot.State.LastScaleDown = now.Add(-s.State.LastScaleDown)
+		snapshot.State.LastScaleTime = snapshot.State.LastScaleDown
+	}
+	snapshot.State.Paused = s.State.Paused
+	snapshot.State.ForcedReplicas = s.State.ForcedReplicas
+	return snapshot
+}
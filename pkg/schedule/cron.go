@@ -0,0 +1,289 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/collections"
+)
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// maxCronSearch limits how far Next and Previous search for the next or previous time a cron expression fires, so an
+// expression that never fires, ex: on the 30th of February, doesn't search forever. It covers the 29th of February of
+// the next leap year.
+const maxCronSearch = 5 * 366 * 24 * time.Hour
+
+// Cron is a parsed 5 field cron expression: minute, hour, day of month, month and day of week
+type Cron struct {
+	expression string
+	// location is the time zone the expression is evaluated in, or the time zone of the evaluated times if nil
+	location *time.Location
+
+	minutes     collections.IntSet
+	hours       collections.IntSet
+	daysOfMonth collections.IntSet
+	months      collections.IntSet
+	daysOfWeek  collections.IntSet
+
+	// Like in cron, if both the day of month and day of week are restricted, either can match
+	daysOfMonthRestricted bool
+	daysOfWeekRestricted  bool
+}
+
+// ParseCron parses a 5 field cron expression evaluated in the given time zone, or in the time zone of the evaluated
+// times if nil. Fields support *, lists (1,2), ranges (1-5), steps (*/15, 1-30/2), and 3 letter month and weekday names.
+// The time zone can be overridden with a CRON_TZ= or TZ= prefix, ex: CRON_TZ=Europe/Paris 0 2 * * *.
+func ParseCron(expression string, location *time.Location) (*Cron, error) {
+	fieldsExpression, location, err := parseTimeZonePrefix(expression, location)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(fieldsExpression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression '%s': expected 5 fields, got %d", expression, len(fields))
+	}
+
+	cron := &Cron{expression: strings.TrimSpace(expression), location: location}
+	if cron.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("Invalid minute in cron expression '%s': %w", expression, err)
+	}
+	if cron.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("Invalid hour in cron expression '%s': %w", expression, err)
+	}
+	if cron.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("Invalid day of month in cron expression '%s': %w", expression, err)
+	}
+	if cron.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("Invalid month in cron expression '%s': %w", expression, err)
+	}
+	if cron.daysOfWeek, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, fmt.Errorf("Invalid day of week in cron expression '%s': %w", expression, err)
+	}
+	// Both 0 and 7 are Sunday
+	if cron.daysOfWeek.Contains(7) {
+		cron.daysOfWeek.Add(0)
+	}
+	// A day field starting with * isn't restricted, even with a step, ex: */2
+	cron.daysOfMonthRestricted = !strings.HasPrefix(fields[2], "*")
+	cron.daysOfWeekRestricted = !strings.HasPrefix(fields[4], "*")
+
+	return cron, nil
+}
+
+func parseCronField(field string, min int, max int, names map[string]int) (collections.IntSet, error) {
+	values := make(collections.IntSet)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step '%s'", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			rangeParts := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = parseCronValue(rangeParts[0], min, max, names); err != nil {
+				return nil, err
+			}
+			end = start
+			if len(rangeParts) == 2 {
+				if end, err = parseCronValue(rangeParts[1], min, max, names); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				// 5/15 means every 15 starting at 5
+				end = max
+			}
+			if end < start {
+				return nil, fmt.Errorf("invalid range '%s'", part)
+			}
+		}
+
+		for value := start; value <= end; value += step {
+			values.Add(value)
+		}
+	}
+	return values, nil
+}
+
+func parseCronValue(value string, min int, max int, names map[string]int) (int, error) {
+	if named, exists := names[strings.ToLower(value)]; exists {
+		return named, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", value)
+	}
+	if number < min || number > max {
+		return 0, fmt.Errorf("value %d is not between %d and %d", number, min, max)
+	}
+	return number, nil
+}
+
+// Matches returns true if the cron expression matches the wall clock minute of the given time in its time zone
+func (c *Cron) Matches(t time.Time) bool {
+	return c.matchesWallClock(c.in(t))
+}
+
+// FiresAt returns true if the cron expression fires at the minute of the given time. Unlike Matches, it's safe across
+// daylight saving time transitions, like cron: the wall clock times skipped when the clocks go forward fire at the first
+// minute after the transition, and the wall clock times repeated when the clocks go back only fire the first time.
+func (c *Cron) FiresAt(t time.Time) bool {
+	minute := t.Truncate(time.Minute)
+	local := c.in(minute)
+	wall := wallClock(local)
+
+	// The clocks went forward, so the skipped wall clock times fire now
+	if expected := wallClock(c.in(minute.Add(-time.Minute))).Add(time.Minute); wall.After(expected) {
+		for skipped := expected; !skipped.After(wall); skipped = skipped.Add(time.Minute) {
+			if c.matchesWallClock(skipped) {
+				return true
+			}
+		}
+		return false
+	}
+	if !c.matchesWallClock(local) {
+		return false
+	}
+	// The clocks went back within the last day, so this wall clock time may have already fired with the earlier offset
+	_, offset := local.Zone()
+	if _, earlierOffset := c.in(minute.Add(-24 * time.Hour)).Zone(); earlierOffset > offset {
+		earlier := minute.Add(-time.Duration(earlierOffset-offset) * time.Second)
+		if wallClock(c.in(earlier)).Equal(wall) {
+			return false
+		}
+	}
+	return true
+}
+
+// Next returns the first minute after the given time that the cron expression fires at, or the zero time if it
+// doesn't fire within the next 5 years
+func (c *Cron) Next(t time.Time) time.Time {
+	limit := t.Add(maxCronSearch)
+	for minute := t.Truncate(time.Minute).Add(time.Minute); minute.Before(limit); {
+		// Skip to the next day if the day doesn't match
+		if local := c.in(minute); !c.matchesDay(local) {
+			minute = time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, local.Location())
+			continue
+		}
+		if c.FiresAt(minute) {
+			return minute
+		}
+		minute = minute.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// Previous returns the last minute at or before the given time that the cron expression fires at, or the zero time if
+// it didn't fire within the previous 5 years
+func (c *Cron) Previous(t time.Time) time.Time {
+	return c.previous(t, t.Add(-maxCronSearch))
+}
+
+// previous returns the last minute at or before the given time that the cron expression fires at, or the zero time if
+// it didn't fire since the limit. It walks back the matching days, hours and minutes instead of every minute.
+func (c *Cron) previous(t time.Time, limit time.Time) time.Time {
+	minute := t.Truncate(time.Minute)
+	local := c.in(minute)
+	for day := 0; ; day++ {
+		year, month, dayOfMonth := local.Year(), local.Month(), local.Day()-day
+		if time.Date(year, month, dayOfMonth+1, 0, 0, 0, 0, local.Location()).Before(limit) {
+			return time.Time{}
+		}
+		if !c.matchesDay(time.Date(year, month, dayOfMonth, 0, 0, 0, 0, time.UTC)) {
+			continue
+		}
+		for hour := 23; hour >= 0; hour-- {
+			if !c.hours.Contains(hour) {
+				continue
+			}
+			for minuteOfHour := 59; minuteOfHour >= 0; minuteOfHour-- {
+				if !c.minutes.Contains(minuteOfHour) {
+					continue
+				}
+				fire := c.fireTime(time.Date(year, month, dayOfMonth, hour, minuteOfHour, 0, 0, time.UTC), local.Location())
+				if fire.After(minute) {
+					continue
+				} else if fire.Before(limit) {
+					return time.Time{}
+				} else if c.FiresAt(fire) {
+					return fire
+				}
+			}
+		}
+	}
+}
+
+// fireTime returns the minute that a wall clock time would fire at in the given time zone, like FiresAt: the first
+// minute after the transition if the clocks went forward past it, or its first occurrence if the clocks went back
+func (c *Cron) fireTime(wall time.Time, location *time.Location) time.Time {
+	fire := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, location)
+	// The wall clock time was skipped, so it fires at the first minute after it
+	if wallClock(c.in(fire)).After(wall) {
+		for wallClock(c.in(fire.Add(-time.Minute))).After(wall) {
+			fire = fire.Add(-time.Minute)
+		}
+	}
+	for wallClock(c.in(fire)).Before(wall) {
+		fire = fire.Add(time.Minute)
+	}
+	// The wall clock time was repeated, so it fires with the earlier offset
+	_, offset := c.in(fire).Zone()
+	if _, earlierOffset := c.in(fire.Add(-24 * time.Hour)).Zone(); earlierOffset > offset {
+		if earlier := fire.Add(-time.Duration(earlierOffset-offset) * time.Second); wallClock(c.in(earlier)).Equal(wall) {
+			fire = earlier
+		}
+	}
+	return fire
+}
+
+// Location returns the time zone the cron expression is evaluated in, or nil if it's evaluated in the time zone of the
+// evaluated times
+func (c *Cron) Location() *time.Location {
+	return c.location
+}
+
+func (c *Cron) String() string {
+	return c.expression
+}
+
+// in returns the given time in the time zone of the cron expression
+func (c *Cron) in(t time.Time) time.Time {
+	if c.location == nil {
+		return t
+	}
+	return t.In(c.location)
+}
+
+// matchesWallClock returns true if the cron expression matches the minute of the given wall clock time
+func (c *Cron) matchesWallClock(t time.Time) bool {
+	return c.minutes.Contains(t.Minute()) && c.hours.Contains(t.Hour()) && c.matchesDay(t)
+}
+
+// matchesDay returns true if the cron expression matches the day of the given wall clock time
+func (c *Cron) matchesDay(t time.Time) bool {
+	if !c.months.Contains(int(t.Month())) {
+		return false
+	}
+	dayOfMonthMatches := c.daysOfMonth.Contains(t.Day())
+	dayOfWeekMatches := c.daysOfWeek.Contains(int(t.Weekday()))
+	if c.daysOfMonthRestricted && c.daysOfWeekRestricted {
+		return dayOfMonthMatches || dayOfWeekMatches
+	}
+	return dayOfMonthMatches && dayOfWeekMatches
+}
@@ -0,0 +1,158 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxCronWindowDuration limits how far back a cron window searches for its start
+const maxCronWindowDuration = 7 * 24 * time.Hour
+
+// maxMergedOccurrences limits how many overlapping occurrences are merged to find when the windows end, so windows that
+// are always active don't merge forever
+const maxMergedOccurrences = 100
+
+// Window is a period of time
+type Window interface {
+	// Active returns true if the given time is within the window
+	Active(t time.Time) bool
+	// Occurrence returns the occurrence of the window that the given time is within, or nil if the window isn't active
+	Occurrence(t time.Time) *Occurrence
+
+	String() string
+}
+
+// Occurrence is a period a window is active, from its start until its end
+type Occurrence struct {
+	Window Window
+	Start  time.Time
+	End    time.Time
+}
+
+// TimeRangeWindow is a window between two points in time
+type TimeRangeWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Active returns true if the given time is within the window
+func (w TimeRangeWindow) Active(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// Occurrence returns the window if the given time is within it
+func (w TimeRangeWindow) Occurrence(t time.Time) *Occurrence {
+	if !w.Active(t) {
+		return nil
+	}
+	return &Occurrence{Window: w, Start: w.Start, End: w.End}
+}
+
+func (w TimeRangeWindow) String() string {
+	return fmt.Sprintf("%s/%s", w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339))
+}
+
+// CronWindow is a window that starts on a cron schedule and lasts for a duration. The duration is elapsed time, so a
+// window that spans a daylight saving time transition ends at a different wall clock time than usual.
+type CronWindow struct {
+	Cron     *Cron
+	Duration time.Duration
+}
+
+// Active returns true if the given time is within the window
+func (w CronWindow) Active(t time.Time) bool {
+	return w.Occurrence(t) != nil
+}
+
+// Occurrence returns the latest occurrence of the window that the given time is within
+func (w CronWindow) Occurrence(t time.Time) *Occurrence {
+	start := w.Cron.previous(t, t.Add(-w.Duration))
+	if start.IsZero() || t.Sub(start) >= w.Duration {
+		return nil
+	}
+	return &Occurrence{Window: w, Start: start, End: start.Add(w.Duration)}
+}
+
+func (w CronWindow) String() string {
+	return fmt.Sprintf("%s|%s", w.Cron.String(), w.Duration.String())
+}
+
+// ParseWindow parses a window, either an RFC3339 range in the format <start>/<end>, or a cron schedule with a duration
+// in the format <cron expression>|<duration>. The cron schedules are evaluated in the given time zone, or in the time
+// zone of the evaluated times if nil, unless they have a CRON_TZ= prefix.
+func ParseWindow(value string, location *time.Location) (Window, error) {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, "|"); i >= 0 {
+		cron, err := ParseCron(value[:i], location)
+		if err != nil {
+			return nil, err
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(value[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid duration in window '%s': %w", value, err)
+		}
+		if duration <= 0 || duration > maxCronWindowDuration {
+			return nil, fmt.Errorf("Invalid duration in window '%s': must be between 1m and %s", value, maxCronWindowDuration.String())
+		}
+		return CronWindow{Cron: cron, Duration: duration}, nil
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid window '%s': expected <start>/<end> or <cron expression>|<duration>", value)
+	}
+	start, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid start of window '%s': %w", value, err)
+	}
+	end, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid end of window '%s': %w", value, err)
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("Invalid window '%s': the end must be after the start", value)
+	}
+	return TimeRangeWindow{Start: start, End: end}, nil
+}
+
+// Resolve returns the occurrence of the windows that applies at the given time, or nil if none are active. When windows
+// overlap, the one that started last applies, so a narrower window within a broader one overrides it. Windows that
+// started at the same time apply in their order.
+func Resolve(windows []Window, t time.Time) *Occurrence {
+	var resolved *Occurrence
+	for _, window := range windows {
+		if occurrence := window.Occurrence(t); occurrence != nil && (resolved == nil || occurrence.Start.After(resolved.Start)) {
+			resolved = occurrence
+		}
+	}
+	return resolved
+}
+
+// ActiveWindow returns the window that applies at the given time, or nil if none are active
+func ActiveWindow(windows []Window, t time.Time) Window {
+	if occurrence := Resolve(windows, t); occurrence != nil {
+		return occurrence.Window
+	}
+	return nil
+}
+
+// ActiveUntil returns when none of the windows are active anymore, if one is active at the given time. The occurrences
+// that overlap or follow each other without a gap are merged, so it's the end of the whole period. It returns the given
+// time if no window is active.
+func ActiveUntil(windows []Window, t time.Time) time.Time {
+	until := t
+	for i := 0; i < maxMergedOccurrences; i++ {
+		end := until
+		for _, window := range windows {
+			if occurrence := window.Occurrence(until); occurrence != nil && occurrence.End.After(end) {
+				end = occurrence.End
+			}
+		}
+		if !end.After(until) {
+			break
+		}
+		until = end
+	}
+	return until
+}
@@ -0,0 +1,52 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// The time zone database is embedded, as the container image doesn't have one
+	_ "time/tzdata"
+)
+
+// timeZonePrefixes override the time zone of a cron expression, like in Kubernetes CronJobs
+var timeZonePrefixes = []string{"CRON_TZ=", "TZ="}
+
+// ParseLocation parses an IANA time zone name, ex: Europe/Paris, or Local for the time zone of the autoscaler.
+// It returns nil if the name is empty, so the schedules are evaluated in the time zone of the times they're given.
+func ParseLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown time zone '%s': %w", name, err)
+	}
+	return location, nil
+}
+
+// parseTimeZonePrefix splits the time zone prefix from a cron expression, and returns the time zone it sets or the
+// given default time zone
+func parseTimeZonePrefix(expression string, location *time.Location) (string, *time.Location, error) {
+	expression = strings.TrimSpace(expression)
+	for _, prefix := range timeZonePrefixes {
+		if !strings.HasPrefix(expression, prefix) {
+			continue
+		}
+		fields := strings.SplitN(expression, " ", 2)
+		prefixed, err := ParseLocation(strings.TrimPrefix(fields[0], prefix))
+		if err != nil || prefixed == nil {
+			return "", nil, fmt.Errorf("Invalid time zone in cron expression '%s'", expression)
+		} else if len(fields) < 2 {
+			return "", nil, fmt.Errorf("Invalid cron expression '%s': expected 5 fields after the time zone", expression)
+		}
+		return fields[1], prefixed, nil
+	}
+	return expression, location, nil
+}
+
+// wallClock returns the date and time of a time in its time zone as a UTC time, so wall clock times in time zones with
+// daylight saving time can be compared and added to
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
@@ -0,0 +1,125 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// imdsTokenURL is the Azure Instance Metadata Service endpoint that issues managed identity tokens
+	imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// defaultAuthorityHost is used with workload identity if AZURE_AUTHORITY_HOST isn't set
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+)
+
+// ManagedIdentity retrieves Azure access tokens with a managed identity.
+// If AKS workload identity is configured on the pod, its federated token is used instead.
+type ManagedIdentity struct {
+	// ClientID selects a user-assigned managed identity. The system-assigned identity is used if empty.
+	ClientID string
+
+	// IdentityEndpoint overrides the Azure Instance Metadata Service token endpoint, for tests
+	IdentityEndpoint string
+
+	httpClient *http.Client
+}
+
+// NewManagedIdentity returns a managed identity with the client ID, or the system-assigned identity if it's empty
+func NewManagedIdentity(clientID string) *ManagedIdentity {
+	return &ManagedIdentity{
+		ClientID:         clientID,
+		IdentityEndpoint: imdsTokenURL,
+		httpClient:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// AccessToken returns an access token for an Azure resource, ex: https://vault.azure.net
+func (m *ManagedIdentity) AccessToken(resource string) (string, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if federatedTokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); federatedTokenFile != "" {
+		assertion, err := ioutil.ReadFile(federatedTokenFile)
+		if err != nil {
+			return "", err
+		}
+		authorityHost := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authorityHost == "" {
+			authorityHost = defaultAuthorityHost
+		}
+		clientID := m.ClientID
+		if clientID == "" {
+			clientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+		form := url.Values{
+			"client_id":             {clientID},
+			"scope":                 {strings.TrimSuffix(resource, "/") + "/.default"},
+			"grant_type":            {"client_credentials"},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		}
+		tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authorityHost, "/"), os.Getenv("AZURE_TENANT_ID"))
+		request, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := do(m.httpClient, request, &token); err != nil {
+			return "", err
+		}
+		return token.AccessToken, nil
+	}
+
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {resource},
+	}
+	if m.ClientID != "" {
+		query.Set("client_id", m.ClientID)
+	}
+	request, err := http.NewRequest("GET", m.IdentityEndpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Metadata", "true")
+	if err := do(m.httpClient, request, &token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// do sends a request to an Azure API and decodes the JSON response
+func do(httpClient *http.Client, request *http.Request, response interface{}) error {
+	httpResponse, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		var errorResponse struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		json.Unmarshal(body, &errorResponse)
+		message := errorResponse.Error.Message
+		if message == "" {
+			message = errorResponse.ErrorDescription
+		}
+		return fmt.Errorf("%s returned HTTP %d: %s", request.URL.Host, httpResponse.StatusCode, message)
+	}
+	return json.Unmarshal(body, response)
+}
@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	keyVaultAPIVersion = "7.4"
+	keyVaultResource   = "https://vault.azure.net"
+)
+
+// KeyVault retrieves a secret from Azure Key Vault with a managed identity.
+// If AKS workload identity is configured on the pod, its federated token is used instead.
+type KeyVault struct {
+	// VaultURL is the URL of the key vault, ex: https://myvault.vault.azure.net
+	VaultURL string
+	// SecretName is the name of the secret. The latest version is always retrieved.
+	SecretName string
+	// ClientID selects a user-assigned managed identity. The system-assigned identity is used if empty.
+	ClientID string
+
+	// IdentityEndpoint overrides the Azure Instance Metadata Service token endpoint, for tests
+	IdentityEndpoint string
+
+	httpClient *http.Client
+}
+
+// NewKeyVault returns a Key Vault secret source
+func NewKeyVault(vaultURL string, secretName string, clientID string) *KeyVault {
+	return &KeyVault{
+		VaultURL:         strings.TrimSuffix(vaultURL, "/"),
+		SecretName:       secretName,
+		ClientID:         clientID,
+		IdentityEndpoint: imdsTokenURL,
+		httpClient:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name describes the secret
+func (k *KeyVault) Name() string {
+	return fmt.Sprintf("Key Vault secret %s in %s", k.SecretName, k.VaultURL)
+}
+
+// Get retrieves the latest version of the secret
+func (k *KeyVault) Get() (string, error) {
+	accessToken, err := k.accessToken()
+	if err != nil {
+		return "", fmt.Errorf("Error getting a Key Vault access token: %w", err)
+	}
+
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/secrets/%s?api-version=%s", k.VaultURL, url.PathEscape(k.SecretName), keyVaultAPIVersion), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	var secret struct {
+		Value string `json:"value"`
+	}
+	if err := do(k.httpClient, request, &secret); err != nil {
+		return "", err
+	}
+	if secret.Value == "" {
+		return "", fmt.Errorf("The secret %s is empty", k.SecretName)
+	}
+	return secret.Value, nil
+}
+
+// accessToken returns a Key Vault access token for the pod's workload identity or managed identity
+func (k *KeyVault) accessToken() (string, error) {
+	identity := &ManagedIdentity{ClientID: k.ClientID, IdentityEndpoint: k.IdentityEndpoint, httpClient: k.httpClient}
+	return identity.AccessToken(keyVaultResource)
+}
@@ -0,0 +1,102 @@
+package secrets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+var logger = logging.Component("secrets")
+
+// Source retrieves a secret from a secret store
+type Source interface {
+	// Name describes the secret and where it's stored, for logs and errors
+	Name() string
+	Get() (string, error)
+}
+
+// RetrieveError is returned when a secret couldn't be retrieved from its source
+type RetrieveError struct {
+	Source string
+	Err    error
+}
+
+func (e RetrieveError) Error() string {
+	return fmt.Sprintf("Error retrieving %s: %s", e.Source, e.Err.Error())
+}
+
+// Unwrap returns the error from the source
+func (e RetrieveError) Unwrap() error {
+	return e.Err
+}
+
+// Token is a secret that is refreshed from its source in the background
+type Token struct {
+	source Source
+
+	lock  sync.RWMutex
+	value string
+
+	stop chan struct{}
+}
+
+// Watch retrieves a secret, then refreshes it every interval until Stop is called.
+// If a refresh fails, the error is logged and the previous value is kept.
+func Watch(source Source, interval time.Duration) (*Token, error) {
+	value, err := source.Get()
+	if err != nil {
+		return nil, RetrieveError{Source: source.Name(), Err: err}
+	}
+	logging.RedactSecret(value)
+	logger.Infof("Retrieved %s", source.Name())
+
+	token := &Token{
+		source: source,
+		value:  value,
+		stop:   make(chan struct{}),
+	}
+	go token.refresh(interval)
+	return token, nil
+}
+
+// Get returns the current value of the secret
+func (t *Token) Get() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.value
+}
+
+// Stop stops refreshing the secret
+func (t *Token) Stop() {
+	close(t.stop)
+}
+
+func (t *Token) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		value, err := t.source.Get()
+		if err != nil {
+			logger.Errorf("Error refreshing %s, the previous value is kept: %s", t.source.Name(), err.Error())
+			continue
+		}
+		logging.RedactSecret(value)
+		t.lock.Lock()
+		changed := value != t.value
+		t.value = value
+		t.lock.Unlock()
+		if changed {
+			logger.Infof("%s changed", t.source.Name())
+		} else {
+			logger.Debugf("Refreshed %s", t.source.Name())
+		}
+	}
+}
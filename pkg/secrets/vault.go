@@ -0,0 +1,182 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serviceAccountTokenFile is the pod's service account token, which Vault's Kubernetes auth method verifies
+const serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// Vault retrieves a secret from a HashiCorp Vault KV secrets engine with the Kubernetes auth method.
+// The Vault token is renewed while it can be, and Vault is logged in to again when it expires.
+// It isn't safe for concurrent use.
+type Vault struct {
+	// Address is the Vault server address, ex: https://vault.example.com:8200
+	Address string
+	// Namespace is the Vault Enterprise namespace. Not sent if empty.
+	Namespace string
+	// AuthPath is the mount path of the Kubernetes auth method, ex: kubernetes
+	AuthPath string
+	// Role is the Kubernetes auth role to log in with
+	Role string
+	// SecretPath is the API path of the secret, ex: secret/data/azp for a KV version 2 engine mounted at secret
+	SecretPath string
+	// SecretKey is the key of the value in the secret
+	SecretKey string
+
+	// JWTFile is the service account token to log in with
+	JWTFile string
+
+	httpClient *http.Client
+
+	token       string
+	renewable   bool
+	tokenTTL    time.Duration
+	tokenExpiry time.Time
+}
+
+// NewVault returns a Vault secret source
+func NewVault(address string, namespace string, authPath string, role string, secretPath string, secretKey string) *Vault {
+	return &Vault{
+		Address:    strings.TrimSuffix(address, "/"),
+		Namespace:  namespace,
+		AuthPath:   strings.Trim(authPath, "/"),
+		Role:       role,
+		SecretPath: strings.Trim(secretPath, "/"),
+		SecretKey:  secretKey,
+		JWTFile:    serviceAccountTokenFile,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name describes the secret
+func (v *Vault) Name() string {
+	return fmt.Sprintf("Vault secret %s key %s", v.SecretPath, v.SecretKey)
+}
+
+// vaultAuth is the auth section of a Vault login or token renewal response
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// Get retrieves the current value of the secret
+func (v *Vault) Get() (string, error) {
+	if err := v.authenticate(); err != nil {
+		return "", err
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.do("GET", v.SecretPath, nil, &secret); err != nil {
+		return "", err
+	}
+
+	// KV version 2 engines nest the values in data with the version metadata
+	data := secret.Data
+	if nested, isV2 := data["data"].(map[string]interface{}); isV2 && data["metadata"] != nil {
+		data = nested
+	}
+	value, isString := data[v.SecretKey].(string)
+	if !isString || value == "" {
+		return "", fmt.Errorf("The Vault secret %s doesn't have a %s key", v.SecretPath, v.SecretKey)
+	}
+	return value, nil
+}
+
+// authenticate renews the Vault token once half of its TTL has passed, and logs in if there's no token or it can't be renewed.
+// Tokens without a TTL never expire.
+func (v *Vault) authenticate() error {
+	if v.token != "" && (v.tokenTTL == 0 || time.Until(v.tokenExpiry) > v.tokenTTL/2) {
+		return nil
+	}
+	if v.token != "" && v.renewable {
+		var response struct {
+			Auth vaultAuth `json:"auth"`
+		}
+		err := v.do("POST", "auth/token/renew-self", map[string]interface{}{}, &response)
+		if err == nil {
+			v.setToken(response.Auth)
+			logger.Debugf("Renewed the Vault token for %s", v.SecretPath)
+			return nil
+		}
+		logger.Warnf("Error renewing the Vault token, logging in again: %s", err.Error())
+	}
+	return v.login()
+}
+
+// login logs in to Vault with the pod's service account token
+func (v *Vault) login() error {
+	jwt, err := ioutil.ReadFile(v.JWTFile)
+	if err != nil {
+		return fmt.Errorf("Error reading the service account token: %w", err)
+	}
+	v.token = ""
+	var response struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	body := map[string]interface{}{"role": v.Role, "jwt": strings.TrimSpace(string(jwt))}
+	if err := v.do("POST", fmt.Sprintf("auth/%s/login", v.AuthPath), body, &response); err != nil {
+		return fmt.Errorf("Error logging in to Vault with role %s: %w", v.Role, err)
+	}
+	v.setToken(response.Auth)
+	return nil
+}
+
+func (v *Vault) setToken(auth vaultAuth) {
+	v.token = auth.ClientToken
+	v.renewable = auth.Renewable
+	v.tokenTTL = time.Duration(auth.LeaseDuration) * time.Second
+	v.tokenExpiry = time.Now().Add(v.tokenTTL)
+}
+
+// do sends a request to the Vault API and decodes the JSON response
+func (v *Vault) do(method string, path string, body interface{}, response interface{}) error {
+	var requestBody []byte
+	if body != nil {
+		var err error
+		if requestBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", v.Address, path), bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	if v.token != "" {
+		request.Header.Set("X-Vault-Token", v.token)
+	}
+	if v.Namespace != "" {
+		request.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResponse, err := v.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		var errorResponse struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(responseBody, &errorResponse)
+		return fmt.Errorf("Vault returned HTTP %d for %s: %s", httpResponse.StatusCode, path, strings.Join(errorResponse.Errors, ", "))
+	}
+	return json.Unmarshal(responseBody, response)
+}
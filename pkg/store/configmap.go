@@ -0,0 +1,34 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// ConfigMapStore persists the data to a ConfigMap, which is limited to 1 MiB
+type ConfigMapStore struct {
+	client    kubernetes.Client
+	namespace string
+	name      string
+}
+
+// NewConfigMap returns a store of the ConfigMap with the name in the namespace
+func NewConfigMap(client kubernetes.Client, namespace string, name string) ConfigMapStore {
+	return ConfigMapStore{client: client, namespace: namespace, name: name}
+}
+
+// Name describes the ConfigMap
+func (s ConfigMapStore) Name() string {
+	return fmt.Sprintf("configmap/%s in namespace %s", s.name, s.namespace)
+}
+
+// Load returns the data of the ConfigMap, or nil if it doesn't exist
+func (s ConfigMapStore) Load() (map[string]string, error) {
+	return s.client.GetConfigMapData(s.namespace, s.name)
+}
+
+// Save replaces the data of the ConfigMap, creating it if it doesn't exist
+func (s ConfigMapStore) Save(data map[string]string) error {
+	return s.client.SaveConfigMapData(s.namespace, s.name, data)
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileStore persists the data to a JSON file, ex: on a persistent volume
+type FileStore struct {
+	path string
+}
+
+// NewFile returns a store of the file with the name in the directory
+func NewFile(directory string, name string) FileStore {
+	return FileStore{path: filepath.Join(directory, name+".json")}
+}
+
+// Name describes the file
+func (s FileStore) Name() string {
+	return fmt.Sprintf("file %s", s.path)
+}
+
+// Load returns the data of the file, or nil if it doesn't exist
+func (s FileStore) Load() (map[string]string, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var data map[string]string
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", s.path, err)
+	}
+	return data, nil
+}
+
+// Save replaces the data of the file. It's written to a temporary file first, so the file is never partially written
+// if the autoscaler is killed while saving.
+func (s FileStore) Save(data map[string]string) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+)
+
+// redisTimeout limits each connection to the Redis server
+const redisTimeout = 10 * time.Second
+
+// errRedisNil is the reply of a GET of a key that doesn't exist
+var errRedisNil = errors.New("nil reply")
+
+// RedisStore persists the data as JSON to a key of a Redis server. A connection is opened for each call, as the data
+// is only loaded at startup and saved after the workloads are scaled.
+type RedisStore struct {
+	redisArgs args.RedisArgs
+	key       string
+}
+
+// NewRedis returns a store of the key with the name and the key prefix of the args
+func NewRedis(redisArgs args.RedisArgs, name string) RedisStore {
+	return RedisStore{redisArgs: redisArgs, key: redisArgs.KeyPrefix + name}
+}
+
+// Name describes the Redis key
+func (s RedisStore) Name() string {
+	return fmt.Sprintf("Redis key %s on %s", s.key, s.redisArgs.Address)
+}
+
+// Load returns the data of the Redis key, or nil if it doesn't exist
+func (s RedisStore) Load() (map[string]string, error) {
+	value, err := s.do("GET", s.key)
+	if errors.Is(err, errRedisNil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var data map[string]string
+	if err := json.Unmarshal([]byte(value), &data); err != nil {
+		return nil, fmt.Errorf("Error parsing Redis key %s: %w", s.key, err)
+	}
+	return data, nil
+}
+
+// Save replaces the data of the Redis key
+func (s RedisStore) Save(data map[string]string) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = s.do("SET", s.key, string(value))
+	return err
+}
+
+// do connects to the Redis server, authenticates, selects the database and sends a command, and returns its reply
+func (s RedisStore) do(command ...string) (string, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if s.redisArgs.TLS {
+		host, _, _ := net.SplitHostPort(s.redisArgs.Address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.redisArgs.Address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.redisArgs.Address)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error connecting to Redis at %s: %w", s.redisArgs.Address, err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return "", err
+	}
+
+	reader := bufio.NewReader(conn)
+	if s.redisArgs.Password != "" {
+		if _, err := sendRedisCommand(conn, reader, "AUTH", s.redisArgs.Password); err != nil {
+			return "", fmt.Errorf("Error authenticating to Redis at %s: %w", s.redisArgs.Address, err)
+		}
+	}
+	if s.redisArgs.DB != 0 {
+		if _, err := sendRedisCommand(conn, reader, "SELECT", strconv.Itoa(s.redisArgs.DB)); err != nil {
+			return "", fmt.Errorf("Error selecting Redis database %d: %w", s.redisArgs.DB, err)
+		}
+	}
+	reply, err := sendRedisCommand(conn, reader, command...)
+	if err != nil && !errors.Is(err, errRedisNil) {
+		return "", fmt.Errorf("Error sending %s %s to Redis: %w", command[0], s.key, err)
+	}
+	return reply, err
+}
+
+// sendRedisCommand sends a command as a RESP array of bulk strings and reads its reply
+func sendRedisCommand(conn io.Writer, reader *bufio.Reader, command ...string) (string, error) {
+	var request strings.Builder
+	fmt.Fprintf(&request, "*%d\r\n", len(command))
+	for _, arg := range command {
+		fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, request.String()); err != nil {
+		return "", err
+	}
+	return readRedisReply(reader)
+}
+
+// readRedisReply reads a simple string, error, integer or bulk string reply
+func readRedisReply(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("Empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", errors.New(line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("Invalid bulk string length %s", line[1:])
+		} else if length < 0 {
+			return "", errRedisNil
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return "", err
+		}
+		return string(value[:length]), nil
+	}
+	return "", fmt.Errorf("Unsupported reply %s", line)
+}
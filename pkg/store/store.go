@@ -0,0 +1,30 @@
+// Package store persists the scaling state and decision history of the autoscaler between restarts, in a ConfigMap,
+// a file or a Redis server
+package store
+
+import (
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// Store persists a set of keys and values between restarts of the autoscaler
+type Store interface {
+	// Name describes where the data is persisted, for logs and errors
+	Name() string
+	// Load returns the persisted data, or nil if nothing was persisted yet
+	Load() (map[string]string, error)
+	// Save replaces the persisted data
+	Save(data map[string]string) error
+}
+
+// New returns the store of the data with the name, ex: the state's --state-configmap, in the store of the args.
+// The Kubernetes client and namespace are only used by the ConfigMap store.
+func New(storeArgs args.StoreArgs, k8sClient kubernetes.Client, namespace string, name string) Store {
+	switch storeArgs.Type {
+	case args.StoreFile:
+		return NewFile(storeArgs.Path, name)
+	case args.StoreRedis:
+		return NewRedis(storeArgs.Redis, name)
+	}
+	return NewConfigMap(k8sClient, namespace, name)
+}
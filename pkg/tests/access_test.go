@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+func TestRequiredPermissions(t *testing.T) {
+	permissions := func(a args.Args) map[string]bool {
+		result := make(map[string]bool)
+		for _, permission := range kubernetes.RequiredPermissions(a) {
+			result[permission.String()] = true
+		}
+		return result
+	}
+
+	a := args.Args{
+		Kubernetes: args.KubernetesArgs{
+			Type:                "StatefulSet",
+			Name:                "azp-agent",
+			Namespace:           "azp",
+			AdditionalWorkloads: []args.WorkloadArgs{{Name: "azp-agent-gpu"}},
+		},
+	}
+	actual := permissions(a)
+	for _, expected := range []string{
+		"get statefulsets.apps azp-agent in namespace azp",
+		"update statefulsets.apps/scale azp-agent in namespace azp",
+		"update statefulsets.apps/scale azp-agent-gpu in namespace azp",
+		"list pods in namespace azp",
+		"watch pods in namespace azp",
+		"list horizontalpodautoscalers.autoscaling in namespace azp",
+		"list scaledobjects.keda.sh in namespace azp",
+	} {
+		if !actual[expected] {
+			t.Errorf("Expected the permission %s in %v", expected, actual)
+		}
+	}
+	if len(actual) != 10 {
+		t.Errorf("Expected 10 permissions, got %d: %v", len(actual), actual)
+	}
+
+	a.Events = true
+	a.State.ConfigMapName = "azp-agent-autoscaler-state"
+	a.State.Namespace = "azp"
+	a.Capacity.Enabled = true
+	actual = permissions(a)
+	for _, expected := range []string{
+		"create events in namespace azp",
+		"update configmaps azp-agent-autoscaler-state in namespace azp",
+		"create configmaps in namespace azp",
+		"list nodes cluster-wide",
+		"list pods cluster-wide",
+	} {
+		if !actual[expected] {
+			t.Errorf("Expected the permission %s in %v", expected, actual)
+		}
+	}
+
+	// The workloads of the operator are in its namespaces, but the state is in its own namespace
+	a.Operator = args.OperatorArgs{Enabled: true, Namespaces: []string{"team-a", "team-b"}}
+	actual = permissions(a)
+	for _, expected := range []string{
+		"list azpagentautoscalers.azp.ogmaresca.github.io in namespace team-a",
+		"update statefulsets.apps/scale in namespace team-b",
+		"create events in namespace team-b",
+		"update configmaps azp-agent-autoscaler-state in namespace azp",
+	} {
+		if !actual[expected] {
+			t.Errorf("Expected the permission %s in %v", expected, actual)
+		}
+	}
+	if actual["list pods in namespace azp"] {
+		t.Errorf("Expected no permissions in namespace azp for workloads in %v", actual)
+	}
+
+	// A dry run only reads the workloads, pods and state
+	a.Operator = args.OperatorArgs{}
+	a.DryRun = true
+	a.SafeToEvict = true
+	a.Recycle.Outdated = true
+	actual = permissions(a)
+	for permission := range actual {
+		if !strings.HasPrefix(permission, "get ") && !strings.HasPrefix(permission, "list ") && !strings.HasPrefix(permission, "watch ") {
+			t.Errorf("Expected only read permissions in a dry run, but got %s", permission)
+		}
+	}
+	if !actual["get configmaps azp-agent-autoscaler-state in namespace azp"] {
+		t.Errorf("Expected the state to be loaded in a dry run: %v", actual)
+	}
+}
+
+func TestVerifyPermissions(t *testing.T) {
+	a := args.Args{
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent",
+			Namespace: "azp",
+		},
+	}
+	k8sClient := mockK8sClient{}
+	if err := kubernetes.VerifyPermissions(k8sClient, a); err != nil {
+		t.Fatalf("Expected every permission to be allowed, but got %s", err.Error())
+	}
+
+	// Every missing permission is reported at once
+	k8sClient.DeniedPermissions = map[string]bool{
+		"update statefulsets.apps/scale azp-agent in namespace azp": true,
+		"watch pods in namespace azp":                               true,
+	}
+	err := kubernetes.VerifyPermissions(k8sClient, a)
+	var missing kubernetes.MissingPermissionsError
+	if !errors.As(err, &missing) || len(missing.Permissions) != 2 {
+		t.Fatalf("Expected 2 missing permissions, but got %v", err)
+	}
+	if !kubernetes.IsAuthError(err) {
+		t.Error("Expected missing permissions to be an auth error")
+	}
+	if !strings.Contains(err.Error(), "watch pods in namespace azp") {
+		t.Errorf("Expected the error to list the missing permissions, but got %s", err.Error())
+	}
+}
+
+func TestDetectRBACScope(t *testing.T) {
+	a := args.Args{
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent",
+			Namespace: "azp",
+			RBACScope: args.RBACScopeAuto,
+		},
+		Capacity: args.CapacityArgs{Enabled: true},
+	}
+	k8sClient := mockK8sClient{}
+	scope, missing, err := kubernetes.DetectRBACScope(k8sClient, a)
+	if err != nil || scope != args.RBACScopeCluster || len(missing) != 0 {
+		t.Fatalf("Expected the cluster scope, but got %s with %v (%v)", scope, missing, err)
+	}
+
+	// A Role can't grant the cluster-wide permissions of the capacity check
+	k8sClient.DeniedPermissions = map[string]bool{
+		"list nodes cluster-wide": true,
+		"list pods cluster-wide":  true,
+	}
+	scope, missing, err = kubernetes.DetectRBACScope(k8sClient, a)
+	if err != nil || scope != args.RBACScopeNamespace || len(missing) != 2 {
+		t.Fatalf("Expected the namespace scope with 2 missing permissions, but got %s with %v (%v)", scope, missing, err)
+	}
+
+	// The namespace-scoped args don't need the cluster-wide permissions
+	namespaceArgs, disabled := a.NamespaceScoped()
+	if namespaceArgs.Capacity.Enabled || len(disabled) != 1 || disabled[0] != "--capacity-check" {
+		t.Errorf("Expected the capacity check to be disabled, but got %v", disabled)
+	}
+	if err := kubernetes.VerifyPermissions(k8sClient, namespaceArgs); err != nil {
+		t.Errorf("Expected every namespace-scoped permission to be allowed, but got %s", err.Error())
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	forbidden := k8serrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "statefulsets"}, "azp-agent", fmt.Errorf("denied"))
+	if !kubernetes.IsAuthError(fmt.Errorf("Error retrieving statefulset/azp-agent: %w", forbidden)) {
+		t.Error("Expected a wrapped Forbidden error to be an auth error")
+	}
+	if kubernetes.IsAuthError(k8serrors.NewNotFound(schema.GroupResource{Group: "apps", Resource: "statefulsets"}, "azp-agent")) {
+		t.Error("Expected a NotFound error not to be an auth error")
+	}
+
+	// Azure Devops responds to an invalid token with a 203
+	if !azuredevops.IsAuthError(fmt.Errorf("Error retrieving agent pools: %w", &azuredevops.HTTPError{StatusCode: http.StatusNonAuthoritativeInfo})) {
+		t.Error("Expected a wrapped HTTP 203 error to be an auth error")
+	}
+	if azuredevops.IsAuthError(&azuredevops.HTTPError{StatusCode: http.StatusTooManyRequests}) {
+		t.Error("Expected an HTTP 429 error not to be an auth error")
+	}
+}
@@ -0,0 +1,281 @@
+package tests
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/admin"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/store"
+)
+
+func TestAdminAPI(t *testing.T) {
+	azdClient := mockAZDClient{
+		NumPools:         5,
+		NumFreeAgents:    1,
+		NumRunningAgents: 1,
+		NumQueuedJobs:    3,
+	}
+	args := args.Args{
+		Min:  1,
+		Max:  10,
+		Rate: 10 * time.Second,
+		ScaleDown: args.ScaleDownArgs{
+			Max: 10,
+		},
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent",
+			Namespace: "admin",
+		},
+	}
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{
+			NumPods: 2,
+		},
+	}
+	workload := k8sClient.GetWorkloadNoError(args.Kubernetes)
+
+	server := httptest.NewServer(admin.Server{
+		Token:   "token",
+		Targets: func() []scaling.Target { return []scaling.Target{{Workload: workload, AgentPoolID: agentPoolID}} },
+	}.Handler())
+	defer server.Close()
+
+	request := func(method string, path string, token string) int {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error calling %s: %s", path, err.Error())
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	autoscale := func() {
+		if err := scaling.Autoscale(azuredevops.NewBackend(azdClient), agentPoolID, kubernetes.MakeFromClient(k8sClient), workload, args); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	if status := request("POST", "/pause", "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("Expected HTTP 401 with the wrong token, but got %d", status)
+	}
+	if status := request("GET", "/pause", "token"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected HTTP 405 for GET /pause, but got %d", status)
+	}
+
+	if status := request("POST", "/pause", "token"); status != http.StatusOK {
+		t.Fatalf("Expected HTTP 200 when pausing, but got %d", status)
+	}
+	autoscale()
+	if k8sClient.Counts.NumPods != 2 {
+		t.Fatalf("Expected 2 pods while paused, but got %d", k8sClient.Counts.NumPods)
+	}
+
+	if status := request("POST", "/scale?workload=statefulset/azp-agent&replicas=-1", "token"); status != http.StatusBadRequest {
+		t.Fatalf("Expected HTTP 400 for negative replicas, but got %d", status)
+	}
+	if status := request("POST", "/scale?workload=statefulset/azp-agent&replicas=8", "token"); status != http.StatusAccepted {
+		t.Fatalf("Expected HTTP 202 when force scaling, but got %d", status)
+	}
+	autoscale()
+	if k8sClient.Counts.NumPods != 8 {
+		t.Fatalf("Expected 8 pods after force scaling, but got %d", k8sClient.Counts.NumPods)
+	}
+
+	if status := request("POST", "/resume?workload=statefulset/azp-agent", "token"); status != http.StatusOK {
+		t.Fatalf("Expected HTTP 200 when resuming, but got %d", status)
+	}
+	autoscale()
+	// 1 active agent, 3 queued jobs and 1 free agent
+	if k8sClient.Counts.NumPods != 5 {
+		t.Fatalf("Expected 5 pods after resuming, but got %d", k8sClient.Counts.NumPods)
+	}
+
+	if status := request("GET", "/state", "token"); status != http.StatusOK {
+		t.Fatalf("Expected HTTP 200 for the state, but got %d", status)
+	}
+
+	resp, err := http.Get(server.URL + "/history")
+	if err != nil {
+		t.Fatalf("Error calling /history: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("Expected HTTP 401 prompting for basic authentication without a token, but got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/history", nil)
+	req.SetBasicAuth("admin", "token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error calling /history: %s", err.Error())
+	}
+	var history admin.HistoryResponse
+	err = json.NewDecoder(resp.Body).Decode(&history)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error decoding the history: %s", err.Error())
+	}
+	var workloadHistory *health.WorkloadHistory
+	for i := range history.Workloads {
+		if history.Workloads[i].Namespace == "admin" {
+			workloadHistory = &history.Workloads[i]
+		}
+	}
+	if workloadHistory == nil {
+		t.Fatal("Expected the history of the workload")
+	} else if len(workloadHistory.Samples) != 3 {
+		t.Fatalf("Expected 3 samples in the history, but got %d", len(workloadHistory.Samples))
+	} else if len(workloadHistory.RecentDecisions) != 2 || workloadHistory.RecentDecisions[0].DesiredReplicas != 5 {
+		t.Fatalf("Expected the force scale and the scale down to 5 pods as the recent decisions, newest first, but got %+v", workloadHistory.RecentDecisions)
+	}
+
+	req, _ = http.NewRequest("GET", server.URL+"/history?format=csv", nil)
+	req.SetBasicAuth("admin", "token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error calling /history: %s", err.Error())
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error reading the CSV history: %s", err.Error())
+	}
+	var workloadRows [][]string
+	for _, row := range rows[1:] {
+		if row[1] == "admin" {
+			workloadRows = append(workloadRows, row)
+		}
+	}
+	if rows[0][0] != "time" || len(workloadRows) != 3 || workloadRows[2][4] != "scale_down" || workloadRows[2][7] != "5" {
+		t.Fatalf("Expected a header and 3 rows of the workload ending with the scale down to 5 pods in the CSV history, but got %v", rows)
+	}
+	if status := request("GET", "/history?format=xml", "token"); status != http.StatusBadRequest {
+		t.Fatalf("Expected HTTP 400 for an unknown format, but got %d", status)
+	}
+
+	k8sClient.ConfigMaps = make(map[string]map[string]string)
+	if err := scaling.SaveHistory(store.NewConfigMap(k8sClient, "admin", "history")); err != nil {
+		t.Fatal(err.Error())
+	}
+	var saved []health.WorkloadHistory
+	if err := json.Unmarshal([]byte(k8sClient.ConfigMaps["history"]["history.json"]), &saved); err != nil {
+		t.Fatalf("Error decoding the saved history: %s", err.Error())
+	} else if len(saved) != len(history.Workloads) {
+		t.Fatalf("Expected the history of %d workloads to be saved, but got %d", len(history.Workloads), len(saved))
+	}
+
+	req, _ = http.NewRequest("GET", server.URL+"/", nil)
+	req.SetBasicAuth("admin", "token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error calling the dashboard: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected the dashboard with HTTP 200, but got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if status := request("GET", "/unknown", "token"); status != http.StatusNotFound {
+		t.Fatalf("Expected HTTP 404 for an unknown path, but got %d", status)
+	}
+}
+
+func TestAdminExplain(t *testing.T) {
+	azdClient := mockAZDClient{
+		NumPools:         5,
+		NumFreeAgents:    1,
+		NumRunningAgents: 1,
+		NumQueuedJobs:    6,
+	}
+	args := args.Args{
+		Min:  1,
+		Max:  4,
+		Rate: 10 * time.Second,
+		ScaleDown: args.ScaleDownArgs{
+			Max: 10,
+		},
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent",
+			Namespace: "explain",
+		},
+	}
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{
+			NumPods: 2,
+		},
+	}
+	workload := k8sClient.GetWorkloadNoError(args.Kubernetes)
+
+	server := httptest.NewServer(admin.Server{
+		Token:   "token",
+		Targets: func() []scaling.Target { return []scaling.Target{{Workload: workload, AgentPoolID: agentPoolID}} },
+	}.Handler())
+	defer server.Close()
+
+	get := func(path string) (int, []byte) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error calling %s: %s", path, err.Error())
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", path, err.Error())
+		}
+		return resp.StatusCode, body
+	}
+
+	if status, _ := get("/explain?workload=statefulset/azp-agent"); status != http.StatusNotFound {
+		t.Fatalf("Expected HTTP 404 before the workload was autoscaled, but got %d", status)
+	}
+
+	if err := scaling.Autoscale(azuredevops.NewBackend(azdClient), agentPoolID, kubernetes.MakeFromClient(k8sClient), workload, args); err != nil {
+		t.Fatal(err.Error())
+	}
+	// 1 active agent, 6 queued jobs and 1 free agent, limited by the max of 4
+	if k8sClient.Counts.NumPods != 4 {
+		t.Fatalf("Expected 4 pods, but got %d", k8sClient.Counts.NumPods)
+	}
+
+	status, body := get("/explain?workload=statefulset/azp-agent")
+	if status != http.StatusOK {
+		t.Fatalf("Expected HTTP 200 for the explanation, but got %d", status)
+	}
+	var response admin.ExplainResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("Error decoding the explanation: %s", err.Error())
+	} else if len(response.Workloads) != 1 {
+		t.Fatalf("Expected the explanation of 1 workload, but got %d", len(response.Workloads))
+	}
+	explanation := response.Workloads[0]
+	if explanation.CurrentReplicas != 2 || explanation.DesiredReplicas != 4 {
+		t.Fatalf("Expected the explanation of the scale up from 2 to 4 pods, but got %+v", explanation)
+	} else if computation := strings.Join(explanation.Computation, "\n"); !strings.Contains(computation, "Needed agents: 1 active + 6 demand + 1 free = 8") || !strings.Contains(computation, "Demanded replicas: 2 pods + 8 needed - 2 available = 8") {
+		t.Fatalf("Expected the needed agents and demanded replicas in the computation, but got %v", explanation.Computation)
+	} else if len(explanation.Limits) != 1 || explanation.Limits[0] != "max: limited from 8 to 4 replicas" {
+		t.Fatalf("Expected the max to limit the replicas from 8 to 4, but got %v", explanation.Limits)
+	}
+
+	status, body = get("/explain?format=text")
+	if status != http.StatusOK || !strings.Contains(string(body), "Outcome: Scaling from 2 to 4 replicas") {
+		t.Fatalf("Expected the outcome in the text explanation, but got %d %s", status, string(body))
+	}
+	if status, _ := get("/explain?format=csv"); status != http.StatusBadRequest {
+		t.Fatalf("Expected HTTP 400 for an unknown format, but got %d", status)
+	}
+}
@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/aks"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+)
+
+func TestAKSNodePoolScaleUp(t *testing.T) {
+	agentPool := map[string]interface{}{
+		"name":       "agents",
+		"properties": map[string]interface{}{"count": 2, "provisioningState": "Succeeded", "vmSize": "Standard_D4s_v3"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/identity" {
+			json.NewEncoder(writer).Encode(map[string]string{"access_token": "accesstoken"})
+			return
+		}
+		if request.Header.Get("Authorization") != "Bearer accesstoken" || !strings.HasSuffix(request.URL.Path, "/managedClusters/cluster/agentPools/agents") {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if request.Method == "PUT" {
+			agentPool = make(map[string]interface{})
+			json.NewDecoder(request.Body).Decode(&agentPool)
+			agentPool["properties"].(map[string]interface{})["provisioningState"] = "Scaling"
+		}
+		json.NewEncoder(writer).Encode(agentPool)
+	}))
+	defer server.Close()
+
+	nodePool := aks.NewNodePool(args.AKSArgs{
+		SubscriptionID: "subscription",
+		ResourceGroup:  "group",
+		Cluster:        "cluster",
+		NodePool:       "agents",
+		MaxNodes:       4,
+		PodsPerNode:    2,
+		Cooldown:       time.Minute,
+	})
+	nodePool.Endpoint = server.URL
+	nodePool.Identity.IdentityEndpoint = server.URL + "/identity"
+
+	// 3 unschedulable pods need 2 more nodes with 2 pods per node
+	scaleUp, err := nodePool.ScaleUp(3, false)
+	if err != nil {
+		t.Fatalf("Error scaling up the node pool: %s", err.Error())
+	}
+	if scaleUp == nil || scaleUp.FromNodes != 2 || scaleUp.ToNodes != 4 {
+		t.Fatalf("Expected the node pool to be scaled from 2 to 4 nodes, but got %+v", scaleUp)
+	}
+	properties := agentPool["properties"].(map[string]interface{})
+	if properties["count"] != float64(4) || properties["vmSize"] != "Standard_D4s_v3" {
+		t.Fatalf("Expected the node pool to be saved with 4 nodes and its other properties, but got %+v", properties)
+	}
+
+	if scaleUp, err := nodePool.ScaleUp(3, false); err != nil || scaleUp != nil {
+		t.Fatalf("Expected no scale up within the cooldown, but got %+v, %v", scaleUp, err)
+	}
+}
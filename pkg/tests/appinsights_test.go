@@ -0,0 +1,25 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/appinsights"
+)
+
+func TestParseAppInsightsConnectionString(t *testing.T) {
+	key, endpoint, err := appinsights.ParseConnectionString("InstrumentationKey=00000000-0000-0000-0000-000000000001;IngestionEndpoint=https://westus2-0.in.applicationinsights.azure.com/")
+	if err != nil {
+		t.Fatalf("Error parsing the connection string: %s", err.Error())
+	}
+	if key != "00000000-0000-0000-0000-000000000001" || endpoint != "https://westus2-0.in.applicationinsights.azure.com/" {
+		t.Fatalf("Unexpected instrumentation key %s and ingestion endpoint %s", key, endpoint)
+	}
+
+	if _, endpoint, _ := appinsights.ParseConnectionString("InstrumentationKey=key"); endpoint != "https://dc.services.visualstudio.com" {
+		t.Fatalf("Expected the default ingestion endpoint, but got %s", endpoint)
+	}
+
+	if _, _, err := appinsights.ParseConnectionString("IngestionEndpoint=https://westus2-0.in.applicationinsights.azure.com/"); err == nil {
+		t.Fatal("Expected an error for a connection string without an instrumentation key")
+	}
+}
@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+func TestEmbeddedAutoscaler(t *testing.T) {
+	azdClient := mockAZDClient{
+		NumPools:         5,
+		NumRunningAgents: 2,
+		NumQueuedJobs:    3,
+	}
+	args := args.Args{
+		Min:     1,
+		Max:     100,
+		Rate:    10 * time.Second,
+		Backend: args.BackendAzurePipelines,
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent-embedded",
+			Namespace: "default",
+		},
+	}
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{
+			NumPods: 2,
+		},
+		Env: []corev1.EnvVar{{Name: "AZP_POOL", Value: "pool-2"}},
+	}
+	a, err := autoscaler.NewWithClients(args, azuredevops.NewBackend(azdClient), kubernetes.MakeFromClient(k8sClient))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer a.Close()
+
+	// The scaling state is global, so another autoscaler can't be created until it's closed
+	if _, err := autoscaler.New(args); !errors.Is(err, autoscaler.ErrAutoscalerExists) {
+		t.Errorf("Expected another autoscaler not to be created, but got %v", err)
+	}
+
+	if err := a.Init(); err != nil {
+		t.Fatal(err.Error())
+	} else if targets := a.Targets(); len(targets) != 1 {
+		t.Fatalf("Expected 1 target, but got %d", len(targets))
+	} else if targets[0].AgentPoolID != agentPoolID {
+		t.Errorf("Expected the agent pool %d to be discovered, but got %d", agentPoolID, targets[0].AgentPoolID)
+	}
+
+	if decisions, err := a.Once(); err != nil {
+		t.Fatal(err.Error())
+	} else if len(decisions) != 1 {
+		t.Errorf("Expected 1 decision, but got %d", len(decisions))
+	} else if k8sClient.Counts.NumPods <= 2 {
+		t.Errorf("Expected the agents to be scaled up, but got %d pods", k8sClient.Counts.NumPods)
+	}
+
+	// Run returns when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected Run to stop without an error, but got %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected Run to stop when the context is cancelled")
+	}
+
+	a.Close()
+	if other, err := autoscaler.New(args); err != nil {
+		t.Errorf("Expected another autoscaler to be created once it's closed, but got %s", err.Error())
+	} else {
+		other.Close()
+	}
+}
+
+func TestResolveTokenPermissions(t *testing.T) {
+	azdClient := mockAZDClient{
+		NumPools:         5,
+		NumRunningAgents: 2,
+		Calls:            &mockAZDClientCalls{},
+	}
+	args := args.Args{
+		Quarantine:       args.QuarantineArgs{FailureRate: 0.5, MinJobs: 5},
+		SyncCapabilities: true,
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent-permissions",
+			Namespace: "default",
+		},
+	}
+	k8sClient := mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}}
+	targets := []scaling.Target{{Workload: k8sClient.GetWorkloadNoError(args.Kubernetes), AgentPoolID: agentPoolID}}
+
+	// A token allowed to manage the agents keeps the features, and the probe doesn't change the agents
+	resolved, err := autoscaler.ResolveTokenPermissions(azuredevops.NewBackend(azdClient), targets, args)
+	if err != nil {
+		t.Fatal(err.Error())
+	} else if !resolved.Quarantine.Enabled() || !resolved.SyncCapabilities {
+		t.Error("Expected the features that manage the agents to be kept")
+	}
+	for agentID, capabilities := range azdClient.Calls.Capabilities {
+		if len(capabilities) != 0 {
+			t.Errorf("Expected the probe not to change the capabilities of agent %d, but got %v", agentID, capabilities)
+		}
+	}
+
+	// A read-only token disables them
+	azdClient.ManageForbidden = true
+	if resolved, err = autoscaler.ResolveTokenPermissions(azuredevops.NewBackend(azdClient), targets, args); err != nil {
+		t.Fatal(err.Error())
+	} else if resolved.Quarantine.Enabled() || resolved.SyncCapabilities {
+		t.Error("Expected the features that manage the agents to be disabled for a read-only token")
+	}
+
+	// A token that can't read the jobs is an error
+	azdClient.ErrorJobs = true
+	if _, err = autoscaler.ResolveTokenPermissions(azuredevops.NewBackend(azdClient), targets, args); err == nil {
+		t.Error("Expected an error when the jobs can't be read")
+	}
+}
+
+func TestWaitForWorkloads(t *testing.T) {
+	args := args.Args{
+		Rate: 10 * time.Millisecond,
+		Kubernetes: args.KubernetesArgs{
+			Type:                   "StatefulSet",
+			Name:                   "azp-agent-missing",
+			Namespace:              "default",
+			MissingWorkload:        args.MissingWorkloadWait,
+			MissingWorkloadTimeout: 50 * time.Millisecond,
+		},
+	}
+
+	if err := autoscaler.WaitForWorkloads(mockK8sClient{}, args); err != nil {
+		t.Errorf("Expected an existing workload not to be waited for, but got %s", err.Error())
+	}
+	// A workload of another kind with the name isn't the agents workload
+	if err := autoscaler.WaitForWorkloads(mockK8sClient{Kinds: []string{"DeploymentConfig"}}, args); err == nil {
+		t.Error("Expected an error once the timeout passed without the workload being created")
+	} else if degraded := health.GetStatus().Degraded; degraded != "" {
+		t.Errorf("Expected the autoscaler not to be degraded once it stopped waiting, but got %s", degraded)
+	}
+
+	args.Kubernetes.MissingWorkload = "fail"
+	if err := autoscaler.WaitForWorkloads(mockK8sClient{Kinds: []string{}}, args); err != nil {
+		t.Errorf("Expected the missing workload not to be waited for with the fail policy, but got %s", err.Error())
+	}
+}
+
+func TestAzureDevopsURLFromWorkload(t *testing.T) {
+	var requestedPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestedPaths = append(requestedPaths, request.URL.Path)
+		writer.Write([]byte(`{"count":1,"value":[{"id":1,"name":"pool-1"}]}`))
+	}))
+	defer server.Close()
+
+	backendArgs := args.Args{
+		Backend: args.BackendAzurePipelines,
+		AZD: args.AzureDevopsArgs{
+			Token:           "token",
+			Timeout:         time.Second,
+			URLFromWorkload: true,
+		},
+		Kubernetes: args.KubernetesArgs{
+			Type:                "StatefulSet",
+			Name:                "azp-agent",
+			Namespace:           "url-from-workload",
+			AdditionalWorkloads: []args.WorkloadArgs{{Name: "azp-agent-gpu"}},
+		},
+	}
+	// The URL is read from the agent containers of every workload, without the trailing slash
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{},
+		Env:    []corev1.EnvVar{{Name: "AZP_URL", Value: server.URL + "/"}},
+	}
+	backend, err := autoscaler.MakeBackend(backendArgs, kubernetes.MakeFromClient(k8sClient))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pools, err := backend.Pools(""); err != nil {
+		t.Fatal(err.Error())
+	} else if len(pools) != 1 || pools[0].Name != "pool-1" {
+		t.Errorf("Expected the agent pools of the workloads' organization, but got %+v", pools)
+	}
+	if len(requestedPaths) != 1 || !strings.HasPrefix(requestedPaths[0], "/_apis/") {
+		t.Errorf("Expected the agent pools to be requested from the workloads' URL, but got %v", requestedPaths)
+	}
+
+	// Without the environment variable, the backend can't be created
+	k8sClient.Env = nil
+	if _, err := autoscaler.MakeBackend(backendArgs, kubernetes.MakeFromClient(k8sClient)); err == nil || !strings.Contains(err.Error(), "Could not retrieve the Azure Devops URL from statefulset/azp-agent") {
+		t.Errorf("Expected an error for the missing AZP_URL, but got %v", err)
+	}
+
+	k8sClient.WorkloadError = errors.New("statefulsets.apps \"azp-agent\" not found")
+	if _, err := autoscaler.MakeBackend(backendArgs, kubernetes.MakeFromClient(k8sClient)); err == nil || !strings.Contains(err.Error(), "Error retrieving statefulset/azp-agent in namespace url-from-workload") {
+		t.Errorf("Expected an error for the missing workload, but got %v", err)
+	}
+}
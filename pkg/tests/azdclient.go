@@ -2,6 +2,7 @@ package tests
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
 )
@@ -31,7 +32,8 @@ func Agents(num int32, free bool, startPos int32) []azuredevops.AgentDetails {
 					ID:   int(i),
 					Name: fmt.Sprintf("agent-%d", i),
 				},
-				Status: "online",
+				Status:  "online",
+				Enabled: true,
 			},
 			SystemCapabilities: map[string]string{
 				"HOSTNAME": fmt.Sprintf("azp-agent-%d", i),
@@ -80,47 +82,70 @@ type mockAZDClient struct {
 	NumQueuedJobs    int32
 	ErrorJobs        bool
 	FreeAgentsFirst  bool
+	// AgentVersions are the versions of the agents by index
+	AgentVersions []string
+	// AgentPodNames are the HOSTNAME capabilities of the agents, by index
+	AgentPodNames []string
+	// FinishedJobResults are the results of the jobs each agent finished, by agent index
+	FinishedJobResults map[int][]azuredevops.JobResult
+	// OfflineAgents are the indexes of the agents reported as offline
+	OfflineAgents []int
+	// QueuedJobDemands are the demands of the queued jobs, which no agent matches if set
+	QueuedJobDemands []string
+	// Calls records the agents that were disabled, enabled and deleted, if it isn't nil
+	Calls *mockAZDClientCalls
+	// ManageForbidden rejects disabling, deleting and setting the capabilities of the agents, like a read-only token
+	ManageForbidden bool
+}
+
+// Make this a pointer to allow stateful changes
+type mockAZDClientCalls struct {
+	DisabledAgentIDs []int
+	EnabledAgentIDs  []int
+	DeletedAgentIDs  []int
+	// Capabilities are the user capabilities set on the agents by agent ID
+	Capabilities map[int]map[string]string
 }
 
 // ListPoolsAsync retrieves a list of agent pools
 func (c mockAZDClient) ListPoolsAsync(channel chan<- azuredevops.PoolDetailsResponse) {
 	if c.ErrorListPools {
-		channel <- azuredevops.PoolDetailsResponse{[]azuredevops.PoolDetails{}, fmt.Errorf("Mock AZD Client Error")}
+		channel <- azuredevops.PoolDetailsResponse{Pools: []azuredevops.PoolDetails{}, Err: fmt.Errorf("Mock AZD Client Error")}
 	} else {
-		channel <- azuredevops.PoolDetailsResponse{PoolDetails(c.NumPools, 0), nil}
+		channel <- azuredevops.PoolDetailsResponse{Pools: PoolDetails(c.NumPools, 0), Err: nil}
 	}
 }
 
 // ListPoolsByNameAsync retrieves a list of agent pools with the given name
 func (c mockAZDClient) ListPoolsByNameAsync(channel chan<- azuredevops.PoolDetailsResponse, poolName string) {
 	if c.ErrorListPools {
-		channel <- azuredevops.PoolDetailsResponse{[]azuredevops.PoolDetails{}, fmt.Errorf("Mock AZD Client Error")}
+		channel <- azuredevops.PoolDetailsResponse{Pools: []azuredevops.PoolDetails{}, Err: fmt.Errorf("Mock AZD Client Error")}
 	} else {
 		pools := PoolDetails(c.NumPools, 0)
 		for _, pool := range pools {
 			if pool.Name == poolName {
-				channel <- azuredevops.PoolDetailsResponse{[]azuredevops.PoolDetails{pool}, nil}
+				channel <- azuredevops.PoolDetailsResponse{Pools: []azuredevops.PoolDetails{pool}, Err: nil}
 				return
 			}
 		}
-		channel <- azuredevops.PoolDetailsResponse{[]azuredevops.PoolDetails{}, nil}
+		channel <- azuredevops.PoolDetailsResponse{Pools: []azuredevops.PoolDetails{}, Err: nil}
 	}
 }
 
 // ListPoolAgentsAsync retrieves all of the agents in a pool
 func (c mockAZDClient) ListPoolAgentsAsync(channel chan<- azuredevops.PoolAgentsResponse, poolID int) {
-	if c.ErrorListPools {
-		channel <- azuredevops.PoolAgentsResponse{[]azuredevops.AgentDetails{}, fmt.Errorf("Mock AZD Client Error")}
+	if c.ErrorListPools || c.ErrorAgents {
+		channel <- azuredevops.PoolAgentsResponse{Agents: []azuredevops.AgentDetails{}, Err: fmt.Errorf("Mock AZD Client Error")}
 	} else {
 		agents := c.listPoolAgents()
-		channel <- azuredevops.PoolAgentsResponse{agents, nil}
+		channel <- azuredevops.PoolAgentsResponse{Agents: agents, Err: nil}
 	}
 }
 
 // ListJobRequestsAsync retrieves the job requests for a pool
 func (c mockAZDClient) ListJobRequestsAsync(channel chan<- azuredevops.JobRequestsResponse, poolID int) {
-	if c.ErrorListPools {
-		channel <- azuredevops.JobRequestsResponse{[]azuredevops.JobRequest{}, fmt.Errorf("Mock AZD Client Error")}
+	if c.ErrorListPools || c.ErrorJobs {
+		channel <- azuredevops.JobRequestsResponse{Jobs: []azuredevops.JobRequest{}, Err: fmt.Errorf("Mock AZD Client Error")}
 	} else {
 		agents := c.listPoolAgents()
 		runningAgentPos := int32(0)
@@ -128,8 +153,23 @@ func (c mockAZDClient) ListJobRequestsAsync(channel chan<- azuredevops.JobReques
 			runningAgentPos = c.NumFreeAgents
 		}
 		jobs := Jobs(c.NumRunningAgents, false, agents, 0, runningAgentPos)
-		jobs = append(jobs, Jobs(c.NumQueuedJobs, true, agents, int32(len(agents)), runningAgentPos)...)
-		channel <- azuredevops.JobRequestsResponse{jobs, nil}
+		queuedJobs := Jobs(c.NumQueuedJobs, true, agents, int32(len(agents)), runningAgentPos)
+		for i := range queuedJobs {
+			if len(c.QueuedJobDemands) > 0 {
+				queuedJobs[i].Demands = c.QueuedJobDemands
+				queuedJobs[i].MatchesAllAgentsInPool = false
+				queuedJobs[i].MatchedAgents = nil
+			}
+		}
+		jobs = append(jobs, queuedJobs...)
+		for i, results := range c.FinishedJobResults {
+			for _, result := range results {
+				finishedJob := Jobs(1, false, agents, 0, int32(i))[0]
+				finishedJob.Result = string(result)
+				jobs = append(jobs, finishedJob)
+			}
+		}
+		channel <- azuredevops.JobRequestsResponse{Jobs: jobs, Err: nil}
 	}
 }
 
@@ -142,6 +182,68 @@ func (c mockAZDClient) listPoolAgents() []azuredevops.AgentDetails {
 		agents = append(agents, Agents(c.NumRunningAgents, false, 0)...)
 		agents = append(agents, Agents(c.NumFreeAgents, true, int32(len(agents)))...)
 	}
+	for i := range agents {
+		if i < len(c.AgentVersions) {
+			agents[i].Version = c.AgentVersions[i]
+		}
+		if i < len(c.AgentPodNames) {
+			agents[i].SystemCapabilities["HOSTNAME"] = c.AgentPodNames[i]
+		}
+	}
+	for _, i := range c.OfflineAgents {
+		agents[i].Status = "offline"
+	}
 
 	return agents
 }
+
+// DisableAgentAsync disables an agent
+func (c mockAZDClient) DisableAgentAsync(channel chan<- error, poolID int, agentID int) {
+	if c.ManageForbidden {
+		channel <- &azuredevops.HTTPError{StatusCode: http.StatusForbidden, Endpoint: "/_apis/distributedtask/pools/agents"}
+		return
+	}
+	if c.Calls != nil {
+		c.Calls.DisabledAgentIDs = append(c.Calls.DisabledAgentIDs, agentID)
+	}
+	channel <- nil
+}
+
+// EnableAgentAsync enables an agent
+func (c mockAZDClient) EnableAgentAsync(channel chan<- error, poolID int, agentID int) {
+	if c.ManageForbidden {
+		channel <- &azuredevops.HTTPError{StatusCode: http.StatusForbidden, Endpoint: "/_apis/distributedtask/pools/agents"}
+		return
+	}
+	if c.Calls != nil {
+		c.Calls.EnabledAgentIDs = append(c.Calls.EnabledAgentIDs, agentID)
+	}
+	channel <- nil
+}
+
+// DeleteAgentAsync deregisters an agent
+func (c mockAZDClient) DeleteAgentAsync(channel chan<- error, poolID int, agentID int) {
+	if c.ManageForbidden {
+		channel <- &azuredevops.HTTPError{StatusCode: http.StatusForbidden, Endpoint: "/_apis/distributedtask/pools/agents"}
+		return
+	}
+	if c.Calls != nil {
+		c.Calls.DeletedAgentIDs = append(c.Calls.DeletedAgentIDs, agentID)
+	}
+	channel <- nil
+}
+
+// UpdateUserCapabilitiesAsync replaces the user capabilities of an agent
+func (c mockAZDClient) UpdateUserCapabilitiesAsync(channel chan<- error, poolID int, agentID int, capabilities map[string]string) {
+	if c.ManageForbidden {
+		channel <- &azuredevops.HTTPError{StatusCode: http.StatusForbidden, Endpoint: "/_apis/distributedtask/pools/agents/usercapabilities"}
+		return
+	}
+	if c.Calls != nil {
+		if c.Calls.Capabilities == nil {
+			c.Calls.Capabilities = make(map[int]map[string]string)
+		}
+		c.Calls.Capabilities[agentID] = capabilities
+	}
+	channel <- nil
+}
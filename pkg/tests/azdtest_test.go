@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azdtest"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+func TestFakeAzureDevops(t *testing.T) {
+	server := azdtest.NewServer("token")
+	defer server.Close()
+	poolID := server.AddPool("linux")
+	server.AddHostedPool("Azure Pipelines")
+
+	if _, err := azuredevops.NewBackend(azuredevops.MakeClient(server.URL, "wrong", time.Second)).Pools(""); !azuredevops.IsAuthError(err) {
+		t.Fatalf("Expected an auth error with the wrong token, but got %v", err)
+	}
+	backend := azuredevops.NewBackend(azuredevops.MakeClient(server.URL, "token", time.Second))
+	pools, err := backend.Pools("")
+	if err != nil {
+		t.Fatal(err.Error())
+	} else if len(pools) != 1 || pools[0].ID != poolID {
+		t.Fatalf("Expected only the self-hosted pool, but got %+v", pools)
+	}
+
+	args := args.Args{
+		Min:  1,
+		Max:  10,
+		Rate: 10 * time.Second,
+		ScaleDown: args.ScaleDownArgs{
+			Max: 10,
+		},
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent",
+			Namespace: "azdtest",
+		},
+	}
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{
+			NumPods: 1,
+		},
+	}
+	workload := k8sClient.GetWorkloadNoError(args.Kubernetes)
+
+	// The agents of the pods register themselves, like a StatefulSet's agents
+	registerAgents := func() {
+		var podNames []string
+		for i := int32(0); i < k8sClient.Counts.NumPods; i++ {
+			podNames = append(podNames, fmt.Sprintf("%s-%d", workload.Name, i))
+		}
+		server.SetAgents(poolID, podNames...)
+	}
+
+	server.Play(azdtest.Scenario{
+		azdtest.QueueJobs(poolID, 3),
+		azdtest.DispatchJobs(poolID),
+		azdtest.FinishJobs(poolID, 3, azuredevops.JobResultSucceeded),
+		azdtest.Fail(http.StatusServiceUnavailable, -1),
+	})
+	// 3 queued jobs and 1 free agent, then 3 busy agents and 1 free agent, then only 1 free agent
+	expectedPods := []int32{4, 4, 1}
+	registerAgents()
+	for step := 0; server.Next(); step++ {
+		err := scaling.Autoscale(backend, poolID, kubernetes.MakeFromClient(k8sClient), workload, args)
+		registerAgents()
+		if step == len(expectedPods) {
+			if err == nil {
+				t.Fatal("Expected an error while Azure Devops is unavailable")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Step %d: %s", step, err.Error())
+		} else if k8sClient.Counts.NumPods != expectedPods[step] {
+			t.Fatalf("Step %d: expected %d pods, but got %d", step, expectedPods[step], k8sClient.Counts.NumPods)
+		}
+	}
+	if calls := server.Calls("ListJobRequests"); calls < len(expectedPods) {
+		t.Fatalf("Expected the job requests to be listed every iteration, but they were listed %d times", calls)
+	}
+}
@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+)
+
+func TestAzureDevopsTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		writer.Write([]byte(`{"count":0,"value":[]}`))
+	}))
+	defer server.Close()
+
+	pools := make(chan azuredevops.PoolDetailsResponse)
+	start := time.Now()
+	go azuredevops.MakeClient(server.URL, "token", 50*time.Millisecond).ListPoolsAsync(pools)
+	if response := <-pools; response.Err == nil {
+		t.Fatal("Expected the request to time out")
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Fatalf("Expected the request to time out after 50ms, but it took %s", elapsed.String())
+	}
+}
+
+func TestAzureDevopsConnectionReuse(t *testing.T) {
+	// The response has trailing whitespace the JSON decoder doesn't read
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"count":0,"value":[]}` + "\n\n"))
+	}))
+	var numConnections int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&numConnections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := azuredevops.MakeClient(server.URL, "token", time.Second)
+	for i := 0; i < 3; i++ {
+		pools := make(chan azuredevops.PoolDetailsResponse)
+		go client.ListPoolsAsync(pools)
+		if response := <-pools; response.Err != nil {
+			t.Fatalf("Error listing the pools: %s", response.Err.Error())
+		}
+		agents := make(chan azuredevops.PoolAgentsResponse)
+		go client.ListPoolAgentsAsync(agents, 1)
+		if response := <-agents; response.Err != nil {
+			t.Fatalf("Error listing the agents: %s", response.Err.Error())
+		}
+	}
+	if n := atomic.LoadInt32(&numConnections); n != 1 {
+		t.Fatalf("Expected the requests to reuse 1 connection, but %d were opened", n)
+	}
+}
+
+func TestAzureDevopsConnectionMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"count":0,"value":[]}`))
+	}))
+	defer server.Close()
+
+	connections := func(reused string) float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatalf("Error gathering metrics: %s", err.Error())
+		}
+		for _, family := range families {
+			if family.GetName() != "azp_agent_autoscaler_azd_connection_count" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				if label := metric.GetLabel()[0]; label.GetName() == "reused" && label.GetValue() == reused {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+		return 0
+	}
+	newBefore, reusedBefore := connections("false"), connections("true")
+
+	client := azuredevops.MakeClientWithConnections(server.URL, func() string { return "token" }, time.Second, azuredevops.Connections{MaxIdlePerHost: 1, IdleTimeout: time.Minute})
+	for i := 0; i < 3; i++ {
+		pools := make(chan azuredevops.PoolDetailsResponse)
+		go client.ListPoolsAsync(pools)
+		if response := <-pools; response.Err != nil {
+			t.Fatalf("Error listing the pools: %s", response.Err.Error())
+		}
+	}
+	if newConnections, reusedConnections := connections("false")-newBefore, connections("true")-reusedBefore; newConnections != 1 || reusedConnections != 2 {
+		t.Fatalf("Expected 1 new connection reused twice, but got %v new and %v reused connections", newConnections, reusedConnections)
+	}
+}
+
+// serveDNS answers the A queries of a host with 127.0.0.1 on a UDP port, and returns the number of queries it answered
+func serveDNS(t *testing.T, host string) (string, *int32) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	var numQueries int32
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buffer[:n])
+			if err != nil {
+				continue
+			}
+			question, err := parser.Question()
+			if err != nil {
+				continue
+			}
+			builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+			builder.EnableCompression()
+			builder.StartQuestions()
+			builder.Question(question)
+			builder.StartAnswers()
+			if question.Type == dnsmessage.TypeA && strings.EqualFold(question.Name.String(), host+".") {
+				atomic.AddInt32(&numQueries, 1)
+				builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+			}
+			if response, err := builder.Finish(); err == nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), &numQueries
+}
+
+func TestAzureDevopsDNSServers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"count":0,"value":[]}`))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	// The host only resolves with the DNS server
+	const host = "dev.azure.test"
+	dnsServer, numQueries := serveDNS(t, host)
+	azdURL := "http://" + net.JoinHostPort(host, serverURL.Port())
+
+	testCases := []struct {
+		name        string
+		connections azuredevops.Connections
+		expectErr   bool
+	}{
+		{"dual stack", azuredevops.Connections{MaxIdlePerHost: 1, DNSServers: []string{dnsServer}}, false},
+		{"ipv4", azuredevops.Connections{MaxIdlePerHost: 1, DNSServers: []string{dnsServer}, Network: "tcp4"}, false},
+		{"ipv6", azuredevops.Connections{MaxIdlePerHost: 1, DNSServers: []string{dnsServer}, Network: "tcp6"}, true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			pools := make(chan azuredevops.PoolDetailsResponse)
+			go azuredevops.MakeClientWithConnections(azdURL, func() string { return "token" }, 2*time.Second, testCase.connections).ListPoolsAsync(pools)
+			if response := <-pools; testCase.expectErr && response.Err == nil {
+				t.Error("Expected an error, as the host only has an IPv4 address")
+			} else if !testCase.expectErr && response.Err != nil {
+				t.Errorf("Error listing the pools: %s", response.Err.Error())
+			}
+		})
+	}
+	if atomic.LoadInt32(numQueries) == 0 {
+		t.Error("Expected the host to be resolved by the DNS server")
+	}
+}
+
+func TestAzureDevopsRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Retry-After", "30")
+		writer.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	pools := make(chan azuredevops.PoolDetailsResponse)
+	go azuredevops.MakeClient(server.URL, "token", time.Second).ListPoolsAsync(pools)
+	response := <-pools
+	var httpError *azuredevops.HTTPError
+	if !errors.As(response.Err, &httpError) {
+		t.Fatalf("Expected an HTTP error, but got %v", response.Err)
+	}
+	if httpError.RetryAfter == nil || *httpError.RetryAfter != 30*time.Second {
+		t.Fatalf("Expected to retry after 30s, but got %v", httpError.RetryAfter)
+	}
+}
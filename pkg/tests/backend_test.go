@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+)
+
+func TestAzurePipelinesBackend(t *testing.T) {
+	backend := azuredevops.NewBackend(mockAZDClient{NumPools: 3, NumRunningAgents: 2, NumFreeAgents: 1, NumQueuedJobs: 4})
+
+	pools, err := backend.Pools("pool-2")
+	if err != nil || len(pools) != 1 || pools[0].ID != 2 {
+		t.Fatalf("Expected pool-2 with ID 2, but got %+v (error %v)", pools, err)
+	}
+
+	agents, err := backend.Agents(pools[0].ID)
+	if err != nil || len(agents) != 3 {
+		t.Fatalf("Expected 3 agents, but got %d (error %v)", len(agents), err)
+	}
+	if agent := agents[0]; agent.PodName != "azp-agent-0" || !agent.Online || !agent.Busy {
+		t.Fatalf("Expected agent-0 to be busy and online on pod azp-agent-0, but got %+v", agent)
+	}
+	if agent := agents[2]; agent.Busy {
+		t.Fatalf("Expected agent-2 to be idle, but got %+v", agent)
+	}
+
+	jobs, err := backend.Jobs(pools[0].ID)
+	if err != nil {
+		t.Fatalf("Error retrieving the jobs: %s", err.Error())
+	}
+	if numQueued, numRunning := len(ci.QueuedJobs(jobs)), len(ci.RunningJobs(jobs)); numQueued != 4 || numRunning != 2 {
+		t.Fatalf("Expected 4 queued and 2 running jobs, but got %d queued and %d running", numQueued, numRunning)
+	}
+
+	calls := &mockAZDClientCalls{}
+	backend = azuredevops.NewBackend(mockAZDClient{NumPools: 3, Calls: calls})
+	if err := backend.Drain(2, agents[1]); err != nil {
+		t.Fatalf("Error draining agent-1: %s", err.Error())
+	}
+	if err := backend.Remove(2, agents[1]); err != nil {
+		t.Fatalf("Error removing agent-1: %s", err.Error())
+	}
+	if len(calls.DisabledAgentIDs) != 1 || calls.DisabledAgentIDs[0] != 1 || len(calls.DeletedAgentIDs) != 1 || calls.DeletedAgentIDs[0] != 1 {
+		t.Fatalf("Expected agent-1 to be disabled and deleted, but got %+v", calls)
+	}
+}
+
+func TestAgentNamePattern(t *testing.T) {
+	agents := []ci.Agent{
+		{Name: "azp-agent-3", PodName: "host"},
+		{Name: "ci-azp-agent-7f9c-x2k4", PodName: "host"},
+		{Name: "other-agent", PodName: "other-pod"},
+	}
+	tests := []struct {
+		pattern  string
+		podNames []string
+	}{
+		{"", []string{"host", "host", "other-pod"}},
+		{"{{workload}}-{{ordinal}}", []string{"azp-agent-3", "host", "other-pod"}},
+		{"ci-{{pod}}", []string{"host", "azp-agent-7f9c-x2k4", "other-pod"}},
+		{`^ci-(?P<pod>azp-agent-[a-z0-9]+)-[a-z0-9]+$`, []string{"host", "azp-agent-7f9c", "other-pod"}},
+		{`^azp-agent-(?P<ordinal>[0-9]+)$`, []string{"azp-agent-3", "host", "other-pod"}},
+	}
+	for _, test := range tests {
+		pattern, err := ci.ParseAgentNamePattern(test.pattern)
+		if test.pattern == "" {
+			pattern = ci.AgentNamePattern{}
+		} else if err != nil {
+			t.Fatalf("Error parsing the agent name pattern %s: %s", test.pattern, err.Error())
+		}
+		mapped := pattern.PodNames(agents, "azp-agent")
+		for i, podName := range test.podNames {
+			if mapped[i].PodName != podName {
+				t.Errorf("Expected agent %s to have pod %s with the pattern %s, but got %s", agents[i].Name, podName, test.pattern, mapped[i].PodName)
+			}
+		}
+	}
+	if agents[0].PodName != "host" {
+		t.Errorf("Expected the agents not to be modified, but got pod %s", agents[0].PodName)
+	}
+
+	for _, invalid := range []string{"{{workload}}-agent", "{{workload}}-{{index}}", "{{pod}}-{{pod}}", "{{workload", "^azp-agent-[0-9]+$", "(?P<pod>"} {
+		if _, err := ci.ParseAgentNamePattern(invalid); err == nil {
+			t.Errorf("Expected the agent name pattern %s to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+func mockNode(name string, cpu string, memory string, ready bool, unschedulable bool) corev1.Node {
+	readyStatus := corev1.ConditionTrue
+	if !ready {
+		readyStatus = corev1.ConditionFalse
+	}
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{Unschedulable: unschedulable},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse(memory),
+				corev1.ResourcePods:   resource.MustParse("110"),
+			},
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: readyStatus},
+			},
+		},
+	}
+}
+
+func mockPodSpec(nodeName string, cpu string, memory string) corev1.PodSpec {
+	return corev1.PodSpec{
+		NodeName: nodeName,
+		Containers: []corev1.Container{{
+			Name: "agent",
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse(cpu),
+					corev1.ResourceMemory: resource.MustParse(memory),
+				},
+			},
+		}},
+	}
+}
+
+func TestEstimateSchedulablePods(t *testing.T) {
+	nodes := []corev1.Node{
+		mockNode("node-0", "4", "16Gi", true, false),
+		mockNode("node-1", "4", "16Gi", true, false),
+		mockNode("node-not-ready", "4", "16Gi", false, false),
+		mockNode("node-cordoned", "4", "16Gi", true, true),
+	}
+	pods := []corev1.Pod{
+		{Spec: mockPodSpec("node-0", "1500m", "2Gi"), Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+		{Spec: mockPodSpec("node-1", "500m", "12Gi"), Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+		{Spec: mockPodSpec("node-1", "4", "16Gi"), Status: corev1.PodStatus{Phase: corev1.PodSucceeded}},
+	}
+
+	testCases := []struct {
+		cpu      string
+		memory   string
+		expected int32
+	}{
+		// node-0 has 2500m CPU and 14Gi free, node-1 has 3500m CPU and 4Gi free
+		{"1", "1Gi", 2 + 3},
+		{"1", "4Gi", 2 + 1},
+		{"500m", "256Mi", 5 + 7},
+		{"3", "1Gi", 0 + 1},
+		{"8", "1Gi", 0},
+	}
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("%s_cpu,%s_memory", testCase.cpu, testCase.memory), func(t *testing.T) {
+			actual := kubernetes.EstimateSchedulablePods(nodes, pods, mockPodSpec("", testCase.cpu, testCase.memory))
+			if actual != testCase.expected {
+				t.Fatalf("Expected %d schedulable pods, but got %d", testCase.expected, actual)
+			}
+		})
+	}
+}
+
+func TestEstimateSchedulablePodsWithPreemption(t *testing.T) {
+	nodes := []corev1.Node{mockNode("node-0", "4", "16Gi", true, false)}
+	priority := func(value int32, spec corev1.PodSpec) corev1.Pod {
+		spec.Priority = &value
+		return corev1.Pod{Spec: spec, Status: corev1.PodStatus{Phase: corev1.PodRunning}}
+	}
+	pods := []corev1.Pod{
+		priority(1000, mockPodSpec("node-0", "1", "1Gi")),
+		priority(100, mockPodSpec("node-0", "1", "1Gi")),
+		{Spec: mockPodSpec("node-0", "1", "1Gi"), Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+	}
+
+	testCases := []struct {
+		priority int32
+		expected int32
+	}{
+		// The pods without a priority have the priority of 0
+		{0, 1},
+		{100, 2},
+		{101, 3},
+		{1000, 3},
+		{1001, 4},
+	}
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("priority_%d", testCase.priority), func(t *testing.T) {
+			remaining := kubernetes.ExcludePreemptedPods(pods, testCase.priority)
+			actual := kubernetes.EstimateSchedulablePods(nodes, remaining, mockPodSpec("", "1", "1Gi"))
+			if actual != testCase.expected {
+				t.Fatalf("Expected %d schedulable pods, but got %d", testCase.expected, actual)
+			}
+		})
+	}
+}
+
+func TestEstimateSchedulablePodsOnEligibleNodes(t *testing.T) {
+	ciNode := mockNode("ci-node", "4", "16Gi", true, false)
+	ciNode.Labels = map[string]string{"agentpool": "ci", "kubernetes.io/os": "linux"}
+	ciNode.Spec.Taints = []corev1.Taint{{Key: "dedicated", Value: "ci", Effect: corev1.TaintEffectNoSchedule}}
+	windowsNode := mockNode("windows-node", "4", "16Gi", true, false)
+	windowsNode.Labels = map[string]string{"agentpool": "ci", "kubernetes.io/os": "windows"}
+	windowsNode.Spec.Taints = []corev1.Taint{{Key: "dedicated", Value: "ci", Effect: corev1.TaintEffectNoSchedule}}
+	systemNode := mockNode("system-node", "4", "16Gi", true, false)
+	systemNode.Labels = map[string]string{"agentpool": "system", "kubernetes.io/os": "linux"}
+	// PreferNoSchedule taints don't prevent scheduling
+	systemNode.Spec.Taints = []corev1.Taint{{Key: "critical", Effect: corev1.TaintEffectPreferNoSchedule}}
+	nodes := []corev1.Node{ciNode, windowsNode, systemNode}
+
+	toleration := corev1.Toleration{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "ci", Effect: corev1.TaintEffectNoSchedule}
+	linuxAffinity := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchExpressions: []corev1.NodeSelectorRequirement{
+						{Key: "kubernetes.io/os", Operator: corev1.NodeSelectorOpIn, Values: []string{"linux"}},
+					},
+				}},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		nodeSelector map[string]string
+		tolerations  []corev1.Toleration
+		affinity     *corev1.Affinity
+		expected     int32
+	}{
+		// Each node has capacity for 4 pods
+		{"untolerated", nil, nil, nil, 4},
+		{"tolerated", nil, []corev1.Toleration{toleration}, nil, 12},
+		{"node selector", map[string]string{"agentpool": "ci"}, []corev1.Toleration{toleration}, nil, 8},
+		{"node selector without toleration", map[string]string{"agentpool": "ci"}, nil, nil, 0},
+		{"node affinity", map[string]string{"agentpool": "ci"}, []corev1.Toleration{toleration}, linuxAffinity, 4},
+		{"tolerate everything", nil, []corev1.Toleration{{Operator: corev1.TolerationOpExists}}, linuxAffinity, 8},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			podSpec := mockPodSpec("", "1", "1Gi")
+			podSpec.NodeSelector = testCase.nodeSelector
+			podSpec.Tolerations = testCase.tolerations
+			podSpec.Affinity = testCase.affinity
+			actual := kubernetes.EstimateSchedulablePods(nodes, nil, podSpec)
+			if actual != testCase.expected {
+				t.Fatalf("Expected %d schedulable pods, but got %d", testCase.expected, actual)
+			}
+		})
+	}
+}
+
+func mockResourceQuota(name string, hard corev1.ResourceList, used corev1.ResourceList) corev1.ResourceQuota {
+	return corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.ResourceQuotaSpec{Hard: hard},
+		Status:     corev1.ResourceQuotaStatus{Hard: hard, Used: used},
+	}
+}
+
+func TestEstimateQuotaPods(t *testing.T) {
+	podSpec := mockPodSpec("", "500m", "2Gi")
+	podSpec.PriorityClassName = "azp-agent"
+
+	priorityClassQuota := mockResourceQuota("other-priority-class", corev1.ResourceList{corev1.ResourcePods: resource.MustParse("0")}, nil)
+	priorityClassQuota.Spec.ScopeSelector = &corev1.ScopeSelector{MatchExpressions: []corev1.ScopedResourceSelectorRequirement{
+		{ScopeName: corev1.ResourceQuotaScopePriorityClass, Operator: corev1.ScopeSelectorOpIn, Values: []string{"other"}},
+	}}
+	bestEffortQuota := mockResourceQuota("best-effort", corev1.ResourceList{corev1.ResourcePods: resource.MustParse("0")}, nil)
+	bestEffortQuota.Spec.Scopes = []corev1.ResourceQuotaScope{corev1.ResourceQuotaScopeBestEffort}
+
+	tests := map[string]struct {
+		quotas   []corev1.ResourceQuota
+		expected *kubernetes.QuotaLimit
+	}{
+		"no_quotas": {},
+		"pods": {
+			quotas: []corev1.ResourceQuota{
+				mockResourceQuota("pods", corev1.ResourceList{"count/pods": resource.MustParse("10")}, corev1.ResourceList{"count/pods": resource.MustParse("7")}),
+			},
+			expected: &kubernetes.QuotaLimit{Pods: 3, Quota: "pods", Resource: "count/pods"},
+		},
+		"cpu": {
+			quotas: []corev1.ResourceQuota{
+				mockResourceQuota("compute", corev1.ResourceList{
+					corev1.ResourceRequestsCPU:    resource.MustParse("4"),
+					corev1.ResourceRequestsMemory: resource.MustParse("64Gi"),
+				}, corev1.ResourceList{
+					corev1.ResourceRequestsCPU:    resource.MustParse("2800m"),
+					corev1.ResourceRequestsMemory: resource.MustParse("8Gi"),
+				}),
+			},
+			expected: &kubernetes.QuotaLimit{Pods: 2, Quota: "compute", Resource: corev1.ResourceRequestsCPU},
+		},
+		"exceeded": {
+			quotas: []corev1.ResourceQuota{
+				mockResourceQuota("memory", corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("8Gi")}, corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("9Gi")}),
+			},
+			expected: &kubernetes.QuotaLimit{Pods: 0, Quota: "memory", Resource: corev1.ResourceMemory},
+		},
+		"unlimited_resources": {
+			quotas: []corev1.ResourceQuota{
+				mockResourceQuota("limits", corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("1")}, nil),
+			},
+		},
+		"other_scopes": {
+			quotas: []corev1.ResourceQuota{priorityClassQuota, bestEffortQuota},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			limit := kubernetes.EstimateQuotaPods(test.quotas, podSpec)
+			if (limit == nil) != (test.expected == nil) || (limit != nil && *limit != *test.expected) {
+				t.Errorf("Expected quota limit %v, but got %v", test.expected, limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/cloudevents"
+)
+
+func TestCloudEventsPublish(t *testing.T) {
+	events := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Content-Type") != cloudevents.ContentType {
+			t.Errorf("Expected the content type %s, but was %s", cloudevents.ContentType, request.Header.Get("Content-Type"))
+		}
+		var event map[string]interface{}
+		json.NewDecoder(request.Body).Decode(&event)
+		events <- event
+		writer.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cloudevents.Init(server.URL, "/azp-agent-autoscaler")
+	cloudevents.Publish("com.example.decision", "azp/statefulset/azp-agent", map[string]int{"desiredReplicas": 7})
+
+	select {
+	case event := <-events:
+		if event["specversion"] != cloudevents.SpecVersion || event["type"] != "com.example.decision" || event["source"] != "/azp-agent-autoscaler" || event["subject"] != "azp/statefulset/azp-agent" {
+			t.Fatalf("Unexpected CloudEvent %+v", event)
+		}
+		if event["id"] == "" || event["data"].(map[string]interface{})["desiredReplicas"] != float64(7) {
+			t.Fatalf("Unexpected CloudEvent %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The CloudEvent was not sent")
+	}
+}
+
+func TestCloudEventsFlush(t *testing.T) {
+	received := make(chan struct{}, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		received <- struct{}{}
+		writer.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cloudevents.Init(server.URL, "/azp-agent-autoscaler")
+	for i := 0; i < 3; i++ {
+		cloudevents.Publish("com.example.decision", "azp/statefulset/azp-agent", nil)
+	}
+	cloudevents.Flush(5 * time.Second)
+
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 CloudEvents to be sent before Flush returned, but %d were", len(received))
+	}
+}
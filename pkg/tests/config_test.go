@@ -0,0 +1,303 @@
+package tests
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+)
+
+func writeConfig(t *testing.T, config string) string {
+	dir, err := ioutil.TempDir("", "azp-agent-autoscaler")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+azureDevops:
+  url: https://dev.azure.com/organization
+  token: azdtoken
+kubernetes:
+  namespace: azp
+  name: azp-agent
+  workloads:
+  - name: azp-agent-gpu
+    priority: 5
+scaling:
+  min: 2
+  max: 20
+  scaleDown:
+    delay: 5m
+logging:
+  levels:
+    scaling: debug
+notifications:
+  slack:
+    minSeverity: warning
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	flag.Set("config", path)
+	defer flag.Set("config", "")
+	// The command line takes precedence over the file
+	flag.Set("max", "50")
+
+	if err := args.LoadConfig(); err != nil {
+		t.Fatalf("Error loading the config: %s", err.Error())
+	}
+	if err := args.ValidateArgs(); err != nil {
+		t.Fatalf("Error validating the config: %s", err.Error())
+	}
+	parsed := args.ArgsFromFlags()
+	if parsed.AZD.URL != "https://dev.azure.com/organization" || parsed.Kubernetes.Namespace != "azp" || parsed.Kubernetes.Name != "azp-agent" {
+		t.Fatalf("Unexpected Azure Devops or Kubernetes args %+v %+v", parsed.AZD, parsed.Kubernetes)
+	}
+	if parsed.Min != 2 || parsed.Max != 50 || parsed.ScaleDown.Delay != 5*time.Minute {
+		t.Fatalf("Expected a min of 2, a max of 50 and a scale down delay of 5m, but got %d, %d and %s", parsed.Min, parsed.Max, parsed.ScaleDown.Delay)
+	}
+	if len(parsed.Kubernetes.AdditionalWorkloads) != 1 || parsed.Kubernetes.AdditionalWorkloads[0].Priority != 5 {
+		t.Fatalf("Unexpected additional workloads %+v", parsed.Kubernetes.AdditionalWorkloads)
+	}
+	if _, hasLevel := parsed.Logging.ComponentLevels["scaling"]; !hasLevel || parsed.Notifications.SlackMinSeverity != "warning" {
+		t.Fatalf("Unexpected logging or notification args %+v %+v", parsed.Logging, parsed.Notifications)
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	path := writeConfig(t, "scaling:\n  mins: 2\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	flag.Set("config", path)
+	defer flag.Set("config", "")
+
+	err := args.LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "field mins not found") {
+		t.Fatalf("Expected an error for the unknown field mins, but got %v", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	config := `
+azureDevops:
+  url: https://dev.azure.com/organization
+  token: %s
+kubernetes:
+  namespace: azp
+  name: azp-agent
+scaling:
+  min: 3
+`
+	path := writeConfig(t, strings.Replace(config, "%s", "azdtoken", 1))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	flag.Set("config", path)
+	defer flag.Set("config", "")
+	if err := args.LoadConfig(); err != nil {
+		t.Fatalf("Error loading the config: %s", err.Error())
+	}
+
+	// Remove the min and rotate the token
+	rotated := strings.Replace(strings.Replace(config, "%s", "rotatedtoken", 1), "scaling:\n  min: 3\n", "", 1)
+	if err := ioutil.WriteFile(path, []byte(rotated), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	reloaded, err := args.ReloadConfig()
+	if err != nil {
+		t.Fatalf("Error reloading the config: %s", err.Error())
+	}
+	if reloaded.AZD.Token != "rotatedtoken" || reloaded.Min != 1 {
+		t.Fatalf("Expected the rotated token and the default min of 1, but got %s and %d", reloaded.AZD.Token, reloaded.Min)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("scaling:\n  min: -1\n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := args.ReloadConfig(); err == nil {
+		t.Fatal("Expected an error reloading an invalid config")
+	}
+}
+
+func TestDefaultNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azp-agent-autoscaler")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { args.ServiceAccountNamespaceFile = file }(args.ServiceAccountNamespaceFile)
+	args.ServiceAccountNamespaceFile = filepath.Join(dir, "namespace")
+	flag.Set("namespace", "")
+
+	// Outside of a pod, the namespace is required
+	if err := args.ValidateArgs(); err == nil || !strings.Contains(err.Error(), "Namespace is required") {
+		t.Errorf("Expected the namespace to be required, but got %v", err)
+	}
+
+	// The file is read when the args are resolved, not when the flags are defined
+	if err := ioutil.WriteFile(args.ServiceAccountNamespaceFile, []byte("azp-agents\n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := args.ValidateArgs(); err != nil && strings.Contains(err.Error(), "Namespace is required") {
+		t.Errorf("Expected the namespace of the service account to be used, but got %s", err.Error())
+	}
+	parsed := args.ArgsFromFlags()
+	if parsed.Kubernetes.Namespace != "azp-agents" || parsed.State.Namespace != "azp-agents" || parsed.History.Namespace != "azp-agents" {
+		t.Errorf("Expected the namespace of the service account, but got %s", parsed.Kubernetes.Namespace)
+	}
+
+	// The argument takes precedence over the service account
+	flag.Set("namespace", "azp")
+	defer flag.Set("namespace", "")
+	if parsed := args.ArgsFromFlags(); parsed.Kubernetes.Namespace != "azp" {
+		t.Errorf("Expected the namespace argument, but got %s", parsed.Kubernetes.Namespace)
+	}
+}
+
+func TestLoadConfigEnvVars(t *testing.T) {
+	os.Setenv("AZP_AUTOSCALER_TEST_ORGANIZATION", "organization")
+	defer os.Unsetenv("AZP_AUTOSCALER_TEST_ORGANIZATION")
+
+	path := writeConfig(t, `
+azureDevops:
+  url: https://dev.azure.com/${AZP_AUTOSCALER_TEST_ORGANIZATION}
+kubernetes:
+  namespace: ${AZP_AUTOSCALER_TEST_NAMESPACE:-azp}
+notifications:
+  template: costs $$5
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	flag.Set("config", path)
+	defer flag.Set("config", "")
+	if err := args.LoadConfig(); err != nil {
+		t.Fatalf("Error loading the config: %s", err.Error())
+	}
+	parsed := args.ArgsFromFlags()
+	if parsed.AZD.URL != "https://dev.azure.com/organization" || parsed.Kubernetes.Namespace != "azp" {
+		t.Fatalf("Expected the expanded URL and the default namespace, but got %s and %s", parsed.AZD.URL, parsed.Kubernetes.Namespace)
+	}
+	var message bytes.Buffer
+	if parsed.Notifications.Template.Execute(&message, nil); message.String() != "costs $5" {
+		t.Fatalf("Expected $$ to be a literal $, but got %s", message.String())
+	}
+
+	if err := ioutil.WriteFile(path, []byte("azureDevops:\n  token: ${AZP_AUTOSCALER_TEST_MISSING}\n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	err := args.LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "azureDevops.token: environment variable AZP_AUTOSCALER_TEST_MISSING is not set") {
+		t.Fatalf("Expected an error for the missing environment variable, but got %v", err)
+	}
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	path := writeConfig(t, `
+kubernetes:
+  namespace: azp
+  name: azp-agent
+  workloads:
+  - name: azp-agent-gpu
+scaling:
+  min: 1
+  rate: 30s
+profiles:
+  prod:
+    kubernetes:
+      workloads:
+      - name: azp-agent-large
+    scaling:
+      min: 3
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	flag.Set("config", path)
+	defer flag.Set("config", "")
+	flag.Set("profile", "prod")
+	defer flag.Set("profile", "")
+	if err := args.LoadConfig(); err != nil {
+		t.Fatalf("Error loading the config: %s", err.Error())
+	}
+	parsed := args.ArgsFromFlags()
+	if parsed.Min != 3 || parsed.Rate != 30*time.Second {
+		t.Fatalf("Expected the min of 3 from the profile and the rate of 30s from the file, but got %d and %s", parsed.Min, parsed.Rate)
+	}
+	workloads := parsed.Kubernetes.Workloads()
+	if len(workloads) != 2 || workloads[1].Name != "azp-agent-large" {
+		t.Fatalf("Expected the profile's workloads to replace the file's, but got %v", workloads)
+	}
+
+	flag.Set("profile", "staging")
+	err := args.LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "has no profile staging") {
+		t.Fatalf("Expected an error for the unknown profile, but got %v", err)
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	flag.Set("token", "azdtoken")
+	defer flag.Set("token", "")
+	flag.Set("rate-limit", "10")
+	defer flag.Set("rate-limit", "0")
+	flag.Set("log-levels", "scaling=debug,health=warn")
+	defer flag.Set("log-levels", "")
+	flag.Set("cloudevents-source", "azp-$agent")
+	defer flag.Set("cloudevents-source", "")
+
+	config, notes := args.MigrateConfig()
+	// The token isn't written to the config file
+	if config.AzureDevops.Token == nil || *config.AzureDevops.Token != "${AZP_TOKEN}" {
+		t.Fatalf("Expected the token to be read from AZP_TOKEN, but got %v", config.AzureDevops.Token)
+	}
+	if len(notes) == 0 || !strings.Contains(notes[0], "AZP_TOKEN") {
+		t.Fatalf("Expected a note to set AZP_TOKEN, but got %v", notes)
+	}
+	if config.Scaling.RateLimit.Max == nil || *config.Scaling.RateLimit.Max != 10 {
+		t.Fatalf("Expected a rate limit of 10, but got %v", config.Scaling.RateLimit.Max)
+	}
+	if config.Logging.Levels["scaling"] != "debug" || config.Logging.Levels["health"] != "warn" {
+		t.Fatalf("Unexpected log levels %v", config.Logging.Levels)
+	}
+	// A $ is escaped, so it isn't expanded as an environment variable
+	if config.CloudEvents.Source == nil || *config.CloudEvents.Source != "azp-$$agent" {
+		t.Fatalf("Expected an escaped CloudEvents source, but got %v", config.CloudEvents.Source)
+	}
+	// Flags that aren't set are left out
+	if config.Scaling.Balloon.Image != nil {
+		t.Fatalf("Expected no balloon image, but got %s", *config.Scaling.Balloon.Image)
+	}
+}
+
+func TestConfigSummary(t *testing.T) {
+	flag.Set("token", "azdtoken")
+	defer flag.Set("token", "")
+	flag.Set("otlp-headers", "api-key=secret")
+	defer flag.Set("otlp-headers", "")
+	flag.Set("rate-limit", "10")
+	defer flag.Set("rate-limit", "0")
+
+	summary := strings.Join(args.ConfigSummary(), " ")
+	if strings.Contains(summary, "azdtoken") || strings.Contains(summary, "secret") {
+		t.Fatalf("Expected the secrets to be redacted, but got %s", summary)
+	}
+	for _, expected := range []string{"--token=<redacted>", "--otlp-headers=<redacted>", "--rate-limit=10"} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("Expected the summary to contain %s, but got %s", expected, summary)
+		}
+	}
+	// Flags that aren't set are left out
+	if strings.Contains(summary, "--balloon-image") {
+		t.Errorf("Expected the balloon image to be left out, but got %s", summary)
+	}
+}
@@ -0,0 +1,191 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+func TestDoctor(t *testing.T) {
+	doctorArgs := args.Args{
+		Min:     1,
+		Max:     10,
+		Backend: args.BackendAzurePipelines,
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent",
+			Namespace: "doctor",
+		},
+	}
+	pool := []corev1.EnvVar{{Name: "AZP_POOL", Value: "pool-2"}}
+	const (
+		lookup    = "statefulset/azp-agent: lookup"
+		conflicts = "statefulset/azp-agent: autoscaler conflicts"
+		agentPool = "statefulset/azp-agent: agent pool"
+		decision  = "statefulset/azp-agent: scaling decision"
+	)
+
+	testCases := []struct {
+		name      string
+		args      func(args.Args) args.Args
+		azdClient mockAZDClient
+		k8sClient mockK8sClient
+		// noBackend creates the backend from the args instead of using the mock
+		noBackend bool
+		// statuses are the expected statuses of the checks by name, the others must pass
+		statuses map[string]string
+	}{
+		{
+			name:      "all checks pass",
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool},
+			statuses:  map[string]string{decision: autoscaler.CheckPass},
+		},
+		{
+			name:      "HorizontalPodAutoscaler conflict",
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool, HPAExists: true},
+			statuses:  map[string]string{conflicts: autoscaler.CheckFail},
+		},
+		{
+			name:      "ScaledObject conflict",
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool, ScaledObjectExists: true},
+			statuses:  map[string]string{conflicts: autoscaler.CheckFail},
+		},
+		{
+			name:      "autoscalers can't be listed",
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool, HPAForbidden: true},
+			statuses:  map[string]string{conflicts: autoscaler.CheckFail},
+		},
+		{
+			name: "acknowledged autoscalers can't be listed",
+			args: func(a args.Args) args.Args {
+				a.HPACheck.Acknowledged = true
+				return a
+			},
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool, HPAForbidden: true},
+			statuses:  map[string]string{conflicts: autoscaler.CheckSkip},
+		},
+		{
+			name: "namespace isn't checked for conflicts",
+			args: func(a args.Args) args.Args {
+				a.HPACheck = args.HPACheckArgs{Namespaces: []string{"other"}, Acknowledged: true}
+				return a
+			},
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool, HPAExists: true},
+			statuses:  map[string]string{conflicts: autoscaler.CheckSkip},
+		},
+		{
+			name:      "workload not found",
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool, WorkloadError: errors.New("statefulsets.apps \"azp-agent\" not found")},
+			// The other checks of the workload depend on it
+			statuses: map[string]string{lookup: autoscaler.CheckFail},
+		},
+		{
+			name:      "agent pools can't be listed",
+			azdClient: mockAZDClient{NumPools: 5, ErrorListPools: true},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool},
+			statuses: map[string]string{
+				"CI authentication": autoscaler.CheckFail,
+				agentPool:           autoscaler.CheckSkip,
+				decision:            autoscaler.CheckSkip,
+			},
+		},
+		{
+			name:      "agent pool not found",
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: []corev1.EnvVar{{Name: "AZP_POOL", Value: "missing"}}},
+			statuses:  map[string]string{agentPool: autoscaler.CheckFail, decision: autoscaler.CheckSkip},
+		},
+		{
+			name:      "agent pool environment variable missing",
+			azdClient: mockAZDClient{NumPools: 5},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}},
+			statuses:  map[string]string{agentPool: autoscaler.CheckFail, decision: autoscaler.CheckSkip},
+		},
+		{
+			name: "CI client can't be created",
+			args: func(a args.Args) args.Args {
+				// The workload doesn't have the AZP_URL environment variable to read the URL from
+				a.AZD.URLFromWorkload = true
+				return a
+			},
+			k8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 2}, Env: pool},
+			noBackend: true,
+			statuses: map[string]string{
+				"CI client":         autoscaler.CheckFail,
+				"CI authentication": autoscaler.CheckSkip,
+				agentPool:           autoscaler.CheckSkip,
+				decision:            autoscaler.CheckSkip,
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			caseArgs := doctorArgs
+			if testCase.args != nil {
+				caseArgs = testCase.args(caseArgs)
+			}
+			var backend ci.Backend
+			if !testCase.noBackend {
+				backend = azuredevops.NewBackend(testCase.azdClient)
+			}
+
+			report := autoscaler.DoctorWithClients(caseArgs, backend, kubernetes.MakeFromClient(testCase.k8sClient))
+
+			found := make(map[string]bool)
+			for _, check := range report.Checks {
+				found[check.Name] = true
+				expected, exists := testCase.statuses[check.Name]
+				if !exists {
+					expected = autoscaler.CheckPass
+				}
+				if check.Status != expected {
+					t.Errorf("Expected check %s to be %s, but it was %s: %s", check.Name, expected, check.Status, check.Detail)
+				}
+			}
+			for name := range testCase.statuses {
+				if !found[name] {
+					t.Errorf("Expected check %s to be reported", name)
+				}
+			}
+
+			// The error is the one of the first failed check
+			var firstFailed *autoscaler.Check
+			for i := range report.Checks {
+				if report.Checks[i].Status == autoscaler.CheckFail {
+					firstFailed = &report.Checks[i]
+					break
+				}
+			}
+			if firstFailed == nil && report.Err != nil {
+				t.Errorf("Expected no error, but got %s", report.Err.Error())
+			} else if firstFailed != nil && (report.Err == nil || report.Err.Error() != firstFailed.Detail) {
+				t.Errorf("Expected the error of check %s, but got %v", firstFailed.Name, report.Err)
+			}
+		})
+	}
+
+	// A conflict can be matched by the callers of the report
+	report := autoscaler.DoctorWithClients(doctorArgs, azuredevops.NewBackend(mockAZDClient{NumPools: 5}), kubernetes.MakeFromClient(mockK8sClient{
+		Counts:    &mockK8sClientCounts{NumPods: 2},
+		Env:       pool,
+		HPAExists: true,
+	}))
+	if !errors.Is(report.Err, kubernetes.ErrHPAConflict) {
+		t.Errorf("Expected an HPA conflict error, but got %v", report.Err)
+	}
+}
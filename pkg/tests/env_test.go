@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// mockEnvSource has ConfigMaps and Secrets by name
+type mockEnvSource struct {
+	ConfigMaps map[string]map[string]string
+	Secrets    map[string]map[string][]byte
+}
+
+func (s mockEnvSource) GetConfigMapData(namespace string, name string) (map[string]string, error) {
+	return s.ConfigMaps[name], nil
+}
+
+func (s mockEnvSource) GetSecretData(namespace string, name string) (map[string][]byte, error) {
+	return s.Secrets[name], nil
+}
+
+func TestResolveEnvValue(t *testing.T) {
+	source := mockEnvSource{
+		ConfigMaps: map[string]map[string]string{
+			"azp": {"AZP_POOL": "from-configmap", "AZP_URL": "https://dev.azure.com/org"},
+		},
+		Secrets: map[string]map[string][]byte{
+			"azp-token": {"token": []byte("secret-token")},
+			"azp-env":   {"AZP_POOL": []byte("from-secret")},
+		},
+	}
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"pool": "from-label"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "agent",
+				Env: []corev1.EnvVar{
+					{Name: "AZP_TOKEN", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "azp-token"},
+						Key:                  "token",
+					}}},
+					{Name: "LABEL_POOL", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['pool']"}}},
+					{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+				},
+				EnvFrom: []corev1.EnvFromSource{
+					{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "azp"}}},
+					{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "azp-env"}}},
+				},
+			}},
+		},
+	}
+
+	for envName, expected := range map[string]string{
+		// Secret values aren't base64 encoded by the client
+		"AZP_TOKEN":  "secret-token",
+		"LABEL_POOL": "from-label",
+		// A later envFrom source overrides an earlier one
+		"AZP_POOL": "from-secret",
+		"AZP_URL":  "https://dev.azure.com/org",
+	} {
+		value, err := kubernetes.ResolveEnvValue(source, template, "azp", envName)
+		if err != nil {
+			t.Errorf("Error resolving %s: %s", envName, err.Error())
+		} else if value != expected {
+			t.Errorf("Expected %s to be %s, but got %s", envName, expected, value)
+		}
+	}
+
+	// The name of a pod isn't known from its template
+	if _, err := kubernetes.ResolveEnvValue(source, template, "azp", "POD_NAME"); err == nil {
+		t.Error("Expected an error resolving a fieldRef to metadata.name")
+	}
+	if _, err := kubernetes.ResolveEnvValue(source, template, "azp", "MISSING"); err == nil {
+		t.Error("Expected an error resolving a missing environment variable")
+	}
+}
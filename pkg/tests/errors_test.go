@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/github"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/gitlab"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+func TestErrorKinds(t *testing.T) {
+	forbidden := k8serrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "statefulsets"}, "azp-agent", errors.New("denied by policy"))
+	testCases := []struct {
+		err   error
+		is    error
+		class autoscaler.ErrorClass
+	}{
+		{err: &azuredevops.HTTPError{StatusCode: http.StatusNonAuthoritativeInfo}, is: ci.ErrUnauthorized, class: autoscaler.ErrorAuth},
+		{err: &azuredevops.HTTPError{StatusCode: http.StatusTooManyRequests}, is: ci.ErrThrottled, class: autoscaler.ErrorThrottled},
+		{err: &github.HTTPError{StatusCode: http.StatusUnauthorized}, is: ci.ErrUnauthorized, class: autoscaler.ErrorAuth},
+		{err: &gitlab.HTTPError{StatusCode: http.StatusTooManyRequests}, is: ci.ErrThrottled, class: autoscaler.ErrorThrottled},
+		{err: kubernetes.NotImplementedKindError{Kind: "DaemonSet"}, is: kubernetes.ErrNotImplementedKind, class: autoscaler.ErrorConfig},
+		{err: kubernetes.HPAConflictError{Workload: "statefulset/azp-agent", Controller: "HorizontalPodAutoscaler azp-agent"}, is: kubernetes.ErrHPAConflict, class: autoscaler.ErrorConflict},
+		{err: scaling.ClaimedError{Workload: "statefulset/azp-agent", Owner: "default/other", ExpiresAt: time.Now()}, is: scaling.ErrWorkloadClaimed, class: autoscaler.ErrorConflict},
+		// A scale rejected by an admission policy isn't the credentials being rejected
+		{err: scaling.ScaleRejectedError{From: 1, To: 2, Err: forbidden}, is: scaling.ErrScaleRejected, class: autoscaler.ErrorConflict},
+	}
+	for _, testCase := range testCases {
+		// The kinds are matched through the errors wrapping them
+		err := fmt.Errorf("Error autoscaling statefulset/azp-agent: %w", testCase.err)
+		if !errors.Is(err, testCase.is) {
+			t.Errorf("Expected '%s' to be '%s'", err.Error(), testCase.is.Error())
+		}
+		if class := autoscaler.ClassifyError(err); class != testCase.class {
+			t.Errorf("Expected '%s' to be classified as %s, but got %s", err.Error(), testCase.class, class)
+		}
+	}
+
+	if !errors.Is(scaling.ScaleRejectedError{Err: forbidden}, forbidden) {
+		t.Error("Expected the rejected scale to wrap the error of the API server")
+	}
+	if errors.Is(&azuredevops.HTTPError{StatusCode: http.StatusInternalServerError}, ci.ErrThrottled) {
+		t.Error("Expected a server error not to be throttling")
+	}
+}
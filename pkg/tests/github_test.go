@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/github"
+)
+
+func TestGitHubBackend(t *testing.T) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	responses := map[string]interface{}{
+		"/orgs/org/actions/runner-groups": map[string]interface{}{
+			"runner_groups": []map[string]interface{}{{"id": 1, "name": "Default"}, {"id": 2, "name": "linux"}},
+		},
+		"/orgs/org/actions/runner-groups/2/runners": map[string]interface{}{
+			"runners": []map[string]interface{}{
+				{"id": 10, "name": "runner-0", "status": "online", "busy": true},
+				{"id": 11, "name": "runner-1", "status": "online", "busy": false},
+			},
+		},
+		"/repos/org/app/actions/runs": map[string]interface{}{
+			"workflow_runs": []map[string]interface{}{{"id": 100}, {"id": 101}},
+		},
+		"/repos/org/app/actions/runs/100/jobs": map[string]interface{}{
+			"jobs": []map[string]interface{}{
+				{"status": "in_progress", "labels": []string{"self-hosted"}, "runner_name": "runner-0", "runner_group_id": 2, "created_at": now, "started_at": now},
+				{"status": "queued", "labels": []string{"self-hosted", "Linux"}, "created_at": now, "started_at": now},
+				{"status": "queued", "labels": []string{"self-hosted", "gpu"}, "created_at": now, "started_at": now},
+				{"status": "queued", "labels": []string{"ubuntu-latest"}, "created_at": now, "started_at": now},
+				{"status": "completed", "labels": []string{"self-hosted"}, "runner_name": "runner-9", "runner_group_id": 1, "created_at": now, "started_at": now, "completed_at": now},
+			},
+		},
+		"/repos/org/app/actions/runs/101/jobs": map[string]interface{}{
+			"jobs": []map[string]interface{}{
+				{"status": "waiting", "labels": []string{"self-hosted", "linux"}, "created_at": now},
+			},
+		},
+		// The deploy job of run 101 waits for the 10 minute wait timer of its environment
+		"/repos/org/app/actions/runs/101/pending_deployments": []map[string]interface{}{
+			{"wait_timer": 10, "wait_timer_started_at": now, "reviewers": []interface{}{}},
+		},
+	}
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if request.Method == http.MethodDelete {
+			deleted = append(deleted, request.URL.Path)
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		response, exists := responses[request.URL.Path]
+		if !exists {
+			writer.WriteHeader(http.StatusNotFound)
+			writer.Write([]byte(`{"message":"Not Found"}`))
+			return
+		}
+		json.NewEncoder(writer).Encode(response)
+	}))
+	defer server.Close()
+
+	backend := github.NewBackend(args.GitHubArgs{
+		URL:          server.URL,
+		Token:        "token",
+		Organization: "org",
+		Repositories: []string{"app"},
+		Labels:       []string{"self-hosted", "linux"},
+		Timeout:      time.Second,
+	})
+
+	pools, err := backend.Pools("linux")
+	if err != nil || len(pools) != 1 || pools[0].ID != 2 {
+		t.Fatalf("Expected runner group linux with ID 2, but got %+v (error %v)", pools, err)
+	}
+
+	agents, err := backend.Agents(2)
+	if err != nil || len(agents) != 2 || !agents[0].Busy || agents[0].PodName != "runner-0" || agents[1].Busy {
+		t.Fatalf("Expected busy runner-0 and idle runner-1, but got %+v (error %v)", agents, err)
+	}
+
+	jobs, err := backend.Jobs(2)
+	if err != nil {
+		t.Fatalf("Error retrieving the jobs: %s", err.Error())
+	}
+	// The jobs that need a gpu label, a GitHub-hosted runner or ran in another runner group aren't jobs of the runner group
+	if numQueued, numRunning := len(ci.QueuedJobs(jobs)), len(ci.RunningJobs(jobs)); len(jobs) != 3 || numQueued != 1 || numRunning != 1 {
+		t.Fatalf("Expected 1 queued and 1 running job, but got %d jobs with %d queued and %d running", len(jobs), numQueued, numRunning)
+	}
+	if waitingJobs := ci.WaitingJobs(jobs); len(waitingJobs) != 1 || !waitingJobs[0].Delayed || waitingJobs[0].Gated || time.Until(waitingJobs[0].ReleaseTime) < 9*time.Minute {
+		t.Fatalf("Expected 1 job delayed for 10 minutes, but got %+v", waitingJobs)
+	}
+
+	if err := backend.Drain(2, agents[1]); err != ci.ErrNotSupported {
+		t.Fatalf("Expected draining a runner to not be supported, but got %v", err)
+	}
+	if err := backend.Remove(2, agents[1]); err != nil || len(deleted) != 1 || deleted[0] != "/orgs/org/actions/runners/11" {
+		t.Fatalf("Expected runner-1 to be removed, but got %v (error %v)", deleted, err)
+	}
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/ci"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/gitlab"
+)
+
+func TestGitLabBackend(t *testing.T) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	responses := map[string]interface{}{
+		"/api/v4/groups/group/runners": []map[string]interface{}{
+			{"id": 10, "description": "runner-0", "status": "online", "online": true},
+			{"id": 11, "description": "runner-1", "status": "online", "online": true},
+		},
+		"/api/v4/runners/10/jobs": []map[string]interface{}{{"id": 1000, "status": "running"}},
+		"/api/v4/runners/11/jobs": []map[string]interface{}{},
+		"/api/v4/projects/group/app/jobs": []map[string]interface{}{
+			{"status": "running", "tag_list": []string{"docker"}, "runner": map[string]interface{}{"id": 10, "description": "runner-0"}, "created_at": now, "started_at": now},
+			{"status": "pending", "tag_list": []string{"docker", "Linux"}, "created_at": now},
+			{"status": "pending", "tag_list": []string{"docker", "gpu"}, "created_at": now},
+			{"status": "pending", "tag_list": []string{}, "created_at": now},
+			{"status": "scheduled", "tag_list": []string{"docker", "linux"}, "created_at": now},
+		},
+	}
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("PRIVATE-TOKEN") != "token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if request.Method != http.MethodGet {
+			request.ParseForm()
+			requests = append(requests, request.Method+" "+request.URL.Path+" "+request.PostForm.Encode())
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		response, exists := responses[request.URL.Path]
+		if !exists {
+			writer.WriteHeader(http.StatusNotFound)
+			writer.Write([]byte(`{"message":"404 Not Found"}`))
+			return
+		}
+		json.NewEncoder(writer).Encode(response)
+	}))
+	defer server.Close()
+
+	backend := gitlab.NewBackend(args.GitLabArgs{
+		URL:        server.URL,
+		Token:      "token",
+		Group:      "group",
+		Projects:   []string{"group/app"},
+		RunnerTags: []string{"docker,linux", "docker,gpu"},
+		Timeout:    time.Second,
+	})
+
+	pools, err := backend.Pools("docker,linux")
+	if err != nil || len(pools) != 1 {
+		t.Fatalf("Expected the docker,linux runner tags, but got %+v (error %v)", pools, err)
+	}
+
+	agents, err := backend.Agents(pools[0].ID)
+	if err != nil || len(agents) != 2 || !agents[0].Busy || agents[0].PodName != "runner-0" || agents[1].Busy {
+		t.Fatalf("Expected busy runner-0 and idle runner-1, but got %+v (error %v)", agents, err)
+	}
+
+	jobs, err := backend.Jobs(pools[0].ID)
+	if err != nil {
+		t.Fatalf("Error retrieving the jobs: %s", err.Error())
+	}
+	// The jobs that need a gpu tag or are untagged aren't jobs of the runner tags
+	if numQueued, numRunning := len(ci.QueuedJobs(jobs)), len(ci.RunningJobs(jobs)); len(jobs) != 3 || numQueued != 1 || numRunning != 1 {
+		t.Fatalf("Expected 1 queued and 1 running job, but got %d jobs with %d queued and %d running", len(jobs), numQueued, numRunning)
+	}
+	if waitingJobs := ci.WaitingJobs(jobs); len(waitingJobs) != 1 || !waitingJobs[0].Delayed {
+		t.Fatalf("Expected 1 delayed job, but got %+v", waitingJobs)
+	}
+
+	if err := backend.Drain(pools[0].ID, agents[1]); err != nil {
+		t.Fatalf("Error draining runner-1: %s", err.Error())
+	}
+	if err := backend.Remove(pools[0].ID, agents[1]); err != nil {
+		t.Fatalf("Error removing runner-1: %s", err.Error())
+	}
+	if len(requests) != 2 || requests[0] != "PUT /api/v4/runners/11 paused=true" || requests[1] != "DELETE /api/v4/runners/11 " {
+		t.Fatalf("Expected runner-1 to be paused and deleted, but got %v", requests)
+	}
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/health"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/listener"
+)
+
+// serve returns the status code and body of a health handler
+func serve(handler http.Handler) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestReadinessCheck(t *testing.T) {
+	readiness := health.ReadinessCheck{MaxStaleness: time.Minute}
+
+	// The autoscaler is only ready once it's initialized, which only the binary does
+	if !health.GetStatus().Ready {
+		if code, body := serve(readiness); code != http.StatusServiceUnavailable || body != "not initialized" {
+			t.Errorf("Expected the autoscaler not to be ready before it's initialized, but got %d %s", code, body)
+		}
+	}
+	health.SetReady()
+	health.RecordAZDPoll()
+	health.RecordK8sContact()
+	if code, body := serve(readiness); code != http.StatusOK || body != "OK" {
+		t.Errorf("Expected the autoscaler to be ready, but got %d %s", code, body)
+	}
+
+	// Azure Devops and Kubernetes must have been reached recently, unless they're only called on request
+	time.Sleep(10 * time.Millisecond)
+	stale := health.ReadinessCheck{MaxStaleness: time.Millisecond}
+	if code, body := serve(stale); code != http.StatusServiceUnavailable || body != "Azure Devops has not been reached in 1ms" {
+		t.Errorf("Expected the autoscaler not to be ready when Azure Devops wasn't reached, but got %d %s", code, body)
+	}
+	health.RecordAZDPoll()
+	if code, body := serve(stale); code != http.StatusServiceUnavailable || body != "Kubernetes has not been reached in 1ms" {
+		t.Errorf("Expected the autoscaler not to be ready when Kubernetes wasn't reached, but got %d %s", code, body)
+	}
+	if code, body := serve(health.ReadinessCheck{MaxStaleness: time.Millisecond, InitializedOnly: true}); code != http.StatusOK {
+		t.Errorf("Expected the externally scaled autoscaler to be ready, but got %d %s", code, body)
+	}
+
+	// An open circuit breaker makes the autoscaler not ready until it's closed
+	health.SetCircuitBreaker("azure-devops", true)
+	if code, body := serve(readiness); code != http.StatusServiceUnavailable || body != "circuit breakers are open: [azure-devops]" {
+		t.Errorf("Expected the autoscaler not to be ready with an open circuit breaker, but got %d %s", code, body)
+	}
+	health.SetCircuitBreaker("azure-devops", false)
+	if code, body := serve(readiness); code != http.StatusOK {
+		t.Errorf("Expected the autoscaler to be ready once the circuit breaker closed, but got %d %s", code, body)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	health.RecordAZDPoll()
+	health.RecordK8sContact()
+	health.RecordDecision(health.DecisionStatus{
+		Time:            time.Now(),
+		Namespace:       "status",
+		Workload:        "statefulset/azp-agent",
+		AgentPoolID:     agentPoolID,
+		CurrentReplicas: 2,
+		DesiredReplicas: 5,
+		Action:          "scale-up",
+		Reason:          "3 queued jobs",
+		QueuedJobs:      3,
+	})
+	health.SetCircuitBreaker("kubernetes", true)
+	defer health.SetCircuitBreaker("kubernetes", false)
+
+	recorder := httptest.NewRecorder()
+	health.StatusHandler{}.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON status, but got %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	for _, field := range []string{`"lastAzdPoll":`, `"lastK8sContact":`, `"decisions":`, `"openCircuitBreakers":`, `"build":`} {
+		if !strings.Contains(recorder.Body.String(), field) {
+			t.Errorf("Expected the status to have %s, but got %s", field, recorder.Body.String())
+		}
+	}
+
+	var status health.Status
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Error decoding the status: %s", err.Error())
+	}
+	if status.LastAZDPoll == nil || time.Since(*status.LastAZDPoll) > time.Minute || status.LastK8sContact == nil || time.Since(*status.LastK8sContact) > time.Minute {
+		t.Errorf("Expected the status to have the last calls to Azure Devops and Kubernetes, but got %v and %v", status.LastAZDPoll, status.LastK8sContact)
+	}
+	found := false
+	for _, decision := range status.Decisions {
+		if decision.Namespace == "status" {
+			found = true
+			if decision.Workload != "statefulset/azp-agent" || decision.DesiredReplicas != 5 || decision.Reason != "3 queued jobs" {
+				t.Errorf("Unexpected last decision %+v", decision)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected the status to have the last decision of the workload, but got %+v", status.Decisions)
+	}
+	if len(status.OpenCircuitBreakers) != 1 || status.OpenCircuitBreakers[0] != "kubernetes" {
+		t.Errorf("Expected the open circuit breaker of Kubernetes, but got %v", status.OpenCircuitBreakers)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	server := httptest.NewServer(listener.Authenticate(health.DebugHandler(), "debugtoken", false))
+	defer server.Close()
+	get := func(path string, token string) (int, string) {
+		request, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return response.StatusCode, string(body)
+	}
+
+	// The profiles require the token
+	if code, _ := get("/debug/pprof/", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected the profiles to require the token, but got %d", code)
+	}
+	if code, body := get("/debug/pprof/", "debugtoken"); code != http.StatusOK || !strings.Contains(body, "goroutine") || !strings.Contains(body, "heap") {
+		t.Errorf("Expected the index of the profiles, but got %d %s", code, body)
+	}
+
+	// The goroutine dump has the stack of every goroutine, ex: this test's
+	if code, body := get("/debug/pprof/goroutine?debug=2", "debugtoken"); code != http.StatusOK || !strings.Contains(body, "tests.TestDebugHandler") {
+		t.Errorf("Expected a goroutine dump with the stack of the test, but got %d %s", code, body)
+	}
+	if code, body := get("/debug/pprof/heap?debug=1", "debugtoken"); code != http.StatusOK || !strings.Contains(body, "heap profile") {
+		t.Errorf("Expected a heap profile, but got %d %s", code, body)
+	}
+	if code, body := get("/debug/pprof/cmdline", "debugtoken"); code != http.StatusOK || body == "" {
+		t.Errorf("Expected the command line, but got %d %s", code, body)
+	}
+
+	// Only the profiles are served on the debug port
+	if code, _ := get("/metrics", "debugtoken"); code != http.StatusNotFound {
+		t.Errorf("Expected the metrics not to be served on the debug port, but got %d", code)
+	}
+}
@@ -1,24 +1,96 @@
 package tests
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
 	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
 )
 
+// mockK8sClientLock guards the maps of mockK8sClient, as the operator reconciles resources concurrently
+var mockK8sClientLock sync.Mutex
+
 type mockK8sClient struct {
 	Counts    *mockK8sClientCounts
 	HPAExists bool
+	// HPAForbidden denies listing the HorizontalPodAutoscalers
+	HPAForbidden bool
+	// ScaledObjectExists adds a ScaledObject targeting every workload
+	ScaledObjectExists bool
+	// WorkloadError is the error of the workload lookups, if they fail
+	WorkloadError error
+	Autoscalers   []kubernetes.AzpAgentAutoscaler
+	// Statuses are the updated statuses of the Autoscalers by name
+	Statuses map[string]kubernetes.AzpAgentAutoscalerStatus
+	// Updates are the updated Autoscalers by name
+	Updates map[string]kubernetes.AzpAgentAutoscaler
+	// Events are the reasons of the events created on the Autoscalers by name
+	Events map[string][]string
+	// WorkloadEvents are the reasons of the events created on the workloads by name, if they're kept
+	WorkloadEvents map[string][]string
+	// Annotations are the annotations set on the pods by pod name
+	Annotations map[string]map[string]string
+	// Deployments are the saved Deployments by name
+	Deployments map[string]appsv1.Deployment
+	// DeletedPods are the names of the deleted pods
+	DeletedPods map[string]bool
+	// ForceDeletedPods are the names of the force deleted pods
+	ForceDeletedPods map[string]bool
+	// RollingUpdate is the rolling update of the workloads, if they're being updated
+	RollingUpdate *kubernetes.RollingUpdate
+	// DeniedPermissions are the permissions the service account isn't allowed, by their description
+	DeniedPermissions map[string]bool
+	// ConfigMaps are the data of the saved ConfigMaps by name, if they're kept
+	ConfigMaps map[string]map[string]string
+	// Kinds are the kinds of the workloads with the given name, or a StatefulSet if nil
+	Kinds []string
+	// ScaleRejection is the error of the server-side dry runs of the scales, if they're rejected
+	ScaleRejection error
+	// ScaleError is the error of the scales, which don't change the pods if it's set
+	ScaleError error
+	// ResourceQuotas are the ResourceQuotas of every namespace
+	ResourceQuotas []corev1.ResourceQuota
+	// WorkloadAnnotations are the annotations of every workload, if they're kept
+	WorkloadAnnotations map[string]string
+	// Env are the environment variables of the agent containers of every workload
+	Env []corev1.EnvVar
+	// TerminatingPods are the deletion timestamps of the pods stuck terminating by ordinal, until they're force deleted
+	TerminatingPods map[int32]time.Time
+	// MissingPods are the ordinals below the replicas without a pod
+	MissingPods map[int32]bool
+	// FailingPodsFrom is the first ordinal of the pods that are crash looping, if it's positive
+	FailingPodsFrom int32
+	// Nodes are the nodes of the cluster
+	Nodes []corev1.Node
+	// WorkloadCounts are the counts of the workloads with their own pods by name, the others use Counts
+	WorkloadCounts map[string]*mockK8sClientCounts
+	// UnavailableAPIs are the API group versions the API server doesn't serve
+	UnavailableAPIs map[string]bool
 }
 
 // Make this a pointer to allow stateful changes
 type mockK8sClientCounts struct {
 	NumPods int32
+	// NumUnschedulablePods are the number of pods, from the last, that are pending because they can't be scheduled
+	NumUnschedulablePods int32
+}
+
+// counts returns the counts of a workload, or the counts of every workload if it doesn't have its own
+func (c mockK8sClient) counts(workload *kubernetes.Workload) *mockK8sClientCounts {
+	if counts, exists := c.WorkloadCounts[workload.Name]; exists {
+		return counts
+	}
+	return c.Counts
 }
 
 // GetWorkload retrieves a Workload with no errors
@@ -38,20 +110,48 @@ func (c mockK8sClient) GetWorkloadNoError(args args.KubernetesArgs) *kubernetes.
 			},
 		},
 		PodTemplateSpec: &corev1.PodTemplateSpec{
-			Spec: corev1.PodSpec{},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "azp-agent", Env: c.Env}},
+			},
 		},
 	}
 }
 
 // GetWorkload retrieves a Workload
 func (c mockK8sClient) GetWorkload(args args.KubernetesArgs) (*kubernetes.Workload, error) {
-	return c.GetWorkloadNoError(args), nil
+	if c.WorkloadError != nil {
+		return nil, c.WorkloadError
+	}
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	workload := c.GetWorkloadNoError(args)
+	if c.WorkloadAnnotations != nil {
+		workload.Annotations = make(map[string]string)
+		for key, value := range c.WorkloadAnnotations {
+			workload.Annotations[key] = value
+		}
+	}
+	return workload, nil
+}
+
+// GetWorkloadKinds returns the kinds of the workloads with the given name
+func (c mockK8sClient) GetWorkloadKinds(namespace string, name string) ([]string, error) {
+	if c.Kinds == nil {
+		return []string{"StatefulSet"}, nil
+	}
+	return c.Kinds, nil
 }
 
 // VerifyNoHorizontalPodAutoscaler returns an error if the given resource has a HorizontalPodAutoscaler
 func (c mockK8sClient) VerifyNoHorizontalPodAutoscaler(args args.KubernetesArgs) error {
+	if c.HPAForbidden {
+		return k8serrors.NewForbidden(schema.GroupResource{Group: "autoscaling", Resource: "horizontalpodautoscalers"}, "", errors.New("RBAC: access denied"))
+	}
+	if c.ScaledObjectExists {
+		return kubernetes.HPAConflictError{Workload: args.FriendlyName(), Controller: "ScaledObject"}
+	}
 	if c.HPAExists {
-		return fmt.Errorf("Error: %s cannot have a HorizontalPodAutoscaler attached for azp-agent-autoscaler to work", args.FriendlyName())
+		return kubernetes.HPAConflictError{Workload: args.FriendlyName(), Controller: "HorizontalPodAutoscaler"}
 	}
 
 	return nil
@@ -59,31 +159,52 @@ func (c mockK8sClient) VerifyNoHorizontalPodAutoscaler(args args.KubernetesArgs)
 
 // Scale scales a given Kubernetes resource
 func (c mockK8sClient) Scale(resource *kubernetes.Workload, replicas int32) error {
-	c.Counts.NumPods = replicas
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	if c.ScaleError != nil {
+		return c.ScaleError
+	}
+	c.counts(resource).NumPods = replicas
 	return nil
 }
 
-// GetEnvValue gets an environment variable value from a pod
-func (c mockK8sClient) GetEnvValue(podSpec corev1.PodSpec, namespace string, envName string) (string, error) {
-	env := kubernetes.GetEnvVar(podSpec, envName)
-	if env == nil {
-		return "", fmt.Errorf("Could not retrieve environment variable %s", envName)
-	}
+// VerifyScale scales a given Kubernetes resource with a dry run
+func (c mockK8sClient) VerifyScale(resource *kubernetes.Workload, replicas int32) error {
+	return c.ScaleRejection
+}
 
-	if env.Value != "" {
-		return env.Value, nil
-	}
-	return "", fmt.Errorf("Error getting value for environment variable %s", env.Name)
+// GetReplicas gets the replicas a given Kubernetes resource is scaled to
+func (c mockK8sClient) GetReplicas(resource *kubernetes.Workload) (int32, error) {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	return c.counts(resource).NumPods, nil
+}
+
+// GetRollingUpdate gets the rolling update of a given Kubernetes resource
+func (c mockK8sClient) GetRollingUpdate(resource *kubernetes.Workload) (*kubernetes.RollingUpdate, error) {
+	return c.RollingUpdate, nil
+}
+
+// GetEnvValue gets an environment variable value from a pod template
+func (c mockK8sClient) GetEnvValue(template corev1.PodTemplateSpec, namespace string, envName string) (string, error) {
+	return kubernetes.ResolveEnvValue(c, template, namespace, envName)
 }
 
 // GetPods gets all pods attached to some workload
 func (c mockK8sClient) GetPods(workload *kubernetes.Workload) ([]corev1.Pod, error) {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	controller := true
+	counts := c.counts(workload)
 	var pods []corev1.Pod
-	for i := int32(0); i < c.Counts.NumPods; i++ {
+	for i := int32(0); i < counts.NumPods; i++ {
 		pods = append(pods, corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      fmt.Sprintf("%s-%d", workload.Name, i),
 				Namespace: workload.Namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: workload.Kind, Name: workload.Name, Controller: &controller},
+				},
 			},
 			TypeMeta: metav1.TypeMeta{
 				Kind: "Pod",
@@ -94,5 +215,198 @@ func (c mockK8sClient) GetPods(workload *kubernetes.Workload) ([]corev1.Pod, err
 			},
 		})
 	}
+	for i := counts.NumPods - counts.NumUnschedulablePods; i >= 0 && i < counts.NumPods; i++ {
+		pods[i].Status = corev1.PodStatus{
+			Phase: corev1.PodPending,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: corev1.PodReasonUnschedulable},
+			},
+		}
+	}
+	for i := c.FailingPodsFrom; i > 0 && i < counts.NumPods; i++ {
+		pods[i].Status.ContainerStatuses = []corev1.ContainerStatus{
+			{Name: "azp-agent", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}},
+		}
+	}
+	// The pods with the highest ordinals are updated first
+	for i := range pods {
+		if c.RollingUpdate != nil {
+			revision := c.RollingUpdate.CurrentRevision
+			if int32(i) >= counts.NumPods-c.RollingUpdate.UpdatedReplicas {
+				revision = c.RollingUpdate.UpdateRevision
+			}
+			pods[i].Labels = map[string]string{appsv1.StatefulSetRevisionLabel: revision}
+		}
+		for key, value := range c.Annotations[pods[i].Name] {
+			if pods[i].Annotations == nil {
+				pods[i].Annotations = make(map[string]string)
+			}
+			pods[i].Annotations[key] = value
+		}
+		// The StatefulSet controller recreates the force deleted pods
+		if deletionTimestamp, isTerminating := c.TerminatingPods[int32(i)]; isTerminating && !c.ForceDeletedPods[pods[i].Name] {
+			pods[i].DeletionTimestamp = &metav1.Time{Time: deletionTimestamp}
+		}
+	}
+	if len(c.MissingPods) > 0 {
+		var presentPods []corev1.Pod
+		for i, pod := range pods {
+			if !c.MissingPods[int32(i)] {
+				presentPods = append(presentPods, pod)
+			}
+		}
+		pods = presentPods
+	}
 	return pods, nil
 }
+
+// AnnotatePod sets an annotation on a pod
+func (c mockK8sClient) AnnotatePod(pod corev1.Pod, key string, value string) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	if c.Annotations[pod.Name] == nil {
+		c.Annotations[pod.Name] = make(map[string]string)
+	}
+	c.Annotations[pod.Name][key] = value
+	return nil
+}
+
+// AnnotateWorkload sets annotations on a workload
+func (c mockK8sClient) AnnotateWorkload(workload *kubernetes.Workload, annotations map[string]string) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	for key, value := range annotations {
+		c.WorkloadAnnotations[key] = value
+	}
+	return nil
+}
+
+// DeletePod deletes a pod
+func (c mockK8sClient) DeletePod(pod corev1.Pod) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	c.DeletedPods[pod.Name] = true
+	return nil
+}
+
+// ForceDeletePod deletes a pod without waiting for its node
+func (c mockK8sClient) ForceDeletePod(pod corev1.Pod) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	c.ForceDeletedPods[pod.Name] = true
+	return nil
+}
+
+// GetConfigMapData gets the data of a ConfigMap
+func (c mockK8sClient) GetConfigMapData(namespace string, name string) (map[string]string, error) {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	return c.ConfigMaps[name], nil
+}
+
+// GetSecretData gets the data of a Secret
+func (c mockK8sClient) GetSecretData(namespace string, name string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// SaveConfigMapData replaces the data of a ConfigMap
+func (c mockK8sClient) SaveConfigMapData(namespace string, name string, data map[string]string) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	if c.ConfigMaps != nil {
+		c.ConfigMaps[name] = data
+	}
+	return nil
+}
+
+// SaveDeployment replaces a Deployment
+func (c mockK8sClient) SaveDeployment(deployment *appsv1.Deployment) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	c.Deployments[deployment.Name] = *deployment
+	return nil
+}
+
+// CreateEvent creates an Event on a workload
+func (c mockK8sClient) CreateEvent(workload *kubernetes.Workload, eventType string, reason string, message string) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	if c.WorkloadEvents != nil {
+		c.WorkloadEvents[workload.Name] = append(c.WorkloadEvents[workload.Name], reason)
+	}
+	return nil
+}
+
+// GetNodes gets all nodes in the cluster
+func (c mockK8sClient) GetNodes() ([]corev1.Node, error) {
+	return c.Nodes, nil
+}
+
+// VerifyAPIAvailable returns an error if the API server doesn't serve an API group version
+func (c mockK8sClient) VerifyAPIAvailable(groupVersion string) error {
+	if c.UnavailableAPIs[groupVersion] {
+		return fmt.Errorf("the server is currently unable to handle the request (get %s)", groupVersion)
+	}
+	return nil
+}
+
+// GetResourceQuotas gets the ResourceQuotas of a namespace
+func (c mockK8sClient) GetResourceQuotas(namespace string) ([]corev1.ResourceQuota, error) {
+	return c.ResourceQuotas, nil
+}
+
+// GetAllPods gets all scheduled pods that haven't completed in every namespace
+func (c mockK8sClient) GetAllPods() ([]corev1.Pod, error) {
+	return nil, nil
+}
+
+// GetPriorityClassValue gets the priority of a PriorityClass
+func (c mockK8sClient) GetPriorityClassValue(name string) (int32, error) {
+	return 0, fmt.Errorf("PriorityClass %s not found", name)
+}
+
+// IsAllowed returns whether the autoscaler's service account is allowed a permission
+func (c mockK8sClient) IsAllowed(permission kubernetes.Permission) (bool, error) {
+	return !c.DeniedPermissions[permission.String()], nil
+}
+
+// ListAutoscalers lists the AzpAgentAutoscaler resources in a namespace
+func (c mockK8sClient) ListAutoscalers(namespace string) ([]kubernetes.AzpAgentAutoscaler, error) {
+	var autoscalers []kubernetes.AzpAgentAutoscaler
+	for _, autoscaler := range c.Autoscalers {
+		if autoscaler.Namespace == namespace {
+			autoscalers = append(autoscalers, autoscaler)
+		}
+	}
+	return autoscalers, nil
+}
+
+// UpdateAutoscaler replaces the metadata and spec of an AzpAgentAutoscaler resource
+func (c mockK8sClient) UpdateAutoscaler(autoscaler kubernetes.AzpAgentAutoscaler) (kubernetes.AzpAgentAutoscaler, error) {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	if c.Updates != nil {
+		c.Updates[autoscaler.Name] = autoscaler
+	}
+	return autoscaler, nil
+}
+
+// UpdateAutoscalerStatus replaces the status of an AzpAgentAutoscaler resource
+func (c mockK8sClient) UpdateAutoscalerStatus(autoscaler kubernetes.AzpAgentAutoscaler) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	if c.Statuses != nil {
+		c.Statuses[autoscaler.Name] = autoscaler.Status
+	}
+	return nil
+}
+
+// CreateAutoscalerEvent creates an Event on an AzpAgentAutoscaler resource
+func (c mockK8sClient) CreateAutoscalerEvent(autoscaler kubernetes.AzpAgentAutoscaler, eventType string, reason string, message string) error {
+	mockK8sClientLock.Lock()
+	defer mockK8sClientLock.Unlock()
+	if c.Events != nil {
+		c.Events[autoscaler.Name] = append(c.Events[autoscaler.Name], reason)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/http2"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/keda"
+)
+
+func TestKEDAExternalScaler(t *testing.T) {
+	// Agents 0 and 1 are busy and agents 2 to 4 are free
+	azdClient := mockAZDClient{NumPools: 2, NumRunningAgents: 2, NumFreeAgents: 3, NumQueuedJobs: 3}
+	scaler := keda.NewScaler(azuredevops.NewBackend(azdClient), args.Args{Rate: time.Second})
+	ref := &keda.ScaledObjectRef{Name: "agents", Namespace: "azp", ScalerMetadata: map[string]string{"pool": "pool-1"}}
+
+	metrics, err := scaler.GetMetrics(&keda.GetMetricsRequest{ScaledObjectRef: ref, MetricName: "s0-azp-agents-pool-1"})
+	if err != nil {
+		t.Fatalf("Error getting the metrics: %s", err.Error())
+	}
+	if value := metrics.MetricValues[0]; value.MetricName != "azp-agents-pool-1" || value.MetricValue != 5 {
+		t.Fatalf("Expected 5 agents for the 2 busy agents and 3 queued jobs, but got %+v", value)
+	}
+
+	// The busy agents azp-agent-3 and azp-agent-4 are kept when the StatefulSet is scaled down, as it removes its highest ordinals first
+	azdClient.NumQueuedJobs = 0
+	azdClient.FreeAgentsFirst = true
+	scaler.Set(azuredevops.NewBackend(azdClient), args.Args{Rate: time.Second})
+	ref.ScalerMetadata["statefulSet"] = "azp-agent"
+	metrics, err = scaler.GetMetrics(&keda.GetMetricsRequest{ScaledObjectRef: ref})
+	if err != nil {
+		t.Fatalf("Error getting the metrics: %s", err.Error())
+	}
+	if value := metrics.MetricValues[0].MetricValue; value != 5 {
+		t.Fatalf("Expected 5 agents to keep the busy agent azp-agent-4, but got %d", value)
+	}
+
+	if _, err := scaler.IsActive(&keda.ScaledObjectRef{Name: "agents", Namespace: "azp"}); err == nil {
+		t.Fatal("Expected an error for the missing pool metadata")
+	}
+
+	// The same request over gRPC
+	server := httptest.NewServer(scaler.Handler())
+	defer server.Close()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network string, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	data, _ := proto.Marshal(&keda.GetMetricsRequest{ScaledObjectRef: ref})
+	frame := append([]byte{0, 0, 0, 0, 0}, data...)
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	response, err := client.Post(server.URL+"/externalscaler.ExternalScaler/GetMetrics", "application/grpc", bytes.NewReader(frame))
+	if err != nil {
+		t.Fatalf("Error calling GetMetrics: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if status := response.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Fatalf("Expected status 0, but got %s: %s", status, response.Trailer.Get("Grpc-Message"))
+	}
+	grpcResponse := &keda.GetMetricsResponse{}
+	if err := proto.Unmarshal(body[5:], grpcResponse); err != nil {
+		t.Fatalf("Error decoding the response: %s", err.Error())
+	}
+	if value := grpcResponse.MetricValues[0].MetricValue; value != 5 {
+		t.Fatalf("Expected 5 agents over gRPC, but got %d", value)
+	}
+}
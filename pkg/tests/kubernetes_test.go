@@ -0,0 +1,433 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// kubeconfig writes a kubeconfig file for a server and points the KUBECONFIG environment variable to it
+func kubeconfig(t *testing.T, server string) {
+	path := filepath.Join(t.TempDir(), "config")
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user:
+    token: token
+`, server)
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("KUBECONFIG", path)
+}
+
+func TestScaleRetriesConflicts(t *testing.T) {
+	// The first update conflicts with an update of the StatefulSet since its scale was retrieved
+	var numGets, numUpdates int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		if request.URL.Path != "/apis/apps/v1/namespaces/azp/statefulsets/azp-agent/scale" {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch request.Method {
+		case http.MethodGet:
+			n := atomic.AddInt32(&numGets, 1)
+			json.NewEncoder(writer).Encode(autoscalingv1.Scale{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "autoscaling/v1", Kind: "Scale"},
+				ObjectMeta: metav1.ObjectMeta{Name: "azp-agent", Namespace: "azp", ResourceVersion: fmt.Sprint(n)},
+				Spec:       autoscalingv1.ScaleSpec{Replicas: 1},
+			})
+		case http.MethodPut:
+			if atomic.AddInt32(&numUpdates, 1) == 1 {
+				writer.WriteHeader(http.StatusConflict)
+				json.NewEncoder(writer).Encode(metav1.Status{
+					TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+					Status:   metav1.StatusFailure,
+					Reason:   metav1.StatusReasonConflict,
+					Code:     http.StatusConflict,
+				})
+				return
+			}
+			var scale autoscalingv1.Scale
+			json.NewDecoder(request.Body).Decode(&scale)
+			json.NewEncoder(writer).Encode(scale)
+		}
+	}))
+	defer server.Close()
+	kubeconfig(t, server.URL)
+
+	k8sClient, err := kubernetes.MakeClient(time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	workload := mockK8sClient{}.GetWorkloadNoError(args.KubernetesArgs{Type: "StatefulSet", Name: "azp-agent", Namespace: "azp"})
+	if err := k8sClient.Sync().Scale(workload, 3); err != nil {
+		t.Fatalf("Expected the conflict to be retried, but got %s", err.Error())
+	}
+	if numGets != 2 || numUpdates != 2 {
+		t.Fatalf("Expected the scale to be retrieved and updated again, but got %d gets and %d updates", numGets, numUpdates)
+	}
+}
+
+func TestKubeconfigPathList(t *testing.T) {
+	// KUBECONFIG is a list of files, separated by ; on Windows, and the files that don't exist are skipped
+	kubeconfig(t, "https://127.0.0.1:6443")
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing")+string(os.PathListSeparator)+os.Getenv("KUBECONFIG"))
+
+	if _, err := kubernetes.MakeClient(time.Second); err != nil {
+		t.Fatalf("Expected the kubeconfig to be loaded from the second file of the list, but got %s", err.Error())
+	}
+}
+
+func TestGetRollingUpdate(t *testing.T) {
+	partition := int32(2)
+	for name, test := range map[string]struct {
+		strategy appsv1.StatefulSetUpdateStrategy
+		status   appsv1.StatefulSetStatus
+		updating bool
+		onDelete bool
+	}{
+		"updated": {
+			status: appsv1.StatefulSetStatus{ObservedGeneration: 2, CurrentRevision: "v2", UpdateRevision: "v2", UpdatedReplicas: 3, Replicas: 3},
+		},
+		"not_observed": {
+			status:   appsv1.StatefulSetStatus{ObservedGeneration: 1, CurrentRevision: "v1", UpdateRevision: "v1", UpdatedReplicas: 3, Replicas: 3},
+			updating: true,
+		},
+		"updating": {
+			status:   appsv1.StatefulSetStatus{ObservedGeneration: 2, CurrentRevision: "v1", UpdateRevision: "v2", UpdatedReplicas: 1, Replicas: 3},
+			updating: true,
+		},
+		"on_delete": {
+			strategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType},
+			status:   appsv1.StatefulSetStatus{ObservedGeneration: 2, CurrentRevision: "v1", UpdateRevision: "v2", UpdatedReplicas: 1, Replicas: 3},
+			onDelete: true,
+		},
+		"partition": {
+			strategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+			},
+			status: appsv1.StatefulSetStatus{ObservedGeneration: 2, CurrentRevision: "v1", UpdateRevision: "v2", UpdatedReplicas: 1, Replicas: 3},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			statefulSet := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Generation: 2},
+				Spec:       appsv1.StatefulSetSpec{UpdateStrategy: test.strategy},
+				Status:     test.status,
+			}
+			update := kubernetes.GetRollingUpdate(statefulSet)
+			if update.InProgress() != test.updating {
+				t.Errorf("Expected a rolling update: %t, but got %v", test.updating, update)
+			}
+			// The OnDelete update strategy only updates the pods as they're deleted
+			if onDelete := update != nil && update.OnDelete; onDelete != test.onDelete {
+				t.Errorf("Expected an OnDelete update: %t, but got %v", test.onDelete, update)
+			}
+		})
+	}
+}
+
+func TestPodSelectors(t *testing.T) {
+	controller := true
+	agents := &kubernetes.Workload{
+		ObjectMeta:   metav1.ObjectMeta{Name: "azp-agent", Namespace: "azp", UID: "agents"},
+		TypeMeta:     metav1.TypeMeta{Kind: "StatefulSet"},
+		FriendlyName: "statefulset/azp-agent",
+		PodSelector:  &metav1.LabelSelector{MatchLabels: map[string]string{"app": "azp-agent"}},
+		PodTemplateSpec: &corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "azp-agent"}},
+		},
+	}
+	gpuAgents := &kubernetes.Workload{
+		ObjectMeta:   metav1.ObjectMeta{Name: "azp-agent-gpu", Namespace: "azp", UID: "gpu"},
+		TypeMeta:     metav1.TypeMeta{Kind: "StatefulSet"},
+		FriendlyName: "statefulset/azp-agent-gpu",
+		PodSelector:  &metav1.LabelSelector{MatchLabels: map[string]string{"app": "azp-agent", "gpu": "true"}},
+		PodTemplateSpec: &corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "azp-agent", "gpu": "true"}},
+		},
+	}
+
+	// The selector of the agents also matches the GPU agents, but not the other way around
+	overlaps, err := kubernetes.OverlappingSelectors([]*kubernetes.Workload{agents, gpuAgents})
+	if err != nil {
+		t.Fatal(err.Error())
+	} else if len(overlaps) != 1 {
+		t.Errorf("Expected 1 overlapping pod selector, but got %v", overlaps)
+	}
+
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "azp-agent-0", OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "azp-agent", UID: "agents", Controller: &controller}}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "azp-agent-gpu-0", OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "azp-agent-gpu", UID: "gpu", Controller: &controller}}}},
+		// A StatefulSet recreated with the same name has a new UID
+		{ObjectMeta: metav1.ObjectMeta{Name: "azp-agent-1", OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "azp-agent", UID: "old", Controller: &controller}}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "debug"}},
+	}
+	foreign := kubernetes.ForeignPods(agents, pods)
+	if len(foreign) != 3 || foreign[0].Name != "azp-agent-gpu-0" || foreign[1].Name != "azp-agent-1" || foreign[2].Name != "debug" {
+		t.Errorf("Expected the pods azp-agent-gpu-0, azp-agent-1 and debug to be foreign, but got %v", foreign)
+	}
+}
+
+func TestDetectWorkloadType(t *testing.T) {
+	testCases := []struct {
+		name     string
+		kinds    []string
+		expected string
+	}{
+		{"statefulset", []string{"StatefulSet"}, "StatefulSet"},
+		{"deploymentconfig", []string{"DeploymentConfig"}, "DeploymentConfig"},
+		{"missing", []string{}, ""},
+		{"deployment", []string{"Deployment"}, ""},
+		{"ambiguous", []string{"StatefulSet", "Deployment"}, ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			kind, err := kubernetes.DetectWorkloadType(mockK8sClient{Kinds: testCase.kinds}, "azp", "azp-agent")
+			if testCase.expected == "" {
+				if err == nil {
+					t.Errorf("Expected an error, got kind %s", kind)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error: %s", err.Error())
+			} else if kind != testCase.expected {
+				t.Errorf("Expected kind %s, got %s", testCase.expected, kind)
+			}
+		})
+	}
+}
+
+func TestGetDeploymentConfigWorkload(t *testing.T) {
+	deploymentConfig := &kubernetes.DeploymentConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "azp-agent", Namespace: "azp", Generation: 3},
+		Spec: kubernetes.DeploymentConfigSpec{
+			Replicas: 3,
+			Selector: map[string]string{"app": "azp-agent"},
+		},
+		Status: kubernetes.DeploymentConfigStatus{LatestVersion: 2, ObservedGeneration: 3, Replicas: 3, UpdatedReplicas: 3},
+	}
+	workload := kubernetes.GetDeploymentConfigWorkload(deploymentConfig)
+	if workload.Kind != "DeploymentConfig" || workload.FriendlyName != "deploymentconfig/azp-agent" {
+		t.Errorf("Unexpected workload %s of kind %s", workload.FriendlyName, workload.Kind)
+	}
+	if workload.PodSelector.MatchLabels["app"] != "azp-agent" {
+		t.Errorf("Expected the pod selector to match the selector of the DeploymentConfig, got %v", workload.PodSelector.MatchLabels)
+	}
+
+	if update := kubernetes.GetDeploymentConfigRollingUpdate(deploymentConfig); update != nil {
+		t.Errorf("Expected no rollout, got %+v", *update)
+	}
+	deploymentConfig.Status.UpdatedReplicas = 1
+	if update := kubernetes.GetDeploymentConfigRollingUpdate(deploymentConfig); update == nil {
+		t.Error("Expected a rollout")
+	} else if update.UpdateRevision != "azp-agent-2" {
+		t.Errorf("Expected the rollout to revision azp-agent-2, got %s", update.UpdateRevision)
+	}
+}
+
+// slowK8sClient is a mockK8sClient whose workloads and HorizontalPodAutoscalers take the delay to retrieve
+type slowK8sClient struct {
+	mockK8sClient
+	Delay       time.Duration
+	WorkloadErr error
+}
+
+func (c slowK8sClient) GetWorkload(args args.KubernetesArgs) (*kubernetes.Workload, error) {
+	time.Sleep(c.Delay)
+	if c.WorkloadErr != nil {
+		return nil, c.WorkloadErr
+	}
+	return c.mockK8sClient.GetWorkload(args)
+}
+
+func (c slowK8sClient) VerifyNoHorizontalPodAutoscaler(args args.KubernetesArgs) error {
+	time.Sleep(c.Delay)
+	return c.mockK8sClient.VerifyNoHorizontalPodAutoscaler(args)
+}
+
+func TestVerifyWorkload(t *testing.T) {
+	workloadArgs := args.KubernetesArgs{Type: "StatefulSet", Name: "azp-agent", Namespace: "default"}
+	client := slowK8sClient{
+		mockK8sClient: mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 3}},
+		Delay:         200 * time.Millisecond,
+	}
+
+	// The workload and the HorizontalPodAutoscalers are retrieved concurrently
+	start := time.Now()
+	verified, err := kubernetes.VerifyWorkload(kubernetes.MakeFromClient(client), workloadArgs, args.HPACheckArgs{}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	} else if verified.Workload == nil || len(verified.Pods) != 3 {
+		t.Errorf("Expected the workload and its 3 pods, got %v and %d pods", verified.Workload, len(verified.Pods))
+	} else if elapsed := time.Since(start); elapsed >= 2*client.Delay {
+		t.Errorf("Expected the workload and the HorizontalPodAutoscalers to be retrieved concurrently, but it took %s", elapsed)
+	}
+
+	// Every error is returned
+	client.WorkloadErr = errors.New("statefulsets.apps \"azp-agent\" not found")
+	client.HPAExists = true
+	if _, err := kubernetes.VerifyWorkload(kubernetes.MakeFromClient(client), workloadArgs, args.HPACheckArgs{}, 5*time.Second); err == nil {
+		t.Error("Expected an error")
+	} else if !errors.Is(err, kubernetes.ErrHPAConflict) || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected the errors of the workload and the HorizontalPodAutoscaler, got %s", err.Error())
+	}
+
+	// The calls share the deadline
+	client.WorkloadErr, client.HPAExists = nil, false
+	if _, err := kubernetes.VerifyWorkload(kubernetes.MakeFromClient(client), workloadArgs, args.HPACheckArgs{}, client.Delay/2); err == nil || !strings.Contains(err.Error(), "within") {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestVerifyNoAutoscalerConflict(t *testing.T) {
+	workloadArgs := args.KubernetesArgs{Type: "StatefulSet", Name: "azp-agent", Namespace: "default"}
+	client := mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 3}, HPAExists: true}
+
+	// The conflict fails the check unless it's disabled or scoped to other namespaces
+	if _, err := kubernetes.VerifyNoAutoscalerConflict(client, workloadArgs, args.HPACheckArgs{}); !errors.Is(err, kubernetes.ErrHPAConflict) {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	for _, check := range []args.HPACheckArgs{{Disabled: true, Acknowledged: true}, {Namespaces: []string{"agents"}, Acknowledged: true}} {
+		if warning, err := kubernetes.VerifyNoAutoscalerConflict(client, workloadArgs, check); err != nil || warning != "" {
+			t.Errorf("Expected %+v not to check namespace default, got %q and %v", check, warning, err)
+		}
+	}
+
+	// A service account that can't list the HorizontalPodAutoscalers fails the check, or is a warning if acknowledged
+	client.HPAExists, client.HPAForbidden = false, true
+	if _, err := kubernetes.VerifyNoAutoscalerConflict(client, workloadArgs, args.HPACheckArgs{}); err == nil {
+		t.Error("Expected the forbidden error")
+	}
+	if warning, err := kubernetes.VerifyNoAutoscalerConflict(client, workloadArgs, args.HPACheckArgs{Acknowledged: true}); err != nil || !strings.Contains(warning, "isn't verified") {
+		t.Errorf("Expected a warning, got %q and %v", warning, err)
+	}
+	verified, err := kubernetes.VerifyWorkload(kubernetes.MakeFromClient(client), workloadArgs, args.HPACheckArgs{Acknowledged: true}, 5*time.Second)
+	if err != nil || verified.Workload == nil || verified.Warning == "" {
+		t.Errorf("Expected the workload to be verified with a warning, got %+v and %v", verified, err)
+	}
+
+	// The autoscalers aren't required to be listed with acknowledged conflicts
+	a := args.Args{Kubernetes: workloadArgs, HPACheck: args.HPACheckArgs{Acknowledged: true}}
+	for _, permission := range kubernetes.RequiredPermissions(a) {
+		if permission.Resource == "horizontalpodautoscalers" || permission.Resource == "scaledobjects" {
+			t.Errorf("Expected the permission to %s not to be required", permission)
+		}
+	}
+}
+
+// mockDynamicClient serves the lists of the given resources of any namespace, and counts the lists. The other
+// resources aren't found.
+type mockDynamicClient struct {
+	dynamic.NamespaceableResourceInterface
+	Lists    map[schema.GroupVersionResource][]unstructured.Unstructured
+	NumLists *int32
+	resource schema.GroupVersionResource
+}
+
+func (c mockDynamicClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	c.resource = resource
+	return c
+}
+
+func (c mockDynamicClient) Namespace(string) dynamic.ResourceInterface {
+	return c
+}
+
+func (c mockDynamicClient) List(metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	atomic.AddInt32(c.NumLists, 1)
+	items, exists := c.Lists[c.resource]
+	if !exists {
+		return nil, k8serrors.NewNotFound(c.resource.GroupResource(), "")
+	}
+	return &unstructured.UnstructuredList{Items: items}, nil
+}
+
+func TestVerifyNoHorizontalPodAutoscalerFallback(t *testing.T) {
+	hpa := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "autoscaling/v1",
+		"kind":       "HorizontalPodAutoscaler",
+		"metadata":   map[string]interface{}{"name": "azp-agent", "namespace": "default"},
+		"spec":       map[string]interface{}{"scaleTargetRef": map[string]interface{}{"kind": "StatefulSet", "name": "azp-agent"}},
+	}}
+
+	// The cluster serves neither autoscaling/v2 nor KEDA, so the HorizontalPodAutoscalers are listed with autoscaling/v1
+	var lists int32
+	dynamicClient := mockDynamicClient{
+		Lists:    map[schema.GroupVersionResource][]unstructured.Unstructured{{Group: "autoscaling", Version: "v1", Resource: "horizontalpodautoscalers"}: {*hpa}},
+		NumLists: &lists,
+	}
+
+	client := kubernetes.MakeFromDynamicClient(dynamicClient, 200*time.Millisecond)
+	workloadArgs := args.KubernetesArgs{Type: "statefulset", Name: "azp-agent", Namespace: "default"}
+	if err := client.VerifyNoHorizontalPodAutoscaler(workloadArgs); !errors.Is(err, kubernetes.ErrHPAConflict) || !strings.Contains(err.Error(), "HorizontalPodAutoscaler azp-agent") {
+		t.Errorf("Expected a conflict with the autoscaling/v1 HorizontalPodAutoscaler, got %v", err)
+	}
+	if n := atomic.LoadInt32(&lists); n != 3 {
+		t.Errorf("Expected the ScaledObjects, and the autoscaling/v2 and v1 HorizontalPodAutoscalers to be listed, got %d lists", n)
+	}
+
+	// The namespace is cached for the check interval, and the other workloads match against the cache
+	otherArgs := workloadArgs
+	otherArgs.Name = "other"
+	if err := client.VerifyNoHorizontalPodAutoscaler(otherArgs); err != nil {
+		t.Errorf("Expected no conflict, got %s", err.Error())
+	}
+	if err := client.VerifyNoHorizontalPodAutoscaler(workloadArgs); !errors.Is(err, kubernetes.ErrHPAConflict) {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if n := atomic.LoadInt32(&lists); n != 3 {
+		t.Errorf("Expected the cached namespace not to be listed, got %d lists", n)
+	}
+
+	// Another client has its own cache
+	if err := kubernetes.MakeFromDynamicClient(dynamicClient, time.Minute).VerifyNoHorizontalPodAutoscaler(workloadArgs); !errors.Is(err, kubernetes.ErrHPAConflict) {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if n := atomic.LoadInt32(&lists); n != 6 {
+		t.Errorf("Expected the other client to list the namespace, got %d lists", n)
+	}
+
+	// The namespace is listed again once the cache expires
+	time.Sleep(250 * time.Millisecond)
+	if err := client.VerifyNoHorizontalPodAutoscaler(workloadArgs); !errors.Is(err, kubernetes.ErrHPAConflict) {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if n := atomic.LoadInt32(&lists); n != 9 {
+		t.Errorf("Expected the expired namespace to be listed again, got %d lists", n)
+	}
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/listener"
+)
+
+func TestAuthenticate(t *testing.T) {
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	})
+	verifiedClient := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+
+	testCases := []struct {
+		name               string
+		token              string
+		clientCertificates bool
+		authorization      string
+		tls                *tls.ConnectionState
+		expected           int
+	}{
+		{"no authentication", "", false, "", nil, http.StatusNoContent},
+		{"token", "token", false, "Bearer token", nil, http.StatusNoContent},
+		{"wrong token", "token", false, "Bearer wrong", nil, http.StatusUnauthorized},
+		{"missing token", "token", false, "", nil, http.StatusUnauthorized},
+		{"client certificate", "", true, "", verifiedClient, http.StatusNoContent},
+		{"client certificate instead of the token", "token", true, "", verifiedClient, http.StatusNoContent},
+		{"missing client certificate", "", true, "", &tls.ConnectionState{}, http.StatusUnauthorized},
+		{"client certificate not accepted", "token", false, "", verifiedClient, http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if testCase.authorization != "" {
+				request.Header.Set("Authorization", testCase.authorization)
+			}
+			request.TLS = testCase.tls
+			recorder := httptest.NewRecorder()
+			listener.Authenticate(handler, testCase.token, testCase.clientCertificates).ServeHTTP(recorder, request)
+			if recorder.Code != testCase.expected {
+				t.Errorf("Expected status %d, got %d", testCase.expected, recorder.Code)
+			}
+			if recorder.Code == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+				t.Error("Expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, err := listener.TLSConfig("test", filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "", tls.RequireAndVerifyClientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Client certificates aren't verified without a client CA, and the certificate is only loaded on a handshake
+	if config.ClientAuth != tls.NoClientCert {
+		t.Errorf("Expected client certificates not to be requested, got %v", config.ClientAuth)
+	}
+	if _, err := config.GetCertificate(nil); err == nil {
+		t.Error("Expected an error loading a missing certificate")
+	}
+
+	clientCA := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(clientCA, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listener.TLSConfig("test", "tls.crt", "tls.key", clientCA, tls.RequireAndVerifyClientCert); err == nil {
+		t.Error("Expected an error with a client CA without a PEM certificate")
+	}
+}
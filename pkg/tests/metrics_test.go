@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// metricValue returns the value of the gauge or counter with the given labels, and if it's set
+func metricValue(t *testing.T, name string, labels map[string]string) (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: %s", err.Error())
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matches := 0
+			for _, label := range metric.GetLabel() {
+				if value, exists := labels[label.GetName()]; exists && value == label.GetValue() {
+					matches++
+				}
+			}
+			if matches != len(labels) {
+				continue
+			}
+			if metric.GetCounter() != nil {
+				return metric.GetCounter().GetValue(), true
+			}
+			return metric.GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestAutoscaleMetrics(t *testing.T) {
+	azdClient := mockAZDClient{
+		NumPools:         5,
+		NumFreeAgents:    1,
+		NumRunningAgents: 2,
+		NumQueuedJobs:    3,
+	}
+	args := args.Args{
+		Min:     1,
+		Max:     10,
+		Rate:    10 * time.Second,
+		Backend: args.BackendAzurePipelines,
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Namespace: "metrics",
+		},
+	}
+	k8sClient := mockK8sClient{
+		WorkloadCounts: map[string]*mockK8sClientCounts{
+			"azp-agent":     {NumPods: 3},
+			"azp-agent-gpu": {NumPods: 3},
+		},
+	}
+	// The workloads are in the same namespace with different agent pools
+	for poolID, name := range map[int]string{1: "azp-agent", 3: "azp-agent-gpu"} {
+		args.Kubernetes.Name = name
+		workload := k8sClient.GetWorkloadNoError(args.Kubernetes)
+		if err := scaling.Autoscale(azuredevops.NewBackend(azdClient), poolID, kubernetes.MakeFromClient(k8sClient), workload, args); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	for pool, name := range map[string]string{"1": "azp-agent", "3": "azp-agent-gpu"} {
+		labels := map[string]string{"pool": pool, "namespace": "metrics", "workload": "statefulset/" + name}
+		numPods := float64(k8sClient.WorkloadCounts[name].NumPods)
+		for metric, expected := range map[string]float64{
+			"azp_agent_autoscaler_desired_replicas_count":   numPods,
+			"azp_agent_autoscaler_registered_agents_count":  3,
+			"azp_agent_autoscaler_running_jobs_count":       2,
+			"azp_agent_autoscaler_queued_pods_count":        3,
+			"azp_agent_autoscaler_scale_up_count":           1,
+			"azp_agent_autoscaler_scale_size":               numPods - 3,
+			"azp_agent_autoscaler_total_agents_count":       3,
+			"azp_agent_autoscaler_scale_down_count":         0,
+			"azp_agent_autoscaler_scale_rate_limited_count": 0,
+			"azp_agent_autoscaler_scale_down_limited_count": 0,
+		} {
+			if value, exists := metricValue(t, metric, labels); !exists && expected != 0 {
+				t.Errorf("Expected %s of %s to be set", metric, name)
+			} else if value != expected {
+				t.Errorf("Expected %s of %s to be %v, but got %v", metric, name, expected, value)
+			}
+		}
+		if polled, _ := metricValue(t, "azp_agent_autoscaler_last_successful_poll_timestamp", labels); polled < float64(time.Now().Add(-time.Minute).Unix()) {
+			t.Errorf("Expected the last successful poll of %s to be recent, but got %v", name, polled)
+		}
+	}
+	if numPods := k8sClient.WorkloadCounts["azp-agent"].NumPods; numPods <= 3 {
+		t.Errorf("Expected the agents to be scaled up for the queued jobs, but got %d pods", numPods)
+	}
+}
+
+func TestAzureDevopsErrorMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	operation := map[string]string{"operation": "ListPoolAgents"}
+	errorsBefore, _ := metricValue(t, "azp_agent_autoscaler_azd_call_error_count", operation)
+
+	agents := make(chan azuredevops.PoolAgentsResponse)
+	go azuredevops.MakeClient(server.URL, "token", time.Second).ListPoolAgentsAsync(agents, 1)
+	if response := <-agents; response.Err == nil {
+		t.Fatal("Expected the request to fail")
+	}
+	if errors, _ := metricValue(t, "azp_agent_autoscaler_azd_call_error_count", operation); errors-errorsBefore != 1 {
+		t.Errorf("Expected 1 Azure Devops error for %s, but got %v", operation["operation"], errors-errorsBefore)
+	}
+	if calls, exists := metricValue(t, "azp_agent_autoscaler_azd_call_count", operation); !exists || calls < 1 {
+		t.Errorf("Expected the Azure Devops call to be counted, but got %v", calls)
+	}
+}
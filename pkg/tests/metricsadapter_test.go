@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/metricsadapter"
+)
+
+func TestMetricsAdapter(t *testing.T) {
+	azdClient := mockAZDClient{NumPools: 2, NumRunningAgents: 2, NumFreeAgents: 3, NumQueuedJobs: 3}
+	server := httptest.NewServer(metricsadapter.NewAdapter(azuredevops.NewBackend(azdClient), args.Args{}).Handler())
+	defer server.Close()
+	basePath := server.URL + "/apis/external.metrics.k8s.io/v1beta1"
+
+	resources := metav1.APIResourceList{}
+	if status := getJSON(t, basePath, &resources); status != http.StatusOK || len(resources.APIResources) != 3 {
+		t.Fatalf("Expected 3 metrics from discovery with status 200, but got %d with status %d", len(resources.APIResources), status)
+	}
+
+	for metricName, expected := range map[string]int64{
+		metricsadapter.MetricQueuedJobs:     3,
+		metricsadapter.MetricBusyAgents:     2,
+		metricsadapter.MetricRequiredAgents: 5,
+	} {
+		metrics := metricsadapter.ExternalMetricValueList{}
+		status := getJSON(t, basePath+"/namespaces/azp/"+metricName+"?labelSelector="+url.QueryEscape("pool=pool-1"), &metrics)
+		if status != http.StatusOK || len(metrics.Items) != 1 {
+			t.Fatalf("Expected metric %s with status 200, but got status %d", metricName, status)
+		}
+		if value, _ := metrics.Items[0].Value.AsInt64(); value != expected || metrics.Items[0].MetricLabels["pool"] != "pool-1" {
+			t.Fatalf("Expected metric %s of pool-1 to be %d, but got %+v", metricName, expected, metrics.Items[0])
+		}
+	}
+
+	errorStatus := metav1.Status{}
+	if status := getJSON(t, basePath+"/namespaces/azp/"+metricsadapter.MetricQueuedJobs, &errorStatus); status != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 without a pool, but got %d: %s", status, errorStatus.Message)
+	}
+	if status := getJSON(t, basePath+"/namespaces/azp/"+metricsadapter.MetricQueuedJobs+"?labelSelector=pool%3Dpool-5", &errorStatus); status != http.StatusNotFound {
+		t.Fatalf("Expected status 404 for a pool that doesn't exist, but got %d: %s", status, errorStatus.Message)
+	}
+	if status := getJSON(t, basePath+"/namespaces/azp/azp_pool_unknown?labelSelector=pool%3Dpool-1", &errorStatus); status != http.StatusNotFound {
+		t.Fatalf("Expected status 404 for an unknown metric, but got %d: %s", status, errorStatus.Message)
+	}
+}
+
+func getJSON(t *testing.T, url string, body interface{}) int {
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error calling %s: %s", url, err.Error())
+	}
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(body); err != nil {
+		t.Fatalf("Error decoding the response of %s: %s", url, err.Error())
+	}
+	return response.StatusCode
+}
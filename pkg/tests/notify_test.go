@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/notify"
+)
+
+// recordingNotifier records the notifications it's sent
+type recordingNotifier struct {
+	mutex         sync.Mutex
+	notifications []notify.Notification
+}
+
+func (n *recordingNotifier) Name() string {
+	return "recording"
+}
+
+func (n *recordingNotifier) Notify(notification notify.Notification) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+// received returns the notifications of a type sent for the workloads of a namespace
+func (n *recordingNotifier) received(notificationType notify.Type, namespace string) []notify.Notification {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var received []notify.Notification
+	for _, notification := range n.notifications {
+		if notification.Type == notificationType && notification.Namespace == namespace {
+			received = append(received, notification)
+		}
+	}
+	return received
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received notify.Notification
+	var signature string
+	var expectedSignature string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		json.Unmarshal(body, &received)
+		signature = request.Header.Get(notify.SignatureHeader)
+		expectedSignature = "sha256=" + notify.Sign(body, "secret")
+	}))
+	defer server.Close()
+
+	notifier := notify.NewWebhookNotifier(server.URL, "secret")
+	err := notifier.Notify(notify.Notification{Type: notify.TypeScaledUp, Workload: "statefulset/azp-agent", FromReplicas: 3, ToReplicas: 7})
+	if err != nil {
+		t.Fatalf("Error sending the notification: %s", err.Error())
+	}
+	if received.Type != notify.TypeScaledUp || received.Workload != "statefulset/azp-agent" || received.ToReplicas != 7 {
+		t.Fatalf("Unexpected notification %+v", received)
+	}
+	if signature == "" || signature != expectedSignature {
+		t.Fatalf("Expected the signature %s, but got %s", expectedSignature, signature)
+	}
+}
+
+func TestWebhookNotifierError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if err := notify.NewWebhookNotifier(server.URL+"/?token=secret", "").Notify(notify.Notification{}); err == nil {
+		t.Fatal("Expected an error when the webhook returns HTTP 500")
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var received map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	messageTemplate, err := notify.ParseTemplate(notify.DefaultTemplate)
+	if err != nil {
+		t.Fatalf("Error parsing the default template: %s", err.Error())
+	}
+	notification := notify.Notification{Type: notify.TypeScaledUp, Severity: notify.SeverityInfo, Workload: "statefulset/azp-agent", FromReplicas: 3, ToReplicas: 7, Reason: "4 queued jobs"}
+	if err := notify.NewSlackNotifier(server.URL, messageTemplate).Notify(notification); err != nil {
+		t.Fatalf("Error sending the notification: %s", err.Error())
+	}
+	expected := ":information_source: Scaled up statefulset/azp-agent from 3 to 7 agents: 4 queued jobs"
+	if received["text"] != expected {
+		t.Fatalf("Expected the message %q, but got %q", expected, received["text"])
+	}
+}
+
+func TestTeamsNotifier(t *testing.T) {
+	var received map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	messageTemplate, err := notify.ParseTemplate("{{ .Type }} {{ .Error }}")
+	if err != nil {
+		t.Fatalf("Error parsing the template: %s", err.Error())
+	}
+	notification := notify.Notification{Type: notify.TypeAutoscaleFailed, Severity: notify.SeverityError, Error: "timeout"}
+	if err := notify.NewTeamsNotifier(server.URL, messageTemplate).Notify(notification); err != nil {
+		t.Fatalf("Error sending the notification: %s", err.Error())
+	}
+	if received["@type"] != "MessageCard" || received["text"] != "autoscale_failed timeout" || received["themeColor"] != "D70000" {
+		t.Fatalf("Unexpected message card %+v", received)
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	severity, err := notify.ParseSeverity("Warning")
+	if err != nil || severity != notify.SeverityWarning {
+		t.Fatalf("Expected the severity warning, but got %s (%v)", severity, err)
+	}
+	if _, err := notify.ParseSeverity("critical"); err == nil {
+		t.Fatal("Expected an error for an unknown severity")
+	}
+	if !notify.SeverityError.AtLeast(notify.SeverityWarning) || notify.SeverityInfo.AtLeast(notify.SeverityWarning) {
+		t.Fatal("Unexpected severity ordering")
+	}
+}
@@ -0,0 +1,377 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/operator"
+)
+
+func autoscalerResource(name string, spec kubernetes.AzpAgentAutoscalerSpec) kubernetes.AzpAgentAutoscaler {
+	return kubernetes.AzpAgentAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "operator"},
+		Spec:       spec,
+	}
+}
+
+func TestOperatorReconcile(t *testing.T) {
+	azdClient := mockAZDClient{
+		NumPools:         5,
+		NumFreeAgents:    1,
+		NumRunningAgents: 1,
+		NumQueuedJobs:    3,
+	}
+	defaults := args.Args{
+		Min:    1,
+		Max:    100,
+		Rate:   10 * time.Second,
+		Events: true,
+		ScaleDown: args.ScaleDownArgs{
+			Max: 10,
+		},
+		Policy: args.PolicyArgs{
+			Mode: args.PolicyQueue,
+		},
+		Kubernetes: args.KubernetesArgs{
+			Namespace: "operator",
+		},
+	}
+	max, invalidMin, invalidMax := int32(3), int32(5), int32(4)
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{
+			NumPods: 2,
+		},
+		Autoscalers: []kubernetes.AzpAgentAutoscaler{
+			autoscalerResource("team-a", kubernetes.AzpAgentAutoscalerSpec{
+				Pool:        "pool-1",
+				WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: "team-a-agent"},
+				Max:         &max,
+				ScaleDown:   &kubernetes.AutoscalerScaleDownSpec{Delay: &metav1.Duration{Duration: time.Minute}},
+			}),
+			autoscalerResource("team-b", kubernetes.AzpAgentAutoscalerSpec{
+				Pool:        "pool-2",
+				WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: "team-b-agent"},
+				Min:         &invalidMin,
+				Max:         &invalidMax,
+			}),
+		},
+		Statuses: map[string]kubernetes.AzpAgentAutoscalerStatus{},
+		Updates:  map[string]kubernetes.AzpAgentAutoscaler{},
+		Events:   map[string][]string{},
+	}
+
+	autoscalers, err := operator.Reconcile(azuredevops.NewBackend(azdClient), kubernetes.MakeFromClient(k8sClient), defaults)
+	if err != nil {
+		t.Fatalf("Error reconciling: %s", err.Error())
+	}
+	if len(autoscalers) != 2 {
+		t.Fatalf("Expected 2 autoscalers, but got %d", len(autoscalers))
+	}
+
+	teamA := autoscalers[0]
+	if teamA.Err != nil {
+		t.Fatalf("Error autoscaling team-a: %s", teamA.Err.Error())
+	}
+	if teamA.Target.AgentPoolID != 1 || teamA.Target.Workload.Name != "team-a-agent" {
+		t.Fatalf("Expected team-a-agent with agent pool 1, but got %s with agent pool %d", teamA.Target.Workload.Name, teamA.Target.AgentPoolID)
+	}
+	if teamA.Target.Args.Max != 3 || teamA.Target.Args.Min != 1 || teamA.Target.Args.ScaleDown.Delay != time.Minute {
+		t.Fatalf("Expected the max and scale down delay from the spec and the min from the defaults, but got %+v", *teamA.Target.Args)
+	}
+	if teamA.Decision == nil || teamA.Decision.DesiredReplicas != 3 {
+		t.Fatalf("Expected team-a to be scaled up to its max of 3, but got %+v", teamA.Decision)
+	}
+
+	teamB := autoscalers[1]
+	if teamB.Err == nil || !strings.Contains(teamB.Err.Error(), "Max must be greater than the minimum") {
+		t.Fatalf("Expected an error for the min of team-b, but got %v", teamB.Err)
+	}
+	if targets := operator.Targets(autoscalers); len(targets) != 1 {
+		t.Fatalf("Expected only the target of team-a, but got %d targets", len(targets))
+	}
+
+	if finalizers := k8sClient.Updates["team-a"].Finalizers; len(finalizers) != 1 || finalizers[0] != kubernetes.TeardownFinalizer {
+		t.Fatalf("Expected the teardown finalizer to be added to team-a, but got %v", finalizers)
+	}
+
+	teamAStatus := k8sClient.Statuses["team-a"]
+	if teamAStatus.AgentPoolName != "pool-1" || teamAStatus.AgentPoolID != 1 || teamAStatus.DesiredReplicas != 3 || teamAStatus.CurrentReplicas != 2 {
+		t.Fatalf("Expected the status of team-a to have agent pool 1 and 3 desired replicas, but got %+v", teamAStatus)
+	}
+	if condition := findCondition(teamAStatus, kubernetes.ConditionReady); condition == nil || condition.Status != corev1.ConditionTrue {
+		t.Fatalf("Expected team-a to be ready, but got %+v", condition)
+	}
+	teamBStatus := k8sClient.Statuses["team-b"]
+	if condition := findCondition(teamBStatus, kubernetes.ConditionReady); condition == nil || condition.Status != corev1.ConditionFalse || condition.Reason != "ResolveFailed" {
+		t.Fatalf("Expected team-b not to be ready, but got %+v", condition)
+	}
+	if condition := findCondition(teamBStatus, kubernetes.ConditionDegraded); condition == nil || condition.Status != corev1.ConditionTrue {
+		t.Fatalf("Expected team-b to be degraded, but got %+v", condition)
+	}
+	if events := fmt.Sprint(k8sClient.Events); events != "map[team-a:[Resolved ScaledUp] team-b:[ResolveFailed]]" {
+		t.Fatalf("Expected events for team-a being resolved and scaled up and for team-b failing to resolve, but got %s", events)
+	}
+}
+
+func findCondition(status kubernetes.AzpAgentAutoscalerStatus, conditionType string) *kubernetes.AutoscalerCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func TestOperatorDiscoverPool(t *testing.T) {
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{},
+		Autoscalers: []kubernetes.AzpAgentAutoscaler{
+			autoscalerResource("team-a", kubernetes.AzpAgentAutoscalerSpec{
+				WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: "team-a-agent"},
+			}),
+		},
+	}
+	defaults := args.Args{Min: 1, Max: 10, ScaleDown: args.ScaleDownArgs{Max: 1}, Policy: args.PolicyArgs{Mode: args.PolicyQueue}, Kubernetes: args.KubernetesArgs{Namespace: "operator"}}
+
+	autoscalers, err := operator.Resolve(azuredevops.NewBackend(mockAZDClient{NumPools: 5}), kubernetes.MakeFromClient(k8sClient), defaults)
+	if err != nil {
+		t.Fatalf("Error resolving: %s", err.Error())
+	}
+	// The mock workload doesn't have an AZP_POOL environment variable
+	if autoscalers[0].Err == nil || !strings.Contains(autoscalers[0].Err.Error(), "AZP_POOL") {
+		t.Fatalf("Expected an error discovering the pool, but got %v", autoscalers[0].Err)
+	}
+}
+
+func TestOperatorNamespaces(t *testing.T) {
+	teamB := autoscalerResource("team-b", kubernetes.AzpAgentAutoscalerSpec{
+		Pool:        "pool-1",
+		WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: "team-b-agent"},
+	})
+	teamB.Namespace = "team-b"
+	teamC := autoscalerResource("team-c", kubernetes.AzpAgentAutoscalerSpec{
+		Pool:        "pool-2",
+		WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: "team-c-agent"},
+	})
+	teamC.Namespace = "team-c"
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{},
+		Autoscalers: []kubernetes.AzpAgentAutoscaler{
+			autoscalerResource("team-a", kubernetes.AzpAgentAutoscalerSpec{
+				Pool:        "pool-1",
+				WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: "team-a-agent"},
+			}),
+			teamB,
+			teamC,
+		},
+	}
+	defaults := args.Args{
+		Min:        1,
+		Max:        10,
+		ScaleDown:  args.ScaleDownArgs{Max: 1},
+		Policy:     args.PolicyArgs{Mode: args.PolicyQueue},
+		Kubernetes: args.KubernetesArgs{Namespace: "operator"},
+		Operator: args.OperatorArgs{
+			Enabled:      true,
+			Namespaces:   []string{"team-b", "team-c"},
+			AllowedPools: map[string][]string{"team-b": {"pool-2"}, "team-c": {"pool-2"}},
+		},
+	}
+
+	autoscalers, err := operator.Resolve(azuredevops.NewBackend(mockAZDClient{NumPools: 5}), kubernetes.MakeFromClient(k8sClient), defaults)
+	if err != nil {
+		t.Fatalf("Error resolving: %s", err.Error())
+	}
+	// The resource in the operator's own namespace isn't autoscaled, as it isn't one of the namespaces
+	if len(autoscalers) != 2 {
+		t.Fatalf("Expected the autoscalers of team-b and team-c, but got %d autoscalers", len(autoscalers))
+	}
+	if autoscalers[0].Err == nil || autoscalers[0].Err.Error() != "Agent pool pool-1 is not allowed in namespace team-b" {
+		t.Fatalf("Expected team-b to not be allowed to use pool-1, but got %v", autoscalers[0].Err)
+	}
+	if autoscalers[1].Err != nil || autoscalers[1].Target.AgentPoolID != 2 {
+		t.Fatalf("Expected team-c to autoscale agent pool 2, but got %+v", autoscalers[1])
+	}
+
+	err = operator.Validate(azuredevops.NewBackend(mockAZDClient{NumPools: 5}), kubernetes.MakeFromClient(k8sClient), teamB, defaults)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("Expected the webhook to reject team-b, but got %v", err)
+	}
+}
+
+func TestOperatorSharding(t *testing.T) {
+	k8sClient := mockK8sClient{Counts: &mockK8sClientCounts{}}
+	for i := 0; i < 20; i++ {
+		spec := kubernetes.AzpAgentAutoscalerSpec{
+			WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: fmt.Sprintf("agent-%d", i)},
+		}
+		// Half of the resources share 2 pools, and the others discover their pool
+		if i%2 == 0 {
+			spec.Pool = fmt.Sprintf("pool-%d", i%4/2+1)
+		}
+		k8sClient.Autoscalers = append(k8sClient.Autoscalers, autoscalerResource(fmt.Sprintf("resource-%d", i), spec))
+	}
+
+	shards := make(map[string]int)
+	poolShards := make(map[string]int)
+	for shard := 0; shard < 3; shard++ {
+		defaults := args.Args{
+			Min:        1,
+			Max:        10,
+			ScaleDown:  args.ScaleDownArgs{Max: 1},
+			Policy:     args.PolicyArgs{Mode: args.PolicyQueue},
+			Kubernetes: args.KubernetesArgs{Namespace: "operator"},
+			Operator:   args.OperatorArgs{Enabled: true},
+			Sharding:   args.ShardingArgs{Shards: 3, Shard: shard},
+		}
+		autoscalers, err := operator.Resolve(azuredevops.NewBackend(mockAZDClient{NumPools: 5}), kubernetes.MakeFromClient(k8sClient), defaults)
+		if err != nil {
+			t.Fatalf("Error resolving shard %d: %s", shard, err.Error())
+		}
+		for _, autoscaler := range autoscalers {
+			if previous, exists := shards[autoscaler.Name()]; exists {
+				t.Fatalf("Expected %s to be in one shard, but it's in shards %d and %d", autoscaler.Name(), previous, shard)
+			}
+			shards[autoscaler.Name()] = shard
+			if pool := autoscaler.Resource.Spec.Pool; pool != "" {
+				if previous, exists := poolShards[pool]; exists && previous != shard {
+					t.Fatalf("Expected the resources of %s to be in one shard, but they're in shards %d and %d", pool, previous, shard)
+				}
+				poolShards[pool] = shard
+			}
+		}
+		if configMapName := defaults.Sharding.ConfigMapName("state"); configMapName != fmt.Sprintf("state-%d", shard) {
+			t.Fatalf("Expected the state ConfigMap of shard %d to be state-%d, but got %s", shard, shard, configMapName)
+		}
+	}
+	if len(shards) != 20 {
+		t.Fatalf("Expected every resource to be in a shard, but %d are", len(shards))
+	}
+}
+
+func TestOperatorTeardown(t *testing.T) {
+	defaults := args.Args{Min: 1, Max: 10, ScaleDown: args.ScaleDownArgs{Max: 1}, Policy: args.PolicyArgs{Mode: args.PolicyQueue}, Kubernetes: args.KubernetesArgs{Namespace: "operator"}}
+	parkedReplicas := int32(1)
+	resource := autoscalerResource("team-a", kubernetes.AzpAgentAutoscalerSpec{
+		Pool:        "pool-1",
+		WorkloadRef: kubernetes.WorkloadReference{Kind: "StatefulSet", Name: "azp-agent"},
+		Teardown:    &kubernetes.AutoscalerTeardownSpec{ParkedReplicas: &parkedReplicas},
+	})
+	resource.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	resource.Finalizers = []string{kubernetes.TeardownFinalizer}
+	reconcile := func(azdClient mockAZDClient) mockK8sClient {
+		k8sClient := mockK8sClient{
+			Counts:      &mockK8sClientCounts{NumPods: 3},
+			Autoscalers: []kubernetes.AzpAgentAutoscaler{resource},
+			Statuses:    map[string]kubernetes.AzpAgentAutoscalerStatus{},
+			Updates:     map[string]kubernetes.AzpAgentAutoscaler{},
+		}
+		autoscalers, err := operator.Reconcile(azuredevops.NewBackend(azdClient), kubernetes.MakeFromClient(k8sClient), defaults)
+		if err != nil {
+			t.Fatalf("Error reconciling: %s", err.Error())
+		}
+		if len(autoscalers) != 1 || autoscalers[0].Err != nil || len(operator.Targets(autoscalers)) != 0 {
+			t.Fatalf("Expected the deleted resource to be torn down without a target, but got %+v", autoscalers)
+		}
+		return k8sClient
+	}
+
+	// Agents azp-agent-0 to azp-agent-2, and azp-agent-2 is running a job
+	busyCalls := &mockAZDClientCalls{}
+	k8sClient := reconcile(mockAZDClient{NumPools: 5, NumFreeAgents: 2, NumRunningAgents: 1, FreeAgentsFirst: true, Calls: busyCalls})
+	if fmt.Sprint(busyCalls.DisabledAgentIDs) != "[1 2]" || len(busyCalls.DeletedAgentIDs) != 0 {
+		t.Fatalf("Expected the agents of the removed pods to be disabled and not deregistered, but got %+v", *busyCalls)
+	}
+	if _, updated := k8sClient.Updates["team-a"]; updated || k8sClient.Counts.NumPods != 3 {
+		t.Fatalf("Expected the teardown to wait for the running job")
+	}
+
+	calls := &mockAZDClientCalls{}
+	k8sClient = reconcile(mockAZDClient{NumPools: 5, NumFreeAgents: 3, Calls: calls})
+	if fmt.Sprint(calls.DeletedAgentIDs) != "[1 2]" {
+		t.Fatalf("Expected the agents of the removed pods to be deregistered, but got %v", calls.DeletedAgentIDs)
+	}
+	if k8sClient.Counts.NumPods != parkedReplicas {
+		t.Fatalf("Expected the workload to be scaled to %d parked replicas, but it has %d", parkedReplicas, k8sClient.Counts.NumPods)
+	}
+	if updated, exists := k8sClient.Updates["team-a"]; !exists || len(updated.Finalizers) != 0 {
+		t.Fatalf("Expected the finalizer to be removed, but got %+v", updated.Finalizers)
+	}
+	if len(k8sClient.Statuses) != 0 {
+		t.Fatalf("Expected the status of the deleted resource not to be updated")
+	}
+}
+
+func TestOperatorWebhook(t *testing.T) {
+	defaults := args.Args{Min: 1, Max: 10, ScaleDown: args.ScaleDownArgs{Max: 1}, Policy: args.PolicyArgs{Mode: args.PolicyQueue}, Kubernetes: args.KubernetesArgs{Namespace: "operator"}}
+	k8sClient := mockK8sClient{Counts: &mockK8sClientCounts{}}
+	server := httptest.NewServer(operator.NewWebhook(azuredevops.NewBackend(mockAZDClient{NumPools: 5}), kubernetes.MakeFromClient(k8sClient), defaults).Handler())
+	defer server.Close()
+
+	review := func(spec kubernetes.AzpAgentAutoscalerSpec) *admissionv1beta1.AdmissionResponse {
+		object, _ := json.Marshal(autoscalerResource("team-a", spec))
+		body, _ := json.Marshal(admissionv1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1beta1.AdmissionRequest{
+				UID:       "uid",
+				Operation: admissionv1beta1.Create,
+				Object:    runtime.RawExtension{Raw: object},
+			},
+		})
+		resp, err := http.Post(server.URL+"/validate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error calling the webhook: %s", err.Error())
+		}
+		defer resp.Body.Close()
+		response := admissionv1beta1.AdmissionReview{}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Error decoding the webhook response: %s", err.Error())
+		}
+		if response.APIVersion != "admission.k8s.io/v1" || response.Response == nil || response.Response.UID != "uid" {
+			t.Fatalf("Expected a response to the request, but got %+v", response)
+		}
+		return response.Response
+	}
+
+	workloadRef := kubernetes.WorkloadReference{Kind: "StatefulSet", Name: "team-a-agent"}
+	if response := review(kubernetes.AzpAgentAutoscalerSpec{Pool: "pool-1", WorkloadRef: workloadRef}); !response.Allowed {
+		t.Fatalf("Expected a valid resource to be allowed, but got %s", response.Result.Message)
+	}
+
+	min, max := int32(5), int32(4)
+	denied := []struct {
+		name    string
+		spec    kubernetes.AzpAgentAutoscalerSpec
+		message string
+	}{
+		{"min greater than max", kubernetes.AzpAgentAutoscalerSpec{Pool: "pool-1", WorkloadRef: workloadRef, Min: &min, Max: &max}, "Max must be greater than the minimum"},
+		{"unknown kind", kubernetes.AzpAgentAutoscalerSpec{Pool: "pool-1", WorkloadRef: kubernetes.WorkloadReference{Kind: "Deployment", Name: "team-a-agent"}}, "Unknown workload kind Deployment"},
+		{"unknown pool", kubernetes.AzpAgentAutoscalerSpec{Pool: "pool-9", WorkloadRef: workloadRef}, "Could not find an agent pool with name pool-9"},
+		{"undiscoverable pool", kubernetes.AzpAgentAutoscalerSpec{WorkloadRef: workloadRef}, "AZP_POOL"},
+	}
+	for _, test := range denied {
+		if response := review(test.spec); response.Allowed || !strings.Contains(response.Result.Message, test.message) {
+			t.Fatalf("Expected the resource with %s to be denied with %q, but got %+v", test.name, test.message, response.Result)
+		}
+	}
+
+	k8sClient.HPAExists = true
+	server.Config.Handler = operator.NewWebhook(azuredevops.NewBackend(mockAZDClient{NumPools: 5}), kubernetes.MakeFromClient(k8sClient), defaults).Handler()
+	if response := review(kubernetes.AzpAgentAutoscalerSpec{Pool: "pool-1", WorkloadRef: workloadRef}); response.Allowed || !strings.Contains(response.Result.Message, "HorizontalPodAutoscaler") {
+		t.Fatalf("Expected the resource of a workload with a HorizontalPodAutoscaler to be denied, but got %+v", response.Result)
+	}
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scenario"
+)
+
+func TestScenarios(t *testing.T) {
+	// The policy of the example scenarios
+	policy := args.Args{
+		Min:       1,
+		Max:       10,
+		ScaleDown: args.ScaleDownArgs{Max: 10, Delay: 10 * time.Minute},
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent",
+			Namespace: "scenarios",
+		},
+	}
+	scenarios, err := scenario.Load("../../example-scenarios.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Scenarios can also be written as Go tables
+	replicas := int32(1)
+	scenarios = append(scenarios, scenario.Scenario{
+		Name:   "Scales down the recently idle agents without an idle delay",
+		Agents: scenario.Agents{Idle: 2, IdleFor: 5 * time.Minute},
+		Expect: scenario.Expect{Replicas: &replicas},
+	})
+	for _, s := range scenarios {
+		t.Run(s.Name, func(t *testing.T) {
+			if result := scenario.Run(s, policy); !result.Passed() {
+				t.Errorf("%v", result.Failures)
+			}
+		})
+	}
+
+	// A scenario fails if the policy doesn't make the expected decision
+	policy.ScaleDown.IdleDelay = 15 * time.Minute
+	if result := scenario.Run(scenarios[len(scenarios)-1], policy); result.Passed() || result.Decision.DesiredReplicas != 2 {
+		t.Errorf("Expected the scenario to fail with 2 replicas with an idle delay, but got %d replicas (%s)", result.Decision.DesiredReplicas, result.Decision.Reason)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	azdClient := mockAZDClient{
+		NumPools:         5,
+		NumRunningAgents: 2,
+		NumQueuedJobs:    5,
+	}
+	policy := args.Args{
+		Min:    1,
+		Max:    100,
+		Rate:   10 * time.Second,
+		Record: args.RecordArgs{Dir: dir, Interval: time.Minute, MaxSize: 1024 * 1024},
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent-record",
+			Namespace: "default",
+		},
+	}
+	k8sClient := mockK8sClient{
+		Counts: &mockK8sClientCounts{
+			NumPods: 2,
+		},
+	}
+	workload := k8sClient.GetWorkloadNoError(policy.Kubernetes)
+
+	// The snapshot is only recorded once per interval
+	for i := 0; i < 2; i++ {
+		if _, err := scaling.Plan(azuredevops.NewBackend(azdClient), agentPoolID, kubernetes.MakeFromClient(k8sClient), workload, policy); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	path := filepath.Join(dir, "default.statefulset.azp-agent-record.jsonl")
+	recordings, err := scaling.ReadRecordings(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(recordings) != 1 || recordings[0].DesiredReplicas != 6 || len(recordings[0].Snapshot.Pods) != 2 {
+		t.Fatalf("Expected 1 recording of a scale up to 6 replicas from 2 pods, but got %+v", recordings)
+	}
+
+	// A partial last line, from the autoscaler being killed while writing it, is skipped
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file.WriteString(`{"snapshot":{"time":`)
+	file.Close()
+	if recordings, err = scaling.ReadRecordings(path); err != nil || len(recordings) != 1 {
+		t.Fatalf("Expected the partial line to be skipped, but got %d recordings (%v)", len(recordings), err)
+	}
+
+	// The same policy makes the recorded decision, and a lower max changes it
+	if replayed := scenario.Replay(recordings, policy); replayed[0].Changed() {
+		t.Errorf("Expected the replay with the recorded policy to scale to %d replicas, but got %d", recordings[0].DesiredReplicas, replayed[0].Decision.DesiredReplicas)
+	}
+	policy.Max = 4
+	replayed := scenario.Replay(recordings, policy)
+	summaries := scenario.SummarizeReplay(replayed)
+	if !replayed[0].Changed() || replayed[0].Decision.DesiredReplicas != 4 {
+		t.Errorf("Expected the replay with a max of 4 to scale to 4 replicas, but got %d", replayed[0].Decision.DesiredReplicas)
+	}
+	if len(summaries) != 1 || summaries[0].Changed != 1 || summaries[0].RecordedReplicas != 6 || summaries[0].ReplayedReplicas != 4 || summaries[0].ReplayedScaleUps != 1 {
+		t.Errorf("Expected a summary of 1 changed decision from 6 to 4 replicas, but got %+v", summaries)
+	}
+}
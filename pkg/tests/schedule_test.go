@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/schedule"
+)
+
+func TestMaintenanceWindows(t *testing.T) {
+	testCases := []struct {
+		window   string
+		time     string
+		expected bool
+	}{
+		{"2024-01-06T02:00:00Z/2024-01-06T06:00:00Z", "2024-01-06T01:59:59Z", false},
+		{"2024-01-06T02:00:00Z/2024-01-06T06:00:00Z", "2024-01-06T02:00:00Z", true},
+		{"2024-01-06T02:00:00Z/2024-01-06T06:00:00Z", "2024-01-06T06:00:00Z", false},
+		// 2024-01-06 is a Saturday
+		{"0 2 * * 6|4h", "2024-01-06T01:59:00Z", false},
+		{"0 2 * * sat|4h", "2024-01-06T02:00:00Z", true},
+		{"0 2 * * 6|4h", "2024-01-06T05:59:59Z", true},
+		{"0 2 * * 6|4h", "2024-01-06T06:00:00Z", false},
+		{"0 2 * * 6|4h", "2024-01-07T03:00:00Z", false},
+		{"0 22 * * 1-5|4h", "2024-01-06T01:00:00Z", true},
+		{"*/30 * * * *|5m", "2024-01-06T10:34:00Z", true},
+		{"*/30 * * * *|5m", "2024-01-06T10:35:00Z", false},
+		// Either the day of month or the day of week matches if both are set
+		{"0 0 1 * 0|1h", "2024-01-07T00:30:00Z", true},
+		{"0 0 1 * 0|1h", "2024-02-01T00:30:00Z", true},
+		{"0 0 1 * 0|1h", "2024-02-02T00:30:00Z", false},
+		// Both must match if either starts with *, ex: on the odd days that are Mondays
+		{"0 0 */2 * 1|1h", "2024-01-01T00:30:00Z", true},
+		{"0 0 */2 * 1|1h", "2024-01-03T00:30:00Z", false},
+		{"0 0 */2 * 1|1h", "2024-01-08T00:30:00Z", false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.window+"@"+testCase.time, func(t *testing.T) {
+			window, err := schedule.ParseWindow(testCase.window, nil)
+			if err != nil {
+				t.Fatalf("Error parsing window: %s", err.Error())
+			}
+			now, _ := time.Parse(time.RFC3339, testCase.time)
+			if actual := window.Active(now); actual != testCase.expected {
+				t.Fatalf("Expected the window to be active=%t, but was active=%t", testCase.expected, actual)
+			}
+		})
+	}
+}
+
+func TestInvalidMaintenanceWindows(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"2024-01-06T06:00:00Z/2024-01-06T02:00:00Z",
+		"2024-01-06/2024-01-07",
+		"0 2 * *|4h",
+		"0 24 * * *|4h",
+		"0 2 * * 6|0s",
+		"0 2 * * 6|1000h",
+		"0 2 * * mon-foo|1h",
+		"CRON_TZ=Mars/Olympus_Mons 0 2 * * *|1h",
+		"CRON_TZ=Europe/Paris|1h",
+	} {
+		t.Run(value, func(t *testing.T) {
+			if _, err := schedule.ParseWindow(value, nil); err == nil {
+				t.Fatalf("Expected an error parsing the window '%s'", value)
+			}
+		})
+	}
+}
+
+func TestScheduleTimeZones(t *testing.T) {
+	testCases := []struct {
+		window   string
+		timeZone string
+		time     string
+		expected bool
+	}{
+		// 02:00 in Paris is 01:00 UTC in the winter
+		{"CRON_TZ=Europe/Paris 0 2 * * *|1h", "", "2024-01-06T01:30:00Z", true},
+		{"CRON_TZ=Europe/Paris 0 2 * * *|1h", "", "2024-01-06T02:30:00Z", false},
+		{"0 2 * * *|1h", "Europe/Paris", "2024-01-06T01:30:00Z", true},
+		{"TZ=UTC 0 2 * * *|1h", "Europe/Paris", "2024-01-06T02:30:00Z", true},
+		// The clocks go forward from 02:00 to 03:00 on 2024-03-31, so 02:30 fires at 03:00, 01:00 UTC
+		{"CRON_TZ=Europe/Paris 30 2 * * *|1h", "", "2024-03-31T00:59:00Z", false},
+		{"CRON_TZ=Europe/Paris 30 2 * * *|1h", "", "2024-03-31T01:10:00Z", true},
+		// The clocks go back from 03:00 to 02:00 on 2024-10-27, so 02:30 only fires the first time, 00:30 UTC
+		{"CRON_TZ=Europe/Paris 30 2 * * *|30m", "", "2024-10-27T00:45:00Z", true},
+		{"CRON_TZ=Europe/Paris 30 2 * * *|30m", "", "2024-10-27T01:45:00Z", false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.window+"@"+testCase.time, func(t *testing.T) {
+			location, err := schedule.ParseLocation(testCase.timeZone)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			window, err := schedule.ParseWindow(testCase.window, location)
+			if err != nil {
+				t.Fatalf("Error parsing window: %s", err.Error())
+			}
+			now, _ := time.Parse(time.RFC3339, testCase.time)
+			if actual := window.Active(now); actual != testCase.expected {
+				t.Fatalf("Expected the window to be active=%t, but was active=%t", testCase.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	testCases := []struct {
+		cron     string
+		time     string
+		expected string
+	}{
+		{"0 2 * * 6", "2024-01-01T00:00:00Z", "2024-01-06T02:00:00Z"},
+		{"*/15 * * * *", "2024-01-01T00:15:00Z", "2024-01-01T00:30:00Z"},
+		{"CRON_TZ=Europe/Paris 30 2 * * *", "2024-03-30T12:00:00Z", "2024-03-31T01:00:00Z"},
+		{"CRON_TZ=Europe/Paris 30 2 * * *", "2024-10-27T00:40:00Z", "2024-10-28T01:30:00Z"},
+		{"0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 0 30 2 *", "2024-01-01T00:00:00Z", ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.cron+"@"+testCase.time, func(t *testing.T) {
+			cron, err := schedule.ParseCron(testCase.cron, nil)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			now, _ := time.Parse(time.RFC3339, testCase.time)
+			var expected time.Time
+			if testCase.expected != "" {
+				expected, _ = time.Parse(time.RFC3339, testCase.expected)
+			}
+			if actual := cron.Next(now); !actual.Equal(expected) {
+				t.Fatalf("Expected the cron expression to next fire at %s, but got %s", expected.String(), actual.String())
+			}
+		})
+	}
+}
+
+func TestCronPrevious(t *testing.T) {
+	testCases := []struct {
+		cron     string
+		time     string
+		expected string
+	}{
+		{"0 2 * * 6", "2024-01-10T00:00:00Z", "2024-01-06T02:00:00Z"},
+		{"*/15 * * * *", "2024-01-01T00:15:30Z", "2024-01-01T00:15:00Z"},
+		// 02:30 is skipped when the clocks go forward, so it fires at 03:00, and only fires the first time when they go back
+		{"CRON_TZ=Europe/Paris 30 2 * * *", "2024-03-31T12:00:00Z", "2024-03-31T01:00:00Z"},
+		{"CRON_TZ=Europe/Paris 30 2 * * *", "2024-10-27T02:00:00Z", "2024-10-27T00:30:00Z"},
+		{"0 0 29 2 *", "2028-02-28T00:00:00Z", "2024-02-29T00:00:00Z"},
+		{"0 0 30 2 *", "2024-01-01T00:00:00Z", ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.cron+"@"+testCase.time, func(t *testing.T) {
+			cron, err := schedule.ParseCron(testCase.cron, nil)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			now, _ := time.Parse(time.RFC3339, testCase.time)
+			var expected time.Time
+			if testCase.expected != "" {
+				expected, _ = time.Parse(time.RFC3339, testCase.expected)
+			}
+			if actual := cron.Previous(now); !actual.Equal(expected) {
+				t.Fatalf("Expected the cron expression to have last fired at %s, but got %s", expected.String(), actual.String())
+			}
+		})
+	}
+}
+
+func TestResolveWindows(t *testing.T) {
+	var windows []schedule.Window
+	for _, value := range []string{"2024-01-06T02:00:00Z/2024-01-06T06:00:00Z", "2024-01-06T05:00:00Z/2024-01-06T08:00:00Z", "0 3 * * *|1h"} {
+		window, err := schedule.ParseWindow(value, time.UTC)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		windows = append(windows, window)
+	}
+	testCases := []struct {
+		time          string
+		expected      int
+		expectedUntil string
+	}{
+		{"2024-01-06T01:00:00Z", -1, "2024-01-06T01:00:00Z"},
+		{"2024-01-06T02:30:00Z", 0, "2024-01-06T08:00:00Z"},
+		// The window that started last applies
+		{"2024-01-06T03:30:00Z", 2, "2024-01-06T08:00:00Z"},
+		{"2024-01-06T05:30:00Z", 1, "2024-01-06T08:00:00Z"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.time, func(t *testing.T) {
+			now, _ := time.Parse(time.RFC3339, testCase.time)
+			var expected schedule.Window
+			if testCase.expected >= 0 {
+				expected = windows[testCase.expected]
+			}
+			if actual := schedule.ActiveWindow(windows, now); actual != expected {
+				t.Errorf("Expected the window %v to apply, but got %v", expected, actual)
+			}
+			expectedUntil, _ := time.Parse(time.RFC3339, testCase.expectedUntil)
+			if until := schedule.ActiveUntil(windows, now); !until.Equal(expectedUntil) {
+				t.Errorf("Expected the windows to be active until %s, but got %s", expectedUntil.String(), until.String())
+			}
+		})
+	}
+}
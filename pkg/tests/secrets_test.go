@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/secrets"
+)
+
+func TestKeyVault(t *testing.T) {
+	os.Unsetenv("AZURE_FEDERATED_TOKEN_FILE")
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/identity":
+			if request.Header.Get("Metadata") != "true" || request.URL.Query().Get("resource") != "https://vault.azure.net" || request.URL.Query().Get("client_id") != "clientid" {
+				t.Errorf("Unexpected managed identity token request %s", request.URL.String())
+			}
+			json.NewEncoder(writer).Encode(map[string]string{"access_token": "accesstoken"})
+		case "/secrets/azp-token":
+			if request.Header.Get("Authorization") != "Bearer accesstoken" {
+				writer.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(writer).Encode(map[string]interface{}{"error": map[string]string{"message": "Unauthorized"}})
+				return
+			}
+			json.NewEncoder(writer).Encode(map[string]string{"value": "azdtoken"})
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(writer).Encode(map[string]interface{}{"error": map[string]string{"message": "SecretNotFound"}})
+		}
+	}))
+	defer server.Close()
+
+	keyVault := secrets.NewKeyVault(server.URL+"/", "azp-token", "clientid")
+	keyVault.IdentityEndpoint = server.URL + "/identity"
+	value, err := keyVault.Get()
+	if err != nil {
+		t.Fatalf("Error retrieving the secret: %s", err.Error())
+	} else if value != "azdtoken" {
+		t.Fatalf("Expected the secret azdtoken, got %s", value)
+	}
+
+	missing := secrets.NewKeyVault(server.URL, "missing", "clientid")
+	missing.IdentityEndpoint = server.URL + "/identity"
+	if _, err := secrets.Watch(missing, time.Minute); err == nil {
+		t.Fatal("Expected an error retrieving a missing secret")
+	}
+}
+
+func TestVault(t *testing.T) {
+	logins, renewals := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			var login map[string]string
+			json.NewDecoder(request.Body).Decode(&login)
+			if login["role"] != "azp-agent-autoscaler" || login["jwt"] != "serviceaccounttoken" {
+				writer.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(writer).Encode(map[string][]string{"errors": {"invalid role or JWT"}})
+				return
+			}
+			logins++
+			json.NewEncoder(writer).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "vaulttoken", "lease_duration": 2, "renewable": true}})
+		case "/v1/auth/token/renew-self":
+			renewals++
+			json.NewEncoder(writer).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "vaulttoken", "lease_duration": 2, "renewable": true}})
+		case "/v1/secret/data/azp-agent-autoscaler":
+			if request.Header.Get("X-Vault-Token") != "vaulttoken" {
+				writer.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(writer).Encode(map[string][]string{"errors": {"permission denied"}})
+				return
+			}
+			json.NewEncoder(writer).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]string{"token": "azdtoken"},
+				"metadata": map[string]int{"version": 1},
+			}})
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	jwtFile, err := ioutil.TempFile("", "azp-agent-autoscaler")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(jwtFile.Name())
+	jwtFile.WriteString("serviceaccounttoken\n")
+	jwtFile.Close()
+
+	vault := secrets.NewVault(server.URL, "", "kubernetes", "azp-agent-autoscaler", "secret/data/azp-agent-autoscaler", "token")
+	vault.JWTFile = jwtFile.Name()
+	for i := 0; i < 2; i++ {
+		value, err := vault.Get()
+		if err != nil {
+			t.Fatalf("Error retrieving the secret: %s", err.Error())
+		} else if value != "azdtoken" {
+			t.Fatalf("Expected the secret azdtoken, got %s", value)
+		}
+	}
+	if logins != 1 || renewals != 0 {
+		t.Fatalf("Expected 1 login and no renewals before half of the TTL passed, got %d logins and %d renewals", logins, renewals)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := vault.Get(); err != nil {
+		t.Fatalf("Error retrieving the secret: %s", err.Error())
+	}
+	if logins != 1 || renewals != 1 {
+		t.Fatalf("Expected the Vault token to be renewed, got %d logins and %d renewals", logins, renewals)
+	}
+
+	missingKey := secrets.NewVault(server.URL, "", "kubernetes", "azp-agent-autoscaler", "secret/data/azp-agent-autoscaler", "password")
+	missingKey.JWTFile = jwtFile.Name()
+	if _, err := missingKey.Get(); err == nil {
+		t.Fatal("Expected an error retrieving a missing key")
+	}
+}
@@ -0,0 +1,237 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/azuredevops"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/store"
+)
+
+func TestFileStore(t *testing.T) {
+	fileStore := store.NewFile(t.TempDir(), "azp-agent-autoscaler-state")
+	if data, err := fileStore.Load(); err != nil {
+		t.Fatal(err.Error())
+	} else if data != nil {
+		t.Errorf("Expected nothing to be loaded before the file is saved, but got %v", data)
+	}
+
+	saved := map[string]string{"default.statefulset.azp-agent": `{"paused":true}`}
+	if err := fileStore.Save(saved); err != nil {
+		t.Fatal(err.Error())
+	}
+	if data, err := fileStore.Load(); err != nil {
+		t.Fatal(err.Error())
+	} else if data["default.statefulset.azp-agent"] != saved["default.statefulset.azp-agent"] {
+		t.Errorf("Expected the saved data to be loaded, but got %v", data)
+	}
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	args := args.Args{
+		Min:       1,
+		Max:       10,
+		Rate:      10 * time.Second,
+		ScaleDown: args.ScaleDownArgs{Max: 1, Delay: time.Hour},
+		RateLimit: args.RateLimitArgs{MaxScales: 5, Window: time.Hour},
+		State:     args.StateArgs{ConfigMapName: "azp-agent-autoscaler-state"},
+		Store:     args.StoreArgs{Type: args.StoreFile, Path: t.TempDir()},
+		Kubernetes: args.KubernetesArgs{
+			Type:      "StatefulSet",
+			Name:      "azp-agent",
+			Namespace: "restart",
+		},
+	}
+	k8sClient := mockK8sClient{Counts: &mockK8sClientCounts{NumPods: 1}}
+	workload := k8sClient.GetWorkloadNoError(args.Kubernetes)
+	stateStore := scaling.StateStore(k8sClient, args)
+	autoscale := func(azdClient mockAZDClient) *scaling.Decision {
+		decision, err := scaling.AutoscaleTarget(azuredevops.NewBackend(azdClient), kubernetes.MakeFromClient(k8sClient), scaling.Target{Workload: workload, AgentPoolID: agentPoolID}, args)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return decision
+	}
+
+	// Scale up for the queued jobs, then down once they're done, which starts the scale down delay
+	autoscale(mockAZDClient{NumPools: 5, NumFreeAgents: 1, NumQueuedJobs: 5})
+	autoscale(mockAZDClient{NumPools: 5, NumFreeAgents: 1})
+	if k8sClient.Counts.NumPods != 5 {
+		t.Fatalf("Expected to scale up to 6 pods and down to 5, but got %d", k8sClient.Counts.NumPods)
+	}
+	if err := scaling.SaveState(stateStore); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Without the saved state, the scale down delay is forgotten
+	scaling.ResetState()
+	decision, err := scaling.Plan(azuredevops.NewBackend(mockAZDClient{NumPools: 5, NumFreeAgents: 1}), agentPoolID, kubernetes.MakeFromClient(k8sClient), workload, args)
+	if err != nil {
+		t.Fatal(err.Error())
+	} else if decision.DesiredReplicas != 4 {
+		t.Fatalf("Expected a scale down to 4 pods without the state, but got %d (%s)", decision.DesiredReplicas, decision.Reason)
+	}
+
+	// With the loaded state, the scale down delay and the recent scales of the rate limit survive the restart
+	scaling.ResetState()
+	if err := scaling.LoadState(stateStore); err != nil {
+		t.Fatal(err.Error())
+	}
+	if recentScales := scaling.GetState(workload).RecentScales; len(recentScales) != 2 {
+		t.Errorf("Expected the scale up and the scale down in the loaded recent scales, but got %v", recentScales)
+	}
+	decision = autoscale(mockAZDClient{NumPools: 5, NumFreeAgents: 1})
+	if k8sClient.Counts.NumPods != 5 || !decision.HasSuppressor(scaling.SuppressorCooldown) {
+		t.Errorf("Expected the loaded scale down delay to keep 5 pods, but got %d (%v)", k8sClient.Counts.NumPods, decision.SuppressorNames())
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server := newMockRedisServer(t, "secret")
+	defer server.Close()
+	redisArgs := args.RedisArgs{Address: server.Addr(), Password: "secret", DB: 2, KeyPrefix: "azp-agent-autoscaler:"}
+
+	redisStore := store.NewRedis(redisArgs, "history")
+	if data, err := redisStore.Load(); err != nil {
+		t.Fatal(err.Error())
+	} else if data != nil {
+		t.Errorf("Expected nothing to be loaded before the key is set, but got %v", data)
+	}
+	if err := redisStore.Save(map[string]string{"history.json": "[]"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if data, err := redisStore.Load(); err != nil {
+		t.Fatal(err.Error())
+	} else if data["history.json"] != "[]" {
+		t.Errorf("Expected the saved data to be loaded, but got %v", data)
+	}
+	if _, saved := server.Values("2/azp-agent-autoscaler:history"); !saved {
+		t.Error("Expected the data to be saved to the prefixed key of the selected database")
+	}
+
+	redisArgs.Password = "wrong"
+	if _, err := store.NewRedis(redisArgs, "history").Load(); err == nil {
+		t.Error("Expected an error when the password is rejected")
+	}
+}
+
+// mockRedisServer is a Redis server that supports AUTH, SELECT, GET and SET
+type mockRedisServer struct {
+	listener net.Listener
+	password string
+
+	lock   sync.Mutex
+	values map[string]string
+}
+
+func newMockRedisServer(t *testing.T, password string) *mockRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server := &mockRedisServer{listener: listener, password: password, values: make(map[string]string)}
+	go server.serve()
+	return server
+}
+
+func (s *mockRedisServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *mockRedisServer) Close() {
+	s.listener.Close()
+}
+
+// Values returns the value of a key, as <db>/<key>
+func (s *mockRedisServer) Values(key string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, exists := s.values[key]
+	return value, exists
+}
+
+func (s *mockRedisServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *mockRedisServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated, db := false, "0"
+	for {
+		command, err := readMockRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		reply := "+OK\r\n"
+		switch strings.ToUpper(command[0]) {
+		case "AUTH":
+			if authenticated = command[1] == s.password; !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case "SELECT":
+			db = command[1]
+		case "GET", "SET":
+			if !authenticated {
+				reply = "-NOAUTH Authentication required.\r\n"
+				break
+			}
+			s.lock.Lock()
+			if strings.ToUpper(command[0]) == "SET" {
+				s.values[db+"/"+command[1]] = command[2]
+			} else if value, exists := s.values[db+"/"+command[1]]; exists {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+			s.lock.Unlock()
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readMockRedisCommand reads a command sent as a RESP array of bulk strings
+func readMockRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+	if err != nil {
+		return nil, err
+	}
+	command := make([]string, count)
+	for i := range command {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		command[i] = string(value[:length])
+	}
+	return command, nil
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/tracing"
+)
+
+func TestTracingExport(t *testing.T) {
+	requests := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/v1/traces" {
+			t.Errorf("Expected the traces to be sent to /v1/traces, but was %s", request.URL.Path)
+		}
+		if request.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("Expected the X-Api-Key header to be sent")
+		}
+		var body map[string]interface{}
+		json.NewDecoder(request.Body).Decode(&body)
+		requests <- body
+	}))
+	defer server.Close()
+
+	tracing.Init(server.URL, map[string]string{"X-Api-Key": "secret"})
+	root := tracing.StartTrace("autoscale")
+	child := root.StartChild("kubernetes.Scale")
+	child.SetAttribute("replicas", int32(3))
+	child.SetError(errors.New("conflict"))
+	child.End()
+	root.End()
+
+	select {
+	case body := <-requests:
+		spans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+		if len(spans) != 2 {
+			t.Fatalf("Expected 2 spans, but got %d", len(spans))
+		}
+		rootSpan, childSpan := spans[0].(map[string]interface{}), spans[1].(map[string]interface{})
+		if childSpan["parentSpanId"] != rootSpan["spanId"] || childSpan["traceId"] != rootSpan["traceId"] {
+			t.Fatalf("Expected %v to be a child of %v", childSpan, rootSpan)
+		}
+		if childSpan["status"].(map[string]interface{})["message"] != "conflict" {
+			t.Fatalf("Expected the child span to have the error status, but was %v", childSpan["status"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The trace was not exported")
+	}
+}
@@ -0,0 +1,201 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/logging"
+)
+
+const serviceName = "azp-agent-autoscaler"
+
+var logger = logging.Component("tracing")
+
+// exporter is nil unless tracing is enabled
+var exporter *otlpExporter
+
+// otlpExporter sends traces to an OpenTelemetry collector with OTLP over HTTP, encoded as JSON
+type otlpExporter struct {
+	url        string
+	headers    map[string]string
+	httpClient *http.Client
+	// pending tracks the traces being exported, so they can be flushed before the process exits
+	pending sync.WaitGroup
+}
+
+// Init enables tracing, exporting traces to the OTLP HTTP endpoint, ex: http://otel-collector:4318
+func Init(endpoint string, headers map[string]string) {
+	exporter = &otlpExporter{
+		url:        strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers:    headers,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Flush waits until the ended traces are exported or the timeout passes.
+// This should be used before the process exits.
+func Flush(timeout time.Duration) {
+	if exporter == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		exporter.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warnf("Timed out exporting the traces after %s", timeout.String())
+	}
+}
+
+func (e *otlpExporter) export(t *trace) {
+	defer e.pending.Done()
+	t.lock.Lock()
+	spans := make([]otlpSpan, 0, len(t.spans))
+	for _, span := range t.spans {
+		spans = append(spans, span.toOTLP(t.id))
+	}
+	t.lock.Unlock()
+
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpAttribute{toOTLPAttribute("service.name", serviceName)}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: serviceName},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		logger.Errorf("Error serializing trace %s: %s", t.id, err.Error())
+		return
+	}
+
+	request, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		logger.Errorf("Error exporting trace %s: %s", t.id, err.Error())
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := e.httpClient.Do(request)
+	if err != nil {
+		logger.Errorf("Error exporting trace %s: %s", t.id, err.Error())
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		logger.Errorf("Error exporting trace %s: %s returned HTTP %d", t.id, e.url, response.StatusCode)
+		return
+	}
+	logger.Tracef("Exported trace %s with %d spans", t.id, len(spans))
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+func (s *Span) toOTLP(traceID string) otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	end := s.end
+	if end.IsZero() {
+		// The span was never ended, ex: due to an early return
+		end = time.Now()
+	}
+	span := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            s.id,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusOK},
+	}
+	for key, value := range s.attributes {
+		span.Attributes = append(span.Attributes, toOTLPAttribute(key, value))
+	}
+	if s.errorMessage != "" {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: s.errorMessage}
+	}
+	return span
+}
+
+func toOTLPAttribute(key string, value interface{}) otlpAttribute {
+	var otlpValue map[string]interface{}
+	switch v := value.(type) {
+	case bool:
+		otlpValue = map[string]interface{}{"boolValue": v}
+	case int:
+		otlpValue = map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int32:
+		otlpValue = map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		otlpValue = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case uint64:
+		otlpValue = map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+	case float64:
+		otlpValue = map[string]interface{}{"doubleValue": v}
+	default:
+		otlpValue = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpAttribute{Key: key, Value: otlpValue}
+}
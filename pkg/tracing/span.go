@@ -0,0 +1,99 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Span is a timed operation in a trace. All methods are safe to call on a nil Span, which is returned when tracing is disabled.
+type Span struct {
+	trace        *trace
+	id           string
+	parentID     string
+	name         string
+	start        time.Time
+	end          time.Time
+	attributes   map[string]interface{}
+	errorMessage string
+	lock         sync.Mutex
+}
+
+// trace holds the spans of a trace until the root span ends
+type trace struct {
+	id    string
+	spans []*Span
+	lock  sync.Mutex
+}
+
+// StartTrace starts the root span of a new trace, or returns nil if tracing is disabled
+func StartTrace(name string) *Span {
+	if exporter == nil {
+		return nil
+	}
+	return newSpan(&trace{id: randomID(16)}, "", name)
+}
+
+func newSpan(t *trace, parentID string, name string) *Span {
+	span := &Span{
+		trace:      t,
+		id:         randomID(8),
+		parentID:   parentID,
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	t.lock.Lock()
+	t.spans = append(t.spans, span)
+	t.lock.Unlock()
+	return span
+}
+
+// StartChild starts a span that is a child of this span
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return newSpan(s.trace, s.id, name)
+}
+
+// SetAttribute sets an attribute of the span. The value should be a string, bool, integer or float.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errorMessage = err.Error()
+}
+
+// End ends the span. Ending the root span exports the trace.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.end = time.Now()
+	s.lock.Unlock()
+	if s.parentID == "" {
+		exporter.pending.Add(1)
+		go exporter.export(s.trace)
+	}
+}
+
+func randomID(numBytes int) string {
+	id := make([]byte, numBytes)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,45 @@
+// Package version is the version the autoscaler was built as, set at build time with
+// -ldflags "-X github.com/ogmaresca/azp-agent-autoscaler/pkg/version.Version=..."
+package version
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Version, Commit and BuildDate are set at build time with -ldflags
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+var buildInfoGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "azp_agent_autoscaler_build_info",
+	Help: "Always 1, labeled by the version, commit and build date of the autoscaler and the Go version it was built with",
+}, []string{"version", "commit", "build_date", "go_version"})
+
+func init() {
+	info := Get()
+	buildInfoGauge.WithLabelValues(info.Version, info.Commit, info.BuildDate, info.GoVersion).Set(1)
+}
+
+// Info is the version the autoscaler was built as
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the version the autoscaler was built as
+func Get() Info {
+	return Info{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
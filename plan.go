@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// plan prints the current state of the agents and the scaling decision of each workload, then exits
+func plan(args args.Args) {
+	backend, k8sClient, targets, err := autoscaler.Initialize(&args)
+	if err != nil {
+		exitWith(args.Output, errorResult(err))
+	}
+	// The decisions are planned from the persisted state of the autoscaler, ex: its cooldowns and rate limit
+	if args.State.ConfigMapName != "" {
+		if err := scaling.LoadState(scaling.StateStore(k8sClient.Sync(), args)); err != nil {
+			exitWith(args.Output, errorResult(err))
+		}
+	}
+
+	var decisions []scaling.DecisionRecord
+	for i, target := range targets {
+		targetArgs := target.ArgsOr(args)
+		decision, err := scaling.Plan(target.BackendOr(backend), target.AgentPoolID, k8sClient, target.Workload, targetArgs)
+		if err != nil {
+			r := errorResult(fmt.Errorf("Error planning the scaling of %s: %w", target.Workload.FriendlyName, err))
+			r.Decisions = decisions
+			exitWith(args.Output, r)
+		}
+		decisions = append(decisions, scaling.NewDecisionRecord(decision, target.AgentPoolID, target.Workload, targetArgs, nil))
+
+		if isText(args.Output) {
+			if i > 0 {
+				fmt.Println()
+			}
+			printPlan(target, decision, len(targets) > 1)
+		}
+	}
+	exitWith(args.Output, result{ExitCode: exitOK, Decisions: decisions})
+}
+
+// printPlan prints the current state of the agents and the scaling decision of a workload
+func printPlan(target scaling.Target, decision *scaling.Decision, showPriority bool) {
+	deployment, agentPoolID := target.Workload, target.AgentPoolID
+
+	numBusyAgents := 0
+	agentStatuses := make(map[string]int)
+	for _, agent := range decision.Agents {
+		agentStatuses[strings.ToLower(agent.Status)]++
+		if agent.Busy {
+			numBusyAgents++
+		}
+	}
+	var agentStatusSummaries []string
+	for status, count := range agentStatuses {
+		agentStatusSummaries = append(agentStatusSummaries, fmt.Sprintf("%d %s", count, status))
+	}
+	sort.Strings(agentStatusSummaries)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "Workload:\t%s (namespace %s)\n", deployment.FriendlyName, deployment.Namespace)
+	if showPriority {
+		fmt.Fprintf(writer, "Priority:\t%d\n", target.Priority)
+	}
+	fmt.Fprintf(writer, "Agent pool ID:\t%d\n", agentPoolID)
+	if priorityClass := deployment.PodTemplateSpec.Spec.PriorityClassName; priorityClass != "" {
+		fmt.Fprintf(writer, "Priority class:\t%s\n", priorityClass)
+	}
+	fmt.Fprintf(writer, "Queued jobs:\t%d (demand of %d agents)\n", decision.NumQueuedJobs, decision.QueueDemand)
+	if decision.SLO != nil {
+		fmt.Fprintf(writer, "Job arrival rate:\t%.2f per minute\n", decision.SLO.ArrivalRate)
+		fmt.Fprintf(writer, "Average job duration:\t%s\n", decision.SLO.AverageDuration.String())
+		fmt.Fprintf(writer, "Agents needed for the SLO:\t%d\n", decision.SLO.RequiredAgents)
+	}
+	fmt.Fprintf(writer, "Registered agents:\t%d (%s)\n", len(decision.Agents), strings.Join(agentStatusSummaries, ", "))
+	fmt.Fprintf(writer, "Busy agents:\t%d (%d in this workload)\n", numBusyAgents, decision.NumActiveAgents)
+	if len(decision.AgentIdleTimes) > 0 {
+		var idleTimes []string
+		for podName, idleTime := range decision.AgentIdleTimes {
+			idleTimes = append(idleTimes, fmt.Sprintf("%s for %s", podName, idleTime.Round(time.Second).String()))
+		}
+		sort.Strings(idleTimes)
+		fmt.Fprintf(writer, "Idle agents:\t%d (%s)\n", decision.NumIdleAgents, strings.Join(idleTimes, ", "))
+	}
+	fmt.Fprintf(writer, "Pods:\t%d running, %d pending (%d unschedulable), %d failed, %d stale\n", decision.NumRunningPods, decision.NumPendingPods, decision.NumUnschedulablePods, decision.NumFailedPods, decision.NumStalePods)
+	fmt.Fprintf(writer, "Current replicas:\t%d\n", decision.NumPods)
+	fmt.Fprintf(writer, "Desired replicas:\t%d\n", decision.DesiredReplicas)
+	fmt.Fprintf(writer, "Reason:\t%s\n", decision.Reason)
+	if decision.Rollout != "" {
+		fmt.Fprintf(writer, "Rollout:\t%s\n", decision.Rollout)
+	}
+	if decision.Quota != nil {
+		fmt.Fprintf(writer, "Quota:\t%s\n", decision.Quota.String())
+	}
+	for _, suppressor := range decision.Suppressors {
+		fmt.Fprintf(writer, "Limited by:\t%s\n", suppressor)
+	}
+	writer.Flush()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+// ConfigMap volumes are updated in place, so a change is detected without a SIGHUP.
+const configPollInterval = 10 * time.Second
+
+// watchConfig reloads the config file on SIGHUP or when its contents change, and returns a channel of the new arguments.
+// If the new config is invalid, the error is logged and the current config is kept.
+// There is nothing to reload without a config file, so the channel is nil if path is empty.
+func watchConfig(path string) <-chan args.Args {
+	if path == "" {
+		return nil
+	}
+	reloads := make(chan args.Args, 1)
+	go watchConfigFile(path, reloads)
+	return reloads
+}
+
+// watchConfigFile sends the arguments to reloads every time the config file is reloaded
+func watchConfigFile(path string, reloads chan<- args.Args) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastContents, _ := ioutil.ReadFile(path)
+	for {
+		select {
+		case <-signals:
+			logger.Infof("Received SIGHUP, reloading %s", path)
+		case <-ticker.C:
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				logger.Warnf("Error reading %s: %s", path, err.Error())
+				continue
+			}
+			if bytes.Equal(contents, lastContents) {
+				continue
+			}
+			logger.Infof("%s changed, reloading it", path)
+		}
+		lastContents, _ = ioutil.ReadFile(path)
+
+		reloaded, err := args.ReloadConfig()
+		if err != nil {
+			logger.Errorf("Error reloading the config, the current config is kept: %s", err.Error())
+			continue
+		}
+		reloads <- reloaded
+		scaling.Reconcile()
+	}
+}
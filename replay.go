@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scaling"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scenario"
+)
+
+// replay decides the replicas of the snapshots recorded with --record-dir in the files given after the flags with the
+// scaling policy of the config file and arguments, without connecting to anything, then exits. It prints how the
+// decisions of the policy differ from the recorded decisions, so thresholds can be tuned against real traffic.
+func replay() {
+	if err := args.LoadConfig(); err != nil {
+		exitWithConfigError(err)
+	}
+	if err := args.ValidateArgs(); err != nil {
+		exitWithConfigError(err)
+	}
+	policy := args.ArgsFromFlags()
+	if flag.NArg() == 0 {
+		exitWith(policy.Output, result{ExitCode: exitConfigError, Error: "replay requires one or more recording files, ex: azp-agent-autoscaler replay --config=config.yaml recordings/agents.statefulset.azp-agent.jsonl"})
+	}
+
+	var recordings []scaling.Recording
+	for _, path := range flag.Args() {
+		loaded, err := scaling.ReadRecordings(path)
+		if err != nil {
+			exitWith(policy.Output, result{ExitCode: exitConfigError, Error: err.Error()})
+		}
+		recordings = append(recordings, loaded...)
+	}
+	replayed := scenario.Replay(recordings, policy)
+	summaries := scenario.SummarizeReplay(replayed)
+	if isText(policy.Output) {
+		printReplay(replayed, summaries)
+	}
+	exitWith(policy.Output, result{ExitCode: exitOK, Replays: summaries})
+}
+
+// printReplay prints the decisions the policy changed, then the summary of each workload
+func printReplay(replayed []scenario.Replayed, summaries []scenario.ReplaySummary) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tWORKLOAD\tPODS\tRECORDED\tREPLAYED\tREASON")
+	for _, r := range replayed {
+		if !r.Changed() {
+			continue
+		}
+		workload := r.Recording.Snapshot.Workload
+		fmt.Fprintf(writer, "%s\t%s/%s\t%d\t%d\t%d\t%s\n", r.Recording.Snapshot.Time.Format(time.RFC3339), workload.Namespace, workload.FriendlyName, r.Decision.NumPods, r.Recording.DesiredReplicas, r.Decision.DesiredReplicas, r.Decision.Reason)
+	}
+	writer.Flush()
+	fmt.Println()
+
+	writer = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "WORKLOAD\tSNAPSHOTS\tCHANGED\tAVG RECORDED\tAVG REPLAYED\tRECORDED SCALE UPS\tREPLAYED SCALE UPS")
+	for _, s := range summaries {
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%.1f\t%.1f\t%d\t%d\n", s.Workload, s.Snapshots, s.Changed, s.RecordedReplicas, s.ReplayedReplicas, s.RecordedScaleUps, s.ReplayedScaleUps)
+	}
+	writer.Flush()
+}
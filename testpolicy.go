@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/scenario"
+)
+
+// testPolicy runs the scenarios of the files given after the flags against the scaling policy of the config file and
+// arguments, without connecting to anything, then exits. It exits with a non-zero status if a scenario didn't make the
+// expected decision, so a policy change can be verified in CI before it's rolled out.
+func testPolicy() {
+	if err := args.LoadConfig(); err != nil {
+		exitWithConfigError(err)
+	}
+	if err := args.ValidateArgs(); err != nil {
+		exitWithConfigError(err)
+	}
+	policy := args.ArgsFromFlags()
+	if flag.NArg() == 0 {
+		exitWith(policy.Output, result{ExitCode: exitConfigError, Error: "test-policy requires one or more scenario files, ex: azp-agent-autoscaler test-policy --config=config.yaml scenarios.yaml"})
+	}
+
+	var scenarios []checkResult
+	failed := 0
+	for _, path := range flag.Args() {
+		loaded, err := scenario.Load(path)
+		if err != nil {
+			exitWith(policy.Output, result{ExitCode: exitConfigError, Error: err.Error()})
+		}
+		for _, s := range loaded {
+			r := scenario.Run(s, policy)
+			if r.Passed() {
+				scenarios = append(scenarios, checkResult{Name: s.Name, Status: checkPass, Detail: fmt.Sprintf("%d replicas, %s", r.Decision.DesiredReplicas, r.Decision.Reason)})
+			} else {
+				failed++
+				scenarios = append(scenarios, checkResult{Name: s.Name, Status: checkFail, Detail: strings.Join(r.Failures, ", ")})
+			}
+		}
+	}
+
+	r := result{ExitCode: exitOK, Scenarios: scenarios}
+	if failed > 0 {
+		r.ExitCode = exitScenarioFailed
+		r.Error = fmt.Sprintf("%d of %d scenarios failed", failed, len(scenarios))
+	}
+	if isText(policy.Output) {
+		printScenarios(scenarios, failed)
+	}
+	exitWith(policy.Output, r)
+}
+
+// printScenarios prints whether each scenario made the expected decision. The number of failed scenarios is printed
+// as the error.
+func printScenarios(scenarios []checkResult, failed int) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, s := range scenarios {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", map[string]string{checkPass: "PASS", checkFail: "FAIL"}[s.Status], s.Name, s.Detail)
+	}
+	writer.Flush()
+	if failed == 0 {
+		fmt.Printf("\nAll %d scenarios passed\n", len(scenarios))
+	} else {
+		fmt.Println()
+	}
+}
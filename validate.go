@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/args"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/autoscaler"
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/kubernetes"
+)
+
+// validateConfig reports whether the config file and arguments are valid and, with --probe,
+// whether Azure Devops and Kubernetes are reachable with the required permissions, then exits.
+// It exits with a non-zero status if anything failed, so it can be run in CI before a rollout.
+func validateConfig() {
+	if err := args.LoadConfig(); err != nil {
+		exitWithConfigError(err)
+	}
+	if err := args.ValidateArgs(); err != nil {
+		exitWithConfigError(err)
+	}
+	args := args.ArgsFromFlags()
+	text := isText(args.Output)
+	if text {
+		fmt.Println("The config is valid")
+	}
+	if !args.Probe {
+		exitWith(args.Output, result{ExitCode: exitOK})
+	}
+
+	k8sClient, err := kubernetes.MakeClient(args.Kubernetes.Timeout)
+	if err != nil {
+		exitWith(args.Output, errorResult(fmt.Errorf("Error creating the Kubernetes client: %w", err)))
+	}
+
+	var r result
+	var missingPermissions kubernetes.MissingPermissionsError
+	if err := kubernetes.VerifyPermissions(k8sClient.Sync(), args); errors.As(err, &missingPermissions) {
+		for _, permission := range missingPermissions.Permissions {
+			r.MissingPermissions = append(r.MissingPermissions, permission.String())
+			if text {
+				fmt.Fprintf(os.Stderr, "Missing RBAC permission: %s\n", permission)
+			}
+		}
+		r.ExitCode = exitAuthError
+		r.Error = fmt.Sprintf("The service account is missing %d RBAC permissions", len(r.MissingPermissions))
+		exitWith(args.Output, r)
+	} else if err != nil {
+		exitWith(args.Output, errorResult(err))
+	}
+	if text {
+		fmt.Println("The RBAC permissions are granted")
+	}
+
+	backend, err := autoscaler.MakeBackend(args, k8sClient)
+	if err != nil {
+		exitWith(args.Output, errorResult(err))
+	}
+	targets, err := autoscaler.InitializeTargets(backend, k8sClient, args)
+	if err != nil {
+		exitWith(args.Output, errorResult(err))
+	}
+	for _, target := range targets {
+		r.Workloads = append(r.Workloads, workloadResult{
+			Namespace:    target.Workload.Namespace,
+			Workload:     target.Workload.FriendlyName,
+			AgentPoolID:  target.AgentPoolID,
+			Priority:     target.Priority,
+			Organization: target.Organization,
+		})
+		if text && target.Organization != "" {
+			fmt.Printf("Found %s in namespace %s with agent pool ID %d of organization %s\n", target.Workload.FriendlyName, target.Workload.Namespace, target.AgentPoolID, target.Organization)
+		} else if text {
+			fmt.Printf("Found %s in namespace %s with agent pool ID %d\n", target.Workload.FriendlyName, target.Workload.Namespace, target.AgentPoolID)
+		}
+	}
+	exitWith(args.Output, r)
+}
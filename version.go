@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ogmaresca/azp-agent-autoscaler/pkg/version"
+)
+
+// printVersion prints the build version, commit and date, then exits
+func printVersion() {
+	fmt.Printf("azp-agent-autoscaler %s\n", version.Get())
+}